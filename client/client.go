@@ -0,0 +1,245 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+// Package client provides a typed Go client of the grpc service of CeresMeta for the external tools.
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// identityKey is the metadata key of the identity of the client, which must be the same as the one of the grpc
+// service.
+const identityKey = "ceresdb-client-identity"
+
+// Table is the table allocated by the CeresMeta.
+type Table struct {
+	SchemaID   uint32
+	SchemaName string
+	ID         uint64
+	Name       string
+	ShardID    uint32
+}
+
+// Client sends the requests to one of the endpoints of the CeresMeta cluster, and switches to the next endpoint once
+// the current one is unreachable or unavailable. The server never forwards the requests to the leader, and the client
+// doesn't look for the leader either, so the requests are served by whichever endpoint is current. It is safe for
+// concurrent use.
+type Client struct {
+	endpoints []string
+	opts      options
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	current int
+	conns   map[string]*grpc.ClientConn
+	closed  bool
+}
+
+// New creates a client of the endpoints, which are the addresses of the grpc service of the CeresMeta servers. The
+// endpoints are connected lazily.
+func New(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Client{
+		endpoints: append([]string(nil), endpoints...),
+		opts:      o,
+		conns:     make(map[string]*grpc.ClientConn, len(endpoints)),
+	}, nil
+}
+
+// AllocSchemaID allocates the id of the schema, and the schema is created if it doesn't exist.
+func (c *Client) AllocSchemaID(ctx context.Context, clusterName, name string) (uint32, error) {
+	var resp *metapb.AllocSchemaIdResponse
+	err := c.call(ctx, true, func(ctx context.Context, cli metapb.CeresmetaRpcServiceClient) (*commonpb.ResponseHeader, error) {
+		var err error
+		resp, err = cli.AllocSchemaId(ctx, &metapb.AllocSchemaIdRequest{Header: requestHeader(clusterName), Name: name})
+		return resp.GetHeader(), err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetId(), nil
+}
+
+// AllocTableID allocates the id of the table, and the table is created if it doesn't exist.
+func (c *Client) AllocTableID(ctx context.Context, clusterName, schemaName, name string) (Table, error) {
+	var resp *metapb.AllocTableIdResponse
+	err := c.call(ctx, true, func(ctx context.Context, cli metapb.CeresmetaRpcServiceClient) (*commonpb.ResponseHeader, error) {
+		var err error
+		resp, err = cli.AllocTableId(ctx, &metapb.AllocTableIdRequest{
+			Header:     requestHeader(clusterName),
+			SchemaName: schemaName,
+			Name:       name,
+		})
+		return resp.GetHeader(), err
+	})
+	if err != nil {
+		return Table{}, err
+	}
+	return Table{
+		SchemaID:   resp.GetSchemaId(),
+		SchemaName: resp.GetSchemaName(),
+		ID:         resp.GetId(),
+		Name:       resp.GetName(),
+		ShardID:    resp.GetShardId(),
+	}, nil
+}
+
+// DropTable drops the table. The drop is not idempotent, so it is only retried if the endpoint is unreachable before
+// the request is sent, and the other failures are returned for the caller to check the table before retrying.
+func (c *Client) DropTable(ctx context.Context, clusterName, schemaName, name string) error {
+	return c.call(ctx, false, func(ctx context.Context, cli metapb.CeresmetaRpcServiceClient) (*commonpb.ResponseHeader, error) {
+		resp, err := cli.DropTable(ctx, &metapb.DropTableRequest{
+			Header:     requestHeader(clusterName),
+			SchemaName: schemaName,
+			Name:       name,
+		})
+		return resp.GetHeader(), err
+	})
+}
+
+// Close closes the connections to the endpoints.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	var firstErr error
+	for endpoint, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.conns, endpoint)
+	}
+	return firstErr
+}
+
+// call sends the request by the send and retries it on the next endpoint if the error is retryable. The request which
+// is not idempotent is only retried if it fails to connect, because it may have been executed by the server otherwise.
+// The error in the response header is returned as a CodeError.
+func (c *Client) call(ctx context.Context, idempotent bool, send func(context.Context, metapb.CeresmetaRpcServiceClient) (*commonpb.ResponseHeader, error)) error {
+	if c.opts.identity != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, identityKey, c.opts.identity)
+	}
+	var lastErr error
+	for i := 0; i <= c.opts.maxRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(c.opts.retryInterval):
+			case <-ctx.Done():
+				return ErrUnavailable.WithCausef("last err:%v, ctx err:%v", lastErr, ctx.Err())
+			}
+		}
+
+		endpoint, conn, err := c.getConn(ctx)
+		if err != nil {
+			if err == ErrClientClosed {
+				return err
+			}
+			lastErr = err
+			c.next(endpoint)
+			continue
+		}
+
+		header, err := send(ctx, metapb.NewCeresmetaRpcServiceClient(conn))
+		switch {
+		case err != nil:
+			if !idempotent || !isRetryableStatus(ctx, err) {
+				return err
+			}
+			lastErr = err
+		case header == nil:
+			return ErrEmptyResponse.WithCausef("endpoint:%s", endpoint)
+		case header.GetCode() == uint32(coderr.Ok):
+			return nil
+		case !idempotent || coderr.Code(header.GetCode()) != coderr.ServiceUnavailable:
+			return responseError(header.GetCode(), header.GetError())
+		default:
+			lastErr = responseError(header.GetCode(), header.GetError())
+		}
+		c.next(endpoint)
+	}
+	return ErrUnavailable.WithCausef("retries:%d, last err:%v", c.opts.maxRetries, lastErr)
+}
+
+// getConn returns the connection to the current endpoint, which is dialed if not connected yet.
+func (c *Client) getConn(ctx context.Context) (string, *grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return "", nil, ErrClientClosed
+	}
+	endpoint := c.endpoints[c.current]
+	if conn, ok := c.conns[endpoint]; ok {
+		return endpoint, conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if c.opts.tlsConfig != nil {
+		creds = credentials.NewTLS(c.opts.tlsConfig)
+	}
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithBlock()}
+	if c.opts.perRPCCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(c.opts.perRPCCreds))
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, c.opts.dialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, endpoint, dialOpts...)
+	if err != nil {
+		return endpoint, nil, ErrDial.WithCausef("endpoint:%s, err:%v", endpoint, err)
+	}
+	c.conns[endpoint] = conn
+	return endpoint, conn, nil
+}
+
+// next switches to the endpoint after the failed one, and the connection to the failed one is closed so that it is
+// dialed again the next time. It does nothing if another request has switched already.
+func (c *Client) next(failed string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.endpoints[c.current] != failed {
+		return
+	}
+	if conn, ok := c.conns[failed]; ok {
+		_ = conn.Close()
+		delete(c.conns, failed)
+	}
+	c.current = (c.current + 1) % len(c.endpoints)
+}
+
+// isRetryableStatus returns true if the endpoint is unreachable, or the connection is closed by a concurrent request
+// switching the endpoint.
+func isRetryableStatus(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.Canceled:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
+
+func requestHeader(clusterName string) *metapb.RequestHeader {
+	return &metapb.RequestHeader{ClusterName: clusterName}
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+const testTimeout = time.Second * 10
+
+// mockService responds the header with the code to all the requests, and counts the requests.
+type mockService struct {
+	metapb.UnimplementedCeresmetaRpcServiceServer
+
+	mu       sync.Mutex
+	code     coderr.Code
+	requests int
+}
+
+func (m *mockService) header() *commonpb.ResponseHeader {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests++
+	if m.code == coderr.Ok {
+		return &commonpb.ResponseHeader{Code: uint32(coderr.Ok)}
+	}
+	return &commonpb.ResponseHeader{Code: uint32(m.code), Error: "injected"}
+}
+
+func (m *mockService) AllocSchemaId(_ context.Context, req *metapb.AllocSchemaIdRequest) (*metapb.AllocSchemaIdResponse, error) { //nolint:revive,stylecheck
+	return &metapb.AllocSchemaIdResponse{Header: m.header(), Name: req.GetName(), Id: 1}, nil
+}
+
+func (m *mockService) AllocTableId(_ context.Context, req *metapb.AllocTableIdRequest) (*metapb.AllocTableIdResponse, error) { //nolint:revive,stylecheck
+	return &metapb.AllocTableIdResponse{
+		Header:     m.header(),
+		SchemaName: req.GetSchemaName(),
+		Name:       req.GetName(),
+		ShardId:    2,
+		SchemaId:   1,
+		Id:         3,
+	}, nil
+}
+
+func (m *mockService) DropTable(context.Context, *metapb.DropTableRequest) (*metapb.DropTableResponse, error) {
+	return &metapb.DropTableResponse{Header: m.header()}, nil
+}
+
+func (m *mockService) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.requests
+}
+
+func startMockService(t *testing.T, svc *mockService) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	metapb.RegisterCeresmetaRpcServiceServer(srv, svc)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// unreachableEndpoint returns an address nothing listens on.
+func unreachableEndpoint(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	return addr
+}
+
+func TestClientFailover(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	unavailable := &mockService{code: coderr.ServiceUnavailable}
+	healthy := &mockService{}
+	endpoints := []string{unreachableEndpoint(t), startMockService(t, unavailable), startMockService(t, healthy)}
+	cli, err := New(endpoints, WithDialTimeout(200*time.Millisecond), WithRetry(3, 10*time.Millisecond))
+	re.NoError(err)
+	defer cli.Close()
+
+	// The request skips the unreachable endpoint and the unavailable one.
+	schemaID, err := cli.AllocSchemaID(ctx, "cluster", "public")
+	re.NoError(err)
+	re.Equal(uint32(1), schemaID)
+	re.Equal(1, unavailable.count())
+
+	// The healthy endpoint is kept for the following requests.
+	table, err := cli.AllocTableID(ctx, "cluster", "public", "table")
+	re.NoError(err)
+	re.Equal(Table{SchemaID: 1, SchemaName: "public", ID: 3, Name: "table", ShardID: 2}, table)
+	re.NoError(cli.DropTable(ctx, "cluster", "public", "table"))
+	re.Equal(3, healthy.count())
+	re.Equal(1, unavailable.count())
+
+	// The other errors are returned without retries.
+	healthy.mu.Lock()
+	healthy.code = coderr.NotFound
+	healthy.mu.Unlock()
+	err = cli.DropTable(ctx, "cluster", "public", "table")
+	re.True(coderr.Is(err, coderr.NotFound))
+	re.Equal(4, healthy.count())
+
+	// The request fails once the retries are exhausted.
+	healthy.mu.Lock()
+	healthy.code = coderr.ServiceUnavailable
+	healthy.mu.Unlock()
+	_, err = cli.AllocSchemaID(ctx, "cluster", "public")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+
+	// The drop is not retried once it reaches the server.
+	requests := unavailable.count() + healthy.count()
+	err = cli.DropTable(ctx, "cluster", "public", "table")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Equal(requests+1, unavailable.count()+healthy.count())
+
+	re.NoError(cli.Close())
+	_, err = cli.AllocSchemaID(ctx, "cluster", "public")
+	re.Equal(ErrClientClosed, err)
+
+	_, err = New(nil)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
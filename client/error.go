@@ -0,0 +1,19 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package client
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrNoEndpoints   = coderr.NewCodeError(coderr.InvalidParams, "no endpoints of ceresmeta")
+	ErrDial          = coderr.NewCodeError(coderr.ServiceUnavailable, "dial ceresmeta")
+	ErrUnavailable   = coderr.NewCodeError(coderr.ServiceUnavailable, "all endpoints of ceresmeta are unavailable")
+	ErrClientClosed  = coderr.NewCodeError(coderr.Internal, "client is closed")
+	ErrEmptyResponse = coderr.NewCodeError(coderr.Internal, "empty response header")
+)
+
+// responseError converts the code and the error in the response header into a CodeError, so that the callers can
+// check the error by coderr.Is just like the server.
+func responseError(code uint32, msg string) error {
+	return coderr.NewCodeError(coderr.Code(code), "ceresmeta responds error").WithCausef("%s", msg)
+}
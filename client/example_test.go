@@ -0,0 +1,29 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/client"
+)
+
+func Example() {
+	cli, err := client.New([]string{"127.0.0.1:2379", "127.0.0.2:2379"}, client.WithRetry(5, time.Second))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	table, err := cli.AllocTableID(ctx, "defaultCluster", "public", "demo")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("table:%d is on shard:%d\n", table.ID, table.ShardID)
+}
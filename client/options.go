@@ -0,0 +1,76 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	defaultDialTimeout   = time.Second * 3
+	defaultMaxRetries    = 3
+	defaultRetryInterval = time.Millisecond * 200
+)
+
+type options struct {
+	tlsConfig     *tls.Config
+	perRPCCreds   credentials.PerRPCCredentials
+	dialTimeout   time.Duration
+	maxRetries    int
+	retryInterval time.Duration
+
+	identity string
+}
+
+func defaultOptions() options {
+	return options{
+		dialTimeout:   defaultDialTimeout,
+		maxRetries:    defaultMaxRetries,
+		retryInterval: defaultRetryInterval,
+	}
+}
+
+// Option configures the Client.
+type Option func(*options)
+
+// WithTLS makes the client connect to the endpoints over TLS, and the connections are insecure by default.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = cfg
+	}
+}
+
+// WithPerRPCCredentials attaches the credentials, e.g. a token, to every request.
+func WithPerRPCCredentials(creds credentials.PerRPCCredentials) Option {
+	return func(o *options) {
+		o.perRPCCreds = creds
+	}
+}
+
+// WithDialTimeout bounds the time to connect to an endpoint.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithRetry sets the max number of the retries of a request and the interval between them. A request is retried on
+// the next endpoint if the current one is unreachable or responds that the service is unavailable, e.g. no leader is
+// elected.
+func WithRetry(maxRetries int, interval time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = maxRetries
+		o.retryInterval = interval
+	}
+}
+
+// WithIdentity attaches the identity to every request, which is recorded by the CeresMeta as the origin of the DDLs
+// along with the address of the client.
+func WithIdentity(identity string) Option {
+	return func(o *options) {
+		o.identity = identity
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+// The ceresmeta-ctl is the admin tool of the metadata of ceresmeta.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const usage = `usage: ceresmeta-ctl meta diff [flags] <dumpA> [<dumpB>]
+
+Compares the metadata dump dumpA with dumpB, or with the live cluster read from the etcd if dumpB is omitted.
+`
+
+func main() {
+	fs := flag.NewFlagSet("meta diff", flag.ExitOnError)
+	format := fs.String("format", "text", "format of the diff, text or json")
+	endpoints := fs.String("etcd-endpoints", "", "comma-separated endpoints of the etcd cluster of the live cluster")
+	rootPath := fs.String("storage-root-path", "/ceresmeta", "root path of the metadata in the etcd cluster")
+	clusterName := fs.String("cluster", "", "name of the live cluster")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of the diff")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	if len(os.Args) < 3 || os.Args[1] != "meta" || os.Args[2] != "diff" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	_ = fs.Parse(os.Args[3:])
+	if fs.NArg() < 1 || fs.NArg() > 2 || (*format != "text" && *format != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	before, err := os.Open(fs.Arg(0))
+	if err != nil {
+		exitf("fail to open dump, err:%v", err)
+	}
+	defer before.Close()
+
+	var diff *cluster.SnapshotDiff
+	if fs.NArg() == 2 {
+		after, err := os.Open(fs.Arg(1))
+		if err != nil {
+			exitf("fail to open dump, err:%v", err)
+		}
+		defer after.Close()
+		diff, err = cluster.DiffSnapshots(ctx, before, after)
+		if err != nil {
+			exitf("fail to diff dumps, err:%v", err)
+		}
+	} else {
+		diff, err = diffLive(ctx, before, *endpoints, *rootPath, *clusterName)
+		if err != nil {
+			exitf("fail to diff dump with live cluster, err:%v", err)
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diff)
+	} else {
+		err = diff.WriteText(os.Stdout)
+	}
+	if err != nil {
+		exitf("fail to write diff, err:%v", err)
+	}
+}
+
+// diffLive compares the dump with the live cluster, which is read from the etcd directly.
+func diffLive(ctx context.Context, before io.Reader, endpoints, rootPath, clusterName string) (*cluster.SnapshotDiff, error) {
+	if endpoints == "" || clusterName == "" {
+		return nil, fmt.Errorf("etcd endpoints and cluster are required to diff with the live cluster")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(endpoints, ","), DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	s := storage.NewStorageWithEtcdBackend(client, rootPath, storage.Options{MaxScanLimit: 100, MinScanLimit: 20})
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(cluster.ExportStorageSnapshot(ctx, s, clusterName, pw))
+	}()
+	defer pr.Close()
+
+	return cluster.DiffSnapshots(ctx, before, pr)
+}
+
+func exitf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -70,8 +70,10 @@ func main() {
 	}()
 
 	if err := srv.Run(ctx); err != nil {
+		// Exit with non-zero code so that the supervisor knows the startup fails, e.g. the etcd is never ready.
 		log.Error("fail to run server", zap.Error(err))
-		return
+		logger.Sync() //nolint:errcheck
+		os.Exit(1)
 	}
 
 	<-ctx.Done()
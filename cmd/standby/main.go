@@ -0,0 +1,66 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+// The standby promotes the metadata mirrored to a standby etcd cluster, so that a new ceresmeta deployment can serve
+// it after the primary one is lost.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/replication"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func main() {
+	fs := flag.NewFlagSet("standby", flag.ExitOnError)
+	targetEndpoints := fs.String("replica-etcd-endpoints", "", "comma-separated endpoints of the standby etcd cluster")
+	targetRoot := fs.String("replica-storage-root-path", "/ceresmeta", "root path of the mirrored metadata in the standby etcd cluster")
+	sourceEndpoints := fs.String("source-etcd-endpoints", "", "comma-separated endpoints of the primary etcd cluster to verify the mirror against (skipped if empty)")
+	sourceRoot := fs.String("source-storage-root-path", "/ceresmeta", "root path of the metadata in the primary etcd cluster")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of the promotion")
+	if len(os.Args) < 2 || os.Args[1] != "promote" {
+		fmt.Fprintln(os.Stderr, "usage: standby promote [flags]")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	_ = fs.Parse(os.Args[2:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	target, err := newClient(*targetEndpoints)
+	if err != nil {
+		exitf("fail to connect standby etcd, err:%v", err)
+	}
+	defer target.Close()
+	var source *clientv3.Client
+	if *sourceEndpoints != "" {
+		if source, err = newClient(*sourceEndpoints); err != nil {
+			exitf("fail to connect primary etcd, err:%v", err)
+		}
+		defer source.Close()
+	}
+
+	promotion, err := replication.Promote(ctx, target, *targetRoot, source, *sourceRoot)
+	if err != nil {
+		exitf("fail to promote mirror, err:%v", err)
+	}
+	fmt.Printf("promoted mirror:%s, source:%s, revision:%d\n", *targetRoot, promotion.SourceRoot, promotion.Revision)
+}
+
+func newClient(endpoints string) (*clientv3.Client, error) {
+	if endpoints == "" {
+		return nil, fmt.Errorf("no endpoint")
+	}
+	return clientv3.New(clientv3.Config{Endpoints: strings.Split(endpoints, ","), DialTimeout: 5 * time.Second})
+}
+
+func exitf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
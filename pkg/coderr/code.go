@@ -7,11 +7,21 @@ import "net/http"
 type Code int
 
 const (
-	InvalidParams Code = http.StatusBadRequest
-	Internal           = http.StatusInternalServerError
+	Ok                  Code = 0
+	InvalidParams       Code = http.StatusBadRequest
+	Unauthorized             = http.StatusUnauthorized
+	NotFound                 = http.StatusNotFound
+	MethodNotAllowed         = http.StatusMethodNotAllowed
+	Conflict                 = http.StatusConflict
+	Internal                 = http.StatusInternalServerError
+	ServiceUnavailable       = http.StatusServiceUnavailable
+	InsufficientStorage      = http.StatusInsufficientStorage
 	// HTTPCodeUpperBound is a bound under which any Code should have the same meaning with the http status code.
 	HTTPCodeUpperBound = Code(1000)
 	PrintHelpUsage     = 1001
+	// SchemaNotFound is distinguished from the NotFound of the other resources, so that the clients creating the
+	// tables can tell the schema is missing and create it.
+	SchemaNotFound = 1002
 )
 
 // ToHTTPCode converts the Code to http code.
@@ -22,6 +32,10 @@ func (c Code) ToHTTPCode() int {
 		return int(c)
 	}
 
-	// TODO: use switch to convert the code to http code.
-	return int(c)
+	switch c {
+	case SchemaNotFound:
+		return http.StatusNotFound
+	default:
+		return int(c)
+	}
 }
@@ -35,6 +35,21 @@ func Is(err error, expectCode Code) bool {
 	return expectCode == cerr.Code()
 }
 
+// GetCauseCode extracts the error code of the cause of `err`.
+// Returns false if the cause of `err` is not CodeError.
+func GetCauseCode(err error) (Code, bool) {
+	if err == nil {
+		return Ok, false
+	}
+
+	cause := errors.Cause(err)
+	cerr, ok := cause.(CodeError)
+	if !ok {
+		return Ok, false
+	}
+	return cerr.Code(), true
+}
+
 // NewCodeError creates a base CodeError definition.
 // The provided code should be defined in the code.go in this package.
 func NewCodeError(code Code, desc string) CodeError {
@@ -44,9 +44,18 @@ func InitGlobalLogger(cfg *Config) (*zap.Logger, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The scoped debug logs are limited by their scopes instead of the level and the sampling.
+	scopedCfg := zapCfg
+	scopedCfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	scopedCfg.Sampling = nil
+	scoped, err := scopedCfg.Build()
+	if err != nil {
+		return nil, err
+	}
 
 	globalLogger = logger
 	globalLoggerCfg = &zapCfg
+	scopedLogger = scoped
 	return logger, nil
 }
 
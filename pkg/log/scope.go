@@ -0,0 +1,200 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// MaxDebugScopeTTL caps how long a debug scope lives.
+	MaxDebugScopeTTL = time.Hour
+	// DefaultDebugScopeRate is the max number of the logs written per second by a debug scope if it is not given.
+	DefaultDebugScopeRate = 100
+)
+
+// DebugScope writes the debug logs about the matching entities regardless of the log level until it expires, so that
+// the debug logs can be turned on for a few entities on a busy server. The Cluster, ShardID and TablePrefix must all
+// match if they are set, and at least one of them is set.
+type DebugScope struct {
+	ID          uint64  `json:"id"`
+	Cluster     string  `json:"cluster,omitempty"`
+	ShardID     *uint32 `json:"shard_id,omitempty"`
+	TablePrefix string  `json:"table_prefix,omitempty"`
+	// RatePerSec is the max number of the logs written per second, and the logs beyond it are dropped.
+	RatePerSec float64   `json:"rate_per_sec"`
+	ExpireAt   time.Time `json:"expire_at"`
+	// Dropped is the number of the logs dropped by the rate.
+	Dropped uint64 `json:"dropped"`
+}
+
+// Entity is what a scoped debug log is about, and its empty fields match no scope setting them.
+type Entity struct {
+	Cluster  string
+	ShardID  uint32
+	HasShard bool
+	Table    string
+}
+
+type debugScope struct {
+	DebugScope
+	limiter *rate.Limiter
+	dropped uint64
+}
+
+func (s *debugScope) matches(entity Entity) bool {
+	if s.Cluster != "" && s.Cluster != entity.Cluster {
+		return false
+	}
+	if s.ShardID != nil && (!entity.HasShard || *s.ShardID != entity.ShardID) {
+		return false
+	}
+	if s.TablePrefix != "" && (entity.Table == "" || !strings.HasPrefix(entity.Table, s.TablePrefix)) {
+		return false
+	}
+	return true
+}
+
+var (
+	// activeDebugScopes is the number of the scopes, which is checked before anything else so that the scoped debug
+	// logs cost nearly nothing if no scope is active.
+	activeDebugScopes int32
+	// debugScopes holds the immutable slice of the scopes, which is replaced under the debugScopesMu.
+	debugScopes   atomic.Value
+	debugScopesMu sync.Mutex
+	lastScopeID   uint64
+
+	// scopedLogger writes the scoped debug logs to the outputs of the global logger at the debug level.
+	scopedLogger *zap.Logger
+)
+
+// AddDebugScope activates the scope for the ttl capped at MaxDebugScopeTTL, and the scope is returned along with its
+// id and expiry.
+func AddDebugScope(scope DebugScope, ttl time.Duration) (DebugScope, error) {
+	if scope.Cluster == "" && scope.ShardID == nil && scope.TablePrefix == "" {
+		return DebugScope{}, fmt.Errorf("debug scope matches everything")
+	}
+	if ttl <= 0 {
+		return DebugScope{}, fmt.Errorf("invalid debug scope ttl:%s", ttl)
+	}
+	if ttl > MaxDebugScopeTTL {
+		ttl = MaxDebugScopeTTL
+	}
+	if scope.RatePerSec <= 0 {
+		scope.RatePerSec = DefaultDebugScopeRate
+	}
+	if scope.ShardID != nil {
+		shardID := *scope.ShardID
+		scope.ShardID = &shardID
+	}
+
+	debugScopesMu.Lock()
+	defer debugScopesMu.Unlock()
+
+	lastScopeID++
+	scope.ID = lastScopeID
+	scope.ExpireAt = time.Now().Add(ttl)
+	scope.Dropped = 0
+	burst := int(scope.RatePerSec)
+	if burst < 1 {
+		burst = 1
+	}
+	added := &debugScope{DebugScope: scope, limiter: rate.NewLimiter(rate.Limit(scope.RatePerSec), burst)}
+	scopes := loadDebugScopes()
+	storeDebugScopesLocked(append(scopes[:len(scopes):len(scopes)], added))
+	time.AfterFunc(ttl, expireDebugScopes)
+
+	Info("add debug scope", zap.Uint64("id", scope.ID), zap.String("cluster", scope.Cluster),
+		zap.Any("shard-id", scope.ShardID), zap.String("table-prefix", scope.TablePrefix), zap.Time("expire-at", scope.ExpireAt))
+	return scope, nil
+}
+
+// RemoveDebugScope deactivates the scope before it expires, and false is returned if it is not active.
+func RemoveDebugScope(id uint64) bool {
+	debugScopesMu.Lock()
+	defer debugScopesMu.Unlock()
+
+	scopes := loadDebugScopes()
+	remained := make([]*debugScope, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope.ID != id {
+			remained = append(remained, scope)
+		}
+	}
+	storeDebugScopesLocked(remained)
+	return len(remained) < len(scopes)
+}
+
+// ListDebugScopes lists the active scopes in the order of their ids.
+func ListDebugScopes() []DebugScope {
+	expireDebugScopes()
+
+	scopes := loadDebugScopes()
+	result := make([]DebugScope, 0, len(scopes))
+	for _, scope := range scopes {
+		listed := scope.DebugScope
+		listed.Dropped = atomic.LoadUint64(&scope.dropped)
+		result = append(result, listed)
+	}
+	return result
+}
+
+// DebugScopesActive tells whether any scope is active, and the hot paths should check it before building the fields
+// of the scoped debug logs.
+func DebugScopesActive() bool {
+	return atomic.LoadInt32(&activeDebugScopes) > 0
+}
+
+// ScopedDebug writes the debug log about the entity if it matches any active scope within the rate of the scope.
+func ScopedDebug(entity Entity, msg string, fields ...zap.Field) {
+	if atomic.LoadInt32(&activeDebugScopes) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, scope := range loadDebugScopes() {
+		if !now.Before(scope.ExpireAt) || !scope.matches(entity) {
+			continue
+		}
+		if !scope.limiter.AllowN(now, 1) {
+			atomic.AddUint64(&scope.dropped, 1)
+			return
+		}
+		scopedLogger.WithOptions(zap.AddCallerSkip(1)).Debug(msg, append(fields, zap.Uint64("debug-scope", scope.ID))...)
+		return
+	}
+}
+
+func expireDebugScopes() {
+	debugScopesMu.Lock()
+	defer debugScopesMu.Unlock()
+
+	now := time.Now()
+	scopes := loadDebugScopes()
+	remained := make([]*debugScope, 0, len(scopes))
+	for _, scope := range scopes {
+		if now.Before(scope.ExpireAt) {
+			remained = append(remained, scope)
+		}
+	}
+	if len(remained) < len(scopes) {
+		storeDebugScopesLocked(remained)
+	}
+}
+
+func loadDebugScopes() []*debugScope {
+	scopes, _ := debugScopes.Load().([]*debugScope)
+	return scopes
+}
+
+func storeDebugScopesLocked(scopes []*debugScope) {
+	debugScopes.Store(scopes)
+	atomic.StoreInt32(&activeDebugScopes, int32(len(scopes)))
+}
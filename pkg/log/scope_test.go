@@ -0,0 +1,118 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func observeScopedLogs(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	prev := scopedLogger
+	scopedLogger = zap.New(core)
+	t.Cleanup(func() {
+		scopedLogger = prev
+		for _, scope := range ListDebugScopes() {
+			RemoveDebugScope(scope.ID)
+		}
+	})
+	return logs
+}
+
+func TestScopedDebug(t *testing.T) {
+	re := require.New(t)
+	logs := observeScopedLogs(t)
+
+	ScopedDebug(Entity{Cluster: "c1"}, "no scope")
+	re.Zero(logs.Len())
+
+	_, err := AddDebugScope(DebugScope{}, time.Minute)
+	re.Error(err)
+	_, err = AddDebugScope(DebugScope{Cluster: "c1"}, 0)
+	re.Error(err)
+
+	shardID := uint32(3)
+	shardScope, err := AddDebugScope(DebugScope{Cluster: "c1", ShardID: &shardID}, time.Minute)
+	re.NoError(err)
+	tableScope, err := AddDebugScope(DebugScope{TablePrefix: "metrics_"}, 2*MaxDebugScopeTTL)
+	re.NoError(err)
+	re.False(tableScope.ExpireAt.After(time.Now().Add(MaxDebugScopeTTL)))
+	re.True(DebugScopesActive())
+
+	// Only the entities matching all the settings of a scope are logged.
+	ScopedDebug(Entity{Cluster: "c1", ShardID: 3, HasShard: true}, "shard 3")
+	ScopedDebug(Entity{Cluster: "c1", ShardID: 4, HasShard: true}, "shard 4")
+	ScopedDebug(Entity{Cluster: "c2", ShardID: 3, HasShard: true}, "other cluster")
+	ScopedDebug(Entity{Cluster: "c1"}, "no shard")
+	ScopedDebug(Entity{Cluster: "c2", Table: "metrics_cpu"}, "table metrics_cpu")
+	ScopedDebug(Entity{Cluster: "c2", Table: "logs"}, "table logs")
+	messages := make([]string, 0, logs.Len())
+	for _, entry := range logs.TakeAll() {
+		messages = append(messages, entry.Message)
+	}
+	re.Equal([]string{"shard 3", "table metrics_cpu"}, messages)
+
+	scopes := ListDebugScopes()
+	re.Len(scopes, 2)
+	re.Equal(shardScope.ID, scopes[0].ID)
+	re.Equal(uint32(3), *scopes[0].ShardID)
+	re.Equal(tableScope.ID, scopes[1].ID)
+
+	re.True(RemoveDebugScope(shardScope.ID))
+	re.False(RemoveDebugScope(shardScope.ID))
+	ScopedDebug(Entity{Cluster: "c1", ShardID: 3, HasShard: true}, "shard 3")
+	re.Zero(logs.Len())
+}
+
+func TestScopedDebugRateAndExpiry(t *testing.T) {
+	re := require.New(t)
+	logs := observeScopedLogs(t)
+
+	scope, err := AddDebugScope(DebugScope{Cluster: "c1", RatePerSec: 2}, 100*time.Millisecond)
+	re.NoError(err)
+	for i := 0; i < 10; i++ {
+		ScopedDebug(Entity{Cluster: "c1"}, "burst")
+	}
+	re.Equal(2, logs.Len())
+	scopes := ListDebugScopes()
+	re.Len(scopes, 1)
+	re.Equal(scope.ID, scopes[0].ID)
+	re.Equal(uint64(8), scopes[0].Dropped)
+
+	// The scope expires by itself.
+	re.Eventually(func() bool { return !DebugScopesActive() }, time.Second, 5*time.Millisecond)
+	re.Empty(ListDebugScopes())
+}
+
+func BenchmarkScopedDebug(b *testing.B) {
+	entity := Entity{Cluster: "c1", ShardID: 3, HasShard: true, Table: "metrics_cpu"}
+	b.Run("inactive", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if DebugScopesActive() {
+				ScopedDebug(entity, "route table", zap.String("table", entity.Table))
+			}
+		}
+	})
+	b.Run("unmatched", func(b *testing.B) {
+		scope, err := AddDebugScope(DebugScope{Cluster: "c2"}, time.Minute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer RemoveDebugScope(scope.ID)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if DebugScopesActive() {
+				ScopedDebug(entity, "route table", zap.String("table", entity.Table))
+			}
+		}
+	})
+}
@@ -0,0 +1,11 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package audit
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrInvalidSink = coderr.NewCodeError(coderr.InvalidParams, "invalid audit sink")
+	ErrOpenSink    = coderr.NewCodeError(coderr.Internal, "open audit sink")
+	ErrWriteRecord = coderr.NewCodeError(coderr.Internal, "write audit record")
+)
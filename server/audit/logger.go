@@ -0,0 +1,157 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueueSize     = 4096
+	defaultMaxAttempts   = 3
+	defaultRetryInterval = time.Second
+	defaultWriteTimeout  = time.Second * 5
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Record describes a mutating operation.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Server is the ceresmeta server executing the operation.
+	Server  string `json:"server"`
+	Cluster string `json:"cluster"`
+	// Environment is the environment label of the cluster, and it is empty if the cluster is not labeled.
+	Environment string `json:"environment,omitempty"`
+	Operation   string `json:"operation"`
+	// Actor is the identity of the caller, and Peer is its address.
+	Actor  string `json:"actor"`
+	Peer   string `json:"peer,omitempty"`
+	Target string `json:"target"`
+	// Result is either ResultSuccess or ResultFailure, and Error is the cause of the failure.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Sink ships the records off the box, and Write is called by a single goroutine.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, record Record) error
+	Close() error
+}
+
+// Logger writes the records to the sink in background, so the operations are never blocked by the sink. The records
+// are dropped if the queue is full or all the attempts to write them fail, and they are logged locally in that case.
+type Logger struct {
+	sink   Sink
+	server string
+	queue  chan Record
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewLogger starts writing the records to the sink, and the server is the name of the ceresmeta server.
+func NewLogger(sink Sink, server string) *Logger {
+	l := &Logger{
+		sink:   sink,
+		server: server,
+		queue:  make(chan Record, defaultQueueSize),
+		stopCh: make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.run()
+	return l
+}
+
+// Log queues the record without blocking, and a nil logger records nothing.
+func (l *Logger) Log(record Record) {
+	if l == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Server = l.server
+
+	select {
+	case l.queue <- record:
+	default:
+		l.drop(record, ErrWriteRecord.WithCausef("queue is full, size:%d", cap(l.queue)))
+	}
+}
+
+// Close writes the queued records and closes the sink.
+func (l *Logger) Close() {
+	close(l.stopCh)
+	l.wg.Wait()
+	if err := l.sink.Close(); err != nil {
+		log.Error("fail to close audit sink", zap.String("sink", l.sink.Name()), zap.Error(err))
+	}
+}
+
+func (l *Logger) run() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case record := <-l.queue:
+			l.write(record)
+		case <-l.stopCh:
+			// The queued records are still written once without retries.
+			for {
+				select {
+				case record := <-l.queue:
+					if err := l.writeOnce(record); err != nil {
+						l.drop(record, err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) write(record Record) {
+	var err error
+	for i := 0; i < defaultMaxAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(defaultRetryInterval):
+			case <-l.stopCh:
+			}
+		}
+		if err = l.writeOnce(record); err == nil {
+			return
+		}
+		log.Warn("fail to write audit record", zap.String("sink", l.sink.Name()), zap.String("operation", record.Operation),
+			zap.Int("attempt", i+1), zap.Error(err))
+	}
+	l.drop(record, err)
+}
+
+func (l *Logger) writeOnce(record Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultWriteTimeout)
+	defer cancel()
+
+	if err := l.sink.Write(ctx, record); err != nil {
+		recordsCounter.WithLabelValues(l.sink.Name(), "failed").Inc()
+		return err
+	}
+	recordsCounter.WithLabelValues(l.sink.Name(), "written").Inc()
+	return nil
+}
+
+func (l *Logger) drop(record Record, err error) {
+	recordsCounter.WithLabelValues(l.sink.Name(), "dropped").Inc()
+	log.Error("drop audit record", zap.String("sink", l.sink.Name()), zap.Any("record", record), zap.Error(err))
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+const defaultTestTimeout = time.Second * 10
+
+func TestFileSink(t *testing.T) {
+	re := require.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewSink(SinkFile, path)
+	re.NoError(err)
+	logger := NewLogger(sink, "meta0")
+
+	for _, target := range []string{"public.t0", "public.t1"} {
+		logger.Log(Record{Cluster: "c1", Operation: "CreateTable", Actor: "ceresdb-0", Target: target, Result: ResultSuccess})
+	}
+	logger.Log(Record{Cluster: "c1", Operation: "DropTable", Actor: "ceresdb-0", Target: "public.t2", Result: ResultFailure,
+		Error: "table not found"})
+	// The queued records are written before the sink is closed.
+	logger.Close()
+
+	file, err := os.Open(path)
+	re.NoError(err)
+	defer file.Close()
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := Record{}
+		re.NoError(json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	re.Len(records, 3)
+	re.Equal("public.t0", records[0].Target)
+	re.Equal("public.t1", records[1].Target)
+	re.Equal("meta0", records[2].Server)
+	re.Equal(ResultFailure, records[2].Result)
+	re.Equal("table not found", records[2].Error)
+	re.False(records[2].Time.IsZero())
+
+	_, err = NewSink("kafka", "")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
+
+func TestHTTPSinkRetry(t *testing.T) {
+	re := require.New(t)
+
+	var mu sync.Mutex
+	var attempts int
+	var records []Record
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// The first attempt fails and the record is written again.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		record := Record{}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		records = append(records, record)
+	}))
+	defer srv.Close()
+
+	sink, err := NewSink(SinkHTTP, srv.URL)
+	re.NoError(err)
+	logger := NewLogger(sink, "meta0")
+	defer logger.Close()
+	logger.Log(Record{Cluster: "c1", Operation: "CreateSchema", Actor: "ceresdb-0", Target: "public", Result: ResultSuccess})
+
+	re.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(records) == 1
+	}, defaultTestTimeout, time.Millisecond*10)
+	mu.Lock()
+	defer mu.Unlock()
+	re.Equal(2, attempts)
+	re.Equal("CreateSchema", records[0].Operation)
+}
+
+func TestSyslogSink(t *testing.T) {
+	re := require.New(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	re.NoError(err)
+	defer conn.Close()
+
+	sink, err := NewSink(SinkSyslog, "udp://"+conn.LocalAddr().String())
+	re.NoError(err)
+	logger := NewLogger(sink, "meta0")
+	defer logger.Close()
+	logger.Log(Record{Cluster: "c1", Operation: "DropTable", Actor: "ceresdb-0", Target: "public.t0", Result: ResultSuccess})
+
+	re.NoError(conn.SetReadDeadline(time.Now().Add(defaultTestTimeout)))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	re.NoError(err)
+	message := string(buf[:n])
+	re.Contains(message, "ceresmeta")
+	record := Record{}
+	re.NoError(json.Unmarshal([]byte(message[strings.Index(message, "{"):]), &record))
+	re.Equal("public.t0", record.Target)
+	re.Equal("meta0", record.Server)
+
+	_, err = NewSink(SinkSyslog, "localhost")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
@@ -0,0 +1,17 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package audit
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var recordsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "audit",
+		Name:      "records_total",
+		Help:      "Number of the audit records by the sink and the outcome, which is written, failed or dropped.",
+	}, []string{"sink", "outcome"})
+
+func init() {
+	prometheus.MustRegister(recordsCounter)
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of the sinks.
+const (
+	SinkFile   = "file"
+	SinkSyslog = "syslog"
+	SinkHTTP   = "http"
+)
+
+// NewSink creates the sink of the kind. The address is the path of the file for the SinkFile, the url of the SinkHTTP,
+// and the url like "udp://host:514" of the SinkSyslog, where the empty address means the local syslog.
+func NewSink(kind, address string) (Sink, error) {
+	switch kind {
+	case SinkFile:
+		return NewFileSink(address)
+	case SinkSyslog:
+		return NewSyslogSink(address)
+	case SinkHTTP:
+		if address == "" {
+			return nil, ErrInvalidSink.WithCausef("url of the http sink is empty")
+		}
+		return &HTTPSink{URL: address, Client: http.DefaultClient}, nil
+	default:
+		return nil, ErrInvalidSink.WithCausef("unknown sink:%s", kind)
+	}
+}
+
+// FileSink appends the json-encoded records to the file line by line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, ErrInvalidSink.WithCausef("path of the file sink is empty")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, ErrOpenSink.WithCause(err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Name() string {
+	return SinkFile
+}
+
+func (s *FileSink) Write(_ context.Context, record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encode audit record")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return ErrWriteRecord.WithCause(err)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// SyslogSink sends the json-encoded records to the syslog with the auth facility.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(address string) (*SyslogSink, error) {
+	var network, raddr string
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, ErrInvalidSink.WithCausef("invalid syslog address:%s", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "ceresmeta")
+	if err != nil {
+		return nil, ErrOpenSink.WithCause(err)
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return SinkSyslog
+}
+
+func (s *SyslogSink) Write(_ context.Context, record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encode audit record")
+	}
+	if record.Result == ResultFailure {
+		err = s.writer.Warning(string(line))
+	} else {
+		err = s.writer.Info(string(line))
+	}
+	if err != nil {
+		return ErrWriteRecord.WithCause(err)
+	}
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// HTTPSink posts the json-encoded records to the URL, and the response of a status other than 2xx is a failure.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPSink) Name() string {
+	return SinkHTTP
+}
+
+func (s *HTTPSink) Write(ctx context.Context, record Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "encode audit record")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return ErrWriteRecord.WithCause(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return ErrWriteRecord.WithCause(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ErrWriteRecord.WithCausef("unexpected status:%s", resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package backup
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrWriteSnapshot  = coderr.NewCodeError(coderr.Internal, "write snapshot")
+	ErrListSnapshots  = coderr.NewCodeError(coderr.Internal, "list snapshots")
+	ErrDeleteSnapshot = coderr.NewCodeError(coderr.Internal, "delete snapshot")
+	ErrInvalidName    = coderr.NewCodeError(coderr.InvalidParams, "invalid snapshot name")
+)
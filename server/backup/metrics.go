@@ -0,0 +1,26 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package backup
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var snapshotsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "backup",
+		Name:      "snapshots_total",
+		Help:      "Number of the scheduled snapshots by result.",
+	}, []string{"cluster", "result"})
+
+var lastSnapshotSuccessGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "backup",
+		Name:      "last_snapshot_success_timestamp_seconds",
+		Help:      "Unix time of the latest successful scheduled snapshot.",
+	}, []string{"cluster"})
+
+func init() {
+	prometheus.MustRegister(snapshotsCounter)
+	prometheus.MustRegister(lastSnapshotSuccessGauge)
+}
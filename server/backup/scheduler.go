@@ -0,0 +1,185 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+// Package backup takes the snapshots of the clusters periodically and prunes the old ones.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotTimeLayout = "20060102T150405.000Z"
+	snapshotNameSuffix = ".json"
+)
+
+// Exporter exports the snapshot of a cluster, which is implemented by the cluster.Cluster.
+type Exporter interface {
+	Name() string
+	ExportSnapshot(ctx context.Context, w io.Writer) error
+}
+
+// RetentionPolicy decides which snapshots of a cluster are kept, and the zero values mean unlimited. The latest
+// snapshot is always kept.
+type RetentionPolicy struct {
+	// MaxCount is the max number of the snapshots kept.
+	MaxCount int
+	// MaxAge is how long a snapshot is kept.
+	MaxAge time.Duration
+}
+
+// Status is the result of the latest scheduled snapshot of a cluster.
+type Status struct {
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+	// LastSnapshot is the name of the latest successful snapshot.
+	LastSnapshot string `json:"last_snapshot,omitempty"`
+	// LastError is the error of the latest attempt, which is empty if it succeeds.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Scheduler writes the snapshots of the clusters by the writer and prunes the old ones by the policy. The snapshots
+// are named by the cluster and the time they are taken, so that the snapshots of different clusters can share the
+// destination.
+type Scheduler struct {
+	writer SnapshotWriter
+	policy RetentionPolicy
+
+	// mu protects the statuses.
+	mu       sync.RWMutex
+	statuses map[string]Status
+}
+
+func NewScheduler(writer SnapshotWriter, policy RetentionPolicy) *Scheduler {
+	return &Scheduler{
+		writer:   writer,
+		policy:   policy,
+		statuses: make(map[string]Status),
+	}
+}
+
+// TakeSnapshot exports the snapshot of the cluster, writes it, and prunes the snapshots of the cluster out of the
+// retention. A failed pruning doesn't fail the snapshot, and it is retried after the next snapshot.
+func (s *Scheduler) TakeSnapshot(ctx context.Context, e Exporter, now time.Time) error {
+	clusterName := e.Name()
+	name := snapshotName(clusterName, now)
+	err := s.takeSnapshot(ctx, e, name)
+
+	s.mu.Lock()
+	status := s.statuses[clusterName]
+	status.LastAttemptAt = now
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccessAt = now
+		status.LastSnapshot = name
+	}
+	s.statuses[clusterName] = status
+	s.mu.Unlock()
+
+	if err != nil {
+		snapshotsCounter.WithLabelValues(clusterName, "failed").Inc()
+		return err
+	}
+	snapshotsCounter.WithLabelValues(clusterName, "success").Inc()
+	lastSnapshotSuccessGauge.WithLabelValues(clusterName).Set(float64(now.Unix()))
+	log.Info("take scheduled snapshot", zap.String("cluster", clusterName), zap.String("name", name))
+
+	if err := s.prune(ctx, clusterName, now); err != nil {
+		log.Warn("fail to prune snapshots", zap.String("cluster", clusterName), zap.Error(err))
+	}
+	return nil
+}
+
+// Status returns the statuses of the scheduled snapshots keyed by the cluster name.
+func (s *Scheduler) Status() map[string]Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make(map[string]Status, len(s.statuses))
+	for name, status := range s.statuses {
+		statuses[name] = status
+	}
+	return statuses
+}
+
+func (s *Scheduler) takeSnapshot(ctx context.Context, e Exporter, name string) error {
+	// The snapshot is exported into the memory first so that the cluster isn't locked while writing to a slow
+	// destination.
+	buf := &bytes.Buffer{}
+	if err := e.ExportSnapshot(ctx, buf); err != nil {
+		return errors.Wrapf(err, "export snapshot, cluster:%s", e.Name())
+	}
+	if err := s.writer.Write(ctx, name, buf); err != nil {
+		return errors.Wrapf(err, "write snapshot, name:%s", name)
+	}
+	return nil
+}
+
+// prune deletes the snapshots of the cluster out of the retention except the latest one. The names not generated by
+// the scheduler are ignored.
+func (s *Scheduler) prune(ctx context.Context, clusterName string, now time.Time) error {
+	if s.policy.MaxCount <= 0 && s.policy.MaxAge <= 0 {
+		return nil
+	}
+
+	names, err := s.writer.List(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list snapshots")
+	}
+	type snapshot struct {
+		name    string
+		takenAt time.Time
+	}
+	snapshots := make([]snapshot, 0, len(names))
+	for _, name := range names {
+		if takenAt, ok := parseSnapshotName(clusterName, name); ok {
+			snapshots = append(snapshots, snapshot{name: name, takenAt: takenAt})
+		}
+	}
+	// The latest snapshots come first.
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].takenAt.After(snapshots[j].takenAt) })
+
+	for i, snapshot := range snapshots {
+		if i == 0 {
+			continue
+		}
+		expired := s.policy.MaxAge > 0 && now.Sub(snapshot.takenAt) > s.policy.MaxAge
+		if !expired && (s.policy.MaxCount <= 0 || i < s.policy.MaxCount) {
+			continue
+		}
+		if err := s.writer.Delete(ctx, snapshot.name); err != nil {
+			return errors.Wrapf(err, "delete snapshot, name:%s", snapshot.name)
+		}
+		log.Info("prune snapshot", zap.String("cluster", clusterName), zap.String("name", snapshot.name))
+	}
+	return nil
+}
+
+func snapshotName(clusterName string, takenAt time.Time) string {
+	return clusterName + "-" + takenAt.UTC().Format(snapshotTimeLayout) + snapshotNameSuffix
+}
+
+// parseSnapshotName returns the time the snapshot of the cluster is taken, and false if the name is not a snapshot of
+// the cluster.
+func parseSnapshotName(clusterName, name string) (time.Time, bool) {
+	prefix := clusterName + "-"
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, snapshotNameSuffix) {
+		return time.Time{}, false
+	}
+	takenAt, err := time.Parse(snapshotTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), snapshotNameSuffix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return takenAt, true
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockExporter struct {
+	name string
+	err  error
+}
+
+func (e *mockExporter) Name() string {
+	return e.name
+}
+
+func (e *mockExporter) ExportSnapshot(_ context.Context, w io.Writer) error {
+	if e.err != nil {
+		return e.err
+	}
+	_, err := fmt.Fprintf(w, "{\"cluster_name\":%q}\n", e.name)
+	return err
+}
+
+func listSorted(t *testing.T, w SnapshotWriter) []string {
+	names, err := w.List(context.Background())
+	require.NoError(t, err)
+	sort.Strings(names)
+	return names
+}
+
+func TestScheduler(t *testing.T) {
+	re := require.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	writer := NewLocalWriter(filepath.Join(dir, "snapshots"))
+	scheduler := NewScheduler(writer, RetentionPolicy{MaxCount: 3, MaxAge: time.Hour})
+
+	// The files not written by the scheduler are never pruned.
+	re.NoError(writer.Write(ctx, "manual.json", strings.NewReader("")))
+	start := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	cluster0, cluster1 := &mockExporter{name: "cluster"}, &mockExporter{name: "cluster-1"}
+	re.NoError(scheduler.TakeSnapshot(ctx, cluster1, start))
+	for i := 0; i < 4; i++ {
+		re.NoError(scheduler.TakeSnapshot(ctx, cluster0, start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	// Only the latest 3 snapshots of the cluster are kept.
+	re.Equal([]string{
+		"cluster-1-20220801T000000.000Z.json",
+		"cluster-20220801T000100.000Z.json",
+		"cluster-20220801T000200.000Z.json",
+		"cluster-20220801T000300.000Z.json",
+		"manual.json",
+	}, listSorted(t, writer))
+	content, err := os.ReadFile(filepath.Join(dir, "snapshots", "cluster-20220801T000300.000Z.json"))
+	re.NoError(err)
+	re.Equal("{\"cluster_name\":\"cluster\"}\n", string(content))
+
+	// The snapshots older than the max age are pruned, except the latest one of the other cluster.
+	later := start.Add(2 * time.Hour)
+	re.NoError(scheduler.TakeSnapshot(ctx, cluster0, later))
+	re.Equal([]string{
+		"cluster-1-20220801T000000.000Z.json",
+		"cluster-20220801T020000.000Z.json",
+		"manual.json",
+	}, listSorted(t, writer))
+
+	// The failure is recorded in the status without touching the latest successful snapshot.
+	cluster0.err = fmt.Errorf("injected")
+	re.Error(scheduler.TakeSnapshot(ctx, cluster0, later.Add(time.Minute)))
+	status := scheduler.Status()["cluster"]
+	re.Equal(later.Add(time.Minute), status.LastAttemptAt)
+	re.Equal(later, status.LastSuccessAt)
+	re.Equal("cluster-20220801T020000.000Z.json", status.LastSnapshot)
+	re.Contains(status.LastError, "injected")
+	re.Equal(start, scheduler.Status()["cluster-1"].LastSuccessAt)
+	re.Len(listSorted(t, writer), 3)
+
+	re.Error(writer.Write(ctx, "../escape.json", strings.NewReader("")))
+}
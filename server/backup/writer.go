@@ -0,0 +1,100 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SnapshotWriter stores the snapshots at some destination, e.g. a local directory or an object store.
+type SnapshotWriter interface {
+	// Write stores the snapshot read from r by the name, and a partially written snapshot must not be listed.
+	Write(ctx context.Context, name string, r io.Reader) error
+	// List returns the names of all the stored snapshots in any order.
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// LocalWriter stores the snapshots as the files in a local directory. A snapshot is written into a temporary file
+// first and renamed once it is complete.
+type LocalWriter struct {
+	dir string
+}
+
+func NewLocalWriter(dir string) *LocalWriter {
+	return &LocalWriter{dir: dir}
+}
+
+const tmpSnapshotSuffix = ".tmp"
+
+func (w *LocalWriter) Write(_ context.Context, name string, r io.Reader) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(w.dir, 0o750); err != nil {
+		return ErrWriteSnapshot.WithCausef("create dir:%s, err:%v", w.dir, err)
+	}
+
+	path := filepath.Join(w.dir, name)
+	tmpPath := path + tmpSnapshotSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return ErrWriteSnapshot.WithCausef("open file:%s, err:%v", tmpPath, err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return ErrWriteSnapshot.WithCausef("file:%s, err:%v", path, err)
+	}
+	return nil
+}
+
+func (w *LocalWriter) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ErrListSnapshots.WithCausef("dir:%s, err:%v", w.dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), tmpSnapshotSuffix) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (w *LocalWriter) Delete(_ context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(w.dir, name)); err != nil && !os.IsNotExist(err) {
+		return ErrDeleteSnapshot.WithCausef("name:%s, err:%v", name, err)
+	}
+	return nil
+}
+
+// checkName rejects the names escaping the directory.
+func checkName(name string) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return ErrInvalidName.WithCausef("name:%s", name)
+	}
+	return nil
+}
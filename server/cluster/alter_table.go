@@ -0,0 +1,182 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// TableSchema is the encoded schema of a table reported by the ceresdb, and the version is bumped by every alter.
+type TableSchema struct {
+	Version uint64 `json:"version"`
+	Encoded []byte `json:"encoded"`
+}
+
+func (s *TableSchema) GetVersion() uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.Version
+}
+
+func (s *TableSchema) GetEncoded() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.Encoded
+}
+
+// AlterTable persists the new encoded schema of the table with the version bumped, and the ceresdb owning the table
+// should apply the alter only after it succeeds, so that a shard reopened after a failover never serves a schema older
+// than the one applied. The expectedVersion must be the current version of the table schema, otherwise
+// ErrTableSchemaConflict is returned, which serializes the concurrent alters on the same table.
+func (c *Cluster) AlterTable(ctx context.Context, schemaName, tableName string, expectedVersion uint64, encodedSchema []byte) (*Table, error) {
+	c.lockForDDL(ctx)
+	defer c.lock.Unlock()
+
+	start := time.Now()
+	table, err := c.alterTableLocked(ctx, schemaName, tableName, expectedVersion, encodedSchema)
+	c.observeProcedureLocked(ProcedureAlterTable, start, err)
+	return table, err
+}
+
+func (c *Cluster) alterTableLocked(ctx context.Context, schemaName, tableName string, expectedVersion uint64, encodedSchema []byte) (*Table, error) {
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	table, ok := schema.getTable(tableName)
+	if !ok {
+		return nil, ErrTableNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+	if _, ok := c.dropTasks[table.GetID()]; ok {
+		return nil, ErrTableDeleting.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+	if err := c.checkHealthyNodesLocked(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.checkTopologyGenerationLocked(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.checkShardDrainingLocked(table.GetShardID()); err != nil {
+		return nil, err
+	}
+	if err := c.checkShardFrozenLocked(ctx, table.GetShardID()); err != nil {
+		return nil, err
+	}
+	if table.GetSchemaVersion() != expectedVersion {
+		return nil, ErrTableSchemaConflict.WithCausef("table:%s, expected version:%d, current version:%d", tableName,
+			expectedVersion, table.GetSchemaVersion())
+	}
+
+	prevValue := ""
+	if table.tableSchema != nil {
+		value, err := json.Marshal(table.tableSchema)
+		if err != nil {
+			return nil, ErrEncodeTableSchema.WithCausef("table:%s, err:%v", tableName, err)
+		}
+		prevValue = string(value)
+	}
+	tableSchema := &TableSchema{Version: expectedVersion + 1, Encoded: encodedSchema}
+	value, err := json.Marshal(tableSchema)
+	if err != nil {
+		return nil, ErrEncodeTableSchema.WithCausef("table:%s, err:%v", tableName, err)
+	}
+	// The version of the shard is bumped before the schema is persisted, so that a failed alter leaves at most a
+	// spurious bump instead of a schema change missed by the version.
+	if increment := c.shardVersionIncrementLocked(ShardOperationAlterTable); increment > 0 {
+		shard, ok := c.shardsCache[table.GetShardID()]
+		if !ok {
+			return nil, ErrShardNotFound.WithCausef("shard:%d, table:%s", table.GetShardID(), tableName)
+		}
+		topology := shard.withVersionBumped(increment)
+		if err := c.storage.PutShardTopologies(ctx, c.clusterID, []uint32{shard.GetID()}, []*metapb.ShardTopology{topology}); err != nil {
+			c.markStaleOnConflictLocked(err)
+			return nil, errors.Wrapf(err, "put shard topology, shard:%d", shard.GetID())
+		}
+		shard.topology = topology
+		c.invalidateTopologyCacheLocked()
+	}
+	ok, err = c.storage.PutTableSchema(ctx, c.clusterID, schema.GetID(), table.GetID(), string(value), prevValue)
+	if err != nil {
+		return nil, errors.Wrapf(err, "put table schema, table:%s", tableName)
+	}
+	if !ok {
+		return nil, ErrTableSchemaConflict.WithCausef("table:%s, version:%d is altered concurrently", tableName,
+			expectedVersion)
+	}
+
+	altered := &Table{schema: table.schema, meta: table.meta, tableSchema: tableSchema, affinityGroup: table.affinityGroup}
+	schema.tableMap[tableName] = altered
+	c.recordShardDDLLocked(table.GetShardID())
+
+	log.Info("alter table", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName),
+		zap.String("table", tableName), zap.Uint64("schema-version", tableSchema.Version),
+		zap.Any("origin", DDLOriginFromContext(ctx)))
+	return altered, nil
+}
+
+// ShardTables are the tables on a shard.
+type ShardTables struct {
+	ShardID uint32
+	Version uint64
+	Node    string
+	// Tables are ordered by the table id, and the tables being dropped are excluded.
+	Tables []*Table
+}
+
+// GetShardTables returns the tables with their schema versions on the shards, which are needed to open the shards.
+func (c *Cluster) GetShardTables(shardIDs []uint32) (map[uint32]*ShardTables, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	result := make(map[uint32]*ShardTables, len(shardIDs))
+	for _, shardID := range shardIDs {
+		shard, ok := c.shardsCache[shardID]
+		if !ok {
+			return nil, ErrShardNotFound.WithCausef("shard:%d", shardID)
+		}
+		result[shardID] = &ShardTables{ShardID: shardID, Version: shard.GetVersion(), Node: shard.GetNode()}
+	}
+
+	for _, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			shardTables, ok := result[table.GetShardID()]
+			if !ok || !c.shardsCache[table.GetShardID()].hasTable(table.GetID()) {
+				continue
+			}
+			shardTables.Tables = append(shardTables.Tables, table)
+		}
+	}
+	for _, shardTables := range result {
+		tables := shardTables.Tables
+		sort.Slice(tables, func(i, j int) bool { return tables[i].GetID() < tables[j].GetID() })
+	}
+	return result, nil
+}
+
+// loadTableSchemas loads the schemas of the altered tables of the schema keyed by table id.
+func (c *Cluster) loadTableSchemas(ctx context.Context, schemaID uint32) (map[uint64]*TableSchema, error) {
+	values, err := c.storage.ListTableSchemas(ctx, c.clusterID, schemaID)
+	if err != nil {
+		return nil, err
+	}
+
+	tableSchemas := make(map[uint64]*TableSchema, len(values))
+	for tableID, value := range values {
+		tableSchema := &TableSchema{}
+		if err := json.Unmarshal([]byte(value), tableSchema); err != nil {
+			return nil, ErrDecodeTableSchema.WithCausef("table:%d, err:%v", tableID, err)
+		}
+		tableSchemas[tableID] = tableSchema
+	}
+	return tableSchemas, nil
+}
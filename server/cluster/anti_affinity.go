@@ -0,0 +1,198 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+type antiAffinityGroupKey struct{}
+
+// WithAntiAffinityGroup returns a context carrying the anti-affinity group, usually the id of the logical partitioned
+// table, of the tables created in the context. The tables of the same group are spread over distinct shards and
+// nodes as far as the cluster allows, and the zero group means no anti-affinity.
+func WithAntiAffinityGroup(ctx context.Context, group uint64) context.Context {
+	return context.WithValue(ctx, antiAffinityGroupKey{}, group)
+}
+
+func antiAffinityGroupFromContext(ctx context.Context) uint64 {
+	group, _ := ctx.Value(antiAffinityGroupKey{}).(uint64)
+	return group
+}
+
+// AntiAffinityViolationKind is how the tables of an anti-affinity group are not spread.
+type AntiAffinityViolationKind string
+
+const (
+	AntiAffinitySameShard AntiAffinityViolationKind = "same_shard"
+	AntiAffinitySameNode  AntiAffinityViolationKind = "same_node"
+)
+
+// AntiAffinityViolation describes a shard or a node holding more tables of the group than the most even spread over
+// the effective shard set of the schema and the nodes owning it.
+type AntiAffinityViolation struct {
+	SchemaName string
+	Group      uint64
+	Kind       AntiAffinityViolationKind
+	// ShardID is set if the kind is AntiAffinitySameShard, and Node is set if the kind is AntiAffinitySameNode.
+	ShardID uint32
+	Node    string
+	Count   int
+	Limit   int
+}
+
+// groupSpread is the number of the tables of an anti-affinity group on every shard and node.
+type groupSpread struct {
+	tableIDs    []uint64
+	shardCounts map[uint32]int
+	nodeCounts  map[string]int
+}
+
+// groupSpreadLocked returns the spread of the tables of the group in the schema, and the tables being dropped are
+// excluded.
+func (c *Cluster) groupSpreadLocked(schema *Schema, group uint64) *groupSpread {
+	spread := &groupSpread{shardCounts: make(map[uint32]int), nodeCounts: make(map[string]int)}
+	if group == 0 {
+		return spread
+	}
+	for _, table := range schema.tableMap {
+		if table.affinityGroup != group {
+			continue
+		}
+		if _, ok := c.dropTasks[table.GetID()]; ok {
+			continue
+		}
+		spread.tableIDs = append(spread.tableIDs, table.GetID())
+		spread.shardCounts[table.GetShardID()]++
+		if shard, ok := c.shardsCache[table.GetShardID()]; ok && shard.GetNode() != "" {
+			spread.nodeCounts[shard.GetNode()]++
+		}
+	}
+	return spread
+}
+
+// score returns the score of the shard as the place for the next table of the group.
+func (s *groupSpread) score(shard *Shard) PlacementScore {
+	return PlacementScore{
+		GroupShardTables: s.shardCounts[shard.GetID()],
+		GroupNodeTables:  s.nodeCounts[shard.GetNode()],
+		Tables:           shard.GetTableCount(),
+	}
+}
+
+// prefers returns true if the shard a is a better place than b for the next table of the group, which means fewer
+// tables of the group on the shard, then on its node, and then fewer tables on the shard.
+func (s *groupSpread) prefers(a, b *Shard) bool {
+	return s.score(a).less(s.score(b))
+}
+
+// setTableAffinityGroupLocked persists the anti-affinity group of the table created without it, which happens if the
+// creation fails after the table is persisted and is retried. The group of a table is never changed.
+func (c *Cluster) setTableAffinityGroupLocked(ctx context.Context, schema *Schema, table *Table, group uint64) (*Table, error) {
+	if group == 0 || table.affinityGroup != 0 {
+		return table, nil
+	}
+	if err := c.storage.PutTableAffinityGroup(ctx, c.clusterID, schema.GetID(), table.GetID(), group); err != nil {
+		return nil, errors.Wrapf(err, "put table anti-affinity group, table:%s", table.GetName())
+	}
+
+	grouped := &Table{schema: table.schema, meta: table.meta, tableSchema: table.tableSchema, affinityGroup: group}
+	schema.tableMap[table.GetName()] = grouped
+	return grouped, nil
+}
+
+// shardAffinityGroupsLocked returns the anti-affinity groups of the tables on every shard, which are considered by the
+// planners when the shards are moved.
+func (c *Cluster) shardAffinityGroupsLocked() map[uint32][]uint64 {
+	groups := make(map[uint32][]uint64)
+	for _, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			if table.affinityGroup == 0 {
+				continue
+			}
+			if _, ok := c.dropTasks[table.GetID()]; ok {
+				continue
+			}
+			groups[table.GetShardID()] = append(groups[table.GetShardID()], table.affinityGroup)
+		}
+	}
+	return groups
+}
+
+// CheckAntiAffinity returns the violations of the anti-affinity groups of all the schemas.
+func (c *Cluster) CheckAntiAffinity() []AntiAffinityViolation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.checkAntiAffinityLocked()
+}
+
+// checkAntiAffinityLocked compares the spread of every anti-affinity group with the most even one, so a violation is
+// only reported if the tables of the group could be spread better with the current shards and their owners.
+func (c *Cluster) checkAntiAffinityLocked() []AntiAffinityViolation {
+	violations := make([]AntiAffinityViolation, 0)
+	for _, schema := range c.schemasCache {
+		groups := make(map[uint64]struct{})
+		for _, table := range schema.tableMap {
+			if table.affinityGroup != 0 {
+				groups[table.affinityGroup] = struct{}{}
+			}
+		}
+		if len(groups) == 0 {
+			continue
+		}
+
+		nodes := make(map[string]struct{})
+		for _, shardID := range schema.shardIDs {
+			if shard, ok := c.shardsCache[shardID]; ok && shard.GetNode() != "" {
+				nodes[shard.GetNode()] = struct{}{}
+			}
+		}
+		for group := range groups {
+			spread := c.groupSpreadLocked(schema, group)
+			shardLimit := ceilDiv(len(spread.tableIDs), len(schema.shardIDs))
+			for shardID, count := range spread.shardCounts {
+				if count > shardLimit {
+					violations = append(violations, AntiAffinityViolation{SchemaName: schema.GetName(), Group: group,
+						Kind: AntiAffinitySameShard, ShardID: shardID, Count: count, Limit: shardLimit})
+				}
+			}
+			nodeLimit := ceilDiv(len(spread.tableIDs), len(nodes))
+			for node, count := range spread.nodeCounts {
+				if count > nodeLimit {
+					violations = append(violations, AntiAffinityViolation{SchemaName: schema.GetName(), Group: group,
+						Kind: AntiAffinitySameNode, Node: node, Count: count, Limit: nodeLimit})
+				}
+			}
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.SchemaName != b.SchemaName {
+			return a.SchemaName < b.SchemaName
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.ShardID != b.ShardID {
+			return a.ShardID < b.ShardID
+		}
+		return a.Node < b.Node
+	})
+	antiAffinityViolationsGauge.WithLabelValues(c.metaData.GetName()).Set(float64(len(violations)))
+	return violations
+}
+
+func ceilDiv(a, b int) int {
+	if b <= 0 {
+		return a
+	}
+	return (a + b - 1) / b
+}
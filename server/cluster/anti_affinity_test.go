@@ -0,0 +1,107 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+)
+
+// createPartitions creates the partitions of the partitioned table in the anti-affinity group, and returns the number
+// of the partitions on every shard and node.
+func createPartitions(ctx context.Context, re *require.Assertions, manager Manager, cluster *Cluster, table string,
+	group uint64, partitionNum int,
+) (map[uint32]int, map[string]int) {
+	shardCounts, nodeCounts := make(map[uint32]int), make(map[string]int)
+	for i := 0; i < partitionNum; i++ {
+		partition, err := manager.AllocTableID(WithAntiAffinityGroup(ctx, group), testClusterName, "public",
+			fmt.Sprintf("__%s_%d", table, i))
+		re.NoError(err)
+		re.Equal(group, partition.GetAffinityGroup())
+		shardCounts[partition.GetShardID()]++
+		shardTables, err := cluster.GetShardTables([]uint32{partition.GetShardID()})
+		re.NoError(err)
+		nodeCounts[shardTables[partition.GetShardID()].Node]++
+	}
+	return shardCounts, nodeCounts
+}
+
+func TestAntiAffinity(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 4, 1, testShardTotal)
+	re.NoError(err)
+	for i, node := range []string{"a", "b", "c", "d"} {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for shardID := uint32(i * 2); shardID < uint32(i*2+2); shardID++ {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	}
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	// The partitions of the small table are spread over all the nodes though the plain tables take some shards.
+	for i := 0; i < 2; i++ {
+		table, err := manager.AllocTableID(ctx, testClusterName, "public", fmt.Sprintf("table%d", i))
+		re.NoError(err)
+		re.Zero(table.GetAffinityGroup())
+	}
+	shardCounts, nodeCounts := createPartitions(ctx, re, manager, cluster, "small", 200, 4)
+	re.Len(shardCounts, 4)
+	re.Equal(map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, nodeCounts)
+
+	// The 8 partitions are spread over all the shards and evenly over all the nodes.
+	shardCounts, nodeCounts = createPartitions(ctx, re, manager, cluster, "large", 100, 8)
+	re.Len(shardCounts, testShardTotal)
+	re.Equal(map[string]int{"a": 2, "b": 2, "c": 2, "d": 2}, nodeCounts)
+
+	// The partitions share the shards if there are more partitions than shards.
+	shardCounts, nodeCounts = createPartitions(ctx, re, manager, cluster, "huge", 300, 10)
+	for _, count := range shardCounts {
+		re.LessOrEqual(count, 2)
+	}
+	for _, count := range nodeCounts {
+		re.LessOrEqual(count, 3)
+	}
+	re.Empty(cluster.CheckAntiAffinity())
+
+	// The retried creation persists the group of the table created without it.
+	joined, err := manager.AllocTableID(WithAntiAffinityGroup(ctx, 400), testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(uint64(400), joined.GetAffinityGroup())
+
+	// The node a taking over the shards of the dead node b holds 4 of the 8 partitions, while 3 is enough for the 3
+	// nodes left.
+	cluster.lock.Lock()
+	cluster.nodesCache["b"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < 4; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	violation := AntiAffinityViolation{SchemaName: "public", Group: 100, Kind: AntiAffinitySameNode, Node: "a", Count: 4, Limit: 3}
+	re.Contains(cluster.CheckAntiAffinity(), violation)
+	re.Contains(cluster.VerifyShardTableSets().AntiAffinityViolations, violation)
+
+	// The groups survive the reload.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	for name, table := range cluster.schemasCache["public"].tableMap {
+		re.Equal(table.GetAffinityGroup(), reloadedCluster.schemasCache["public"].tableMap[name].GetAffinityGroup())
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/server/audit"
+)
+
+type auditorKey struct{}
+
+// WithAuditor returns a context whose DDLs record the operations implied by them, e.g. the schema created along with
+// the table, with the auditor. The DDLs requested are recorded by the callers instead.
+func WithAuditor(ctx context.Context, auditor *audit.Logger) context.Context {
+	return context.WithValue(ctx, auditorKey{}, auditor)
+}
+
+// auditorFromContext returns the auditor carried by the ctx, and nil is returned if it is not set, which records
+// nothing.
+func auditorFromContext(ctx context.Context) *audit.Logger {
+	auditor, _ := ctx.Value(auditorKey{}).(*audit.Logger)
+	return auditor
+}
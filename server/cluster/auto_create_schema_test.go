@@ -0,0 +1,107 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink keeps the audit records written.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) Write(_ context.Context, record audit.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestAutoCreateSchema(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+
+	// The missing schema fails the creation with the dedicated code by default.
+	_, err = manager.AllocTableID(ctx, testClusterName, "tenant", "t0")
+	re.True(coderr.Is(err, coderr.SchemaNotFound))
+	code, ok := coderr.GetCauseCode(err)
+	re.True(ok)
+	re.Equal(http.StatusNotFound, code.ToHTTPCode())
+
+	opts := cluster.GetOptions()
+	opts.AutoCreateSchema = true
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+
+	// The concurrent creations into the missing schema create it only once.
+	sink := &recordingSink{}
+	auditor := audit.NewLogger(sink, "test")
+	ctx = WithAuditor(WithDDLOrigin(ctx, DDLOrigin{Peer: "127.0.0.1:8831", Identity: "ceresdb-0"}), auditor)
+	const tableNum = 16
+	tables := make([]*Table, tableNum)
+	errs := make([]error, tableNum)
+	var wg sync.WaitGroup
+	for i := 0; i < tableNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tables[i], errs[i] = manager.AllocTableID(ctx, testClusterName, "tenant", fmt.Sprintf("t%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < tableNum; i++ {
+		re.NoError(errs[i])
+		re.Equal(tables[0].GetSchemaID(), tables[i].GetSchemaID())
+	}
+	schemas, err := s.ListSchemas(ctx, cluster.clusterID)
+	re.NoError(err)
+	tenants := 0
+	for _, schema := range schemas {
+		if schema.GetName() == "tenant" {
+			tenants++
+			re.Equal(tables[0].GetSchemaID(), schema.GetId())
+		}
+	}
+	re.Equal(1, tenants)
+
+	// The creation of the schema is audited as the one of the origin of the table.
+	auditor.Close()
+	re.Len(sink.records, 1)
+	re.Equal(string(ProcedureCreateSchema), sink.records[0].Operation)
+	re.Equal("tenant", sink.records[0].Target)
+	re.Equal("ceresdb-0", sink.records[0].Actor)
+	re.Equal(audit.ResultSuccess, sink.records[0].Result)
+
+	// The schema created is loaded as the others.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	stats, err := reloaded.GetSchemaStats(ctx, testClusterName, "tenant")
+	re.NoError(err)
+	re.Len(stats.ShardIDs, testShardTotal)
+}
@@ -0,0 +1,858 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/CeresDB/ceresmeta/server/hook"
+	"github.com/CeresDB/ceresmeta/server/id"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// shardUnavailableCheckInterval is the interval to check whether the unavailable shard recovers.
+const shardUnavailableCheckInterval = time.Millisecond * 100
+
+type Cluster struct {
+	clusterID uint32
+
+	// RWMutex is used to protect following fields.
+	lock     sync.RWMutex
+	metaData *metapb.Cluster
+	// schemaName -> schema
+	schemasCache map[string]*Schema
+	// shardID -> shard
+	shardsCache map[uint32]*Shard
+	// tableID -> task dropping the table in background
+	dropTasks map[uint64]*dropTableTask
+	// tableID set of the partitioned tables being dropped along with their sub-tables
+	deletingTables map[uint64]struct{}
+	// shardID -> freeze of the shard version
+	frozenShards map[uint32]*shardFreeze
+	// shardID set of the shards whose DDLs are drained before they are moved
+	drainingShards map[uint32]struct{}
+	// (schemaName, tableName) -> reservation of the table name
+	tableReservations map[tableNameKey]*tableReservation
+	// nodeName -> node
+	nodesCache map[string]*Node
+	options    Options
+	status     ClusterStatus
+	labels     ClusterLabels
+	// clusterInfoSeries are the label values of the series of the info metric of the cluster, and nil if not set.
+	clusterInfoSeries []string
+	// topologyGeneration is bumped whenever the nodes or the owners of the shards change.
+	topologyGeneration uint64
+	// shardID -> number of the DDLs on the shard
+	shardDDLCounts map[uint32]uint64
+	// nodeName -> token allowing the node to restart
+	restartTokens map[string]*restartToken
+	// topologyCache caches the assembled topology of the cluster.
+	topologyCache topologyCache
+	// failedProcedures are the latest failed procedures from the oldest.
+	failedProcedures []FailedProcedure
+	// tableID -> table left by a failed creation whose compensation fails too
+	uncompensatedTables map[uint64]UncompensatedTable
+	// tableID -> table created with the topology of its shard not persisted yet
+	pendingReconciles map[uint64]PendingReconcile
+	// shardID -> shard whose owner is ambiguous found by the heartbeats
+	ambiguousShardOwners map[uint32]AmbiguousShardOwner
+	// shardID -> latest ownership change found by the heartbeats and not persisted yet
+	pendingOwnerChanges map[uint32]*ShardOwnerChange
+	// flushingOwnerChanges tells whether the pendingOwnerChanges are being persisted outside the lock.
+	flushingOwnerChanges bool
+	// duplicateTableIDs are the ids held by more than one table found by the latest load.
+	duplicateTableIDs []DuplicateTableID
+	// stale tells the caches are older than the storage, which is found by a rejected write of the shard topologies or
+	// by the watch of a follower, and the cluster is reloaded before it is used.
+	stale bool
+
+	// decisionMu protects the seededDecisions, which makes the choices of the creations if the DecisionSeed is set, so
+	// that the source is got before waiting for the lock.
+	decisionMu      sync.Mutex
+	seededDecisions *SeededSource
+
+	// nodeName -> max number of the shards the node may own, and zero means unlimited, which is protected by the lock.
+	nodeShardCapacities map[string]uint32
+
+	// heartbeatMu protects the fields below, which are used by the fast path of the heartbeats without the lock. It
+	// is never held while waiting for the lock or the storage.
+	heartbeatMu   sync.Mutex
+	heartbeatView *heartbeatView
+	// nodeName -> latest touch of the node not applied yet
+	pendingTouches map[string]heartbeatTouch
+
+	// hotTables and routeStats are goroutine safe and not protected by the lock.
+	hotTables  *hotTables
+	routeStats *tableRouteStats
+
+	shardFreezeTTL         time.Duration
+	dropTableMaxAttempts   int
+	dropTableRetryInterval time.Duration
+	dropTableFenceTimeout  time.Duration
+
+	storage       storage.Storage
+	schemaIDAlloc id.Allocator
+	tableIDAlloc  id.Allocator
+	// gapFreeTableIDAlloc shares the end id with the tableIDAlloc, and it is used if the GapFreeTableID option is set.
+	gapFreeTableIDAlloc *id.GapFreeAllocator
+	// schemaTableIDAlloc is partitioned by the ids of the schemas, and it is used instead of the tableIDAlloc if the
+	// TableIDAllocScope is TableIDAllocScopeSchema.
+	schemaTableIDAlloc *id.PartitionedAllocator
+}
+
+func NewCluster(meta *metapb.Cluster, storage storage.Storage, schemaIDAlloc, tableIDAlloc id.Allocator,
+	schemaTableIDAlloc *id.PartitionedAllocator,
+) *Cluster {
+	return &Cluster{
+		clusterID:     meta.GetId(),
+		metaData:      meta,
+		schemasCache:  make(map[string]*Schema),
+		shardsCache:   make(map[uint32]*Shard),
+		dropTasks:     make(map[uint64]*dropTableTask),
+		frozenShards:  make(map[uint32]*shardFreeze),
+		nodesCache:    make(map[string]*Node),
+		options:       defaultOptions(),
+		status:        defaultClusterStatus(),
+		storage:       storage,
+		schemaIDAlloc: schemaIDAlloc,
+		tableIDAlloc:  tableIDAlloc,
+
+		gapFreeTableIDAlloc: id.NewGapFreeAllocator(storage, makeTableIDAllocKey(meta.GetId())),
+		schemaTableIDAlloc:  schemaTableIDAlloc,
+
+		shardDDLCounts: make(map[uint32]uint64),
+		restartTokens:  make(map[string]*restartToken),
+		hotTables:      newHotTables(defaultHotTableCapacity),
+		routeStats:     newTableRouteStats(defaultRouteSampleRate),
+
+		uncompensatedTables: make(map[uint64]UncompensatedTable),
+		pendingReconciles:   make(map[uint64]PendingReconcile),
+
+		ambiguousShardOwners: make(map[uint32]AmbiguousShardOwner),
+		pendingOwnerChanges:  make(map[uint32]*ShardOwnerChange),
+
+		tableReservations: make(map[tableNameKey]*tableReservation),
+
+		drainingShards: make(map[uint32]struct{}),
+
+		nodeShardCapacities: make(map[string]uint32),
+		pendingTouches:      make(map[string]heartbeatTouch),
+
+		deletingTables: make(map[uint64]struct{}),
+
+		// The generation starts from the creation time so that it won't go back after restarting.
+		topologyGeneration:     uint64(time.Now().UnixNano()),
+		shardFreezeTTL:         defaultShardFreezeTTL,
+		dropTableMaxAttempts:   defaultDropTableMaxAttempts,
+		dropTableRetryInterval: defaultDropTableRetryInterval,
+		dropTableFenceTimeout:  defaultDropTableFenceTimeout,
+	}
+}
+
+func (c *Cluster) GetClusterID() uint32 {
+	return c.clusterID
+}
+
+func (c *Cluster) Name() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.metaData.GetName()
+}
+
+func (c *Cluster) GetShardTotal() uint32 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.metaData.GetShardTotal()
+}
+
+// rename persists the new name of the cluster and the name index in a single transaction.
+func (c *Cluster) rename(ctx context.Context, oldName, newName string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	meta := proto.Clone(c.metaData).(*metapb.Cluster)
+	meta.Name = newName
+	if err := c.storage.PutClusterWithName(ctx, meta, oldName); err != nil {
+		return err
+	}
+	c.metaData = meta
+	c.observeClusterInfoLocked()
+	return nil
+}
+
+// lockForDDL takes the lock of the cluster for the DDL carried by the ctx, and the DDL is reported as blocked while
+// waiting for the lock.
+func (c *Cluster) lockForDDL(ctx context.Context) {
+	endStep := procedure.BeginStep(ctx, procedure.StepQueueWait)
+	endWait := procedure.BeginWait(ctx, procedure.WaitClusterLock, fmt.Sprintf("cluster:%d", c.clusterID))
+	c.lock.Lock()
+	endWait()
+	endStep()
+}
+
+// Load loads the schemas, tables and shards of the cluster from the storage into the memory.
+func (c *Cluster) Load(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.loadLocked(ctx)
+}
+
+// MarkStale marks the caches of the cluster stale, e.g. once the server is no longer the leader.
+func (c *Cluster) MarkStale() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stale = true
+}
+
+// ReloadIfStale reloads the cluster if it is marked stale, e.g. by a rejected write of the shard topologies built from
+// the caches loaded before a former leader writes them, or by the changes written by the leader to a follower.
+func (c *Cluster) ReloadIfStale(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.stale {
+		return nil
+	}
+	if err := c.loadLocked(ctx); err != nil {
+		return errors.Wrap(err, "reload stale cluster")
+	}
+	c.stale = false
+	log.Debug("reload stale cluster", zap.String("cluster", c.metaData.GetName()))
+	return nil
+}
+
+// markStaleOnConflictLocked marks the cluster stale if the err of the storage tells the shard topologies are written by
+// others since they are loaded.
+func (c *Cluster) markStaleOnConflictLocked(err error) {
+	if coderr.Is(err, coderr.Conflict) {
+		c.stale = true
+	}
+}
+
+func (c *Cluster) loadLocked(ctx context.Context) error {
+	shardTotal := c.metaData.GetShardTotal()
+	shardIDs := make([]uint32, 0, shardTotal)
+	for i := uint32(0); i < shardTotal; i++ {
+		shardIDs = append(shardIDs, i)
+	}
+	topologies, err := c.storage.ListShardTopologies(ctx, c.clusterID, shardIDs)
+	if err != nil {
+		return errors.Wrap(err, "load shard topologies")
+	}
+	ownerChanges, err := c.loadShardOwnerChanges(ctx)
+	if err != nil {
+		return err
+	}
+	shardsCache := make(map[uint32]*Shard, len(shardIDs))
+	for i, shardID := range shardIDs {
+		shard := newShard(shardID, topologies[i])
+		// The owners of the shards are only known from the heartbeats, so keep them.
+		if oldShard, ok := c.shardsCache[shardID]; ok {
+			shard.node = oldShard.node
+			shard.unassignedSince = oldShard.unassignedSince
+		}
+		shard.lastOwnerChange = ownerChanges[shardID]
+		shardsCache[shardID] = shard
+	}
+
+	options, err := c.loadOptions(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := c.loadStatus(ctx)
+	if err != nil {
+		return err
+	}
+	labels, err := c.loadLabels(ctx)
+	if err != nil {
+		return err
+	}
+
+	schemas, err := c.storage.ListSchemas(ctx, c.clusterID)
+	if err != nil {
+		return errors.Wrap(err, "load schemas")
+	}
+	hints, err := c.storage.ListSchemaShardCountHints(ctx, c.clusterID)
+	if err != nil {
+		return errors.Wrap(err, "load schema shard count hints")
+	}
+	schemasCache := make(map[string]*Schema, len(schemas))
+	tableReservations := make(map[tableNameKey]*tableReservation)
+	deletingTables := make(map[uint64]struct{})
+	dropTasks := make([]*dropTableTask, 0)
+	reconciles := make([]PendingReconcile, 0)
+	for _, schemaMeta := range schemas {
+		schema := newSchema(schemaMeta, hints[schemaMeta.GetId()], shardTotal)
+		tables, err := c.storage.ListTables(ctx, c.clusterID, schemaMeta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "load tables, schema:%s", schemaMeta.GetName())
+		}
+		tableSchemas, err := c.loadTableSchemas(ctx, schemaMeta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "load table schemas, schema:%s", schemaMeta.GetName())
+		}
+		affinityGroups, err := c.storage.ListTableAffinityGroups(ctx, c.clusterID, schemaMeta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "load table anti-affinity groups, schema:%s", schemaMeta.GetName())
+		}
+		encodedMarkers, err := c.storage.ListDeletingTables(ctx, c.clusterID, schemaMeta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "load deleting tables, schema:%s", schemaMeta.GetName())
+		}
+		markers := make(map[uint64]tableDeletingMarker, len(encodedMarkers))
+		for tableID, value := range encodedMarkers {
+			marker, err := decodeDeletingMarker(tableID, value)
+			if err != nil {
+				return errors.Wrapf(err, "load deleting tables, schema:%s", schemaMeta.GetName())
+			}
+			markers[tableID] = marker
+			if !marker.Reconcile {
+				deletingTables[tableID] = struct{}{}
+			}
+		}
+		if err := c.loadTableReservations(ctx, schemaMeta.GetId(), schemaMeta.GetName(), tableReservations); err != nil {
+			return err
+		}
+		for _, tableMeta := range tables {
+			schema.tableMap[tableMeta.GetName()] = &Table{
+				schema:        schemaMeta,
+				meta:          tableMeta,
+				tableSchema:   tableSchemas[tableMeta.GetId()],
+				affinityGroup: affinityGroups[tableMeta.GetId()],
+			}
+			if shard, ok := shardsCache[tableMeta.GetShardId()]; ok && shard.hasTable(tableMeta.GetId()) {
+				continue
+			}
+			// The table absent from its shard with a deleting marker is being dropped, or its creation is not
+			// finished, and both of them are dropped by the leader unless the creation is to be reconciled. The one
+			// without a marker is kept for the table set verification to find.
+			marker, ok := markers[tableMeta.GetId()]
+			if !ok {
+				log.Warn("table absent from its shard without deleting marker", zap.String("cluster", c.metaData.GetName()),
+					zap.String("schema", schemaMeta.GetName()), zap.String("table", tableMeta.GetName()),
+					zap.Uint64("table-id", tableMeta.GetId()), zap.Uint32("shard", tableMeta.GetShardId()))
+				continue
+			}
+			if marker.Reconcile {
+				reconciles = append(reconciles, newPendingReconcile(schemaMeta.GetName(), tableMeta))
+				continue
+			}
+			if _, ok := c.dropTasks[tableMeta.GetId()]; !ok {
+				dropTasks = append(dropTasks, &dropTableTask{
+					schemaID:       schemaMeta.GetId(),
+					schemaName:     schemaMeta.GetName(),
+					table:          tableMeta,
+					awaitingLeader: true,
+				})
+			}
+		}
+		schemasCache[schemaMeta.GetName()] = schema
+	}
+	routeStats, routeStatsSince, err := c.loadTableRouteStats(ctx, schemasCache)
+	if err != nil {
+		return err
+	}
+	nodeShardCapacities, err := c.storage.ListNodeShardCapacities(ctx, c.clusterID)
+	if err != nil {
+		return errors.Wrap(err, "load node shard capacities")
+	}
+
+	c.shardsCache = shardsCache
+	c.dropHeartbeatViewLocked()
+	c.schemasCache = schemasCache
+	c.tableReservations = tableReservations
+	c.deletingTables = deletingTables
+	c.options = options
+	c.setDecisionSeed(options.DecisionSeed)
+	c.status = status
+	c.labels = labels
+	c.observeClusterInfoLocked()
+	c.nodeShardCapacities = nodeShardCapacities
+	c.routeStats.load(routeStats, routeStatsSince)
+	for _, shard := range shardsCache {
+		c.observeShardTopologySizeLocked(shard)
+	}
+	for _, task := range dropTasks {
+		c.dropTasks[task.table.GetId()] = task
+	}
+	c.loadPendingReconcilesLocked(reconciles)
+	return c.checkTableIDsLocked(ctx)
+}
+
+// GetOrCreateSchema returns the schema if it exists, otherwise a new schema will be created with the shard count hint.
+// The shard count hint decides how many shards the tables of the schema will be spread over, and zero means all the
+// shards of the cluster. The hint of an existing schema won't be changed.
+func (c *Cluster) GetOrCreateSchema(ctx context.Context, schemaName string, shardCountHint uint32) (*Schema, error) {
+	c.lockForDDL(ctx)
+	defer c.lock.Unlock()
+
+	if schema, ok := c.schemasCache[schemaName]; ok {
+		return schema, nil
+	}
+
+	start := time.Now()
+	schema, err := c.createSchemaLocked(ctx, schemaName, shardCountHint)
+	c.observeProcedureLocked(ProcedureCreateSchema, start, err)
+	return schema, err
+}
+
+// autoCreateSchemaLocked creates the missing schema of the table being created, which is recorded by the auditor
+// carried by the ctx as the creation of the schema by the origin of the creation of the table.
+func (c *Cluster) autoCreateSchemaLocked(ctx context.Context, schemaName string) (*Schema, error) {
+	start := time.Now()
+	schema, err := c.createSchemaLocked(ctx, schemaName, 0)
+	c.observeProcedureLocked(ProcedureCreateSchema, start, err)
+
+	origin := DDLOriginFromContext(ctx)
+	record := audit.Record{
+		Cluster:     c.metaData.GetName(),
+		Environment: c.labels.Environment,
+		Operation:   string(ProcedureCreateSchema),
+		Actor:       origin.Actor(),
+		Peer:        origin.Peer,
+		Target:      schemaName,
+		Result:      audit.ResultSuccess,
+	}
+	if err != nil {
+		record.Result = audit.ResultFailure
+		record.Error = err.Error()
+	}
+	auditorFromContext(ctx).Log(record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "auto create schema, schema:%s", schemaName)
+	}
+	log.Info("auto create schema", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName))
+	return schema, nil
+}
+
+func (c *Cluster) createSchemaLocked(ctx context.Context, schemaName string, shardCountHint uint32) (*Schema, error) {
+	if err := c.checkHealthyNodesLocked(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.checkTopologyGenerationLocked(ctx); err != nil {
+		return nil, err
+	}
+	shardTotal := c.metaData.GetShardTotal()
+	if shardCountHint > shardTotal {
+		return nil, ErrInvalidShardCountHint.WithCausef("hint:%d exceeds shard total:%d", shardCountHint, shardTotal)
+	}
+
+	endStep := procedure.BeginStep(ctx, procedure.StepIDAlloc)
+	schemaID, err := c.schemaIDAlloc.Alloc(ctx)
+	endStep()
+	if err != nil {
+		return nil, errors.Wrapf(err, "alloc schema id, schema:%s", schemaName)
+	}
+
+	schemaMeta := &metapb.Schema{
+		Id:        uint32(schemaID),
+		ClusterId: c.clusterID,
+		Name:      schemaName,
+	}
+	// Persist the hint before the schema so that a schema never exists without its hint.
+	if shardCountHint > 0 {
+		if err := c.storage.PutSchemaShardCountHint(ctx, c.clusterID, schemaMeta.GetId(), shardCountHint); err != nil {
+			return nil, errors.Wrapf(err, "put schema shard count hint, schema:%s", schemaName)
+		}
+	}
+	if err := c.storage.PutSchemas(ctx, c.clusterID, []*metapb.Schema{schemaMeta}); err != nil {
+		return nil, errors.Wrapf(err, "put schema, schema:%s", schemaName)
+	}
+
+	schema := newSchema(schemaMeta, shardCountHint, shardTotal)
+	c.schemasCache[schemaName] = schema
+	c.invalidateTopologyCacheLocked()
+
+	log.Info("create schema", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName),
+		zap.Uint32("shard-count-hint", shardCountHint), zap.Uint32s("shard-ids", schema.shardIDs),
+		zap.Any("origin", DDLOriginFromContext(ctx)))
+	return schema, nil
+}
+
+// GetOrCreateTable returns the table if it exists, otherwise a new table will be created and placed on the shard with
+// the fewest tables in the effective shard set of the schema.
+// If the selected shard is owned by a dead node, the ShardUnavailablePolicy of the cluster decides whether to fail,
+// reselect another shard or wait for the node to recover.
+// The choices of the creation are made by the DecisionSource, and the trace of them is logged if the creation fails so
+// that the failure can be replayed.
+func (c *Cluster) GetOrCreateTable(ctx context.Context, schemaName, tableName string) (*Table, error) {
+	recorder := NewDecisionRecorder(c.decisionSource(ctx))
+	table, err := c.getOrCreateTableWithRetry(WithDecisionSource(ctx, recorder), schemaName, tableName)
+	if err != nil {
+		if trace := recorder.Trace(); len(trace.Decisions) > 0 {
+			encoded, _ := json.Marshal(trace)
+			log.Warn("fail to create table, record decision trace", zap.String("cluster", c.Name()),
+				zap.String("schema", schemaName), zap.String("table", tableName), zap.ByteString("trace", encoded),
+				zap.Error(err))
+		}
+	}
+	return table, err
+}
+
+// getOrCreateTableWithRetry retries the creation on the unavailable shard until the waits decided add up to the wait
+// timeout, which is counted by the waits instead of the wall clock so that the attempts are reproducible. The creation
+// also waits once for the table of the same name being dropped in background to settle.
+func (c *Cluster) getOrCreateTableWithRetry(ctx context.Context, schemaName, tableName string) (*Table, error) {
+	start := time.Now()
+	fenced := false
+	var waited time.Duration
+	for attempt := 1; ; attempt++ {
+		table, unavailableShard, dropSettled, err := c.getOrCreateTable(ctx, schemaName, tableName, start)
+		if dropSettled != nil {
+			// The drop may start again after the fence.
+			if fenced {
+				err = ErrTableDropInFlight.WithCausef("schema:%s, table:%s", schemaName, tableName)
+			} else {
+				err = c.waitForDropTableFence(ctx, schemaName, tableName, dropSettled)
+			}
+			if err != nil {
+				ObserveProcedure(c.Name(), ProcedureCreateTable, start, ProcedureOutcomeOf(err))
+				return nil, err
+			}
+			fenced = true
+			continue
+		}
+		if unavailableShard == nil {
+			return table, err
+		}
+
+		if waited >= c.GetOptions().shardUnavailableWaitTimeout() {
+			ObserveProcedure(c.Name(), ProcedureCreateTable, start, ProcedureTimedOut)
+			return nil, ErrShardUnavailable.WithCausef("wait timeout, shard:%d, node:%s, table:%s",
+				unavailableShard.GetID(), unavailableShard.GetNode(), tableName)
+		}
+		wait, err := decisionSourceFromContext(ctx).RetryWait(tableName, attempt)
+		if err != nil {
+			return nil, err
+		}
+		endWait := procedure.BeginWait(ctx, procedure.WaitShardUnavailable,
+			fmt.Sprintf("shard:%d, node:%s", unavailableShard.GetID(), unavailableShard.GetNode()))
+		select {
+		case <-ctx.Done():
+			endWait()
+			ObserveProcedure(c.Name(), ProcedureCreateTable, start, ProcedureOutcomeOf(ctx.Err()))
+			return nil, ErrShardUnavailable.WithCausef("shard:%d, node:%s, table:%s, err:%v",
+				unavailableShard.GetID(), unavailableShard.GetNode(), tableName, ctx.Err())
+		case <-time.After(wait):
+			endWait()
+		}
+		waited += wait
+	}
+}
+
+// getOrCreateTable returns the unavailable shard if the table should wait for it to recover, or the channel closed
+// once the drop of the table of the same name settles if the table should wait for the drop. The creation of the
+// table is measured from the start.
+func (c *Cluster) getOrCreateTable(ctx context.Context, schemaName, tableName string, start time.Time) (*Table, *Shard, <-chan struct{}, error) {
+	c.lockForDDL(ctx)
+	defer c.lock.Unlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		if !c.options.AutoCreateSchema {
+			return nil, nil, nil, ErrSchemaNotFoundForTable.WithCausef("schema:%s, table:%s", schemaName, tableName)
+		}
+		var err error
+		if schema, err = c.autoCreateSchemaLocked(ctx, schemaName); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if task := c.inFlightDropTableLocked(schemaName, tableName); task != nil {
+		return nil, nil, task.settled, nil
+	}
+	if table, ok := schema.getTable(tableName); ok {
+		if _, ok := c.dropTasks[table.GetID()]; ok || c.inDeletingFamilyLocked(table) {
+			return nil, nil, nil, ErrTableDeleting.WithCausef("schema:%s, table:%s", schemaName, tableName)
+		}
+		if err := c.checkTableReservationLocked(ctx, schemaName, tableName, table); err != nil {
+			return nil, nil, nil, err
+		}
+		table, err := c.setTableAffinityGroupLocked(ctx, schema, table, antiAffinityGroupFromContext(ctx))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c.recordRouteLookup(schemaName, table)
+		return table, nil, nil, nil
+	}
+	// The sub-table can't join the partitioned table being dropped.
+	if group := antiAffinityGroupFromContext(ctx); group != 0 {
+		if _, ok := c.deletingTables[group]; ok {
+			return nil, nil, nil, ErrTableDeleting.WithCausef("schema:%s, table:%s, group:%d", schemaName, tableName, group)
+		}
+	}
+
+	table, unavailableShard, err := c.createTableInSchemaLocked(ctx, schema, tableName)
+	if unavailableShard == nil {
+		c.observeProcedureLocked(ProcedureCreateTable, start, err)
+	}
+	return table, unavailableShard, nil, err
+}
+
+func (c *Cluster) createTableInSchemaLocked(ctx context.Context, schema *Schema, tableName string) (*Table, *Shard, error) {
+	schemaName := schema.GetName()
+	if err := c.checkHealthyNodesLocked(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkTopologyGenerationLocked(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkTableReservationLocked(ctx, schemaName, tableName, nil); err != nil {
+		return nil, nil, err
+	}
+
+	taken, err := c.checkTableNameScopeLocked(schema, tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The shards holding the name, being drained or whose topologies are too large are never picked, and the shards
+	// whose versions are frozen are skipped unless the ctx carries the token.
+	placeable := func(shard *Shard) string {
+		if _, ok := taken[shard.GetID()]; ok {
+			return PlacementConstraintNameScope
+		}
+		if c.checkShardDrainingLocked(shard.GetID()) != nil {
+			return PlacementConstraintNotDraining
+		}
+		if c.checkShardTopologySizeLocked(shard) != nil {
+			return PlacementConstraintTopologySize
+		}
+		return ""
+	}
+	notFrozen := func(shard *Shard) string {
+		if violated := placeable(shard); violated != "" {
+			return violated
+		}
+		if c.checkShardFrozenLocked(ctx, shard.GetID()) != nil {
+			return PlacementConstraintNotFrozen
+		}
+		return ""
+	}
+	group := antiAffinityGroupFromContext(ctx)
+	record := newPlacementRecord(group)
+	shard, err := c.pickShardLocked(ctx, schema, tableName, group, placeable, record)
+	if err != nil {
+		// No shard is left to place the table if all of them are drained, and the creation should be retried, or if
+		// all of them are too large, and the shards should be split.
+		for _, shardID := range schema.shardIDs {
+			if drainErr := c.checkShardDrainingLocked(shardID); drainErr != nil {
+				return nil, nil, drainErr
+			}
+		}
+		for _, shardID := range schema.shardIDs {
+			if shard, ok := c.shardsCache[shardID]; ok {
+				if sizeErr := c.checkShardTopologySizeLocked(shard); sizeErr != nil {
+					return nil, nil, sizeErr
+				}
+			}
+		}
+		return nil, nil, err
+	}
+	if frozenErr := c.checkShardFrozenLocked(ctx, shard.GetID()); frozenErr != nil {
+		record.reselect(shard, PlacementConstraintNotFrozen)
+		if shard, err = c.pickShardLocked(ctx, schema, tableName, group, notFrozen, record); err != nil {
+			return nil, nil, frozenErr
+		}
+	}
+	if !c.isShardAvailableLocked(shard) {
+		switch c.options.ShardUnavailablePolicy {
+		case ShardUnavailablePolicyReselect:
+			record.reselect(shard, PlacementConstraintAvailable)
+			reselected, err := c.pickShardLocked(ctx, schema, tableName, group, func(shard *Shard) string {
+				if violated := notFrozen(shard); violated != "" {
+					return violated
+				}
+				if !c.isShardAvailableLocked(shard) {
+					return PlacementConstraintAvailable
+				}
+				return ""
+			}, record)
+			if err != nil {
+				return nil, nil, ErrShardUnavailable.WithCausef("no available shard, schema:%s, table:%s", schemaName, tableName)
+			}
+			log.Info("reselect shard for table", zap.String("table", tableName), zap.Uint32("unavailable-shard", shard.GetID()),
+				zap.String("node", shard.GetNode()), zap.Uint32("shard", reselected.GetID()))
+			shard = reselected
+		case ShardUnavailablePolicyWait:
+			return nil, shard, nil
+		default:
+			return nil, nil, ErrShardUnavailable.WithCausef("shard:%d, node:%s, table:%s", shard.GetID(), shard.GetNode(), tableName)
+		}
+	}
+
+	if log.DebugScopesActive() {
+		log.ScopedDebug(log.Entity{Cluster: c.metaData.GetName(), ShardID: shard.GetID(), HasShard: true, Table: tableName},
+			"place table", zap.String("schema", schemaName), zap.String("table", tableName),
+			zap.Uint32("shard", shard.GetID()), zap.Int("shard-tables", shard.GetTableCount()),
+			zap.Uint64("anti-affinity-group", group), zap.Any("placement", record))
+	}
+	createTable := c.createTableLocked
+	if c.options.GapFreeTableID {
+		createTable = c.createTableGapFreeLocked
+	}
+	tableMeta, newTopology, err := createTable(ctx, schema, shard, tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	shard.topology = newTopology
+	c.observeShardTopologySizeLocked(shard)
+	c.recordShardDDLLocked(shard.GetID())
+
+	table := &Table{schema: schema.meta, meta: tableMeta}
+	schema.tableMap[tableName] = table
+	c.invalidateTopologyCacheLocked()
+	c.useTableReservationLocked(ctx, schemaName, table)
+	log.Info("create table", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName),
+		zap.String("table", tableName), zap.Uint64("table-id", table.GetID()), zap.Uint32("shard", shard.GetID()),
+		zap.Any("origin", DDLOriginFromContext(ctx)))
+	c.putTablePlacementLocked(ctx, schema, table.GetID(), record)
+	hooksFromContext(ctx).Emit(hook.Event{
+		Type:    hook.EventTableCreated,
+		Cluster: c.metaData.GetName(),
+		Schema:  schemaName,
+		Table:   tableName,
+		TableID: table.GetID(),
+		ShardID: shard.GetID(),
+	})
+	// The table is created even if its group fails to be persisted, and the group is persisted again by the retry.
+	table, err = c.setTableAffinityGroupLocked(ctx, schema, table, group)
+	return table, nil, err
+}
+
+// pickShardLocked picks the shard with the fewest tables in the effective shard set of the schema for the table, and
+// the DecisionSource carried by the ctx picks one of the shards if the numbers of tables are equal, which is the first
+// one of the effective shard set by default. The shards and then the nodes holding fewer tables of the anti-affinity group are
+// preferred before that if the group is not zero, so the tables of the group fall back to the shared shards only if
+// the cluster is too small. The filter returns the constraint violated by the shard, which is never picked then, and
+// the candidates along with their scores and the choice are recorded by the record.
+func (c *Cluster) pickShardLocked(ctx context.Context, schema *Schema, tableName string, group uint64, filter func(*Shard) string, record *PlacementRecord) (*Shard, error) {
+	defer procedure.BeginStep(ctx, procedure.StepShardPick)()
+
+	spread := c.groupSpreadLocked(schema, group)
+	record.Candidates = record.Candidates[:0]
+	var candidates []*Shard
+	for _, shardID := range schema.shardIDs {
+		shard, ok := c.shardsCache[shardID]
+		if !ok {
+			return nil, ErrShardNotFound.WithCausef("shard:%d, schema:%s", shardID, schema.GetName())
+		}
+		candidate := PlacementCandidate{ShardID: shardID, Node: shard.GetNode(), Score: spread.score(shard)}
+		if filter != nil {
+			candidate.Rejected = filter(shard)
+		}
+		record.Candidates = append(record.Candidates, candidate)
+		if candidate.Rejected != "" {
+			continue
+		}
+		switch {
+		case len(candidates) == 0 || spread.prefers(shard, candidates[0]):
+			candidates = []*Shard{shard}
+		case !spread.prefers(candidates[0], shard):
+			candidates = append(candidates, shard)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrShardNotFound.WithCausef("no shard for schema:%s", schema.GetName())
+	}
+	if len(candidates) == 1 {
+		record.choose(candidates[0])
+		return candidates[0], nil
+	}
+	shardIDs := make([]uint32, 0, len(candidates))
+	for _, shard := range candidates {
+		shardIDs = append(shardIDs, shard.GetID())
+	}
+	shardID, err := decisionSourceFromContext(ctx).PickShard(tableName, shardIDs)
+	if err != nil {
+		return nil, err
+	}
+	record.markTied(shardIDs)
+	record.choose(c.shardsCache[shardID])
+	return c.shardsCache[shardID], nil
+}
+
+// decisionSource returns the source of the choices of the creation, which is the one carried by the ctx, the seeded
+// one of the cluster if the DecisionSeed is set, or the live one.
+func (c *Cluster) decisionSource(ctx context.Context) DecisionSource {
+	if source, ok := ctx.Value(decisionSourceKey{}).(DecisionSource); ok && source != nil {
+		return source
+	}
+
+	c.decisionMu.Lock()
+	defer c.decisionMu.Unlock()
+
+	if c.seededDecisions == nil {
+		return liveSource{}
+	}
+	return c.seededDecisions
+}
+
+// setDecisionSeed restarts the seeded source if the seed changes, and zero disables it.
+func (c *Cluster) setDecisionSeed(seed int64) {
+	c.decisionMu.Lock()
+	defer c.decisionMu.Unlock()
+
+	switch {
+	case seed == 0:
+		c.seededDecisions = nil
+	case c.seededDecisions == nil || c.seededDecisions.seed != seed:
+		c.seededDecisions = NewSeededSource(seed)
+	}
+}
+
+// SchemaStats describes how the tables of a schema are spread over its effective shard set.
+type SchemaStats struct {
+	SchemaID       uint32 `json:"schema_id"`
+	SchemaName     string `json:"schema_name"`
+	ShardCountHint uint32 `json:"shard_count_hint"`
+	// ShardIDs is the effective shard set of the schema.
+	ShardIDs []uint32 `json:"shard_ids"`
+	// ShardTableCounts maps the shard id to the number of the tables of the schema placed on it.
+	ShardTableCounts map[uint32]int `json:"shard_table_counts"`
+}
+
+func (c *Cluster) GetSchemaStats(schemaName string) (*SchemaStats, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+
+	shardTableCounts := make(map[uint32]int, len(schema.shardIDs))
+	for _, shardID := range schema.shardIDs {
+		shardTableCounts[shardID] = 0
+	}
+	for _, table := range schema.tableMap {
+		if _, ok := c.dropTasks[table.GetID()]; ok {
+			continue
+		}
+		shardTableCounts[table.GetShardID()]++
+	}
+
+	return &SchemaStats{
+		SchemaID:         schema.GetID(),
+		SchemaName:       schema.GetName(),
+		ShardCountHint:   schema.shardCountHint,
+		ShardIDs:         schema.GetShardIDs(),
+		ShardTableCounts: shardTableCounts,
+	}, nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const (
+	defaultTestTimeout = time.Second * 10
+	testRootPath       = "/ceresmeta"
+	testClusterName    = "ceresdbCluster1"
+	testShardTotal     = 8
+)
+
+func prepareEtcdStorage(t *testing.T) (storage.Storage, func()) {
+	client, clean := prepareEtcdClient(t)
+	return newTestStorage(client), clean
+}
+
+func prepareEtcdClient(t *testing.T) (*clientv3.Client, func()) {
+	re := require.New(t)
+	cfg := etcdutil.NewTestSingleConfig()
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+
+	clean := func() {
+		_ = client.Close()
+		etcd.Close()
+		etcdutil.CleanConfig(cfg)
+	}
+	return client, clean
+}
+
+func newTestStorage(client *clientv3.Client) storage.Storage {
+	return storage.NewStorageWithEtcdBackend(client, testRootPath, storage.Options{
+		MaxScanLimit: 100,
+		MinScanLimit: 10,
+		Observer:     procedure.StorageObserver{},
+	})
+}
+
+func TestReloadStaleCluster(t *testing.T) {
+	re := require.New(t)
+	client, clean := prepareEtcdClient(t)
+	defer clean()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The former leader and the new one load the same cluster with a single shard.
+	former := NewManagerImpl(newTestStorage(client), testRootPath)
+	_, err := former.CreateCluster(ctx, testClusterName, 1, 1, 1)
+	re.NoError(err)
+	_, err = former.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	leader := NewManagerImpl(newTestStorage(client), testRootPath)
+	re.NoError(leader.Load(ctx))
+	_, err = leader.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+
+	// The table created by the former leader from its stale cache is rejected, and the cluster is reloaded to serve
+	// the next one.
+	_, err = former.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.True(coderr.Is(err, coderr.Conflict), "err:%v", err)
+	c, err := former.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.NoError(c.ReloadIfStale(ctx))
+	_, err = former.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+
+	tables, err := former.GetShardTables(ctx, testClusterName, []uint32{0})
+	re.NoError(err)
+	re.Len(tables[0].Tables, 2)
+}
+
+func TestSelectSchemaShards(t *testing.T) {
+	re := require.New(t)
+
+	re.Equal([]uint32{0, 1, 2, 3}, selectSchemaShards(0, 0, 4))
+	re.Equal([]uint32{0, 1, 2, 3}, selectSchemaShards(0, 5, 4))
+	re.Equal([]uint32{3, 0}, selectSchemaShards(3, 2, 4))
+	re.Equal([]uint32{1}, selectSchemaShards(5, 1, 4))
+}
+
+func TestSchemaShardCountHint(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+
+	_, err = manager.CreateSchema(ctx, testClusterName, "invalid", testShardTotal+1)
+	re.Error(err)
+
+	small, err := manager.CreateSchema(ctx, testClusterName, "small", 2)
+	re.NoError(err)
+	re.Len(small.GetShardIDs(), 2)
+	large, err := manager.CreateSchema(ctx, testClusterName, "large", 0)
+	re.NoError(err)
+	re.Len(large.GetShardIDs(), testShardTotal)
+
+	// The hint of an existing schema is kept.
+	schema, err := manager.CreateSchema(ctx, testClusterName, "small", 4)
+	re.NoError(err)
+	re.Equal(uint32(2), schema.GetShardCountHint())
+
+	for i := 0; i < 16; i++ {
+		_, err := manager.AllocTableID(ctx, testClusterName, "small", fmt.Sprintf("small_table_%d", i))
+		re.NoError(err)
+		_, err = manager.AllocTableID(ctx, testClusterName, "large", fmt.Sprintf("large_table_%d", i))
+		re.NoError(err)
+	}
+
+	checkStats := func(m Manager) {
+		stats, err := m.GetSchemaStats(ctx, testClusterName, "small")
+		re.NoError(err)
+		re.Equal(small.GetShardIDs(), stats.ShardIDs)
+		re.Len(stats.ShardTableCounts, 2)
+		total := 0
+		for _, count := range stats.ShardTableCounts {
+			total += count
+		}
+		re.Equal(16, total)
+
+		stats, err = m.GetSchemaStats(ctx, testClusterName, "large")
+		re.NoError(err)
+		re.Len(stats.ShardIDs, testShardTotal)
+		total = 0
+		for _, count := range stats.ShardTableCounts {
+			total += count
+		}
+		re.Equal(16, total)
+	}
+	checkStats(manager)
+
+	// The hints and the placement should survive the reloading.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	checkStats(reloaded)
+
+	table, err := reloaded.AllocTableID(ctx, testClusterName, "small", "small_table_0")
+	re.NoError(err)
+	re.Contains(small.GetShardIDs(), table.GetShardID())
+}
+
+func TestShardUnavailablePolicy(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	firstShardID := schema.GetShardIDs()[0]
+
+	// Node a owns the first half of the shards and node b owns the others.
+	nodeInfo := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("b", 4, 5, 6, 7)))
+	// Make node a dead, and the shard owned by it is selected for the next table.
+	re.Less(firstShardID, uint32(4))
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "fail_fast")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+
+	re.Error(manager.SetClusterOptions(ctx, testClusterName, Options{ShardUnavailablePolicy: "unknown"}))
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{ShardUnavailablePolicy: ShardUnavailablePolicyReselect}))
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "reselect")
+	re.NoError(err)
+	re.Equal(uint32(4), table.GetShardID())
+
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:        ShardUnavailablePolicyWait,
+		ShardUnavailableWaitTimeoutMs: 200,
+	}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "wait_timeout")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+
+	// The options are persisted.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.Equal(ShardUnavailablePolicyWait, reloadedCluster.GetOptions().ShardUnavailablePolicy)
+
+	// The update keeps the options it doesn't change, and the invalid one changes nothing.
+	opts, err := manager.UpdateClusterOptions(ctx, testClusterName, func(opts *Options) {
+		opts.ShardUnavailableWaitTimeoutMs = 300
+	})
+	re.NoError(err)
+	re.Equal(ShardUnavailablePolicyWait, opts.ShardUnavailablePolicy)
+	_, err = manager.UpdateClusterOptions(ctx, testClusterName, func(opts *Options) {
+		opts.ShardUnavailableWaitTimeoutMs = 0
+	})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.Equal(opts, cluster.GetOptions())
+
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:        ShardUnavailablePolicyWait,
+		ShardUnavailableWaitTimeoutMs: uint64(defaultTestTimeout.Milliseconds()),
+	}))
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		_ = manager.RegisterNode(ctx, testClusterName, nodeInfo("a", 0, 1, 2, 3))
+	}()
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "wait")
+	re.NoError(err)
+	re.Equal(firstShardID, table.GetShardID())
+}
+
+func TestMinHealthyNodes(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 3, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "existing")
+	re.NoError(err)
+	for _, node := range []string{"a", "b", "c"} {
+		re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: node, Lease: 60}))
+	}
+	killNodes := func(nodes ...string) {
+		cluster.lock.Lock()
+		defer cluster.lock.Unlock()
+		for _, node := range nodes {
+			cluster.nodesCache[node].lastTouchTime = time.Now().Add(-time.Hour)
+		}
+	}
+
+	re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyReselect,
+		MinHealthyNodeRatio:    1.5,
+	}), coderr.InvalidParams))
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyReselect,
+		MinHealthyNodes:        2,
+	}))
+
+	killNodes("b", "c")
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "new")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Contains(err.Error(), "insufficient healthy nodes")
+	_, err = manager.CreateSchema(ctx, testClusterName, "new", 0)
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.True(coderr.Is(manager.DropTable(ctx, testClusterName, "public", "existing", false), coderr.ServiceUnavailable))
+	// The reads still work.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "existing")
+	re.NoError(err)
+
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "new")
+	re.NoError(err)
+
+	// Two of the three nodes are alive, which is below the ratio.
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyReselect,
+		MinHealthyNodeRatio:    0.9,
+	}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "new2")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "c", Lease: 60}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "new2")
+	re.NoError(err)
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// maxFailedProcedures is the number of the latest failed procedures kept by the cluster.
+const maxFailedProcedures = 64
+
+// CompensationAction is the kind of the actions taken to roll back a failed procedure.
+type CompensationAction string
+
+const (
+	// CompensationDeleteTable deletes the table persisted by a failed creation.
+	CompensationDeleteTable CompensationAction = "delete_table"
+)
+
+// CompensationOutcome is how a compensation action ends.
+type CompensationOutcome string
+
+const (
+	CompensationSucceeded CompensationOutcome = "succeeded"
+	CompensationFailed    CompensationOutcome = "failed"
+)
+
+// CompensationStep is an action taken to roll back a failed procedure.
+type CompensationStep struct {
+	Action CompensationAction `json:"action"`
+	// Target is the entity the action is taken on, such as the table.
+	Target  string              `json:"target"`
+	Outcome CompensationOutcome `json:"outcome"`
+	Error   string              `json:"error,omitempty"`
+	At      time.Time           `json:"at"`
+}
+
+// FailedProcedure is a failed procedure with the log of the compensations run for it, which is empty if nothing is
+// left to be rolled back.
+type FailedProcedure struct {
+	Type          ProcedureType      `json:"type"`
+	Target        string             `json:"target"`
+	Error         string             `json:"error"`
+	FailedAt      time.Time          `json:"failed_at"`
+	Compensations []CompensationStep `json:"compensations"`
+}
+
+// UncompensatedTable is a table left in the storage by a failed creation whose compensation fails too. It is reported
+// by the table set verification and its deletion is retried until it succeeds.
+type UncompensatedTable struct {
+	SchemaID   uint32
+	SchemaName string
+	TableID    uint64
+	TableName  string
+	FlaggedAt  time.Time
+}
+
+// ListFailedProcedures returns the latest failed procedures of the cluster from the oldest. They are kept in memory, so
+// they are lost when the leader of the ceresmeta changes.
+func (c *Cluster) ListFailedProcedures() []FailedProcedure {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	procedures := make([]FailedProcedure, 0, len(c.failedProcedures))
+	for _, procedure := range c.failedProcedures {
+		procedure.Compensations = append([]CompensationStep(nil), procedure.Compensations...)
+		procedures = append(procedures, procedure)
+	}
+	return procedures
+}
+
+// RetryCompensations retries to delete the uncompensated tables and to persist the shard topologies of the pending
+// reconciles, and the tables done are no longer flagged.
+func (c *Cluster) RetryCompensations(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reconcilePendingLocked(ctx)
+
+	for tableID, table := range c.uncompensatedTables {
+		if err := c.storage.DeleteTables(ctx, c.clusterID, table.SchemaID, []uint64{tableID}); err != nil {
+			log.Warn("fail to retry compensation of table", zap.String("cluster", c.metaData.GetName()),
+				zap.String("schema", table.SchemaName), zap.String("table", table.TableName),
+				zap.Uint64("table-id", tableID), zap.Error(err))
+			continue
+		}
+		delete(c.uncompensatedTables, tableID)
+		compensationsCounter.WithLabelValues(c.metaData.GetName(), string(CompensationDeleteTable),
+			string(CompensationSucceeded)).Inc()
+		log.Info("retry compensation of table", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", table.SchemaName), zap.String("table", table.TableName), zap.Uint64("table-id", tableID))
+	}
+}
+
+// compensateCreateTableLocked deletes the table persisted by the creation failed with the err, and the table is
+// flagged for the table set verification if it fails to be deleted.
+func (c *Cluster) compensateCreateTableLocked(ctx context.Context, schemaName string, table *metapb.Table, err error) {
+	target := fmt.Sprintf("%s.%s(%d)", schemaName, table.GetName(), table.GetId())
+	step := CompensationStep{Action: CompensationDeleteTable, Target: target, Outcome: CompensationSucceeded}
+	if deleteErr := c.storage.DeleteTables(ctx, c.clusterID, table.GetSchemaId(), []uint64{table.GetId()}); deleteErr != nil {
+		step.Outcome = CompensationFailed
+		step.Error = deleteErr.Error()
+		c.uncompensatedTables[table.GetId()] = UncompensatedTable{
+			SchemaID:   table.GetSchemaId(),
+			SchemaName: schemaName,
+			TableID:    table.GetId(),
+			TableName:  table.GetName(),
+			FlaggedAt:  time.Now(),
+		}
+	}
+	step.At = time.Now()
+	compensationsCounter.WithLabelValues(c.metaData.GetName(), string(step.Action), string(step.Outcome)).Inc()
+	log.Warn("compensate failed table creation", zap.String("cluster", c.metaData.GetName()),
+		zap.String("target", target), zap.String("outcome", string(step.Outcome)), zap.String("compensation-error", step.Error),
+		zap.Error(err), zap.Any("origin", DDLOriginFromContext(ctx)))
+
+	c.recordFailedProcedureLocked(ProcedureCreateTable, target, err, []CompensationStep{step})
+}
+
+func (c *Cluster) recordFailedProcedureLocked(typ ProcedureType, target string, err error, steps []CompensationStep) {
+	c.failedProcedures = append(c.failedProcedures, FailedProcedure{
+		Type:          typ,
+		Target:        target,
+		Error:         err.Error(),
+		FailedAt:      time.Now(),
+		Compensations: steps,
+	})
+	if len(c.failedProcedures) > maxFailedProcedures {
+		c.failedProcedures = c.failedProcedures[len(c.failedProcedures)-maxFailedProcedures:]
+	}
+}
+
+func (c *Cluster) listUncompensatedTablesLocked() []UncompensatedTable {
+	tables := make([]UncompensatedTable, 0, len(c.uncompensatedTables))
+	for _, table := range c.uncompensatedTables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].TableID < tables[j].TableID })
+	return tables
+}
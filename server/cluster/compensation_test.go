@@ -0,0 +1,181 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// placementFailingStorage fails to place the tables on the shards, and fails to delete the tables too if failDelete
+// is set.
+type placementFailingStorage struct {
+	storage.Storage
+	failPut    bool
+	failDelete bool
+}
+
+func (s *placementFailingStorage) PutShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology) error {
+	if s.failPut {
+		return errors.New("injected put failure")
+	}
+	return s.Storage.PutShardTopologies(ctx, clusterID, shardIDs, topologies)
+}
+
+func (s *placementFailingStorage) PutShardTopologyPlacingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, tables []*metapb.Table) error {
+	if s.failPut {
+		return errors.New("injected put failure")
+	}
+	return s.Storage.PutShardTopologyPlacingTables(ctx, clusterID, shardID, topology, tables)
+}
+
+func (s *placementFailingStorage) DeleteTables(ctx context.Context, clusterID uint32, schemaID uint32, tableIDs []uint64) error {
+	if s.failDelete {
+		return errors.New("injected delete failure")
+	}
+	return s.Storage.DeleteTables(ctx, clusterID, schemaID, tableIDs)
+}
+
+func TestCreateTableCompensation(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	failingStorage := &placementFailingStorage{Storage: s}
+	manager := NewManagerImpl(failingStorage, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	deleted := testutil.ToFloat64(compensationsCounter.WithLabelValues(testClusterName, string(CompensationDeleteTable),
+		string(CompensationSucceeded)))
+
+	// The table persisted by the failed creation is deleted.
+	failingStorage.failPut = true
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.Error(err)
+	procedures, err := manager.ListFailedProcedures(ctx, testClusterName)
+	re.NoError(err)
+	re.Len(procedures, 1)
+	re.Equal(ProcedureCreateTable, procedures[0].Type)
+	re.Len(procedures[0].Compensations, 1)
+	step := procedures[0].Compensations[0]
+	re.Equal(CompensationDeleteTable, step.Action)
+	re.Equal(CompensationSucceeded, step.Outcome)
+	re.Equal(procedures[0].Target, step.Target)
+	re.Equal(deleted+1, testutil.ToFloat64(compensationsCounter.WithLabelValues(testClusterName,
+		string(CompensationDeleteTable), string(CompensationSucceeded))))
+	tables, err := s.ListTables(ctx, cluster.GetClusterID(), schema.GetID())
+	re.NoError(err)
+	re.Empty(tables)
+	re.Empty(cluster.VerifyShardTableSets().UncompensatedTables)
+
+	// The table is flagged if it fails to be deleted, and its deletion is retried.
+	failingStorage.failDelete = true
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.Error(err)
+	procedures, err = manager.ListFailedProcedures(ctx, testClusterName)
+	re.NoError(err)
+	re.Len(procedures, 2)
+	step = procedures[1].Compensations[0]
+	re.Equal(CompensationFailed, step.Outcome)
+	re.Contains(step.Error, "injected delete failure")
+	uncompensated := cluster.VerifyShardTableSets().UncompensatedTables
+	re.Len(uncompensated, 1)
+	re.Equal("t1", uncompensated[0].TableName)
+	tables, err = s.ListTables(ctx, cluster.GetClusterID(), schema.GetID())
+	re.NoError(err)
+	re.Len(tables, 1)
+
+	cluster.RetryCompensations(ctx)
+	re.Len(cluster.VerifyShardTableSets().UncompensatedTables, 1)
+	failingStorage.failDelete = false
+	cluster.RetryCompensations(ctx)
+	re.Empty(cluster.VerifyShardTableSets().UncompensatedTables)
+	tables, err = s.ListTables(ctx, cluster.GetClusterID(), schema.GetID())
+	re.NoError(err)
+	re.Empty(tables)
+}
+
+func TestCreateTablePersistFailureReconcile(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	failingStorage := &placementFailingStorage{Storage: s}
+	manager := NewManagerImpl(failingStorage, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	re.Error(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:     ShardUnavailablePolicyFailFast,
+		CreatePersistFailurePolicy: "unknown",
+	}))
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:     ShardUnavailablePolicyFailFast,
+		CreatePersistFailurePolicy: CreatePersistFailureReconcile,
+	}))
+
+	// The table is kept as created although the topology of its shard fails to be persisted.
+	failingStorage.failPut = true
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	reconciles, err := manager.ListPendingReconciles(ctx, testClusterName)
+	re.NoError(err)
+	re.Len(reconciles, 1)
+	re.Equal(table.GetID(), reconciles[0].TableID)
+	re.Equal(table.GetShardID(), reconciles[0].ShardID)
+	re.Equal(1, reconciles[0].Attempts)
+	re.Contains(reconciles[0].Error, "injected put failure")
+	re.Equal(1.0, testutil.ToFloat64(pendingReconcilesGauge.WithLabelValues(testClusterName)))
+	re.Len(cluster.VerifyShardTableSets().PendingReconciles, 1)
+	procedures, err := manager.ListFailedProcedures(ctx, testClusterName)
+	re.NoError(err)
+	re.Empty(procedures)
+	again, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	re.Equal(table.GetID(), again.GetID())
+
+	// The topology of the shard is persisted again until it succeeds.
+	cluster.RetryCompensations(ctx)
+	reconciles = cluster.ListPendingReconciles()
+	re.Len(reconciles, 1)
+	re.Equal(2, reconciles[0].Attempts)
+
+	// The pending reconcile is recovered instead of dropping the table when the cluster is loaded by another leader.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	reconciles = reloadedCluster.ListPendingReconciles()
+	re.Len(reconciles, 1)
+	re.Equal(table.GetID(), reconciles[0].TableID)
+	re.Empty(reloadedCluster.ListDropTableTasks())
+	again, err = reloaded.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	re.Equal(table.GetID(), again.GetID())
+
+	failingStorage.failPut = false
+	cluster.RetryCompensations(ctx)
+	re.Empty(cluster.ListPendingReconciles())
+	re.Equal(0.0, testutil.ToFloat64(pendingReconcilesGauge.WithLabelValues(testClusterName)))
+
+	topologies, err := s.ListShardTopologies(ctx, cluster.GetClusterID(), []uint32{table.GetShardID()})
+	re.NoError(err)
+	re.Contains(topologies[0].GetTableIds(), table.GetID())
+	re.NoError(reloadedCluster.Load(ctx))
+	re.Empty(reloadedCluster.ListPendingReconciles())
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import "context"
+
+// DDLOrigin is the ceresdb server issuing a DDL.
+type DDLOrigin struct {
+	// Peer is the address of the ceresdb server sending the request.
+	Peer string `json:"peer,omitempty"`
+	// Identity is provided by the ceresdb server itself, and it is empty if the server doesn't provide any.
+	Identity string `json:"identity,omitempty"`
+}
+
+func (o DDLOrigin) IsEmpty() bool {
+	return o.Peer == "" && o.Identity == ""
+}
+
+// Actor is the identity of the origin, or the peer if the identity is not provided.
+func (o DDLOrigin) Actor() string {
+	if o.Identity != "" {
+		return o.Identity
+	}
+	return o.Peer
+}
+
+type ddlOriginKey struct{}
+
+// WithDDLOrigin returns a context carrying the origin of the DDLs issued in the context.
+func WithDDLOrigin(ctx context.Context, origin DDLOrigin) context.Context {
+	return context.WithValue(ctx, ddlOriginKey{}, origin)
+}
+
+// DDLOriginFromContext returns the origin carried by the ctx, and an empty origin is returned if it is not set.
+func DDLOriginFromContext(ctx context.Context) DDLOrigin {
+	origin, _ := ctx.Value(ddlOriginKey{}).(DDLOrigin)
+	return origin
+}
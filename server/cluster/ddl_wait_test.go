@@ -0,0 +1,47 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDDLBlockedOnClusterLock(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	tracker := procedure.NewTracker()
+	ddlCtx, finish := tracker.Start(ctx, string(ProcedureCreateTable), testClusterName, "public.t0")
+	defer finish()
+
+	// The creation is blocked while the lock is held by others.
+	cluster.lock.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := manager.AllocTableID(ddlCtx, testClusterName, "public", "t0")
+		done <- err
+	}()
+	re.Eventually(func() bool { return len(tracker.ListBlocked()) == 1 }, defaultTestTimeout, 10*time.Millisecond)
+	blocked := tracker.ListBlocked()[0]
+	re.Equal(procedure.WaitClusterLock, blocked.Reason)
+	re.Equal("public.t0", blocked.Target)
+	cluster.lock.Unlock()
+
+	re.NoError(<-done)
+	re.Empty(tracker.ListBlocked())
+}
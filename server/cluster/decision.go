@@ -0,0 +1,235 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DecisionKind is the kind of the nondeterministic choices made by the create-table pipeline.
+type DecisionKind string
+
+const (
+	// DecisionShardPick picks one of the shards equally preferred for the new table.
+	DecisionShardPick DecisionKind = "shard_pick"
+	// DecisionRetryWait decides how long to wait before retrying the creation on an unavailable shard.
+	DecisionRetryWait DecisionKind = "retry_wait"
+)
+
+// Decision is a choice made by the create-table pipeline.
+type Decision struct {
+	Kind  DecisionKind `json:"kind"`
+	Table string       `json:"table"`
+	// Candidates are the shards to pick from, which are only set for the DecisionShardPick.
+	Candidates []uint32 `json:"candidates,omitempty"`
+	// Value is the id of the shard picked or the milliseconds to wait.
+	Value int64 `json:"value"`
+}
+
+// DecisionTrace is the replayable record of the decisions made by the creations of the tables, and Seed is the seed
+// of the source making the decisions, which is zero for the live source.
+type DecisionTrace struct {
+	Seed      int64      `json:"seed"`
+	Decisions []Decision `json:"decisions"`
+}
+
+// DecodeDecisionTrace decodes the trace recorded by the DecisionRecorder.
+func DecodeDecisionTrace(data []byte) (DecisionTrace, error) {
+	trace := DecisionTrace{}
+	if err := json.Unmarshal(data, &trace); err != nil {
+		return DecisionTrace{}, errors.Wrap(err, "decode decision trace")
+	}
+	return trace, nil
+}
+
+// DecisionSource makes every nondeterministic choice of the create-table pipeline, so that the choices can be made
+// from a seed or replayed from a recorded trace to reproduce a failure.
+type DecisionSource interface {
+	// PickShard picks one of the candidates for the table, which are in the order of the effective shard set.
+	PickShard(table string, candidates []uint32) (uint32, error)
+	// RetryWait returns how long to wait before the attempt to create the table again, which starts from one.
+	RetryWait(table string, attempt int) (time.Duration, error)
+}
+
+type decisionSourceKey struct{}
+
+// WithDecisionSource returns a context whose creations of the tables make the choices by the source.
+func WithDecisionSource(ctx context.Context, source DecisionSource) context.Context {
+	return context.WithValue(ctx, decisionSourceKey{}, source)
+}
+
+// decisionSourceFromContext returns the source carried by the ctx, and the live source is returned if it is not set.
+func decisionSourceFromContext(ctx context.Context) DecisionSource {
+	if source, ok := ctx.Value(decisionSourceKey{}).(DecisionSource); ok && source != nil {
+		return source
+	}
+	return liveSource{}
+}
+
+// liveSource picks the first candidate and retries at the fixed interval.
+type liveSource struct{}
+
+func (liveSource) PickShard(_ string, candidates []uint32) (uint32, error) {
+	return candidates[0], nil
+}
+
+func (liveSource) RetryWait(_ string, _ int) (time.Duration, error) {
+	return shardUnavailableCheckInterval, nil
+}
+
+// SeededSource makes the choices by a pseudo-random source of the seed, so the same requests in the same order make
+// the same choices.
+type SeededSource struct {
+	seed int64
+
+	// mu protects the rand.
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func NewSeededSource(seed int64) *SeededSource {
+	return &SeededSource{
+		seed: seed,
+		rand: rand.New(rand.NewSource(seed)), //nolint:gosec
+	}
+}
+
+func (s *SeededSource) PickShard(_ string, candidates []uint32) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return candidates[s.rand.Intn(len(candidates))], nil
+}
+
+// RetryWait jitters the interval within [0.5, 1.5) of the fixed one.
+func (s *SeededSource) RetryWait(_ string, _ int) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shardUnavailableCheckInterval/2 + time.Duration(s.rand.Int63n(int64(shardUnavailableCheckInterval))), nil
+}
+
+// DecisionRecorder records the choices made by the source into a trace.
+type DecisionRecorder struct {
+	source DecisionSource
+	seed   int64
+
+	// mu protects the decisions.
+	mu        sync.Mutex
+	decisions []Decision
+}
+
+// NewDecisionRecorder records the choices made by the source, and the live source is used if it is nil.
+func NewDecisionRecorder(source DecisionSource) *DecisionRecorder {
+	r := &DecisionRecorder{source: source}
+	switch s := source.(type) {
+	case nil:
+		r.source = liveSource{}
+	case *SeededSource:
+		r.seed = s.seed
+	}
+	return r
+}
+
+func (r *DecisionRecorder) PickShard(table string, candidates []uint32) (uint32, error) {
+	shardID, err := r.source.PickShard(table, candidates)
+	if err != nil {
+		return 0, err
+	}
+	r.record(Decision{
+		Kind:       DecisionShardPick,
+		Table:      table,
+		Candidates: append([]uint32(nil), candidates...),
+		Value:      int64(shardID),
+	})
+	return shardID, nil
+}
+
+func (r *DecisionRecorder) RetryWait(table string, attempt int) (time.Duration, error) {
+	wait, err := r.source.RetryWait(table, attempt)
+	if err != nil {
+		return 0, err
+	}
+	r.record(Decision{Kind: DecisionRetryWait, Table: table, Value: wait.Milliseconds()})
+	return wait, nil
+}
+
+// Trace returns the decisions recorded so far.
+func (r *DecisionRecorder) Trace() DecisionTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return DecisionTrace{Seed: r.seed, Decisions: append([]Decision(nil), r.decisions...)}
+}
+
+func (r *DecisionRecorder) record(decision Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.decisions = append(r.decisions, decision)
+}
+
+// ReplaySource makes the choices recorded in the trace in order, and ErrReplayDiverged is returned once the pipeline
+// asks for a choice different from the recorded one, e.g. the code or the state of the cluster has changed.
+type ReplaySource struct {
+	// mu protects the fields below.
+	mu        sync.Mutex
+	decisions []Decision
+	next      int
+}
+
+func NewReplaySource(trace DecisionTrace) *ReplaySource {
+	return &ReplaySource{decisions: trace.Decisions}
+}
+
+func (s *ReplaySource) PickShard(table string, candidates []uint32) (uint32, error) {
+	decision, err := s.take(DecisionShardPick, table)
+	if err != nil {
+		return 0, err
+	}
+	for _, shardID := range candidates {
+		if int64(shardID) == decision.Value {
+			return shardID, nil
+		}
+	}
+	return 0, ErrReplayDiverged.WithCausef("shard:%d is not a candidate, table:%s, candidates:%v", decision.Value, table,
+		candidates)
+}
+
+func (s *ReplaySource) RetryWait(table string, _ int) (time.Duration, error) {
+	decision, err := s.take(DecisionRetryWait, table)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(decision.Value) * time.Millisecond, nil
+}
+
+// Remaining returns the number of the decisions not replayed yet.
+func (s *ReplaySource) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.decisions) - s.next
+}
+
+func (s *ReplaySource) take(kind DecisionKind, table string) (Decision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next >= len(s.decisions) {
+		return Decision{}, ErrReplayDiverged.WithCausef("trace is exhausted, kind:%s, table:%s", kind, table)
+	}
+	decision := s.decisions[s.next]
+	if decision.Kind != kind || decision.Table != table {
+		return Decision{}, ErrReplayDiverged.WithCausef("expect:%s of table:%s, got:%s of table:%s", decision.Kind,
+			decision.Table, kind, table)
+	}
+	s.next++
+	return decision, nil
+}
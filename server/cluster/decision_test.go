@@ -0,0 +1,102 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// prepareDecisionCluster creates the cluster with the tables t0 and t1, whose shards are all owned by the node a,
+// which is dead if the kill is set. The creations on the unavailable shards wait for 300ms.
+func prepareDecisionCluster(ctx context.Context, t *testing.T, s storage.Storage, clusterName string, kill bool) (Manager, *Cluster) {
+	re := require.New(t)
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, clusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, clusterName, "public", 0)
+	re.NoError(err)
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < testShardTotal; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, clusterName, info))
+	for _, tableName := range []string{"t0", "t1"} {
+		_, err = manager.AllocTableID(ctx, clusterName, "public", tableName)
+		re.NoError(err)
+	}
+	re.NoError(manager.SetClusterOptions(ctx, clusterName, Options{
+		ShardUnavailablePolicy:        ShardUnavailablePolicyWait,
+		ShardUnavailableWaitTimeoutMs: 300,
+	}))
+	if kill {
+		cluster.lock.Lock()
+		cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+		cluster.lock.Unlock()
+	}
+	return manager, cluster
+}
+
+func TestSeededDecisions(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The clusters of the same seed place the same tables on the same shards.
+	var placements [2][]uint32
+	for i, clusterName := range []string{"seeded0", "seeded1"} {
+		manager, _ := prepareDecisionCluster(ctx, t, s, clusterName, false)
+		re.NoError(manager.SetClusterOptions(ctx, clusterName, Options{
+			ShardUnavailablePolicy: ShardUnavailablePolicyFailFast,
+			DecisionSeed:           42,
+		}))
+		for j := 2; j < 10; j++ {
+			table, err := manager.AllocTableID(ctx, clusterName, "public", fmt.Sprintf("t%d", j))
+			re.NoError(err)
+			placements[i] = append(placements[i], table.GetShardID())
+		}
+	}
+	re.Equal(placements[0], placements[1])
+}
+
+// TestReplayDecisionTrace replays the trace recorded from a creation waiting for the dead node, in which the shard
+// picked for the table flaps between the attempts.
+func TestReplayDecisionTrace(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "create_table_trace.json"))
+	re.NoError(err)
+	trace, err := DecodeDecisionTrace(data)
+	re.NoError(err)
+	manager, _ := prepareDecisionCluster(ctx, t, s, testClusterName, true)
+
+	replay := NewReplaySource(trace)
+	recorder := NewDecisionRecorder(replay)
+	_, err = manager.AllocTableID(WithDecisionSource(ctx, recorder), testClusterName, "public", "t2")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Contains(err.Error(), "wait timeout, shard:6")
+	re.Zero(replay.Remaining())
+	re.Equal(trace.Decisions, recorder.Trace().Decisions)
+
+	// The replay of another table diverges from the trace.
+	_, err = manager.AllocTableID(WithDecisionSource(ctx, NewReplaySource(trace)), testClusterName, "public", "t3")
+	re.True(coderr.Is(err, coderr.Internal))
+	re.Contains(err.Error(), "replay diverged")
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxDeploymentClaimAttempts bounds the attempts to claim the root path, which fail only if the fingerprint is written
+// concurrently.
+const maxDeploymentClaimAttempts = 3
+
+// DeploymentFingerprint identifies the deployment of the ceresmeta owning the root path of the storage, which keeps the
+// deployments configured with the same etcd and root path by accident from interleaving their data and fighting over
+// the leadership.
+type DeploymentFingerprint struct {
+	// ID is generated randomly by the first bootstrap of the deployment unless it is configured.
+	ID string `json:"id"`
+	// Clusters are the names of the clusters the deployment is expected to serve.
+	Clusters  []string  `json:"clusters"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeploymentExpectation is what a node expects of the fingerprint of its deployment.
+type DeploymentExpectation struct {
+	// ID is the expected id of the deployment, and any id is accepted if it is empty.
+	ID string
+	// Clusters must all be in the fingerprint.
+	Clusters []string
+	// Override takes over the root path owned by another deployment by stamping the fingerprint with the expectation.
+	Override bool
+}
+
+// ClaimDeployment checks the fingerprint of the deployment owning the root path of the storage against the expected,
+// and ErrRootPathOwned is returned on mismatch unless it is overridden. The fingerprint is created on the first
+// bootstrap along with the names of the clusters already stored, and it is created in a transaction, so the nodes of
+// the deployments racing on the same fresh root path all end with the fingerprint of exactly one of them.
+func ClaimDeployment(ctx context.Context, s storage.Storage, expected DeploymentExpectation) (*DeploymentFingerprint, error) {
+	for attempt := 0; attempt < maxDeploymentClaimAttempts; attempt++ {
+		value, err := s.GetDeploymentFingerprint(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get deployment fingerprint")
+		}
+
+		var fingerprint *DeploymentFingerprint
+		if value == "" {
+			if fingerprint, err = newDeploymentFingerprint(ctx, s, expected); err != nil {
+				return nil, err
+			}
+		} else {
+			current := &DeploymentFingerprint{}
+			if err := json.Unmarshal([]byte(value), current); err != nil {
+				return nil, ErrDecodeFingerprint.WithCausef("fingerprint:%s, err:%v", value, err)
+			}
+			mismatch := current.mismatch(expected)
+			if mismatch == "" {
+				return current, nil
+			}
+			if !expected.Override {
+				return nil, ErrRootPathOwned.WithCausef("deployment:%s, clusters:%v, %s", current.ID, current.Clusters,
+					mismatch)
+			}
+			fingerprint = current.takeOver(expected)
+			log.Warn("take over root path owned by another deployment", zap.String("deployment", current.ID),
+				zap.Strings("clusters", current.Clusters), zap.String("mismatch", mismatch),
+				zap.String("new-deployment", fingerprint.ID), zap.Strings("new-clusters", fingerprint.Clusters))
+		}
+
+		encoded, err := json.Marshal(fingerprint)
+		if err != nil {
+			return nil, ErrEncodeFingerprint.WithCause(err)
+		}
+		ok, err := s.PutDeploymentFingerprint(ctx, string(encoded), value)
+		if err != nil {
+			return nil, errors.Wrap(err, "put deployment fingerprint")
+		}
+		if ok {
+			log.Info("claim root path for deployment", zap.String("deployment", fingerprint.ID),
+				zap.Strings("clusters", fingerprint.Clusters))
+			return fingerprint, nil
+		}
+		// The fingerprint is written concurrently, and the new one is checked then.
+	}
+	return nil, ErrDeploymentClaimConflict.WithCausef("attempts:%d", maxDeploymentClaimAttempts)
+}
+
+func newDeploymentFingerprint(ctx context.Context, s storage.Storage, expected DeploymentExpectation) (*DeploymentFingerprint, error) {
+	id := expected.ID
+	if id == "" {
+		var err error
+		if id, err = newDeploymentID(); err != nil {
+			return nil, ErrEncodeFingerprint.WithCausef("generate deployment id, err:%v", err)
+		}
+	}
+	// The root path stored before the fingerprint is introduced is owned by the deployment of its clusters.
+	nameIndex, err := s.ListClusterNameIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list cluster name index")
+	}
+	clusters := make([]string, 0, len(nameIndex))
+	for name := range nameIndex {
+		clusters = append(clusters, name)
+	}
+	return &DeploymentFingerprint{
+		ID:        id,
+		Clusters:  mergeClusterNames(clusters, expected.Clusters),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// mismatch describes how the fingerprint fails to meet the expected, which is empty if it matches.
+func (f *DeploymentFingerprint) mismatch(expected DeploymentExpectation) string {
+	if expected.ID != "" && expected.ID != f.ID {
+		return fmt.Sprintf("expected deployment:%s", expected.ID)
+	}
+	owned := make(map[string]struct{}, len(f.Clusters))
+	for _, name := range f.Clusters {
+		owned[name] = struct{}{}
+	}
+	var missing []string
+	for _, name := range expected.Clusters {
+		if _, ok := owned[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("expected clusters not owned:%v", missing)
+	}
+	return ""
+}
+
+// takeOver returns the fingerprint meeting the expected, which keeps the id of the fingerprint unless another one is
+// expected.
+func (f *DeploymentFingerprint) takeOver(expected DeploymentExpectation) *DeploymentFingerprint {
+	id := f.ID
+	if expected.ID != "" {
+		id = expected.ID
+	}
+	return &DeploymentFingerprint{
+		ID:        id,
+		Clusters:  mergeClusterNames(f.Clusters, expected.Clusters),
+		CreatedAt: f.CreatedAt,
+	}
+}
+
+func mergeClusterNames(names, others []string) []string {
+	set := make(map[string]struct{}, len(names)+len(others))
+	for _, name := range append(append([]string{}, names...), others...) {
+		set[name] = struct{}{}
+	}
+	merged := make([]string, 0, len(set))
+	for name := range set {
+		merged = append(merged, name)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// newDeploymentID generates a random UUID of version 4.
+func newDeploymentID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
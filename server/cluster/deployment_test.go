@@ -0,0 +1,97 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimDeploymentRace(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The nodes of two fresh deployments race on the same root path, and only the nodes of one of them are accepted.
+	const nodes = 8
+	fingerprints := make([]*DeploymentFingerprint, nodes)
+	errs := make([]error, nodes)
+	var wg sync.WaitGroup
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			expected := DeploymentExpectation{Clusters: []string{fmt.Sprintf("cluster%d", i%2)}}
+			fingerprints[i], errs[i] = ClaimDeployment(ctx, s, expected)
+		}(i)
+	}
+	wg.Wait()
+
+	var owner *DeploymentFingerprint
+	for i := 0; i < nodes; i++ {
+		if errs[i] == nil {
+			owner = fingerprints[i]
+			break
+		}
+	}
+	re.NotNil(owner)
+	re.Len(owner.Clusters, 1)
+	for i := 0; i < nodes; i++ {
+		if fmt.Sprintf("cluster%d", i%2) == owner.Clusters[0] {
+			re.NoError(errs[i])
+			re.Equal(owner.ID, fingerprints[i].ID)
+			continue
+		}
+		re.True(coderr.Is(errs[i], coderr.Conflict))
+		re.ErrorContains(errs[i], "rootPath owned by another deployment")
+	}
+}
+
+func TestClaimDeploymentMismatch(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The clusters stored before the fingerprint is created are owned by the deployment.
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, "existing", 1, 1, testShardTotal)
+	re.NoError(err)
+	fingerprint, err := ClaimDeployment(ctx, s, DeploymentExpectation{Clusters: []string{testClusterName}})
+	re.NoError(err)
+	re.Len(fingerprint.ID, 36)
+	re.Equal([]string{testClusterName, "existing"}, fingerprint.Clusters)
+
+	// The node expecting a subset of the clusters or the same id is accepted.
+	claimed, err := ClaimDeployment(ctx, s, DeploymentExpectation{ID: fingerprint.ID, Clusters: []string{"existing"}})
+	re.NoError(err)
+	re.Equal(fingerprint.ID, claimed.ID)
+
+	// The node expecting another id or another cluster is refused.
+	_, err = ClaimDeployment(ctx, s, DeploymentExpectation{ID: "another", Clusters: []string{testClusterName}})
+	re.True(coderr.Is(err, coderr.Conflict))
+	_, err = ClaimDeployment(ctx, s, DeploymentExpectation{Clusters: []string{"another"}})
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.ErrorContains(err, fingerprint.ID)
+
+	// The override takes over the root path, and the fingerprint meets the expectation afterwards.
+	claimed, err = ClaimDeployment(ctx, s, DeploymentExpectation{ID: "another", Clusters: []string{"another"}, Override: true})
+	re.NoError(err)
+	re.Equal("another", claimed.ID)
+	re.Equal([]string{"another", testClusterName, "existing"}, claimed.Clusters)
+	re.Equal(fingerprint.CreatedAt.Unix(), claimed.CreatedAt.Unix())
+	_, err = ClaimDeployment(ctx, s, DeploymentExpectation{ID: "another", Clusters: []string{"another"}})
+	re.NoError(err)
+	_, err = ClaimDeployment(ctx, s, DeploymentExpectation{ID: fingerprint.ID})
+	re.True(coderr.Is(err, coderr.Conflict))
+}
@@ -0,0 +1,309 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// tableDeletingMarker is persisted for the partitioned table being dropped, so that the drop interrupted is resumed by
+// the retries and the routes of the partitioned table and its sub-tables are never returned in the meantime. It is also
+// persisted for the table removed from its shard or not placed on its shard yet, which is dropped by the leader after
+// the cluster is reloaded.
+type tableDeletingMarker struct {
+	StartedAt int64 `json:"started_at"`
+	// Timing is the timing of the failed attempts, which is carried over to the procedure resuming the drop.
+	Timing *procedure.Timing `json:"timing,omitempty"`
+	// Reconcile is set for the table created under the CreatePersistFailureReconcile policy, which is placed on its
+	// shard again as a pending reconcile instead of being dropped if it is not placed yet.
+	Reconcile bool `json:"reconcile,omitempty"`
+}
+
+// SubTableDrop is the result of dropping a sub-table of the partitioned table.
+type SubTableDrop struct {
+	TableName string
+	TableID   uint64
+	ShardID   uint32
+	// Node is the owner of the shard of the sub-table when it is dropped.
+	Node string
+	// Err is nil if the sub-table is gone.
+	Err error
+}
+
+// PartitionedTableDrop describes the progress of dropping a partitioned table.
+type PartitionedTableDrop struct {
+	SchemaName string
+	TableName  string
+	TableID    uint64
+	// SubTables are the sub-tables left when the attempt starts, sorted by the shard id and the table id.
+	SubTables []SubTableDrop
+	// Done is set once the partitioned table is dropped after all its sub-tables are gone.
+	Done bool
+}
+
+// DropPartitionedTable drops the partitioned table along with its sub-tables, which are the tables of the schema created
+// in the anti-affinity group of the id of the partitioned table, as persisted at their creation. The drop is refused
+// with ErrSubTablesNotFound if no sub-table is found before the drop starts, because the table is then either not
+// partitioned or its sub-tables were created without the group, and dropping it alone would leave them. The table is marked as deleting at first, and then the
+// sub-tables are removed from their shards with one topology update per shard and their meta is deleted. The sub-tables
+// on a shard failing to be dropped don't stop the ones on the other shards, and the partitioned table is dropped only
+// if all its sub-tables are gone. Otherwise ErrPartialTableDrop is returned along with the progress, and the drop is
+// resumed by dropping the partitioned table again, even after the cluster is reloaded.
+func (c *Cluster) DropPartitionedTable(ctx context.Context, schemaName, tableName string) (*PartitionedTableDrop, error) {
+	c.lockForDDL(ctx)
+	defer c.lock.Unlock()
+
+	start := time.Now()
+	drop, err := c.dropPartitionedTableLocked(ctx, schemaName, tableName)
+	c.observeProcedureLocked(ProcedureDropTable, start, err)
+	return drop, err
+}
+
+func (c *Cluster) dropPartitionedTableLocked(ctx context.Context, schemaName, tableName string) (*PartitionedTableDrop, error) {
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	table, ok := schema.getTable(tableName)
+	if !ok {
+		return nil, ErrTableNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+
+	shardSubTables := make(map[uint32][]*Table)
+	for _, subTable := range schema.tableMap {
+		if subTable.affinityGroup == table.GetID() && subTable.GetID() != table.GetID() {
+			shardSubTables[subTable.GetShardID()] = append(shardSubTables[subTable.GetShardID()], subTable)
+		}
+	}
+
+	marker := tableDeletingMarker{StartedAt: time.Now().UnixMilli()}
+	if _, ok := c.deletingTables[table.GetID()]; ok {
+		resumed, err := c.getDeletingMarkerLocked(ctx, schema.GetID(), table.GetID())
+		if err != nil {
+			return nil, err
+		}
+		marker = resumed
+		if marker.Timing != nil {
+			procedure.Resume(ctx, *marker.Timing)
+		}
+	} else {
+		if _, ok := c.dropTasks[table.GetID()]; ok {
+			return nil, ErrTableDeleting.WithCausef("schema:%s, table:%s", schemaName, tableName)
+		}
+		if len(shardSubTables) == 0 {
+			return nil, ErrSubTablesNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+		}
+		if err := c.checkHealthyNodesLocked(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.checkTopologyGenerationLocked(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.putDeletingMarkerLocked(ctx, schema.GetID(), table.GetID(), marker); err != nil {
+			return nil, errors.Wrapf(err, "table:%s", tableName)
+		}
+		c.deletingTables[table.GetID()] = struct{}{}
+		c.invalidateTopologyCacheLocked()
+
+		log.Info("start dropping partitioned table", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", schemaName), zap.String("table", tableName), zap.Uint64("table-id", table.GetID()))
+	}
+
+	shardIDs := make([]uint32, 0, len(shardSubTables))
+	for shardID := range shardSubTables {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+
+	drop := &PartitionedTableDrop{SchemaName: schemaName, TableName: tableName, TableID: table.GetID()}
+	failed := 0
+	for _, shardID := range shardIDs {
+		subTables := shardSubTables[shardID]
+		sort.Slice(subTables, func(i, j int) bool { return subTables[i].GetID() < subTables[j].GetID() })
+		node := ""
+		if shard, ok := c.shardsCache[shardID]; ok {
+			node = shard.GetNode()
+		}
+		for i, err := range c.dropSubTablesLocked(ctx, schema, shardID, subTables) {
+			drop.SubTables = append(drop.SubTables, SubTableDrop{
+				TableName: subTables[i].GetName(),
+				TableID:   subTables[i].GetID(),
+				ShardID:   shardID,
+				Node:      node,
+				Err:       err,
+			})
+			if err != nil {
+				failed++
+				log.Warn("fail to drop sub-table", zap.String("schema", schemaName), zap.String("table", tableName),
+					zap.String("sub-table", subTables[i].GetName()), zap.Uint32("shard", shardID), zap.String("node", node),
+					zap.Error(err))
+			}
+		}
+	}
+	if failed > 0 {
+		// The timing of the attempt is kept for the procedure resuming the drop, which may run on another leader.
+		if timing, ok := procedure.CurrentTiming(ctx); ok {
+			marker.Timing = &timing
+			if err := c.putDeletingMarkerLocked(ctx, schema.GetID(), table.GetID(), marker); err != nil {
+				log.Warn("fail to keep timing of partitioned table drop", zap.String("schema", schemaName),
+					zap.String("table", tableName), zap.Error(err))
+			}
+		}
+		return drop, ErrPartialTableDrop.WithCausef("schema:%s, table:%s, failed:%d, sub-tables:%d", schemaName,
+			tableName, failed, len(drop.SubTables))
+	}
+
+	// The deleting marker is deleted along with the partitioned table.
+	if err := c.dropTableLocked(ctx, schemaName, tableName, false); err != nil {
+		return drop, errors.Wrapf(err, "drop partitioned table, table:%s", tableName)
+	}
+	drop.Done = true
+	return drop, nil
+}
+
+func (c *Cluster) getDeletingMarkerLocked(ctx context.Context, schemaID uint32, tableID uint64) (tableDeletingMarker, error) {
+	markers, err := c.storage.ListDeletingTables(ctx, c.clusterID, schemaID)
+	if err != nil {
+		return tableDeletingMarker{}, errors.Wrap(err, "list deleting markers")
+	}
+	if value, ok := markers[tableID]; ok {
+		return decodeDeletingMarker(tableID, value)
+	}
+	return tableDeletingMarker{}, nil
+}
+
+func (c *Cluster) putDeletingMarkerLocked(ctx context.Context, schemaID uint32, tableID uint64, marker tableDeletingMarker) error {
+	value, err := encodeDeletingMarker(marker)
+	if err != nil {
+		return err
+	}
+	if err := c.storage.PutDeletingTable(ctx, c.clusterID, schemaID, tableID, value); err != nil {
+		return errors.Wrap(err, "put deleting marker")
+	}
+	return nil
+}
+
+func encodeDeletingMarker(marker tableDeletingMarker) (string, error) {
+	value, err := json.Marshal(marker)
+	if err != nil {
+		return "", errors.Wrap(err, "encode deleting marker")
+	}
+	return string(value), nil
+}
+
+func decodeDeletingMarker(tableID uint64, value string) (tableDeletingMarker, error) {
+	marker := tableDeletingMarker{}
+	if err := json.Unmarshal([]byte(value), &marker); err != nil {
+		return tableDeletingMarker{}, errors.Wrapf(err, "decode deleting marker, table id:%d", tableID)
+	}
+	return marker, nil
+}
+
+// dropSubTablesLocked removes the sub-tables from the shard in a single topology update and then deletes their meta,
+// and the errors are returned in the same order as the sub-tables. The sub-tables already absent from the shard are
+// only deleted.
+func (c *Cluster) dropSubTablesLocked(ctx context.Context, schema *Schema, shardID uint32, subTables []*Table) []error {
+	errs := make([]error, len(subTables))
+	setErr := func(err error) {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		setErr(ErrShardNotFound.WithCausef("shard:%d", shardID))
+		return errs
+	}
+	removedIDs := make([]uint64, 0, len(subTables))
+	for _, subTable := range subTables {
+		if shard.hasTable(subTable.GetID()) {
+			removedIDs = append(removedIDs, subTable.GetID())
+		}
+	}
+	if len(removedIDs) > 0 {
+		if err := c.checkShardFrozenLocked(ctx, shardID); err != nil {
+			setErr(err)
+			return errs
+		}
+		if err := c.checkShardDrainingLocked(shardID); err != nil {
+			setErr(err)
+			return errs
+		}
+		newTopology := shard.withoutTables(removedIDs, c.shardVersionIncrementLocked(ShardOperationDropTable))
+		marker, err := encodeDeletingMarker(tableDeletingMarker{StartedAt: time.Now().UnixMilli()})
+		if err != nil {
+			setErr(err)
+			return errs
+		}
+		if err := c.storage.PutShardTopologyRemovingTables(ctx, c.clusterID, shardID, newTopology, schema.GetID(), removedIDs, marker); err != nil {
+			c.markStaleOnConflictLocked(err)
+			setErr(errors.Wrapf(err, "put shard topology, shard:%d", shardID))
+			return errs
+		}
+		shard.topology = newTopology
+		c.observeShardTopologySizeLocked(shard)
+		c.recordShardDDLLocked(shardID)
+		c.invalidateTopologyCacheLocked()
+	}
+
+	tasks := make([]*dropTableTask, 0, len(subTables))
+	tableIDs := make([]uint64, 0, len(subTables))
+	for i, subTable := range subTables {
+		task, ok := c.dropTasks[subTable.GetID()]
+		if !ok {
+			task = &dropTableTask{
+				schemaID:   schema.GetID(),
+				schemaName: schema.GetName(),
+				table:      subTable.meta,
+				origin:     DDLOriginFromContext(ctx),
+			}
+			c.dropTasks[subTable.GetID()] = task
+		} else if task.settled != nil && !task.failed {
+			// The sub-table is being dropped in background, and it is checked again by the next retry.
+			errs[i] = ErrTableDeleting.WithCausef("schema:%s, table:%s", schema.GetName(), subTable.GetName())
+			continue
+		}
+		tasks = append(tasks, task)
+		tableIDs = append(tableIDs, subTable.GetID())
+	}
+	if len(tableIDs) == 0 {
+		return errs
+	}
+	if err := c.storage.DeleteTables(ctx, c.clusterID, schema.GetID(), tableIDs); err != nil {
+		for _, task := range tasks {
+			task.attempts++
+			task.lastErr = err
+			task.failed = true
+		}
+		setErr(errors.Wrapf(err, "delete sub-tables, shard:%d", shardID))
+		return errs
+	}
+	for _, task := range tasks {
+		c.finishDropTableLocked(task)
+	}
+	return errs
+}
+
+// inDeletingFamilyLocked tells whether the table is a partitioned table being dropped or one of its sub-tables, which
+// are hidden from the routes until the drop finishes.
+func (c *Cluster) inDeletingFamilyLocked(table *Table) bool {
+	if _, ok := c.deletingTables[table.GetID()]; ok {
+		return true
+	}
+	if table.affinityGroup == 0 {
+		return false
+	}
+	_, ok := c.deletingTables[table.affinityGroup]
+	return ok
+}
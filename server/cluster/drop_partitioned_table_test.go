@@ -0,0 +1,178 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// shardFailingStorage fails to put the topology of the broken shard, and a negative one breaks no shard.
+type shardFailingStorage struct {
+	storage.Storage
+	brokenShard int64
+}
+
+func (s *shardFailingStorage) PutShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology) error {
+	for _, shardID := range shardIDs {
+		if int64(shardID) == atomic.LoadInt64(&s.brokenShard) {
+			return errors.New("injected shard topology failure")
+		}
+	}
+	return s.Storage.PutShardTopologies(ctx, clusterID, shardIDs, topologies)
+}
+
+func (s *shardFailingStorage) PutShardTopologyRemovingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, schemaID uint32, tableIDs []uint64, marker string) error {
+	if int64(shardID) == atomic.LoadInt64(&s.brokenShard) {
+		return errors.New("injected shard topology failure")
+	}
+	return s.Storage.PutShardTopologyRemovingTables(ctx, clusterID, shardID, topology, schemaID, tableIDs, marker)
+}
+
+// visibleTables returns the shards of the tables of the schema visible to the nodes keyed by the table names, and the
+// tables being dropped are absent.
+func visibleTables(c *Cluster, schemaName string) map[string]ShardView {
+	c.lock.RLock()
+	snapshot := c.newReadSnapshotLocked()
+	c.lock.RUnlock()
+
+	views := make(map[string]ShardView)
+	for tableName, table := range snapshot.tables[schemaName] {
+		views[tableName] = newShardView(table.GetShardID(), snapshot.shards[table.GetShardID()])
+	}
+	return views
+}
+
+func TestDropPartitionedTable(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	failing := &shardFailingStorage{Storage: s, brokenShard: -1}
+	manager := NewManagerImpl(failing, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	for i, node := range []string{"a", "b"} {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for shardID := uint32(i * 4); shardID < uint32(i*4+4); shardID++ {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	}
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	logical, err := manager.AllocTableID(ctx, testClusterName, "public", "orders")
+	re.NoError(err)
+
+	// The table whose sub-tables can't be found is never dropped alone.
+	_, err = manager.DropPartitionedTable(ctx, testClusterName, "public", "orders")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.Len(visibleTables(cluster, "public"), 1)
+
+	_, nodeCounts := createPartitions(ctx, re, manager, cluster, "orders", logical.GetID(), 4)
+	re.Equal(map[string]int{"a": 2, "b": 2}, nodeCounts)
+	tables := visibleTables(cluster, "public")
+	re.Len(tables, 5)
+	for i := 0; i < 4; i++ {
+		re.Contains(tables, fmt.Sprintf("__orders_%d", i))
+	}
+
+	// The sub-table on a shard of the node b fails to be dropped, while the others are dropped.
+	brokenShard := uint32(0)
+	for tableName, shard := range tables {
+		if tableName != "orders" && shard.Node == "b" {
+			brokenShard = shard.ID
+		}
+	}
+	atomic.StoreInt64(&failing.brokenShard, int64(brokenShard))
+	tracker := procedure.NewTracker()
+	dropCtx, finish := tracker.Start(ctx, string(ProcedureDropTable), testClusterName, "public.orders")
+	drop, err := manager.DropPartitionedTable(dropCtx, testClusterName, "public", "orders")
+	finish()
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.False(drop.Done)
+	re.Len(drop.SubTables, 4)
+	for _, subTable := range drop.SubTables {
+		if subTable.ShardID == brokenShard {
+			re.Equal("b", subTable.Node)
+			re.Error(subTable.Err)
+		} else {
+			re.NoError(subTable.Err)
+		}
+	}
+
+	// No table of the partitioned table is visible to the nodes until the drop finishes, even after reloading.
+	re.Empty(visibleTables(cluster, "public"))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "orders")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = manager.AllocTableID(WithAntiAffinityGroup(ctx, logical.GetID()), testClusterName, "public", "__orders_4")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	reloaded := NewManagerImpl(failing, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.Empty(visibleTables(reloadedCluster, "public"))
+
+	// The retry resumes the drop and tolerates the sub-tables dropped already, and it keeps the timing of the failed
+	// attempt even though it is tracked by another leader.
+	failedAttempt, ok := tracker.Get(1)
+	re.True(ok)
+	atomic.StoreInt64(&failing.brokenShard, -1)
+	tracker = procedure.NewTracker()
+	dropCtx, finish = tracker.Start(ctx, string(ProcedureDropTable), testClusterName, "public.orders")
+	drop, err = reloaded.DropPartitionedTable(dropCtx, testClusterName, "public", "orders")
+	finish()
+	re.NoError(err)
+	re.True(drop.Done)
+	resumed, ok := tracker.Get(1)
+	re.True(ok)
+	re.True(resumed.Resumed)
+	re.Greater(resumed.Timing.Total, failedAttempt.Timing.Total)
+	stepCounts := func(timing procedure.Timing) map[procedure.Step]int {
+		counts := make(map[procedure.Step]int)
+		sum := time.Duration(0)
+		for _, step := range timing.Steps {
+			counts[step.Step] = step.Count
+			sum += step.Duration
+		}
+		re.Equal(timing.Total, sum)
+		return counts
+	}
+	failedCounts, resumedCounts := stepCounts(failedAttempt.Timing), stepCounts(resumed.Timing)
+	re.Equal(1, failedCounts[procedure.StepQueueWait])
+	re.Positive(failedCounts[procedure.StepPersist])
+	re.Equal(2, resumedCounts[procedure.StepQueueWait])
+	re.Greater(resumedCounts[procedure.StepPersist], failedCounts[procedure.StepPersist])
+	re.Len(drop.SubTables, 1)
+	re.Equal(brokenShard, drop.SubTables[0].ShardID)
+	_, err = reloaded.DropPartitionedTable(ctx, testClusterName, "public", "orders")
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	reloaded = NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	recreated, err := reloaded.AllocTableID(ctx, testClusterName, "public", "orders")
+	re.NoError(err)
+	re.NotEqual(logical.GetID(), recreated.GetID())
+	stats, err := reloaded.GetSchemaStats(ctx, testClusterName, "public")
+	re.NoError(err)
+	total := 0
+	for _, count := range stats.ShardTableCounts {
+		total += count
+	}
+	re.Equal(1, total)
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDropTableMaxAttempts   = 5
+	defaultDropTableRetryInterval = time.Second
+	defaultDropTableTimeout       = time.Second * 5
+	defaultDropTableFenceTimeout  = time.Second * 5
+)
+
+// dropTableTask finishes dropping a table in background after the table has been removed from its shard.
+type dropTableTask struct {
+	schemaID   uint32
+	schemaName string
+	table      *metapb.Table
+	// origin is empty for the tasks resumed after the cluster is loaded.
+	origin DDLOrigin
+
+	// Following fields are protected by the lock of the cluster.
+	attempts int
+	lastErr  error
+	// failed is set if all the attempts fail, and the task stays in the cluster as a dead letter until it is retried.
+	failed bool
+	// settled is closed once the background run finishes or gives up, and it is nil if the task never runs in
+	// background.
+	settled chan struct{}
+	// awaitingLeader is set for the task found by loading the cluster, which is started by ResumeDropTables on the
+	// leader only.
+	awaitingLeader bool
+}
+
+// DropTableTask describes the progress of dropping a table in background.
+type DropTableTask struct {
+	SchemaName string
+	TableName  string
+	TableID    uint64
+	Attempts   int
+	LastError  string
+	Failed     bool
+	// Origin is the ceresdb server issuing the drop.
+	Origin DDLOrigin
+}
+
+// DropTable removes the table from its shard at first, and then deletes the table meta.
+// If async is set, it returns as soon as the table is removed from its shard and the table meta is deleted in
+// background with retries. The name of the table can't be reused until the table meta is deleted, and a failed
+// background drop can be retried by dropping the table again.
+func (c *Cluster) DropTable(ctx context.Context, schemaName, tableName string, async bool) error {
+	c.lockForDDL(ctx)
+	defer c.lock.Unlock()
+
+	start := time.Now()
+	err := c.dropTableLocked(ctx, schemaName, tableName, async)
+	c.observeProcedureLocked(ProcedureDropTable, start, err)
+	return err
+}
+
+func (c *Cluster) dropTableLocked(ctx context.Context, schemaName, tableName string, async bool) error {
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	table, ok := schema.getTable(tableName)
+	if !ok {
+		return ErrTableNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+
+	task, ok := c.dropTasks[table.GetID()]
+	if !ok {
+		if err := c.checkHealthyNodesLocked(ctx); err != nil {
+			return err
+		}
+		if err := c.checkTopologyGenerationLocked(ctx); err != nil {
+			return err
+		}
+		shard, ok := c.shardsCache[table.GetShardID()]
+		if !ok {
+			return ErrShardNotFound.WithCausef("shard:%d, table:%s", table.GetShardID(), tableName)
+		}
+		if err := c.checkShardFrozenLocked(ctx, shard.GetID()); err != nil {
+			return err
+		}
+		if err := c.checkShardDrainingLocked(shard.GetID()); err != nil {
+			return err
+		}
+		newTopology := shard.withoutTable(table.GetID(), c.shardVersionIncrementLocked(ShardOperationDropTable))
+		marker, err := encodeDeletingMarker(tableDeletingMarker{StartedAt: time.Now().UnixMilli()})
+		if err != nil {
+			return err
+		}
+		// The table is marked as deleting along with its removal, so the drop is resumed if the meta is left.
+		if err := c.storage.PutShardTopologyRemovingTables(ctx, c.clusterID, shard.GetID(), newTopology, schema.GetID(), []uint64{table.GetID()}, marker); err != nil {
+			c.markStaleOnConflictLocked(err)
+			return errors.Wrapf(err, "put shard topology, shard:%d", shard.GetID())
+		}
+		shard.topology = newTopology
+		c.observeShardTopologySizeLocked(shard)
+		c.recordShardDDLLocked(shard.GetID())
+		c.invalidateTopologyCacheLocked()
+
+		task = &dropTableTask{schemaID: schema.GetID(), schemaName: schemaName, table: table.meta, origin: DDLOriginFromContext(ctx)}
+		c.dropTasks[table.GetID()] = task
+	} else if !task.failed && !task.awaitingLeader {
+		if async {
+			return nil
+		}
+		return ErrTableDeleting.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+
+	if async {
+		c.startDropTableTaskLocked(task)
+		return nil
+	}
+
+	if err := c.storage.DeleteTables(ctx, c.clusterID, task.schemaID, []uint64{task.table.GetId()}); err != nil {
+		task.attempts++
+		task.lastErr = err
+		task.failed = true
+		return errors.Wrapf(err, "delete table, table:%s", tableName)
+	}
+	c.finishDropTableLocked(task)
+	return nil
+}
+
+// ListDropTableTasks lists the tables being dropped in background, including the failed ones.
+func (c *Cluster) ListDropTableTasks() []DropTableTask {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	tasks := make([]DropTableTask, 0, len(c.dropTasks))
+	for _, task := range c.dropTasks {
+		lastErr := ""
+		if task.lastErr != nil {
+			lastErr = task.lastErr.Error()
+		}
+		tasks = append(tasks, DropTableTask{
+			SchemaName: task.schemaName,
+			TableName:  task.table.GetName(),
+			TableID:    task.table.GetId(),
+			Attempts:   task.attempts,
+			LastError:  lastErr,
+			Failed:     task.failed,
+			Origin:     task.origin,
+		})
+	}
+	return tasks
+}
+
+// ResumeDropTables starts dropping the tables found being dropped when the cluster is loaded, and it should be called
+// by the leader only, so the followers never delete the meta of the tables.
+func (c *Cluster) ResumeDropTables() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, task := range c.dropTasks {
+		if !task.awaitingLeader {
+			continue
+		}
+		log.Info("resume dropping table", zap.String("cluster", c.metaData.GetName()), zap.String("schema", task.schemaName),
+			zap.String("table", task.table.GetName()), zap.Uint64("table-id", task.table.GetId()))
+		c.startDropTableTaskLocked(task)
+	}
+}
+
+func (c *Cluster) startDropTableTaskLocked(task *dropTableTask) {
+	task.failed = false
+	task.awaitingLeader = false
+	task.settled = make(chan struct{})
+	go c.runDropTableTask(task, task.settled)
+}
+
+func (c *Cluster) runDropTableTask(task *dropTableTask, settled chan struct{}) {
+	defer close(settled)
+
+	for i := 0; i < c.dropTableMaxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(c.dropTableRetryInterval)
+		}
+
+		// The background drop is retried if it is shed by the overloaded storage.
+		ctx, cancel := context.WithTimeout(storage.WithPriority(context.Background(), storage.PriorityLow), defaultDropTableTimeout)
+		err := c.storage.DeleteTables(ctx, c.clusterID, task.schemaID, []uint64{task.table.GetId()})
+		cancel()
+
+		c.lock.Lock()
+		if err == nil {
+			c.finishDropTableLocked(task)
+			c.lock.Unlock()
+			return
+		}
+		task.attempts++
+		task.lastErr = err
+		c.lock.Unlock()
+
+		log.Warn("fail to drop table in background", zap.String("schema", task.schemaName),
+			zap.String("table", task.table.GetName()), zap.Int("attempts", task.attempts), zap.Error(err))
+	}
+
+	c.lock.Lock()
+	task.failed = true
+	c.lock.Unlock()
+
+	log.Error("give up dropping table in background and keep it as a dead letter", zap.String("schema", task.schemaName),
+		zap.String("table", task.table.GetName()), zap.Uint64("table-id", task.table.GetId()), zap.Any("origin", task.origin))
+}
+
+// waitForDropTableFence waits for the table of the name being dropped in background to settle before the table of the
+// same name is created, so that the creation never races with the deletion of the dropped one. ErrTableDropInFlight is
+// returned if the drop doesn't settle within the fence timeout, and the creation can be retried later.
+func (c *Cluster) waitForDropTableFence(ctx context.Context, schemaName, tableName string, settled <-chan struct{}) error {
+	endWait := procedure.BeginWait(ctx, procedure.WaitDropTable, fmt.Sprintf("schema:%s, table:%s", schemaName, tableName))
+	defer endWait()
+	timer := time.NewTimer(c.dropTableFenceTimeout)
+	defer timer.Stop()
+	select {
+	case <-settled:
+		return nil
+	case <-ctx.Done():
+		return ErrTableDropInFlight.WithCausef("schema:%s, table:%s, err:%v", schemaName, tableName, ctx.Err())
+	case <-timer.C:
+		return ErrTableDropInFlight.WithCausef("wait timeout, schema:%s, table:%s", schemaName, tableName)
+	}
+}
+
+// inFlightDropTableLocked returns the task dropping the table of the name in background which is not given up, and nil
+// is returned if there is none. The names in the other schemas are fenced too in the wider table name scopes.
+func (c *Cluster) inFlightDropTableLocked(schemaName, tableName string) *dropTableTask {
+	wideScope := c.options.TableNameScope == TableNameScopeCluster || c.options.TableNameScope == TableNameScopeShard
+	for name, schema := range c.schemasCache {
+		if name != schemaName && !wideScope {
+			continue
+		}
+		table, ok := schema.getTable(tableName)
+		if !ok {
+			continue
+		}
+		if task, ok := c.dropTasks[table.GetID()]; ok && task.settled != nil && !task.failed {
+			return task
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) finishDropTableLocked(task *dropTableTask) {
+	delete(c.dropTasks, task.table.GetId())
+	delete(c.deletingTables, task.table.GetId())
+	c.routeStats.remove(task.table.GetId())
+	if schema, ok := c.schemasCache[task.schemaName]; ok {
+		if table, ok := schema.getTable(task.table.GetName()); ok && table.GetID() == task.table.GetId() {
+			delete(schema.tableMap, task.table.GetName())
+		}
+	}
+
+	log.Info("drop table", zap.String("cluster", c.metaData.GetName()), zap.String("schema", task.schemaName),
+		zap.String("table", task.table.GetName()), zap.Uint64("table-id", task.table.GetId()), zap.Any("origin", task.origin))
+}
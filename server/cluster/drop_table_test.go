@@ -0,0 +1,182 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage fails to delete tables until it is healed.
+type flakyStorage struct {
+	storage.Storage
+	broken int32
+}
+
+func (s *flakyStorage) DeleteTables(ctx context.Context, clusterID uint32, schemaID uint32, tableIDs []uint64) error {
+	if atomic.LoadInt32(&s.broken) == 1 {
+		return errors.New("injected delete failure")
+	}
+	return s.Storage.DeleteTables(ctx, clusterID, schemaID, tableIDs)
+}
+
+func TestDropTable(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "sync_table")
+	re.NoError(err)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "sync_table", false))
+	err = manager.DropTable(ctx, testClusterName, "public", "sync_table", false)
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	// The name can be reused at once after a sync drop.
+	recreated, err := manager.AllocTableID(ctx, testClusterName, "public", "sync_table")
+	re.NoError(err)
+	re.NotEqual(table.GetID(), recreated.GetID())
+
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	stats, err := reloaded.GetSchemaStats(ctx, testClusterName, "public")
+	re.NoError(err)
+	re.Equal(1, stats.ShardTableCounts[recreated.GetShardID()])
+}
+
+func TestAsyncDropTable(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	flaky := &flakyStorage{Storage: s}
+	manager := NewManagerImpl(flaky, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	cluster.dropTableRetryInterval = time.Millisecond * 10
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "async_table")
+	re.NoError(err)
+
+	// The failed background drop lands in the dead letters and the name is still blocked.
+	atomic.StoreInt32(&flaky.broken, 1)
+	origin := DDLOrigin{Peer: "127.0.0.1:8831", Identity: "ceresdb-0"}
+	re.NoError(manager.DropTable(WithDDLOrigin(ctx, origin), testClusterName, "public", "async_table", true))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "async_table")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.Eventually(func() bool {
+		tasks := cluster.ListDropTableTasks()
+		return len(tasks) == 1 && tasks[0].Failed
+	}, defaultTestTimeout, time.Millisecond*10)
+	tasks := cluster.ListDropTableTasks()
+	re.Equal(table.GetID(), tasks[0].TableID)
+	re.Equal(defaultDropTableMaxAttempts, tasks[0].Attempts)
+	re.Equal(origin, tasks[0].Origin)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "async_table")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	// Retry the dead letter by dropping the table again.
+	atomic.StoreInt32(&flaky.broken, 0)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "async_table", true))
+	re.Eventually(func() bool {
+		_, err := manager.AllocTableID(ctx, testClusterName, "public", "async_table")
+		return err == nil
+	}, defaultTestTimeout, time.Millisecond*10)
+	re.Empty(cluster.ListDropTableTasks())
+}
+
+func TestDropTableFence(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	flaky := &flakyStorage{Storage: s, broken: 1}
+	manager := NewManagerImpl(flaky, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	cluster.dropTableRetryInterval = time.Millisecond * 100
+	cluster.dropTableFenceTimeout = time.Millisecond * 50
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "fenced_table")
+	re.NoError(err)
+
+	// The creation is rejected as retriable if the drop doesn't settle within the fence timeout.
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "fenced_table", true))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "fenced_table")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+
+	// The creation waits for the drop to finish instead of racing with it.
+	cluster.dropTableFenceTimeout = defaultTestTimeout
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		atomic.StoreInt32(&flaky.broken, 0)
+	}()
+	recreated, err := manager.AllocTableID(ctx, testClusterName, "public", "fenced_table")
+	re.NoError(err)
+	re.NotEqual(table.GetID(), recreated.GetID())
+	re.Empty(cluster.ListDropTableTasks())
+}
+
+func TestResumeDropTable(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	flaky := &flakyStorage{Storage: s, broken: 1}
+	manager := NewManagerImpl(flaky, testRootPath)
+	created, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "async_table")
+	re.NoError(err)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "async_table", true))
+	// The table absent from its shard without a deleting marker is never dropped.
+	orphan := &metapb.Table{Id: 1000, Name: "orphan_table", SchemaId: schema.GetID(), ShardId: 0}
+	re.NoError(s.PutTables(ctx, created.clusterID, schema.GetID(), []*metapb.Table{orphan}))
+
+	// The unfinished drop is left after reloading until it is resumed by the leader.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	cluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	_, err = reloaded.AllocTableID(ctx, testClusterName, "public", "async_table")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.Len(cluster.ListDropTableTasks(), 1)
+
+	cluster.ResumeDropTables()
+	re.Eventually(func() bool {
+		_, err := reloaded.AllocTableID(ctx, testClusterName, "public", "async_table")
+		return err == nil
+	}, defaultTestTimeout, time.Millisecond*10)
+	table, err := reloaded.AllocTableID(ctx, testClusterName, "public", "orphan_table")
+	re.NoError(err)
+	re.Equal(orphan.GetId(), table.GetID())
+}
@@ -0,0 +1,72 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrCreateCluster            = coderr.NewCodeError(coderr.Internal, "create cluster")
+	ErrClusterAlreadyExists     = coderr.NewCodeError(coderr.InvalidParams, "cluster already exists")
+	ErrClusterNotFound          = coderr.NewCodeError(coderr.NotFound, "cluster not found")
+	ErrSchemaNotFound           = coderr.NewCodeError(coderr.NotFound, "schema not found")
+	ErrShardNotFound            = coderr.NewCodeError(coderr.NotFound, "shard not found")
+	ErrInvalidShardCountHint    = coderr.NewCodeError(coderr.InvalidParams, "invalid shard count hint")
+	ErrInvalidClusterOptions    = coderr.NewCodeError(coderr.InvalidParams, "invalid cluster options")
+	ErrInvalidShardAssignment   = coderr.NewCodeError(coderr.InvalidParams, "invalid initial shard assignment")
+	ErrShardUnavailable         = coderr.NewCodeError(coderr.ServiceUnavailable, "shard unavailable")
+	ErrShardVersionFrozen       = coderr.NewCodeError(coderr.InvalidParams, "shard version is frozen")
+	ErrShardFreezeNotFound      = coderr.NewCodeError(coderr.NotFound, "shard freeze not found")
+	ErrInvalidShardSwap         = coderr.NewCodeError(coderr.InvalidParams, "invalid shard swap")
+	ErrShardSwapConflict        = coderr.NewCodeError(coderr.Conflict, "shards changed during swap")
+	ErrStaleTopology            = coderr.NewCodeError(coderr.Conflict, "STALE_TOPOLOGY")
+	ErrInvalidReservationTTL    = coderr.NewCodeError(coderr.InvalidParams, "invalid table reservation ttl")
+	ErrTableNameReserved        = coderr.NewCodeError(coderr.Conflict, "table name reserved")
+	ErrTableReservationLost     = coderr.NewCodeError(coderr.Conflict, "table name reservation lost")
+	ErrTableReservationNotFound = coderr.NewCodeError(coderr.NotFound, "table name reservation not found")
+	ErrShardAlreadyAssigned     = coderr.NewCodeError(coderr.InvalidParams, "shard already assigned")
+	ErrNodeNotFound             = coderr.NewCodeError(coderr.NotFound, "node not found")
+	ErrNodeNotAlive             = coderr.NewCodeError(coderr.ServiceUnavailable, "node not alive")
+	ErrInsufficientHealthyNodes = coderr.NewCodeError(coderr.ServiceUnavailable, "insufficient healthy nodes")
+	ErrInvalidNodeEndpoint      = coderr.NewCodeError(coderr.InvalidParams, "invalid node endpoint")
+	ErrNodeEndpointUnreachable  = coderr.NewCodeError(coderr.InvalidParams, "node endpoint unreachable")
+	ErrTableNotFound            = coderr.NewCodeError(coderr.NotFound, "table not found")
+	ErrTableDeleting            = coderr.NewCodeError(coderr.InvalidParams, "table is being deleted")
+	ErrTableIDConflict          = coderr.NewCodeError(coderr.Conflict, "table id allocated concurrently")
+	ErrTableSchemaConflict      = coderr.NewCodeError(coderr.Conflict, "table schema altered concurrently")
+	ErrEncodeTableSchema        = coderr.NewCodeError(coderr.Internal, "encode table schema")
+	ErrDecodeTableSchema        = coderr.NewCodeError(coderr.Internal, "decode table schema")
+	ErrEncodeTableRouteStats    = coderr.NewCodeError(coderr.Internal, "encode table route stats")
+	ErrDecodeTableRouteStats    = coderr.NewCodeError(coderr.Internal, "decode table route stats")
+	ErrEncodeSnapshot           = coderr.NewCodeError(coderr.Internal, "encode cluster snapshot")
+	ErrDecodeSnapshot           = coderr.NewCodeError(coderr.InvalidParams, "decode cluster snapshot")
+	ErrSnapshotMismatch         = coderr.NewCodeError(coderr.InvalidParams, "cluster snapshot mismatch")
+	ErrRestoreNotConfirmed      = coderr.NewCodeError(coderr.InvalidParams, "cluster restore not confirmed")
+	ErrAcquireRestartToken      = coderr.NewCodeError(coderr.Internal, "acquire restart token")
+	ErrGenerateToken            = coderr.NewCodeError(coderr.Internal, "generate random token")
+	ErrRestartTokenNotFound     = coderr.NewCodeError(coderr.NotFound, "restart token not found")
+	ErrRestoreCluster           = coderr.NewCodeError(coderr.Internal, "restore cluster")
+	ErrPartiallyRestored        = coderr.NewCodeError(coderr.Internal, "cluster partially restored")
+	ErrEncodeShardOwnerChange   = coderr.NewCodeError(coderr.Internal, "encode shard owner change")
+	ErrDecodeShardOwnerChange   = coderr.NewCodeError(coderr.Internal, "decode shard owner change")
+	ErrIllegalTransition        = coderr.NewCodeError(coderr.InvalidParams, "illegal cluster state transition")
+	ErrEncodeClusterStatus      = coderr.NewCodeError(coderr.Internal, "encode cluster status")
+	ErrDecodeClusterStatus      = coderr.NewCodeError(coderr.Internal, "decode cluster status")
+	ErrInvalidClusterLabels     = coderr.NewCodeError(coderr.InvalidParams, "invalid cluster labels")
+	ErrDecodeClusterLabels      = coderr.NewCodeError(coderr.Internal, "decode cluster labels")
+	ErrEncodePlacementRecord    = coderr.NewCodeError(coderr.Internal, "encode placement record")
+	ErrDecodePlacementRecord    = coderr.NewCodeError(coderr.Internal, "decode placement record")
+	ErrTableExists              = coderr.NewCodeError(coderr.Conflict, "table already exists")
+	ErrShardDraining            = coderr.NewCodeError(coderr.ServiceUnavailable, "ddls of shard are drained")
+	ErrShardMoveConflict        = coderr.NewCodeError(coderr.Conflict, "shard changed during move")
+	ErrShardTopologyTooLarge    = coderr.NewCodeError(coderr.InsufficientStorage, "shard topology too large")
+	ErrReplayDiverged           = coderr.NewCodeError(coderr.Internal, "replay diverged from decision trace")
+	ErrNodeCapacityExceeded     = coderr.NewCodeError(coderr.Conflict, "node shard capacity exceeded")
+	ErrTableDropInFlight        = coderr.NewCodeError(coderr.ServiceUnavailable, "table of same name is being dropped")
+	ErrPartialTableDrop         = coderr.NewCodeError(coderr.ServiceUnavailable, "sub-tables left by table drop")
+	ErrSubTablesNotFound        = coderr.NewCodeError(coderr.InvalidParams, "sub-tables of partitioned table not found")
+	ErrSchemaNotFoundForTable   = coderr.NewCodeError(coderr.SchemaNotFound, "schema of table to create not found")
+	ErrRootPathOwned            = coderr.NewCodeError(coderr.Conflict, "rootPath owned by another deployment")
+	ErrDeploymentClaimConflict  = coderr.NewCodeError(coderr.Conflict, "deployment fingerprint written concurrently")
+	ErrEncodeFingerprint        = coderr.NewCodeError(coderr.Internal, "encode deployment fingerprint")
+	ErrDecodeFingerprint        = coderr.NewCodeError(coderr.Internal, "decode deployment fingerprint")
+)
@@ -0,0 +1,212 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"go.uber.org/zap"
+)
+
+// heartbeatView is the immutable view of the alive nodes, against which the fast path of the heartbeats is checked
+// without the lock of the cluster. It is rebuilt by the slow path, and dropped whenever the topology generation is
+// bumped, the cluster is loaded, or the options or the capacities of the nodes change.
+type heartbeatView struct {
+	generation       uint64
+	maxGenerationLag uint64
+	// shardIDs are all the shards of the cluster.
+	shardIDs map[uint32]struct{}
+	// nodeName -> the alive node
+	nodes map[string]heartbeatNodeView
+}
+
+type heartbeatNodeView struct {
+	// ownedShardIDs are the shards owned by the node.
+	ownedShardIDs map[uint32]struct{}
+	capacity      uint32
+	hasCapacity   bool
+}
+
+// heartbeatTouch is the latest heartbeat of an alive node handled by the fast path, which is not applied to the node
+// yet. The time is read from the local clock when the heartbeat is received, so the node is never regarded as late
+// for the touch applied late.
+type heartbeatTouch struct {
+	info *metapb.NodeInfo
+	time time.Time
+}
+
+// HandleHeartbeat handles the heartbeat of the node and returns the path taken, which is one of the heartbeat paths
+// of the schedule package, along with the shards the node should close because they are owned by other alive nodes,
+// which are only found by the slow path. ErrStaleTopology is returned if the generation carried by the ctx is too stale, and the
+// node is still registered just like the CheckTopologyGeneration before the RegisterNode.
+//
+// The heartbeat changing nothing but the liveness of an alive node takes the fast path without the lock of the
+// cluster, and the others are registered on the pool, which is waited for until the deadline. The registration is
+// bounded by the registerTimeout even if it is not waited for. The heartbeat failing to be registered within the
+// deadline takes the deferred path, where only the liveness of the node is kept until it is registered later, so the
+// nodes are never expired for the overload of the leader, e.g. during the DDL bursts.
+func (c *Cluster) HandleHeartbeat(ctx context.Context, info *metapb.NodeInfo, pool *schedule.HeartbeatPool,
+	deadline, registerTimeout time.Duration,
+) (string, []uint32, error) {
+	if log.DebugScopesActive() {
+		log.ScopedDebug(log.Entity{Cluster: c.metaData.GetName()}, "handle heartbeat", zap.String("node", info.GetNode()),
+			zap.Int("shards", len(info.GetShardsInfo())), zap.String("binary-version", info.GetBinaryVersion()))
+	}
+	if handled, err := c.processHeartbeatFast(ctx, info); handled {
+		return schedule.HeartbeatPathFast, nil, err
+	}
+
+	var (
+		staleErr  error
+		conflicts []uint32
+	)
+	registered := pool.Process(ctx, info.GetNode(), deadline, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, registerTimeout)
+		defer cancel()
+		staleErr = c.CheckTopologyGeneration(ctx)
+		conflicts = c.RegisterNode(ctx, info)
+	})
+	if !registered {
+		c.touchNode(info)
+		return schedule.HeartbeatPathDeferred, nil, nil
+	}
+	return schedule.HeartbeatPathSlow, conflicts, staleErr
+}
+
+// processHeartbeatFast handles the heartbeat without the lock of the cluster if it changes nothing but the liveness of
+// an alive node, i.e. the shards owned by the node and its capacity are the same as the ones already known, and false
+// is returned if the slow path, the RegisterNode, is required. The liveness of the node is recorded along with the
+// info and applied to the node later in batch, which involves no storage write.
+func (c *Cluster) processHeartbeatFast(ctx context.Context, info *metapb.NodeInfo) (bool, error) {
+	now := time.Now()
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+
+	view := c.heartbeatView
+	if view == nil {
+		return false, nil
+	}
+	node, ok := view.nodes[info.GetNode()]
+	if !ok || !node.matches(ctx, view, info) {
+		return false, nil
+	}
+	c.touchLocked(info, now)
+	return true, checkTopologyGeneration(ctx, view.generation, view.maxGenerationLag)
+}
+
+// touchNode records the liveness of the node whose heartbeat can't be registered in time, so that the node is not
+// expired for the delay of the leader. The touch only keeps an alive node alive, and the node registers or recovers
+// only by the RegisterNode.
+func (c *Cluster) touchNode(info *metapb.NodeInfo) {
+	now := time.Now()
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+
+	c.touchLocked(info, now)
+}
+
+// touchLocked records the touch of the node, which requires the heartbeatMu.
+func (c *Cluster) touchLocked(info *metapb.NodeInfo, now time.Time) {
+	if touch, ok := c.pendingTouches[info.GetNode()]; ok && touch.time.After(now) {
+		return
+	}
+	c.pendingTouches[info.GetNode()] = heartbeatTouch{info: info, time: now}
+}
+
+// FlushHeartbeats applies the pending touches of the fast path to the nodes, and it should be called periodically so
+// that the readers not refreshing the nodes see the recent liveness.
+func (c *Cluster) FlushHeartbeats() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.flushHeartbeatsLocked()
+}
+
+// flushHeartbeatsLocked applies the pending touches to the alive nodes, and the touches older than the last ones of
+// the nodes, e.g. those taken before the liveness is reset, are ignored.
+func (c *Cluster) flushHeartbeatsLocked() {
+	c.heartbeatMu.Lock()
+	touches := c.pendingTouches
+	c.pendingTouches = make(map[string]heartbeatTouch, len(touches))
+	c.heartbeatMu.Unlock()
+
+	for name, touch := range touches {
+		node, ok := c.nodesCache[name]
+		if !ok || !node.alive || !touch.time.After(node.lastTouchTime) {
+			continue
+		}
+		node.info = touch.info
+		node.lastTouchTime = touch.time
+		node.expiryHeld = false
+	}
+}
+
+// rebuildHeartbeatViewLocked rebuilds the view of the alive nodes for the fast path.
+func (c *Cluster) rebuildHeartbeatViewLocked() {
+	view := &heartbeatView{
+		generation:       c.topologyGeneration,
+		maxGenerationLag: c.options.MaxTopologyGenerationLag,
+		shardIDs:         make(map[uint32]struct{}, len(c.shardsCache)),
+		nodes:            make(map[string]heartbeatNodeView, len(c.nodesCache)),
+	}
+	for name, node := range c.nodesCache {
+		if !node.alive {
+			continue
+		}
+		capacity, hasCapacity := c.nodeShardCapacities[name]
+		view.nodes[name] = heartbeatNodeView{
+			ownedShardIDs: make(map[uint32]struct{}),
+			capacity:      capacity,
+			hasCapacity:   hasCapacity,
+		}
+	}
+	for shardID, shard := range c.shardsCache {
+		view.shardIDs[shardID] = struct{}{}
+		if node, ok := view.nodes[shard.node]; ok {
+			node.ownedShardIDs[shardID] = struct{}{}
+		}
+	}
+
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+	c.heartbeatView = view
+}
+
+// dropHeartbeatViewLocked drops the view, so the heartbeats take the slow path until it is rebuilt.
+func (c *Cluster) dropHeartbeatViewLocked() {
+	c.heartbeatMu.Lock()
+	defer c.heartbeatMu.Unlock()
+
+	c.heartbeatView = nil
+}
+
+// bumpTopologyGenerationLocked bumps the topology generation, which drops the view of the fast path.
+func (c *Cluster) bumpTopologyGenerationLocked() {
+	c.topologyGeneration++
+	c.dropHeartbeatViewLocked()
+}
+
+// matches tells whether the heartbeat reports the same shards and capacity of the node as the view.
+func (n heartbeatNodeView) matches(ctx context.Context, view *heartbeatView, info *metapb.NodeInfo) bool {
+	if capacity, ok := nodeShardCapacityFromContext(ctx); ok && (!n.hasCapacity || capacity != n.capacity) {
+		return false
+	}
+	reported := make(map[uint32]struct{}, len(n.ownedShardIDs))
+	for _, shardInfo := range info.GetShardsInfo() {
+		if shardInfo.GetRole() != metapb.ShardRole_LEADER {
+			continue
+		}
+		if _, ok := view.shardIDs[shardInfo.GetShardId()]; !ok {
+			continue
+		}
+		if _, ok := n.ownedShardIDs[shardInfo.GetShardId()]; !ok {
+			return false
+		}
+		reported[shardInfo.GetShardId()] = struct{}{}
+	}
+	return len(reported) == len(n.ownedShardIDs)
+}
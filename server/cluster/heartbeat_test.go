@@ -0,0 +1,261 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/stretchr/testify/require"
+)
+
+func heartbeatNodeInfo(node string, shardIDs ...uint32) *metapb.NodeInfo {
+	info := &metapb.NodeInfo{Node: node, Lease: 60}
+	for _, shardID := range shardIDs {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	return info
+}
+
+func TestHeartbeatFastPath(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:   ShardUnavailablePolicyReselect,
+		MaxTopologyGenerationLag: 1,
+	}))
+
+	pool := schedule.NewHeartbeatPool(1, 16)
+	defer pool.Close()
+	handle := func(ctx context.Context, info *metapb.NodeInfo) (string, error) {
+		path, _, err := cluster.HandleHeartbeat(ctx, info, pool, time.Second, time.Second)
+		return path, err
+	}
+
+	// The first heartbeat registers the node.
+	path, err := handle(ctx, heartbeatNodeInfo("a", 0, 1))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathSlow, path)
+	path, err = handle(ctx, heartbeatNodeInfo("a", 1, 0))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathFast, path)
+
+	// The fast path never waits for the lock of the cluster held by the DDLs.
+	cluster.lock.Lock()
+	path, err = handle(ctx, heartbeatNodeInfo("a", 0, 1))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathFast, path)
+	touchTime := cluster.nodesCache["a"].lastTouchTime
+	cluster.lock.Unlock()
+
+	// The touch is applied when the nodes are read.
+	nodes := cluster.GetNodes(0)
+	re.Len(nodes.Nodes, 1)
+	re.True(nodes.Nodes[0].LastTouchTime.After(touchTime))
+	re.Equal([]uint32{0, 1}, nodes.Nodes[0].ShardIDs)
+
+	// The changes of the ownership and the capacity take the slow path.
+	path, err = handle(ctx, heartbeatNodeInfo("a", 0))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathSlow, path)
+	path, err = handle(WithNodeShardCapacity(ctx, 4), heartbeatNodeInfo("a", 0))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathSlow, path)
+	path, err = handle(WithNodeShardCapacity(ctx, 4), heartbeatNodeInfo("a", 0))
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathFast, path)
+
+	// The stale generation is rejected by the fast path too, and the bumped generation drops the view.
+	observed := cluster.GetTopologyGeneration()
+	_, err = handle(ctx, heartbeatNodeInfo("b"))
+	re.NoError(err)
+	_, err = handle(ctx, heartbeatNodeInfo("c"))
+	re.NoError(err)
+	staleCtx := WithObservedTopologyGeneration(ctx, observed)
+	path, err = handle(staleCtx, heartbeatNodeInfo("c", 7))
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Equal(schedule.HeartbeatPathSlow, path)
+	path, err = handle(staleCtx, heartbeatNodeInfo("c", 7))
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Equal(schedule.HeartbeatPathFast, path)
+
+	// The touches taken before the liveness is reset are ignored.
+	cluster.touchNode(heartbeatNodeInfo("c", 7))
+	cluster.ResetNodeLiveness()
+	resetTime := cluster.nodesCache["c"].lastTouchTime
+	cluster.FlushHeartbeats()
+	re.Equal(resetTime, cluster.nodesCache["c"].lastTouchTime)
+
+	// The heartbeat not registered before the deadline keeps the node alive only, and it is registered later.
+	busyPool := schedule.NewHeartbeatPool(1, 1)
+	defer busyPool.Close()
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	go busyPool.Process(ctx, "blocker", time.Minute, func(context.Context) {
+		close(blocked)
+		<-release
+	})
+	<-blocked
+	cluster.lock.Lock()
+	cluster.nodesCache["c"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	path, _, err = cluster.HandleHeartbeat(ctx, heartbeatNodeInfo("c", 6), busyPool, 10*time.Millisecond, time.Second)
+	re.NoError(err)
+	re.Equal(schedule.HeartbeatPathDeferred, path)
+	nodeStatus := func(name string) NodeStatus {
+		for _, node := range cluster.GetNodes(0).Nodes {
+			if node.Name == name {
+				return node
+			}
+		}
+		return NodeStatus{}
+	}
+	re.True(nodeStatus("c").Alive)
+	re.Equal([]uint32{7}, nodeStatus("c").ShardIDs)
+
+	close(release)
+	re.Eventually(func() bool {
+		node := nodeStatus("c")
+		return node.Alive && len(node.ShardIDs) == 1 && node.ShardIDs[0] == 6
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestHeartbeatUnderDDLStorm sends about 1k heartbeats per second from many nodes during the DDL storm, and checks the
+// p99 latency of the heartbeats is within the default SLO.
+func TestHeartbeatUnderDDLStorm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip the load test in short mode")
+	}
+
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	const (
+		nodes             = 200
+		senders           = 20
+		heartbeatInterval = 200 * time.Millisecond
+		duration          = 3 * time.Second
+		ddlWorkers        = 8
+		slo               = 100 * time.Millisecond
+	)
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	pool := schedule.NewHeartbeatPool(8, 4096)
+	defer pool.Close()
+	infos := make([]*metapb.NodeInfo, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		info := heartbeatNodeInfo(fmt.Sprintf("node%d", i))
+		if i < testShardTotal {
+			info = heartbeatNodeInfo(info.GetNode(), uint32(i))
+		}
+		infos = append(infos, info)
+		_, _, err := cluster.HandleHeartbeat(ctx, info, pool, time.Second, time.Second)
+		re.NoError(err)
+	}
+
+	stop := make(chan struct{})
+	var ddlWg sync.WaitGroup
+	ddls := make([]int, ddlWorkers)
+	for i := 0; i < ddlWorkers; i++ {
+		ddlWg.Add(1)
+		go func(worker int) {
+			defer ddlWg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				tableName := fmt.Sprintf("table_%d_%d", worker, ddls[worker])
+				if _, err := manager.AllocTableID(ctx, testClusterName, "public", tableName); err != nil {
+					t.Errorf("create table:%s, err:%v", tableName, err)
+					return
+				}
+				if err := manager.DropTable(ctx, testClusterName, "public", tableName, false); err != nil {
+					t.Errorf("drop table:%s, err:%v", tableName, err)
+					return
+				}
+				ddls[worker]++
+			}
+		}(i)
+	}
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cluster.FlushHeartbeats()
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	latencies := make([]time.Duration, 0, int(duration/heartbeatInterval)*nodes)
+	var senderWg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		senderWg.Add(1)
+		go func(sender int) {
+			defer senderWg.Done()
+			ticker := time.NewTicker(heartbeatInterval)
+			defer ticker.Stop()
+			deadline := time.Now().Add(duration)
+			for time.Now().Before(deadline) {
+				<-ticker.C
+				for j := sender; j < nodes; j += senders {
+					start := time.Now()
+					if _, _, err := cluster.HandleHeartbeat(ctx, infos[j], pool, time.Second, time.Second); err != nil {
+						t.Errorf("heartbeat of node:%s, err:%v", infos[j].GetNode(), err)
+					}
+					latency := time.Since(start)
+					mu.Lock()
+					latencies = append(latencies, latency)
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	senderWg.Wait()
+	close(stop)
+	ddlWg.Wait()
+
+	totalDDLs := 0
+	for _, n := range ddls {
+		totalDDLs += n
+	}
+	re.Positive(totalDDLs)
+	re.GreaterOrEqual(len(latencies), int(duration/heartbeatInterval)*nodes*9/10)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p99 := latencies[len(latencies)*99/100]
+	re.Less(p99, slo, "heartbeats:%d, ddls:%d", len(latencies), totalDDLs)
+
+	for _, node := range cluster.GetNodes(0).Nodes {
+		re.True(node.Alive)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/server/hook"
+)
+
+type hooksKey struct{}
+
+// WithHooks returns a context whose DDLs invoke the hooks once they are committed.
+func WithHooks(ctx context.Context, hooks *hook.Registry) context.Context {
+	return context.WithValue(ctx, hooksKey{}, hooks)
+}
+
+// hooksFromContext returns the hooks carried by the ctx, and nil is returned if it is not set, which invokes nothing.
+func hooksFromContext(ctx context.Context) *hook.Registry {
+	hooks, _ := ctx.Value(hooksKey{}).(*hook.Registry)
+	return hooks
+}
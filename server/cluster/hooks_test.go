@@ -0,0 +1,76 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/hook"
+	"github.com/stretchr/testify/require"
+)
+
+type recordHook struct {
+	mu     sync.Mutex
+	events []hook.Event
+}
+
+func (h *recordHook) Name() string {
+	return "record"
+}
+
+func (h *recordHook) Handle(_ context.Context, event hook.Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+	return nil
+}
+
+func (h *recordHook) list() []hook.Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]hook.Event(nil), h.events...)
+}
+
+func TestTableCreatedHook(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	registry := hook.NewRegistry()
+	defer registry.Close()
+	recorder := &recordHook{}
+	re.NoError(registry.Register(recorder, hook.Options{}))
+	hooksCtx := WithHooks(ctx, registry)
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	// The tables created without the hooks and the existing tables returned invoke nothing.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	_, err = manager.AllocTableID(hooksCtx, testClusterName, "public", "t0")
+	re.NoError(err)
+	table, err := manager.AllocTableID(hooksCtx, testClusterName, "public", "t1")
+	re.NoError(err)
+
+	re.Eventually(func() bool {
+		return len(recorder.list()) > 0
+	}, defaultTestTimeout, time.Millisecond*10)
+	events := recorder.list()
+	re.Len(events, 1)
+	re.Equal(hook.EventTableCreated, events[0].Type)
+	re.Equal(testClusterName, events[0].Cluster)
+	re.Equal("public", events[0].Schema)
+	re.Equal("t1", events[0].Table)
+	re.Equal(table.GetID(), events[0].TableID)
+	re.Equal(table.GetShardID(), events[0].ShardID)
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultHotTableCapacity is the number of the tables tracked by the heavy hitter sketch, which bounds the memory
+// no matter how many tables there are.
+const defaultHotTableCapacity = 1024
+
+type tableKey struct {
+	schemaName string
+	tableName  string
+}
+
+type tableCounter struct {
+	key   tableKey
+	count uint64
+	// overestimate is the count inherited from the evicted counter, which is the max error of the count.
+	overestimate uint64
+	index        int
+}
+
+// tableCounterHeap is a min heap of the counters ordered by the count.
+type tableCounterHeap []*tableCounter
+
+func (h tableCounterHeap) Len() int           { return len(h) }
+func (h tableCounterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h tableCounterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *tableCounterHeap) Push(x interface{}) {
+	counter := x.(*tableCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *tableCounterHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
+
+// hotTables tracks the most looked up tables with the Space-Saving algorithm: when a table not tracked is looked up
+// and the sketch is full, the table takes over the counter with the smallest count. So any table looked up more than
+// total/capacity times is guaranteed to be tracked, and its count is overestimated by at most the overestimate.
+type hotTables struct {
+	capacity int
+
+	// mu protects the following fields.
+	mu       sync.Mutex
+	counters map[tableKey]*tableCounter
+	heap     tableCounterHeap
+}
+
+func newHotTables(capacity int) *hotTables {
+	return &hotTables{
+		capacity: capacity,
+		counters: make(map[tableKey]*tableCounter, capacity),
+		heap:     make(tableCounterHeap, 0, capacity),
+	}
+}
+
+func (h *hotTables) record(schemaName, tableName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := tableKey{schemaName: schemaName, tableName: tableName}
+	if counter, ok := h.counters[key]; ok {
+		counter.count++
+		heap.Fix(&h.heap, counter.index)
+		return
+	}
+
+	if len(h.heap) < h.capacity {
+		counter := &tableCounter{key: key, count: 1}
+		heap.Push(&h.heap, counter)
+		h.counters[key] = counter
+		return
+	}
+
+	counter := h.heap[0]
+	delete(h.counters, counter.key)
+	counter.key = key
+	counter.overestimate = counter.count
+	counter.count++
+	heap.Fix(&h.heap, 0)
+	h.counters[key] = counter
+}
+
+func (h *hotTables) top(n int) []HotTable {
+	h.mu.Lock()
+	tables := make([]HotTable, 0, len(h.heap))
+	for _, counter := range h.heap {
+		tables = append(tables, HotTable{
+			SchemaName:   counter.key.schemaName,
+			TableName:    counter.key.tableName,
+			Lookups:      counter.count,
+			Overestimate: counter.overestimate,
+		})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Lookups != tables[j].Lookups {
+			return tables[i].Lookups > tables[j].Lookups
+		}
+		if tables[i].SchemaName != tables[j].SchemaName {
+			return tables[i].SchemaName < tables[j].SchemaName
+		}
+		return tables[i].TableName < tables[j].TableName
+	})
+	if n < len(tables) {
+		tables = tables[:n]
+	}
+	return tables
+}
+
+// HotTable is a table with many route lookups.
+type HotTable struct {
+	SchemaName string `json:"schema_name"`
+	TableName  string `json:"table_name"`
+	// Lookups is the estimated number of the route lookups, which may be larger than the real one by Overestimate.
+	Lookups      uint64 `json:"lookups"`
+	Overestimate uint64 `json:"overestimate"`
+}
+
+// HotShard is a shard with many DDLs.
+type HotShard struct {
+	ShardID uint32 `json:"shard_id"`
+	DDLs    uint64 `json:"ddls"`
+}
+
+// HotSpots are the busiest tables and shards of the cluster since the meta server started.
+type HotSpots struct {
+	Tables []HotTable `json:"tables"`
+	Shards []HotShard `json:"shards"`
+}
+
+// recordRouteLookup is goroutine safe.
+func (c *Cluster) recordRouteLookup(schemaName string, table *Table) {
+	c.hotTables.record(schemaName, table.GetName())
+	c.routeStats.record(table.GetID(), time.Now())
+	routeLookupsCounter.WithLabelValues(c.metaData.GetName()).Inc()
+}
+
+func (c *Cluster) recordShardDDLLocked(shardID uint32) {
+	c.shardDDLCounts[shardID]++
+	shardDDLsCounter.WithLabelValues(c.metaData.GetName(), strconv.FormatUint(uint64(shardID), 10)).Inc()
+}
+
+// HotSpots returns the topN tables with the most route lookups and the topN shards with the most DDLs.
+func (c *Cluster) HotSpots(topN int) *HotSpots {
+	c.lock.RLock()
+	shards := make([]HotShard, 0, len(c.shardDDLCounts))
+	for shardID, count := range c.shardDDLCounts {
+		shards = append(shards, HotShard{ShardID: shardID, DDLs: count})
+	}
+	c.lock.RUnlock()
+
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].DDLs != shards[j].DDLs {
+			return shards[i].DDLs > shards[j].DDLs
+		}
+		return shards[i].ShardID < shards[j].ShardID
+	})
+	if topN < len(shards) {
+		shards = shards[:topN]
+	}
+
+	return &HotSpots{
+		Tables: c.hotTables.top(topN),
+		Shards: shards,
+	}
+}
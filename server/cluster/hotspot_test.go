@@ -0,0 +1,83 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotTablesSketch(t *testing.T) {
+	re := require.New(t)
+
+	tables := newHotTables(2)
+	record := func(tableName string, times int) {
+		for i := 0; i < times; i++ {
+			tables.record("public", tableName)
+		}
+	}
+	record("a", 5)
+	record("b", 3)
+	// The table c takes over the counter of the table b with the smallest count.
+	record("c", 1)
+
+	re.Equal([]HotTable{
+		{SchemaName: "public", TableName: "a", Lookups: 5},
+		{SchemaName: "public", TableName: "c", Lookups: 4, Overestimate: 3},
+	}, tables.top(10))
+	re.Equal([]HotTable{{SchemaName: "public", TableName: "a", Lookups: 5}}, tables.top(1))
+
+	// The heavy hitter is always tracked no matter how many tables are looked up once.
+	for i := 0; i < 100; i++ {
+		record(fmt.Sprintf("cold_%d", i), 1)
+		record("hot", 2)
+	}
+	top := tables.top(1)
+	re.Equal("hot", top[0].TableName)
+	re.True(top[0].Lookups-top[0].Overestimate <= 200)
+	re.True(top[0].Lookups >= 200)
+}
+
+func TestHotSpots(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 2)
+	re.NoError(err)
+
+	// Three tables are created on the shard with the fewest tables by turns and one of them is dropped.
+	hotTable, err := manager.AllocTableID(ctx, testClusterName, "public", "hot")
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "cold")
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "dropped")
+	re.NoError(err)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "dropped", false))
+	for i := 0; i < 3; i++ {
+		_, err = manager.AllocTableID(ctx, testClusterName, "public", "hot")
+		re.NoError(err)
+	}
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "cold")
+	re.NoError(err)
+
+	hotSpots, err := manager.HotSpots(ctx, testClusterName, 1)
+	re.NoError(err)
+	re.Equal([]HotTable{{SchemaName: "public", TableName: "hot", Lookups: 3}}, hotSpots.Tables)
+	re.Equal([]HotShard{{ShardID: hotTable.GetShardID(), DDLs: 3}}, hotSpots.Shards)
+
+	hotSpots, err = manager.HotSpots(ctx, testClusterName, 10)
+	re.NoError(err)
+	re.Len(hotSpots.Tables, 2)
+	re.Len(hotSpots.Shards, 2)
+	re.Equal(uint64(1), hotSpots.Shards[1].DDLs)
+}
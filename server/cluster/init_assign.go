@@ -0,0 +1,137 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InitialShardAssignment decides the owners of the shards of a new cluster before any node registers, so that the
+// topology of the cluster is reproducible.
+type InitialShardAssignment struct {
+	// Nodes are the names of the nodes expected to join the cluster.
+	Nodes []string
+	// Shards maps the shard to its initial owner, and the shards absent are spread over the Nodes in round-robin order
+	// of the sorted names.
+	Shards map[uint32]string
+}
+
+// ParseInitialShardAssignment parses the comma-separated node names and the comma-separated shard assignments in the
+// form of shardID=node.
+func ParseInitialShardAssignment(nodes, shards string) (*InitialShardAssignment, error) {
+	assignment := &InitialShardAssignment{Shards: make(map[uint32]string)}
+	for _, node := range strings.Split(nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			assignment.Nodes = append(assignment.Nodes, node)
+		}
+	}
+	for _, item := range strings.Split(shards, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidShardAssignment.WithCausef("invalid shard assignment:%s", item)
+		}
+		shardID, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil {
+			return nil, ErrInvalidShardAssignment.WithCausef("invalid shard id of assignment:%s, err:%v", item, err)
+		}
+		assignment.Shards[uint32(shardID)] = strings.TrimSpace(parts[1])
+	}
+	return assignment, nil
+}
+
+// resolve validates the assignment and returns the initial owners of all the shards.
+func (a *InitialShardAssignment) resolve(shardTotal uint32) (map[uint32]string, error) {
+	if len(a.Nodes) == 0 {
+		return nil, ErrInvalidShardAssignment.WithCausef("no node is given")
+	}
+	nodes := make([]string, len(a.Nodes))
+	copy(nodes, a.Nodes)
+	sort.Strings(nodes)
+	known := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		if _, ok := known[node]; ok {
+			return nil, ErrInvalidShardAssignment.WithCausef("duplicate node:%s", node)
+		}
+		known[node] = struct{}{}
+	}
+
+	owners := make(map[uint32]string, shardTotal)
+	for shardID, node := range a.Shards {
+		if shardID >= shardTotal {
+			return nil, ErrInvalidShardAssignment.WithCausef("shard:%d exceeds shard total:%d", shardID, shardTotal)
+		}
+		if _, ok := known[node]; !ok {
+			return nil, ErrInvalidShardAssignment.WithCausef("shard:%d is assigned to unknown node:%s, nodes:%v",
+				shardID, node, nodes)
+		}
+		owners[shardID] = node
+	}
+	next := 0
+	for shardID := uint32(0); shardID < shardTotal; shardID++ {
+		if _, ok := owners[shardID]; ok {
+			continue
+		}
+		owners[shardID] = nodes[next%len(nodes)]
+		next++
+	}
+	return owners, nil
+}
+
+// ApplyInitialShardAssignment assigns the shards never owned by any node to their initial owners once the owners are
+// alive. The shards of the nodes never joining should be assigned manually. Nothing is assigned in the maintenance mode.
+func (c *Cluster) ApplyInitialShardAssignment(ctx context.Context) ([]ShardAssignment, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.status.Maintenance || len(c.options.InitialShardAssignment) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	shardIDs := make([]uint32, 0)
+	for shardID, shard := range c.shardsCache {
+		if !c.waitsForInitialOwnerLocked(shard) {
+			continue
+		}
+		if node, ok := c.nodesCache[c.options.InitialShardAssignment[shardID]]; ok && node.IsAlive(now) {
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+	if len(shardIDs) == 0 {
+		return nil, nil
+	}
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+
+	procedureID, err := newRandomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate initial assignment procedure id")
+	}
+	assignments := make([]ShardAssignment, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		node := c.options.InitialShardAssignment[shardID]
+		if err := c.assignShardLocked(ctx, shardID, node, ShardOwnerInitAssign, procedureID); err != nil {
+			return assignments, err
+		}
+		assignments = append(assignments, ShardAssignment{ShardID: shardID, Node: node})
+	}
+	c.listUnassignedShardsLocked(now, 0)
+	return assignments, nil
+}
+
+// waitsForInitialOwnerLocked tells whether the shard has never been owned and has an initial owner.
+func (c *Cluster) waitsForInitialOwnerLocked(shard *Shard) bool {
+	if shard.node != "" || shard.lastOwnerChange != nil {
+		return false
+	}
+	_, ok := c.options.InitialShardAssignment[shard.GetID()]
+	return ok
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInitialShardAssignment(t *testing.T) {
+	re := require.New(t)
+
+	assignment, err := ParseInitialShardAssignment("b:8831, a:8831", "0=b:8831, 3=b:8831")
+	re.NoError(err)
+	re.Equal([]string{"b:8831", "a:8831"}, assignment.Nodes)
+	re.Equal(map[uint32]string{0: "b:8831", 3: "b:8831"}, assignment.Shards)
+
+	owners, err := assignment.resolve(4)
+	re.NoError(err)
+	re.Equal(map[uint32]string{0: "b:8831", 1: "a:8831", 2: "b:8831", 3: "b:8831"}, owners)
+
+	_, err = ParseInitialShardAssignment("a", "0:a")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = ParseInitialShardAssignment("a", "x=a")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
+
+func TestInitialShardAssignment(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+
+	// The assignment referring to unknown nodes or shards is rejected and no cluster is created.
+	_, err := manager.CreateClusterWithAssignment(ctx, testClusterName, 2, 1, testShardTotal,
+		&InitialShardAssignment{Nodes: []string{"a", "b"}, Shards: map[uint32]string{0: "c"}})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.Contains(err.Error(), "unknown node:c")
+	_, err = manager.CreateClusterWithAssignment(ctx, testClusterName, 2, 1, testShardTotal,
+		&InitialShardAssignment{Nodes: []string{"a", "b"}, Shards: map[uint32]string{testShardTotal: "a"}})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = manager.CreateClusterWithAssignment(ctx, testClusterName, 2, 1, testShardTotal, &InitialShardAssignment{})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = manager.GetCluster(ctx, testClusterName)
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	cluster, err := manager.CreateClusterWithAssignment(ctx, testClusterName, 2, 1, testShardTotal,
+		&InitialShardAssignment{Nodes: []string{"b", "a"}, Shards: map[uint32]string{0: "b"}})
+	re.NoError(err)
+	re.Len(cluster.GetOptions().InitialShardAssignment, testShardTotal)
+
+	// Only the shards of the alive initial owner are assigned, and the others wait for their owner.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60}))
+	assignments, err := cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	re.Empty(assignments)
+	assignments, err = cluster.ApplyInitialShardAssignment(ctx)
+	re.NoError(err)
+	re.Equal([]ShardAssignment{{1, "a"}, {3, "a"}, {5, "a"}, {7, "a"}}, assignments)
+	change, err := manager.GetShardOwnerChange(ctx, testClusterName, 1)
+	re.NoError(err)
+	re.Equal(ShardOwnerInitAssign, change.Reason)
+
+	// The assignment survives reloading.
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	cluster, err = manager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	assignments, err = cluster.ApplyInitialShardAssignment(ctx)
+	re.NoError(err)
+	re.Equal([]ShardAssignment{{0, "b"}, {2, "b"}, {4, "b"}, {6, "b"}}, assignments)
+}
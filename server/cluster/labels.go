@@ -0,0 +1,178 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	maxClusterLabelLength = 64
+	maxClusterOwnerLength = 128
+	maxClusterTags        = 32
+	maxClusterTagValueLen = 256
+)
+
+// clusterLabelPattern is the pattern of the environment and the keys of the tags, which may be used by the tooling
+// as the values of the metric labels and the keys of the policies.
+var clusterLabelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// ClusterLabels describe the cluster so that the tooling can tell the clusters apart, e.g. prod from staging, and
+// they change no behavior of the cluster. They are persisted separately from the options.
+type ClusterLabels struct {
+	// Environment is where the cluster is deployed, e.g. prod, staging or dev, and it is carried by the audit records
+	// and the info metric of the cluster.
+	Environment string            `json:"environment,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// ParseClusterTags parses the comma-separated tags in the form of key=value.
+func ParseClusterTags(tags string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, item := range strings.Split(tags, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidClusterLabels.WithCausef("invalid tag:%s", item)
+		}
+		parsed[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return parsed, nil
+}
+
+func (l ClusterLabels) validate() error {
+	if l.Environment != "" && (len(l.Environment) > maxClusterLabelLength || !clusterLabelPattern.MatchString(l.Environment)) {
+		return ErrInvalidClusterLabels.WithCausef("environment:%q should match %s and be at most %d bytes",
+			l.Environment, clusterLabelPattern, maxClusterLabelLength)
+	}
+	if len(l.Owner) > maxClusterOwnerLength {
+		return ErrInvalidClusterLabels.WithCausef("owner is longer than %d bytes", maxClusterOwnerLength)
+	}
+	if len(l.Tags) > maxClusterTags {
+		return ErrInvalidClusterLabels.WithCausef("%d tags are more than %d", len(l.Tags), maxClusterTags)
+	}
+	for key, value := range l.Tags {
+		if len(key) > maxClusterLabelLength || !clusterLabelPattern.MatchString(key) {
+			return ErrInvalidClusterLabels.WithCausef("tag key:%q should match %s and be at most %d bytes",
+				key, clusterLabelPattern, maxClusterLabelLength)
+		}
+		if len(value) > maxClusterTagValueLen {
+			return ErrInvalidClusterLabels.WithCausef("value of tag:%s is longer than %d bytes", key, maxClusterTagValueLen)
+		}
+	}
+	return nil
+}
+
+func (l ClusterLabels) clone() ClusterLabels {
+	if l.Tags == nil {
+		return l
+	}
+	tags := make(map[string]string, len(l.Tags))
+	for key, value := range l.Tags {
+		tags[key] = value
+	}
+	l.Tags = tags
+	return l
+}
+
+// ClusterSummary describes a cluster for listing the clusters.
+type ClusterSummary struct {
+	ID         uint32        `json:"id"`
+	Name       string        `json:"name"`
+	ShardTotal uint32        `json:"shard_total"`
+	State      ClusterState  `json:"state"`
+	Labels     ClusterLabels `json:"labels"`
+}
+
+func (c *Cluster) Summary() ClusterSummary {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return ClusterSummary{
+		ID:         c.clusterID,
+		Name:       c.metaData.GetName(),
+		ShardTotal: c.metaData.GetShardTotal(),
+		State:      c.status.State,
+		Labels:     c.labels.clone(),
+	}
+}
+
+// sortClusterSummaries sorts the summaries by the names of the clusters.
+func sortClusterSummaries(summaries []ClusterSummary) {
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+}
+
+func (c *Cluster) GetLabels() ClusterLabels {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.labels.clone()
+}
+
+// Environment returns the environment of the cluster, which is empty if not labeled.
+func (c *Cluster) Environment() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.labels.Environment
+}
+
+// SetLabels validates and persists the labels of the cluster, which replace the current ones as a whole.
+func (c *Cluster) SetLabels(ctx context.Context, labels ClusterLabels) error {
+	if err := labels.validate(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(labels)
+	if err != nil {
+		return ErrInvalidClusterLabels.WithCause(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.storage.PutClusterLabels(ctx, c.clusterID, string(value)); err != nil {
+		return errors.Wrap(err, "put cluster labels")
+	}
+	c.labels = labels.clone()
+	c.observeClusterInfoLocked()
+	log.Info("set cluster labels", zap.String("cluster", c.metaData.GetName()), zap.ByteString("labels", value))
+	return nil
+}
+
+// loadLabels loads the persisted labels, and the empty labels are returned if not set.
+func (c *Cluster) loadLabels(ctx context.Context) (ClusterLabels, error) {
+	value, err := c.storage.GetClusterLabels(ctx, c.clusterID)
+	if err != nil {
+		return ClusterLabels{}, errors.Wrap(err, "get cluster labels")
+	}
+	if value == "" {
+		return ClusterLabels{}, nil
+	}
+
+	labels := ClusterLabels{}
+	if err := json.Unmarshal([]byte(value), &labels); err != nil {
+		return ClusterLabels{}, ErrDecodeClusterLabels.WithCausef("labels:%s, err:%v", value, err)
+	}
+	return labels, nil
+}
+
+// observeClusterInfoLocked replaces the series of the info metric of the cluster with the one of the current name and
+// labels, which is joined with the other metrics of the cluster by the name to tell their environment.
+func (c *Cluster) observeClusterInfoLocked() {
+	if c.clusterInfoSeries != nil {
+		clusterInfoGauge.DeleteLabelValues(c.clusterInfoSeries...)
+	}
+	c.clusterInfoSeries = []string{c.metaData.GetName(), c.labels.Environment, c.labels.Owner}
+	clusterInfoGauge.WithLabelValues(c.clusterInfoSeries...).Set(1)
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterLabels(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	tags, err := ParseClusterTags(" team=storage, region=us-east-1 ,")
+	re.NoError(err)
+	re.Equal(map[string]string{"team": "storage", "region": "us-east-1"}, tags)
+	_, err = ParseClusterTags("team")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err = manager.CreateClusterWithOptions(ctx, "invalid", 1, 1, testShardTotal, CreateClusterOptions{
+		Labels: ClusterLabels{Environment: "prod env"},
+	})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	cluster, err := manager.CreateClusterWithOptions(ctx, testClusterName, 1, 1, testShardTotal, CreateClusterOptions{
+		Labels: ClusterLabels{Environment: "staging", Owner: "storage-team", Tags: tags},
+	})
+	re.NoError(err)
+	_, err = manager.CreateCluster(ctx, "unlabeled", 1, 1, testShardTotal)
+	re.NoError(err)
+
+	summaries := manager.ListClusterSummaries(ctx)
+	re.Len(summaries, 2)
+	re.Equal(testClusterName, summaries[0].Name)
+	re.Equal(ClusterStateEmpty, summaries[0].State)
+	re.Equal(uint32(testShardTotal), summaries[0].ShardTotal)
+	re.Equal("staging", summaries[0].Labels.Environment)
+	re.Equal(tags, summaries[0].Labels.Tags)
+	re.Equal("unlabeled", summaries[1].Name)
+	re.Empty(summaries[1].Labels.Environment)
+	re.Equal(1.0, testutil.ToFloat64(clusterInfoGauge.WithLabelValues(testClusterName, "staging", "storage-team")))
+
+	// The labels are replaced as a whole, and the returned labels are copies.
+	re.True(coderr.Is(manager.SetClusterLabels(ctx, testClusterName, ClusterLabels{Tags: map[string]string{"": "x"}}),
+		coderr.InvalidParams))
+	series := testutil.CollectAndCount(clusterInfoGauge)
+	re.NoError(manager.SetClusterLabels(ctx, testClusterName, ClusterLabels{Environment: "prod", Tags: map[string]string{"tier": "1"}}))
+	re.Equal(series, testutil.CollectAndCount(clusterInfoGauge))
+	labels := cluster.GetLabels()
+	labels.Tags["tier"] = "2"
+	re.Equal(ClusterLabels{Environment: "prod", Tags: map[string]string{"tier": "1"}}, cluster.GetLabels())
+	re.Equal("prod", cluster.Environment())
+	re.Equal(1.0, testutil.ToFloat64(clusterInfoGauge.WithLabelValues(testClusterName, "prod", "")))
+
+	// The labels are loaded along with the cluster, and the renamed cluster keeps them.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	re.NoError(reloaded.RenameCluster(ctx, testClusterName, "renamed", 0))
+	renamed, err := reloaded.GetCluster(ctx, "renamed")
+	re.NoError(err)
+	re.Equal("prod", renamed.Environment())
+	re.Equal(1.0, testutil.ToFloat64(clusterInfoGauge.WithLabelValues("renamed", "prod", "")))
+}
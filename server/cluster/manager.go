@@ -0,0 +1,764 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/id"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	AllocClusterIDPrefix = "ClusterID"
+	AllocSchemaIDPrefix  = "SchemaID"
+	AllocTableIDPrefix   = "TableID"
+)
+
+type Manager interface {
+	// Load loads all the clusters from the storage.
+	Load(ctx context.Context) error
+	CreateCluster(ctx context.Context, clusterName string, nodeCount, replicationFactor, shardTotal uint32) (*Cluster, error)
+	// CreateClusterWithAssignment creates the cluster whose shards are assigned to the given initial owners once they
+	// join, and it fails if the assignment refers to unknown nodes or shards.
+	CreateClusterWithAssignment(ctx context.Context, clusterName string, nodeCount, replicationFactor, shardTotal uint32,
+		assignment *InitialShardAssignment) (*Cluster, error)
+	// CreateClusterWithOptions creates the cluster with the options which can only be decided at the creation.
+	CreateClusterWithOptions(ctx context.Context, clusterName string, nodeCount, replicationFactor, shardTotal uint32,
+		opts CreateClusterOptions) (*Cluster, error)
+	// GetCluster returns the cluster by its name, and the old name of a renamed cluster is accepted in the grace period.
+	GetCluster(ctx context.Context, clusterName string) (*Cluster, error)
+	ListClusters(ctx context.Context) []*Cluster
+	// ListClusterSummaries returns the summaries of all the clusters along with their labels sorted by the names.
+	ListClusterSummaries(ctx context.Context) []ClusterSummary
+	// SetClusterLabels validates and persists the labels of the cluster, which replace the current ones as a whole.
+	SetClusterLabels(ctx context.Context, clusterName string, labels ClusterLabels) error
+	// RenameCluster changes the name of the cluster, and the old name is still accepted in the grace period.
+	RenameCluster(ctx context.Context, oldName, newName string, gracePeriod time.Duration) error
+	// AllocSchemaID creates the schema with default options if not exists and returns its id.
+	AllocSchemaID(ctx context.Context, clusterName, schemaName string) (uint32, error)
+	// CreateSchema creates the schema with the shard count hint if not exists.
+	CreateSchema(ctx context.Context, clusterName, schemaName string, shardCountHint uint32) (*Schema, error)
+	AllocTableID(ctx context.Context, clusterName, schemaName, tableName string) (*Table, error)
+	// RegisterNode registers the node of the cluster according to its heartbeat.
+	RegisterNode(ctx context.Context, clusterName string, info *metapb.NodeInfo) error
+	// GetNodes returns the registered nodes of the cluster unless the topology generation equals to ifGenerationNot.
+	GetNodes(ctx context.Context, clusterName string, ifGenerationNot uint64) (*NodesResult, error)
+	// GetTopology returns the assembled topology of the cluster unless its version equals to ifVersionNot.
+	GetTopology(ctx context.Context, clusterName string, ifVersionNot uint64) (*TopologyResult, error)
+	// ListFailedProcedures returns the latest failed procedures of the cluster with their compensation logs.
+	ListFailedProcedures(ctx context.Context, clusterName string) ([]FailedProcedure, error)
+	// ListPendingReconciles returns the created tables whose shard topologies are not persisted yet.
+	ListPendingReconciles(ctx context.Context, clusterName string) ([]PendingReconcile, error)
+	// SetClusterOptions validates and persists the options of the cluster.
+	SetClusterOptions(ctx context.Context, clusterName string, opts Options) error
+	// UpdateClusterOptions changes the current options of the cluster by the update, and the updated options are
+	// returned.
+	UpdateClusterOptions(ctx context.Context, clusterName string, update func(opts *Options)) (Options, error)
+	// SetClusterMaintenance enters or leaves the maintenance mode of the cluster.
+	SetClusterMaintenance(ctx context.Context, clusterName string, enabled bool, reason string) error
+	// ListUnassignedShards lists the shards owned by no node.
+	ListUnassignedShards(ctx context.Context, clusterName string) ([]uint32, error)
+	// AssignShard assigns the unassigned shard to the alive node.
+	AssignShard(ctx context.Context, clusterName string, shardID uint32, node string) error
+	// GetShardOwnerChange returns the last ownership change of the shard, and nil if its owner has never changed.
+	GetShardOwnerChange(ctx context.Context, clusterName string, shardID uint32) (*ShardOwnerChange, error)
+	// FreezeShardVersion pins the version of the shard and returns the token to bump or unfreeze it.
+	FreezeShardVersion(ctx context.Context, clusterName string, shardID uint32) (string, error)
+	UnfreezeShardVersion(ctx context.Context, clusterName, token string) error
+	// AlterTable persists the new encoded schema of the table if its current schema version is the expectedVersion.
+	AlterTable(ctx context.Context, clusterName, schemaName, tableName string, expectedVersion uint64, encodedSchema []byte) (*Table, error)
+	// GetShardTables returns the tables with their schema versions on the shards.
+	GetShardTables(ctx context.Context, clusterName string, shardIDs []uint32) (map[uint32]*ShardTables, error)
+	// DropTable drops the table, and the table meta is deleted in background if async is set.
+	DropTable(ctx context.Context, clusterName, schemaName, tableName string, async bool) error
+	// DropPartitionedTable drops the partitioned table along with its sub-tables, and the progress is returned even if
+	// it fails.
+	DropPartitionedTable(ctx context.Context, clusterName, schemaName, tableName string) (*PartitionedTableDrop, error)
+	GetSchemaStats(ctx context.Context, clusterName, schemaName string) (*SchemaStats, error)
+	// ReserveTableName reserves the table name for the ttl, and the table can only be created with the returned token
+	// before the reservation expires.
+	ReserveTableName(ctx context.Context, clusterName, schemaName, tableName string, ttl time.Duration) (*TableNameReservation, error)
+	// ReleaseTableName releases the reservation of the token before it expires.
+	ReleaseTableName(ctx context.Context, clusterName, schemaName, tableName, token string) error
+	// ListTables lists the tables of the schema with their route statistics and the reserved table names.
+	ListTables(ctx context.Context, clusterName, schemaName string, opts ListTablesOptions) ([]*TableListing, error)
+	// ExplainPlacement explains why the table is placed on its shard by the constraints satisfied or relaxed.
+	ExplainPlacement(ctx context.Context, clusterName, schemaName, tableName string) (*PlacementExplanation, error)
+	// ExplainTablePlacement explains the placement of the table with the id along with the decision recorded at its
+	// creation and the move of its shard since then.
+	ExplainTablePlacement(ctx context.Context, clusterName string, tableID uint64) (*PlacementExplanation, error)
+	// HotSpots returns the topN tables with the most route lookups and the topN shards with the most DDLs.
+	HotSpots(ctx context.Context, clusterName string, topN int) (*HotSpots, error)
+	// GetNodeSnapshot returns the complete desired state of the node in one consistent response, which is fetched by
+	// the node at startup.
+	GetNodeSnapshot(ctx context.Context, clusterName, nodeName string) (*NodeSnapshot, error)
+	// AcquireRestartToken grants the node a token to restart if the shards hosted by it still keep enough replicas.
+	AcquireRestartToken(ctx context.Context, clusterName, node string, ttl time.Duration) (*RestartDecision, error)
+	// ReleaseRestartToken releases the restart token after the node is alive again.
+	ReleaseRestartToken(ctx context.Context, clusterName, node, token string) error
+	// ExportTopologyDOT renders the topology of the cluster as a Graphviz DOT graph into w, and the tables are
+	// collapsed into the counts on the shards unless expandTables is set.
+	ExportTopologyDOT(ctx context.Context, clusterName string, w io.Writer, expandTables bool) error
+	// ExportShardMappingCSV writes the owner, the table count, the version and the zone of every shard into w as CSV.
+	ExportShardMappingCSV(ctx context.Context, clusterName string, w io.Writer) error
+	// ExportClusterSnapshot writes the snapshot of all the meta data of the cluster into w.
+	ExportClusterSnapshot(ctx context.Context, clusterName string, w io.Writer) error
+	// DiffClusterSnapshot compares the snapshot read from r with the live meta data of the cluster.
+	DiffClusterSnapshot(ctx context.Context, clusterName string, r io.Reader) (*SnapshotDiff, error)
+	// RestoreClusterFromSnapshot replaces the meta data of the cluster with the snapshot read from r, and the confirm
+	// must be the cluster name to avoid restoring the wrong cluster by mistake. The restore is not atomic: the meta data
+	// too large for a single transaction are replaced in batches, and the cluster whose restore fails midway returns
+	// ErrPartiallyRestored to all the other operations, even after the reload, until it is restored again.
+	RestoreClusterFromSnapshot(ctx context.Context, clusterName string, r io.Reader, confirm string) error
+}
+
+type managerImpl struct {
+	// RWMutex is used to protect clusters and aliases when creating or renaming cluster.
+	lock     sync.RWMutex
+	clusters map[string]*Cluster
+	// aliases are the old names of the renamed clusters, which are still accepted in the grace period.
+	aliases map[string]*clusterAlias
+	// partiallyRestored are the clusters whose restore is interrupted midway, which are kept out of the clusters and
+	// only accessible to the restore until it is done.
+	partiallyRestored map[string]*Cluster
+
+	storage  storage.Storage
+	rootPath string
+	alloc    id.Allocator
+}
+
+type clusterAlias struct {
+	cluster  *Cluster
+	expireAt time.Time
+}
+
+func NewManagerImpl(storage storage.Storage, rootPath string) Manager {
+	return &managerImpl{
+		clusters:          make(map[string]*Cluster),
+		aliases:           make(map[string]*clusterAlias),
+		partiallyRestored: make(map[string]*Cluster),
+		storage:           storage,
+		rootPath:          rootPath,
+		alloc:             id.NewAllocatorImpl(storage, rootPath, AllocClusterIDPrefix),
+	}
+}
+
+func (m *managerImpl) Load(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metas, err := m.storage.ListClusters(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list clusters")
+	}
+	nameIndex, err := m.storage.ListClusterNameIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list cluster name index")
+	}
+
+	clusters := make(map[string]*Cluster, len(metas))
+	partiallyRestored := make(map[string]*Cluster)
+	for _, meta := range metas {
+		// The clusters created before the name index is introduced have no index entries.
+		if clusterID, ok := nameIndex[meta.GetName()]; !ok {
+			if err := m.storage.PutClusterNameIndex(ctx, meta.GetName(), meta.GetId()); err != nil {
+				return errors.Wrapf(err, "backfill cluster name index, cluster:%s", meta.GetName())
+			}
+		} else if clusterID != meta.GetId() {
+			log.Error("cluster name is indexed to another cluster", zap.String("cluster", meta.GetName()),
+				zap.Uint32("cluster-id", meta.GetId()), zap.Uint32("indexed-cluster-id", clusterID))
+		}
+
+		cluster := m.newCluster(meta)
+		restoring, err := m.storage.IsClusterPartiallyRestored(ctx, meta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "check cluster restore, cluster:%s", meta.GetName())
+		}
+		if restoring {
+			log.Error("cluster is partially restored, restore it from the snapshot again",
+				zap.String("cluster", meta.GetName()))
+			partiallyRestored[meta.GetName()] = cluster
+			continue
+		}
+		if err := cluster.Load(ctx); err != nil {
+			return errors.Wrapf(err, "load cluster, cluster:%s", meta.GetName())
+		}
+		clusters[meta.GetName()] = cluster
+	}
+
+	m.clusters = clusters
+	m.partiallyRestored = partiallyRestored
+	return nil
+}
+
+func (m *managerImpl) CreateCluster(ctx context.Context, clusterName string, nodeCount, replicationFactor, shardTotal uint32) (*Cluster, error) {
+	return m.CreateClusterWithAssignment(ctx, clusterName, nodeCount, replicationFactor, shardTotal, nil)
+}
+
+func (m *managerImpl) CreateClusterWithAssignment(ctx context.Context, clusterName string, nodeCount, replicationFactor,
+	shardTotal uint32, assignment *InitialShardAssignment,
+) (*Cluster, error) {
+	return m.CreateClusterWithOptions(ctx, clusterName, nodeCount, replicationFactor, shardTotal,
+		CreateClusterOptions{InitialShardAssignment: assignment})
+}
+
+// CreateClusterOptions are the options of a new cluster which can't be changed after the creation.
+type CreateClusterOptions struct {
+	InitialShardAssignment *InitialShardAssignment
+	// TableNameScope is TableNameScopeSchema if it is empty.
+	TableNameScope TableNameScope
+	// TableIDAllocScope is TableIDAllocScopeCluster if it is empty.
+	TableIDAllocScope TableIDAllocScope
+	// Labels describe the cluster, and they can be changed by the SetClusterLabels later.
+	Labels ClusterLabels
+}
+
+func (m *managerImpl) CreateClusterWithOptions(ctx context.Context, clusterName string, nodeCount, replicationFactor,
+	shardTotal uint32, createOpts CreateClusterOptions,
+) (*Cluster, error) {
+	if shardTotal == 0 {
+		return nil, ErrInvalidClusterOptions.WithCausef("shard total must be positive, cluster:%s", clusterName)
+	}
+	var options string
+	if createOpts.InitialShardAssignment != nil || createOpts.TableNameScope != "" || createOpts.TableIDAllocScope != "" {
+		opts := defaultOptions()
+		if createOpts.InitialShardAssignment != nil {
+			owners, err := createOpts.InitialShardAssignment.resolve(shardTotal)
+			if err != nil {
+				return nil, err
+			}
+			opts.InitialShardAssignment = owners
+		}
+		if createOpts.TableNameScope != "" {
+			opts.TableNameScope = createOpts.TableNameScope
+		}
+		if createOpts.TableIDAllocScope != "" {
+			opts.TableIDAllocScope = createOpts.TableIDAllocScope
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(opts)
+		if err != nil {
+			return nil, ErrInvalidClusterOptions.WithCause(err)
+		}
+		options = string(value)
+	}
+
+	if err := createOpts.Labels.validate(); err != nil {
+		return nil, err
+	}
+	labels, err := json.Marshal(createOpts.Labels)
+	if err != nil {
+		return nil, ErrInvalidClusterLabels.WithCause(err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.clusters[clusterName]; ok {
+		return nil, ErrClusterAlreadyExists.WithCausef("cluster:%s", clusterName)
+	}
+
+	clusterID, err := m.alloc.Alloc(ctx)
+	if err != nil {
+		return nil, ErrCreateCluster.WithCausef("alloc cluster id, cluster:%s, err:%v", clusterName, err)
+	}
+
+	meta := &metapb.Cluster{
+		Id:                uint32(clusterID),
+		Name:              clusterName,
+		MinNodeCount:      nodeCount,
+		ReplicationFactor: replicationFactor,
+		ShardTotal:        shardTotal,
+	}
+
+	topologies := make([]*metapb.ShardTopology, 0, shardTotal)
+	for i := uint32(0); i < shardTotal; i++ {
+		topologies = append(topologies, &metapb.ShardTopology{})
+	}
+	// All the keys of the cluster are persisted in a single transaction, so the servers racing to create the cluster
+	// never leave a partially created one, and only one of them succeeds.
+	if err := m.storage.CreateClusterWithName(ctx, meta, topologies, options, string(labels)); err != nil {
+		if coderr.Is(err, coderr.InvalidParams) {
+			return nil, ErrClusterAlreadyExists.WithCausef("cluster:%s, err:%v", clusterName, err)
+		}
+		return nil, ErrCreateCluster.WithCausef("put cluster, cluster:%s, err:%v", clusterName, err)
+	}
+
+	cluster := m.newCluster(meta)
+	if err := cluster.Load(ctx); err != nil {
+		return nil, ErrCreateCluster.WithCausef("load cluster, cluster:%s, err:%v", clusterName, err)
+	}
+	m.clusters[clusterName] = cluster
+	delete(m.aliases, clusterName)
+
+	log.Info("create cluster", zap.String("cluster", clusterName), zap.Uint32("cluster-id", meta.GetId()),
+		zap.Uint32("shard-total", shardTotal))
+	return cluster, nil
+}
+
+func (m *managerImpl) GetCluster(_ context.Context, clusterName string) (*Cluster, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if cluster, ok := m.clusters[clusterName]; ok {
+		return cluster, nil
+	}
+	if alias, ok := m.aliases[clusterName]; ok && time.Now().Before(alias.expireAt) {
+		log.Warn("cluster is accessed by its deprecated name", zap.String("deprecated-name", clusterName),
+			zap.String("cluster", alias.cluster.Name()), zap.Time("expire-at", alias.expireAt))
+		return alias.cluster, nil
+	}
+	if _, ok := m.partiallyRestored[clusterName]; ok {
+		return nil, ErrPartiallyRestored.WithCausef("cluster:%s", clusterName)
+	}
+	return nil, ErrClusterNotFound.WithCausef("cluster:%s", clusterName)
+}
+
+func (m *managerImpl) ListClusters(_ context.Context) []*Cluster {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	clusters := make([]*Cluster, 0, len(m.clusters))
+	for _, cluster := range m.clusters {
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+func (m *managerImpl) ListClusterSummaries(ctx context.Context) []ClusterSummary {
+	clusters := m.ListClusters(ctx)
+	summaries := make([]ClusterSummary, 0, len(clusters))
+	for _, cluster := range clusters {
+		summaries = append(summaries, cluster.Summary())
+	}
+	sortClusterSummaries(summaries)
+	return summaries
+}
+
+func (m *managerImpl) SetClusterLabels(ctx context.Context, clusterName string, labels ClusterLabels) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.SetLabels(ctx, labels)
+}
+
+func (m *managerImpl) RenameCluster(ctx context.Context, oldName, newName string, gracePeriod time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cluster, ok := m.clusters[oldName]
+	if !ok {
+		return ErrClusterNotFound.WithCausef("cluster:%s", oldName)
+	}
+	if _, ok := m.clusters[newName]; ok {
+		return ErrClusterAlreadyExists.WithCausef("cluster:%s", newName)
+	}
+
+	if err := cluster.rename(ctx, oldName, newName); err != nil {
+		if coderr.Is(err, coderr.InvalidParams) {
+			return ErrClusterAlreadyExists.WithCausef("cluster:%s, err:%v", newName, err)
+		}
+		return errors.Wrapf(err, "rename cluster, cluster:%s, new name:%s", oldName, newName)
+	}
+
+	delete(m.clusters, oldName)
+	m.clusters[newName] = cluster
+	delete(m.aliases, newName)
+	for name, alias := range m.aliases {
+		if !time.Now().Before(alias.expireAt) {
+			delete(m.aliases, name)
+		}
+	}
+	if gracePeriod > 0 {
+		m.aliases[oldName] = &clusterAlias{cluster: cluster, expireAt: time.Now().Add(gracePeriod)}
+	}
+
+	log.Info("rename cluster", zap.String("old-name", oldName), zap.String("new-name", newName),
+		zap.Duration("grace-period", gracePeriod))
+	return nil
+}
+
+func (m *managerImpl) AllocSchemaID(ctx context.Context, clusterName, schemaName string) (uint32, error) {
+	schema, err := m.CreateSchema(ctx, clusterName, schemaName, 0)
+	if err != nil {
+		return 0, err
+	}
+	return schema.GetID(), nil
+}
+
+func (m *managerImpl) CreateSchema(ctx context.Context, clusterName, schemaName string, shardCountHint uint32) (*Schema, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetOrCreateSchema(ctx, schemaName, shardCountHint)
+}
+
+func (m *managerImpl) AllocTableID(ctx context.Context, clusterName, schemaName, tableName string) (*Table, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetOrCreateTable(ctx, schemaName, tableName)
+}
+
+func (m *managerImpl) RegisterNode(ctx context.Context, clusterName string, info *metapb.NodeInfo) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	cluster.RegisterNode(ctx, info)
+	return nil
+}
+
+func (m *managerImpl) GetNodes(ctx context.Context, clusterName string, ifGenerationNot uint64) (*NodesResult, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetNodes(ifGenerationNot), nil
+}
+
+func (m *managerImpl) GetTopology(ctx context.Context, clusterName string, ifVersionNot uint64) (*TopologyResult, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetTopology(ifVersionNot), nil
+}
+
+func (m *managerImpl) ListFailedProcedures(ctx context.Context, clusterName string) ([]FailedProcedure, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ListFailedProcedures(), nil
+}
+
+func (m *managerImpl) ListPendingReconciles(ctx context.Context, clusterName string) ([]PendingReconcile, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ListPendingReconciles(), nil
+}
+
+func (m *managerImpl) SetClusterOptions(ctx context.Context, clusterName string, opts Options) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.SetOptions(ctx, opts)
+}
+
+func (m *managerImpl) UpdateClusterOptions(ctx context.Context, clusterName string, update func(opts *Options)) (Options, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return Options{}, err
+	}
+
+	return cluster.UpdateOptions(ctx, update)
+}
+
+func (m *managerImpl) SetClusterMaintenance(ctx context.Context, clusterName string, enabled bool, reason string) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.SetMaintenance(ctx, enabled, reason)
+}
+
+func (m *managerImpl) ListUnassignedShards(ctx context.Context, clusterName string) ([]uint32, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ListUnassignedShards(0), nil
+}
+
+func (m *managerImpl) AssignShard(ctx context.Context, clusterName string, shardID uint32, node string) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.AssignShard(ctx, shardID, node)
+}
+
+func (m *managerImpl) GetShardOwnerChange(ctx context.Context, clusterName string, shardID uint32) (*ShardOwnerChange, error) {
+	cluster, err := m.getFreshCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetShardOwnerChange(shardID)
+}
+
+func (m *managerImpl) FreezeShardVersion(ctx context.Context, clusterName string, shardID uint32) (string, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return "", err
+	}
+
+	return cluster.FreezeShardVersion(ctx, shardID)
+}
+
+func (m *managerImpl) UnfreezeShardVersion(ctx context.Context, clusterName, token string) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.UnfreezeShardVersion(token)
+}
+
+func (m *managerImpl) DropTable(ctx context.Context, clusterName, schemaName, tableName string, async bool) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.DropTable(ctx, schemaName, tableName, async)
+}
+
+func (m *managerImpl) DropPartitionedTable(ctx context.Context, clusterName, schemaName, tableName string) (*PartitionedTableDrop, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.DropPartitionedTable(ctx, schemaName, tableName)
+}
+
+func (m *managerImpl) GetSchemaStats(ctx context.Context, clusterName, schemaName string) (*SchemaStats, error) {
+	cluster, err := m.getFreshCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetSchemaStats(schemaName)
+}
+
+func (m *managerImpl) AlterTable(ctx context.Context, clusterName, schemaName, tableName string, expectedVersion uint64, encodedSchema []byte) (*Table, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.AlterTable(ctx, schemaName, tableName, expectedVersion, encodedSchema)
+}
+
+// getFreshCluster returns the cluster reloaded if it is stale, which is needed by the reads served by the followers.
+func (m *managerImpl) getFreshCluster(ctx context.Context, clusterName string) (*Cluster, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if err := cluster.ReloadIfStale(ctx); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+func (m *managerImpl) GetShardTables(ctx context.Context, clusterName string, shardIDs []uint32) (map[uint32]*ShardTables, error) {
+	cluster, err := m.getFreshCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetShardTables(shardIDs)
+}
+
+func (m *managerImpl) ReserveTableName(ctx context.Context, clusterName, schemaName, tableName string, ttl time.Duration) (*TableNameReservation, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ReserveTableName(ctx, schemaName, tableName, ttl)
+}
+
+func (m *managerImpl) ReleaseTableName(ctx context.Context, clusterName, schemaName, tableName, token string) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.ReleaseTableName(ctx, schemaName, tableName, token)
+}
+
+func (m *managerImpl) ListTables(ctx context.Context, clusterName, schemaName string, opts ListTablesOptions) ([]*TableListing, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ListTables(schemaName, opts)
+}
+
+func (m *managerImpl) ExplainPlacement(ctx context.Context, clusterName, schemaName, tableName string) (*PlacementExplanation, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ExplainPlacement(ctx, schemaName, tableName)
+}
+
+func (m *managerImpl) ExplainTablePlacement(ctx context.Context, clusterName string, tableID uint64) (*PlacementExplanation, error) {
+	cluster, err := m.getFreshCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.ExplainTablePlacement(ctx, tableID)
+}
+
+func (m *managerImpl) HotSpots(ctx context.Context, clusterName string, topN int) (*HotSpots, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.HotSpots(topN), nil
+}
+
+func (m *managerImpl) GetNodeSnapshot(ctx context.Context, clusterName, nodeName string) (*NodeSnapshot, error) {
+	cluster, err := m.getFreshCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.GetNodeSnapshot(nodeName), nil
+}
+
+func (m *managerImpl) AcquireRestartToken(ctx context.Context, clusterName, node string, ttl time.Duration) (*RestartDecision, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.AcquireRestartToken(node, ttl)
+}
+
+func (m *managerImpl) ReleaseRestartToken(ctx context.Context, clusterName, node, token string) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.ReleaseRestartToken(node, token)
+}
+
+func (m *managerImpl) ExportTopologyDOT(ctx context.Context, clusterName string, w io.Writer, expandTables bool) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.ExportTopologyDOT(w, expandTables)
+}
+
+func (m *managerImpl) ExportShardMappingCSV(ctx context.Context, clusterName string, w io.Writer) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.ExportShardMappingCSV(w)
+}
+
+func (m *managerImpl) ExportClusterSnapshot(ctx context.Context, clusterName string, w io.Writer) error {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+
+	return cluster.ExportSnapshot(ctx, w)
+}
+
+func (m *managerImpl) DiffClusterSnapshot(ctx context.Context, clusterName string, r io.Reader) (*SnapshotDiff, error) {
+	cluster, err := m.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster.DiffSnapshot(ctx, r)
+}
+
+func (m *managerImpl) RestoreClusterFromSnapshot(ctx context.Context, clusterName string, r io.Reader, confirm string) error {
+	if confirm != clusterName {
+		return ErrRestoreNotConfirmed.WithCausef("confirm:%s, cluster:%s", confirm, clusterName)
+	}
+
+	m.lock.RLock()
+	cluster, ok := m.partiallyRestored[clusterName]
+	m.lock.RUnlock()
+	if !ok {
+		var err error
+		if cluster, err = m.GetCluster(ctx, clusterName); err != nil {
+			return err
+		}
+	}
+
+	restoreErr := cluster.RestoreSnapshot(ctx, r)
+	// The marker tells whether the key-values are replaced partially, e.g. by the failure of a batch in the middle,
+	// so that the cluster is never served with the mixed meta data.
+	restoring, err := m.storage.IsClusterPartiallyRestored(ctx, cluster.clusterID)
+	if err != nil {
+		if restoreErr != nil {
+			return restoreErr
+		}
+		return errors.Wrapf(err, "check cluster restore, cluster:%s", clusterName)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if restoring {
+		log.Error("cluster is partially restored, restore it from the snapshot again", zap.String("cluster", clusterName))
+		delete(m.clusters, clusterName)
+		m.partiallyRestored[clusterName] = cluster
+	} else if restoreErr == nil {
+		delete(m.partiallyRestored, clusterName)
+		m.clusters[clusterName] = cluster
+	}
+	return restoreErr
+}
+
+func (m *managerImpl) newCluster(meta *metapb.Cluster) *Cluster {
+	schemaIDAlloc := id.NewAllocatorImpl(m.storage, m.rootPath, fmt.Sprintf("%s/%d", AllocSchemaIDPrefix, meta.GetId()))
+	tableIDAlloc := id.NewAllocatorImpl(m.storage, m.rootPath, makeTableIDAllocKey(meta.GetId()))
+	schemaTableIDAlloc := id.NewPartitionedAllocator(m.storage, m.rootPath, makeTableIDAllocKey(meta.GetId()))
+	return NewCluster(meta, m.storage, schemaIDAlloc, tableIDAlloc, schemaTableIDAlloc)
+}
+
+// makeTableIDAllocKey returns the key of the table id allocator of the cluster, which is relative to the root path.
+func makeTableIDAllocKey(clusterID uint32) string {
+	return fmt.Sprintf("%s/%d", AllocTableIDPrefix, clusterID)
+}
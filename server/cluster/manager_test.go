@@ -0,0 +1,130 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameCluster(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	const (
+		newName   = "renamedCluster"
+		otherName = "otherCluster"
+	)
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateCluster(ctx, otherName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	re.True(coderr.Is(manager.RenameCluster(ctx, testClusterName, otherName, time.Minute), coderr.InvalidParams))
+
+	// Heartbeats and DDLs with the old name keep going during the renaming.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 200)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				errCh <- manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: fmt.Sprintf("node%d", i)})
+				_, err := manager.AllocTableID(ctx, testClusterName, "public", fmt.Sprintf("table_%d_%d", i, j))
+				errCh <- err
+			}
+		}(i)
+	}
+	re.NoError(manager.RenameCluster(ctx, testClusterName, newName, time.Second*2))
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		re.NoError(err)
+	}
+
+	renamed, err := manager.GetCluster(ctx, newName)
+	re.NoError(err)
+	re.Equal(cluster.GetClusterID(), renamed.GetClusterID())
+	re.Equal(newName, renamed.Name())
+	stats, err := manager.GetSchemaStats(ctx, newName, "public")
+	re.NoError(err)
+	total := 0
+	for _, count := range stats.ShardTableCounts {
+		total += count
+	}
+	re.Equal(100, total)
+
+	// The old name is rejected after the grace period.
+	re.Eventually(func() bool {
+		_, err := manager.GetCluster(ctx, testClusterName)
+		return coderr.Is(err, coderr.NotFound)
+	}, defaultTestTimeout, time.Millisecond*100)
+
+	// The old name can be used by a new cluster, and the renaming survives the reloading.
+	_, err = manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	renamed, err = reloaded.GetCluster(ctx, newName)
+	re.NoError(err)
+	re.Equal(cluster.GetClusterID(), renamed.GetClusterID())
+	created, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.NotEqual(cluster.GetClusterID(), created.GetClusterID())
+}
+
+func TestCreateClusterRace(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// Only one of the managers sharing the storage creates the cluster, and the others find it by loading.
+	managers := []Manager{NewManagerImpl(s, testRootPath), NewManagerImpl(s, testRootPath), NewManagerImpl(s, testRootPath)}
+	errs := make([]error, len(managers))
+	var wg sync.WaitGroup
+	for i, manager := range managers {
+		wg.Add(1)
+		go func(i int, manager Manager) {
+			defer wg.Done()
+			_, errs[i] = manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+		}(i, manager)
+	}
+	wg.Wait()
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		re.True(coderr.Is(err, coderr.InvalidParams))
+	}
+	re.Equal(1, created)
+
+	clusters, err := s.ListClusters(ctx)
+	re.NoError(err)
+	re.Len(clusters, 1)
+	for _, manager := range managers {
+		re.NoError(manager.Load(ctx))
+		cluster, err := manager.GetCluster(ctx, testClusterName)
+		re.NoError(err)
+		re.Equal(clusters[0].GetId(), cluster.GetClusterID())
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var unassignedShardsGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "unassigned_shards",
+		Help:      "Number of the shards owned by no node.",
+	}, []string{"cluster"})
+
+// clusterInfoGauge is always 1, and it carries the labels of the cluster which are joined with the other metrics by
+// the cluster.
+var clusterInfoGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "info",
+		Help:      "Labels of the cluster, e.g. the environment.",
+	}, []string{"cluster", "environment", "owner"})
+
+// The route lookups are not labeled by the tables to bound the cardinality, and the hot tables are tracked by the
+// heavy hitter sketch of the cluster instead.
+var routeLookupsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "route_lookups_total",
+		Help:      "Number of the route lookups of the existing tables.",
+	}, []string{"cluster"})
+
+var shardDDLsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "shard_ddls_total",
+		Help:      "Number of the DDLs on the shards.",
+	}, []string{"cluster", "shard"})
+
+var procedureDurationHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "procedure_duration_seconds",
+		Help:      "Duration of the procedures changing the metadata of the cluster.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"cluster", "type"})
+
+var proceduresCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "procedures_total",
+		Help:      "Number of the procedures changing the metadata of the cluster by their outcomes.",
+	}, []string{"cluster", "type", "outcome"})
+
+var antiAffinityViolationsGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "anti_affinity_violations",
+		Help:      "Number of the shards and nodes holding more tables of an anti-affinity group than the even spread.",
+	}, []string{"cluster"})
+
+var nodeExpiryRefusedCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "node_expiry_refused_total",
+		Help:      "Number of the refused expiries of the nodes which take too many alive nodes at once.",
+	}, []string{"cluster"})
+
+var topologyCacheRequestsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "topology_cache_requests_total",
+		Help:      "Number of the requests of the cluster topology by the result of the cache, which is hit, miss or not_modified.",
+	}, []string{"cluster", "result"})
+
+var compensationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "compensations_total",
+		Help:      "Number of the compensation actions rolling back the failed procedures by the action and the outcome.",
+	}, []string{"cluster", "action", "outcome"})
+
+var pendingReconcilesGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "pending_reconciles",
+		Help:      "Number of the created tables whose shard topologies are not persisted yet.",
+	}, []string{"cluster"})
+
+var shardTopologyBytesGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "shard_topology_bytes",
+		Help:      "Encoded size of the topology of the shard, which is rewritten on every change of the shard.",
+	}, []string{"cluster", "shard"})
+
+var duplicateTableIDsGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "duplicate_table_ids",
+		Help:      "Number of the table ids held by more than one table found at loading the cluster, which should be zero.",
+	}, []string{"cluster"})
+
+var shardOwnerConflictsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "shard_owner_conflicts_total",
+		Help:      "Number of the shards reported by the nodes other than their alive owners by the resolution.",
+	}, []string{"cluster", "resolution"})
+
+var ambiguousShardOwnersGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "cluster",
+		Name:      "ambiguous_shard_owners",
+		Help:      "Number of the shards whose owners are ambiguous, which should be zero.",
+	}, []string{"cluster"})
+
+func init() {
+	prometheus.MustRegister(unassignedShardsGauge)
+	prometheus.MustRegister(clusterInfoGauge)
+	prometheus.MustRegister(routeLookupsCounter)
+	prometheus.MustRegister(shardDDLsCounter)
+	prometheus.MustRegister(procedureDurationHistogram)
+	prometheus.MustRegister(proceduresCounter)
+	prometheus.MustRegister(antiAffinityViolationsGauge)
+	prometheus.MustRegister(nodeExpiryRefusedCounter)
+	prometheus.MustRegister(topologyCacheRequestsCounter)
+	prometheus.MustRegister(compensationsCounter)
+	prometheus.MustRegister(pendingReconcilesGauge)
+	prometheus.MustRegister(shardTopologyBytesGauge)
+	prometheus.MustRegister(duplicateTableIDsGauge)
+	prometheus.MustRegister(shardOwnerConflictsCounter)
+	prometheus.MustRegister(ambiguousShardOwnersGauge)
+}
@@ -0,0 +1,325 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// defaultNodeLease is used if the lease is not reported by the node.
+const defaultNodeLease = time.Second * 10
+
+// Node is a ceresdb node registered by its heartbeats, and it is only kept in memory.
+type Node struct {
+	info *metapb.NodeInfo
+	// lastTouchTime is read from the local clock when the heartbeat is received, and it carries the monotonic reading
+	// so the recency of the heartbeat is immune to the jumps of the wall clock. It must not be taken from the nodes or
+	// decoded from anywhere, which loses the monotonic reading.
+	lastTouchTime time.Time
+	// firstSeenTime is when the first heartbeat is received since the node becomes alive, and it is read from the
+	// local clock as the lastTouchTime.
+	firstSeenTime time.Time
+	// alive is the liveness observed at last, and the topology generation is bumped if it changes.
+	alive bool
+	// expiryHeld is set if the lease of the node expires but the expiry is refused by the safety valve, and the node
+	// is regarded as alive until the next heartbeat or the expiry is allowed.
+	expiryHeld bool
+}
+
+func (n *Node) GetName() string {
+	return n.info.GetNode()
+}
+
+func (n *Node) GetLastTouchTime() time.Time {
+	return n.lastTouchTime
+}
+
+func (n *Node) GetFirstSeenTime() time.Time {
+	return n.firstSeenTime
+}
+
+// IsAlive tells whether the node has sent heartbeat within its lease, or its expiry is held by the safety valve.
+func (n *Node) IsAlive(now time.Time) bool {
+	return n.expiryHeld || !n.leaseExpired(now)
+}
+
+func (n *Node) leaseExpired(now time.Time) bool {
+	return now.Sub(n.lastTouchTime) > n.lease()
+}
+
+func (n *Node) lease() time.Duration {
+	if n.info.GetLease() > 0 {
+		return time.Duration(n.info.GetLease()) * time.Second
+	}
+	return defaultNodeLease
+}
+
+// RegisterNode updates the node and the ownership of the shards according to the node info from the heartbeat, and
+// returns the shards the node should close because they are owned by other alive nodes. The heartbeat is the source of
+// truth of the ownership except for such conflicts, so the ownership changes are applied even if they fail to be
+// persisted.
+func (c *Cluster) RegisterNode(ctx context.Context, info *metapb.NodeInfo) []uint32 {
+	conflicts := c.registerNode(ctx, info)
+	// The ownership changes are persisted after the lock is released, so that the other heartbeats and the reads of
+	// the cluster aren't blocked by the etcd.
+	c.flushShardOwnerChanges(ctx)
+	return conflicts
+}
+
+func (c *Cluster) registerNode(ctx context.Context, info *metapb.NodeInfo) []uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.flushHeartbeatsLocked()
+	changed := false
+	nodeName := info.GetNode()
+	now := time.Now()
+	firstSeenTime := now
+	if oldNode, ok := c.nodesCache[nodeName]; !ok || !oldNode.alive {
+		log.Info("register node", zap.String("cluster", c.metaData.GetName()), zap.String("node", nodeName))
+		changed = true
+	} else {
+		firstSeenTime = oldNode.firstSeenTime
+	}
+	c.nodesCache[nodeName] = &Node{info: info, lastTouchTime: now, firstSeenTime: firstSeenTime, alive: true}
+	if capacity, ok := nodeShardCapacityFromContext(ctx); ok {
+		c.updateNodeShardCapacityLocked(ctx, nodeName, capacity)
+	}
+
+	ownerChanges := make([]*ShardOwnerChange, 0)
+	owned := make(map[uint32]struct{}, len(info.GetShardsInfo()))
+	var conflicts []uint32
+	for _, shardInfo := range info.GetShardsInfo() {
+		if shardInfo.GetRole() != metapb.ShardRole_LEADER {
+			continue
+		}
+		shard, ok := c.shardsCache[shardInfo.GetShardId()]
+		if !ok {
+			continue
+		}
+		if shard.node != nodeName {
+			switch c.claimReportedShardLocked(shard, nodeName, now) {
+			case shardClaimConflict:
+				conflicts = append(conflicts, shard.GetID())
+				continue
+			case shardClaimAmbiguous:
+				continue
+			}
+			ownerChanges = append(ownerChanges, newShardOwnerChange(shard, nodeName, ShardOwnerReported, ""))
+		}
+		owned[shard.GetID()] = struct{}{}
+	}
+	for _, shard := range c.shardsCache {
+		if _, ok := owned[shard.GetID()]; !ok && shard.node == nodeName {
+			ownerChanges = append(ownerChanges, newShardOwnerChange(shard, "", ShardOwnerLost, ""))
+		}
+	}
+
+	for _, change := range ownerChanges {
+		c.applyShardOwnerChangeLocked(c.shardsCache[change.ShardID], change)
+		c.pendingOwnerChanges[change.ShardID] = change
+	}
+	if len(ownerChanges) == 0 && changed {
+		c.bumpTopologyGenerationLocked()
+	}
+	c.syncStateLocked(ctx, "register node "+nodeName)
+	c.rebuildHeartbeatViewLocked()
+	return conflicts
+}
+
+// NodeStatus is the status of a registered node.
+type NodeStatus struct {
+	Name  string
+	Alive bool
+	// LastTouchTime is when the last heartbeat is received, and SinceLastHeartbeat is how long it has been since then.
+	// The node is declared dead once SinceLastHeartbeat exceeds its Lease.
+	LastTouchTime      time.Time
+	SinceLastHeartbeat time.Duration
+	Lease              time.Duration
+	// FirstSeenTime is when the first heartbeat is received since the node becomes alive, and Uptime is how long it
+	// has been since then.
+	FirstSeenTime time.Time
+	Uptime        time.Duration
+	// ShardIDs are the shards owned by the node in ascending order.
+	ShardIDs []uint32
+	// ShardCapacity is the max number of the shards the node may own, and zero means unlimited.
+	ShardCapacity uint32
+}
+
+// NodesResult is the result of GetNodes, and Nodes is nil if NotModified is set.
+type NodesResult struct {
+	Generation  uint64
+	NotModified bool
+	Nodes       []NodeStatus
+}
+
+// GetTopologyGeneration returns the generation of the topology, which is bumped whenever a node joins, dies or
+// recovers, or the owner of any shard changes.
+func (c *Cluster) GetTopologyGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.refreshNodesLocked(time.Now())
+	return c.topologyGeneration
+}
+
+// GetNodes returns the status of all the registered nodes sorted by name, unless the topology generation equals to
+// ifGenerationNot, in which case only the generation is returned. Zero ifGenerationNot never matches.
+func (c *Cluster) GetNodes(ifGenerationNot uint64) *NodesResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.refreshNodesLocked(now)
+	if c.topologyGeneration == ifGenerationNot {
+		return &NodesResult{Generation: c.topologyGeneration, NotModified: true}
+	}
+
+	nodeShards := make(map[string][]uint32, len(c.nodesCache))
+	for _, shard := range c.shardsCache {
+		if shard.node != "" {
+			nodeShards[shard.node] = append(nodeShards[shard.node], shard.GetID())
+		}
+	}
+	nodes := make([]NodeStatus, 0, len(c.nodesCache))
+	for name, node := range c.nodesCache {
+		shardIDs := nodeShards[name]
+		sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+		nodes = append(nodes, NodeStatus{
+			Name:               name,
+			Alive:              node.alive,
+			LastTouchTime:      node.lastTouchTime,
+			SinceLastHeartbeat: now.Sub(node.lastTouchTime),
+			Lease:              node.lease(),
+			FirstSeenTime:      node.firstSeenTime,
+			Uptime:             now.Sub(node.firstSeenTime),
+			ShardIDs:           shardIDs,
+			ShardCapacity:      c.nodeShardCapacities[name],
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	return &NodesResult{Generation: c.topologyGeneration, Nodes: nodes}
+}
+
+// refreshNodesLocked detects the nodes whose lease expires since the liveness is not driven by any event, after the
+// pending touches of the fast path of the heartbeats are applied. The expiry is refused and alarmed if it takes more
+// alive nodes than the MaxNodeExpiryRatio of the options at once, which is more likely caused by the stall or the clock
+// of the leader than the nodes, and at least one node is always allowed to expire.
+func (c *Cluster) refreshNodesLocked(now time.Time) {
+	c.flushHeartbeatsLocked()
+	alive := 0
+	expiring := make([]*Node, 0)
+	for _, node := range c.nodesCache {
+		if !node.alive {
+			continue
+		}
+		alive++
+		if node.leaseExpired(now) {
+			expiring = append(expiring, node)
+		} else {
+			node.expiryHeld = false
+		}
+	}
+	if len(expiring) == 0 {
+		return
+	}
+
+	if ratio := c.options.MaxNodeExpiryRatio; ratio > 0 {
+		allowed := int(ratio * float64(alive))
+		if allowed < 1 {
+			allowed = 1
+		}
+		if len(expiring) > allowed {
+			names := make([]string, 0, len(expiring))
+			for _, node := range expiring {
+				node.expiryHeld = true
+				names = append(names, node.GetName())
+			}
+			sort.Strings(names)
+			nodeExpiryRefusedCounter.WithLabelValues(c.metaData.GetName()).Inc()
+			log.Error("refuse to expire too many nodes at once", zap.String("cluster", c.metaData.GetName()),
+				zap.Strings("nodes", names), zap.Int("alive-nodes", alive), zap.Float64("max-node-expiry-ratio", ratio))
+			return
+		}
+	}
+
+	for _, node := range expiring {
+		log.Warn("node lease expires", zap.String("cluster", c.metaData.GetName()), zap.String("node", node.GetName()))
+		node.alive = false
+		node.expiryHeld = false
+		c.bumpTopologyGenerationLocked()
+	}
+}
+
+// ResetNodeLiveness restarts the tracking of the heartbeats of all the alive nodes from now, which should be called when
+// the server becomes the leader, because the heartbeats received before are not tracked by this server since then, and
+// the nodes should not be expired for the heartbeats sent to the previous leader. The dead nodes are kept dead until
+// they send heartbeats again.
+func (c *Cluster) ResetNodeLiveness() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for _, node := range c.nodesCache {
+		if !node.alive {
+			continue
+		}
+		node.lastTouchTime = now
+		node.expiryHeld = false
+	}
+	log.Info("reset node liveness", zap.String("cluster", c.metaData.GetName()), zap.Int("nodes", len(c.nodesCache)))
+}
+
+// isShardAvailableLocked tells whether the shard is not owned by a dead node.
+func (c *Cluster) isShardAvailableLocked(shard *Shard) bool {
+	if shard.node == "" {
+		return true
+	}
+	node, ok := c.nodesCache[shard.node]
+	return ok && node.IsAlive(time.Now())
+}
+
+// checkHealthyNodesLocked updates the degraded modifier of the status, and returns ErrInsufficientHealthyNodes if the
+// cluster is degraded.
+func (c *Cluster) checkHealthyNodesLocked(ctx context.Context) error {
+	err := c.healthyNodesLocked()
+	c.setDegradedLocked(ctx, err != nil, "healthy nodes check")
+	return err
+}
+
+// healthyNodesLocked returns ErrInsufficientHealthyNodes if the alive nodes are below the thresholds of the options.
+// The expected number of the nodes is the larger one of the registered nodes and the min node count of the cluster.
+func (c *Cluster) healthyNodesLocked() error {
+	minNodes, minRatio := c.options.MinHealthyNodes, c.options.MinHealthyNodeRatio
+	if minNodes == 0 && minRatio == 0 {
+		return nil
+	}
+
+	c.refreshNodesLocked(time.Now())
+	healthy := 0
+	for _, node := range c.nodesCache {
+		if node.alive {
+			healthy++
+		}
+	}
+	expected := len(c.nodesCache)
+	if minNodeCount := int(c.metaData.GetMinNodeCount()); minNodeCount > expected {
+		expected = minNodeCount
+	}
+
+	if healthy < int(minNodes) {
+		return ErrInsufficientHealthyNodes.WithCausef("healthy nodes:%d, min healthy nodes:%d", healthy, minNodes)
+	}
+	if expected > 0 && float64(healthy) < minRatio*float64(expected) {
+		return ErrInsufficientHealthyNodes.WithCausef("healthy nodes:%d, expected nodes:%d, min healthy node ratio:%v",
+			healthy, expected, minRatio)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+type nodeShardCapacityKey struct{}
+
+// WithNodeShardCapacity returns a context carrying the max number of the shards the node sending the heartbeat may
+// own, which is derived from the config of the node.
+func WithNodeShardCapacity(ctx context.Context, capacity uint32) context.Context {
+	return context.WithValue(ctx, nodeShardCapacityKey{}, capacity)
+}
+
+// nodeShardCapacityFromContext returns the capacity carried by the ctx, and false is returned if it is not reported.
+func nodeShardCapacityFromContext(ctx context.Context) (uint32, bool) {
+	capacity, ok := ctx.Value(nodeShardCapacityKey{}).(uint32)
+	return capacity, ok
+}
+
+// ShardCapacity is the total shard capacity of the alive nodes compared with the shards of the cluster.
+type ShardCapacity struct {
+	// Capacity is the sum of the capacities of the alive nodes, which is meaningless if Unlimited is set.
+	Capacity uint64
+	// Unlimited is set if any alive node has no capacity.
+	Unlimited bool
+	Shards    uint32
+}
+
+// Insufficient tells whether the alive nodes can't own all the shards, and the excess shards are left unassigned.
+func (c ShardCapacity) Insufficient() bool {
+	return !c.Unlimited && c.Capacity < uint64(c.Shards)
+}
+
+// GetShardCapacity returns the total shard capacity of the alive nodes.
+func (c *Cluster) GetShardCapacity() ShardCapacity {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := time.Now()
+	capacity := ShardCapacity{Shards: uint32(len(c.shardsCache))}
+	for name, node := range c.nodesCache {
+		if !node.IsAlive(now) {
+			continue
+		}
+		nodeCapacity, ok := c.nodeShardCapacities[name]
+		if !ok || nodeCapacity == 0 {
+			capacity.Unlimited = true
+			continue
+		}
+		capacity.Capacity += uint64(nodeCapacity)
+	}
+	return capacity
+}
+
+// updateNodeShardCapacityLocked persists the capacity reported by the node if it changes. The capacity is applied even
+// if it fails to be persisted, since it is reported by every heartbeat.
+func (c *Cluster) updateNodeShardCapacityLocked(ctx context.Context, nodeName string, capacity uint32) {
+	if old, ok := c.nodeShardCapacities[nodeName]; ok && old == capacity {
+		return
+	}
+
+	log.Info("update node shard capacity", zap.String("cluster", c.metaData.GetName()), zap.String("node", nodeName),
+		zap.Uint32("capacity", capacity))
+	c.nodeShardCapacities[nodeName] = capacity
+	c.dropHeartbeatViewLocked()
+	if err := c.storage.PutNodeShardCapacity(ctx, c.clusterID, nodeName, capacity); err != nil {
+		log.Warn("fail to persist node shard capacity", zap.String("cluster", c.metaData.GetName()),
+			zap.String("node", nodeName), zap.Error(err))
+	}
+}
+
+// plannerCapacitiesLocked returns the capacities of the nodes for the planners, and the unlimited nodes are omitted.
+func (c *Cluster) plannerCapacitiesLocked(nodes []string) map[string]int {
+	capacities := make(map[string]int)
+	for _, node := range nodes {
+		if capacity := c.nodeShardCapacities[node]; capacity > 0 {
+			capacities[node] = int(capacity)
+		}
+	}
+	return capacities
+}
+
+// checkNodeShardCapacityLocked returns error if the node has owned as many shards as its capacity.
+func (c *Cluster) checkNodeShardCapacityLocked(nodeName string) error {
+	capacity := c.nodeShardCapacities[nodeName]
+	if capacity == 0 {
+		return nil
+	}
+	owned := uint32(0)
+	for _, shard := range c.shardsCache {
+		if shard.node == nodeName {
+			owned++
+		}
+	}
+	if owned >= capacity {
+		return ErrNodeCapacityExceeded.WithCausef("node:%s, capacity:%d, owned:%d", nodeName, capacity, owned)
+	}
+	return nil
+}
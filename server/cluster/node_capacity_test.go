@@ -0,0 +1,56 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeShardCapacity(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+
+	// The 2:1 fleet can't own all the shards.
+	re.NoError(manager.RegisterNode(WithNodeShardCapacity(ctx, 4), testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60}))
+	re.NoError(manager.RegisterNode(WithNodeShardCapacity(ctx, 2), testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	re.True(cluster.GetShardCapacity().Insufficient())
+
+	// The shards are distributed in proportion to the capacities, and the excess ones are left unassigned.
+	assignments, err := cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	owned := make(map[string]int)
+	for _, assignment := range assignments {
+		owned[assignment.Node]++
+	}
+	re.Equal(map[string]int{"a": 4, "b": 2}, owned)
+	re.Len(cluster.ListUnassignedShards(0), 2)
+	shardID := cluster.ListUnassignedShards(0)[0]
+	re.True(coderr.Is(cluster.AssignShard(ctx, shardID, "a"), coderr.Conflict))
+
+	// The capacity survives the reload.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.NoError(reloaded.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60}))
+	nodes := reloadedCluster.GetNodes(0).Nodes
+	re.Len(nodes, 1)
+	re.Equal(uint32(4), nodes[0].ShardCapacity)
+
+	// The capacity is sufficient once the node reports a larger one.
+	re.NoError(manager.RegisterNode(WithNodeShardCapacity(ctx, 4), testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	re.False(cluster.GetShardCapacity().Insufficient())
+}
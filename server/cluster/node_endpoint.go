@@ -0,0 +1,45 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ValidateNodeEndpoint checks whether the endpoint advertised by the node is usable by others, that is to say, it must
+// be a host:port whose host is neither unspecified (e.g. 0.0.0.0) nor loopback. The loopback endpoints are accepted if
+// allowLoopback is set, which is useful for the deployments on a single machine.
+func ValidateNodeEndpoint(endpoint string, allowLoopback bool) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return ErrInvalidNodeEndpoint.WithCausef("endpoint:%s, err:%v", endpoint, err)
+	}
+	if host == "" {
+		return ErrInvalidNodeEndpoint.WithCausef("missing host, endpoint:%s", endpoint)
+	}
+	if portNum, err := strconv.ParseUint(port, 10, 16); err != nil || portNum == 0 {
+		return ErrInvalidNodeEndpoint.WithCausef("invalid port, endpoint:%s", endpoint)
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		return ErrInvalidNodeEndpoint.WithCausef("unspecified host, endpoint:%s", endpoint)
+	}
+	isLoopback := (ip != nil && ip.IsLoopback()) || strings.EqualFold(host, "localhost")
+	if isLoopback && !allowLoopback {
+		return ErrInvalidNodeEndpoint.WithCausef("loopback host is not allowed, endpoint:%s", endpoint)
+	}
+	return nil
+}
+
+// ProbeNodeEndpoint checks whether the endpoint can be connected.
+func ProbeNodeEndpoint(ctx context.Context, endpoint string) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return ErrNodeEndpointUnreachable.WithCausef("endpoint:%s, err:%v", endpoint, err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"sort"
+	"time"
+)
+
+// NodeTableView is a table of a shard in the NodeSnapshot.
+type NodeTableView struct {
+	ID         uint64 `json:"id"`
+	Name       string `json:"name"`
+	SchemaID   uint32 `json:"schema_id"`
+	SchemaName string `json:"schema_name"`
+	// SchemaVersion is the version of the table schema, which is zero before the table is altered.
+	SchemaVersion uint64 `json:"schema_version"`
+}
+
+// NodeShardView is a shard assigned to the node in the NodeSnapshot.
+type NodeShardView struct {
+	ID      uint32 `json:"id"`
+	Version uint64 `json:"version"`
+	// Tables are ordered by the table id, and the tables being dropped are excluded.
+	Tables []NodeTableView `json:"tables"`
+}
+
+// NodeSnapshot is the complete desired state of a node taken from a single snapshot of the cluster, so that the node
+// starting up gets its shards and their tables in one consistent response instead of piecing them together from the
+// heartbeats.
+type NodeSnapshot struct {
+	ClusterName string `json:"cluster_name"`
+	Node        string `json:"node"`
+	// TopologyGeneration is the topology generation the snapshot is taken at.
+	TopologyGeneration uint64 `json:"topology_generation"`
+	// Shards are the shards assigned to the node ordered by the shard id.
+	Shards  []NodeShardView `json:"shards"`
+	Options Options         `json:"options"`
+	TakenAt time.Time       `json:"taken_at"`
+}
+
+// GetNodeSnapshot returns the shards assigned to the node along with their tables, which are generated from a read
+// snapshot of the cluster outside the lock. The node unknown to the cluster gets no shard.
+func (c *Cluster) GetNodeSnapshot(nodeName string) *NodeSnapshot {
+	c.lock.RLock()
+	snapshot := c.newReadSnapshotLocked()
+	c.lock.RUnlock()
+
+	tables := make(map[uint64]*Table)
+	for _, schemaTables := range snapshot.tables {
+		for _, table := range schemaTables {
+			tables[table.GetID()] = table
+		}
+	}
+	nodeSnapshot := &NodeSnapshot{
+		ClusterName:        c.metaData.GetName(),
+		Node:               nodeName,
+		TopologyGeneration: snapshot.topologyGeneration,
+		Shards:             make([]NodeShardView, 0),
+		Options:            snapshot.options,
+		TakenAt:            time.Now(),
+	}
+	for shardID, shard := range snapshot.shards {
+		if shard.node != nodeName {
+			continue
+		}
+		view := NodeShardView{
+			ID:      shardID,
+			Version: shard.topology.GetVersion(),
+			Tables:  make([]NodeTableView, 0, len(shard.topology.GetTableIds())),
+		}
+		for _, tableID := range shard.topology.GetTableIds() {
+			table, ok := tables[tableID]
+			if !ok {
+				continue
+			}
+			view.Tables = append(view.Tables, NodeTableView{
+				ID:            table.GetID(),
+				Name:          table.GetName(),
+				SchemaID:      table.GetSchemaID(),
+				SchemaName:    table.GetSchemaName(),
+				SchemaVersion: table.GetSchemaVersion(),
+			})
+		}
+		sort.Slice(view.Tables, func(i, j int) bool { return view.Tables[i].ID < view.Tables[j].ID })
+		nodeSnapshot.Shards = append(nodeSnapshot.Shards, view)
+	}
+	sort.Slice(nodeSnapshot.Shards, func(i, j int) bool { return nodeSnapshot.Shards[i].ID < nodeSnapshot.Shards[j].ID })
+	return nodeSnapshot
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeSnapshot(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < testShardTotal/2; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+
+	snapshot, err := manager.GetNodeSnapshot(ctx, testClusterName, "a")
+	re.NoError(err)
+	re.Equal("a", snapshot.Node)
+	re.Len(snapshot.Shards, testShardTotal/2)
+	initialVersions := make(map[uint32]uint64)
+	for i, shard := range snapshot.Shards {
+		re.Equal(uint32(i), shard.ID)
+		re.Empty(shard.Tables)
+		initialVersions[shard.ID] = shard.Version
+	}
+	unknown, err := manager.GetNodeSnapshot(ctx, testClusterName, "unknown")
+	re.NoError(err)
+	re.Empty(unknown.Shards)
+
+	// The snapshots taken during the creations of the tables are consistent, i.e. the tables of each shard are the
+	// ones created before its version, since only the creations bump the versions.
+	const tables = 64
+	created := make(chan error, 1)
+	go func() {
+		for i := 0; i < tables; i++ {
+			if _, err := manager.AllocTableID(ctx, testClusterName, "public", fmt.Sprintf("table%d", i)); err != nil {
+				created <- err
+				return
+			}
+		}
+		created <- nil
+	}()
+	done := false
+	for !done {
+		select {
+		case err := <-created:
+			re.NoError(err)
+			done = true
+		default:
+		}
+
+		snapshot, err := manager.GetNodeSnapshot(ctx, testClusterName, "a")
+		re.NoError(err)
+		seen := make(map[uint64]struct{})
+		for _, shard := range snapshot.Shards {
+			re.Equal(int(shard.Version-initialVersions[shard.ID]), len(shard.Tables), "shard:%d", shard.ID)
+			for _, table := range shard.Tables {
+				re.NotContains(seen, table.ID)
+				seen[table.ID] = struct{}{}
+				re.Equal("public", table.SchemaName)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetNodes(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+
+	leaderShards := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("b", 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("a", 1, 0)))
+
+	result, err := manager.GetNodes(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.False(result.NotModified)
+	re.Len(result.Nodes, 2)
+	re.Equal("a", result.Nodes[0].Name)
+	re.Equal([]uint32{0, 1}, result.Nodes[0].ShardIDs)
+	re.True(result.Nodes[0].Alive)
+	re.Equal(time.Minute, result.Nodes[0].Lease)
+	re.Less(result.Nodes[0].SinceLastHeartbeat, time.Minute)
+	firstSeenTime := result.Nodes[0].FirstSeenTime
+	re.Equal(result.Nodes[0].LastTouchTime, firstSeenTime)
+	generation := result.Generation
+	re.Equal(generation, cluster.GetTopologyGeneration())
+
+	// The unchanged heartbeats don't bump the generation, and the not modified result carries no nodes.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("a", 0, 1)))
+	result, err = manager.GetNodes(ctx, testClusterName, generation)
+	re.NoError(err)
+	re.True(result.NotModified)
+	re.Nil(result.Nodes)
+	re.Equal(generation, result.Generation)
+	result, err = manager.GetNodes(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.Equal(firstSeenTime, result.Nodes[0].FirstSeenTime)
+	re.False(result.Nodes[0].LastTouchTime.Before(firstSeenTime))
+	re.GreaterOrEqual(result.Nodes[0].Uptime, result.Nodes[0].SinceLastHeartbeat)
+
+	// Moving a shard bumps the generation.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("a", 0)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("b", 1, 2, 3)))
+	result, err = manager.GetNodes(ctx, testClusterName, generation)
+	re.NoError(err)
+	re.False(result.NotModified)
+	re.Greater(result.Generation, generation)
+	re.Equal([]uint32{0}, result.Nodes[0].ShardIDs)
+	re.Equal([]uint32{1, 2, 3}, result.Nodes[1].ShardIDs)
+	generation = result.Generation
+
+	// The expiration of the lease bumps the generation.
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.nodesCache["a"].firstSeenTime = time.Now().Add(-time.Hour * 2)
+	cluster.lock.Unlock()
+	result, err = manager.GetNodes(ctx, testClusterName, generation)
+	re.NoError(err)
+	re.False(result.NotModified)
+	re.False(result.Nodes[0].Alive)
+	re.Greater(result.Nodes[0].SinceLastHeartbeat, result.Nodes[0].Lease)
+	re.Greater(result.Nodes[0].Uptime, time.Hour)
+
+	// The uptime restarts once the dead node recovers.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderShards("a", 0)))
+	result, err = manager.GetNodes(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.True(result.Nodes[0].Alive)
+	re.Less(result.Nodes[0].Uptime, time.Minute)
+	re.Equal(result.Nodes[0].LastTouchTime, result.Nodes[0].FirstSeenTime)
+}
+
+func TestNodeExpirySafetyValve(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 4, 1, testShardTotal)
+	re.NoError(err)
+	nodes := []string{"a", "b", "c", "d"}
+	for _, node := range nodes {
+		re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: node, Lease: 60}))
+	}
+	re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyFailFast,
+		MaxNodeExpiryRatio:     1.5,
+	}), coderr.InvalidParams))
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyFailFast,
+		MaxNodeExpiryRatio:     0.5,
+	}))
+	aliveNodes := func() []string {
+		result, err := manager.GetNodes(ctx, testClusterName, 0)
+		re.NoError(err)
+		alive := make([]string, 0)
+		for _, node := range result.Nodes {
+			if node.Alive {
+				alive = append(alive, node.Name)
+			}
+		}
+		return alive
+	}
+
+	// The receipt of the heartbeat is read from the monotonic clock.
+	re.Contains(cluster.nodesCache["a"].lastTouchTime.String(), "m=")
+
+	// The clock of the leader jumps by an hour, and all the nodes are kept alive instead of expired at once.
+	refused := testutil.ToFloat64(nodeExpiryRefusedCounter.WithLabelValues(testClusterName))
+	generation := cluster.GetTopologyGeneration()
+	cluster.lock.Lock()
+	cluster.refreshNodesLocked(time.Now().Add(time.Hour))
+	for _, node := range nodes {
+		re.True(cluster.nodesCache[node].IsAlive(time.Now().Add(time.Hour)), node)
+	}
+	cluster.lock.Unlock()
+	re.Equal(refused+1, testutil.ToFloat64(nodeExpiryRefusedCounter.WithLabelValues(testClusterName)))
+	re.Equal(generation, cluster.GetTopologyGeneration())
+	re.Equal(nodes, aliveNodes())
+
+	// Half of the nodes are allowed to expire.
+	cluster.lock.Lock()
+	cluster.nodesCache["c"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.nodesCache["d"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	re.Equal([]string{"a", "b"}, aliveNodes())
+
+	// The new leader inherits the stale heartbeats, which are reset instead of expiring the nodes.
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{ShardUnavailablePolicy: ShardUnavailablePolicyFailFast}))
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.nodesCache["b"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	cluster.ResetNodeLiveness()
+	re.Equal([]string{"a", "b"}, aliveNodes())
+
+	// The dead nodes are not revived by the reset.
+	cluster.lock.RLock()
+	for _, node := range []string{"c", "d"} {
+		re.False(cluster.nodesCache[node].IsAlive(time.Now()), node)
+	}
+	cluster.lock.RUnlock()
+}
+
+func TestValidateNodeEndpoint(t *testing.T) {
+	re := require.New(t)
+
+	for _, endpoint := range []string{"10.0.0.1:8831", "ceresdb-0.ceresdb:8831", "[fe80::1]:8831"} {
+		re.NoError(ValidateNodeEndpoint(endpoint, false), endpoint)
+	}
+
+	invalidEndpoints := []string{
+		"",
+		"10.0.0.1",
+		":8831",
+		"10.0.0.1:",
+		"10.0.0.1:port",
+		"10.0.0.1:0",
+		"10.0.0.1:65536",
+		"0.0.0.0:8831",
+		"[::]:8831",
+	}
+	for _, endpoint := range invalidEndpoints {
+		re.True(coderr.Is(ValidateNodeEndpoint(endpoint, false), coderr.InvalidParams), endpoint)
+		re.True(coderr.Is(ValidateNodeEndpoint(endpoint, true), coderr.InvalidParams), endpoint)
+	}
+
+	// The loopback endpoints are only accepted in the development mode.
+	for _, endpoint := range []string{"127.0.0.1:8831", "localhost:8831", "[::1]:8831"} {
+		re.True(coderr.Is(ValidateNodeEndpoint(endpoint, false), coderr.InvalidParams), endpoint)
+		re.NoError(ValidateNodeEndpoint(endpoint, true), endpoint)
+	}
+}
+
+func TestProbeNodeEndpoint(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	re.NoError(err)
+	endpoint := listener.Addr().String()
+	re.NoError(ProbeNodeEndpoint(ctx, endpoint))
+
+	re.NoError(listener.Close())
+	re.True(coderr.Is(ProbeNodeEndpoint(ctx, endpoint), coderr.InvalidParams))
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ShardUnavailablePolicy decides what to do when the shard selected for a new table is owned by a dead node.
+type ShardUnavailablePolicy string
+
+const (
+	// ShardUnavailablePolicyFailFast fails the creation with ErrShardUnavailable at once.
+	ShardUnavailablePolicyFailFast ShardUnavailablePolicy = "fail_fast"
+	// ShardUnavailablePolicyReselect selects another available shard of the schema.
+	ShardUnavailablePolicyReselect ShardUnavailablePolicy = "reselect"
+	// ShardUnavailablePolicyWait waits for the node to recover until the timeout.
+	ShardUnavailablePolicyWait ShardUnavailablePolicy = "wait"
+
+	defaultShardUnavailableWaitTimeoutMs = 10000
+)
+
+// TableNameScope is the scope in which the names of the tables are unique.
+type TableNameScope string
+
+const (
+	// TableNameScopeSchema makes the names unique in every schema.
+	TableNameScopeSchema TableNameScope = "schema"
+	// TableNameScopeCluster makes the names unique across all the schemas of the cluster.
+	TableNameScopeCluster TableNameScope = "cluster"
+	// TableNameScopeShard makes the names unique across all the tables on the same shard besides the schema, and the
+	// table is placed on a shard not holding the name.
+	TableNameScopeShard TableNameScope = "shard"
+)
+
+// TableIDAllocScope is the scope sharing the same allocator of the ids of the tables.
+type TableIDAllocScope string
+
+const (
+	// TableIDAllocScopeCluster allocates the ids of all the tables of the cluster from a single allocator.
+	TableIDAllocScopeCluster TableIDAllocScope = "cluster"
+	// TableIDAllocScopeSchema allocates the ids of the tables of every schema from its own partition of the id space,
+	// which is the id of the schema in the high 32 bits, so the creations in different schemas don't contend on the
+	// same allocator and the ids are still unique across the schemas.
+	TableIDAllocScopeSchema TableIDAllocScope = "schema"
+)
+
+// CreatePersistFailurePolicy decides what to do when the table is persisted by the creation but the topology of its
+// shard fails to be.
+type CreatePersistFailurePolicy string
+
+const (
+	// CreatePersistFailureRollback deletes the table and fails the creation.
+	CreatePersistFailureRollback CreatePersistFailurePolicy = "rollback"
+	// CreatePersistFailureReconcile keeps the table placed on the shard and returns it as created, and the topology of
+	// the shard is persisted again in background, so the table created on the node with the returned id is never
+	// unknown to the ceresmeta even if the failure is ambiguous and the retried creation would get another id.
+	CreatePersistFailureReconcile CreatePersistFailurePolicy = "reconcile"
+)
+
+// Options are the configurable behaviors of a cluster, and they are persisted separately from the cluster meta.
+type Options struct {
+	ShardUnavailablePolicy ShardUnavailablePolicy `json:"shard_unavailable_policy"`
+	// ShardUnavailableWaitTimeoutMs is only used by the ShardUnavailablePolicyWait.
+	ShardUnavailableWaitTimeoutMs uint64 `json:"shard_unavailable_wait_timeout_ms"`
+	// The mutating DDLs are rejected if the alive nodes are fewer than MinHealthyNodes or their ratio to the expected
+	// nodes is below MinHealthyNodeRatio, and zero disables the check.
+	MinHealthyNodes     uint32  `json:"min_healthy_nodes"`
+	MinHealthyNodeRatio float64 `json:"min_healthy_node_ratio"`
+	// GapFreeTableID makes the ids of the tables contiguous by advancing the end id of the allocator only along with
+	// persisting the table, at the cost of a storage read on every creation and rejecting the creations racing with
+	// the allocation of other ceresmeta instances.
+	GapFreeTableID bool `json:"gap_free_table_id"`
+	// InitialShardAssignment maps the shards to their owners given at the creation of the cluster, which are assigned
+	// to the shards never owned instead of the planned ones.
+	InitialShardAssignment map[uint32]string `json:"initial_shard_assignment,omitempty"`
+	// The DDLs computed against a topology generation lagging behind the current one by more than
+	// MaxTopologyGenerationLag are rejected, and zero disables the check.
+	MaxTopologyGenerationLag uint64 `json:"max_topology_generation_lag"`
+	// The lease expiry of the nodes is refused and alarmed if it takes more than MaxNodeExpiryRatio of the alive
+	// nodes at once, and zero disables the check.
+	MaxNodeExpiryRatio float64 `json:"max_node_expiry_ratio"`
+	// TableNameScope can only be set at the creation of the cluster, and it is left empty to keep the current one
+	// when the options are changed.
+	TableNameScope TableNameScope `json:"table_name_scope"`
+	// ShardVersionPolicy decides which operations bump the versions of the shards, and the empty one is the default.
+	ShardVersionPolicy ShardVersionPolicy `json:"shard_version_policy"`
+	// A warning is logged when the encoded topology of a shard grows beyond ShardTopologyWarnBytes, and no more table
+	// is placed on the shard once its topology would grow beyond MaxShardTopologyBytes. Zero means the default size.
+	ShardTopologyWarnBytes int `json:"shard_topology_warn_bytes"`
+	MaxShardTopologyBytes  int `json:"max_shard_topology_bytes"`
+	// DecisionSeed makes the choices of the create-table pipeline by a pseudo-random source of the seed instead of the
+	// live one, which is only for reproducing the failures in debugging, and zero disables it.
+	DecisionSeed int64 `json:"decision_seed"`
+	// AutoCreateSchema makes the creation of the table create its missing schema with the default shard count hint
+	// instead of failing with ErrSchemaNotFoundForTable.
+	AutoCreateSchema bool `json:"auto_create_schema"`
+	// TableIDAllocScope can only be set at the creation of the cluster like the TableNameScope, so that all the readers
+	// agree on how the ids are allocated, and the GapFreeTableID is only supported by the TableIDAllocScopeCluster.
+	TableIDAllocScope TableIDAllocScope `json:"table_id_alloc_scope"`
+	// CreatePersistFailurePolicy is not used by the GapFreeTableID, which persists the table along with its shard
+	// topology atomically.
+	CreatePersistFailurePolicy CreatePersistFailurePolicy `json:"create_persist_failure_policy"`
+}
+
+func defaultOptions() Options {
+	return Options{
+		ShardUnavailablePolicy:        ShardUnavailablePolicyFailFast,
+		ShardUnavailableWaitTimeoutMs: defaultShardUnavailableWaitTimeoutMs,
+		TableNameScope:                TableNameScopeSchema,
+		ShardVersionPolicy:            defaultShardVersionPolicy,
+		TableIDAllocScope:             TableIDAllocScopeCluster,
+		CreatePersistFailurePolicy:    CreatePersistFailureRollback,
+	}
+}
+
+func (o Options) validate() error {
+	switch o.ShardUnavailablePolicy {
+	case ShardUnavailablePolicyFailFast, ShardUnavailablePolicyReselect, ShardUnavailablePolicyWait:
+	default:
+		return ErrInvalidClusterOptions.WithCausef("unknown shard unavailable policy:%s", o.ShardUnavailablePolicy)
+	}
+	if o.ShardUnavailablePolicy == ShardUnavailablePolicyWait && o.ShardUnavailableWaitTimeoutMs == 0 {
+		return ErrInvalidClusterOptions.WithCausef("wait timeout must be positive for policy:%s", o.ShardUnavailablePolicy)
+	}
+	if o.MinHealthyNodeRatio < 0 || o.MinHealthyNodeRatio > 1 {
+		return ErrInvalidClusterOptions.WithCausef("min healthy node ratio:%v is out of [0, 1]", o.MinHealthyNodeRatio)
+	}
+	switch o.TableNameScope {
+	case "", TableNameScopeSchema, TableNameScopeCluster, TableNameScopeShard:
+	default:
+		return ErrInvalidClusterOptions.WithCausef("unknown table name scope:%s", o.TableNameScope)
+	}
+	if err := o.validateTableIDAllocScope(); err != nil {
+		return err
+	}
+	switch o.CreatePersistFailurePolicy {
+	case "", CreatePersistFailureRollback, CreatePersistFailureReconcile:
+	default:
+		return ErrInvalidClusterOptions.WithCausef("unknown create persist failure policy:%s", o.CreatePersistFailurePolicy)
+	}
+	if !o.ShardVersionPolicy.IsValid() {
+		return ErrInvalidClusterOptions.WithCausef("unknown shard version policy:%s", o.ShardVersionPolicy)
+	}
+	if o.ShardTopologyWarnBytes < 0 || o.MaxShardTopologyBytes < 0 {
+		return ErrInvalidClusterOptions.WithCausef("shard topology sizes must not be negative, warn:%d, max:%d",
+			o.ShardTopologyWarnBytes, o.MaxShardTopologyBytes)
+	}
+	if o.MaxNodeExpiryRatio < 0 || o.MaxNodeExpiryRatio > 1 {
+		return ErrInvalidClusterOptions.WithCausef("max node expiry ratio:%v is out of [0, 1]", o.MaxNodeExpiryRatio)
+	}
+	return nil
+}
+
+func (o Options) validateTableIDAllocScope() error {
+	switch o.TableIDAllocScope {
+	case "", TableIDAllocScopeCluster:
+	case TableIDAllocScopeSchema:
+		if o.GapFreeTableID {
+			return ErrInvalidClusterOptions.WithCausef("gap-free table id is not supported by table id alloc scope:%s",
+				o.TableIDAllocScope)
+		}
+	default:
+		return ErrInvalidClusterOptions.WithCausef("unknown table id alloc scope:%s", o.TableIDAllocScope)
+	}
+	return nil
+}
+
+func (o Options) shardUnavailableWaitTimeout() time.Duration {
+	return time.Duration(o.ShardUnavailableWaitTimeoutMs) * time.Millisecond
+}
+
+// loadOptions loads the options of the cluster, and the default options are returned if not set.
+func (c *Cluster) loadOptions(ctx context.Context) (Options, error) {
+	value, err := c.storage.GetClusterOptions(ctx, c.clusterID)
+	if err != nil {
+		return Options{}, errors.Wrap(err, "get cluster options")
+	}
+
+	opts := defaultOptions()
+	if value == "" {
+		return opts, nil
+	}
+	if err := json.Unmarshal([]byte(value), &opts); err != nil {
+		return Options{}, ErrInvalidClusterOptions.WithCausef("decode options:%s, err:%v", value, err)
+	}
+	return opts, nil
+}
+
+func (c *Cluster) GetOptions() Options {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.options
+}
+
+// SetOptions validates and persists the options of the cluster.
+func (c *Cluster) SetOptions(ctx context.Context, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.setOptionsLocked(ctx, opts)
+}
+
+// UpdateOptions changes the current options of the cluster by the update, and the options are validated and persisted
+// as a whole. The updated options are returned.
+func (c *Cluster) UpdateOptions(ctx context.Context, update func(opts *Options)) (Options, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	opts := c.options
+	update(&opts)
+	if err := opts.validate(); err != nil {
+		return Options{}, err
+	}
+	if err := c.setOptionsLocked(ctx, opts); err != nil {
+		return Options{}, err
+	}
+	return c.options, nil
+}
+
+func (c *Cluster) setOptionsLocked(ctx context.Context, opts Options) error {
+	// The existing tables may break the uniqueness in another scope.
+	if opts.TableNameScope == "" {
+		opts.TableNameScope = c.options.TableNameScope
+	}
+	if opts.TableNameScope != c.options.TableNameScope {
+		return ErrInvalidClusterOptions.WithCausef("table name scope:%s can't be changed to %s after the creation",
+			c.options.TableNameScope, opts.TableNameScope)
+	}
+	if opts.TableIDAllocScope == "" {
+		opts.TableIDAllocScope = c.options.TableIDAllocScope
+	}
+	if opts.TableIDAllocScope != c.options.TableIDAllocScope {
+		return ErrInvalidClusterOptions.WithCausef("table id alloc scope:%s can't be changed to %s after the creation",
+			c.options.TableIDAllocScope, opts.TableIDAllocScope)
+	}
+	if err := opts.validateTableIDAllocScope(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(opts)
+	if err != nil {
+		return ErrInvalidClusterOptions.WithCause(err)
+	}
+	if err := c.storage.PutClusterOptions(ctx, c.clusterID, string(value)); err != nil {
+		return errors.Wrap(err, "put cluster options")
+	}
+	c.options = opts
+	c.setDecisionSeed(opts.DecisionSeed)
+	c.dropHeartbeatViewLocked()
+	c.invalidateTopologyCacheLocked()
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// PendingReconcile is a table created under the CreatePersistFailureReconcile policy whose shard topology fails to be
+// persisted. The table is served as created, and the topology of its shard is persisted again until it succeeds. The
+// table is persisted along with a deleting marker carrying the policy, which is deleted by persisting the topology, so
+// the entries are recovered by loading the cluster when the leader of the ceresmeta changes.
+type PendingReconcile struct {
+	SchemaName string `json:"schema_name"`
+	TableName  string `json:"table_name"`
+	TableID    uint64 `json:"table_id"`
+	ShardID    uint32 `json:"shard_id"`
+	// Error is the latest failure to persist the topology of the shard.
+	Error      string    `json:"error"`
+	Attempts   int       `json:"attempts"`
+	RecordedAt time.Time `json:"recorded_at"`
+
+	meta *metapb.Table
+}
+
+func newPendingReconcile(schemaName string, table *metapb.Table) PendingReconcile {
+	return PendingReconcile{
+		SchemaName: schemaName,
+		TableName:  table.GetName(),
+		TableID:    table.GetId(),
+		ShardID:    table.GetShardId(),
+		RecordedAt: time.Now(),
+		meta:       table,
+	}
+}
+
+// ListPendingReconciles returns the tables whose shard topologies are not persisted yet ordered by the table id.
+func (c *Cluster) ListPendingReconciles() []PendingReconcile {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.listPendingReconcilesLocked()
+}
+
+func (c *Cluster) listPendingReconcilesLocked() []PendingReconcile {
+	reconciles := make([]PendingReconcile, 0, len(c.pendingReconciles))
+	for _, reconcile := range c.pendingReconciles {
+		reconciles = append(reconciles, reconcile)
+	}
+	sort.Slice(reconciles, func(i, j int) bool { return reconciles[i].TableID < reconciles[j].TableID })
+	return reconciles
+}
+
+// recordPendingReconcileLocked records the table whose creation fails to persist the topology of its shard with the
+// err, and the table is kept as created.
+func (c *Cluster) recordPendingReconcileLocked(ctx context.Context, schemaName string, table *metapb.Table, err error) {
+	reconcile := newPendingReconcile(schemaName, table)
+	reconcile.Error = err.Error()
+	reconcile.Attempts = 1
+	c.pendingReconciles[table.GetId()] = reconcile
+	pendingReconcilesGauge.WithLabelValues(c.metaData.GetName()).Set(float64(len(c.pendingReconciles)))
+	log.Warn("keep created table with shard topology not persisted", zap.String("cluster", c.metaData.GetName()),
+		zap.String("schema", schemaName), zap.String("table", table.GetName()), zap.Uint64("table-id", table.GetId()),
+		zap.Uint32("shard", table.GetShardId()), zap.Error(err), zap.Any("origin", DDLOriginFromContext(ctx)))
+}
+
+// loadPendingReconcilesLocked replaces the pending reconciles with the ones found by loading the cluster, and places
+// their tables on the loaded topologies of their shards, which are persisted by the next reconcile. The attempts made
+// before the reload are kept.
+func (c *Cluster) loadPendingReconcilesLocked(reconciles []PendingReconcile) {
+	pendingReconciles := make(map[uint64]PendingReconcile, len(reconciles))
+	for _, reconcile := range reconciles {
+		if old, ok := c.pendingReconciles[reconcile.TableID]; ok {
+			reconcile.Error = old.Error
+			reconcile.Attempts = old.Attempts
+			reconcile.RecordedAt = old.RecordedAt
+		}
+		if shard, ok := c.shardsCache[reconcile.ShardID]; ok && !shard.hasTable(reconcile.TableID) {
+			shard.topology = shard.withTable(reconcile.TableID, c.shardVersionIncrementLocked(ShardOperationCreateTable))
+			c.observeShardTopologySizeLocked(shard)
+		}
+		pendingReconciles[reconcile.TableID] = reconcile
+		log.Info("load pending reconcile of table", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", reconcile.SchemaName), zap.String("table", reconcile.TableName),
+			zap.Uint64("table-id", reconcile.TableID), zap.Uint32("shard", reconcile.ShardID))
+	}
+	c.pendingReconciles = pendingReconciles
+	pendingReconcilesGauge.WithLabelValues(c.metaData.GetName()).Set(float64(len(c.pendingReconciles)))
+}
+
+// reconcilePendingLocked persists the current topologies of the shards of the pending reconciles, which carry the
+// tables of the reconciles along with the changes made since then, along with deleting the markers of the tables, and
+// the reconciles of the shards persisted are done.
+func (c *Cluster) reconcilePendingLocked(ctx context.Context) {
+	if len(c.pendingReconciles) == 0 {
+		return
+	}
+
+	shardTables := make(map[uint32][]*metapb.Table)
+	for _, reconcile := range c.pendingReconciles {
+		shardTables[reconcile.ShardID] = append(shardTables[reconcile.ShardID], reconcile.meta)
+	}
+	for shardID, tables := range shardTables {
+		var err error
+		// The shard is gone only if the cluster is reloaded, and there is nothing left to persist.
+		if shard, ok := c.shardsCache[shardID]; ok {
+			err = c.storage.PutShardTopologyPlacingTables(ctx, c.clusterID, shardID, shard.topology, tables)
+			c.markStaleOnConflictLocked(err)
+		}
+		for tableID, reconcile := range c.pendingReconciles {
+			if reconcile.ShardID != shardID {
+				continue
+			}
+			if err != nil {
+				reconcile.Attempts++
+				reconcile.Error = err.Error()
+				c.pendingReconciles[tableID] = reconcile
+				log.Warn("fail to reconcile shard topology of table", zap.String("cluster", c.metaData.GetName()),
+					zap.String("schema", reconcile.SchemaName), zap.String("table", reconcile.TableName),
+					zap.Uint64("table-id", tableID), zap.Uint32("shard", shardID), zap.Int("attempts", reconcile.Attempts),
+					zap.Error(err))
+				continue
+			}
+			delete(c.pendingReconciles, tableID)
+			log.Info("reconcile shard topology of table", zap.String("cluster", c.metaData.GetName()),
+				zap.String("schema", reconcile.SchemaName), zap.String("table", reconcile.TableName),
+				zap.Uint64("table-id", tableID), zap.Uint32("shard", shardID))
+		}
+	}
+	pendingReconcilesGauge.WithLabelValues(c.metaData.GetName()).Set(float64(len(c.pendingReconciles)))
+}
@@ -0,0 +1,348 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Names of the constraints considered by the placement of the tables.
+const (
+	PlacementConstraintSchemaShards = "schema_shards"
+	PlacementConstraintFewestTables = "fewest_tables"
+	PlacementConstraintNotFrozen    = "shard_not_frozen"
+	PlacementConstraintAvailable    = "shard_available"
+	PlacementConstraintNameScope    = "table_name_scope"
+	PlacementConstraintNotDraining  = "shard_not_draining"
+	PlacementConstraintTopologySize = "shard_topology_size"
+)
+
+// maxPlacementRecordSize bounds the size of the encoded placement record of a table, and the candidates not picked are
+// left out of the record beyond it.
+const maxPlacementRecordSize = 4096
+
+// PlacementStrategy is how the candidate shards of a table are ranked by the picker.
+type PlacementStrategy string
+
+const (
+	// PlacementStrategyFewestTables prefers the shard with the fewest tables.
+	PlacementStrategyFewestTables PlacementStrategy = "fewest_tables"
+	// PlacementStrategyAntiAffinity prefers the shard and then the node with the fewest tables of the anti-affinity
+	// group of the table before the shard with the fewest tables.
+	PlacementStrategyAntiAffinity PlacementStrategy = "anti_affinity"
+)
+
+// PlacementScore ranks a candidate shard, and the lower one is preferred by comparing the fields in order. The numbers
+// of the tables of the group are always zero under the PlacementStrategyFewestTables.
+type PlacementScore struct {
+	GroupShardTables int `json:"group_shard_tables,omitempty"`
+	GroupNodeTables  int `json:"group_node_tables,omitempty"`
+	Tables           int `json:"tables"`
+}
+
+func (s PlacementScore) less(other PlacementScore) bool {
+	if s.GroupShardTables != other.GroupShardTables {
+		return s.GroupShardTables < other.GroupShardTables
+	}
+	if s.GroupNodeTables != other.GroupNodeTables {
+		return s.GroupNodeTables < other.GroupNodeTables
+	}
+	return s.Tables < other.Tables
+}
+
+// PlacementCandidate is a shard of the effective shard set of the schema considered by the picker.
+type PlacementCandidate struct {
+	ShardID uint32         `json:"shard_id"`
+	Node    string         `json:"node,omitempty"`
+	Score   PlacementScore `json:"score"`
+	// Rejected is the constraint violated by the shard, which is never picked then, and it is empty if the shard is
+	// eligible.
+	Rejected string `json:"rejected,omitempty"`
+	// Tied means the shard is one of the best candidates with the equal scores, among which the DecisionSource picks.
+	Tied bool `json:"tied,omitempty"`
+}
+
+// PlacementReselection is a shard picked and then given up because it violates the constraint.
+type PlacementReselection struct {
+	ShardID    uint32 `json:"shard_id"`
+	Constraint string `json:"constraint"`
+}
+
+// PlacementRecord is the decision of the picker taken at the creation of the table, which is persisted along with the
+// table and deleted along with it. The candidates are the ones of the last round of the picker, which makes the final
+// choice, and the rounds before are told by the reselections.
+type PlacementRecord struct {
+	Strategy      PlacementStrategy    `json:"strategy"`
+	AffinityGroup uint64               `json:"affinity_group,omitempty"`
+	Candidates    []PlacementCandidate `json:"candidates"`
+	// OmittedCandidates is the number of the candidates left out to bound the size of the record.
+	OmittedCandidates int                    `json:"omitted_candidates,omitempty"`
+	Reselections      []PlacementReselection `json:"reselections,omitempty"`
+	ShardID           uint32                 `json:"shard_id"`
+	Node              string                 `json:"node,omitempty"`
+	CreatedAt         time.Time              `json:"created_at"`
+}
+
+func newPlacementRecord(group uint64) *PlacementRecord {
+	record := &PlacementRecord{Strategy: PlacementStrategyFewestTables}
+	if group != 0 {
+		record.Strategy = PlacementStrategyAntiAffinity
+		record.AffinityGroup = group
+	}
+	return record
+}
+
+func (r *PlacementRecord) reselect(shard *Shard, constraint string) {
+	r.Reselections = append(r.Reselections, PlacementReselection{ShardID: shard.GetID(), Constraint: constraint})
+}
+
+func (r *PlacementRecord) markTied(shardIDs []uint32) {
+	tied := make(map[uint32]struct{}, len(shardIDs))
+	for _, shardID := range shardIDs {
+		tied[shardID] = struct{}{}
+	}
+	for i := range r.Candidates {
+		_, r.Candidates[i].Tied = tied[r.Candidates[i].ShardID]
+	}
+}
+
+func (r *PlacementRecord) choose(shard *Shard) {
+	r.ShardID = shard.GetID()
+	r.Node = shard.GetNode()
+}
+
+// encodePlacementRecord encodes the record within the maxPlacementRecordSize by leaving out the candidates not picked
+// from the last one.
+func encodePlacementRecord(record *PlacementRecord) (string, error) {
+	bounded := *record
+	bounded.Candidates = append([]PlacementCandidate(nil), record.Candidates...)
+	for {
+		value, err := json.Marshal(bounded)
+		if err != nil {
+			return "", ErrEncodePlacementRecord.WithCausef("shard:%d, err:%v", record.ShardID, err)
+		}
+		if len(value) <= maxPlacementRecordSize {
+			return string(value), nil
+		}
+
+		omitted := false
+		for i := len(bounded.Candidates) - 1; i >= 0; i-- {
+			if bounded.Candidates[i].ShardID != bounded.ShardID {
+				bounded.Candidates = append(bounded.Candidates[:i], bounded.Candidates[i+1:]...)
+				bounded.OmittedCandidates++
+				omitted = true
+				break
+			}
+		}
+		if !omitted {
+			return "", ErrEncodePlacementRecord.WithCausef("shard:%d, size:%d exceeds %d", record.ShardID, len(value),
+				maxPlacementRecordSize)
+		}
+	}
+}
+
+// putTablePlacementLocked persists the placement record of the created table. The failure is logged only, because the
+// record serves the explanation only, and the placement of the table is explained retrospectively without it.
+func (c *Cluster) putTablePlacementLocked(ctx context.Context, schema *Schema, tableID uint64, record *PlacementRecord) {
+	record.CreatedAt = time.Now()
+	value, err := encodePlacementRecord(record)
+	if err == nil {
+		err = c.storage.PutTablePlacement(ctx, c.clusterID, schema.GetID(), tableID, value)
+	}
+	if err != nil {
+		log.Warn("fail to put table placement record", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", schema.GetName()), zap.Uint64("table-id", tableID), zap.Error(err))
+	}
+}
+
+// getTablePlacementLocked returns the persisted placement record of the table, and nil is returned if the table has
+// none.
+func (c *Cluster) getTablePlacementLocked(ctx context.Context, schema *Schema, tableID uint64) (*PlacementRecord, error) {
+	value, err := c.storage.GetTablePlacement(ctx, c.clusterID, schema.GetID(), tableID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get table placement, table-id:%d", tableID)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	record := &PlacementRecord{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, ErrDecodePlacementRecord.WithCausef("table-id:%d, err:%v", tableID, err)
+	}
+	return record, nil
+}
+
+// PlacementConstraint tells whether the shard of the table satisfies a constraint of the placement, and an
+// unsatisfied constraint has been relaxed when the table was placed or is violated after that.
+type PlacementConstraint struct {
+	Name      string
+	Satisfied bool
+	Detail    string
+}
+
+// PlacementExplanation explains why the table is placed on its shard, and the shard and the node are the current
+// location of the table.
+type PlacementExplanation struct {
+	SchemaName string
+	TableName  string
+	TableID    uint64
+	ShardID    uint32
+	Node       string
+	// CandidateShardIDs is the effective shard set of the schema.
+	CandidateShardIDs []uint32
+	Constraints       []PlacementConstraint
+	// Record is the decision of the picker recorded at the creation, and it is nil if the table is created before the
+	// decisions are recorded or the record fails to be persisted.
+	Record *PlacementRecord
+	// OwnerChange is the last change of the owner of the shard after the creation, which moves the table to another
+	// node along with its shard, and it is nil if the shard is never moved since then. The earlier changes are not
+	// kept, and the last change is returned regardless of its time if the Record is nil.
+	OwnerChange *ShardOwnerChange
+}
+
+// ExplainPlacement evaluates the constraints of the placement against the stored state retrospectively along with the
+// decision recorded at the creation. The numbers of the tables on the shards at the creation are reconstructed by
+// counting the tables with smaller ids, which ignores the tables dropped since then, and the freeze and the
+// availability of the shard are evaluated on the current state because their history is not kept.
+func (c *Cluster) ExplainPlacement(ctx context.Context, schemaName, tableName string) (*PlacementExplanation, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	table, ok := schema.getTable(tableName)
+	if !ok {
+		return nil, ErrTableNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+	return c.explainPlacementLocked(ctx, schema, table)
+}
+
+// ExplainTablePlacement explains the placement of the table with the id like the ExplainPlacement.
+func (c *Cluster) ExplainTablePlacement(ctx context.Context, tableID uint64) (*PlacementExplanation, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			if table.GetID() == tableID {
+				return c.explainPlacementLocked(ctx, schema, table)
+			}
+		}
+	}
+	return nil, ErrTableNotFound.WithCausef("table-id:%d", tableID)
+}
+
+func (c *Cluster) explainPlacementLocked(ctx context.Context, schema *Schema, table *Table) (*PlacementExplanation, error) {
+	shard, ok := c.shardsCache[table.GetShardID()]
+	if !ok {
+		return nil, ErrShardNotFound.WithCausef("shard:%d, table:%s", table.GetShardID(), table.GetName())
+	}
+	record, err := c.getTablePlacementLocked(ctx, schema, table.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &PlacementExplanation{
+		SchemaName:        schema.GetName(),
+		TableName:         table.GetName(),
+		TableID:           table.GetID(),
+		ShardID:           shard.GetID(),
+		Node:              shard.GetNode(),
+		CandidateShardIDs: schema.GetShardIDs(),
+	}
+	explanation.Constraints = []PlacementConstraint{
+		c.explainSchemaShardsLocked(schema, shard),
+		c.explainFewestTablesLocked(schema, table, shard),
+		c.explainNotFrozenLocked(shard),
+		c.explainAvailableLocked(shard),
+	}
+	explanation.Record = record
+	if change := shard.lastOwnerChange; change != nil && (record == nil || change.Time.After(record.CreatedAt)) {
+		changeCopy := *change
+		explanation.OwnerChange = &changeCopy
+	}
+	return explanation, nil
+}
+
+func (c *Cluster) explainSchemaShardsLocked(schema *Schema, shard *Shard) PlacementConstraint {
+	constraint := PlacementConstraint{
+		Name:   PlacementConstraintSchemaShards,
+		Detail: fmt.Sprintf("shard count hint:%d, shards:%v", schema.GetShardCountHint(), schema.shardIDs),
+	}
+	for _, shardID := range schema.shardIDs {
+		if shardID == shard.GetID() {
+			constraint.Satisfied = true
+			break
+		}
+	}
+	return constraint
+}
+
+// explainFewestTablesLocked compares the shard with the candidate that would be picked by the pickShardLocked at the
+// creation of the table.
+func (c *Cluster) explainFewestTablesLocked(schema *Schema, table *Table, shard *Shard) PlacementConstraint {
+	tablesBefore := func(s *Shard) int {
+		count := 0
+		for _, tableID := range s.topology.GetTableIds() {
+			if tableID < table.GetID() {
+				count++
+			}
+		}
+		return count
+	}
+
+	var fewest *Shard
+	fewestCount := 0
+	for _, shardID := range schema.shardIDs {
+		candidate, ok := c.shardsCache[shardID]
+		if !ok {
+			continue
+		}
+		if count := tablesBefore(candidate); fewest == nil || count < fewestCount {
+			fewest, fewestCount = candidate, count
+		}
+	}
+
+	count := tablesBefore(shard)
+	constraint := PlacementConstraint{
+		Name:      PlacementConstraintFewestTables,
+		Satisfied: fewest == nil || fewest.GetID() == shard.GetID(),
+		Detail:    fmt.Sprintf("tables on the shard before the creation:%d", count),
+	}
+	if !constraint.Satisfied {
+		constraint.Detail = fmt.Sprintf("%s, fewest:%d on shard:%d", constraint.Detail, fewestCount, fewest.GetID())
+	}
+	return constraint
+}
+
+func (c *Cluster) explainNotFrozenLocked(shard *Shard) PlacementConstraint {
+	constraint := PlacementConstraint{
+		Name:      PlacementConstraintNotFrozen,
+		Satisfied: true,
+		Detail:    "shard version is not frozen now",
+	}
+	if freeze, ok := c.frozenShards[shard.GetID()]; ok && time.Now().Before(freeze.expireAt) {
+		constraint.Satisfied = false
+		constraint.Detail = fmt.Sprintf("shard version is frozen now until %s", freeze.expireAt)
+	}
+	return constraint
+}
+
+func (c *Cluster) explainAvailableLocked(shard *Shard) PlacementConstraint {
+	return PlacementConstraint{
+		Name:      PlacementConstraintAvailable,
+		Satisfied: c.isShardAvailableLocked(shard),
+		Detail: fmt.Sprintf("owner:%q now, shard unavailable policy:%s", shard.GetNode(),
+			c.options.ShardUnavailablePolicy),
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainPlacement(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 2)
+	re.NoError(err)
+	candidates := schema.GetShardIDs()
+
+	t0, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	re.Equal(candidates[0], t0.GetShardID())
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+
+	// The first candidate is skipped because its version is frozen.
+	_, err = manager.FreezeShardVersion(ctx, testClusterName, candidates[0])
+	re.NoError(err)
+	t2, err := manager.AllocTableID(ctx, testClusterName, "public", "t2")
+	re.NoError(err)
+	re.Equal(candidates[1], t2.GetShardID())
+
+	constraintsOf := func(explanation *PlacementExplanation) map[string]PlacementConstraint {
+		constraints := make(map[string]PlacementConstraint, len(explanation.Constraints))
+		for _, constraint := range explanation.Constraints {
+			constraints[constraint.Name] = constraint
+		}
+		return constraints
+	}
+
+	explanation, err := manager.ExplainPlacement(ctx, testClusterName, "public", "t2")
+	re.NoError(err)
+	re.Equal(t2.GetID(), explanation.TableID)
+	re.Equal(candidates[1], explanation.ShardID)
+	re.Equal(candidates, explanation.CandidateShardIDs)
+	constraints := constraintsOf(explanation)
+	re.Len(constraints, 4)
+	re.True(constraints[PlacementConstraintSchemaShards].Satisfied)
+	re.False(constraints[PlacementConstraintFewestTables].Satisfied)
+	re.True(constraints[PlacementConstraintNotFrozen].Satisfied)
+	re.True(constraints[PlacementConstraintAvailable].Satisfied)
+
+	// The state at the creation of t0 is reconstructed, but the freeze is evaluated on the current state.
+	explanation, err = manager.ExplainPlacement(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	constraints = constraintsOf(explanation)
+	re.True(constraints[PlacementConstraintFewestTables].Satisfied)
+	re.False(constraints[PlacementConstraintNotFrozen].Satisfied)
+
+	_, err = manager.ExplainPlacement(ctx, testClusterName, "public", "unknown")
+	re.True(coderr.Is(err, coderr.NotFound))
+}
+
+func TestPlacementRecord(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	re.NoError(manager.RegisterNode(ctx, testClusterName, heartbeatNodeInfo("a", 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, heartbeatNodeInfo("b", 4, 5, 6, 7)))
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 4)
+	re.NoError(err)
+	candidates := schema.GetShardIDs()
+	nodeOf := func(shardID uint32) string {
+		if shardID < 4 {
+			return "a"
+		}
+		return "b"
+	}
+
+	// create creates the table, and checks the recorded scores are the ones expected from the tables placed before, and
+	// the picked shard is the best eligible one.
+	groupTables := make(map[uint32]int)
+	create := func(ctx context.Context, tableName string, strategy PlacementStrategy) (*Table, *PlacementRecord) {
+		stats, err := manager.GetSchemaStats(ctx, testClusterName, "public")
+		re.NoError(err)
+		table, err := manager.AllocTableID(ctx, testClusterName, "public", tableName)
+		re.NoError(err)
+		explanation, err := manager.ExplainTablePlacement(ctx, testClusterName, table.GetID())
+		re.NoError(err)
+		re.Equal(tableName, explanation.TableName)
+		record := explanation.Record
+		re.NotNil(record)
+		re.Equal(strategy, record.Strategy)
+		re.Equal(table.GetShardID(), record.ShardID)
+		re.Equal(nodeOf(record.ShardID), record.Node)
+		re.Len(record.Candidates, len(candidates))
+
+		var best *PlacementScore
+		bestCount := 0
+		for i, candidate := range record.Candidates {
+			re.Equal(candidates[i], candidate.ShardID)
+			re.Equal(nodeOf(candidate.ShardID), candidate.Node)
+			expected := PlacementScore{Tables: stats.ShardTableCounts[candidate.ShardID]}
+			if strategy == PlacementStrategyAntiAffinity {
+				expected.GroupShardTables = groupTables[candidate.ShardID]
+				for shardID, count := range groupTables {
+					if nodeOf(shardID) == candidate.Node {
+						expected.GroupNodeTables += count
+					}
+				}
+			}
+			re.Equal(expected, candidate.Score)
+			if candidate.Rejected != "" {
+				continue
+			}
+			switch {
+			case best == nil || candidate.Score.less(*best):
+				best, bestCount = &record.Candidates[i].Score, 1
+			case candidate.Score == *best:
+				bestCount++
+			}
+		}
+		re.NotNil(best)
+		for _, candidate := range record.Candidates {
+			if candidate.ShardID == record.ShardID {
+				re.Empty(candidate.Rejected)
+				re.Equal(*best, candidate.Score)
+			}
+			re.Equal(candidate.Rejected == "" && bestCount > 1 && candidate.Score == *best, candidate.Tied)
+		}
+		if strategy == PlacementStrategyAntiAffinity {
+			groupTables[record.ShardID]++
+		}
+		return table, record
+	}
+
+	t0, _ := create(ctx, "t0", PlacementStrategyFewestTables)
+	_, _ = create(ctx, "t1", PlacementStrategyFewestTables)
+	groupCtx := WithAntiAffinityGroup(ctx, 7)
+	g0, record := create(groupCtx, "g0", PlacementStrategyAntiAffinity)
+	re.Equal(uint64(7), record.AffinityGroup)
+	g1, _ := create(groupCtx, "g1", PlacementStrategyAntiAffinity)
+	re.NotEqual(nodeOf(g0.GetShardID()), nodeOf(g1.GetShardID()))
+	_, _ = create(groupCtx, "g2", PlacementStrategyAntiAffinity)
+
+	// The shard picked first is frozen, and the reselection is recorded.
+	stats, err := manager.GetSchemaStats(ctx, testClusterName, "public")
+	re.NoError(err)
+	frozen := candidates[0]
+	for _, shardID := range candidates {
+		if stats.ShardTableCounts[shardID] < stats.ShardTableCounts[frozen] {
+			frozen = shardID
+		}
+	}
+	_, err = manager.FreezeShardVersion(ctx, testClusterName, frozen)
+	re.NoError(err)
+	r0, record := create(ctx, "r0", PlacementStrategyFewestTables)
+	re.NotEqual(frozen, r0.GetShardID())
+	re.Equal([]PlacementReselection{{ShardID: frozen, Constraint: PlacementConstraintNotFrozen}}, record.Reselections)
+	for _, candidate := range record.Candidates {
+		if candidate.ShardID == frozen {
+			re.Equal(PlacementConstraintNotFrozen, candidate.Rejected)
+		}
+	}
+
+	// The record is deleted along with the table.
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "r0", false))
+	value, err := s.GetTablePlacement(ctx, cluster.clusterID, schema.GetID(), r0.GetID())
+	re.NoError(err)
+	re.Empty(value)
+
+	// The move of the shard after the creation is explained along with the current location.
+	explanation, err := manager.ExplainTablePlacement(ctx, testClusterName, t0.GetID())
+	re.NoError(err)
+	re.Nil(explanation.OwnerChange)
+	from := nodeOf(t0.GetShardID())
+	to := "a"
+	if from == "a" {
+		to = "b"
+	}
+	cluster.lock.Lock()
+	cluster.nodesCache[from].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	re.NoError(manager.RegisterNode(ctx, testClusterName, heartbeatNodeInfo(to, t0.GetShardID())))
+	explanation, err = manager.ExplainTablePlacement(ctx, testClusterName, t0.GetID())
+	re.NoError(err)
+	re.Equal(to, explanation.Node)
+	re.Equal(from, explanation.Record.Node)
+	re.NotNil(explanation.OwnerChange)
+	re.Equal(from, explanation.OwnerChange.From)
+	re.Equal(to, explanation.OwnerChange.To)
+	re.Equal(ShardOwnerReported, explanation.OwnerChange.Reason)
+
+	_, err = manager.ExplainTablePlacement(ctx, testClusterName, r0.GetID())
+	re.True(coderr.Is(err, coderr.NotFound))
+}
+
+func TestEncodePlacementRecord(t *testing.T) {
+	re := require.New(t)
+
+	record := &PlacementRecord{Strategy: PlacementStrategyFewestTables, ShardID: 150}
+	for i := 0; i < 200; i++ {
+		record.Candidates = append(record.Candidates, PlacementCandidate{
+			ShardID: uint32(i),
+			Node:    "ceresdb-node-with-a-long-name",
+			Score:   PlacementScore{Tables: i},
+		})
+	}
+	value, err := encodePlacementRecord(record)
+	re.NoError(err)
+	re.LessOrEqual(len(value), maxPlacementRecordSize)
+	re.Len(record.Candidates, 200)
+
+	decoded := &PlacementRecord{}
+	re.NoError(json.Unmarshal([]byte(value), decoded))
+	re.Equal(200, len(decoded.Candidates)+decoded.OmittedCandidates)
+	re.Positive(decoded.OmittedCandidates)
+	re.Equal(uint32(0), decoded.Candidates[0].ShardID)
+	picked := false
+	for _, candidate := range decoded.Candidates {
+		picked = picked || candidate.ShardID == record.ShardID
+	}
+	re.True(picked)
+}
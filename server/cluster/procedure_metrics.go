@@ -0,0 +1,58 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProcedureType is the kind of the procedures changing the metadata of the cluster.
+type ProcedureType string
+
+const (
+	ProcedureCreateSchema ProcedureType = "create_schema"
+	ProcedureCreateTable  ProcedureType = "create_table"
+	ProcedureDropTable    ProcedureType = "drop_table"
+	ProcedureAlterTable   ProcedureType = "alter_table"
+	ProcedureSwapShards   ProcedureType = "swap_shards"
+	// ProcedureReassignShards moves all the shards of a node, and every shard moved is not observed separately.
+	ProcedureReassignShards ProcedureType = "reassign_shards"
+)
+
+// ProcedureOutcome is how a procedure ends.
+type ProcedureOutcome string
+
+const (
+	ProcedureSucceeded  ProcedureOutcome = "success"
+	ProcedureFailed     ProcedureOutcome = "failed"
+	ProcedureRolledBack ProcedureOutcome = "rolled_back"
+	ProcedureTimedOut   ProcedureOutcome = "timed_out"
+)
+
+// ProcedureOutcomeOf returns the outcome of the procedure ending with the err. The error message is checked because
+// the deadline of the ctx may be flattened into a string by the CodeError.
+func ProcedureOutcomeOf(err error) ProcedureOutcome {
+	switch {
+	case err == nil:
+		return ProcedureSucceeded
+	case errors.Is(err, context.DeadlineExceeded) || strings.Contains(err.Error(), context.DeadlineExceeded.Error()):
+		return ProcedureTimedOut
+	default:
+		return ProcedureFailed
+	}
+}
+
+// ObserveProcedure records the duration and the outcome of the procedure started at the start.
+func ObserveProcedure(clusterName string, typ ProcedureType, start time.Time, outcome ProcedureOutcome) {
+	procedureDurationHistogram.WithLabelValues(clusterName, string(typ)).Observe(time.Since(start).Seconds())
+	proceduresCounter.WithLabelValues(clusterName, string(typ), string(outcome)).Inc()
+}
+
+// observeProcedureLocked records the procedure of the cluster ending with the err.
+func (c *Cluster) observeProcedureLocked(typ ProcedureType, start time.Time, err error) {
+	ObserveProcedure(c.metaData.GetName(), typ, start, ProcedureOutcomeOf(err))
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcedureOutcomeOf(t *testing.T) {
+	re := require.New(t)
+
+	re.Equal(ProcedureSucceeded, ProcedureOutcomeOf(nil))
+	re.Equal(ProcedureFailed, ProcedureOutcomeOf(ErrTableNotFound))
+	re.Equal(ProcedureTimedOut, ProcedureOutcomeOf(errors.Wrap(context.DeadlineExceeded, "put table")))
+	// The deadline flattened by the CodeError is recognized too.
+	re.Equal(ProcedureTimedOut, ProcedureOutcomeOf(ErrShardUnavailable.WithCause(context.DeadlineExceeded)))
+	re.Equal(ProcedureFailed, ProcedureOutcomeOf(context.Canceled))
+}
+
+func TestProcedureMetrics(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+
+	count := func(typ ProcedureType, outcome ProcedureOutcome) float64 {
+		return testutil.ToFloat64(proceduresCounter.WithLabelValues(testClusterName, string(typ), string(outcome)))
+	}
+	base := map[ProcedureType]float64{
+		ProcedureCreateSchema: count(ProcedureCreateSchema, ProcedureSucceeded),
+		ProcedureCreateTable:  count(ProcedureCreateTable, ProcedureSucceeded),
+		ProcedureAlterTable:   count(ProcedureAlterTable, ProcedureFailed),
+		ProcedureDropTable:    count(ProcedureDropTable, ProcedureSucceeded),
+	}
+
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	// The routing of the existing table is not a procedure.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "table0", 1, []byte("schema"))
+	re.Error(err)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "table0", false))
+
+	re.Equal(base[ProcedureCreateSchema]+1, count(ProcedureCreateSchema, ProcedureSucceeded))
+	re.Equal(base[ProcedureCreateTable]+1, count(ProcedureCreateTable, ProcedureSucceeded))
+	re.Equal(base[ProcedureAlterTable]+1, count(ProcedureAlterTable, ProcedureFailed))
+	re.Equal(base[ProcedureDropTable]+1, count(ProcedureDropTable, ProcedureSucceeded))
+	re.GreaterOrEqual(testutil.CollectAndCount(procedureDurationHistogram), 4)
+}
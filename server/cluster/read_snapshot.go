@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+)
+
+// readSnapshot is an immutable view of the topology of the cluster taken at some point in time, so that it can be
+// read outside the lock. The shard topologies are copy-on-write and only referenced by the snapshot, and only the
+// table maps of the schemas are copied.
+type readSnapshot struct {
+	topologyGeneration uint64
+	options            Options
+
+	// schemaName -> tableName -> table
+	tables map[string]map[string]*Table
+	shards map[uint32]shardRef
+}
+
+// shardRef references the copy-on-write topology of the shard.
+type shardRef struct {
+	topology    *metapb.ShardTopology
+	node        string
+	ownerChange *ShardOwnerChange
+}
+
+// ShardView is the state of a shard handed out of the lock.
+type ShardView struct {
+	ID       uint32   `json:"id"`
+	Version  uint64   `json:"version"`
+	Node     string   `json:"node"`
+	TableIDs []uint64 `json:"table_ids"`
+	// LastOwnerChange is nil if the owner of the shard has never changed.
+	LastOwnerChange *ShardOwnerChange `json:"last_owner_change"`
+}
+
+// newReadSnapshotLocked takes the snapshot of the current topology, which only copies the table maps of the schemas.
+func (c *Cluster) newReadSnapshotLocked() *readSnapshot {
+	snapshot := &readSnapshot{
+		topologyGeneration: c.topologyGeneration,
+		options:            c.options,
+		tables:             make(map[string]map[string]*Table, len(c.schemasCache)),
+		shards:             make(map[uint32]shardRef, len(c.shardsCache)),
+	}
+	for schemaName, schema := range c.schemasCache {
+		tables := make(map[string]*Table, len(schema.tableMap))
+		for tableName, table := range schema.tableMap {
+			if _, ok := c.dropTasks[table.GetID()]; ok || c.inDeletingFamilyLocked(table) {
+				continue
+			}
+			tables[tableName] = table
+		}
+		snapshot.tables[schemaName] = tables
+	}
+	for shardID, shard := range c.shardsCache {
+		snapshot.shards[shardID] = shardRef{topology: shard.topology, node: shard.node, ownerChange: shard.lastOwnerChange}
+	}
+	return snapshot
+}
+
+// newShardView copies the table ids and the ownership change so that the view can be handed out safely.
+func newShardView(shardID uint32, shard shardRef) ShardView {
+	tableIDs := make([]uint64, len(shard.topology.GetTableIds()))
+	copy(tableIDs, shard.topology.GetTableIds())
+	view := ShardView{
+		ID:       shardID,
+		Version:  shard.topology.GetVersion(),
+		Node:     shard.node,
+		TableIDs: tableIDs,
+	}
+	if shard.ownerChange != nil {
+		change := *shard.ownerChange
+		view.LastOwnerChange = &change
+	}
+	return view
+}
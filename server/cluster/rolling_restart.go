@@ -0,0 +1,139 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRestartTokenTTL = time.Minute * 10
+	maxRestartTokenTTL     = time.Hour
+)
+
+type restartToken struct {
+	token    string
+	expireAt time.Time
+}
+
+// BlockingShard is a shard which would lose too many replicas if the node restarts.
+type BlockingShard struct {
+	ShardID uint32 `json:"shard_id"`
+	// UnavailableNodes are the other nodes hosting the shard which are restarting or dead.
+	UnavailableNodes []string `json:"unavailable_nodes"`
+}
+
+// RestartDecision tells whether the node is allowed to restart. The token is granted if so, otherwise the blocking
+// shards explain why.
+type RestartDecision struct {
+	Granted        bool            `json:"granted"`
+	Token          string          `json:"token,omitempty"`
+	ExpireAt       time.Time       `json:"expire_at"`
+	BlockingShards []BlockingShard `json:"blocking_shards,omitempty"`
+}
+
+// AcquireRestartToken grants the node a token to restart if every shard hosted by the node still keeps enough
+// replicas, that is to say, at most max(1, replicationFactor-1) replicas of a shard are unavailable at the same time,
+// where the nodes holding the restart tokens and the dead nodes are unavailable. The token expires after the ttl
+// unless it is released. The default ttl is used if ttl is not positive, and the ttl is capped at maxRestartTokenTTL.
+// The current token is returned if the node has acquired one.
+func (c *Cluster) AcquireRestartToken(nodeName string, ttl time.Duration) (*RestartDecision, error) {
+	if ttl <= 0 {
+		ttl = defaultRestartTokenTTL
+	} else if ttl > maxRestartTokenTTL {
+		ttl = maxRestartTokenTTL
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	node, ok := c.nodesCache[nodeName]
+	if !ok {
+		return nil, ErrNodeNotFound.WithCausef("node:%s", nodeName)
+	}
+	for name, token := range c.restartTokens {
+		if !now.Before(token.expireAt) {
+			log.Warn("restart token expires", zap.String("cluster", c.metaData.GetName()), zap.String("node", name))
+			delete(c.restartTokens, name)
+		}
+	}
+	if token, ok := c.restartTokens[nodeName]; ok {
+		return &RestartDecision{Granted: true, Token: token.token, ExpireAt: token.expireAt}, nil
+	}
+
+	if blockingShards := c.checkRestartLocked(node, now); len(blockingShards) > 0 {
+		return &RestartDecision{BlockingShards: blockingShards}, nil
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return nil, ErrAcquireRestartToken.WithCausef("generate token, err:%v", err)
+	}
+	restart := &restartToken{token: token, expireAt: now.Add(ttl)}
+	c.restartTokens[nodeName] = restart
+
+	log.Info("grant restart token", zap.String("cluster", c.metaData.GetName()), zap.String("node", nodeName),
+		zap.Duration("ttl", ttl))
+	return &RestartDecision{Granted: true, Token: restart.token, ExpireAt: restart.expireAt}, nil
+}
+
+// ReleaseRestartToken releases the restart token of the node, and the node must be alive again.
+func (c *Cluster) ReleaseRestartToken(nodeName, token string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	restart, ok := c.restartTokens[nodeName]
+	if !ok || restart.token != token {
+		return ErrRestartTokenNotFound.WithCausef("node:%s, token:%s", nodeName, token)
+	}
+	if node, ok := c.nodesCache[nodeName]; !ok || !node.IsAlive(time.Now()) {
+		return ErrNodeNotAlive.WithCausef("node:%s", nodeName)
+	}
+
+	delete(c.restartTokens, nodeName)
+	log.Info("release restart token", zap.String("cluster", c.metaData.GetName()), zap.String("node", nodeName))
+	return nil
+}
+
+// checkRestartLocked returns the shards hosted by the node which would lose too many replicas if the node restarts.
+func (c *Cluster) checkRestartLocked(node *Node, now time.Time) []BlockingShard {
+	maxUnavailable := int(c.metaData.GetReplicationFactor()) - 1
+	if maxUnavailable < 1 {
+		maxUnavailable = 1
+	}
+
+	// shardID -> the other nodes hosting the shard which are unavailable
+	unavailableNodes := make(map[uint32][]string)
+	for _, shardInfo := range node.info.GetShardsInfo() {
+		unavailableNodes[shardInfo.GetShardId()] = nil
+	}
+	for name, other := range c.nodesCache {
+		if name == node.GetName() {
+			continue
+		}
+		if _, restarting := c.restartTokens[name]; !restarting && other.IsAlive(now) {
+			continue
+		}
+		for _, shardInfo := range other.info.GetShardsInfo() {
+			if nodes, ok := unavailableNodes[shardInfo.GetShardId()]; ok {
+				unavailableNodes[shardInfo.GetShardId()] = append(nodes, name)
+			}
+		}
+	}
+
+	blockingShards := make([]BlockingShard, 0)
+	for shardID, nodes := range unavailableNodes {
+		// The node itself becomes unavailable too.
+		if len(nodes)+1 > maxUnavailable {
+			sort.Strings(nodes)
+			blockingShards = append(blockingShards, BlockingShard{ShardID: shardID, UnavailableNodes: nodes})
+		}
+	}
+	sort.Slice(blockingShards, func(i, j int) bool { return blockingShards[i].ShardID < blockingShards[j].ShardID })
+	return blockingShards
+}
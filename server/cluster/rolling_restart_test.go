@@ -0,0 +1,88 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingRestart(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 4, 2, testShardTotal)
+	re.NoError(err)
+
+	// Node a and b share the shards 0~3, and node c and d share the shards 4~7.
+	nodeInfo := func(node string, role metapb.ShardRole, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: role})
+		}
+		return info
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", metapb.ShardRole_LEADER, 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("b", metapb.ShardRole_FOLLOWER, 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("c", metapb.ShardRole_LEADER, 4, 5, 6, 7)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("d", metapb.ShardRole_FOLLOWER, 4, 5, 6, 7)))
+
+	_, err = manager.AcquireRestartToken(ctx, testClusterName, "unknown", 0)
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	decisionA, err := manager.AcquireRestartToken(ctx, testClusterName, "a", time.Minute)
+	re.NoError(err)
+	re.True(decisionA.Granted)
+	re.NotEmpty(decisionA.Token)
+	// Acquiring again returns the same token.
+	decision, err := manager.AcquireRestartToken(ctx, testClusterName, "a", time.Minute)
+	re.NoError(err)
+	re.Equal(decisionA.Token, decision.Token)
+
+	// Node b shares the replicas with the restarting node a.
+	decision, err = manager.AcquireRestartToken(ctx, testClusterName, "b", time.Minute)
+	re.NoError(err)
+	re.False(decision.Granted)
+	re.Empty(decision.Token)
+	re.Equal([]BlockingShard{
+		{ShardID: 0, UnavailableNodes: []string{"a"}},
+		{ShardID: 1, UnavailableNodes: []string{"a"}},
+		{ShardID: 2, UnavailableNodes: []string{"a"}},
+		{ShardID: 3, UnavailableNodes: []string{"a"}},
+	}, decision.BlockingShards)
+
+	// Node c shares no replica with node a.
+	decisionC, err := manager.AcquireRestartToken(ctx, testClusterName, "c", time.Minute)
+	re.NoError(err)
+	re.True(decisionC.Granted)
+
+	// The token can only be released by its owner after the node is alive again.
+	re.True(coderr.Is(manager.ReleaseRestartToken(ctx, testClusterName, "a", decisionC.Token), coderr.NotFound))
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	re.True(coderr.Is(manager.ReleaseRestartToken(ctx, testClusterName, "a", decisionA.Token), coderr.ServiceUnavailable))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", metapb.ShardRole_LEADER, 0, 1, 2, 3)))
+	re.NoError(manager.ReleaseRestartToken(ctx, testClusterName, "a", decisionA.Token))
+
+	decision, err = manager.AcquireRestartToken(ctx, testClusterName, "b", time.Millisecond)
+	re.NoError(err)
+	re.True(decision.Granted)
+
+	// The token of node b expires, and node a can restart then.
+	time.Sleep(time.Millisecond * 10)
+	decision, err = manager.AcquireRestartToken(ctx, testClusterName, "a", time.Minute)
+	re.NoError(err)
+	re.True(decision.Granted)
+	re.True(coderr.Is(manager.ReleaseRestartToken(ctx, testClusterName, "b", decision.Token), coderr.NotFound))
+}
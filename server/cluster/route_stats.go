@@ -0,0 +1,331 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// defaultRouteSampleRate means one in the rate route lookups is counted, and the hits are estimated by scaling the
+// sampled count up by the rate.
+const defaultRouteSampleRate = 16
+
+// tableRouteStat has fixed size, and its fields are accessed atomically so that recording a route lookup allocates
+// nothing once the table is tracked.
+type tableRouteStat struct {
+	sampledHits uint64
+	// lastRoutedAt is the unix nanoseconds of the latest route lookup, and zero if never routed since the trackedSince.
+	lastRoutedAt int64
+	// trackedSince is the unix nanoseconds since when the route lookups are tracked, which is immutable.
+	trackedSince int64
+	// dirty is 1 if the stat has changed since it was persisted.
+	dirty uint32
+}
+
+// persistedTableRouteStat is the encoding of the route statistics of a table in the storage.
+type persistedTableRouteStat struct {
+	SampledHits  uint64 `json:"sampled_hits"`
+	LastRoutedAt int64  `json:"last_routed_at"`
+	TrackedSince int64  `json:"tracked_since"`
+}
+
+// tableRouteStats keeps an entry for each routed table, so the memory grows linearly with the tables routed and is
+// bounded by the number of the tables.
+type tableRouteStats struct {
+	sampleRate uint64
+	// seed is advanced atomically to generate the random numbers for the sampling.
+	seed uint64
+
+	// mu protects the following fields, while the fields of the entries are accessed atomically.
+	mu    sync.RWMutex
+	stats map[uint64]*tableRouteStat
+	// since is the time since when the tables without an entry are tracked.
+	since time.Time
+}
+
+func newTableRouteStats(sampleRate uint64) *tableRouteStats {
+	return &tableRouteStats{
+		sampleRate: sampleRate,
+		seed:       uint64(time.Now().UnixNano()),
+		stats:      make(map[uint64]*tableRouteStat),
+		since:      time.Now(),
+	}
+}
+
+// sampled tells whether a route lookup should be counted with the splitmix64 generator.
+func (s *tableRouteStats) sampled() bool {
+	z := atomic.AddUint64(&s.seed, 0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z%s.sampleRate == 0
+}
+
+func (s *tableRouteStats) record(tableID uint64, now time.Time) {
+	s.mu.RLock()
+	stat, ok := s.stats[tableID]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if stat, ok = s.stats[tableID]; !ok {
+			stat = &tableRouteStat{trackedSince: s.since.UnixNano()}
+			s.stats[tableID] = stat
+		}
+		s.mu.Unlock()
+	}
+
+	if s.sampled() {
+		atomic.AddUint64(&stat.sampledHits, 1)
+	}
+	atomic.StoreInt64(&stat.lastRoutedAt, now.UnixNano())
+	atomic.StoreUint32(&stat.dirty, 1)
+}
+
+func (s *tableRouteStats) get(tableID uint64) TableRouteStats {
+	s.mu.RLock()
+	stat, ok := s.stats[tableID]
+	since := s.since
+	s.mu.RUnlock()
+	if !ok {
+		return TableRouteStats{TrackedSince: since}
+	}
+
+	stats := TableRouteStats{
+		Hits:         atomic.LoadUint64(&stat.sampledHits) * s.sampleRate,
+		TrackedSince: time.Unix(0, stat.trackedSince),
+	}
+	if lastRoutedAt := atomic.LoadInt64(&stat.lastRoutedAt); lastRoutedAt != 0 {
+		stats.LastRoutedAt = time.Unix(0, lastRoutedAt)
+	}
+	return stats
+}
+
+func (s *tableRouteStats) remove(tableID uint64) {
+	s.mu.Lock()
+	delete(s.stats, tableID)
+	s.mu.Unlock()
+}
+
+// reset forgets all the route lookups, and the tables are tracked since now.
+func (s *tableRouteStats) reset(now time.Time) {
+	s.mu.Lock()
+	s.stats = make(map[uint64]*tableRouteStat)
+	s.since = now
+	s.mu.Unlock()
+}
+
+// load replaces the entries with the persisted ones of the tables, and the other tables are tracked since the since.
+func (s *tableRouteStats) load(persisted map[uint64]persistedTableRouteStat, since time.Time) {
+	stats := make(map[uint64]*tableRouteStat, len(persisted))
+	for tableID, stat := range persisted {
+		stats[tableID] = &tableRouteStat{
+			sampledHits:  stat.SampledHits,
+			lastRoutedAt: stat.LastRoutedAt,
+			trackedSince: stat.TrackedSince,
+		}
+	}
+
+	s.mu.Lock()
+	s.stats = stats
+	s.since = since
+	s.mu.Unlock()
+}
+
+// takeDirty returns the stats changed since they were persisted and marks them clean.
+func (s *tableRouteStats) takeDirty() ([]uint64, []persistedTableRouteStat) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tableIDs := make([]uint64, 0)
+	stats := make([]persistedTableRouteStat, 0)
+	for tableID, stat := range s.stats {
+		if !atomic.CompareAndSwapUint32(&stat.dirty, 1, 0) {
+			continue
+		}
+		tableIDs = append(tableIDs, tableID)
+		stats = append(stats, persistedTableRouteStat{
+			SampledHits:  atomic.LoadUint64(&stat.sampledHits),
+			LastRoutedAt: atomic.LoadInt64(&stat.lastRoutedAt),
+			TrackedSince: stat.trackedSince,
+		})
+	}
+	return tableIDs, stats
+}
+
+// markDirty marks the stats dirty again after they fail to be persisted.
+func (s *tableRouteStats) markDirty(tableIDs []uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, tableID := range tableIDs {
+		if stat, ok := s.stats[tableID]; ok {
+			atomic.StoreUint32(&stat.dirty, 1)
+		}
+	}
+}
+
+// TableRouteStats are the route lookups of a table since TrackedSince.
+type TableRouteStats struct {
+	// Hits is estimated from the sampled route lookups.
+	Hits uint64
+	// LastRoutedAt is zero if the table has not been routed since TrackedSince.
+	LastRoutedAt time.Time
+	// TrackedSince is when the meta server started tracking the route lookups of the table, and it is reset if the
+	// cluster is restored from a snapshot.
+	TrackedSince time.Time
+}
+
+// States of the listed tables.
+const (
+	TableStateCreated  = "created"
+	TableStateReserved = "reserved"
+)
+
+// TableListing is a table with its route statistics, or a reserved table name whose Table is nil.
+type TableListing struct {
+	Name       string
+	State      string
+	Table      *Table
+	RouteStats TableRouteStats
+	// Reservation is only set for the reserved table names.
+	Reservation *TableNameReservation
+}
+
+// ListTablesOptions filters the tables listed.
+type ListTablesOptions struct {
+	// NeverRoutedSince keeps only the tables not routed since the time if it is not zero, and the tables whose route
+	// lookups are tracked later than the time are excluded because the lookups before the tracking are unknown.
+	NeverRoutedSince time.Time
+}
+
+// ListTables lists the tables of the schema with their route statistics ordered by the table id, and the tables being
+// dropped are excluded. The reserved table names follow the tables in the order of the names unless the tables are
+// filtered by the route statistics.
+func (c *Cluster) ListTables(schemaName string, opts ListTablesOptions) ([]*TableListing, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+
+	listings := make([]*TableListing, 0, len(schema.tableMap))
+	for _, table := range schema.tableMap {
+		if _, ok := c.dropTasks[table.GetID()]; ok {
+			continue
+		}
+		stats := c.routeStats.get(table.GetID())
+		if !opts.NeverRoutedSince.IsZero() {
+			if stats.TrackedSince.After(opts.NeverRoutedSince) || !stats.LastRoutedAt.Before(opts.NeverRoutedSince) {
+				continue
+			}
+		}
+		listings = append(listings, &TableListing{Name: table.GetName(), State: TableStateCreated, Table: table, RouteStats: stats})
+	}
+	sort.Slice(listings, func(i, j int) bool { return listings[i].Table.GetID() < listings[j].Table.GetID() })
+	if !opts.NeverRoutedSince.IsZero() {
+		return listings, nil
+	}
+
+	reservations := c.listTableReservationsLocked(schemaName)
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].TableName < reservations[j].TableName })
+	for _, reservation := range reservations {
+		listings = append(listings, &TableListing{Name: reservation.TableName, State: TableStateReserved, Reservation: reservation})
+	}
+	return listings, nil
+}
+
+// PersistTableRouteStats persists the route statistics changed since the last persistence, so that they survive the
+// failover of the meta server with the changes within an interval lost at most.
+func (c *Cluster) PersistTableRouteStats(ctx context.Context) error {
+	tableIDs, stats := c.routeStats.takeDirty()
+	if len(tableIDs) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(stats))
+	for i, stat := range stats {
+		value, err := json.Marshal(stat)
+		if err != nil {
+			c.routeStats.markDirty(tableIDs)
+			return ErrEncodeTableRouteStats.WithCausef("table:%d, err:%v", tableIDs[i], err)
+		}
+		values = append(values, string(value))
+	}
+	if err := c.storage.PutTableRouteStats(ctx, c.clusterID, tableIDs, values); err != nil {
+		c.routeStats.markDirty(tableIDs)
+		return errors.Wrapf(err, "put table route stats, tables:%d", len(tableIDs))
+	}
+	return nil
+}
+
+// loadTableRouteStats loads the persisted route statistics of the tables in the schemas and the time since when the
+// route lookups are tracked, which is initialized as now at the first loading.
+func (c *Cluster) loadTableRouteStats(ctx context.Context, schemas map[string]*Schema) (map[uint64]persistedTableRouteStat, time.Time, error) {
+	sinceValue, err := c.storage.GetTableRouteStatsSince(ctx, c.clusterID)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "load table route stats since")
+	}
+	since := time.Now()
+	if sinceValue == "" {
+		if err := c.storage.PutTableRouteStatsSince(ctx, c.clusterID, strconv.FormatInt(since.UnixNano(), 10)); err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "put table route stats since")
+		}
+	} else {
+		nanos, err := strconv.ParseInt(sinceValue, 10, 64)
+		if err != nil {
+			return nil, time.Time{}, ErrDecodeTableRouteStats.WithCausef("since:%s, err:%v", sinceValue, err)
+		}
+		since = time.Unix(0, nanos)
+	}
+
+	values, err := c.storage.ListTableRouteStats(ctx, c.clusterID)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "load table route stats")
+	}
+
+	tableIDs := make(map[uint64]struct{})
+	for _, schema := range schemas {
+		for _, table := range schema.tableMap {
+			tableIDs[table.GetID()] = struct{}{}
+		}
+	}
+
+	persisted := make(map[uint64]persistedTableRouteStat, len(values))
+	for tableID, value := range values {
+		// The stats persisted concurrently with dropping the table are left behind and ignored.
+		if _, ok := tableIDs[tableID]; !ok {
+			continue
+		}
+		stat := persistedTableRouteStat{}
+		if err := json.Unmarshal([]byte(value), &stat); err != nil {
+			return nil, time.Time{}, ErrDecodeTableRouteStats.WithCausef("table:%d, err:%v", tableID, err)
+		}
+		persisted[tableID] = stat
+	}
+	return persisted, since, nil
+}
+
+// resetTableRouteStatsLocked forgets the route statistics of all the tables, because the tables restored from a
+// snapshot may have been routed since the snapshot was taken.
+func (c *Cluster) resetTableRouteStatsLocked(ctx context.Context) {
+	now := time.Now()
+	c.routeStats.reset(now)
+	if err := c.storage.PutTableRouteStatsSince(ctx, c.clusterID, strconv.FormatInt(now.UnixNano(), 10)); err != nil {
+		log.Warn("fail to put table route stats since", zap.String("cluster", c.metaData.GetName()), zap.Error(err))
+	}
+	if err := c.storage.DeleteTableRouteStats(ctx, c.clusterID); err != nil {
+		log.Warn("fail to delete table route stats", zap.String("cluster", c.metaData.GetName()), zap.Error(err))
+	}
+}
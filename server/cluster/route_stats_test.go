@@ -0,0 +1,111 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableRouteStatsSampling(t *testing.T) {
+	re := require.New(t)
+
+	stats := newTableRouteStats(defaultRouteSampleRate)
+	now := time.Now()
+	for i := 0; i < 100000; i++ {
+		stats.record(1, now)
+	}
+	for i := 0; i < 10000; i++ {
+		stats.record(2, now)
+	}
+	re.InDelta(100000, stats.get(1).Hits, 100000*0.05)
+	re.InDelta(10000, stats.get(2).Hits, 10000*0.15)
+	re.Equal(now.UnixNano(), stats.get(1).LastRoutedAt.UnixNano())
+	re.True(stats.get(3).LastRoutedAt.IsZero())
+
+	// Recording the route lookups of a tracked table allocates nothing.
+	allocs := testing.AllocsPerRun(1000, func() {
+		stats.record(1, now)
+	})
+	re.Zero(allocs)
+}
+
+func TestTableRouteStats(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	routed, err := manager.AllocTableID(ctx, testClusterName, "public", "routed")
+	re.NoError(err)
+	idle, err := manager.AllocTableID(ctx, testClusterName, "public", "idle")
+	re.NoError(err)
+	checkpoint := time.Now()
+	for i := 0; i < 1000; i++ {
+		_, err = manager.AllocTableID(ctx, testClusterName, "public", "routed")
+		re.NoError(err)
+	}
+
+	listings, err := manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Len(listings, 2)
+	re.Equal(routed.GetID(), listings[0].Table.GetID())
+	re.False(listings[0].RouteStats.LastRoutedAt.IsZero())
+	re.True(listings[1].RouteStats.LastRoutedAt.IsZero())
+	routedStats := listings[0].RouteStats
+
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{NeverRoutedSince: checkpoint})
+	re.NoError(err)
+	re.Len(listings, 1)
+	re.Equal(idle.GetID(), listings[0].Table.GetID())
+
+	// The persisted stats survive the failover.
+	re.NoError(cluster.PersistTableRouteStats(ctx))
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Len(listings, 2)
+	re.Equal(routedStats, listings[0].RouteStats)
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{NeverRoutedSince: checkpoint})
+	re.NoError(err)
+	re.Len(listings, 1)
+	re.Equal(idle.GetID(), listings[0].Table.GetID())
+
+	// The stats are reset after the cluster is restored from a snapshot.
+	cluster, err = manager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	var buf bytes.Buffer
+	re.NoError(cluster.ExportSnapshot(ctx, &buf))
+	re.NoError(cluster.RestoreSnapshot(ctx, &buf))
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Zero(listings[0].RouteStats.Hits)
+	re.True(listings[0].RouteStats.TrackedSince.After(checkpoint))
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{NeverRoutedSince: checkpoint})
+	re.NoError(err)
+	re.Empty(listings)
+	stats, err := s.ListTableRouteStats(ctx, cluster.GetClusterID())
+	re.NoError(err)
+	re.Empty(stats)
+
+	// The stats of a dropped table are deleted.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "routed")
+	re.NoError(err)
+	re.NoError(cluster.PersistTableRouteStats(ctx))
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "routed", false))
+	stats, err = s.ListTableRouteStats(ctx, cluster.GetClusterID())
+	re.NoError(err)
+	re.Empty(stats)
+}
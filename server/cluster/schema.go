@@ -0,0 +1,67 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import "github.com/CeresDB/ceresdbproto/pkg/metapb"
+
+type Schema struct {
+	meta *metapb.Schema
+
+	// shardCountHint is the number of shards expected to be used by the schema, and zero means all the shards of the
+	// cluster.
+	shardCountHint uint32
+	// shardIDs is the effective shard set of the schema, that is to say, the tables of the schema are only placed on
+	// these shards.
+	shardIDs []uint32
+	// tableName -> table
+	tableMap map[string]*Table
+}
+
+func newSchema(meta *metapb.Schema, shardCountHint, shardTotal uint32) *Schema {
+	return &Schema{
+		meta:           meta,
+		shardCountHint: shardCountHint,
+		shardIDs:       selectSchemaShards(meta.GetId(), shardCountHint, shardTotal),
+		tableMap:       make(map[string]*Table),
+	}
+}
+
+func (s *Schema) GetID() uint32 {
+	return s.meta.GetId()
+}
+
+func (s *Schema) GetName() string {
+	return s.meta.GetName()
+}
+
+func (s *Schema) GetShardCountHint() uint32 {
+	return s.shardCountHint
+}
+
+// GetShardIDs returns the effective shard set of the schema.
+func (s *Schema) GetShardIDs() []uint32 {
+	shardIDs := make([]uint32, len(s.shardIDs))
+	copy(shardIDs, s.shardIDs)
+	return shardIDs
+}
+
+func (s *Schema) getTable(tableName string) (*Table, bool) {
+	table, ok := s.tableMap[tableName]
+	return table, ok
+}
+
+// selectSchemaShards selects the effective shard set for the schema according to the shard count hint.
+// The shards are chosen as a contiguous (wrapped) range starting from the position decided by the schema id, so that
+// the small schemas are spread over the whole cluster rather than all crowded on the first few shards.
+func selectSchemaShards(schemaID, shardCountHint, shardTotal uint32) []uint32 {
+	count := shardCountHint
+	if count == 0 || count > shardTotal {
+		count = shardTotal
+	}
+
+	shardIDs := make([]uint32, 0, count)
+	for i := uint32(0); i < count; i++ {
+		shardIDs = append(shardIDs, (schemaID+i)%shardTotal)
+	}
+	return shardIDs
+}
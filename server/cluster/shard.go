@@ -0,0 +1,109 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+)
+
+type Shard struct {
+	id       uint32
+	topology *metapb.ShardTopology
+	// node is the name of the node owning the shard reported by the heartbeats, and empty if unknown.
+	node string
+	// unassignedSince is the time when the shard lost its owner.
+	unassignedSince time.Time
+	// lastOwnerChange is immutable once set, and nil if the owner has never changed.
+	lastOwnerChange *ShardOwnerChange
+}
+
+func newShard(id uint32, topology *metapb.ShardTopology) *Shard {
+	if topology == nil {
+		topology = &metapb.ShardTopology{}
+	}
+	return &Shard{
+		id:              id,
+		topology:        topology,
+		unassignedSince: time.Now(),
+	}
+}
+
+func (s *Shard) GetID() uint32 {
+	return s.id
+}
+
+func (s *Shard) GetVersion() uint64 {
+	return s.topology.GetVersion()
+}
+
+func (s *Shard) GetNode() string {
+	return s.node
+}
+
+func (s *Shard) GetTableCount() int {
+	return len(s.topology.GetTableIds())
+}
+
+// withTable returns a new topology of the shard with the table added, and the version is bumped by the increment.
+func (s *Shard) withTable(tableID uint64, increment uint64) *metapb.ShardTopology {
+	tableIDs := make([]uint64, 0, len(s.topology.GetTableIds())+1)
+	tableIDs = append(tableIDs, s.topology.GetTableIds()...)
+	tableIDs = append(tableIDs, tableID)
+	return s.newTopology(tableIDs, increment)
+}
+
+// withoutTable returns a new topology of the shard with the table removed, and the version is bumped by the increment.
+func (s *Shard) withoutTable(tableID uint64, increment uint64) *metapb.ShardTopology {
+	tableIDs := make([]uint64, 0, len(s.topology.GetTableIds()))
+	for _, id := range s.topology.GetTableIds() {
+		if id != tableID {
+			tableIDs = append(tableIDs, id)
+		}
+	}
+	return s.newTopology(tableIDs, increment)
+}
+
+// withoutTables returns a new topology of the shard without the tables and the version bumped by the increment.
+func (s *Shard) withoutTables(tableIDs []uint64, increment uint64) *metapb.ShardTopology {
+	removed := make(map[uint64]struct{}, len(tableIDs))
+	for _, id := range tableIDs {
+		removed[id] = struct{}{}
+	}
+	remained := make([]uint64, 0, len(s.topology.GetTableIds()))
+	for _, id := range s.topology.GetTableIds() {
+		if _, ok := removed[id]; !ok {
+			remained = append(remained, id)
+		}
+	}
+	return s.newTopology(remained, increment)
+}
+
+// withVersionBumped returns a new topology of the shard with the same tables and the version bumped by the increment.
+func (s *Shard) withVersionBumped(increment uint64) *metapb.ShardTopology {
+	return s.newTopology(s.topology.GetTableIds(), increment)
+}
+
+// newTopology returns a new topology of the shard with the tables and the version bumped by the increment. The unknown
+// fields of the current topology, e.g. the ones written by a newer ceresmeta during a rolling upgrade, are carried over
+// so that they are not lost by the rewrite.
+func (s *Shard) newTopology(tableIDs []uint64, increment uint64) *metapb.ShardTopology {
+	topology := &metapb.ShardTopology{
+		TableIds: tableIDs,
+		Version:  s.topology.GetVersion() + increment,
+	}
+	if unknown := s.topology.ProtoReflect().GetUnknown(); len(unknown) > 0 {
+		topology.ProtoReflect().SetUnknown(unknown)
+	}
+	return topology
+}
+
+func (s *Shard) hasTable(tableID uint64) bool {
+	for _, id := range s.topology.GetTableIds() {
+		if id == tableID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ShardAssignment assigns the shard to the node.
+type ShardAssignment struct {
+	ShardID uint32
+	Node    string
+}
+
+// ListUnassignedShards lists the shards which have been owned by no node for at least minDuration in ascending order,
+// and the gauge of the unassigned shards is updated.
+func (c *Cluster) ListUnassignedShards(minDuration time.Duration) []uint32 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.listUnassignedShardsLocked(time.Now(), minDuration)
+}
+
+func (c *Cluster) listUnassignedShardsLocked(now time.Time, minDuration time.Duration) []uint32 {
+	total := 0
+	shardIDs := make([]uint32, 0)
+	for _, shard := range c.shardsCache {
+		if shard.node != "" {
+			continue
+		}
+		total++
+		if now.Sub(shard.unassignedSince) >= minDuration {
+			shardIDs = append(shardIDs, shard.GetID())
+		}
+	}
+	unassignedShardsGauge.WithLabelValues(c.metaData.GetName()).Set(float64(total))
+
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+	return shardIDs
+}
+
+// AssignShard assigns the unassigned shard to the alive node, and the assignment is confirmed by the following
+// heartbeats of the node.
+func (c *Cluster) AssignShard(ctx context.Context, shardID uint32, nodeName string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.assignShardLocked(ctx, shardID, nodeName, ShardOwnerManualAssign, "")
+}
+
+// assignShardLocked persists the ownership change before applying it, so that the reason of the change is never lost.
+func (c *Cluster) assignShardLocked(ctx context.Context, shardID uint32, nodeName string, reason ShardOwnerChangeReason,
+	procedureID string,
+) error {
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		return ErrShardNotFound.WithCausef("shard:%d", shardID)
+	}
+	if shard.node != "" {
+		return ErrShardAlreadyAssigned.WithCausef("shard:%d, node:%s", shardID, shard.node)
+	}
+	node, ok := c.nodesCache[nodeName]
+	if !ok {
+		return ErrNodeNotFound.WithCausef("node:%s", nodeName)
+	}
+	if !node.IsAlive(time.Now()) {
+		return ErrNodeNotAlive.WithCausef("node:%s, last touch time:%s", nodeName, node.lastTouchTime)
+	}
+	if err := c.checkNodeShardCapacityLocked(nodeName); err != nil {
+		return err
+	}
+
+	change := newShardOwnerChange(shard, nodeName, reason, procedureID)
+	if err := c.persistShardOwnerChangesLocked(ctx, []*ShardOwnerChange{change}); err != nil {
+		return err
+	}
+	c.applyShardOwnerChangeLocked(shard, change)
+	c.syncStateLocked(ctx, "assign shard")
+	log.Info("assign shard", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID),
+		zap.String("node", nodeName), zap.String("reason", string(reason)), zap.String("procedure", procedureID))
+	return nil
+}
+
+// AutoAssignShards assigns the shards unassigned for at least minDuration to the lightest alive nodes with room in
+// proportion to their shard capacities, except the shards waiting for their initial owners, and the shards beyond the
+// capacities are left unassigned. Nothing is assigned in the maintenance mode.
+// Every run is identified by a random procedure id recorded in the ownership changes of the assigned shards.
+func (c *Cluster) AutoAssignShards(ctx context.Context, minDuration time.Duration) ([]ShardAssignment, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.status.Maintenance {
+		return nil, nil
+	}
+
+	now := time.Now()
+	shardIDs := make([]uint32, 0)
+	for _, shardID := range c.listUnassignedShardsLocked(now, minDuration) {
+		// The shards waiting for their initial owners are assigned by the ApplyInitialShardAssignment.
+		if !c.waitsForInitialOwnerLocked(c.shardsCache[shardID]) {
+			shardIDs = append(shardIDs, shardID)
+		}
+	}
+	if len(shardIDs) == 0 {
+		return nil, nil
+	}
+
+	// Only the shards owned by the alive nodes and the ones to assign are considered by the planner.
+	snapshot := &schedule.TopologySnapshot{Shards: make(map[uint32]string), AffinityGroups: c.shardAffinityGroupsLocked()}
+	for name, node := range c.nodesCache {
+		if node.IsAlive(now) {
+			snapshot.Nodes = append(snapshot.Nodes, name)
+		}
+	}
+	sort.Strings(snapshot.Nodes)
+	snapshot.Capacities = c.plannerCapacitiesLocked(snapshot.Nodes)
+	for _, shard := range c.shardsCache {
+		if node, ok := c.nodesCache[shard.node]; ok && node.IsAlive(now) {
+			snapshot.Shards[shard.GetID()] = shard.node
+		}
+	}
+	for _, shardID := range shardIDs {
+		snapshot.Shards[shardID] = ""
+	}
+
+	plan, err := schedule.ScatterPlanner{}.Plan(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Unplaced) > 0 {
+		log.Warn("insufficient shard capacity to assign shards", zap.String("cluster", c.metaData.GetName()),
+			zap.Uint32s("shards", plan.Unplaced))
+	}
+	procedureID, err := newRandomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate auto assignment procedure id")
+	}
+	assignments := make([]ShardAssignment, 0, len(plan.Moves))
+	for _, move := range plan.Moves {
+		if err := c.assignShardLocked(ctx, move.ShardID, move.To, ShardOwnerAutoAssign, procedureID); err != nil {
+			return assignments, err
+		}
+		assignments = append(assignments, ShardAssignment{ShardID: move.ShardID, Node: move.To})
+	}
+	c.listUnassignedShardsLocked(now, minDuration)
+	return assignments, nil
+}
+
+// shardRouteActivity is the route lookups of the tables of a shard since a time.
+type shardRouteActivity struct {
+	shardID uint32
+	// routedTables is the number of the tables routed since the time.
+	routedTables int
+	lastRoutedAt time.Time
+}
+
+// OrderShardsByRoutes orders the shards to be opened so that the shards with more tables routed since the time come
+// first, which brings the tables in use back earlier. The ties are broken by the latest route lookup of their tables and
+// then by the shard id, and the unknown shards come last.
+func (c *Cluster) OrderShardsByRoutes(shardIDs []uint32, since time.Time) []uint32 {
+	c.lock.RLock()
+	activities := make([]shardRouteActivity, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		activity := shardRouteActivity{shardID: shardID, routedTables: -1}
+		if shard, ok := c.shardsCache[shardID]; ok {
+			activity.routedTables = 0
+			for _, tableID := range shard.topology.GetTableIds() {
+				stats := c.routeStats.get(tableID)
+				if !stats.LastRoutedAt.Before(since) {
+					activity.routedTables++
+				}
+				if stats.LastRoutedAt.After(activity.lastRoutedAt) {
+					activity.lastRoutedAt = stats.LastRoutedAt
+				}
+			}
+		}
+		activities = append(activities, activity)
+	}
+	c.lock.RUnlock()
+
+	sort.Slice(activities, func(i, j int) bool {
+		if activities[i].routedTables != activities[j].routedTables {
+			return activities[i].routedTables > activities[j].routedTables
+		}
+		if !activities[i].lastRoutedAt.Equal(activities[j].lastRoutedAt) {
+			return activities[i].lastRoutedAt.After(activities[j].lastRoutedAt)
+		}
+		return activities[i].shardID < activities[j].shardID
+	})
+	ordered := make([]uint32, 0, len(activities))
+	for _, activity := range activities {
+		ordered = append(ordered, activity.shardID)
+	}
+	return ordered
+}
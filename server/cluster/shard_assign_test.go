@@ -0,0 +1,96 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignShards(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < 4; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+
+	shardIDs, err := manager.ListUnassignedShards(ctx, testClusterName)
+	re.NoError(err)
+	re.Equal([]uint32{4, 5, 6, 7}, shardIDs)
+	re.Equal(float64(4), testutil.ToFloat64(unassignedShardsGauge.WithLabelValues(testClusterName)))
+
+	re.True(coderr.Is(manager.AssignShard(ctx, testClusterName, 4, "unknown"), coderr.NotFound))
+	re.NoError(manager.AssignShard(ctx, testClusterName, 4, "a"))
+	re.True(coderr.Is(manager.AssignShard(ctx, testClusterName, 4, "b"), coderr.InvalidParams))
+
+	// The recently unassigned shards are not assigned automatically.
+	assignments, err := cluster.AutoAssignShards(ctx, time.Hour)
+	re.NoError(err)
+	re.Empty(assignments)
+
+	assignments, err = cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	re.Equal([]ShardAssignment{{ShardID: 5, Node: "b"}, {ShardID: 6, Node: "b"}, {ShardID: 7, Node: "b"}}, assignments)
+	shardIDs, err = manager.ListUnassignedShards(ctx, testClusterName)
+	re.NoError(err)
+	re.Empty(shardIDs)
+	re.Equal(float64(0), testutil.ToFloat64(unassignedShardsGauge.WithLabelValues(testClusterName)))
+}
+
+func TestOrderShardsByRoutes(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	recent, err := manager.AllocTableID(ctx, testClusterName, "public", "recent")
+	re.NoError(err)
+	stale, err := manager.AllocTableID(ctx, testClusterName, "public", "stale")
+	re.NoError(err)
+	re.NotEqual(recent.GetShardID(), stale.GetShardID())
+
+	now := time.Now()
+	cluster.routeStats.reset(now.Add(-3 * time.Hour))
+	cluster.routeStats.record(recent.GetID(), now)
+	cluster.routeStats.record(stale.GetID(), now.Add(-2*time.Hour))
+
+	// The shard with the table routed lately comes first, followed by the shard with the table routed before the time,
+	// the never routed shards and at last the unknown shard.
+	shardIDs := []uint32{100}
+	for shardID := uint32(0); shardID < testShardTotal; shardID++ {
+		shardIDs = append(shardIDs, shardID)
+	}
+	expected := []uint32{recent.GetShardID(), stale.GetShardID()}
+	for shardID := uint32(0); shardID < testShardTotal; shardID++ {
+		if shardID != recent.GetShardID() && shardID != stale.GetShardID() {
+			expected = append(expected, shardID)
+		}
+	}
+	expected = append(expected, 100)
+	re.Equal(expected, cluster.OrderShardsByRoutes(shardIDs, now.Add(-time.Hour)))
+}
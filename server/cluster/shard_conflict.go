@@ -0,0 +1,98 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// shardConflictClose means the reporter is told to close the shard.
+	shardConflictClose = "close"
+	// shardConflictAmbiguous means the conflict is left to the operator because the owner is ambiguous.
+	shardConflictAmbiguous = "ambiguous"
+)
+
+// AmbiguousShardOwner is a shard whose persisted last owner change names a node other than its current owner, and the
+// node named by the record reports the shard too, so neither of them can be told to close it. It is found by the
+// heartbeats and listed by the table set verification until the owner of the shard changes.
+type AmbiguousShardOwner struct {
+	ShardID uint32
+	// Owner is the current owner of the shard, and PersistedOwner is the one named by the persisted last owner change,
+	// which reports the shard as well.
+	Owner          string
+	PersistedOwner string
+	DetectedAt     time.Time
+}
+
+// shardClaim is the outcome of the shard reported by a node other than its owner.
+type shardClaim int
+
+const (
+	// shardClaimAccepted means the reporter becomes the owner, e.g. after a failover from the dead owner.
+	shardClaimAccepted shardClaim = iota
+	// shardClaimConflict means the reporter should close the shard because an alive node owns it.
+	shardClaimConflict
+	// shardClaimAmbiguous means the owner can't be decided, and the topology is left as it is.
+	shardClaimAmbiguous
+)
+
+// claimReportedShardLocked decides whether the shard reported as the leader by the node, which is not its owner, is
+// taken over by the node. The report never overrides an alive owner, because the two nodes serving the same shard is
+// caused by a failover bug of the nodes rather than a change of the topology. The shard frozen by a transfer or a swap
+// is taken over as before, since the procedure commits its owner.
+func (c *Cluster) claimReportedShardLocked(shard *Shard, nodeName string, now time.Time) shardClaim {
+	if shard.node == "" {
+		return shardClaimAccepted
+	}
+	if owner, ok := c.nodesCache[shard.node]; !ok || !owner.IsAlive(now) {
+		return shardClaimAccepted
+	}
+	if freeze, ok := c.frozenShards[shard.GetID()]; ok && now.Before(freeze.expireAt) {
+		return shardClaimAccepted
+	}
+
+	clusterName := c.metaData.GetName()
+	if change := shard.lastOwnerChange; change != nil && change.To == nodeName {
+		if _, ok := c.ambiguousShardOwners[shard.GetID()]; !ok {
+			c.ambiguousShardOwners[shard.GetID()] = AmbiguousShardOwner{
+				ShardID:        shard.GetID(),
+				Owner:          shard.node,
+				PersistedOwner: nodeName,
+				DetectedAt:     now,
+			}
+			ambiguousShardOwnersGauge.WithLabelValues(clusterName).Set(float64(len(c.ambiguousShardOwners)))
+		}
+		shardOwnerConflictsCounter.WithLabelValues(clusterName, shardConflictAmbiguous).Inc()
+		log.Error("shard owner is ambiguous", zap.String("cluster", clusterName), zap.Uint32("shard", shard.GetID()),
+			zap.String("owner", shard.node), zap.String("persisted-owner", nodeName))
+		return shardClaimAmbiguous
+	}
+
+	shardOwnerConflictsCounter.WithLabelValues(clusterName, shardConflictClose).Inc()
+	log.Warn("shard reported by node other than its owner", zap.String("cluster", clusterName),
+		zap.Uint32("shard", shard.GetID()), zap.String("owner", shard.node), zap.String("node", nodeName))
+	return shardClaimConflict
+}
+
+// clearAmbiguousShardOwnerLocked forgets the ambiguity of the shard whose owner changes.
+func (c *Cluster) clearAmbiguousShardOwnerLocked(shardID uint32) {
+	if _, ok := c.ambiguousShardOwners[shardID]; !ok {
+		return
+	}
+	delete(c.ambiguousShardOwners, shardID)
+	ambiguousShardOwnersGauge.WithLabelValues(c.metaData.GetName()).Set(float64(len(c.ambiguousShardOwners)))
+}
+
+func (c *Cluster) listAmbiguousShardOwnersLocked() []AmbiguousShardOwner {
+	ambiguities := make([]AmbiguousShardOwner, 0, len(c.ambiguousShardOwners))
+	for _, ambiguity := range c.ambiguousShardOwners {
+		ambiguities = append(ambiguities, ambiguity)
+	}
+	sort.Slice(ambiguities, func(i, j int) bool { return ambiguities[i].ShardID < ambiguities[j].ShardID })
+	return ambiguities
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuelingShardReporters(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	pool := schedule.NewHeartbeatPool(1, 16)
+	defer pool.Close()
+
+	// serving simulates the shards opened by the nodes, and the nodes close the shards as told by the heartbeats.
+	serving := map[string]map[uint32]struct{}{
+		"a": {0: {}, 1: {}},
+		"b": {2: {}, 3: {}},
+	}
+	heartbeat := func(node string) []uint32 {
+		shardIDs := make([]uint32, 0, len(serving[node]))
+		for shardID := range serving[node] {
+			shardIDs = append(shardIDs, shardID)
+		}
+		sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+		_, conflicts, err := cluster.HandleHeartbeat(ctx, heartbeatNodeInfo(node, shardIDs...), pool, time.Second,
+			time.Second)
+		re.NoError(err)
+		for _, shardID := range conflicts {
+			delete(serving[node], shardID)
+		}
+		return conflicts
+	}
+	ownerOf := func(shardID uint32) string {
+		shardTables, err := cluster.GetShardTables([]uint32{shardID})
+		re.NoError(err)
+		return shardTables[shardID].Node
+	}
+	heartbeat("a")
+	heartbeat("b")
+	re.Equal("a", ownerOf(0))
+	change, err := cluster.GetShardOwnerChange(0)
+	re.NoError(err)
+
+	// The node b opens the shard 0 by mistake, and it is told to close the shard without changing the owner.
+	closed := testutil.ToFloat64(shardOwnerConflictsCounter.WithLabelValues(testClusterName, shardConflictClose))
+	serving["b"][0] = struct{}{}
+	for i := 0; i < 3; i++ {
+		heartbeat("a")
+		heartbeat("b")
+	}
+	re.Equal("a", ownerOf(0))
+	re.Contains(serving["a"], uint32(0))
+	re.NotContains(serving["b"], uint32(0))
+	re.Equal(closed+1, testutil.ToFloat64(shardOwnerConflictsCounter.WithLabelValues(testClusterName, shardConflictClose)))
+	unchanged, err := cluster.GetShardOwnerChange(0)
+	re.NoError(err)
+	re.Equal(change, unchanged)
+
+	// The persisted last owner change naming the node b disagrees with the owner, so neither is told to close it.
+	change = &ShardOwnerChange{ShardID: 0, From: "a", To: "b", Reason: ShardOwnerReported, Time: time.Now()}
+	value, err := encodeShardOwnerChange(change)
+	re.NoError(err)
+	re.NoError(s.PutShardOwnerChanges(ctx, cluster.clusterID, []uint32{0}, []string{value}))
+	re.NoError(cluster.Load(ctx))
+	serving["b"][0] = struct{}{}
+	re.Empty(heartbeat("b"))
+	re.Empty(heartbeat("a"))
+	re.Equal("a", ownerOf(0))
+	ambiguities := cluster.VerifyShardTableSets().AmbiguousShardOwners
+	re.Len(ambiguities, 1)
+	re.Equal(uint32(0), ambiguities[0].ShardID)
+	re.Equal("a", ambiguities[0].Owner)
+	re.Equal("b", ambiguities[0].PersistedOwner)
+
+	// The ambiguity is resolved once the node a closes the shard.
+	delete(serving["a"], 0)
+	heartbeat("a")
+	heartbeat("b")
+	re.Equal("b", ownerOf(0))
+	re.Empty(cluster.VerifyShardTableSets().AmbiguousShardOwners)
+
+	// The shard of the dead node is taken over by the node reporting it.
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	serving["b"][1] = struct{}{}
+	re.Empty(heartbeat("b"))
+	re.Equal("b", ownerOf(1))
+	change, err = cluster.GetShardOwnerChange(1)
+	re.NoError(err)
+	re.Equal(ShardOwnerReported, change.Reason)
+	re.Equal("a", change.From)
+
+	// The node a coming back is told to close the shard taken over.
+	re.Equal([]uint32{1}, heartbeat("a"))
+	re.Equal("b", ownerOf(1))
+}
+
+func TestShardReportedDuringTransfer(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	re.Empty(cluster.RegisterNode(ctx, heartbeatNodeInfo("a", 0)))
+	re.Empty(cluster.RegisterNode(ctx, heartbeatNodeInfo("b")))
+
+	// The target opening the shard before the source reports it closed is not a conflict.
+	transfer, err := cluster.PrepareShardTransfer("p1", 0, "a", "b")
+	re.NoError(err)
+	re.Empty(cluster.RegisterNode(ctx, heartbeatNodeInfo("b", 0)))
+	re.NoError(cluster.CommitShardTransfer(ctx, transfer))
+	re.Equal([]uint32{0}, cluster.RegisterNode(ctx, heartbeatNodeInfo("a", 0)))
+	shardTables, err := cluster.GetShardTables([]uint32{0})
+	re.NoError(err)
+	re.Equal("b", shardTables[0].Node)
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const shardDrainCheckInterval = 50 * time.Millisecond
+
+// DrainShardDDLs blocks the new DDLs of the shards and waits for their pending DDLs before the shards are moved, so
+// that no DDL is carried across the move. The DDLs run under the lock of the cluster, so the in-flight ones finish on
+// the current owners before the drain starts, and the background drops of the tables of the shards are waited until
+// they finish or give up. The new DDLs fail with ErrShardDraining to be retried after the move, except the creations
+// which are placed on the other shards. If the ctx is done before the pending DDLs finish, the shards are released and
+// the move should not proceed.
+func (c *Cluster) DrainShardDDLs(ctx context.Context, shardIDs []uint32) error {
+	c.lock.Lock()
+	for _, shardID := range shardIDs {
+		if _, ok := c.shardsCache[shardID]; !ok {
+			c.lock.Unlock()
+			return ErrShardNotFound.WithCausef("shard:%d", shardID)
+		}
+		if _, ok := c.drainingShards[shardID]; ok {
+			c.lock.Unlock()
+			return ErrShardDraining.WithCausef("shard:%d is drained by another move", shardID)
+		}
+	}
+	for _, shardID := range shardIDs {
+		c.drainingShards[shardID] = struct{}{}
+	}
+	c.lock.Unlock()
+
+	log.Info("drain shard ddls", zap.String("cluster", c.Name()), zap.Uint32s("shards", shardIDs))
+	ticker := time.NewTicker(shardDrainCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.lock.RLock()
+		pending := c.pendingShardDropsLocked(shardIDs)
+		c.lock.RUnlock()
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.UndrainShardDDLs(shardIDs)
+			return ErrShardDraining.WithCausef("shards:%v, pending drops:%d, err:%v", shardIDs, pending, ctx.Err())
+		}
+	}
+}
+
+// UndrainShardDDLs accepts the DDLs of the shards again, which should be called once the move finishes or fails.
+func (c *Cluster) UndrainShardDDLs(shardIDs []uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, shardID := range shardIDs {
+		delete(c.drainingShards, shardID)
+	}
+	log.Info("undrain shard ddls", zap.String("cluster", c.metaData.GetName()), zap.Uint32s("shards", shardIDs))
+}
+
+// checkShardDrainingLocked returns ErrShardDraining if the DDLs of the shard are drained.
+func (c *Cluster) checkShardDrainingLocked(shardID uint32) error {
+	if _, ok := c.drainingShards[shardID]; ok {
+		return ErrShardDraining.WithCausef("shard:%d is being moved, retry after the move", shardID)
+	}
+	return nil
+}
+
+// pendingShardDropsLocked returns the number of the background drops of the tables of the shards which are still
+// retried, and the ones given up are kept as dead letters to be retried after the move.
+func (c *Cluster) pendingShardDropsLocked(shardIDs []uint32) int {
+	pending := 0
+	for _, task := range c.dropTasks {
+		if task.failed {
+			continue
+		}
+		for _, shardID := range shardIDs {
+			if task.table.GetShardId() == shardID {
+				pending++
+				break
+			}
+		}
+	}
+	return pending
+}
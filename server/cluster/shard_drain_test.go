@@ -0,0 +1,89 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainShardDDLs(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 1)
+	re.NoError(err)
+	shardID := schema.GetShardIDs()[0]
+	for _, name := range []string{"table0", "table1"} {
+		_, err = manager.AllocTableID(ctx, testClusterName, "public", name)
+		re.NoError(err)
+	}
+
+	// The table0 is being dropped in background, which blocks the drain until it finishes.
+	cluster.lock.Lock()
+	table0, _ := cluster.schemasCache["public"].getTable("table0")
+	task := &dropTableTask{schemaID: table0.GetSchemaID(), schemaName: "public", table: table0.meta}
+	cluster.dropTasks[table0.GetID()] = task
+	cluster.lock.Unlock()
+
+	// The drain gives up and releases the shard if the pending drop doesn't finish in time.
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	err = cluster.DrainShardDDLs(timeoutCtx, []uint32{shardID})
+	timeoutCancel()
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "table1", 0, []byte("v1"))
+	re.NoError(err)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- cluster.DrainShardDDLs(ctx, []uint32{shardID})
+	}()
+	re.Eventually(func() bool {
+		cluster.lock.RLock()
+		defer cluster.lock.RUnlock()
+		return cluster.checkShardDrainingLocked(shardID) != nil
+	}, defaultTestTimeout, 10*time.Millisecond)
+
+	// The new DDLs of the drained shard fail to be retried after the move, and the creations of the other schemas are
+	// placed on the other shards.
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "table1", 1, []byte("v2"))
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.True(coderr.Is(manager.DropTable(ctx, testClusterName, "public", "table1", false), coderr.ServiceUnavailable))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table2")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	_, err = manager.CreateSchema(ctx, testClusterName, "other", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "other", "table0")
+	re.NoError(err)
+	re.NotEqual(shardID, table.GetShardID())
+	re.True(coderr.Is(cluster.DrainShardDDLs(ctx, []uint32{shardID}), coderr.ServiceUnavailable))
+
+	select {
+	case err := <-drained:
+		re.FailNow("drain finishes before the pending drop", "err:%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cluster.lock.Lock()
+	cluster.finishDropTableLocked(task)
+	cluster.lock.Unlock()
+	re.NoError(<-drained)
+
+	// The DDLs are accepted again after the move.
+	cluster.UndrainShardDDLs([]uint32{shardID})
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "table1", 1, []byte("v2"))
+	re.NoError(err)
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "table2")
+	re.NoError(err)
+	re.Equal(shardID, table.GetShardID())
+}
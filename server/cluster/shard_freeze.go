@@ -0,0 +1,98 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const defaultShardFreezeTTL = time.Minute
+
+type shardFreezeTokenKey struct{}
+
+// WithShardFreezeToken returns a context carrying the token, which allows the operations in the context to bump the
+// version of the shard frozen by the token.
+func WithShardFreezeToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, shardFreezeTokenKey{}, token)
+}
+
+func shardFreezeTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(shardFreezeTokenKey{}).(string)
+	return token
+}
+
+type shardFreeze struct {
+	token    string
+	expireAt time.Time
+}
+
+// FreezeShardVersion pins the version of the shard until the returned token is used to unfreeze it or the freeze
+// expires, and the operations bumping the version of the shard are rejected unless they carry the token.
+func (c *Cluster) FreezeShardVersion(_ context.Context, shardID uint32) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		return "", ErrShardNotFound.WithCausef("shard:%d", shardID)
+	}
+	if freeze, ok := c.frozenShards[shardID]; ok && time.Now().Before(freeze.expireAt) {
+		return "", ErrShardVersionFrozen.WithCausef("shard:%d, expire at:%s", shardID, freeze.expireAt)
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return "", ErrGenerateToken.WithCausef("shard version freeze, err:%v", err)
+	}
+	c.frozenShards[shardID] = &shardFreeze{token: token, expireAt: time.Now().Add(c.shardFreezeTTL)}
+
+	log.Info("freeze shard version", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID),
+		zap.Uint64("version", shard.GetVersion()), zap.Duration("ttl", c.shardFreezeTTL))
+	return token, nil
+}
+
+// UnfreezeShardVersion releases the freeze of the token.
+func (c *Cluster) UnfreezeShardVersion(token string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for shardID, freeze := range c.frozenShards {
+		if freeze.token == token {
+			delete(c.frozenShards, shardID)
+			log.Info("unfreeze shard version", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID))
+			return nil
+		}
+	}
+	return ErrShardFreezeNotFound.WithCausef("token:%s", token)
+}
+
+// checkShardFrozenLocked returns error if the shard is frozen and the ctx doesn't carry the token.
+func (c *Cluster) checkShardFrozenLocked(ctx context.Context, shardID uint32) error {
+	freeze, ok := c.frozenShards[shardID]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(freeze.expireAt) {
+		log.Warn("shard freeze expires", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID))
+		delete(c.frozenShards, shardID)
+		return nil
+	}
+	if shardFreezeTokenFromContext(ctx) == freeze.token {
+		return nil
+	}
+	return ErrShardVersionFrozen.WithCausef("shard:%d, expire at:%s", shardID, freeze.expireAt)
+}
+
+func newRandomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeShardVersion(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	schema, err := manager.CreateSchema(ctx, testClusterName, "public", 1)
+	re.NoError(err)
+	shardID := schema.GetShardIDs()[0]
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	token, err := manager.FreezeShardVersion(ctx, testClusterName, shardID)
+	re.NoError(err)
+	_, err = manager.FreezeShardVersion(ctx, testClusterName, shardID)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	// The operations bumping the version are rejected without the token.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	err = manager.DropTable(ctx, testClusterName, "public", "table0", false)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	stats, err := manager.GetSchemaStats(ctx, testClusterName, "public")
+	re.NoError(err)
+	re.Equal(1, stats.ShardTableCounts[shardID])
+
+	// The tables of other schemas avoid the frozen shard.
+	_, err = manager.CreateSchema(ctx, testClusterName, "other", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "other", "table0")
+	re.NoError(err)
+	re.NotEqual(shardID, table.GetShardID())
+
+	// The operations carrying the token are allowed.
+	tokenCtx := WithShardFreezeToken(ctx, token)
+	table, err = manager.AllocTableID(tokenCtx, testClusterName, "public", "table1")
+	re.NoError(err)
+	re.Equal(shardID, table.GetShardID())
+	re.NoError(manager.DropTable(tokenCtx, testClusterName, "public", "table0", false))
+
+	re.NoError(manager.UnfreezeShardVersion(ctx, testClusterName, token))
+	re.True(coderr.Is(manager.UnfreezeShardVersion(ctx, testClusterName, token), coderr.NotFound))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table2")
+	re.NoError(err)
+
+	// The freeze expires after the ttl.
+	cluster.shardFreezeTTL = time.Millisecond * 100
+	_, err = manager.FreezeShardVersion(ctx, testClusterName, shardID)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table3")
+	re.Error(err)
+	time.Sleep(time.Millisecond * 150)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table3")
+	re.NoError(err)
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// shardMappingCSVHeader is the header row of the shard mapping CSV.
+var shardMappingCSVHeader = []string{"shard_id", "node", "table_count", "version", "zone"}
+
+// ExportShardMappingCSV writes the shards ordered by the shard id as CSV, one row per shard with its owner, the number
+// of its tables, its version and the zone reported by its owner, after a header row. The node and the zone are empty if
+// the shard is owned by no node. The rows are copied from the memory under the read lock at once, so they are
+// consistent, and the lock is not held while writing.
+func (c *Cluster) ExportShardMappingCSV(w io.Writer) error {
+	c.lock.RLock()
+	clusterName := c.metaData.GetName()
+	shardIDs := make([]uint32, 0, len(c.shardsCache))
+	for shardID := range c.shardsCache {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+	rows := make([][]string, 0, len(shardIDs)+1)
+	rows = append(rows, shardMappingCSVHeader)
+	for _, shardID := range shardIDs {
+		shard := c.shardsCache[shardID]
+		zone := ""
+		if node, ok := c.nodesCache[shard.node]; ok {
+			zone = node.info.GetZone()
+		}
+		rows = append(rows, []string{
+			strconv.FormatUint(uint64(shardID), 10),
+			shard.node,
+			strconv.Itoa(shard.GetTableCount()),
+			strconv.FormatUint(shard.GetVersion(), 10),
+			zone,
+		})
+	}
+	c.lock.RUnlock()
+
+	if err := csv.NewWriter(w).WriteAll(rows); err != nil {
+		return errors.Wrapf(err, "write shard mapping csv, cluster:%s", clusterName)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportShardMappingCSV(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 2, 2, 3)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 1)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	re.Equal(uint32(1), table.GetShardID())
+
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60, Zone: "zone-1",
+		ShardsInfo: []*metapb.ShardInfo{{ShardId: 1, Role: metapb.ShardRole_LEADER}}}))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b,c", Lease: 60,
+		ShardsInfo: []*metapb.ShardInfo{{ShardId: 2, Role: metapb.ShardRole_LEADER}}}))
+
+	buf := &bytes.Buffer{}
+	re.NoError(manager.ExportShardMappingCSV(ctx, testClusterName, buf))
+	re.Equal(`shard_id,node,table_count,version,zone
+0,,0,0,
+1,a,1,1,zone-1
+2,"b,c",0,0,
+`, buf.String())
+
+	err = manager.ExportShardMappingCSV(ctx, "not_exist", buf)
+	re.True(coderr.Is(err, coderr.NotFound))
+}
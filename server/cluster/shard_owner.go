@@ -0,0 +1,186 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ShardOwnerChangeReason tells why the owner of a shard changed.
+type ShardOwnerChangeReason string
+
+const (
+	// ShardOwnerReported means the new owner reported itself as the leader of the shard by heartbeat, e.g. after a
+	// failover from the previous owner.
+	ShardOwnerReported ShardOwnerChangeReason = "reported"
+	// ShardOwnerLost means the owner stopped reporting itself as the leader of the shard.
+	ShardOwnerLost ShardOwnerChangeReason = "lost"
+	// ShardOwnerManualAssign means the shard is assigned by the operator.
+	ShardOwnerManualAssign ShardOwnerChangeReason = "manual_assign"
+	// ShardOwnerAutoAssign means the shard is assigned by the plan of the automatic assignment.
+	ShardOwnerAutoAssign ShardOwnerChangeReason = "auto_assign"
+	// ShardOwnerInitAssign means the shard is assigned to its owner given at the creation of the cluster.
+	ShardOwnerInitAssign ShardOwnerChangeReason = "init_assign"
+	// ShardOwnerSwap means the owners of two shards are exchanged in one step.
+	ShardOwnerSwap ShardOwnerChangeReason = "swap"
+	// ShardOwnerReassign means the shard is moved as a part of the reassignment of all the shards of its owner.
+	ShardOwnerReassign ShardOwnerChangeReason = "reassign"
+)
+
+// ShardOwnerChange records the last change of the owner of a shard, and it is persisted along with the cluster.
+type ShardOwnerChange struct {
+	ShardID uint32                 `json:"shard_id"`
+	From    string                 `json:"from"`
+	To      string                 `json:"to"`
+	Reason  ShardOwnerChangeReason `json:"reason"`
+	// ProcedureID identifies the procedure making the change, e.g. the run of the automatic assignment, and it is
+	// empty if the change is driven by the heartbeats.
+	ProcedureID string    `json:"procedure_id,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// GetShardOwnerChange returns the last ownership change of the shard, and nil is returned if its owner has never
+// changed.
+func (c *Cluster) GetShardOwnerChange(shardID uint32) (*ShardOwnerChange, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		return nil, ErrShardNotFound.WithCausef("shard:%d", shardID)
+	}
+	if shard.lastOwnerChange == nil {
+		return nil, nil
+	}
+	change := *shard.lastOwnerChange
+	return &change, nil
+}
+
+// newShardOwnerChange describes the change of the owner of the shard to the node, and the change is not applied.
+func newShardOwnerChange(shard *Shard, node string, reason ShardOwnerChangeReason, procedureID string) *ShardOwnerChange {
+	return &ShardOwnerChange{
+		ShardID:     shard.GetID(),
+		From:        shard.node,
+		To:          node,
+		Reason:      reason,
+		ProcedureID: procedureID,
+		Time:        time.Now(),
+	}
+}
+
+// applyShardOwnerChangeLocked changes the owner of the shard and bumps the topology generation.
+func (c *Cluster) applyShardOwnerChangeLocked(shard *Shard, change *ShardOwnerChange) {
+	shard.node = change.To
+	if change.To == "" {
+		shard.unassignedSince = change.Time
+	}
+	shard.lastOwnerChange = change
+	c.clearAmbiguousShardOwnerLocked(shard.GetID())
+	c.bumpTopologyGenerationLocked()
+}
+
+func encodeShardOwnerChange(change *ShardOwnerChange) (string, error) {
+	value, err := json.Marshal(change)
+	if err != nil {
+		return "", ErrEncodeShardOwnerChange.WithCausef("shard:%d, err:%v", change.ShardID, err)
+	}
+	return string(value), nil
+}
+
+// persistShardOwnerChangesLocked persists the changes in a single transaction, and the changes are persisted again
+// after the ones being flushed if any, so that they aren't overwritten by the older ones.
+func (c *Cluster) persistShardOwnerChangesLocked(ctx context.Context, changes []*ShardOwnerChange) error {
+	if err := c.putShardOwnerChanges(ctx, changes); err != nil {
+		return err
+	}
+	if c.flushingOwnerChanges {
+		for _, change := range changes {
+			c.pendingOwnerChanges[change.ShardID] = change
+		}
+	}
+	return nil
+}
+
+// flushShardOwnerChanges persists the pending ownership changes without the lock, and it returns at once if they
+// are being flushed by another one, which keeps flushing until none is pending. Only one flushes at a time, so the
+// changes are persisted in the order they are made.
+func (c *Cluster) flushShardOwnerChanges(ctx context.Context) {
+	c.lock.Lock()
+	if c.flushingOwnerChanges {
+		c.lock.Unlock()
+		return
+	}
+	c.flushingOwnerChanges = true
+	for len(c.pendingOwnerChanges) > 0 {
+		changes := make([]*ShardOwnerChange, 0, len(c.pendingOwnerChanges))
+		for _, change := range c.pendingOwnerChanges {
+			changes = append(changes, change)
+		}
+		c.pendingOwnerChanges = make(map[uint32]*ShardOwnerChange)
+		c.lock.Unlock()
+
+		sortShardOwnerChanges(changes)
+		err := c.putShardOwnerChanges(ctx, changes)
+
+		c.lock.Lock()
+		if err != nil {
+			log.Warn("fail to persist shard owner changes", zap.String("cluster", c.metaData.GetName()), zap.Error(err))
+			// The failed changes are retried by the next flush unless they are superseded.
+			for _, change := range changes {
+				if _, ok := c.pendingOwnerChanges[change.ShardID]; !ok {
+					c.pendingOwnerChanges[change.ShardID] = change
+				}
+			}
+			break
+		}
+	}
+	c.flushingOwnerChanges = false
+	c.lock.Unlock()
+}
+
+func (c *Cluster) putShardOwnerChanges(ctx context.Context, changes []*ShardOwnerChange) error {
+	shardIDs := make([]uint32, 0, len(changes))
+	values := make([]string, 0, len(changes))
+	for _, change := range changes {
+		value, err := encodeShardOwnerChange(change)
+		if err != nil {
+			return err
+		}
+		shardIDs = append(shardIDs, change.ShardID)
+		values = append(values, value)
+	}
+	if err := c.storage.PutShardOwnerChanges(ctx, c.clusterID, shardIDs, values); err != nil {
+		return errors.Wrapf(err, "put shard owner changes, shards:%v", shardIDs)
+	}
+	return nil
+}
+
+// loadShardOwnerChanges loads the last ownership changes of the shards keyed by shard id.
+func (c *Cluster) loadShardOwnerChanges(ctx context.Context) (map[uint32]*ShardOwnerChange, error) {
+	values, err := c.storage.ListShardOwnerChanges(ctx, c.clusterID)
+	if err != nil {
+		return nil, errors.Wrap(err, "list shard owner changes")
+	}
+
+	changes := make(map[uint32]*ShardOwnerChange, len(values))
+	for shardID, value := range values {
+		change := &ShardOwnerChange{}
+		if err := json.Unmarshal([]byte(value), change); err != nil {
+			return nil, ErrDecodeShardOwnerChange.WithCausef("shard:%d, value:%s, err:%v", shardID, value, err)
+		}
+		changes[shardID] = change
+	}
+	return changes, nil
+}
+
+// sortShardOwnerChanges sorts the changes by shard id so that they are persisted in a stable order.
+func sortShardOwnerChanges(changes []*ShardOwnerChange) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ShardID < changes[j].ShardID })
+}
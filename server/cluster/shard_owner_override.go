@@ -0,0 +1,31 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+//go:build testutil
+
+package cluster
+
+import (
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// ShardOwnerOverride means the owner of the shard is overridden by the tests.
+const ShardOwnerOverride ShardOwnerChangeReason = "override"
+
+// OverrideShardOwner sets the owner of the shard in the memory only, which is neither persisted nor sent to any node,
+// so the tests can construct the topologies quickly without moving the shards. The node needn't be registered, and
+// the empty node makes the shard owned by no node. It is only built with the testutil tag and never in production.
+func (c *Cluster) OverrideShardOwner(shardID uint32, node string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		return ErrShardNotFound.WithCausef("shard:%d", shardID)
+	}
+	c.applyShardOwnerChangeLocked(shard, newShardOwnerChange(shard, node, ShardOwnerOverride, ""))
+	c.invalidateTopologyCacheLocked()
+	log.Warn("override shard owner", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID),
+		zap.String("node", node))
+	return nil
+}
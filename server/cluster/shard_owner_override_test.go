@@ -0,0 +1,43 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+//go:build testutil
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrideShardOwner(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+
+	re.True(coderr.Is(cluster.OverrideShardOwner(testShardTotal, "a"), coderr.NotFound))
+	re.NoError(cluster.OverrideShardOwner(1, "a"))
+	re.Equal("a", cluster.GetTopology(0).Topology.Shards[1].Node)
+	change, err := cluster.GetShardOwnerChange(1)
+	re.NoError(err)
+	re.Equal(ShardOwnerOverride, change.Reason)
+
+	// The override is not persisted.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	change, err = reloadedCluster.GetShardOwnerChange(1)
+	re.NoError(err)
+	re.Nil(change)
+	re.Empty(reloadedCluster.GetTopology(0).Topology.Shards[1].Node)
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardOwnerChange(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+
+	leaderOf := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+
+	change, err := manager.GetShardOwnerChange(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.Nil(change)
+	_, err = manager.GetShardOwnerChange(ctx, testClusterName, testShardTotal)
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	// Shard 0 is reported by a and fails over to b after a dies.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("a", 0, 1)))
+	cluster.lock.Lock()
+	cluster.nodesCache["a"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("b", 0)))
+	change, err = manager.GetShardOwnerChange(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.Equal("a", change.From)
+	re.Equal("b", change.To)
+	re.Equal(ShardOwnerReported, change.Reason)
+	re.Empty(change.ProcedureID)
+
+	// Shard 1 is lost after a stops reporting it.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("a")))
+	change, err = manager.GetShardOwnerChange(ctx, testClusterName, 1)
+	re.NoError(err)
+	re.Equal("a", change.From)
+	re.Equal("", change.To)
+	re.Equal(ShardOwnerLost, change.Reason)
+
+	re.NoError(manager.AssignShard(ctx, testClusterName, 1, "a"))
+	change, err = manager.GetShardOwnerChange(ctx, testClusterName, 1)
+	re.NoError(err)
+	re.Equal("", change.From)
+	re.Equal("a", change.To)
+	re.Equal(ShardOwnerManualAssign, change.Reason)
+
+	assignments, err := cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	re.NotEmpty(assignments)
+	procedureID := ""
+	for _, assignment := range assignments {
+		change, err = manager.GetShardOwnerChange(ctx, testClusterName, assignment.ShardID)
+		re.NoError(err)
+		re.Equal(assignment.Node, change.To)
+		re.Equal(ShardOwnerAutoAssign, change.Reason)
+		re.NotEmpty(change.ProcedureID)
+		if procedureID != "" {
+			re.Equal(procedureID, change.ProcedureID)
+		}
+		procedureID = change.ProcedureID
+	}
+
+	// The changes are exposed by the cluster snapshot.
+	var buf bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, testClusterName, &buf))
+	re.Contains(buf.String(), "shard_owner")
+
+	// The changes are persisted and loaded by a new manager.
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	change, err = manager.GetShardOwnerChange(ctx, testClusterName, 0)
+	re.NoError(err)
+	re.Equal("b", change.To)
+	re.Equal(ShardOwnerReported, change.Reason)
+	change, err = manager.GetShardOwnerChange(ctx, testClusterName, 1)
+	re.NoError(err)
+	re.Equal(ShardOwnerManualAssign, change.Reason)
+}
+
+// blockingOwnerStorage blocks the first put of the shard owner changes after it is armed until it is released.
+type blockingOwnerStorage struct {
+	storage.Storage
+	armed   int32
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingOwnerStorage) PutShardOwnerChanges(ctx context.Context, clusterID uint32, shardIDs []uint32,
+	values []string,
+) error {
+	if atomic.CompareAndSwapInt32(&s.armed, 1, 0) {
+		close(s.blocked)
+		<-s.release
+	}
+	return s.Storage.PutShardOwnerChanges(ctx, clusterID, shardIDs, values)
+}
+
+func TestShardOwnerChangePersistedWithoutLock(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	bs := &blockingOwnerStorage{Storage: s, blocked: make(chan struct{}), release: make(chan struct{})}
+	manager := NewManagerImpl(bs, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+
+	atomic.StoreInt32(&bs.armed, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cluster.RegisterNode(ctx, heartbeatNodeInfo("a", 0))
+	}()
+	<-bs.blocked
+
+	// The cluster is accessible while the change is being persisted, and the changes made meanwhile are persisted by
+	// the one flushing.
+	change, err := cluster.GetShardOwnerChange(0)
+	re.NoError(err)
+	re.Equal("a", change.To)
+	re.Empty(cluster.RegisterNode(ctx, heartbeatNodeInfo("b", 1)))
+	close(bs.release)
+	<-done
+
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	for shardID, node := range map[uint32]string{0: "a", 1: "b"} {
+		change, err = reloaded.GetShardOwnerChange(ctx, testClusterName, shardID)
+		re.NoError(err)
+		re.Equal(node, change.To)
+		re.Equal(ShardOwnerReported, change.Reason)
+	}
+}
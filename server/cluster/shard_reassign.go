@@ -0,0 +1,207 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ShardMoveState is the state of a shard in the reassignment of the shards of a node.
+type ShardMoveState string
+
+const (
+	ShardMovePending ShardMoveState = "pending"
+	ShardMoveDone    ShardMoveState = "moved"
+	ShardMoveFailed  ShardMoveState = "failed"
+	// ShardMoveSkipped means the shard is not moved because an earlier move fails.
+	ShardMoveSkipped ShardMoveState = "skipped"
+)
+
+// ShardMoveResult is the planned move of a shard and how it ends.
+type ShardMoveResult struct {
+	ShardID uint32         `json:"shard_id"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	State   ShardMoveState `json:"state"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// ShardReassignReport is the plan and the progress of the reassignment of all the shards of a node.
+type ShardReassignReport struct {
+	ProcedureID string                    `json:"procedure_id"`
+	From        string                    `json:"from"`
+	Targets     []string                  `json:"targets"`
+	Strategy    schedule.ReassignStrategy `json:"strategy"`
+	Moves       []ShardMoveResult         `json:"moves"`
+}
+
+// ShardTransfer moves a shard from its owner to another node.
+type ShardTransfer struct {
+	ProcedureID string
+	ShardID     uint32
+	From        string
+	To          string
+
+	// version and token are the version of the shard and the token freezing it at the preparation.
+	version uint64
+	token   string
+}
+
+// PlanShardReassignment plans moving all the shards of the node to the alive targets by the strategy, and the moves
+// are returned in the report as pending.
+func (c *Cluster) PlanShardReassignment(from string, targets []string, strategy schedule.ReassignStrategy) (*ShardReassignReport, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if _, ok := c.nodesCache[from]; !ok {
+		return nil, ErrNodeNotFound.WithCausef("node:%s", from)
+	}
+	now := time.Now()
+	for _, target := range targets {
+		node, ok := c.nodesCache[target]
+		if !ok {
+			return nil, ErrNodeNotFound.WithCausef("node:%s", target)
+		}
+		if !node.IsAlive(now) {
+			return nil, ErrNodeNotAlive.WithCausef("node:%s, last touch time:%s", target, node.lastTouchTime)
+		}
+	}
+
+	snapshot := &schedule.TopologySnapshot{Shards: make(map[uint32]string), AffinityGroups: c.shardAffinityGroupsLocked()}
+	for name := range c.nodesCache {
+		snapshot.Nodes = append(snapshot.Nodes, name)
+	}
+	sort.Strings(snapshot.Nodes)
+	snapshot.Capacities = c.plannerCapacitiesLocked(snapshot.Nodes)
+	for _, shard := range c.shardsCache {
+		if _, ok := c.nodesCache[shard.node]; ok {
+			snapshot.Shards[shard.GetID()] = shard.node
+		}
+	}
+	plan, err := schedule.ReassignPlanner{From: from, Targets: targets, Strategy: strategy}.Plan(snapshot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plan shard reassignment, from:%s, targets:%v", from, targets)
+	}
+	if len(plan.Unplaced) > 0 {
+		return nil, ErrNodeCapacityExceeded.WithCausef("targets:%v can't own shards:%v", targets, plan.Unplaced)
+	}
+
+	procedureID, err := newRandomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate shard reassignment procedure id")
+	}
+	report := &ShardReassignReport{
+		ProcedureID: procedureID,
+		From:        from,
+		Targets:     append([]string(nil), targets...),
+		Strategy:    strategy,
+		Moves:       make([]ShardMoveResult, 0, len(plan.Moves)),
+	}
+	for _, move := range plan.Moves {
+		report.Moves = append(report.Moves, ShardMoveResult{ShardID: move.ShardID, From: move.From, To: move.To, State: ShardMovePending})
+	}
+	return report, nil
+}
+
+// PrepareShardTransfer validates the move of the shard owned by the from node to the alive target, and freezes the
+// version of the shard until the transfer is committed or aborted.
+func (c *Cluster) PrepareShardTransfer(procedureID string, shardID uint32, from, to string) (*ShardTransfer, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shard, ok := c.shardsCache[shardID]
+	if !ok {
+		return nil, ErrShardNotFound.WithCausef("shard:%d", shardID)
+	}
+	if shard.node != from {
+		return nil, ErrShardMoveConflict.WithCausef("shard:%d is owned by node:%s, expected node:%s", shardID, shard.node, from)
+	}
+	node, ok := c.nodesCache[to]
+	if !ok {
+		return nil, ErrNodeNotFound.WithCausef("node:%s", to)
+	}
+	now := time.Now()
+	if !node.IsAlive(now) {
+		return nil, ErrNodeNotAlive.WithCausef("shard:%d, node:%s, last touch time:%s", shardID, to, node.lastTouchTime)
+	}
+	if err := c.checkNodeShardCapacityLocked(to); err != nil {
+		return nil, err
+	}
+	if freeze, ok := c.frozenShards[shardID]; ok && now.Before(freeze.expireAt) {
+		return nil, ErrShardVersionFrozen.WithCausef("shard:%d, expire at:%s", shardID, freeze.expireAt)
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate shard transfer freeze token")
+	}
+	c.frozenShards[shardID] = &shardFreeze{token: token, expireAt: now.Add(c.shardFreezeTTL)}
+	return &ShardTransfer{
+		ProcedureID: procedureID,
+		ShardID:     shardID,
+		From:        from,
+		To:          to,
+		version:     shard.GetVersion(),
+		token:       token,
+	}, nil
+}
+
+// CommitShardTransfer persists the new owner of the shard along with its version bump in a single transaction. The
+// shard may have been reported by the new owner already, but the transfer is rejected if it is owned by a third node
+// or its freeze has been lost, and the transfer should be aborted then.
+func (c *Cluster) CommitShardTransfer(ctx context.Context, transfer *ShardTransfer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shard := c.shardsCache[transfer.ShardID]
+	if freeze, ok := c.frozenShards[transfer.ShardID]; !ok || freeze.token != transfer.token {
+		return ErrShardMoveConflict.WithCausef("freeze of shard:%d is lost", transfer.ShardID)
+	}
+	if shard.GetVersion() != transfer.version {
+		return ErrShardMoveConflict.WithCausef("shard:%d, version:%d, expected version:%d", transfer.ShardID,
+			shard.GetVersion(), transfer.version)
+	}
+	if shard.node != transfer.From && shard.node != transfer.To && shard.node != "" {
+		return ErrShardMoveConflict.WithCausef("shard:%d is owned by node:%s", transfer.ShardID, shard.node)
+	}
+
+	change := newShardOwnerChange(shard, transfer.To, ShardOwnerReassign, transfer.ProcedureID)
+	change.From = transfer.From
+	value, err := encodeShardOwnerChange(change)
+	if err != nil {
+		return err
+	}
+	topology := shard.withVersionBumped(c.shardVersionIncrementLocked(ShardOperationMove))
+	if err := c.storage.PutShardTopologiesWithOwnerChanges(ctx, c.clusterID, []uint32{transfer.ShardID},
+		[]*metapb.ShardTopology{topology}, []string{value}); err != nil {
+		c.markStaleOnConflictLocked(err)
+		return errors.Wrapf(err, "put shard topology with owner change, shard:%d", transfer.ShardID)
+	}
+
+	shard.topology = topology
+	c.applyShardOwnerChangeLocked(shard, change)
+	delete(c.frozenShards, transfer.ShardID)
+	log.Info("commit shard transfer", zap.String("cluster", c.metaData.GetName()), zap.String("procedure", transfer.ProcedureID),
+		zap.Uint32("shard", transfer.ShardID), zap.String("from", transfer.From), zap.String("to", transfer.To))
+	return nil
+}
+
+// AbortShardTransfer releases the freeze of the transfer, and the owner of the shard is left to the heartbeats.
+func (c *Cluster) AbortShardTransfer(transfer *ShardTransfer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if freeze, ok := c.frozenShards[transfer.ShardID]; ok && freeze.token == transfer.token {
+		delete(c.frozenShards, transfer.ShardID)
+	}
+	log.Warn("abort shard transfer", zap.String("cluster", c.metaData.GetName()), zap.String("procedure", transfer.ProcedureID),
+		zap.Uint32("shard", transfer.ShardID))
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardReassign(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 3, 1, testShardTotal)
+	re.NoError(err)
+
+	nodeInfo := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("b", 4, 5)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("c", 6, 7)))
+
+	// The invalid reassignments are rejected.
+	_, err = cluster.PlanShardReassignment("x", []string{"b"}, schedule.ReassignRoundRobin)
+	re.True(coderr.Is(err, coderr.NotFound))
+	_, err = cluster.PlanShardReassignment("a", []string{"a"}, schedule.ReassignRoundRobin)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = cluster.PlanShardReassignment("a", nil, schedule.ReassignRoundRobin)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	report, err := cluster.PlanShardReassignment("a", []string{"b", "c"}, schedule.ReassignRoundRobin)
+	re.NoError(err)
+	re.NotEmpty(report.ProcedureID)
+	re.Len(report.Moves, 4)
+	for i, move := range report.Moves {
+		re.Equal("a", move.From)
+		re.Equal([]string{"b", "c"}[i%2], move.To)
+		re.Equal(ShardMovePending, move.State)
+	}
+
+	// The shard is frozen during the transfer, and an aborted transfer releases it.
+	move := report.Moves[0]
+	transfer, err := cluster.PrepareShardTransfer(report.ProcedureID, move.ShardID, move.From, move.To)
+	re.NoError(err)
+	_, err = cluster.PrepareShardTransfer(report.ProcedureID, move.ShardID, move.From, move.To)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	cluster.AbortShardTransfer(transfer)
+	re.True(coderr.Is(cluster.CommitShardTransfer(ctx, transfer), coderr.Conflict))
+	_, err = cluster.PrepareShardTransfer(report.ProcedureID, move.ShardID, "b", move.To)
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// The new owner has reported the shard before the commit.
+	before, err := cluster.GetShardTables([]uint32{move.ShardID})
+	re.NoError(err)
+	transfer, err = cluster.PrepareShardTransfer(report.ProcedureID, move.ShardID, move.From, move.To)
+	re.NoError(err)
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo(move.To, 4, 5, move.ShardID)))
+	re.NoError(cluster.CommitShardTransfer(ctx, transfer))
+	after, err := cluster.GetShardTables([]uint32{move.ShardID})
+	re.NoError(err)
+	re.Equal(before[move.ShardID].Version+1, after[move.ShardID].Version)
+	change, err := cluster.GetShardOwnerChange(move.ShardID)
+	re.NoError(err)
+	re.Equal(ShardOwnerReassign, change.Reason)
+	re.Equal(report.ProcedureID, change.ProcedureID)
+	re.Equal("a", change.From)
+	re.Equal(move.To, change.To)
+
+	// The moved shard is not planned again.
+	report, err = cluster.PlanShardReassignment("a", []string{"b", "c"}, schedule.ReassignLeastLoaded)
+	re.NoError(err)
+	re.Len(report.Moves, 3)
+	for _, m := range report.Moves {
+		re.NotEqual(move.ShardID, m.ShardID)
+	}
+}
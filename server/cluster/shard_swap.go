@@ -0,0 +1,157 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ShardSwap exchanges the owners of two shards: ShardA moves from NodeA to NodeB and ShardB moves from NodeB to NodeA.
+type ShardSwap struct {
+	ProcedureID string
+	ShardA      uint32
+	NodeA       string
+	ShardB      uint32
+	NodeB       string
+
+	// versions and tokens are the versions of the shards and the tokens freezing them at the preparation.
+	versions map[uint32]uint64
+	tokens   map[uint32]string
+}
+
+// PrepareShardSwap validates the swap and freezes the versions of both shards until the swap is committed or aborted,
+// so that no DDL can change the shards while they are reopened on the other nodes.
+func (c *Cluster) PrepareShardSwap(shardA, shardB uint32) (*ShardSwap, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if shardA == shardB {
+		return nil, ErrInvalidShardSwap.WithCausef("same shard:%d", shardA)
+	}
+	swap := &ShardSwap{
+		ShardA:   shardA,
+		ShardB:   shardB,
+		versions: make(map[uint32]uint64, 2),
+		tokens:   make(map[uint32]string, 2),
+	}
+	now := time.Now()
+	for _, shardID := range []uint32{shardA, shardB} {
+		shard, ok := c.shardsCache[shardID]
+		if !ok {
+			return nil, ErrShardNotFound.WithCausef("shard:%d", shardID)
+		}
+		node, ok := c.nodesCache[shard.node]
+		if !ok {
+			return nil, ErrInvalidShardSwap.WithCausef("shard:%d is not assigned", shardID)
+		}
+		if !node.IsAlive(now) {
+			return nil, ErrNodeNotAlive.WithCausef("shard:%d, node:%s, last touch time:%s", shardID, shard.node,
+				node.lastTouchTime)
+		}
+		if freeze, ok := c.frozenShards[shardID]; ok && now.Before(freeze.expireAt) {
+			return nil, ErrShardVersionFrozen.WithCausef("shard:%d, expire at:%s", shardID, freeze.expireAt)
+		}
+		swap.versions[shardID] = shard.GetVersion()
+	}
+	swap.NodeA = c.shardsCache[shardA].node
+	swap.NodeB = c.shardsCache[shardB].node
+	if swap.NodeA == swap.NodeB {
+		return nil, ErrInvalidShardSwap.WithCausef("shards:%d and %d are owned by the same node:%s", shardA, shardB, swap.NodeA)
+	}
+
+	procedureID, err := newRandomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate shard swap procedure id")
+	}
+	swap.ProcedureID = procedureID
+	for _, shardID := range []uint32{shardA, shardB} {
+		token, err := newRandomToken()
+		if err != nil {
+			return nil, errors.Wrap(err, "generate shard swap freeze token")
+		}
+		c.frozenShards[shardID] = &shardFreeze{token: token, expireAt: now.Add(c.shardFreezeTTL)}
+		swap.tokens[shardID] = token
+	}
+
+	log.Info("prepare shard swap", zap.String("cluster", c.metaData.GetName()), zap.String("procedure", procedureID),
+		zap.Uint32("shard-a", shardA), zap.String("node-a", swap.NodeA), zap.Uint32("shard-b", shardB),
+		zap.String("node-b", swap.NodeB))
+	return swap, nil
+}
+
+// CommitShardSwap persists the new owners of both shards along with their version bumps in a single transaction. The
+// shards may have been reported by their new owners already, but the swap is rejected if any of them is owned by a
+// third node or its freeze has been lost, and the swap should be aborted then.
+func (c *Cluster) CommitShardSwap(ctx context.Context, swap *ShardSwap) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	targets := map[uint32]string{swap.ShardA: swap.NodeB, swap.ShardB: swap.NodeA}
+	origins := map[uint32]string{swap.ShardA: swap.NodeA, swap.ShardB: swap.NodeB}
+	shardIDs := []uint32{swap.ShardA, swap.ShardB}
+	shards := make([]*Shard, 0, len(shardIDs))
+	topologies := make([]*metapb.ShardTopology, 0, len(shardIDs))
+	changes := make([]*ShardOwnerChange, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		shard := c.shardsCache[shardID]
+		if freeze, ok := c.frozenShards[shardID]; !ok || freeze.token != swap.tokens[shardID] {
+			return ErrShardSwapConflict.WithCausef("freeze of shard:%d is lost", shardID)
+		}
+		if shard.GetVersion() != swap.versions[shardID] {
+			return ErrShardSwapConflict.WithCausef("shard:%d, version:%d, expected version:%d", shardID,
+				shard.GetVersion(), swap.versions[shardID])
+		}
+		if shard.node != origins[shardID] && shard.node != targets[shardID] && shard.node != "" {
+			return ErrShardSwapConflict.WithCausef("shard:%d is owned by node:%s", shardID, shard.node)
+		}
+
+		change := newShardOwnerChange(shard, targets[shardID], ShardOwnerSwap, swap.ProcedureID)
+		change.From = origins[shardID]
+		shards = append(shards, shard)
+		topologies = append(topologies, shard.withVersionBumped(c.shardVersionIncrementLocked(ShardOperationMove)))
+		changes = append(changes, change)
+	}
+
+	values := make([]string, 0, len(changes))
+	for _, change := range changes {
+		value, err := encodeShardOwnerChange(change)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+	if err := c.storage.PutShardTopologiesWithOwnerChanges(ctx, c.clusterID, shardIDs, topologies, values); err != nil {
+		c.markStaleOnConflictLocked(err)
+		return errors.Wrapf(err, "put shard topologies with owner changes, shards:%v", shardIDs)
+	}
+
+	for i, shard := range shards {
+		shard.topology = topologies[i]
+		c.applyShardOwnerChangeLocked(shard, changes[i])
+		delete(c.frozenShards, shard.GetID())
+	}
+	log.Info("commit shard swap", zap.String("cluster", c.metaData.GetName()), zap.String("procedure", swap.ProcedureID),
+		zap.Uint32("shard-a", swap.ShardA), zap.String("node-a", swap.NodeB), zap.Uint32("shard-b", swap.ShardB),
+		zap.String("node-b", swap.NodeA))
+	return nil
+}
+
+// AbortShardSwap releases the freezes of the swap, and the owners of the shards are left to the heartbeats.
+func (c *Cluster) AbortShardSwap(swap *ShardSwap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for shardID, token := range swap.tokens {
+		if freeze, ok := c.frozenShards[shardID]; ok && freeze.token == token {
+			delete(c.frozenShards, shardID)
+		}
+	}
+	log.Warn("abort shard swap", zap.String("cluster", c.metaData.GetName()), zap.String("procedure", swap.ProcedureID),
+		zap.Uint32("shard-a", swap.ShardA), zap.Uint32("shard-b", swap.ShardB))
+}
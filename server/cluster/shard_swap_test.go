@@ -0,0 +1,102 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardSwap(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	nodeInfo := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", 0, 1, 2, 3)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("b", 4, 5, 6, 7)))
+	shardA := table.GetShardID()
+	shardB := (shardA + testShardTotal/2) % testShardTotal
+	before, err := cluster.GetShardTables([]uint32{shardA, shardB})
+	re.NoError(err)
+
+	// The invalid swaps are rejected.
+	_, err = cluster.PrepareShardSwap(shardA, shardA)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	// The neighbour of the shard is owned by the same node.
+	_, err = cluster.PrepareShardSwap(shardA, shardA^1)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = cluster.PrepareShardSwap(shardA, testShardTotal)
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	// The shards are frozen during the swap, and an aborted swap releases them.
+	swap, err := cluster.PrepareShardSwap(shardA, shardB)
+	re.NoError(err)
+	_, err = cluster.PrepareShardSwap(shardA, shardB)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	re.True(coderr.Is(manager.DropTable(ctx, testClusterName, "public", "table0", false), coderr.InvalidParams))
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "table0", table.GetSchemaVersion(), []byte("schema"))
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	frozen, err := cluster.GetShardTables([]uint32{shardA})
+	re.NoError(err)
+	re.Equal(before[shardA].Version, frozen[shardA].Version)
+	cluster.AbortShardSwap(swap)
+	re.True(coderr.Is(cluster.CommitShardSwap(ctx, swap), coderr.Conflict))
+
+	// The new owners have reported the shards before the commit.
+	swap, err = cluster.PrepareShardSwap(shardA, shardB)
+	re.NoError(err)
+	re.Equal("a", swap.NodeA)
+	re.Equal("b", swap.NodeB)
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("a", shardB)))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, nodeInfo("b", shardA)))
+	re.NoError(cluster.CommitShardSwap(ctx, swap))
+
+	after, err := cluster.GetShardTables([]uint32{shardA, shardB})
+	re.NoError(err)
+	re.Equal(before[shardA].Version+1, after[shardA].Version)
+	re.Equal(before[shardB].Version+1, after[shardB].Version)
+	re.Len(after[shardA].Tables, 1)
+	for shardID, owners := range map[uint32][2]string{shardA: {"a", "b"}, shardB: {"b", "a"}} {
+		change, err := cluster.GetShardOwnerChange(shardID)
+		re.NoError(err)
+		re.Equal(ShardOwnerSwap, change.Reason)
+		re.Equal(swap.ProcedureID, change.ProcedureID)
+		re.Equal(owners[0], change.From)
+		re.Equal(owners[1], change.To)
+	}
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "table0", false))
+
+	// The versions and the owner changes are persisted together.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	reloadedShards, err := reloadedCluster.GetShardTables([]uint32{shardB})
+	re.NoError(err)
+	re.Equal(after[shardB].Version, reloadedShards[shardB].Version)
+	change, err := reloadedCluster.GetShardOwnerChange(shardB)
+	re.NoError(err)
+	re.Equal(ShardOwnerSwap, change.Reason)
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestShardTopologyKeepsUnknownFields(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, 1)
+	re.NoError(err)
+
+	// The topology of the shard is rewritten by a newer version with a field unknown to this version.
+	future := protowire.AppendTag(nil, 1000, protowire.VarintType)
+	future = protowire.AppendVarint(future, 42)
+	written := &metapb.ShardTopology{Version: 1}
+	written.ProtoReflect().SetUnknown(future)
+	re.NoError(s.PutShardTopologies(ctx, cluster.clusterID, []uint32{0}, []*metapb.ShardTopology{written}))
+
+	// The field survives the read-modify-write of the shard by this version.
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	topologies, err := s.ListShardTopologies(ctx, cluster.clusterID, []uint32{0})
+	re.NoError(err)
+	re.Equal([]uint64{table.GetID()}, topologies[0].GetTableIds())
+	re.Greater(topologies[0].GetVersion(), written.GetVersion())
+	re.Equal(future, []byte(topologies[0].ProtoReflect().GetUnknown()))
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+// ShardOperation is the kind of the operations changing a shard.
+type ShardOperation string
+
+const (
+	ShardOperationCreateTable ShardOperation = "create_table"
+	ShardOperationDropTable   ShardOperation = "drop_table"
+	ShardOperationAlterTable  ShardOperation = "alter_table"
+	// ShardOperationMove changes the owner of the shard.
+	ShardOperationMove ShardOperation = "move"
+)
+
+// ShardVersionPolicy decides which operations bump the version of the shard. The policy is a part of the persisted
+// options of the cluster, so the versions are bumped in the same way after the leader of the ceresmeta changes, and
+// it is returned along with the DDLs and the topology so that the ceresdb servers know what the versions mean.
+type ShardVersionPolicy string
+
+const (
+	// ShardVersionEveryChange bumps the version on every change of the shard, including the alteration of its tables.
+	ShardVersionEveryChange ShardVersionPolicy = "every_change"
+	// ShardVersionTableSet bumps the version whenever the tables on the shard or its owner change.
+	ShardVersionTableSet ShardVersionPolicy = "table_set"
+	// ShardVersionPlacement bumps the version only when the owner of the shard changes. The table set verification
+	// may report a transient divergence under this policy, because a report is not known to be stale until the
+	// version changes.
+	ShardVersionPlacement ShardVersionPolicy = "placement"
+
+	defaultShardVersionPolicy = ShardVersionTableSet
+)
+
+// IsValid returns true if the policy is known, and the empty policy is the default one.
+func (p ShardVersionPolicy) IsValid() bool {
+	switch p {
+	case "", ShardVersionEveryChange, ShardVersionTableSet, ShardVersionPlacement:
+		return true
+	default:
+		return false
+	}
+}
+
+// OrDefault returns the default policy if the policy is empty.
+func (p ShardVersionPolicy) OrDefault() ShardVersionPolicy {
+	if p == "" {
+		return defaultShardVersionPolicy
+	}
+	return p
+}
+
+// Increment returns how much the version of the shard is bumped by the operation. The moves always bump the version,
+// which guards the shard against the stale owners.
+func (p ShardVersionPolicy) Increment(op ShardOperation) uint64 {
+	if op == ShardOperationMove {
+		return 1
+	}
+	switch p.OrDefault() {
+	case ShardVersionEveryChange:
+		return 1
+	case ShardVersionTableSet:
+		if op == ShardOperationCreateTable || op == ShardOperationDropTable {
+			return 1
+		}
+	}
+	return 0
+}
+
+// shardVersionIncrementLocked returns how much the version of the shard is bumped by the operation under the policy of
+// the cluster.
+func (c *Cluster) shardVersionIncrementLocked(op ShardOperation) uint64 {
+	return c.options.ShardVersionPolicy.Increment(op)
+}
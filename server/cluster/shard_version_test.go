@@ -0,0 +1,90 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardVersionPolicyIncrement(t *testing.T) {
+	re := require.New(t)
+
+	ops := []ShardOperation{ShardOperationCreateTable, ShardOperationDropTable, ShardOperationAlterTable, ShardOperationMove}
+	cases := map[ShardVersionPolicy][]uint64{
+		"":                      {1, 1, 0, 1},
+		ShardVersionTableSet:    {1, 1, 0, 1},
+		ShardVersionEveryChange: {1, 1, 1, 1},
+		ShardVersionPlacement:   {0, 0, 0, 1},
+	}
+	for policy, increments := range cases {
+		re.True(policy.IsValid())
+		for i, op := range ops {
+			re.Equal(increments[i], policy.Increment(op), "policy:%s, op:%s", policy, op)
+		}
+	}
+	re.False(ShardVersionPolicy("unknown").IsValid())
+}
+
+func TestShardVersionPolicy(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	shardVersion := func(c *Cluster, shardID uint32) uint64 {
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return c.shardsCache[shardID].GetVersion()
+	}
+
+	opts := cluster.GetOptions()
+	opts.ShardVersionPolicy = "unknown"
+	re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, opts), coderr.InvalidParams))
+
+	// The alter bumps the version only if every change does.
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	version := shardVersion(cluster, table.GetShardID())
+	re.Equal(uint64(1), version)
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "t0", 0, []byte("v1"))
+	re.NoError(err)
+	re.Equal(version, shardVersion(cluster, table.GetShardID()))
+
+	opts.ShardVersionPolicy = ShardVersionEveryChange
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+	re.Equal(ShardVersionEveryChange, cluster.GetTopology(0).Topology.ShardVersionPolicy)
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "t0", 1, []byte("v2"))
+	re.NoError(err)
+	re.Equal(version+1, shardVersion(cluster, table.GetShardID()))
+
+	// The creations don't bump the version if only the placement does.
+	opts.ShardVersionPolicy = ShardVersionPlacement
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+	versions := make(map[uint32]uint64, testShardTotal)
+	for shardID := uint32(0); shardID < testShardTotal; shardID++ {
+		versions[shardID] = shardVersion(cluster, shardID)
+	}
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	version = shardVersion(cluster, table.GetShardID())
+	re.Equal(versions[table.GetShardID()], version)
+
+	// The policy is kept after the leader changes.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	reloadedCluster, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.Equal(ShardVersionPlacement, reloadedCluster.GetOptions().ShardVersionPolicy)
+	re.Equal(version, shardVersion(reloadedCluster, table.GetShardID()))
+}
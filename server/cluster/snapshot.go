@@ -0,0 +1,120 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Snapshot contains all the raw meta data of a cluster at some point in time.
+// The id allocators are not included, so that the ids allocated after the snapshot is taken won't be reused after the
+// snapshot is restored.
+type Snapshot struct {
+	ClusterID   uint32             `json:"cluster_id"`
+	ClusterName string             `json:"cluster_name"`
+	ShardTotal  uint32             `json:"shard_total"`
+	KeyValues   []storage.KeyValue `json:"key_values"`
+}
+
+// ExportSnapshot writes the json-encoded snapshot of the cluster into w.
+func (c *Cluster) ExportSnapshot(ctx context.Context, w io.Writer) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	kvs, err := c.storage.ListClusterKeyValues(ctx, c.clusterID)
+	if err != nil {
+		return errors.Wrapf(err, "list cluster key values, cluster:%s", c.metaData.GetName())
+	}
+
+	return writeSnapshot(w, c.metaData, kvs)
+}
+
+// ExportStorageSnapshot writes the json-encoded snapshot of the cluster of the name into w, which is read from the
+// storage directly without loading the cluster, e.g. by the tools outside the ceresmeta server.
+func ExportStorageSnapshot(ctx context.Context, s storage.Storage, clusterName string, w io.Writer) error {
+	clusters, err := s.ListClusters(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list clusters")
+	}
+	for _, meta := range clusters {
+		if meta.GetName() != clusterName {
+			continue
+		}
+		kvs, err := s.ListClusterKeyValues(ctx, meta.GetId())
+		if err != nil {
+			return errors.Wrapf(err, "list cluster key values, cluster:%s", clusterName)
+		}
+		return writeSnapshot(w, meta, kvs)
+	}
+	return ErrClusterNotFound.WithCausef("cluster:%s", clusterName)
+}
+
+func writeSnapshot(w io.Writer, meta *metapb.Cluster, kvs []storage.KeyValue) error {
+	// The keys are sorted so that the snapshots can be compared as streams.
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	snapshot := &Snapshot{
+		ClusterID:   meta.GetId(),
+		ClusterName: meta.GetName(),
+		ShardTotal:  meta.GetShardTotal(),
+		KeyValues:   kvs,
+	}
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		return ErrEncodeSnapshot.WithCause(err)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces all the meta data of the cluster with the snapshot read from r.
+// The snapshot must be taken from the same cluster with the same shard total, and the cluster is quiesced during the
+// restoring, that is to say, all the other operations on the cluster are blocked until the restoring is done.
+func (c *Cluster) RestoreSnapshot(ctx context.Context, r io.Reader) error {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return ErrDecodeSnapshot.WithCause(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	clusterName := c.metaData.GetName()
+	if snapshot.ClusterID != c.clusterID || snapshot.ClusterName != clusterName {
+		return ErrSnapshotMismatch.WithCausef("snapshot cluster:%s(%d), target cluster:%s(%d)",
+			snapshot.ClusterName, snapshot.ClusterID, clusterName, c.clusterID)
+	}
+	if snapshot.ShardTotal != c.metaData.GetShardTotal() {
+		return ErrSnapshotMismatch.WithCausef("snapshot shard total:%d, target shard total:%d, cluster:%s",
+			snapshot.ShardTotal, c.metaData.GetShardTotal(), clusterName)
+	}
+
+	log.Info("start to restore cluster from snapshot", zap.String("cluster", clusterName),
+		zap.Int("key-values", len(snapshot.KeyValues)))
+
+	if err := c.storage.ReplaceClusterKeyValues(ctx, c.clusterID, snapshot.KeyValues); err != nil {
+		return ErrRestoreCluster.WithCausef("replace cluster key values, cluster:%s, err:%v", clusterName, err)
+	}
+
+	meta, err := c.storage.GetCluster(ctx, c.clusterID)
+	if err != nil {
+		return ErrRestoreCluster.WithCausef("get cluster, cluster:%s, err:%v", clusterName, err)
+	}
+	if meta == nil || meta.GetName() != clusterName || meta.GetShardTotal() != snapshot.ShardTotal {
+		return ErrRestoreCluster.WithCausef("invalid cluster meta in snapshot, cluster:%s, meta:%v", clusterName, meta)
+	}
+	c.metaData = meta
+	if err := c.loadLocked(ctx); err != nil {
+		return ErrRestoreCluster.WithCausef("load cluster, cluster:%s, err:%v", clusterName, err)
+	}
+	c.resetTableRouteStatsLocked(ctx)
+
+	log.Info("finish restoring cluster from snapshot", zap.String("cluster", clusterName))
+	return nil
+}
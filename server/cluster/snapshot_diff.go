@@ -0,0 +1,537 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// KeyChangeType is how a key differs between two snapshots.
+type KeyChangeType string
+
+const (
+	KeyAdded    KeyChangeType = "added"
+	KeyRemoved  KeyChangeType = "removed"
+	KeyModified KeyChangeType = "modified"
+)
+
+// rawValueField is the name of the field holding the whole value which can't be decoded.
+const rawValueField = "value"
+
+// FieldChange is the change of a field of the decoded value. The elements added to or removed from a repeated field of
+// scalars are listed instead of the whole field, and the field of an absent value is empty.
+type FieldChange struct {
+	Field   string   `json:"field"`
+	Before  string   `json:"before,omitempty"`
+	After   string   `json:"after,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// KeyDiff is the change of a key, and the fields of an added or removed key are compared with an empty value.
+type KeyDiff struct {
+	Key string `json:"key"`
+	// Kind is the kind of the value, e.g. "table" or "shard", which is empty if it is unknown.
+	Kind   string        `json:"kind,omitempty"`
+	Type   KeyChangeType `json:"type"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// SnapshotInfo identifies the cluster a snapshot is taken from.
+type SnapshotInfo struct {
+	ClusterID   uint32 `json:"cluster_id"`
+	ClusterName string `json:"cluster_name"`
+	ShardTotal  uint32 `json:"shard_total"`
+	KeyValues   int    `json:"key_values"`
+}
+
+// KindDiff counts the keys of a kind added, removed and modified.
+type KindDiff struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Modified int `json:"modified"`
+}
+
+// SnapshotDiff is the difference from the snapshot Before to the snapshot After, and the keys are sorted.
+type SnapshotDiff struct {
+	Before   SnapshotInfo `json:"before"`
+	After    SnapshotInfo `json:"after"`
+	Added    int          `json:"added"`
+	Removed  int          `json:"removed"`
+	Modified int          `json:"modified"`
+	// Kinds are the changes of every kind of the keys, and the kind of the unknown keys is "unknown".
+	Kinds map[string]KindDiff `json:"kinds"`
+	Keys  []KeyDiff           `json:"keys"`
+}
+
+// errSnapshotUnsorted is returned by the streaming comparison if the keys of a snapshot are not sorted.
+var errSnapshotUnsorted = errors.New("keys of snapshot are not sorted")
+
+// DiffSnapshots compares the snapshots exported by the ExportSnapshot. The values of the protobuf messages are compared
+// field by field, and so are the json-encoded objects, while the other values are compared as a whole.
+// The snapshots are read as streams and merged by the keys, so neither of them is loaded into memory as a whole, which
+// requires the keys to be sorted as the ExportSnapshot does. The snapshots exported before the keys are sorted are
+// loaded into memory if both the readers are seekable, e.g. files, and ErrDecodeSnapshot is returned otherwise.
+func DiffSnapshots(ctx context.Context, a, b io.Reader) (*SnapshotDiff, error) {
+	diff, err := diffSortedSnapshots(ctx, a, b)
+	if !errors.Is(err, errSnapshotUnsorted) {
+		return diff, err
+	}
+
+	for _, r := range []io.Reader{a, b} {
+		seeker, ok := r.(io.Seeker)
+		if !ok {
+			return nil, ErrDecodeSnapshot.WithCause(err)
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, ErrDecodeSnapshot.WithCause(err)
+		}
+	}
+	return diffSnapshotsInMemory(ctx, a, b)
+}
+
+func diffSortedSnapshots(ctx context.Context, a, b io.Reader) (*SnapshotDiff, error) {
+	before, after := newSnapshotReader(a), newSnapshotReader(b)
+	if err := before.open(); err != nil {
+		return nil, err
+	}
+	if err := after.open(); err != nil {
+		return nil, err
+	}
+
+	diff := newSnapshotDiff()
+	beforeKV, err := before.next()
+	if err != nil {
+		return nil, err
+	}
+	afterKV, err := after.next()
+	if err != nil {
+		return nil, err
+	}
+	for beforeKV != nil || afterKV != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case afterKV == nil || (beforeKV != nil && beforeKV.Key < afterKV.Key):
+			diff.compareKey(beforeKV.Key, beforeKV.Value, nil, true, false)
+			beforeKV, err = before.next()
+		case beforeKV == nil || afterKV.Key < beforeKV.Key:
+			diff.compareKey(afterKV.Key, nil, afterKV.Value, false, true)
+			afterKV, err = after.next()
+		default:
+			diff.compareKey(beforeKV.Key, beforeKV.Value, afterKV.Value, true, true)
+			if beforeKV, err = before.next(); err == nil {
+				afterKV, err = after.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	diff.Before, diff.After = before.info, after.info
+	return diff, nil
+}
+
+func diffSnapshotsInMemory(ctx context.Context, a, b io.Reader) (*SnapshotDiff, error) {
+	before, err := decodeSnapshot(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodeSnapshot(b)
+	if err != nil {
+		return nil, err
+	}
+
+	beforeValues := make(map[string][]byte, len(before.KeyValues))
+	for _, kv := range before.KeyValues {
+		beforeValues[kv.Key] = kv.Value
+	}
+	afterValues := make(map[string][]byte, len(after.KeyValues))
+	keys := make([]string, 0, len(before.KeyValues)+len(after.KeyValues))
+	for _, kv := range after.KeyValues {
+		afterValues[kv.Key] = kv.Value
+		if _, ok := beforeValues[kv.Key]; !ok {
+			keys = append(keys, kv.Key)
+		}
+	}
+	for key := range beforeValues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diff := newSnapshotDiff()
+	diff.Before, diff.After = before.info(), after.info()
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		beforeValue, inBefore := beforeValues[key]
+		afterValue, inAfter := afterValues[key]
+		diff.compareKey(key, beforeValue, afterValue, inBefore, inAfter)
+	}
+	return diff, nil
+}
+
+func newSnapshotDiff() *SnapshotDiff {
+	return &SnapshotDiff{Kinds: make(map[string]KindDiff), Keys: make([]KeyDiff, 0)}
+}
+
+// compareKey appends the change of the key, which must be greater than the keys compared before.
+func (d *SnapshotDiff) compareKey(key string, beforeValue, afterValue []byte, inBefore, inAfter bool) {
+	keyDiff := KeyDiff{Key: key, Kind: storage.KeyKind(key)}
+	kind := keyDiff.Kind
+	if kind == "" {
+		kind = "unknown"
+	}
+	kindDiff := d.Kinds[kind]
+	switch {
+	case !inAfter:
+		keyDiff.Type = KeyRemoved
+		d.Removed++
+		kindDiff.Removed++
+	case !inBefore:
+		keyDiff.Type = KeyAdded
+		d.Added++
+		kindDiff.Added++
+	case bytes.Equal(beforeValue, afterValue):
+		return
+	default:
+		keyDiff.Type = KeyModified
+		d.Modified++
+		kindDiff.Modified++
+	}
+	d.Kinds[kind] = kindDiff
+
+	keyDiff.Fields = diffValues(keyDiff.Kind, beforeValue, afterValue)
+	// The fields of the absent value are only the defaults, which are not worth reporting.
+	for i := range keyDiff.Fields {
+		switch keyDiff.Type {
+		case KeyAdded:
+			keyDiff.Fields[i].Before = ""
+		case KeyRemoved:
+			keyDiff.Fields[i].After = ""
+		}
+	}
+	d.Keys = append(d.Keys, keyDiff)
+}
+
+// DiffSnapshot compares the snapshot read from r with the live meta data of the cluster, that is to say, the snapshot
+// is the before one.
+func (c *Cluster) DiffSnapshot(ctx context.Context, r io.Reader) (*SnapshotDiff, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.ExportSnapshot(ctx, pw))
+	}()
+	// The export is stopped if the comparison fails before reading all of it.
+	defer pr.Close()
+
+	return DiffSnapshots(ctx, r, pr)
+}
+
+// WriteText writes the diff in the form of a unified diff, where the added keys are marked by "+", the removed ones by
+// "-" and the modified ones by "~".
+func (d *SnapshotDiff) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s(%d), shard total:%d, key values:%d\n", d.Before.ClusterName, d.Before.ClusterID,
+		d.Before.ShardTotal, d.Before.KeyValues)
+	fmt.Fprintf(&buf, "+++ %s(%d), shard total:%d, key values:%d\n", d.After.ClusterName, d.After.ClusterID,
+		d.After.ShardTotal, d.After.KeyValues)
+	fmt.Fprintf(&buf, "added:%d, removed:%d, modified:%d\n", d.Added, d.Removed, d.Modified)
+	kinds := make([]string, 0, len(d.Kinds))
+	for kind := range d.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(&buf, "  %s: added:%d, removed:%d, modified:%d\n", kind, d.Kinds[kind].Added, d.Kinds[kind].Removed,
+			d.Kinds[kind].Modified)
+	}
+
+	marks := map[KeyChangeType]string{KeyAdded: "+", KeyRemoved: "-", KeyModified: "~"}
+	for _, key := range d.Keys {
+		kind := key.Kind
+		if kind == "" {
+			kind = "unknown"
+		}
+		fmt.Fprintf(&buf, "%s %s (%s)\n", marks[key.Type], key.Key, kind)
+		for _, field := range key.Fields {
+			switch {
+			case len(field.Added) > 0 || len(field.Removed) > 0:
+				fmt.Fprintf(&buf, "    %s: +[%s] -[%s]\n", field.Field, strings.Join(field.Added, " "), strings.Join(field.Removed, " "))
+			case key.Type == KeyAdded:
+				fmt.Fprintf(&buf, "    %s: %s\n", field.Field, field.After)
+			case key.Type == KeyRemoved:
+				fmt.Fprintf(&buf, "    %s: %s\n", field.Field, field.Before)
+			default:
+				fmt.Fprintf(&buf, "    %s: %s -> %s\n", field.Field, field.Before, field.After)
+			}
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// snapshotReader reads the key values of the snapshot one by one, and the info of the snapshot is complete once all
+// the key values are read.
+type snapshotReader struct {
+	dec  *json.Decoder
+	info SnapshotInfo
+	// inKeyValues is set while the key values are being read, and done is set once the whole snapshot is read.
+	inKeyValues bool
+	done        bool
+	lastKey     string
+}
+
+func newSnapshotReader(r io.Reader) *snapshotReader {
+	return &snapshotReader{dec: json.NewDecoder(r)}
+}
+
+func (r *snapshotReader) open() error {
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+	return r.readFields()
+}
+
+// next returns the next key value, and nil is returned once all the key values are read.
+func (r *snapshotReader) next() (*storage.KeyValue, error) {
+	for !r.done {
+		if !r.inKeyValues {
+			if err := r.readFields(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !r.dec.More() {
+			if err := r.expectDelim(']'); err != nil {
+				return nil, err
+			}
+			r.inKeyValues = false
+			continue
+		}
+
+		kv := &storage.KeyValue{}
+		if err := r.dec.Decode(kv); err != nil {
+			return nil, ErrDecodeSnapshot.WithCause(err)
+		}
+		if r.info.KeyValues > 0 && kv.Key <= r.lastKey {
+			return nil, errors.Wrapf(errSnapshotUnsorted, "key:%s, previous key:%s", kv.Key, r.lastKey)
+		}
+		r.lastKey = kv.Key
+		r.info.KeyValues++
+		return kv, nil
+	}
+	return nil, nil
+}
+
+// readFields reads the fields of the snapshot until the start of the key values or the end of the snapshot.
+func (r *snapshotReader) readFields() error {
+	for r.dec.More() {
+		token, err := r.dec.Token()
+		if err != nil {
+			return ErrDecodeSnapshot.WithCause(err)
+		}
+		switch token {
+		case "cluster_id":
+			err = r.dec.Decode(&r.info.ClusterID)
+		case "cluster_name":
+			err = r.dec.Decode(&r.info.ClusterName)
+		case "shard_total":
+			err = r.dec.Decode(&r.info.ShardTotal)
+		case "key_values":
+			token, err := r.dec.Token()
+			if err != nil {
+				return ErrDecodeSnapshot.WithCause(err)
+			}
+			if token == nil {
+				continue
+			}
+			if delim, ok := token.(json.Delim); !ok || delim != '[' {
+				return ErrDecodeSnapshot.WithCausef("key values are not an array, token:%v", token)
+			}
+			r.inKeyValues = true
+			return nil
+		default:
+			var skipped json.RawMessage
+			err = r.dec.Decode(&skipped)
+		}
+		if err != nil {
+			return ErrDecodeSnapshot.WithCause(err)
+		}
+	}
+	if err := r.expectDelim('}'); err != nil {
+		return err
+	}
+	r.done = true
+	return nil
+}
+
+func (r *snapshotReader) expectDelim(delim json.Delim) error {
+	token, err := r.dec.Token()
+	if err != nil {
+		return ErrDecodeSnapshot.WithCause(err)
+	}
+	if token != delim {
+		return ErrDecodeSnapshot.WithCausef("expect:%v, got:%v", delim, token)
+	}
+	return nil
+}
+
+func decodeSnapshot(r io.Reader) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, ErrDecodeSnapshot.WithCause(err)
+	}
+	return snapshot, nil
+}
+
+func (s *Snapshot) info() SnapshotInfo {
+	return SnapshotInfo{
+		ClusterID:   s.ClusterID,
+		ClusterName: s.ClusterName,
+		ShardTotal:  s.ShardTotal,
+		KeyValues:   len(s.KeyValues),
+	}
+}
+
+// diffValues compares the values of the kind, and the absent value is nil. The values are compared as a whole if
+// either of them can't be decoded.
+func diffValues(kind string, before, after []byte) []FieldChange {
+	if msg := storage.NewValueMessage(kind); msg != nil {
+		beforeMsg, afterMsg := msg, proto.Clone(msg)
+		if proto.Unmarshal(before, beforeMsg) == nil && proto.Unmarshal(after, afterMsg) == nil {
+			return diffMessageFields(beforeMsg.ProtoReflect(), afterMsg.ProtoReflect())
+		}
+	}
+
+	var beforeObj, afterObj map[string]json.RawMessage
+	if (before == nil || json.Unmarshal(before, &beforeObj) == nil) && (after == nil || json.Unmarshal(after, &afterObj) == nil) &&
+		(beforeObj != nil || afterObj != nil) {
+		return diffObjectFields(beforeObj, afterObj)
+	}
+
+	if bytes.Equal(before, after) {
+		return nil
+	}
+	return []FieldChange{{Field: rawValueField, Before: string(before), After: string(after)}}
+}
+
+func diffMessageFields(before, after protoreflect.Message) []FieldChange {
+	var changes []FieldChange
+	fields := before.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.IsList() && fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind {
+			added, removed := diffLists(formatList(before, fd), formatList(after, fd))
+			if len(added) > 0 || len(removed) > 0 {
+				changes = append(changes, FieldChange{Field: string(fd.Name()), Added: added, Removed: removed})
+			}
+			continue
+		}
+		beforeValue, afterValue := formatField(before, fd), formatField(after, fd)
+		if beforeValue != afterValue {
+			changes = append(changes, FieldChange{Field: string(fd.Name()), Before: beforeValue, After: afterValue})
+		}
+	}
+	return changes
+}
+
+func diffObjectFields(before, after map[string]json.RawMessage) []FieldChange {
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []FieldChange
+	for _, name := range names {
+		beforeValue, afterValue := string(before[name]), string(after[name])
+		if beforeValue != afterValue {
+			changes = append(changes, FieldChange{Field: name, Before: beforeValue, After: afterValue})
+		}
+	}
+	return changes
+}
+
+// diffLists returns the elements only in the after and the elements only in the before, and the duplicated elements
+// are counted.
+func diffLists(before, after []string) (added, removed []string) {
+	counts := make(map[string]int, len(before))
+	for _, v := range before {
+		counts[v]++
+	}
+	for _, v := range after {
+		if counts[v] > 0 {
+			counts[v]--
+			continue
+		}
+		added = append(added, v)
+	}
+	for _, v := range before {
+		if counts[v] > 0 {
+			counts[v]--
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+// formatField formats the field of the message, and the field not set is formatted as its default value.
+func formatField(m protoreflect.Message, fd protoreflect.FieldDescriptor) string {
+	v := m.Get(fd)
+	switch {
+	case fd.IsList():
+		return "[" + strings.Join(formatList(m, fd), ", ") + "]"
+	case fd.IsMap():
+		return fmt.Sprint(v.Interface())
+	default:
+		return formatScalar(fd, v)
+	}
+}
+
+func formatList(m protoreflect.Message, fd protoreflect.FieldDescriptor) []string {
+	list := m.Get(fd).List()
+	values := make([]string, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		values = append(values, formatScalar(fd, list.Get(i)))
+	}
+	return values
+}
+
+func formatScalar(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "{" + strings.TrimSpace(prototext.MarshalOptions{}.Format(v.Message().Interface())) + "}"
+	case protoreflect.EnumKind:
+		if value := fd.Enum().Values().ByNumber(v.Enum()); value != nil {
+			return string(value.Name())
+		}
+		return fmt.Sprint(v.Enum())
+	case protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%q", v.Bytes())
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
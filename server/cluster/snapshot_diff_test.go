@@ -0,0 +1,209 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update the golden files of the tests")
+
+func TestDiffSnapshots(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	opts := cluster.GetOptions()
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+	var before bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, testClusterName, &before))
+
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "later", 0)
+	re.NoError(err)
+	opts.MaxTopologyGenerationLag = 10
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+	var after bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, testClusterName, &after))
+
+	diff, err := DiffSnapshots(ctx, bytes.NewReader(before.Bytes()), bytes.NewReader(after.Bytes()))
+	re.NoError(err)
+	re.Equal(testClusterName, diff.After.ClusterName)
+	re.Equal(0, diff.Removed)
+	re.Equal(diff.Added+diff.Modified, len(diff.Keys))
+
+	byKind := make(map[string][]KeyDiff)
+	for _, key := range diff.Keys {
+		byKind[key.Kind] = append(byKind[key.Kind], key)
+	}
+	// The new table and schema are added with their fields.
+	re.Len(byKind["table"], 1)
+	re.Equal(KeyAdded, byKind["table"][0].Type)
+	re.Contains(byKind["table"][0].Fields, FieldChange{Field: "name", After: `"t1"`})
+	re.Len(byKind["schema"], 1)
+	re.Equal(KeyAdded, byKind["schema"][0].Type)
+	// The table is placed on its shard whose version is bumped.
+	re.Len(byKind["shard"], 1)
+	shardDiff := byKind["shard"][0]
+	re.Equal(KeyModified, shardDiff.Type)
+	re.Contains(shardDiff.Fields, FieldChange{Field: "table_ids", Added: []string{strconv.FormatUint(table.GetID(), 10)}})
+	re.Contains(shardDiff.Fields, FieldChange{Field: "version", Before: "0", After: "1"})
+	// The json-encoded options are compared field by field.
+	re.Len(byKind["options"], 1)
+	re.Equal(KeyModified, byKind["options"][0].Type)
+	re.Equal([]FieldChange{{Field: "max_topology_generation_lag", Before: "0", After: "10"}}, byKind["options"][0].Fields)
+
+	// The diff is machine-readable and human-friendly.
+	encoded, err := json.Marshal(diff)
+	re.NoError(err)
+	decoded := &SnapshotDiff{}
+	re.NoError(json.Unmarshal(encoded, decoded))
+	re.Equal(diff, decoded)
+	var text bytes.Buffer
+	re.NoError(diff.WriteText(&text))
+	re.Contains(text.String(), "+ "+byKind["table"][0].Key+" (table)\n")
+	re.Contains(text.String(), "    table_ids: +["+strconv.FormatUint(table.GetID(), 10)+"] -[]\n")
+	re.Contains(text.String(), "    version: 0 -> 1\n")
+
+	// The diff in the reverse direction removes the keys added.
+	reversed, err := DiffSnapshots(ctx, bytes.NewReader(after.Bytes()), bytes.NewReader(before.Bytes()))
+	re.NoError(err)
+	re.Equal(diff.Added, reversed.Removed)
+	re.Equal(diff.Modified, reversed.Modified)
+
+	same, err := DiffSnapshots(ctx, bytes.NewReader(after.Bytes()), bytes.NewReader(after.Bytes()))
+	re.NoError(err)
+	re.Empty(same.Keys)
+
+	// The dump is compared with the live cluster.
+	live, err := manager.DiffClusterSnapshot(ctx, testClusterName, bytes.NewReader(before.Bytes()))
+	re.NoError(err)
+	re.Equal(diff.Keys, live.Keys)
+	live, err = manager.DiffClusterSnapshot(ctx, testClusterName, bytes.NewReader(after.Bytes()))
+	re.NoError(err)
+	re.Empty(live.Keys)
+
+	_, err = DiffSnapshots(ctx, strings.NewReader("{"), bytes.NewReader(after.Bytes()))
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
+
+// synthesizeSnapshot returns the key values of a synthesized snapshot of the cluster 1, and the snapshot taken later
+// has changed the schemas, the tables, the shards, the owners and the options.
+func synthesizeSnapshot(re *require.Assertions, later bool) (*metapb.Cluster, []storage.KeyValue) {
+	key := func(segments ...string) string {
+		return path.Join(append([]string{"v1/cluster", fmt.Sprintf("%020d", 1)}, segments...)...)
+	}
+	id := func(id uint64) string { return fmt.Sprintf("%020d", id) }
+	kvs := make([]storage.KeyValue, 0)
+	put := func(key string, msg proto.Message) {
+		value, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		re.NoError(err)
+		kvs = append(kvs, storage.KeyValue{Key: key, Value: value})
+	}
+	putRaw := func(key, value string) {
+		kvs = append(kvs, storage.KeyValue{Key: key, Value: []byte(value)})
+	}
+
+	meta := &metapb.Cluster{Id: 1, Name: "golden", MinNodeCount: 2, ReplicationFactor: 1, ShardTotal: 2}
+	put(path.Join("v1/cluster_meta", id(1)), meta)
+	put(key("schema", id(1)), &metapb.Schema{Id: 1, ClusterId: 1, Name: "public"})
+	put(key("table", id(1), id(1)), &metapb.Table{Id: 1, Name: "t0", SchemaId: 1, ShardId: 0})
+	if later {
+		put(key("schema", id(2)), &metapb.Schema{Id: 2, ClusterId: 1, Name: "later"})
+		put(key("table", id(1), id(3)), &metapb.Table{Id: 3, Name: "t2", SchemaId: 1, ShardId: 0})
+		put(key("shard", id(0)), &metapb.ShardTopology{TableIds: []uint64{1, 3}, Version: 2})
+		put(key("shard", id(1)), &metapb.ShardTopology{Version: 2})
+		putRaw(key("shard_owner", id(1)), `{"node":"b","version":2}`)
+		putRaw(key("options"), `{"max_topology_generation_lag":10}`)
+		putRaw(key("misc"), "after")
+	} else {
+		put(key("table", id(1), id(2)), &metapb.Table{Id: 2, Name: "t1", SchemaId: 1, ShardId: 1})
+		put(key("shard", id(0)), &metapb.ShardTopology{TableIds: []uint64{1}, Version: 1})
+		put(key("shard", id(1)), &metapb.ShardTopology{TableIds: []uint64{2}, Version: 1})
+		putRaw(key("shard_owner", id(1)), `{"node":"a","version":1}`)
+		putRaw(key("options"), `{"max_topology_generation_lag":0}`)
+		putRaw(key("misc"), "before")
+	}
+	return meta, kvs
+}
+
+// nonSeekableReader hides the Seek of the reader, so the snapshot can only be read as a stream.
+type nonSeekableReader struct {
+	io.Reader
+}
+
+func TestDiffSnapshotsGolden(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	dumps := make([][]byte, 0, 2)
+	unsortedDumps := make([][]byte, 0, 2)
+	for _, later := range []bool{false, true} {
+		meta, kvs := synthesizeSnapshot(re, later)
+		// The exported dumps before the keys are sorted have the cluster meta at first.
+		unsorted, err := json.Marshal(&Snapshot{ClusterID: 1, ClusterName: "golden", ShardTotal: 2, KeyValues: kvs})
+		re.NoError(err)
+		unsortedDumps = append(unsortedDumps, unsorted)
+		var dump bytes.Buffer
+		re.NoError(writeSnapshot(&dump, meta, kvs))
+		dumps = append(dumps, dump.Bytes())
+	}
+
+	// The sorted dumps are compared as streams.
+	diff, err := DiffSnapshots(ctx, nonSeekableReader{bytes.NewReader(dumps[0])}, nonSeekableReader{bytes.NewReader(dumps[1])})
+	re.NoError(err)
+	var text bytes.Buffer
+	re.NoError(diff.WriteText(&text))
+	encoded, err := json.MarshalIndent(diff, "", "  ")
+	re.NoError(err)
+	encoded = append(encoded, '\n')
+
+	goldenText := filepath.Join("testdata", "snapshot_diff.golden.txt")
+	goldenJSON := filepath.Join("testdata", "snapshot_diff.golden.json")
+	if *updateGolden {
+		re.NoError(os.WriteFile(goldenText, text.Bytes(), 0o600))
+		re.NoError(os.WriteFile(goldenJSON, encoded, 0o600))
+	}
+	expectText, err := os.ReadFile(goldenText)
+	re.NoError(err)
+	re.Equal(string(expectText), text.String())
+	expectJSON, err := os.ReadFile(goldenJSON)
+	re.NoError(err)
+	re.Equal(string(expectJSON), string(encoded))
+
+	// The unsorted dumps can't be compared as streams, but they are loaded into memory if they can be read again.
+	_, err = DiffSnapshots(ctx, nonSeekableReader{bytes.NewReader(unsortedDumps[0])}, bytes.NewReader(dumps[1]))
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	loaded, err := DiffSnapshots(ctx, bytes.NewReader(unsortedDumps[0]), bytes.NewReader(unsortedDumps[1]))
+	re.NoError(err)
+	re.Equal(diff, loaded)
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreClusterFromSnapshot(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	const otherClusterName = "ceresdbCluster2"
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateCluster(ctx, otherClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table0, err := manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	var snapshot bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, testClusterName, &snapshot))
+	var otherSnapshot bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, otherClusterName, &otherSnapshot))
+
+	// Changes made after the snapshot is taken.
+	table1, err := manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "later", 0)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, otherClusterName, "other", 0)
+	re.NoError(err)
+
+	// The restoring must be confirmed with the cluster name.
+	err = manager.RestoreClusterFromSnapshot(ctx, testClusterName, bytes.NewReader(snapshot.Bytes()), "wrong")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	// The snapshot of another cluster is refused.
+	err = manager.RestoreClusterFromSnapshot(ctx, testClusterName, bytes.NewReader(otherSnapshot.Bytes()), testClusterName)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	re.NoError(manager.RestoreClusterFromSnapshot(ctx, testClusterName, bytes.NewReader(snapshot.Bytes()), testClusterName))
+
+	check := func(m Manager) {
+		stats, err := m.GetSchemaStats(ctx, testClusterName, "public")
+		re.NoError(err)
+		total := 0
+		for _, count := range stats.ShardTableCounts {
+			total += count
+		}
+		re.Equal(1, total)
+		_, err = m.GetSchemaStats(ctx, testClusterName, "later")
+		re.Error(err)
+
+		// The other cluster is untouched.
+		_, err = m.GetSchemaStats(ctx, otherClusterName, "other")
+		re.NoError(err)
+	}
+	check(manager)
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	check(reloaded)
+
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(table0.GetID(), table.GetID())
+	// The ids allocated after the snapshot is taken are not reused.
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+	re.Greater(table.GetID(), table1.GetID())
+}
+
+func TestRestoreClusterPartially(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table0, err := manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	var snapshot bytes.Buffer
+	re.NoError(manager.ExportClusterSnapshot(ctx, testClusterName, &snapshot))
+
+	// The key-values exceeding a transaction are replaced in batches, and the value too large for the etcd fails the
+	// last batch after the first ones are replaced.
+	broken := &Snapshot{}
+	re.NoError(json.Unmarshal(snapshot.Bytes(), broken))
+	var prefix string
+	for _, kv := range broken.KeyValues {
+		if i := strings.Index(kv.Key, "/schema/"); i >= 0 {
+			prefix = kv.Key[:i+1]
+		}
+	}
+	re.NotEmpty(prefix)
+	for i := 0; i < 200; i++ {
+		broken.KeyValues = append(broken.KeyValues, storage.KeyValue{Key: fmt.Sprintf("%sjunk/%03d", prefix, i)})
+	}
+	broken.KeyValues = append(broken.KeyValues, storage.KeyValue{Key: prefix + "junk/last", Value: make([]byte, 4<<20)})
+	brokenSnapshot, err := json.Marshal(broken)
+	re.NoError(err)
+
+	err = manager.RestoreClusterFromSnapshot(ctx, testClusterName, bytes.NewReader(brokenSnapshot), testClusterName)
+	re.Error(err)
+	for _, m := range []Manager{manager, NewManagerImpl(s, testRootPath)} {
+		re.NoError(m.Load(ctx))
+		_, err = m.GetCluster(ctx, testClusterName)
+		re.True(coderr.Is(err, ErrPartiallyRestored.Code()))
+		_, err = m.AllocTableID(ctx, testClusterName, "public", "table0")
+		re.Error(err)
+	}
+
+	// Restoring the snapshot again makes the cluster accessible.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	re.NoError(reloaded.RestoreClusterFromSnapshot(ctx, testClusterName, bytes.NewReader(snapshot.Bytes()), testClusterName))
+	table, err := reloaded.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(table0.GetID(), table.GetID())
+}
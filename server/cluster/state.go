@@ -0,0 +1,189 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ClusterState is the base state of the cluster, which goes EMPTY -> PREPARING -> STABLE as the nodes join and own
+// the shards, and falls back to PREPARING if any shard loses its owner.
+type ClusterState string
+
+const (
+	// ClusterStateEmpty means no node has joined and no shard is owned.
+	ClusterStateEmpty ClusterState = "EMPTY"
+	// ClusterStatePreparing means some shards are not owned by any node.
+	ClusterStatePreparing ClusterState = "PREPARING"
+	// ClusterStateStable means all the shards are owned.
+	ClusterStateStable ClusterState = "STABLE"
+)
+
+// allowedTransitions are the base states allowed to transit to from every base state.
+var allowedTransitions = map[ClusterState][]ClusterState{
+	ClusterStateEmpty:     {ClusterStatePreparing},
+	ClusterStatePreparing: {ClusterStateStable, ClusterStateEmpty},
+	ClusterStateStable:    {ClusterStatePreparing},
+}
+
+// AllowedNextStates returns the base states allowed to transit to from the state.
+func AllowedNextStates(state ClusterState) []ClusterState {
+	return append([]ClusterState(nil), allowedTransitions[state]...)
+}
+
+// ClusterStatus is the base state of the cluster with the modifiers orthogonal to it.
+type ClusterStatus struct {
+	State ClusterState `json:"state"`
+	// Maintenance pauses the automatic assignment of the shards, and it can't be set in the EMPTY state.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Degraded is set if the alive nodes are below the thresholds of the options, and the DDLs are rejected.
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+func defaultClusterStatus() ClusterStatus {
+	return ClusterStatus{State: ClusterStateEmpty}
+}
+
+// validateTransition returns ErrIllegalTransition with the allowed next states if the cluster can't transit from the
+// status to the next one. Staying in the same base state is always allowed.
+func validateTransition(from, to ClusterStatus) error {
+	allowed, ok := allowedTransitions[from.State]
+	if !ok {
+		return ErrIllegalTransition.WithCausef("unknown state:%s", from.State)
+	}
+	if _, ok := allowedTransitions[to.State]; !ok {
+		return ErrIllegalTransition.WithCausef("unknown state:%s", to.State)
+	}
+	if from.State != to.State && !containsState(allowed, to.State) {
+		return ErrIllegalTransition.WithCausef("from:%s, to:%s, allowed next states:%v", from.State, to.State, allowed)
+	}
+	if to.Maintenance && to.State == ClusterStateEmpty {
+		return ErrIllegalTransition.WithCausef("maintenance in state:%s, allowed states:%v", to.State,
+			[]ClusterState{ClusterStatePreparing, ClusterStateStable})
+	}
+	return nil
+}
+
+func containsState(states []ClusterState, state ClusterState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStatus returns the current status of the cluster.
+func (c *Cluster) GetStatus() ClusterStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.status
+}
+
+// SetMaintenance enters or leaves the maintenance mode of the cluster.
+func (c *Cluster) SetMaintenance(ctx context.Context, enabled bool, reason string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	next := c.status
+	next.Maintenance = enabled
+	return c.transitionLocked(ctx, next, reason)
+}
+
+// transitionLocked is the only way to change the status of the cluster. The status is validated and persisted before
+// it takes effect, and every change is logged for auditing.
+func (c *Cluster) transitionLocked(ctx context.Context, next ClusterStatus, reason string) error {
+	prev := c.status
+	if prev == next {
+		return nil
+	}
+	if err := validateTransition(prev, next); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(next)
+	if err != nil {
+		return ErrEncodeClusterStatus.WithCausef("status:%v, err:%v", next, err)
+	}
+	if err := c.storage.PutClusterStatus(ctx, c.clusterID, string(value)); err != nil {
+		return errors.Wrapf(err, "put cluster status, status:%s", value)
+	}
+	c.status = next
+	log.Info("cluster status transition", zap.String("cluster", c.metaData.GetName()),
+		zap.String("from", string(prev.State)), zap.String("to", string(next.State)),
+		zap.Bool("maintenance", next.Maintenance), zap.Bool("degraded", next.Degraded), zap.String("reason", reason))
+	return nil
+}
+
+// deriveStateLocked returns the base state decided by the registered nodes and the owners of the shards.
+func (c *Cluster) deriveStateLocked() ClusterState {
+	owned := 0
+	for _, shard := range c.shardsCache {
+		if shard.node != "" {
+			owned++
+		}
+	}
+	switch {
+	case len(c.nodesCache) == 0 && owned == 0:
+		return ClusterStateEmpty
+	case owned == len(c.shardsCache):
+		return ClusterStateStable
+	default:
+		return ClusterStatePreparing
+	}
+}
+
+// syncStateLocked moves the base state towards the derived one through the allowed transitions. The maintenance mode
+// is left when the cluster becomes EMPTY.
+func (c *Cluster) syncStateLocked(ctx context.Context, reason string) {
+	target := c.deriveStateLocked()
+	for c.status.State != target {
+		next := c.status
+		next.State = ClusterStatePreparing
+		if containsState(allowedTransitions[c.status.State], target) {
+			next.State = target
+		}
+		if next.State == ClusterStateEmpty {
+			next.Maintenance = false
+		}
+		if err := c.transitionLocked(ctx, next, reason); err != nil {
+			log.Warn("fail to sync cluster state", zap.String("cluster", c.metaData.GetName()),
+				zap.String("target", string(target)), zap.Error(err))
+			return
+		}
+	}
+}
+
+// setDegradedLocked updates the degraded modifier of the status, and the failure is only logged because the
+// modifier is derived from the nodes again in the next check.
+func (c *Cluster) setDegradedLocked(ctx context.Context, degraded bool, reason string) {
+	next := c.status
+	next.Degraded = degraded
+	if err := c.transitionLocked(ctx, next, reason); err != nil {
+		log.Warn("fail to update degraded status", zap.String("cluster", c.metaData.GetName()),
+			zap.Bool("degraded", degraded), zap.Error(err))
+	}
+}
+
+// loadStatus loads the persisted status, and the default status is returned if not exists.
+func (c *Cluster) loadStatus(ctx context.Context) (ClusterStatus, error) {
+	value, err := c.storage.GetClusterStatus(ctx, c.clusterID)
+	if err != nil {
+		return ClusterStatus{}, errors.Wrap(err, "get cluster status")
+	}
+	if value == "" {
+		return defaultClusterStatus(), nil
+	}
+
+	status := ClusterStatus{}
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return ClusterStatus{}, ErrDecodeClusterStatus.WithCausef("status:%s, err:%v", value, err)
+	}
+	return status, nil
+}
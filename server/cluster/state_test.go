@@ -0,0 +1,119 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTransition(t *testing.T) {
+	re := require.New(t)
+
+	empty, preparing, stable := ClusterStateEmpty, ClusterStatePreparing, ClusterStateStable
+	cases := []struct {
+		from  ClusterStatus
+		to    ClusterStatus
+		legal bool
+	}{
+		{ClusterStatus{State: empty}, ClusterStatus{State: empty}, true},
+		{ClusterStatus{State: empty}, ClusterStatus{State: preparing}, true},
+		{ClusterStatus{State: empty}, ClusterStatus{State: stable}, false},
+		{ClusterStatus{State: preparing}, ClusterStatus{State: empty}, true},
+		{ClusterStatus{State: preparing}, ClusterStatus{State: preparing}, true},
+		{ClusterStatus{State: preparing}, ClusterStatus{State: stable}, true},
+		{ClusterStatus{State: stable}, ClusterStatus{State: empty}, false},
+		{ClusterStatus{State: stable}, ClusterStatus{State: preparing}, true},
+		{ClusterStatus{State: stable}, ClusterStatus{State: stable}, true},
+
+		// The modifiers.
+		{ClusterStatus{State: empty}, ClusterStatus{State: empty, Maintenance: true}, false},
+		{ClusterStatus{State: empty}, ClusterStatus{State: empty, Degraded: true}, true},
+		{ClusterStatus{State: preparing}, ClusterStatus{State: preparing, Maintenance: true, Degraded: true}, true},
+		{ClusterStatus{State: preparing, Maintenance: true}, ClusterStatus{State: empty, Maintenance: true}, false},
+		{ClusterStatus{State: preparing, Maintenance: true}, ClusterStatus{State: empty}, true},
+		{ClusterStatus{State: stable, Maintenance: true}, ClusterStatus{State: stable}, true},
+		{ClusterStatus{State: stable, Degraded: true}, ClusterStatus{State: preparing, Degraded: true}, true},
+
+		// The unknown states.
+		{ClusterStatus{State: "UNKNOWN"}, ClusterStatus{State: empty}, false},
+		{ClusterStatus{State: empty}, ClusterStatus{State: "UNKNOWN"}, false},
+	}
+	for _, c := range cases {
+		err := validateTransition(c.from, c.to)
+		if c.legal {
+			re.NoError(err, "from:%v, to:%v", c.from, c.to)
+		} else {
+			re.True(coderr.Is(err, coderr.InvalidParams), "from:%v, to:%v", c.from, c.to)
+		}
+	}
+
+	err := validateTransition(ClusterStatus{State: stable}, ClusterStatus{State: empty})
+	re.Contains(err.Error(), "allowed next states:[PREPARING]")
+	re.Equal([]ClusterState{stable, empty}, AllowedNextStates(preparing))
+}
+
+func TestClusterStatus(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	re.Equal(ClusterStatus{State: ClusterStateEmpty}, cluster.GetStatus())
+	re.True(coderr.Is(manager.SetClusterMaintenance(ctx, testClusterName, true, "test"), coderr.InvalidParams))
+
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < 4; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	re.Equal(ClusterStatePreparing, cluster.GetStatus().State)
+
+	// Nothing is assigned automatically in the maintenance mode.
+	re.NoError(manager.SetClusterMaintenance(ctx, testClusterName, true, "test"))
+	assignments, err := cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	re.Empty(assignments)
+
+	re.NoError(manager.SetClusterMaintenance(ctx, testClusterName, false, "test"))
+	assignments, err = cluster.AutoAssignShards(ctx, 0)
+	re.NoError(err)
+	re.Len(assignments, 4)
+	re.Equal(ClusterStatus{State: ClusterStateStable}, cluster.GetStatus())
+
+	// The DDLs are rejected by the degraded cluster.
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyReselect,
+		MinHealthyNodes:        3,
+	}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Equal(ClusterStatus{State: ClusterStateStable, Degraded: true}, cluster.GetStatus())
+
+	// The status survives the reloading.
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	cluster, err = manager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	re.Equal(ClusterStatus{State: ClusterStateStable, Degraded: true}, cluster.GetStatus())
+
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy: ShardUnavailablePolicyReselect,
+	}))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60}))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(ClusterStatus{State: ClusterStatePreparing}, cluster.GetStatus())
+}
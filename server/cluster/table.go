@@ -0,0 +1,50 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import "github.com/CeresDB/ceresdbproto/pkg/metapb"
+
+// Table is immutable, and a new one replaces it in the schema if it is altered.
+type Table struct {
+	schema *metapb.Schema
+	meta   *metapb.Table
+	// tableSchema is nil if the table has never been altered.
+	tableSchema *TableSchema
+	// affinityGroup is zero if the table has no anti-affinity group.
+	affinityGroup uint64
+}
+
+func (t *Table) GetID() uint64 {
+	return t.meta.GetId()
+}
+
+func (t *Table) GetName() string {
+	return t.meta.GetName()
+}
+
+func (t *Table) GetSchemaID() uint32 {
+	return t.meta.GetSchemaId()
+}
+
+func (t *Table) GetSchemaName() string {
+	return t.schema.GetName()
+}
+
+func (t *Table) GetShardID() uint32 {
+	return t.meta.GetShardId()
+}
+
+// GetSchemaVersion returns the version of the table schema, which is zero before the table is altered.
+func (t *Table) GetSchemaVersion() uint64 {
+	return t.tableSchema.GetVersion()
+}
+
+// GetEncodedSchema returns the latest encoded schema of the table, and nil if the table has never been altered.
+func (t *Table) GetEncodedSchema() []byte {
+	return t.tableSchema.GetEncoded()
+}
+
+// GetAffinityGroup returns the anti-affinity group of the table, and zero if it has none.
+func (t *Table) GetAffinityGroup() uint64 {
+	return t.affinityGroup
+}
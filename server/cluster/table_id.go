@@ -0,0 +1,99 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/pkg/errors"
+)
+
+// createTableLocked allocates the table id and persists the table and the new topology of its shard, and the id is
+// lost if the persisting fails. The table is persisted along with a deleting marker which is deleted by placing it on
+// its shard, so the table left out of its shard by a crash is dropped after the cluster is reloaded, or placed on its
+// shard again under the CreatePersistFailureReconcile policy.
+func (c *Cluster) createTableLocked(ctx context.Context, schema *Schema, shard *Shard, tableName string) (*metapb.Table, *metapb.ShardTopology, error) {
+	tableID, err := c.allocTableIDLocked(ctx, schema)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "alloc table id, table:%s", tableName)
+	}
+
+	tableMeta := &metapb.Table{
+		Id:       tableID,
+		Name:     tableName,
+		SchemaId: schema.GetID(),
+		ShardId:  shard.GetID(),
+	}
+	newTopology := shard.withTable(tableID, c.shardVersionIncrementLocked(ShardOperationCreateTable))
+	if err := c.checkNewShardTopologySizeLocked(shard.GetID(), newTopology); err != nil {
+		return nil, nil, err
+	}
+	marker, err := encodeDeletingMarker(tableDeletingMarker{
+		StartedAt: time.Now().UnixMilli(),
+		Reconcile: c.options.CreatePersistFailurePolicy == CreatePersistFailureReconcile,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.storage.PutTableWithDeletingMarker(ctx, c.clusterID, tableMeta, marker); err != nil {
+		return nil, nil, errors.Wrapf(err, "put table, table:%s", tableName)
+	}
+
+	if err := c.storage.PutShardTopologyPlacingTables(ctx, c.clusterID, shard.GetID(), newTopology, []*metapb.Table{tableMeta}); err != nil {
+		c.markStaleOnConflictLocked(err)
+		err = errors.Wrapf(err, "put shard topology, shard:%d", shard.GetID())
+		if c.options.CreatePersistFailurePolicy == CreatePersistFailureReconcile {
+			c.recordPendingReconcileLocked(ctx, schema.GetName(), tableMeta, err)
+			return tableMeta, newTopology, nil
+		}
+		// The table is persisted without being placed on the shard, so it is deleted to roll back the creation.
+		c.compensateCreateTableLocked(ctx, schema.GetName(), tableMeta, err)
+		return nil, nil, err
+	}
+	return tableMeta, newTopology, nil
+}
+
+// createTableGapFreeLocked persists the table, the new topology of its shard and the advanced end id of the allocator
+// in a single transaction, so the id is reused by the next creation if this one fails. The lock of the cluster
+// serializes the creations, which is required by the GapFreeAllocator.
+func (c *Cluster) createTableGapFreeLocked(ctx context.Context, schema *Schema, shard *Shard, tableName string) (*metapb.Table, *metapb.ShardTopology, error) {
+	endStep := procedure.BeginStep(ctx, procedure.StepIDAlloc)
+	tableID, err := c.gapFreeTableIDAlloc.Next(ctx)
+	endStep()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "alloc table id, table:%s", tableName)
+	}
+
+	tableMeta := &metapb.Table{
+		Id:       tableID,
+		Name:     tableName,
+		SchemaId: schema.GetID(),
+		ShardId:  shard.GetID(),
+	}
+	newTopology := shard.withTable(tableID, c.shardVersionIncrementLocked(ShardOperationCreateTable))
+	if err := c.checkNewShardTopologySizeLocked(shard.GetID(), newTopology); err != nil {
+		return nil, nil, err
+	}
+	ok, err := c.storage.PutTableWithIDEnd(ctx, c.clusterID, tableMeta, newTopology, c.gapFreeTableIDAlloc.EndIDKey())
+	if err != nil {
+		c.markStaleOnConflictLocked(err)
+		return nil, nil, errors.Wrapf(err, "put table with id end, table:%s", tableName)
+	}
+	if !ok {
+		return nil, nil, ErrTableIDConflict.WithCausef("table:%s, id:%d", tableName, tableID)
+	}
+	return tableMeta, newTopology, nil
+}
+
+// allocTableIDLocked allocates the id of the table to be created in the schema by the allocator of the scope.
+func (c *Cluster) allocTableIDLocked(ctx context.Context, schema *Schema) (uint64, error) {
+	defer procedure.BeginStep(ctx, procedure.StepIDAlloc)()
+
+	if c.options.TableIDAllocScope == TableIDAllocScopeSchema {
+		return c.schemaTableIDAlloc.Alloc(ctx, schema.GetID())
+	}
+	return c.tableIDAlloc.Alloc(ctx)
+}
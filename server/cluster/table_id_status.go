@@ -0,0 +1,158 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/id"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// TableIDStatus describes the ids of the tables. The ids are monotonically increasing 64-bit values never reused, so
+// the data left by a dropped table never collides with a new table.
+type TableIDStatus struct {
+	// Scope is the scope sharing the same allocator of the ids.
+	Scope TableIDAllocScope
+	// HighWaterMark is the end id of the allocator, and every id allocated so far is not larger than it. It is the
+	// largest end id among the partitions of the schemas for the TableIDAllocScopeSchema.
+	HighWaterMark uint64
+	// MaxTableID is the largest id of the tables, including the ones being dropped.
+	MaxTableID uint64
+	// DuplicateIDs are the ids held by more than one table found at loading, which break the invariant.
+	DuplicateIDs []DuplicateTableID
+}
+
+// DuplicateTableID is an id held by more than one table.
+type DuplicateTableID struct {
+	ID uint64
+	// Tables are the names of the tables qualified by the schemas in ascending order.
+	Tables []string
+}
+
+// GetTableIDStatus returns the high-water mark of the table ids and the violations of the invariant.
+func (c *Cluster) GetTableIDStatus(ctx context.Context) (TableIDStatus, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	end, err := c.tableIDEndLocked(ctx)
+	if err != nil {
+		return TableIDStatus{}, err
+	}
+	maxTableID, _ := c.scanTableIDsLocked()
+	return TableIDStatus{
+		Scope:         c.options.TableIDAllocScope,
+		HighWaterMark: end,
+		MaxTableID:    maxTableID,
+		DuplicateIDs:  append([]DuplicateTableID(nil), c.duplicateTableIDs...),
+	}, nil
+}
+
+// checkTableIDsLocked checks the ids of the loaded tables, and the tables being dropped are included because their data
+// may still be on the disks. The duplicate ids are flagged, and the end id of the allocator is advanced to the largest
+// id if it is behind, e.g. the end id is restored from a stale backup, so the ids are never allocated again.
+func (c *Cluster) checkTableIDsLocked(ctx context.Context) error {
+	maxTableID, duplicates := c.scanTableIDsLocked()
+	name := c.metaData.GetName()
+	for _, duplicate := range duplicates {
+		log.Error("table id is held by more than one table", zap.String("cluster", name), zap.Uint64("table-id", duplicate.ID),
+			zap.Strings("tables", duplicate.Tables))
+	}
+	c.duplicateTableIDs = duplicates
+	duplicateTableIDsGauge.WithLabelValues(name).Set(float64(len(duplicates)))
+
+	if c.options.TableIDAllocScope == TableIDAllocScopeSchema {
+		return c.checkSchemaTableIDEndsLocked(ctx)
+	}
+	end, err := c.gapFreeTableIDAlloc.End(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get table id end")
+	}
+	if end >= maxTableID {
+		return nil
+	}
+	log.Warn("table id end is behind the tables and is advanced", zap.String("cluster", name), zap.Uint64("end-id", end),
+		zap.Uint64("max-table-id", maxTableID))
+	if _, err := c.gapFreeTableIDAlloc.EnsureEnd(ctx, maxTableID); err != nil {
+		return errors.Wrap(err, "advance table id end")
+	}
+	return nil
+}
+
+func (c *Cluster) scanTableIDsLocked() (uint64, []DuplicateTableID) {
+	var maxTableID uint64
+	tables := make(map[uint64][]string)
+	for schemaName, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			tables[table.GetID()] = append(tables[table.GetID()], schemaName+"."+table.GetName())
+			if table.GetID() > maxTableID {
+				maxTableID = table.GetID()
+			}
+		}
+	}
+
+	var duplicates []DuplicateTableID
+	for tableID, names := range tables {
+		if len(names) > 1 {
+			sort.Strings(names)
+			duplicates = append(duplicates, DuplicateTableID{ID: tableID, Tables: names})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].ID < duplicates[j].ID })
+	return maxTableID, duplicates
+}
+
+// tableIDEndLocked returns the high-water mark of the table ids in the TableIDAllocScope.
+func (c *Cluster) tableIDEndLocked(ctx context.Context) (uint64, error) {
+	if c.options.TableIDAllocScope != TableIDAllocScopeSchema {
+		end, err := c.gapFreeTableIDAlloc.End(ctx)
+		if err != nil {
+			return 0, errors.Wrap(err, "get table id end")
+		}
+		return end, nil
+	}
+
+	var maxEnd uint64
+	for _, schema := range c.schemasCache {
+		end, err := id.NewGapFreeAllocator(c.storage, c.schemaTableIDAlloc.Key(schema.GetID())).End(ctx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "get table id end, schema:%s", schema.GetName())
+		}
+		if end := id.MakePartitionedID(schema.GetID(), end); end > maxEnd {
+			maxEnd = end
+		}
+	}
+	return maxEnd, nil
+}
+
+// checkSchemaTableIDEndsLocked advances the end of the partition of every schema to the largest sequence of its tables
+// if it is behind, just like the end id of the single allocator.
+func (c *Cluster) checkSchemaTableIDEndsLocked(ctx context.Context) error {
+	for _, schema := range c.schemasCache {
+		var maxSeq uint64
+		for _, table := range schema.tableMap {
+			partition, seq := id.SplitPartitionedID(table.GetID())
+			if partition == schema.GetID() && seq > maxSeq {
+				maxSeq = seq
+			}
+		}
+
+		alloc := id.NewGapFreeAllocator(c.storage, c.schemaTableIDAlloc.Key(schema.GetID()))
+		end, err := alloc.End(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "get table id end, schema:%s", schema.GetName())
+		}
+		if end >= maxSeq {
+			continue
+		}
+		log.Warn("table id end of schema is behind the tables and is advanced", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", schema.GetName()), zap.Uint64("end", end), zap.Uint64("max-sequence", maxSeq))
+		if _, err := alloc.EnsureEnd(ctx, maxSeq); err != nil {
+			return errors.Wrapf(err, "advance table id end, schema:%s", schema.GetName())
+		}
+	}
+	return nil
+}
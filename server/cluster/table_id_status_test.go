@@ -0,0 +1,66 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableIDsNeverReused(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	tables := make([]*Table, 0, 3)
+	for _, name := range []string{"t0", "t1", "t2"} {
+		table, err := manager.AllocTableID(ctx, testClusterName, "public", name)
+		re.NoError(err)
+		tables = append(tables, table)
+	}
+	dropped, t1, maxID := tables[0].GetID(), tables[1], tables[2].GetID()
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "t0", false))
+
+	status, err := cluster.GetTableIDStatus(ctx)
+	re.NoError(err)
+	re.GreaterOrEqual(status.HighWaterMark, maxID)
+	re.Empty(status.DuplicateIDs)
+
+	// The end id is restored from a stale backup while another table holds the id of the t1 by mistake, and the new
+	// leader loading the cluster after the failover advances the end id.
+	re.NoError(s.Put(ctx, makeTableIDAllocKey(cluster.GetClusterID()), "1"))
+	schema, err := manager.CreateSchema(ctx, testClusterName, "other", 0)
+	re.NoError(err)
+	re.NoError(s.PutTables(ctx, cluster.GetClusterID(), schema.GetID(), []*metapb.Table{
+		{Id: t1.GetID(), Name: "copy", SchemaId: schema.GetID(), ShardId: t1.GetShardID()},
+	}))
+
+	newManager := NewManagerImpl(s, testRootPath)
+	re.NoError(newManager.Load(ctx))
+	newCluster, err := newManager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	status, err = newCluster.GetTableIDStatus(ctx)
+	re.NoError(err)
+	re.Equal(maxID, status.MaxTableID)
+	re.Equal(maxID, status.HighWaterMark)
+	re.Equal([]DuplicateTableID{{ID: t1.GetID(), Tables: []string{"other.copy", "public.t1"}}}, status.DuplicateIDs)
+	re.Equal(float64(1), testutil.ToFloat64(duplicateTableIDsGauge.WithLabelValues(testClusterName)))
+
+	// The ids allocated after the failover never go back, so the id of the dropped table is never reused.
+	table, err := newManager.AllocTableID(ctx, testClusterName, "public", "t3")
+	re.NoError(err)
+	re.Greater(table.GetID(), maxID)
+	re.NotEqual(dropped, table.GetID())
+}
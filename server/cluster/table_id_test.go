@@ -0,0 +1,176 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/id"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// hookedTableStorage calls the beforePut before creating the table, and the creation fails if it returns error.
+type hookedTableStorage struct {
+	storage.Storage
+	beforePut func(ctx context.Context) error
+}
+
+func (s *hookedTableStorage) PutTableWithIDEnd(ctx context.Context, clusterID uint32, table *metapb.Table, topology *metapb.ShardTopology, endIDKey string) (bool, error) {
+	if s.beforePut != nil {
+		if err := s.beforePut(ctx); err != nil {
+			return false, err
+		}
+	}
+	return s.Storage.PutTableWithIDEnd(ctx, clusterID, table, topology, endIDKey)
+}
+
+func TestGapFreeTableID(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	hookedStorage := &hookedTableStorage{Storage: s}
+	manager := NewManagerImpl(hookedStorage, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	// The allocator caches a range of the ids, which is skipped after switching to the gap-free mode.
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	re.Equal(uint64(1), table.GetID())
+	opts := cluster.GetOptions()
+	opts.GapFreeTableID = true
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	firstID := table.GetID()
+	re.Greater(firstID, uint64(1))
+
+	// The id of the failed creation is reused.
+	hookedStorage.beforePut = func(_ context.Context) error { return fmt.Errorf("injected failure") }
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t2")
+	re.Error(err)
+	hookedStorage.beforePut = nil
+	for i := 2; i < 5; i++ {
+		table, err = manager.AllocTableID(ctx, testClusterName, "public", fmt.Sprintf("t%d", i))
+		re.NoError(err)
+		re.Equal(firstID+uint64(i-1), table.GetID())
+	}
+
+	// The creation is rejected if the end id is advanced by others concurrently, and the next one follows the new end.
+	endIDKey := makeTableIDAllocKey(cluster.GetClusterID())
+	hookedStorage.beforePut = func(ctx context.Context) error {
+		return s.Put(ctx, endIDKey, fmt.Sprintf("%d", firstID+10))
+	}
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t5")
+	re.True(coderr.Is(err, coderr.Conflict))
+	hookedStorage.beforePut = nil
+	table, err = manager.AllocTableID(ctx, testClusterName, "public", "t5")
+	re.NoError(err)
+	re.Equal(firstID+11, table.GetID())
+
+	// The tables and the topologies are persisted along with the end id.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	table, err = reloaded.AllocTableID(ctx, testClusterName, "public", "t4")
+	re.NoError(err)
+	re.Equal(firstID+3, table.GetID())
+	c, err := reloaded.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	shard := c.shardsCache[table.GetShardID()]
+	re.True(shard.hasTable(table.GetID()))
+}
+
+func TestSchemaTableIDAllocScope(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateClusterWithOptions(ctx, testClusterName, 1, 1, testShardTotal,
+		CreateClusterOptions{TableIDAllocScope: TableIDAllocScopeSchema})
+	re.NoError(err)
+	schemaNames := []string{"s0", "s1", "s2"}
+	schemaIDs := make(map[string]uint32)
+	for _, schemaName := range schemaNames {
+		schema, err := manager.CreateSchema(ctx, testClusterName, schemaName, 0)
+		re.NoError(err)
+		schemaIDs[schemaName] = schema.GetID()
+	}
+
+	const tablesPerSchema = 20
+	var wg sync.WaitGroup
+	tables := make(chan *Table, len(schemaNames)*tablesPerSchema)
+	errs := make(chan error, len(schemaNames)*tablesPerSchema)
+	for _, schemaName := range schemaNames {
+		for i := 0; i < tablesPerSchema; i++ {
+			wg.Add(1)
+			go func(schemaName string, i int) {
+				defer wg.Done()
+				table, err := manager.AllocTableID(ctx, testClusterName, schemaName, fmt.Sprintf("t%d", i))
+				if err != nil {
+					errs <- err
+					return
+				}
+				tables <- table
+			}(schemaName, i)
+		}
+	}
+	wg.Wait()
+	close(tables)
+	close(errs)
+	for err := range errs {
+		re.NoError(err)
+	}
+	ids := make(map[uint64]struct{})
+	for table := range tables {
+		_, ok := ids[table.GetID()]
+		re.False(ok, "id:%d is allocated twice", table.GetID())
+		ids[table.GetID()] = struct{}{}
+		partition, seq := id.SplitPartitionedID(table.GetID())
+		re.Equal(schemaIDs[table.GetSchemaName()], partition)
+		re.LessOrEqual(seq, uint64(tablesPerSchema))
+	}
+	re.Len(ids, len(schemaNames)*tablesPerSchema)
+
+	// The scope is recorded in the options, and it can't be changed or combined with the gap-free ids.
+	cluster, err := manager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	opts := cluster.GetOptions()
+	re.Equal(TableIDAllocScopeSchema, opts.TableIDAllocScope)
+	opts.TableIDAllocScope = TableIDAllocScopeCluster
+	re.True(coderr.Is(cluster.SetOptions(ctx, opts), coderr.InvalidParams))
+	opts.TableIDAllocScope = ""
+	opts.GapFreeTableID = true
+	re.True(coderr.Is(cluster.SetOptions(ctx, opts), coderr.InvalidParams))
+
+	// The end of the partition restored from a stale backup is advanced by the reload.
+	re.NoError(s.Put(ctx, cluster.schemaTableIDAlloc.Key(schemaIDs["s0"]), "1"))
+	newManager := NewManagerImpl(s, testRootPath)
+	re.NoError(newManager.Load(ctx))
+	newCluster, err := newManager.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+	status, err := newCluster.GetTableIDStatus(ctx)
+	re.NoError(err)
+	re.Equal(TableIDAllocScopeSchema, status.Scope)
+	re.GreaterOrEqual(status.HighWaterMark, status.MaxTableID)
+	table, err := newManager.AllocTableID(ctx, testClusterName, "s0", "new")
+	re.NoError(err)
+	_, ok := ids[table.GetID()]
+	re.False(ok, "id:%d is allocated twice", table.GetID())
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+// checkTableNameScopeLocked returns ErrTableExists if the name of the table to be created in the schema is taken in
+// the table name scope of the cluster. The names are only indexed by the schemas in memory, so the other schemas are
+// scanned for the wider scopes. The shards holding the name in the other schemas are returned for the shard scope,
+// which should not be picked for the table.
+func (c *Cluster) checkTableNameScopeLocked(schema *Schema, tableName string) (map[uint32]struct{}, error) {
+	scope := c.options.TableNameScope
+	if scope != TableNameScopeCluster && scope != TableNameScopeShard {
+		return nil, nil
+	}
+
+	taken := make(map[uint32]struct{})
+	for _, other := range c.schemasCache {
+		if other == schema {
+			continue
+		}
+		table, ok := other.getTable(tableName)
+		if !ok {
+			continue
+		}
+		if scope == TableNameScopeCluster {
+			return nil, ErrTableExists.WithCausef("table:%s exists in schema:%s, scope:%s", tableName, other.GetName(), scope)
+		}
+		taken[table.GetShardID()] = struct{}{}
+	}
+
+	for _, shardID := range schema.shardIDs {
+		if _, ok := taken[shardID]; !ok {
+			return taken, nil
+		}
+	}
+	return nil, ErrTableExists.WithCausef("table:%s exists on all the shards of schema:%s, scope:%s", tableName,
+		schema.GetName(), scope)
+}
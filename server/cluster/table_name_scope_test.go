@@ -0,0 +1,85 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableNameScope(t *testing.T) {
+	testCases := []struct {
+		scope TableNameScope
+		// created tells whether the same name can be created in the schemas in order.
+		created []bool
+	}{
+		{scope: "", created: []bool{true, true, true}},
+		{scope: TableNameScopeSchema, created: []bool{true, true, true}},
+		{scope: TableNameScopeCluster, created: []bool{true, false, false}},
+		{scope: TableNameScopeShard, created: []bool{true, true, false}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.scope), func(t *testing.T) {
+			re := require.New(t)
+			s, clean := prepareEtcdStorage(t)
+			defer clean()
+
+			ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+			defer cancel()
+
+			manager := NewManagerImpl(s, testRootPath)
+			_, err := manager.CreateClusterWithOptions(ctx, testClusterName, 1, 1, 2, CreateClusterOptions{TableNameScope: tc.scope})
+			re.NoError(err)
+
+			shardIDs := make(map[uint32]struct{})
+			for i, schemaName := range []string{"s0", "s1", "s2"} {
+				_, err := manager.CreateSchema(ctx, testClusterName, schemaName, 0)
+				re.NoError(err)
+				table, err := manager.AllocTableID(ctx, testClusterName, schemaName, "table")
+				if !tc.created[i] {
+					re.True(coderr.Is(err, coderr.Conflict), err)
+					re.Contains(err.Error(), "table already exists")
+					continue
+				}
+				re.NoError(err)
+				shardIDs[table.GetShardID()] = struct{}{}
+				// The existing table is returned from its own schema.
+				existing, err := manager.AllocTableID(ctx, testClusterName, schemaName, "table")
+				re.NoError(err)
+				re.Equal(table.GetID(), existing.GetID())
+			}
+			if tc.scope == TableNameScopeShard {
+				re.Len(shardIDs, 2)
+			}
+
+			// The scope is kept if it is not given, and it can't be changed.
+			scope := tc.scope
+			if scope == "" {
+				scope = TableNameScopeSchema
+			}
+			re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{ShardUnavailablePolicy: ShardUnavailablePolicyFailFast}))
+			re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, Options{
+				ShardUnavailablePolicy: ShardUnavailablePolicyFailFast,
+				TableNameScope:         "unknown",
+			}), coderr.InvalidParams))
+			for _, other := range []TableNameScope{TableNameScopeSchema, TableNameScopeCluster, TableNameScopeShard} {
+				if other != scope {
+					re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, Options{
+						ShardUnavailablePolicy: ShardUnavailablePolicyFailFast,
+						TableNameScope:         other,
+					}), coderr.InvalidParams))
+				}
+			}
+
+			reloaded := NewManagerImpl(s, testRootPath)
+			re.NoError(reloaded.Load(ctx))
+			cluster, err := reloaded.GetCluster(ctx, testClusterName)
+			re.NoError(err)
+			re.Equal(scope, cluster.GetOptions().TableNameScope)
+		})
+	}
+}
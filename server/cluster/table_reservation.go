@@ -0,0 +1,237 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type tableReservationTokenKey struct{}
+
+// WithTableReservationToken returns a context carrying the token, which allows the table creations in the context to
+// take the name reserved by the token.
+func WithTableReservationToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tableReservationTokenKey{}, token)
+}
+
+func tableReservationTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tableReservationTokenKey{}).(string)
+	return token
+}
+
+type tableNameKey struct {
+	schemaName string
+	tableName  string
+}
+
+type tableReservation struct {
+	token    string
+	expireAt time.Time
+	// tableID is the table created with the reservation, and zero if the reservation is not used yet.
+	tableID uint64
+}
+
+// persistedTableReservation is the reservation persisted with a lease of its ttl, so that it is kept by the next
+// leader and deleted by the etcd once it expires.
+type persistedTableReservation struct {
+	Token    string `json:"token"`
+	ExpireAt int64  `json:"expire_at"`
+	TableID  uint64 `json:"table_id,omitempty"`
+}
+
+// TableNameReservation is a reservation of a table name, and the token is only returned to the reserver.
+type TableNameReservation struct {
+	SchemaName string
+	TableName  string
+	Token      string
+	ExpireAt   time.Time
+}
+
+// ReserveTableName reserves the name of a table to be created for the ttl, and the creation of the table is rejected
+// unless it carries the returned token until the reservation expires. The reservation is persisted with a lease of the
+// ttl, so it survives the change of the leader of the ceresmeta.
+func (c *Cluster) ReserveTableName(ctx context.Context, schemaName, tableName string, ttl time.Duration) (*TableNameReservation, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidReservationTTL.WithCausef("ttl:%s", ttl)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return nil, ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	if _, ok := schema.getTable(tableName); ok {
+		return nil, ErrTableNameReserved.WithCausef("table already exists, schema:%s, table:%s", schemaName, tableName)
+	}
+	now := time.Now()
+	c.pruneTableReservationsLocked(now)
+	key := tableNameKey{schemaName: schemaName, tableName: tableName}
+	if reservation, ok := c.tableReservations[key]; ok {
+		return nil, ErrTableNameReserved.WithCausef("schema:%s, table:%s, expire at:%s", schemaName, tableName,
+			reservation.expireAt)
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return nil, ErrGenerateToken.WithCausef("table name reservation, err:%v", err)
+	}
+	reservation := &tableReservation{token: token, expireAt: now.Add(ttl)}
+	if err := c.putTableReservationLocked(ctx, schema.GetID(), tableName, reservation); err != nil {
+		return nil, errors.Wrapf(err, "schema:%s, table:%s", schemaName, tableName)
+	}
+	c.tableReservations[key] = reservation
+
+	log.Info("reserve table name", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName),
+		zap.String("table", tableName), zap.Duration("ttl", ttl))
+	return &TableNameReservation{SchemaName: schemaName, TableName: tableName, Token: token, ExpireAt: reservation.expireAt}, nil
+}
+
+// ReleaseTableName releases the reservation of the token before it expires, so that the name can be taken by others.
+// The creation retried with the token after the release is rejected like the one after the expiry.
+func (c *Cluster) ReleaseTableName(ctx context.Context, schemaName, tableName, token string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	schema, ok := c.schemasCache[schemaName]
+	if !ok {
+		return ErrSchemaNotFound.WithCausef("schema:%s", schemaName)
+	}
+	c.pruneTableReservationsLocked(time.Now())
+	key := tableNameKey{schemaName: schemaName, tableName: tableName}
+	reservation, ok := c.tableReservations[key]
+	if !ok || reservation.token != token {
+		return ErrTableReservationNotFound.WithCausef("schema:%s, table:%s", schemaName, tableName)
+	}
+	if err := c.storage.DeleteTableReservation(ctx, c.clusterID, schema.GetID(), tableName); err != nil {
+		return errors.Wrapf(err, "delete table name reservation, schema:%s, table:%s", schemaName, tableName)
+	}
+	delete(c.tableReservations, key)
+
+	log.Info("release table name", zap.String("cluster", c.metaData.GetName()), zap.String("schema", schemaName),
+		zap.String("table", tableName))
+	return nil
+}
+
+// checkTableReservationLocked checks the reservation of the table name against the token carried by the ctx, and the
+// existing table is nil if the table is to be created. The reservation used by the creation is kept until it expires,
+// so that the creation can be retried with the token, while the token of an expired reservation is rejected because
+// the name may have been taken by others.
+func (c *Cluster) checkTableReservationLocked(ctx context.Context, schemaName, tableName string, existing *Table) error {
+	token := tableReservationTokenFromContext(ctx)
+	reservation, ok := c.tableReservations[tableNameKey{schemaName: schemaName, tableName: tableName}]
+	if ok && !time.Now().Before(reservation.expireAt) {
+		ok = false
+	}
+
+	switch {
+	case existing != nil:
+		if token == "" || (ok && reservation.token == token && reservation.tableID == existing.GetID()) {
+			return nil
+		}
+		return ErrTableReservationLost.WithCausef("table is created by others, schema:%s, table:%s", schemaName, tableName)
+	case !ok:
+		if token == "" {
+			return nil
+		}
+		return ErrTableReservationLost.WithCausef("reservation expires, schema:%s, table:%s", schemaName, tableName)
+	case reservation.token != token:
+		return ErrTableNameReserved.WithCausef("schema:%s, table:%s, expire at:%s", schemaName, tableName, reservation.expireAt)
+	default:
+		return nil
+	}
+}
+
+// useTableReservationLocked marks the reservation carried by the ctx as used by the created table.
+func (c *Cluster) useTableReservationLocked(ctx context.Context, schemaName string, table *Table) {
+	token := tableReservationTokenFromContext(ctx)
+	if token == "" {
+		return
+	}
+	reservation, ok := c.tableReservations[tableNameKey{schemaName: schemaName, tableName: table.GetName()}]
+	if !ok || reservation.token != token {
+		return
+	}
+	reservation.tableID = table.GetID()
+	// The next leader failing to know the reservation is used only rejects the retries of the creation with the token.
+	if err := c.putTableReservationLocked(ctx, table.GetSchemaID(), table.GetName(), reservation); err != nil {
+		log.Warn("fail to persist used table name reservation", zap.String("cluster", c.metaData.GetName()),
+			zap.String("schema", schemaName), zap.String("table", table.GetName()), zap.Error(err))
+	}
+}
+
+func (c *Cluster) putTableReservationLocked(ctx context.Context, schemaID uint32, tableName string, reservation *tableReservation) error {
+	ttl := time.Until(reservation.expireAt)
+	if ttl <= 0 {
+		return nil
+	}
+	value, err := json.Marshal(persistedTableReservation{
+		Token:    reservation.token,
+		ExpireAt: reservation.expireAt.UnixMilli(),
+		TableID:  reservation.tableID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode table name reservation")
+	}
+	if err := c.storage.PutTableReservation(ctx, c.clusterID, schemaID, tableName, string(value), ttl); err != nil {
+		return errors.Wrap(err, "put table name reservation")
+	}
+	return nil
+}
+
+// loadTableReservations loads the reservations of the schema not expired yet into the reservations.
+func (c *Cluster) loadTableReservations(ctx context.Context, schemaID uint32, schemaName string, reservations map[tableNameKey]*tableReservation) error {
+	values, err := c.storage.ListTableReservations(ctx, c.clusterID, schemaID)
+	if err != nil {
+		return errors.Wrapf(err, "load table name reservations, schema:%s", schemaName)
+	}
+	now := time.Now()
+	for tableName, value := range values {
+		var persisted persistedTableReservation
+		if err := json.Unmarshal([]byte(value), &persisted); err != nil {
+			return errors.Wrapf(err, "decode table name reservation, schema:%s, table:%s", schemaName, tableName)
+		}
+		expireAt := time.UnixMilli(persisted.ExpireAt)
+		if !now.Before(expireAt) {
+			continue
+		}
+		reservations[tableNameKey{schemaName: schemaName, tableName: tableName}] = &tableReservation{
+			token:    persisted.Token,
+			expireAt: expireAt,
+			tableID:  persisted.TableID,
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) pruneTableReservationsLocked(now time.Time) {
+	for key, reservation := range c.tableReservations {
+		if !now.Before(reservation.expireAt) {
+			delete(c.tableReservations, key)
+		}
+	}
+}
+
+// listTableReservationsLocked lists the active reservations not used yet of the schema without their tokens.
+func (c *Cluster) listTableReservationsLocked(schemaName string) []*TableNameReservation {
+	now := time.Now()
+	var reservations []*TableNameReservation
+	for key, reservation := range c.tableReservations {
+		if key.schemaName != schemaName || reservation.tableID != 0 || !now.Before(reservation.expireAt) {
+			continue
+		}
+		reservations = append(reservations, &TableNameReservation{
+			SchemaName: key.schemaName,
+			TableName:  key.tableName,
+			ExpireAt:   reservation.expireAt,
+		})
+	}
+	return reservations
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserveTableName(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	_, err = manager.ReserveTableName(ctx, testClusterName, "public", "table0", 0)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	reservation, err := manager.ReserveTableName(ctx, testClusterName, "public", "table0", time.Minute)
+	re.NoError(err)
+	_, err = manager.ReserveTableName(ctx, testClusterName, "public", "table0", time.Minute)
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// The reserved name is listed as a distinct state without the token.
+	listings, err := manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Len(listings, 1)
+	re.Equal(TableStateReserved, listings[0].State)
+	re.Equal("table0", listings[0].Name)
+	re.Nil(listings[0].Table)
+	re.Empty(listings[0].Reservation.Token)
+
+	// The creation without the token or with a wrong token is rejected.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.Conflict))
+	_, err = manager.AllocTableID(WithTableReservationToken(ctx, "wrong"), testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	tokenCtx := WithTableReservationToken(ctx, reservation.Token)
+	table, err := manager.AllocTableID(tokenCtx, testClusterName, "public", "table0")
+	re.NoError(err)
+	retried, err := manager.AllocTableID(tokenCtx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(table.GetID(), retried.GetID())
+	listings, err = manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Len(listings, 1)
+	re.Equal(TableStateCreated, listings[0].State)
+	_, err = manager.ReserveTableName(ctx, testClusterName, "public", "table0", time.Minute)
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// The released name can be taken by others at once, and only the reserver can release it.
+	reservation, err = manager.ReserveTableName(ctx, testClusterName, "public", "table1", time.Minute)
+	re.NoError(err)
+	re.True(coderr.Is(manager.ReleaseTableName(ctx, testClusterName, "public", "table1", "wrong"), coderr.NotFound))
+	re.NoError(manager.ReleaseTableName(ctx, testClusterName, "public", "table1", reservation.Token))
+	re.True(coderr.Is(manager.ReleaseTableName(ctx, testClusterName, "public", "table1", reservation.Token), coderr.NotFound))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+}
+
+func TestTableReservationExpiry(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	ttl := time.Millisecond * 100
+	reservation, err := manager.ReserveTableName(ctx, testClusterName, "public", "table0", ttl)
+	re.NoError(err)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// Another job takes the name once the reservation expires, and the late creation with the token is told that the
+	// reservation is lost instead of getting the table of others.
+	time.Sleep(ttl + time.Millisecond*50)
+	listings, err := manager.ListTables(ctx, testClusterName, "public", ListTablesOptions{})
+	re.NoError(err)
+	re.Empty(listings)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	_, err = manager.AllocTableID(WithTableReservationToken(ctx, reservation.Token), testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Contains(err.Error(), "reservation lost")
+
+	// The late creation with the token of an expired reservation is rejected even if the name is still free.
+	reservation, err = manager.ReserveTableName(ctx, testClusterName, "public", "table1", ttl)
+	re.NoError(err)
+	time.Sleep(ttl + time.Millisecond*50)
+	_, err = manager.AllocTableID(WithTableReservationToken(ctx, reservation.Token), testClusterName, "public", "table1")
+	re.True(coderr.Is(err, coderr.Conflict))
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+}
+
+func TestTableReservationReload(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	_, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	reservation, err := manager.ReserveTableName(ctx, testClusterName, "public", "table0", time.Minute)
+	re.NoError(err)
+
+	// The reservation survives the change of the leader.
+	reloaded := NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	_, err = reloaded.ReserveTableName(ctx, testClusterName, "public", "table0", time.Minute)
+	re.True(coderr.Is(err, coderr.Conflict))
+	_, err = reloaded.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.True(coderr.Is(err, coderr.Conflict))
+	tokenCtx := WithTableReservationToken(ctx, reservation.Token)
+	table, err := reloaded.AllocTableID(tokenCtx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	// So does the table created with the reservation, and the retries of the creation get the same table.
+	reloaded = NewManagerImpl(s, testRootPath)
+	re.NoError(reloaded.Load(ctx))
+	retried, err := reloaded.AllocTableID(tokenCtx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Equal(table.GetID(), retried.GetID())
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlterTable(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 1)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "alter")
+	re.NoError(err)
+	re.Zero(table.GetSchemaVersion())
+	re.Nil(table.GetEncodedSchema())
+
+	leaderOf := func(node string, shardIDs ...uint32) *metapb.NodeInfo {
+		info := &metapb.NodeInfo{Node: node, Lease: 60}
+		for _, shardID := range shardIDs {
+			info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+		}
+		return info
+	}
+	shardID := table.GetShardID()
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("a", shardID)))
+
+	altered, err := manager.AlterTable(ctx, testClusterName, "public", "alter", 0, []byte("v1"))
+	re.NoError(err)
+	re.Equal(uint64(1), altered.GetSchemaVersion())
+	re.Equal([]byte("v1"), altered.GetEncodedSchema())
+	// The table returned before the alter is not changed.
+	re.Zero(table.GetSchemaVersion())
+
+	// The stale alter is rejected.
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "alter", 0, []byte("stale"))
+	re.True(coderr.Is(err, coderr.Conflict))
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "not_exist", 0, []byte("v1"))
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	// The new owner after the failover opens the shard with the altered schema.
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("a")))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, leaderOf("b", shardID)))
+	shardTables, err := manager.GetShardTables(ctx, testClusterName, []uint32{shardID})
+	re.NoError(err)
+	re.Equal("b", shardTables[shardID].Node)
+	re.Len(shardTables[shardID].Tables, 1)
+	re.Equal(uint64(1), shardTables[shardID].Tables[0].GetSchemaVersion())
+	re.Equal([]byte("v1"), shardTables[shardID].Tables[0].GetEncodedSchema())
+	_, err = manager.GetShardTables(ctx, testClusterName, []uint32{testShardTotal})
+	re.True(coderr.Is(err, coderr.NotFound))
+
+	// The schema version is persisted and loaded by a new manager.
+	manager = NewManagerImpl(s, testRootPath)
+	re.NoError(manager.Load(ctx))
+	_, err = manager.AlterTable(ctx, testClusterName, "public", "alter", 0, []byte("stale"))
+	re.True(coderr.Is(err, coderr.Conflict))
+	altered, err = manager.AlterTable(ctx, testClusterName, "public", "alter", 1, []byte("v2"))
+	re.NoError(err)
+	re.Equal(uint64(2), altered.GetSchemaVersion())
+
+	// The schema is deleted with the table.
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "alter", false))
+	schemas, err := s.ListTableSchemas(ctx, cluster.GetClusterID(), altered.GetSchemaID())
+	re.NoError(err)
+	re.Empty(schemas)
+}
@@ -0,0 +1,30 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+// TableSetVerification is the result of a round of the verification.
+type TableSetVerification struct {
+	// AntiAffinityViolations are the anti-affinity groups whose tables are not spread as far as the cluster allows.
+	AntiAffinityViolations []AntiAffinityViolation
+	// UncompensatedTables are the tables left by the failed creations whose compensations fail too.
+	UncompensatedTables []UncompensatedTable
+	// PendingReconciles are the tables created with the topologies of their shards not persisted yet.
+	PendingReconciles []PendingReconcile
+	// AmbiguousShardOwners are the shards reported by both their owners and the nodes named by their persisted last
+	// owner changes, which should be resolved by the operator.
+	AmbiguousShardOwners []AmbiguousShardOwner
+}
+
+// VerifyShardTableSets verifies the placement of the tables on the shards with the stored topologies. The tables
+// reported by the nodes are not verified, because the heartbeats of the ceresdbproto carry no tables of the shards.
+func (c *Cluster) VerifyShardTableSets() *TableSetVerification {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	verification := &TableSetVerification{}
+	verification.AntiAffinityViolations = c.checkAntiAffinityLocked()
+	verification.UncompensatedTables = c.listUncompensatedTablesLocked()
+	verification.PendingReconciles = c.listPendingReconcilesLocked()
+	verification.AmbiguousShardOwners = c.listAmbiguousShardOwnersLocked()
+	return verification
+}
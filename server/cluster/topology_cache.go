@@ -0,0 +1,186 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// TopologyNode is a node in the Topology.
+type TopologyNode struct {
+	Name  string `json:"name"`
+	Alive bool   `json:"alive"`
+	// ShardIDs are the shards owned by the node in ascending order.
+	ShardIDs []uint32 `json:"shard_ids"`
+}
+
+// TopologyTable is a table in the Topology.
+type TopologyTable struct {
+	SchemaName string `json:"schema_name"`
+	Name       string `json:"name"`
+	ID         uint64 `json:"id"`
+	ShardID    uint32 `json:"shard_id"`
+}
+
+// Topology is the assembled topology of the whole cluster, which is shared by the callers and must not be modified.
+type Topology struct {
+	// Version changes whenever the topology may change.
+	Version uint64 `json:"version"`
+	// Revision is the etcd revision of the latest change of the topology observed by the watch.
+	Revision   int64  `json:"revision"`
+	Generation uint64 `json:"generation"`
+	// ShardVersionPolicy tells which operations bump the versions of the shards.
+	ShardVersionPolicy ShardVersionPolicy `json:"shard_version_policy"`
+	// Nodes, Shards and Tables are sorted by the names or the ids.
+	Nodes  []TopologyNode  `json:"nodes"`
+	Shards []ShardView     `json:"shards"`
+	Tables []TopologyTable `json:"tables"`
+}
+
+// TopologyResult is the result of GetTopology, and Topology is nil if NotModified is set.
+type TopologyResult struct {
+	Version     uint64    `json:"version"`
+	NotModified bool      `json:"not_modified"`
+	Topology    *Topology `json:"topology,omitempty"`
+	// CacheHitRate is the ratio of the requests of the cluster served without assembling the topology since the cluster
+	// is loaded.
+	CacheHitRate float64 `json:"cache_hit_rate"`
+}
+
+// topologyCache caches the assembled topology while the changes of the topology in the storage are watched, and it is
+// invalidated by the watch, the DDLs and the changes of the topology generation.
+type topologyCache struct {
+	// watching is set once the watch starts, and nothing is cached otherwise.
+	watching bool
+	version  uint64
+	revision int64
+	cached   *Topology
+
+	// requests and hits count the requests and the ones served without assembling the topology.
+	requests uint64
+	hits     uint64
+}
+
+// GetTopology returns the assembled topology of the cluster, unless its version equals to ifVersionNot, in which case
+// only the version is returned. Zero ifVersionNot never matches. The topology is assembled again only if it may have
+// changed since the last call.
+func (c *Cluster) GetTopology(ifVersionNot uint64) *TopologyResult {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.refreshNodesLocked(time.Now())
+	cache := &c.topologyCache
+	if cache.cached != nil && cache.cached.Generation != c.topologyGeneration {
+		c.invalidateTopologyCacheLocked()
+	}
+	if !cache.watching {
+		return c.topologyResultLocked("miss", &TopologyResult{Topology: c.assembleTopologyLocked()})
+	}
+	if cache.version == ifVersionNot {
+		return c.topologyResultLocked("not_modified", &TopologyResult{Version: cache.version, NotModified: true})
+	}
+	if cache.cached != nil {
+		return c.topologyResultLocked("hit", &TopologyResult{Version: cache.version, Topology: cache.cached})
+	}
+
+	cache.cached = c.assembleTopologyLocked()
+	return c.topologyResultLocked("miss", &TopologyResult{Version: cache.version, Topology: cache.cached})
+}
+
+// topologyResultLocked counts the request served as the kind and fills the hit rate of the result.
+func (c *Cluster) topologyResultLocked(kind string, result *TopologyResult) *TopologyResult {
+	topologyCacheRequestsCounter.WithLabelValues(c.metaData.GetName(), kind).Inc()
+	cache := &c.topologyCache
+	cache.requests++
+	if kind != "miss" {
+		cache.hits++
+	}
+	result.CacheHitRate = float64(cache.hits) / float64(cache.requests)
+	return result
+}
+
+// WatchTopology watches the changes of the topology in the storage to keep the cached topology valid until the ctx is
+// done, and the topology is not cached before the watch starts or after it stops. The caches of the cluster are only
+// written by the leader itself, so the cluster is marked stale by the changes while follower tells the server isn't
+// the leader, and it is reloaded before serving the reads.
+func (c *Cluster) WatchTopology(ctx context.Context, follower func() bool) {
+	c.storage.WatchClusterTopology(ctx, c.clusterID, func(revision int64) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.topologyCache.watching = true
+		c.topologyCache.revision = revision
+		c.invalidateTopologyCacheLocked()
+		if follower() {
+			c.stale = true
+		}
+	})
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.topologyCache.watching = false
+	c.invalidateTopologyCacheLocked()
+}
+
+// invalidateTopologyCacheLocked drops the cached topology and changes the version. The version starts from the time
+// so that it won't go back after restarting.
+func (c *Cluster) invalidateTopologyCacheLocked() {
+	cache := &c.topologyCache
+	cache.cached = nil
+	if version := uint64(time.Now().UnixNano()); version > cache.version {
+		cache.version = version
+	} else {
+		cache.version++
+	}
+}
+
+func (c *Cluster) assembleTopologyLocked() *Topology {
+	topology := &Topology{
+		Version:    c.topologyCache.version,
+		Revision:   c.topologyCache.revision,
+		Generation: c.topologyGeneration,
+		Nodes:      make([]TopologyNode, 0, len(c.nodesCache)),
+		Shards:     make([]ShardView, 0, len(c.shardsCache)),
+
+		ShardVersionPolicy: c.options.ShardVersionPolicy.OrDefault(),
+	}
+
+	nodeShards := make(map[string][]uint32, len(c.nodesCache))
+	for shardID, shard := range c.shardsCache {
+		topology.Shards = append(topology.Shards, newShardView(shardID, shardRef{
+			topology:    shard.topology,
+			node:        shard.node,
+			ownerChange: shard.lastOwnerChange,
+		}))
+		if shard.node != "" {
+			nodeShards[shard.node] = append(nodeShards[shard.node], shardID)
+		}
+	}
+	sort.Slice(topology.Shards, func(i, j int) bool { return topology.Shards[i].ID < topology.Shards[j].ID })
+	for name, node := range c.nodesCache {
+		shardIDs := nodeShards[name]
+		sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+		topology.Nodes = append(topology.Nodes, TopologyNode{Name: name, Alive: node.alive, ShardIDs: shardIDs})
+	}
+	sort.Slice(topology.Nodes, func(i, j int) bool { return topology.Nodes[i].Name < topology.Nodes[j].Name })
+
+	// The tables being dropped have been removed from their shards.
+	for schemaName, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			if _, ok := c.dropTasks[table.GetID()]; ok {
+				continue
+			}
+			topology.Tables = append(topology.Tables, TopologyTable{
+				SchemaName: schemaName,
+				Name:       table.GetName(),
+				ID:         table.GetID(),
+				ShardID:    table.GetShardID(),
+			})
+		}
+	}
+	sort.Slice(topology.Tables, func(i, j int) bool { return topology.Tables[i].ID < topology.Tables[j].ID })
+	return topology
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopologyCache(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < testShardTotal; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	// The topology is assembled for every call before it is watched.
+	result := cluster.GetTopology(0)
+	re.Zero(result.Version)
+	re.NotSame(result.Topology, cluster.GetTopology(0).Topology)
+	re.Len(result.Topology.Nodes, 1)
+	re.Equal([]TopologyTable{{SchemaName: "public", Name: "table0", ID: table.GetID(), ShardID: table.GetShardID()}},
+		result.Topology.Tables)
+	re.Len(result.Topology.Shards, testShardTotal)
+	re.Equal([]uint64{table.GetID()}, result.Topology.Shards[table.GetShardID()].TableIDs)
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	watchDone := make(chan struct{})
+	go func() {
+		cluster.WatchTopology(watchCtx, func() bool { return false })
+		close(watchDone)
+	}()
+	re.Eventually(func() bool { return cluster.GetTopology(0).Version != 0 }, defaultTestTimeout, 10*time.Millisecond)
+
+	// The cached topology is served until it changes.
+	hits := testutil.ToFloat64(topologyCacheRequestsCounter.WithLabelValues(testClusterName, "hit"))
+	result = cluster.GetTopology(0)
+	re.Same(result.Topology, cluster.GetTopology(0).Topology)
+	re.Equal(hits+2, testutil.ToFloat64(topologyCacheRequestsCounter.WithLabelValues(testClusterName, "hit")))
+	notModified := cluster.GetTopology(result.Version)
+	re.True(notModified.NotModified)
+	re.Greater(notModified.CacheHitRate, 0.0)
+	re.Less(notModified.CacheHitRate, 1.0)
+
+	// The DDL invalidates the cache at once.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+	next := cluster.GetTopology(result.Version)
+	re.False(next.NotModified)
+	re.Len(next.Topology.Tables, 2)
+
+	// The change in the storage invalidates the cache by the watch.
+	shard := cluster.shardsCache[table.GetShardID()]
+	re.NoError(s.PutShardTopologies(ctx, cluster.clusterID, []uint32{shard.GetID()},
+		[]*metapb.ShardTopology{shard.withVersionBumped(1)}))
+	re.Eventually(func() bool { return !cluster.GetTopology(next.Version).NotModified }, defaultTestTimeout,
+		10*time.Millisecond)
+
+	// The change of the nodes invalidates the cache.
+	result = cluster.GetTopology(0)
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60}))
+	next = cluster.GetTopology(result.Version)
+	re.False(next.NotModified)
+	re.Len(next.Topology.Nodes, 2)
+
+	// Nothing is cached after the watch stops.
+	stopWatch()
+	<-watchDone
+	re.Zero(cluster.GetTopology(next.Version).Version)
+}
+
+func TestFollowerReloadByWatch(t *testing.T) {
+	re := require.New(t)
+	client, clean := prepareEtcdClient(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	leader := NewManagerImpl(newTestStorage(client), testRootPath)
+	_, err := leader.CreateCluster(ctx, testClusterName, 1, 1, 1)
+	re.NoError(err)
+	_, err = leader.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	follower := NewManagerImpl(newTestStorage(client), testRootPath)
+	re.NoError(follower.Load(ctx))
+	cluster, err := follower.GetCluster(ctx, testClusterName)
+	re.NoError(err)
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	go cluster.WatchTopology(watchCtx, func() bool { return true })
+	re.Eventually(func() bool { return cluster.GetTopology(0).Version != 0 }, defaultTestTimeout, 10*time.Millisecond)
+
+	// The tables created by the leader are served by the follower once its watch sees them.
+	_, err = leader.AllocTableID(ctx, testClusterName, "public", "table0")
+	re.NoError(err)
+	re.Eventually(func() bool {
+		tables, err := follower.GetShardTables(ctx, testClusterName, []uint32{0})
+		re.NoError(err)
+		return len(tables[0].Tables) == 1
+	}, defaultTestTimeout, 10*time.Millisecond)
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/pkg/errors"
+)
+
+// ExportTopologyDOT renders the nodes, the shards and the shards hosted by the nodes as a Graphviz DOT graph. The
+// tables are collapsed into the counts on the shards unless expandTables is set.
+// The leaders are connected by solid edges and the followers by dashed ones, the dead nodes are gray and the shards
+// owned by no node are red.
+func (c *Cluster) ExportTopologyDOT(w io.Writer, expandTables bool) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	printf := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format, args...)
+	}
+
+	printf("digraph %s {\n", strconv.Quote(c.metaData.GetName()))
+	printf("  rankdir=LR;\n")
+
+	now := time.Now()
+	nodeNames := make([]string, 0, len(c.nodesCache))
+	for name := range c.nodesCache {
+		nodeNames = append(nodeNames, name)
+	}
+	sort.Strings(nodeNames)
+	for _, name := range nodeNames {
+		status, color := "alive", "black"
+		if !c.nodesCache[name].IsAlive(now) {
+			status, color = "dead", "gray"
+		}
+		printf("  %s [shape=box, color=%s, label=%s];\n", dotNodeID(name), color, strconv.Quote(name+"\n"+status))
+	}
+
+	shardIDs := make([]uint32, 0, len(c.shardsCache))
+	for shardID := range c.shardsCache {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+	for _, shardID := range shardIDs {
+		shard := c.shardsCache[shardID]
+		color := "black"
+		if shard.node == "" {
+			color = "red"
+		}
+		label := fmt.Sprintf("shard %d\nversion %d\n%d tables", shardID, shard.GetVersion(), shard.GetTableCount())
+		printf("  %s [shape=ellipse, color=%s, label=%s];\n", dotShardID(shardID), color, strconv.Quote(label))
+	}
+
+	for _, name := range nodeNames {
+		// The shards info is copied to be sorted since the node info is shared.
+		shardsInfo := append([]*metapb.ShardInfo(nil), c.nodesCache[name].info.GetShardsInfo()...)
+		sort.Slice(shardsInfo, func(i, j int) bool { return shardsInfo[i].GetShardId() < shardsInfo[j].GetShardId() })
+		for _, shardInfo := range shardsInfo {
+			if _, ok := c.shardsCache[shardInfo.GetShardId()]; !ok {
+				continue
+			}
+			style := "solid"
+			if shardInfo.GetRole() != metapb.ShardRole_LEADER {
+				style = "dashed"
+			}
+			printf("  %s -> %s [style=%s];\n", dotNodeID(name), dotShardID(shardInfo.GetShardId()), style)
+		}
+	}
+
+	if expandTables {
+		c.writeDOTTablesLocked(printf)
+	}
+	printf("}\n")
+
+	if err := bw.Flush(); err != nil {
+		return errors.Wrapf(err, "write topology dot, cluster:%s", c.metaData.GetName())
+	}
+	return nil
+}
+
+func (c *Cluster) writeDOTTablesLocked(printf func(format string, args ...interface{})) {
+	tables := make([]*Table, 0)
+	for _, schema := range c.schemasCache {
+		for _, table := range schema.tableMap {
+			if _, ok := c.dropTasks[table.GetID()]; !ok {
+				tables = append(tables, table)
+			}
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].GetID() < tables[j].GetID() })
+
+	for _, table := range tables {
+		tableID := strconv.Quote(fmt.Sprintf("table/%d", table.GetID()))
+		printf("  %s [shape=note, label=%s];\n", tableID, strconv.Quote(table.GetSchemaName()+"."+table.GetName()))
+		printf("  %s -> %s;\n", dotShardID(table.GetShardID()), tableID)
+	}
+}
+
+func dotNodeID(name string) string {
+	return strconv.Quote("node/" + name)
+}
+
+func dotShardID(shardID uint32) string {
+	return strconv.Quote(fmt.Sprintf("shard/%d", shardID))
+}
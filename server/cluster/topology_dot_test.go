@@ -0,0 +1,63 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTopologyDOT(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 2, 2, 2)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 1)
+	re.NoError(err)
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.NoError(err)
+	re.Equal(uint32(1), table.GetShardID())
+
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "a", Lease: 60, ShardsInfo: []*metapb.ShardInfo{
+		{ShardId: 1, Role: metapb.ShardRole_LEADER},
+	}}))
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "b", Lease: 60, ShardsInfo: []*metapb.ShardInfo{
+		{ShardId: 1, Role: metapb.ShardRole_FOLLOWER},
+	}}))
+	cluster.lock.Lock()
+	cluster.nodesCache["b"].lastTouchTime = time.Now().Add(-time.Hour)
+	cluster.lock.Unlock()
+
+	collapsed := `digraph "ceresdbCluster1" {
+  rankdir=LR;
+  "node/a" [shape=box, color=black, label="a\nalive"];
+  "node/b" [shape=box, color=gray, label="b\ndead"];
+  "shard/0" [shape=ellipse, color=red, label="shard 0\nversion 0\n0 tables"];
+  "shard/1" [shape=ellipse, color=black, label="shard 1\nversion 1\n1 tables"];
+  "node/a" -> "shard/1" [style=solid];
+  "node/b" -> "shard/1" [style=dashed];
+`
+	buf := &bytes.Buffer{}
+	re.NoError(manager.ExportTopologyDOT(ctx, testClusterName, buf, false))
+	re.Equal(collapsed+"}\n", buf.String())
+
+	expanded := fmt.Sprintf(`  "table/%d" [shape=note, label="public.t1"];
+  "shard/1" -> "table/%d";
+}
+`, table.GetID(), table.GetID())
+	buf.Reset()
+	re.NoError(manager.ExportTopologyDOT(ctx, testClusterName, buf, true))
+	re.Equal(collapsed+expanded, buf.String())
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+)
+
+type observedTopologyGenerationKey struct{}
+
+// WithObservedTopologyGeneration returns a context carrying the topology generation observed by the sender of the
+// request, which lets the DDLs and the acks in the context be rejected if the generation is too stale.
+func WithObservedTopologyGeneration(ctx context.Context, generation uint64) context.Context {
+	return context.WithValue(ctx, observedTopologyGenerationKey{}, generation)
+}
+
+func observedTopologyGenerationFromContext(ctx context.Context) (uint64, bool) {
+	generation, ok := ctx.Value(observedTopologyGenerationKey{}).(uint64)
+	return generation, ok
+}
+
+// CheckTopologyGeneration returns ErrStaleTopology with the current generation if the generation carried by the ctx
+// lags behind the current one by more than the MaxTopologyGenerationLag of the options. The ctx without the
+// generation, e.g. from the old clients, always passes the check.
+func (c *Cluster) CheckTopologyGeneration(ctx context.Context) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.checkTopologyGenerationLocked(ctx)
+}
+
+func (c *Cluster) checkTopologyGenerationLocked(ctx context.Context) error {
+	return checkTopologyGeneration(ctx, c.topologyGeneration, c.options.MaxTopologyGenerationLag)
+}
+
+func checkTopologyGeneration(ctx context.Context, generation, maxLag uint64) error {
+	if maxLag == 0 {
+		return nil
+	}
+	observed, ok := observedTopologyGenerationFromContext(ctx)
+	if !ok || observed >= generation {
+		return nil
+	}
+	if lag := generation - observed; lag > maxLag {
+		return ErrStaleTopology.WithCausef("current generation:%d, observed generation:%d, max lag:%d",
+			generation, observed, maxLag)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleTopologyGeneration(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, testShardTotal)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{
+		ShardUnavailablePolicy:   ShardUnavailablePolicyReselect,
+		MaxTopologyGenerationLag: 2,
+	}))
+
+	observed := cluster.GetTopologyGeneration()
+	for _, node := range []string{"a", "b"} {
+		re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: node, Lease: 60}))
+	}
+	re.Equal(observed+2, cluster.GetTopologyGeneration())
+
+	// The generation lagging exactly by the bound is accepted.
+	_, err = manager.AllocTableID(WithObservedTopologyGeneration(ctx, observed), testClusterName, "public", "table0")
+	re.NoError(err)
+
+	re.NoError(manager.RegisterNode(ctx, testClusterName, &metapb.NodeInfo{Node: "c", Lease: 60}))
+	staleCtx := WithObservedTopologyGeneration(ctx, observed)
+	err = cluster.CheckTopologyGeneration(staleCtx)
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Contains(err.Error(), "STALE_TOPOLOGY")
+	re.Contains(err.Error(), "current generation:")
+	_, err = manager.AllocTableID(staleCtx, testClusterName, "public", "table1")
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.True(coderr.Is(manager.DropTable(staleCtx, testClusterName, "public", "table0", false), coderr.Conflict))
+	_, err = manager.AlterTable(staleCtx, testClusterName, "public", "table0", 0, []byte("schema"))
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// The routing of the existing tables is not a DDL.
+	_, err = manager.AllocTableID(staleCtx, testClusterName, "public", "table0")
+	re.NoError(err)
+
+	// The requests without the generation bypass the check.
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "table1")
+	re.NoError(err)
+	re.NoError(manager.DropTable(ctx, testClusterName, "public", "table0", false))
+
+	// The check is disabled by a zero bound.
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, Options{ShardUnavailablePolicy: ShardUnavailablePolicyReselect}))
+	re.NoError(cluster.CheckTopologyGeneration(WithObservedTopologyGeneration(ctx, 0)))
+}
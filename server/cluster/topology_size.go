@@ -0,0 +1,69 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"strconv"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// The whole topology of a shard is rewritten on every change of its version, so it is kept well below the default
+	// limit of the etcd on the size of a request, which is 1.5MB.
+	defaultShardTopologyWarnBytes = 256 * 1024
+	defaultMaxShardTopologyBytes  = 1024 * 1024
+
+	// maxTableEntryBytes is the max growth of an encoded topology by placing a table on it, which is the varint of the
+	// table id and the growth of the length of the packed table ids.
+	maxTableEntryBytes = 16
+)
+
+// shardTopologyLimitsLocked returns the size of the topology above which a warning is logged, and the max size of the
+// topology a table can still be placed on.
+func (c *Cluster) shardTopologyLimitsLocked() (warnBytes, maxBytes int) {
+	warnBytes, maxBytes = c.options.ShardTopologyWarnBytes, c.options.MaxShardTopologyBytes
+	if warnBytes == 0 {
+		warnBytes = defaultShardTopologyWarnBytes
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultMaxShardTopologyBytes
+	}
+	return warnBytes, maxBytes
+}
+
+// checkShardTopologySizeLocked returns ErrShardTopologyTooLarge if the topology of the shard can't hold another table
+// without exceeding the max size, which is checked before a table is placed on the shard.
+func (c *Cluster) checkShardTopologySizeLocked(shard *Shard) error {
+	_, maxBytes := c.shardTopologyLimitsLocked()
+	if size := proto.Size(shard.topology); size+maxTableEntryBytes > maxBytes {
+		return ErrShardTopologyTooLarge.WithCausef("shard:%d, tables:%d, size:%d, max size:%d, split the shard or place the tables in another schema",
+			shard.GetID(), shard.GetTableCount(), size, maxBytes)
+	}
+	return nil
+}
+
+// checkNewShardTopologySizeLocked checks the topology to be written for the shard, and a warning is logged if it is
+// larger than the warning size.
+func (c *Cluster) checkNewShardTopologySizeLocked(shardID uint32, topology *metapb.ShardTopology) error {
+	warnBytes, maxBytes := c.shardTopologyLimitsLocked()
+	size := proto.Size(topology)
+	if size > maxBytes {
+		return ErrShardTopologyTooLarge.WithCausef("shard:%d, tables:%d, size:%d, max size:%d, split the shard or place the tables in another schema",
+			shardID, len(topology.GetTableIds()), size, maxBytes)
+	}
+	if size > warnBytes {
+		log.Warn("shard topology is oversized", zap.String("cluster", c.metaData.GetName()), zap.Uint32("shard", shardID),
+			zap.Int("tables", len(topology.GetTableIds())), zap.Int("size", size), zap.Int("max-size", maxBytes))
+	}
+	return nil
+}
+
+// observeShardTopologySizeLocked exports the size of the topology of the shard.
+func (c *Cluster) observeShardTopologySizeLocked(shard *Shard) {
+	shardTopologyBytesGauge.WithLabelValues(c.metaData.GetName(), strconv.FormatUint(uint64(shard.GetID()), 10)).
+		Set(float64(proto.Size(shard.topology)))
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package cluster
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// fillShardTopology replaces the topology of the shard with the tables from the firstID until it reaches the size.
+func fillShardTopology(c *Cluster, shardID uint32, firstID uint64, size int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	shard := c.shardsCache[shardID]
+	topology := &metapb.ShardTopology{Version: shard.GetVersion()}
+	for id := firstID; proto.Size(topology) < size; id++ {
+		topology.TableIds = append(topology.TableIds, id)
+	}
+	shard.topology = topology
+	return len(topology.TableIds)
+}
+
+func TestShardTopologySize(t *testing.T) {
+	re := require.New(t)
+	s, clean := prepareEtcdStorage(t)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	logFile := filepath.Join(t.TempDir(), "cluster.log")
+	_, err := log.InitGlobalLogger(&log.Config{Level: "info", File: logFile})
+	re.NoError(err)
+	defer func() {
+		_, _ = log.InitGlobalLogger(&log.Config{Level: "info", File: "stdout"})
+	}()
+
+	manager := NewManagerImpl(s, testRootPath)
+	cluster, err := manager.CreateCluster(ctx, testClusterName, 1, 1, 2)
+	re.NoError(err)
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	opts := cluster.GetOptions()
+	opts.MaxShardTopologyBytes = -1
+	re.True(coderr.Is(manager.SetClusterOptions(ctx, testClusterName, opts), coderr.InvalidParams))
+	opts.ShardTopologyWarnBytes, opts.MaxShardTopologyBytes = 512, 2048
+	re.NoError(manager.SetClusterOptions(ctx, testClusterName, opts))
+
+	// The shard 0 is near the limit with fewer tables, which would be picked otherwise, and the shard 1 is just above
+	// the warning size.
+	nearLimit := fillShardTopology(cluster, 0, 1<<60, 2048-maxTableEntryBytes+1)
+	aboveWarning := fillShardTopology(cluster, 1, 1000, 520)
+	re.Less(nearLimit, aboveWarning)
+
+	table, err := manager.AllocTableID(ctx, testClusterName, "public", "t0")
+	re.NoError(err)
+	re.Equal(uint32(1), table.GetShardID())
+	cluster.lock.RLock()
+	size := proto.Size(cluster.shardsCache[1].topology)
+	cluster.lock.RUnlock()
+	re.Equal(float64(size), testutil.ToFloat64(shardTopologyBytesGauge.WithLabelValues(testClusterName, "1")))
+	logged, err := os.ReadFile(logFile)
+	re.NoError(err)
+	re.Contains(string(logged), "shard topology is oversized")
+
+	// No table is placed once all the shards are near the limit.
+	fillShardTopology(cluster, 1, 1000, 2048-maxTableEntryBytes+1)
+	_, err = manager.AllocTableID(ctx, testClusterName, "public", "t1")
+	re.True(coderr.Is(err, coderr.InsufficientStorage))
+	re.ErrorContains(err, "split the shard")
+
+	// The topology to write is rejected if it exceeds the limit anyway.
+	cluster.lock.Lock()
+	oversized := cluster.shardsCache[0].withTable(1<<62, 1)
+	oversized.TableIds = append(oversized.TableIds, 1<<62+1, 1<<62+2)
+	err = cluster.checkNewShardTopologySizeLocked(0, oversized)
+	cluster.lock.Unlock()
+	re.True(coderr.Is(err, coderr.InsufficientStorage))
+}
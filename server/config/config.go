@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/CeresDB/ceresmeta/pkg/log"
@@ -15,12 +16,19 @@ import (
 const (
 	defaultGrpcHandleTimeoutMs int64 = 10 * 1000
 	defaultEtcdStartTimeoutMs  int64 = 10 * 1000
+	defaultEtcdStartupWaitMs   int64 = 60 * 1000
 	defaultCallTimeoutMs             = 5 * 1000
 	defaultEtcdLeaseTTLSec           = 10
 
+	defaultEtcdSpaceCheckIntervalMs int64 = 10 * 1000
+	defaultEtcdCompactionIntervalMs int64 = 5 * 60 * 1000
+	defaultReadStalenessCheckMs     int64 = 1000
+	defaultLeadershipCheckMs        int64 = 1000
+
 	defaultNodeNamePrefix          = "ceresmeta"
 	defaultDataDir                 = "/tmp/ceresmeta/data"
 	defaultWalDir                  = "/tmp/ceresmeta/wal"
+	defaultSnapshotDir             = "/tmp/ceresmeta/snapshot"
 	defaultClientUrls              = "http://127.0.0.1:2379"
 	defaultPeerUrls                = "http://127.0.0.1:2380"
 	defaultInitialClusterState     = embed.ClusterStateFlagNew
@@ -33,6 +41,53 @@ const (
 	defaultQuotaBackendBytes       = 8 * 1024 * 1024 * 1024 // 8GB
 
 	defaultMaxRequestBytes uint = 2 * 1024 * 1024 // 2MB
+
+	defaultStorageRootPath = "/ceresmeta"
+	defaultMaxScanLimit    = 100
+	defaultMinScanLimit    = 20
+
+	defaultEtcdRateLimitBurst = 100
+
+	defaultTopologyDeltaMaxChanges = 256
+
+	defaultClusterName              = "defaultCluster"
+	defaultClusterNodeCount         = 2
+	defaultClusterReplicationFactor = 1
+	defaultClusterShardTotal        = 8
+
+	defaultHeartbeatWorkers               = 8
+	defaultHeartbeatQueueSize             = 4096
+	defaultHeartbeatDeadlineMs      int64 = 1000
+	defaultHeartbeatFlushIntervalMs int64 = 200
+	defaultHeartbeatLatencySLOMs    int64 = 100
+
+	defaultShardAutoAssignIntervalMs int64 = 10 * 1000
+	defaultShardAutoAssignDelayMs    int64 = 30 * 1000
+
+	defaultShardOpenBatchSize          = 8
+	defaultShardOpenMaxInFlight        = 16
+	defaultShardOpenAckTimeoutMs int64 = 60 * 1000
+
+	defaultConditionCheckIntervalMs int64 = 10 * 1000
+
+	defaultHookTimeoutMs int64 = 5 * 1000
+
+	defaultTableSetVerifyIntervalMs int64 = 30 * 1000
+
+	defaultTableRouteStatsPersistIntervalMs int64 = 60 * 1000
+
+	defaultNodeEndpointProbeTimeoutMs int64 = 1000
+
+	defaultSnapshotRetentionCount = 24
+
+	defaultNodeConflictPolicy = "fence"
+
+	defaultObserverCheckIntervalMs  int64  = 5 * 1000
+	defaultObserverPromotionDelayMs int64  = 60 * 1000
+	defaultObserverMaxLagIndex      uint64 = 1000
+
+	defaultAdaptiveLeaseMaxTTLSec int64 = 60
+	defaultAdaptiveLeaseStableMs  int64 = 10 * 60 * 1000
 )
 
 type Config struct {
@@ -42,8 +97,31 @@ type Config struct {
 	GrpcHandleTimeoutMs int64 `toml:"grpc-handle-timeout-ms" json:"grpc-handle-timeout-ms"`
 	EtcdStartTimeoutMs  int64 `toml:"etcd-start-timeout-ms" json:"etcd-start-timeout-ms"`
 	EtcdCallTimeoutMs   int64 `toml:"etcd-call-timeout-ms" json:"etcd-call-timeout-ms"`
+	// The connection to the etcd and the first read of the storage are retried with backoff for at most
+	// EtcdStartupWaitMs during the startup, and they are attempted only once if it is zero.
+	EtcdStartupWaitMs int64 `toml:"etcd-startup-wait-ms" json:"etcd-startup-wait-ms"`
 
 	LeaseTTLSec int64 `toml:"lease-sec" json:"lease-sec"`
+	// EtcdUsername and EtcdPassword are the credentials of the etcd client if the etcd authentication is enabled.
+	EtcdUsername string `toml:"etcd-username" json:"etcd-username"`
+	EtcdPassword string `toml:"etcd-password" json:"-"`
+	// EtcdSpaceCheckIntervalMs is the interval for checking whether the etcd space quota is exceeded.
+	EtcdSpaceCheckIntervalMs int64 `toml:"etcd-space-check-interval-ms" json:"etcd-space-check-interval-ms"`
+	// The leader compacts the etcd revisions older than EtcdCompactionRetentionMs or out of the latest
+	// EtcdCompactionRetentionRevisions periodically, and the compaction is disabled if both are zero. The etcd is
+	// defragmented after the compaction once a day in EtcdDefragWindow in the form of HH:MM-HH:MM in UTC if it is not
+	// empty.
+	EtcdCompactionIntervalMs         int64  `toml:"etcd-compaction-interval-ms" json:"etcd-compaction-interval-ms"`
+	EtcdCompactionRetentionMs        int64  `toml:"etcd-compaction-retention-ms" json:"etcd-compaction-retention-ms"`
+	EtcdCompactionRetentionRevisions int64  `toml:"etcd-compaction-retention-revisions" json:"etcd-compaction-retention-revisions"`
+	EtcdDefragWindow                 string `toml:"etcd-defrag-window" json:"etcd-defrag-window"`
+	// A follower stops serving the reads if the revision it has applied lags behind the leader by more than
+	// MaxReadStalenessRevisions, which is checked every ReadStalenessCheckIntervalMs. Zero means unbounded.
+	MaxReadStalenessRevisions    int64 `toml:"max-read-staleness-revisions" json:"max-read-staleness-revisions"`
+	ReadStalenessCheckIntervalMs int64 `toml:"read-staleness-check-interval-ms" json:"read-staleness-check-interval-ms"`
+	// The server checks whether it becomes the leader every LeadershipCheckIntervalMs, and restarts tracking the
+	// heartbeats of the nodes if so.
+	LeadershipCheckIntervalMs int64 `toml:"leadership-check-interval-ms" json:"leadership-check-interval-ms"`
 
 	NodeName            string `toml:"node-name" json:"node-name"`
 	DataDir             string `toml:"data-dir" json:"data-dir"`
@@ -72,6 +150,155 @@ type Config struct {
 	PeerUrls            string `toml:"peer-urls" json:"peer-urls"`
 	AdvertiseClientUrls string `toml:"advertise-client-urls" json:"advertise-client-urls"`
 	AdvertisePeerUrls   string `toml:"advertise-peer-urls" json:"advertise-peer-urls"`
+
+	// StorageRootPath is the root path of all the meta data stored in the etcd.
+	StorageRootPath string `toml:"storage-root-path" json:"storage-root-path"`
+	MaxScanLimit    int    `toml:"max-scan-limit" json:"max-scan-limit"`
+	MinScanLimit    int    `toml:"min-scan-limit" json:"min-scan-limit"`
+	// The etcd reads and writes of the storage are capped by the token buckets with the rates in ops/sec and the
+	// bursts, and a zero rate disables the limit. The requests exceeding the limit wait for the tokens unless
+	// EtcdRateLimitFailFast is set.
+	EtcdReadRateLimit     float64 `toml:"etcd-read-rate-limit" json:"etcd-read-rate-limit"`
+	EtcdReadBurst         int     `toml:"etcd-read-burst" json:"etcd-read-burst"`
+	EtcdWriteRateLimit    float64 `toml:"etcd-write-rate-limit" json:"etcd-write-rate-limit"`
+	EtcdWriteBurst        int     `toml:"etcd-write-burst" json:"etcd-write-burst"`
+	EtcdRateLimitFailFast bool    `toml:"etcd-rate-limit-fail-fast" json:"etcd-rate-limit-fail-fast"`
+	// The shard topology writes within TopologyBatchWindowMs are coalesced into the etcd transactions, which speeds up
+	// the bursts of the writes at the cost of the latency of a single one, and zero disables the batching.
+	TopologyBatchWindowMs int64 `toml:"topology-batch-window-ms" json:"topology-batch-window-ms"`
+	// The shard topologies holding at least TopologyDeltaMinTables tables are written as the deltas against their
+	// bases until more than TopologyDeltaMaxChanges tables are added or removed since the base, which reduces the etcd
+	// writes of the shards with huge table sets. Zero TopologyDeltaMinTables disables the delta encoding.
+	TopologyDeltaMinTables  int `toml:"topology-delta-min-tables" json:"topology-delta-min-tables"`
+	TopologyDeltaMaxChanges int `toml:"topology-delta-max-changes" json:"topology-delta-max-changes"`
+
+	// The root path is owned by the deployment whose fingerprint is created by its first bootstrap, and the node refuses
+	// to start if the fingerprint has another id than the DeploymentID or misses the default cluster, unless
+	// AllowRootPathTakeover is set. Any id is accepted if the DeploymentID is empty, and the id is logged at startup.
+	DeploymentID          string `toml:"deployment-id" json:"deployment-id"`
+	AllowRootPathTakeover bool   `toml:"allow-root-path-takeover" json:"allow-root-path-takeover"`
+
+	// At most MaxConcurrentProcedures procedures run at the same time, and the others are queued by their priorities
+	// while the low priority ones are rejected. Zero means unlimited.
+	MaxConcurrentProcedures int `toml:"max-concurrent-procedures" json:"max-concurrent-procedures"`
+
+	// The default cluster is created at startup if it does not exist.
+	DefaultClusterName              string `toml:"default-cluster-name" json:"default-cluster-name"`
+	DefaultClusterNodeCount         int    `toml:"default-cluster-node-count" json:"default-cluster-node-count"`
+	DefaultClusterReplicationFactor int    `toml:"default-cluster-replication-factor" json:"default-cluster-replication-factor"`
+	DefaultClusterShardTotal        int    `toml:"default-cluster-shard-total" json:"default-cluster-shard-total"`
+	// DefaultClusterInitialNodes are the comma-separated names of the nodes expected to join the default cluster, and
+	// the shards of the default cluster are spread over them deterministically if it is not empty.
+	DefaultClusterInitialNodes string `toml:"default-cluster-initial-nodes" json:"default-cluster-initial-nodes"`
+	// DefaultClusterInitialShardAssignment pins the shards of the default cluster to the initial nodes, in the form of
+	// comma-separated shardID=node.
+	DefaultClusterInitialShardAssignment string `toml:"default-cluster-initial-shard-assignment" json:"default-cluster-initial-shard-assignment"`
+	// DefaultClusterTableNameScope is the scope in which the names of the tables of the default cluster are unique,
+	// one of schema, cluster and shard, and it can't be changed once the cluster is created.
+	DefaultClusterTableNameScope string `toml:"default-cluster-table-name-scope" json:"default-cluster-table-name-scope"`
+	// DefaultClusterTableIDAllocScope is the scope sharing the same allocator of the ids of the tables of the default
+	// cluster, either cluster or schema, and it can't be changed once the cluster is created.
+	DefaultClusterTableIDAllocScope string `toml:"default-cluster-table-id-alloc-scope" json:"default-cluster-table-id-alloc-scope"`
+	// DefaultClusterEnvironment, DefaultClusterOwner and DefaultClusterTags label the default cluster at its creation,
+	// and the tags are comma-separated in the form of key=value.
+	DefaultClusterEnvironment string `toml:"default-cluster-environment" json:"default-cluster-environment"`
+	DefaultClusterOwner       string `toml:"default-cluster-owner" json:"default-cluster-owner"`
+	DefaultClusterTags        string `toml:"default-cluster-tags" json:"default-cluster-tags"`
+
+	// The heartbeats changing more than the liveness of the nodes are handled by HeartbeatWorkers dedicated workers,
+	// queueing at most HeartbeatQueueSize nodes, and the heartbeat not handled within the HeartbeatDeadlineMs is
+	// acked with the liveness of its node kept. The liveness recorded by the other heartbeats is applied to the nodes
+	// every HeartbeatFlushIntervalMs, and the heartbeats slower than the HeartbeatLatencySLOMs are counted.
+	HeartbeatWorkers         int   `toml:"heartbeat-workers" json:"heartbeat-workers"`
+	HeartbeatQueueSize       int   `toml:"heartbeat-queue-size" json:"heartbeat-queue-size"`
+	HeartbeatDeadlineMs      int64 `toml:"heartbeat-deadline-ms" json:"heartbeat-deadline-ms"`
+	HeartbeatFlushIntervalMs int64 `toml:"heartbeat-flush-interval-ms" json:"heartbeat-flush-interval-ms"`
+	HeartbeatLatencySLOMs    int64 `toml:"heartbeat-latency-slo-ms" json:"heartbeat-latency-slo-ms"`
+
+	// EnableShardAutoAssign enables assigning the shards owned by no node to the alive nodes automatically.
+	EnableShardAutoAssign     bool  `toml:"enable-shard-auto-assign" json:"enable-shard-auto-assign"`
+	ShardAutoAssignIntervalMs int64 `toml:"shard-auto-assign-interval-ms" json:"shard-auto-assign-interval-ms"`
+	// ShardAutoAssignDelayMs is how long a shard should be owned by no node before it is assigned automatically, so
+	// that the shards are not assigned before the nodes report their shards after restarting.
+	ShardAutoAssignDelayMs int64 `toml:"shard-auto-assign-delay-ms" json:"shard-auto-assign-delay-ms"`
+	// The open commands are sent to a node in batches of at most ShardOpenBatchSize shards, and the next batch is sent
+	// once less than ShardOpenMaxInFlight shards of the node are waiting for the acks within ShardOpenAckTimeoutMs.
+	// Zero size or max in flight means unlimited, and the pacing can be changed at runtime by SetShardOpenPacing.
+	ShardOpenBatchSize    int   `toml:"shard-open-batch-size" json:"shard-open-batch-size"`
+	ShardOpenMaxInFlight  int   `toml:"shard-open-max-in-flight" json:"shard-open-max-in-flight"`
+	ShardOpenAckTimeoutMs int64 `toml:"shard-open-ack-timeout-ms" json:"shard-open-ack-timeout-ms"`
+
+	// The transitions of the cluster conditions are posted to the WebhookURL if it is not empty.
+	WebhookURL string `toml:"webhook-url" json:"webhook-url"`
+	// WebhookAuthHeader is the value of the Authorization header of the webhook requests.
+	WebhookAuthHeader        string `toml:"webhook-auth-header" json:"webhook-auth-header"`
+	ConditionCheckIntervalMs int64  `toml:"condition-check-interval-ms" json:"condition-check-interval-ms"`
+
+	// AdminToken is the token the callers of the http apis must present as the bearer token, and the http apis are
+	// disabled if it is empty.
+	AdminToken string `toml:"admin-token" json:"-"`
+
+	// EnableLogHook logs the events the hooks are invoked on, such as the tables created and the nodes gone offline.
+	EnableLogHook bool `toml:"enable-log-hook" json:"enable-log-hook"`
+	// The events are posted to the HookWebhookURL if it is not empty.
+	HookWebhookURL string `toml:"hook-webhook-url" json:"hook-webhook-url"`
+	// HookExecCommand is the command run with the json-encoded event on its stdin, which is disabled if it is empty.
+	HookExecCommand string `toml:"hook-exec-command" json:"hook-exec-command"`
+	// HookTimeoutMs bounds every invocation of the hooks, and the hook overrunning it is abandoned.
+	HookTimeoutMs int64 `toml:"hook-timeout-ms" json:"hook-timeout-ms"`
+
+	// AuditSink is the kind of the sink the records of the mutating operations are shipped to, which is one of file,
+	// syslog and http, and the audit logging is disabled if it is empty.
+	AuditSink string `toml:"audit-sink" json:"audit-sink"`
+	// AuditSinkAddress is the path of the file, the url like "udp://host:514" of the syslog or the url of the http.
+	AuditSinkAddress string `toml:"audit-sink-address" json:"audit-sink-address"`
+
+	TableSetVerifyIntervalMs int64 `toml:"table-set-verify-interval-ms" json:"table-set-verify-interval-ms"`
+
+	// TableRouteStatsPersistIntervalMs is the interval for persisting the route statistics of the tables, which bounds
+	// the statistics lost in a failover.
+	TableRouteStatsPersistIntervalMs int64 `toml:"table-route-stats-persist-interval-ms" json:"table-route-stats-persist-interval-ms"`
+
+	// AllowLoopbackNodeEndpoint accepts the loopback endpoints advertised by the nodes, which is only for development.
+	AllowLoopbackNodeEndpoint bool `toml:"allow-loopback-node-endpoint" json:"allow-loopback-node-endpoint"`
+	// EnableNodeEndpointProbe enables connecting the endpoint advertised by a node before accepting it.
+	EnableNodeEndpointProbe    bool  `toml:"enable-node-endpoint-probe" json:"enable-node-endpoint-probe"`
+	NodeEndpointProbeTimeoutMs int64 `toml:"node-endpoint-probe-timeout-ms" json:"node-endpoint-probe-timeout-ms"`
+
+	// CommandAckMinNodeVersion is the min binary version of the nodes whose shard commands are tracked until acked by
+	// their heartbeats and resent after they reconnect, and the tracking is disabled if it is empty.
+	CommandAckMinNodeVersion string `toml:"command-ack-min-node-version" json:"command-ack-min-node-version"`
+	// NodeConflictPolicy decides how to handle a node started twice with the same identity, which is one of reject,
+	// fence and ignore.
+	NodeConflictPolicy string `toml:"node-conflict-policy" json:"node-conflict-policy"`
+
+	// The leader writes the snapshots of the clusters into SnapshotDir every SnapshotIntervalMs, and the scheduled
+	// snapshots are disabled if the interval is zero. The latest SnapshotRetentionCount snapshots within
+	// SnapshotRetentionMs are kept, and zero means unlimited.
+	SnapshotIntervalMs     int64  `toml:"snapshot-interval-ms" json:"snapshot-interval-ms"`
+	SnapshotDir            string `toml:"snapshot-dir" json:"snapshot-dir"`
+	SnapshotRetentionCount int    `toml:"snapshot-retention-count" json:"snapshot-retention-count"`
+	SnapshotRetentionMs    int64  `toml:"snapshot-retention-ms" json:"snapshot-retention-ms"`
+
+	// The leader mirrors the metadata under StorageRootPath to ReplicaStorageRootPath of the standby etcd cluster
+	// served on the comma-separated ReplicaEtcdEndpoints, and the mirroring is disabled if no endpoint is given.
+	ReplicaEtcdEndpoints   string `toml:"replica-etcd-endpoints" json:"replica-etcd-endpoints"`
+	ReplicaStorageRootPath string `toml:"replica-storage-root-path" json:"replica-storage-root-path"`
+
+	// EnableObserverAutoPromotion makes the leader replace a voting etcd member unhealthy for ObserverPromotionDelayMs
+	// with the freshest observer (an etcd learner), and the observers lagging more than ObserverMaxLagIndex raft entries
+	// are never promoted. The promotion is only possible while the quorum is still kept.
+	EnableObserverAutoPromotion bool   `toml:"enable-observer-auto-promotion" json:"enable-observer-auto-promotion"`
+	ObserverCheckIntervalMs     int64  `toml:"observer-check-interval-ms" json:"observer-check-interval-ms"`
+	ObserverPromotionDelayMs    int64  `toml:"observer-promotion-delay-ms" json:"observer-promotion-delay-ms"`
+	ObserverMaxLagIndex         uint64 `toml:"observer-max-lag-index" json:"observer-max-lag-index"`
+
+	// EnableAdaptiveLeaseTTL raises the ttl of the leadership lease from LeaseTTLSec up to AdaptiveLeaseMaxTTLSec once
+	// a keepalive delay or a gc pause takes more than half of it, and lowers it back by a second after every
+	// AdaptiveLeaseStableMs without such a near miss. The tuned ttl takes effect from the next campaign.
+	EnableAdaptiveLeaseTTL bool  `toml:"enable-adaptive-lease-ttl" json:"enable-adaptive-lease-ttl"`
+	AdaptiveLeaseMaxTTLSec int64 `toml:"adaptive-lease-max-ttl-sec" json:"adaptive-lease-max-ttl-sec"`
+	AdaptiveLeaseStableMs  int64 `toml:"adaptive-lease-stable-ms" json:"adaptive-lease-stable-ms"`
 }
 
 func (c *Config) GrpcHandleTimeout() time.Duration {
@@ -86,6 +313,105 @@ func (c *Config) EtcdCallTimeout() time.Duration {
 	return time.Duration(c.EtcdCallTimeoutMs) * time.Millisecond
 }
 
+func (c *Config) EtcdStartupWait() time.Duration {
+	return time.Duration(c.EtcdStartupWaitMs) * time.Millisecond
+}
+
+func (c *Config) EtcdSpaceCheckInterval() time.Duration {
+	return time.Duration(c.EtcdSpaceCheckIntervalMs) * time.Millisecond
+}
+
+func (c *Config) EtcdCompactionInterval() time.Duration {
+	return time.Duration(c.EtcdCompactionIntervalMs) * time.Millisecond
+}
+
+func (c *Config) ReadStalenessCheckInterval() time.Duration {
+	return time.Duration(c.ReadStalenessCheckIntervalMs) * time.Millisecond
+}
+
+func (c *Config) LeadershipCheckInterval() time.Duration {
+	return time.Duration(c.LeadershipCheckIntervalMs) * time.Millisecond
+}
+
+func (c *Config) TopologyBatchWindow() time.Duration {
+	return time.Duration(c.TopologyBatchWindowMs) * time.Millisecond
+}
+
+func (c *Config) ShardAutoAssignInterval() time.Duration {
+	return time.Duration(c.ShardAutoAssignIntervalMs) * time.Millisecond
+}
+
+func (c *Config) ShardAutoAssignDelay() time.Duration {
+	return time.Duration(c.ShardAutoAssignDelayMs) * time.Millisecond
+}
+
+func (c *Config) ShardOpenAckTimeout() time.Duration {
+	return time.Duration(c.ShardOpenAckTimeoutMs) * time.Millisecond
+}
+
+func (c *Config) HeartbeatDeadline() time.Duration {
+	return time.Duration(c.HeartbeatDeadlineMs) * time.Millisecond
+}
+
+func (c *Config) HeartbeatFlushInterval() time.Duration {
+	return time.Duration(c.HeartbeatFlushIntervalMs) * time.Millisecond
+}
+
+func (c *Config) HeartbeatLatencySLO() time.Duration {
+	return time.Duration(c.HeartbeatLatencySLOMs) * time.Millisecond
+}
+
+func (c *Config) ConditionCheckInterval() time.Duration {
+	return time.Duration(c.ConditionCheckIntervalMs) * time.Millisecond
+}
+
+func (c *Config) HookTimeout() time.Duration {
+	return time.Duration(c.HookTimeoutMs) * time.Millisecond
+}
+
+func (c *Config) TableSetVerifyInterval() time.Duration {
+	return time.Duration(c.TableSetVerifyIntervalMs) * time.Millisecond
+}
+
+func (c *Config) TableRouteStatsPersistInterval() time.Duration {
+	return time.Duration(c.TableRouteStatsPersistIntervalMs) * time.Millisecond
+}
+
+func (c *Config) NodeEndpointProbeTimeout() time.Duration {
+	return time.Duration(c.NodeEndpointProbeTimeoutMs) * time.Millisecond
+}
+
+func (c *Config) SnapshotInterval() time.Duration {
+	return time.Duration(c.SnapshotIntervalMs) * time.Millisecond
+}
+
+func (c *Config) SnapshotRetention() time.Duration {
+	return time.Duration(c.SnapshotRetentionMs) * time.Millisecond
+}
+
+func (c *Config) ObserverCheckInterval() time.Duration {
+	return time.Duration(c.ObserverCheckIntervalMs) * time.Millisecond
+}
+
+func (c *Config) ObserverPromotionDelay() time.Duration {
+	return time.Duration(c.ObserverPromotionDelayMs) * time.Millisecond
+}
+
+func (c *Config) AdaptiveLeaseStable() time.Duration {
+	return time.Duration(c.AdaptiveLeaseStableMs) * time.Millisecond
+}
+
+// ReplicaEndpoints returns the endpoints of the standby etcd cluster, which is empty if the mirroring is disabled.
+func (c *Config) ReplicaEndpoints() []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(c.ReplicaEtcdEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
 // ValidateAndAdjust validates the config fields and adjusts some fields which should be adjusted.
 // Return error if any field is invalid.
 func (c *Config) ValidateAndAdjust() error {
@@ -185,7 +511,18 @@ func MakeConfigParser() (*Parser, error) {
 	fs.Int64Var(&cfg.GrpcHandleTimeoutMs, "grpc-handle-timeout-ms", defaultGrpcHandleTimeoutMs, "timeout for handling grpc requests")
 	fs.Int64Var(&cfg.EtcdStartTimeoutMs, "etcd-start-timeout-ms", defaultEtcdStartTimeoutMs, "timeout for starting etcd server")
 	fs.Int64Var(&cfg.EtcdCallTimeoutMs, "etcd-dial-timeout-ms", defaultCallTimeoutMs, "timeout for dialing etcd server")
+	fs.Int64Var(&cfg.EtcdStartupWaitMs, "etcd-startup-wait-ms", defaultEtcdStartupWaitMs, "max duration for waiting for etcd to be ready during startup (attempted once if zero)")
+	fs.StringVar(&cfg.EtcdUsername, "etcd-username", "", "username of the etcd client if the etcd authentication is enabled")
+	fs.StringVar(&cfg.EtcdPassword, "etcd-password", "", "password of the etcd client if the etcd authentication is enabled")
 	fs.Int64Var(&cfg.LeaseTTLSec, "lease-ttl-sec", defaultEtcdLeaseTTLSec, "ttl of etcd key lease (suggest 10s)")
+	fs.Int64Var(&cfg.EtcdSpaceCheckIntervalMs, "etcd-space-check-interval-ms", defaultEtcdSpaceCheckIntervalMs, "interval for checking whether the etcd space quota is exceeded")
+	fs.Int64Var(&cfg.EtcdCompactionIntervalMs, "etcd-compaction-interval-ms", defaultEtcdCompactionIntervalMs, "interval for compacting the etcd revisions")
+	fs.Int64Var(&cfg.EtcdCompactionRetentionMs, "etcd-compaction-retention-ms", 0, "retention of the etcd revisions by time (unlimited if zero)")
+	fs.Int64Var(&cfg.EtcdCompactionRetentionRevisions, "etcd-compaction-retention-revisions", 0, "number of the latest etcd revisions retained (unlimited if zero)")
+	fs.StringVar(&cfg.EtcdDefragWindow, "etcd-defrag-window", "", "daily window HH:MM-HH:MM in UTC to defragment the etcd after the compaction (disabled if empty)")
+	fs.Int64Var(&cfg.MaxReadStalenessRevisions, "max-read-staleness-revisions", 0, "max revisions a follower may lag behind the leader and still serve reads (unbounded if zero)")
+	fs.Int64Var(&cfg.ReadStalenessCheckIntervalMs, "read-staleness-check-interval-ms", defaultReadStalenessCheckMs, "interval for checking the lag of the follower behind the leader")
+	fs.Int64Var(&cfg.LeadershipCheckIntervalMs, "leadership-check-interval-ms", defaultLeadershipCheckMs, "interval for checking whether the server becomes the leader")
 
 	defaultNodeName, err := makeDefaultNodeName()
 	if err != nil {
@@ -214,5 +551,86 @@ func MakeConfigParser() (*Parser, error) {
 	fs.StringVar(&cfg.AutoCompactionRetention, "auto-compaction-retention", defaultAutoCompactionRetention, "retention for auto compaction(works only if auto-compaction-mode is periodic)")
 	fs.UintVar(&cfg.MaxRequestBytes, "max-request-bytes", defaultMaxRequestBytes, "max bytes of requests received by etcd server")
 
+	fs.StringVar(&cfg.StorageRootPath, "storage-root-path", defaultStorageRootPath, "root path of the meta data stored in etcd")
+	fs.IntVar(&cfg.MaxScanLimit, "max-scan-limit", defaultMaxScanLimit, "max number of keys in a scan of the storage")
+	fs.IntVar(&cfg.MinScanLimit, "min-scan-limit", defaultMinScanLimit, "min number of keys in a scan of the storage")
+	fs.Float64Var(&cfg.EtcdReadRateLimit, "etcd-read-rate-limit", 0, "max etcd reads per second of the storage (unlimited if zero)")
+	fs.IntVar(&cfg.EtcdReadBurst, "etcd-read-burst", defaultEtcdRateLimitBurst, "max burst of the etcd reads of the storage")
+	fs.Float64Var(&cfg.EtcdWriteRateLimit, "etcd-write-rate-limit", 0, "max etcd writes per second of the storage (unlimited if zero)")
+	fs.IntVar(&cfg.EtcdWriteBurst, "etcd-write-burst", defaultEtcdRateLimitBurst, "max burst of the etcd writes of the storage")
+	fs.BoolVar(&cfg.EtcdRateLimitFailFast, "etcd-rate-limit-fail-fast", false, "fail the etcd requests exceeding the rate limit instead of waiting")
+	fs.Int64Var(&cfg.TopologyBatchWindowMs, "topology-batch-window-ms", 0, "window for coalescing the shard topology writes into the etcd transactions (disabled if zero)")
+	fs.IntVar(&cfg.TopologyDeltaMinTables, "topology-delta-min-tables", 0, "min number of the tables of a shard topology written as a delta against its base (disabled if zero)")
+	fs.IntVar(&cfg.TopologyDeltaMaxChanges, "topology-delta-max-changes", defaultTopologyDeltaMaxChanges, "max number of the tables added or removed since the base of a shard topology before a new base is written")
+	fs.StringVar(&cfg.DeploymentID, "deployment-id", "", "expected id of the deployment owning the storage root path (any if empty)")
+	fs.BoolVar(&cfg.AllowRootPathTakeover, "allow-root-path-takeover", false, "take over the storage root path owned by another deployment instead of refusing to start")
+	fs.IntVar(&cfg.MaxConcurrentProcedures, "max-concurrent-procedures", 0, "max number of the procedures running at the same time (unlimited if 0)")
+
+	fs.StringVar(&cfg.DefaultClusterName, "default-cluster-name", defaultClusterName, "name of the default cluster")
+	fs.IntVar(&cfg.DefaultClusterNodeCount, "default-cluster-node-count", defaultClusterNodeCount, "node count of the default cluster")
+	fs.IntVar(&cfg.DefaultClusterReplicationFactor, "default-cluster-replication-factor", defaultClusterReplicationFactor, "replication factor of the default cluster")
+	fs.IntVar(&cfg.DefaultClusterShardTotal, "default-cluster-shard-total", defaultClusterShardTotal, "shard total of the default cluster")
+	fs.StringVar(&cfg.DefaultClusterInitialNodes, "default-cluster-initial-nodes", "", "comma-separated names of the nodes the shards of the default cluster are initially assigned to (arbitrary if empty)")
+	fs.StringVar(&cfg.DefaultClusterInitialShardAssignment, "default-cluster-initial-shard-assignment", "", "comma-separated shardID=node pinning the shards of the default cluster to the initial nodes")
+	fs.StringVar(&cfg.DefaultClusterTableNameScope, "default-cluster-table-name-scope", "schema", "scope in which the names of the tables of the default cluster are unique: schema, cluster or shard")
+	fs.StringVar(&cfg.DefaultClusterTableIDAllocScope, "default-cluster-table-id-alloc-scope", "cluster", "scope sharing the same allocator of the table ids of the default cluster: cluster or schema")
+	fs.StringVar(&cfg.DefaultClusterEnvironment, "default-cluster-environment", "", "environment label of the default cluster, e.g. prod, staging or dev")
+	fs.StringVar(&cfg.DefaultClusterOwner, "default-cluster-owner", "", "owner label of the default cluster")
+	fs.StringVar(&cfg.DefaultClusterTags, "default-cluster-tags", "", "comma-separated tags of the default cluster in the form of key=value")
+
+	fs.IntVar(&cfg.HeartbeatWorkers, "heartbeat-workers", defaultHeartbeatWorkers, "number of the workers dedicated to the heartbeats changing more than the liveness")
+	fs.IntVar(&cfg.HeartbeatQueueSize, "heartbeat-queue-size", defaultHeartbeatQueueSize, "max number of the nodes whose heartbeats wait for the workers")
+	fs.Int64Var(&cfg.HeartbeatDeadlineMs, "heartbeat-deadline-ms", defaultHeartbeatDeadlineMs, "deadline of handling a heartbeat before it is acked with the liveness kept")
+	fs.Int64Var(&cfg.HeartbeatFlushIntervalMs, "heartbeat-flush-interval-ms", defaultHeartbeatFlushIntervalMs, "interval for applying the liveness recorded by the heartbeats to the nodes")
+	fs.Int64Var(&cfg.HeartbeatLatencySLOMs, "heartbeat-latency-slo-ms", defaultHeartbeatLatencySLOMs, "latency SLO of handling the heartbeats (disabled if zero)")
+
+	fs.BoolVar(&cfg.EnableShardAutoAssign, "enable-shard-auto-assign", false, "assign the shards owned by no node to the alive nodes automatically")
+	fs.Int64Var(&cfg.ShardAutoAssignIntervalMs, "shard-auto-assign-interval-ms", defaultShardAutoAssignIntervalMs, "interval for checking the shards owned by no node")
+	fs.Int64Var(&cfg.ShardAutoAssignDelayMs, "shard-auto-assign-delay-ms", defaultShardAutoAssignDelayMs, "how long a shard is owned by no node before it is assigned automatically")
+	fs.IntVar(&cfg.ShardOpenBatchSize, "shard-open-batch-size", defaultShardOpenBatchSize, "max number of the shards opened by an open command (unlimited if 0)")
+	fs.IntVar(&cfg.ShardOpenMaxInFlight, "shard-open-max-in-flight", defaultShardOpenMaxInFlight, "max number of the shards of a node waiting for the acks of their open commands (unlimited if 0)")
+	fs.Int64Var(&cfg.ShardOpenAckTimeoutMs, "shard-open-ack-timeout-ms", defaultShardOpenAckTimeoutMs, "how long an open command is waited for its ack before the next batch is sent")
+
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", "", "url to post the transitions of the cluster conditions to (disabled if empty)")
+	fs.StringVar(&cfg.WebhookAuthHeader, "webhook-auth-header", "", "value of the Authorization header of the webhook requests")
+	fs.Int64Var(&cfg.ConditionCheckIntervalMs, "condition-check-interval-ms", defaultConditionCheckIntervalMs, "interval for checking the conditions of the clusters")
+
+	fs.StringVar(&cfg.AdminToken, "admin-token", "", "token required by the http apis (disabled if empty)")
+
+	fs.BoolVar(&cfg.EnableLogHook, "enable-log-hook", false, "log the events the hooks are invoked on")
+	fs.StringVar(&cfg.HookWebhookURL, "hook-webhook-url", "", "url to post the events the hooks are invoked on to (disabled if empty)")
+	fs.StringVar(&cfg.HookExecCommand, "hook-exec-command", "", "command run with the json-encoded event on its stdin (disabled if empty)")
+	fs.Int64Var(&cfg.HookTimeoutMs, "hook-timeout-ms", defaultHookTimeoutMs, "timeout of every invocation of the hooks")
+
+	fs.StringVar(&cfg.AuditSink, "audit-sink", "", "kind of the sink of the audit records: file, syslog or http (disabled if empty)")
+	fs.StringVar(&cfg.AuditSinkAddress, "audit-sink-address", "", "path of the file, or url of the syslog or the http sink of the audit records")
+
+	fs.Int64Var(&cfg.TableSetVerifyIntervalMs, "table-set-verify-interval-ms", defaultTableSetVerifyIntervalMs, "interval for verifying the placement of the tables on the shards")
+
+	fs.Int64Var(&cfg.TableRouteStatsPersistIntervalMs, "table-route-stats-persist-interval-ms", defaultTableRouteStatsPersistIntervalMs, "interval for persisting the route statistics of the tables")
+
+	fs.BoolVar(&cfg.AllowLoopbackNodeEndpoint, "allow-loopback-node-endpoint", false, "accept the loopback endpoints advertised by the nodes (only for development)")
+	fs.BoolVar(&cfg.EnableNodeEndpointProbe, "enable-node-endpoint-probe", false, "connect the endpoint advertised by a node before accepting it")
+	fs.Int64Var(&cfg.NodeEndpointProbeTimeoutMs, "node-endpoint-probe-timeout-ms", defaultNodeEndpointProbeTimeoutMs, "timeout for connecting the endpoint advertised by a node")
+
+	fs.StringVar(&cfg.CommandAckMinNodeVersion, "command-ack-min-node-version", "", "min binary version of the nodes whose shard commands are tracked until acked (disabled if empty)")
+	fs.StringVar(&cfg.NodeConflictPolicy, "node-conflict-policy", defaultNodeConflictPolicy, "policy for a node started twice with the same identity: reject, fence or ignore")
+
+	fs.Int64Var(&cfg.SnapshotIntervalMs, "snapshot-interval-ms", 0, "interval for taking the snapshots of the clusters by the leader (disabled if zero)")
+	fs.StringVar(&cfg.SnapshotDir, "snapshot-dir", defaultSnapshotDir, "local directory to write the scheduled snapshots into")
+	fs.IntVar(&cfg.SnapshotRetentionCount, "snapshot-retention-count", defaultSnapshotRetentionCount, "max number of the scheduled snapshots kept for a cluster (unlimited if zero)")
+	fs.Int64Var(&cfg.SnapshotRetentionMs, "snapshot-retention-ms", 0, "how long the scheduled snapshots are kept (unlimited if zero)")
+
+	fs.StringVar(&cfg.ReplicaEtcdEndpoints, "replica-etcd-endpoints", "", "comma-separated endpoints of the standby etcd cluster the metadata is mirrored to (disabled if empty)")
+	fs.StringVar(&cfg.ReplicaStorageRootPath, "replica-storage-root-path", defaultStorageRootPath, "root path of the mirrored metadata in the standby etcd cluster")
+
+	fs.BoolVar(&cfg.EnableObserverAutoPromotion, "enable-observer-auto-promotion", false, "replace the unhealthy voting etcd members with the observers automatically")
+	fs.Int64Var(&cfg.ObserverCheckIntervalMs, "observer-check-interval-ms", defaultObserverCheckIntervalMs, "interval for checking the health of the etcd members")
+	fs.Int64Var(&cfg.ObserverPromotionDelayMs, "observer-promotion-delay-ms", defaultObserverPromotionDelayMs, "how long a voting etcd member is unhealthy before it is replaced by an observer")
+	fs.Uint64Var(&cfg.ObserverMaxLagIndex, "observer-max-lag-index", defaultObserverMaxLagIndex, "max raft entries an observer may lag behind the voters to be promoted")
+	fs.BoolVar(&cfg.EnableAdaptiveLeaseTTL, "enable-adaptive-lease-ttl", false, "tune the ttl of the leadership lease by the observed keepalive delays and gc pauses")
+	fs.Int64Var(&cfg.AdaptiveLeaseMaxTTLSec, "adaptive-lease-max-ttl-sec", defaultAdaptiveLeaseMaxTTLSec, "max ttl the leadership lease may be raised to")
+	fs.Int64Var(&cfg.AdaptiveLeaseStableMs, "adaptive-lease-stable-ms", defaultAdaptiveLeaseStableMs, "how long without a near miss before the ttl of the leadership lease is lowered by a second")
+
 	return builder, nil
 }
@@ -5,7 +5,14 @@ package server
 import "github.com/CeresDB/ceresmeta/pkg/coderr"
 
 var (
-	ErrCreateEtcdClient = coderr.NewCodeError(coderr.Internal, "create etcd etcdCli")
-	ErrStartEtcd        = coderr.NewCodeError(coderr.Internal, "start embed etcd")
-	ErrStartEtcdTimeout = coderr.NewCodeError(coderr.Internal, "start etcd server timeout")
+	ErrCreateEtcdClient  = coderr.NewCodeError(coderr.Internal, "create etcd etcdCli")
+	ErrStartEtcd         = coderr.NewCodeError(coderr.Internal, "start embed etcd")
+	ErrStartEtcdTimeout  = coderr.NewCodeError(coderr.Internal, "start etcd server timeout")
+	ErrLoadClusters      = coderr.NewCodeError(coderr.Internal, "load clusters")
+	ErrCreateCluster     = coderr.NewCodeError(coderr.Internal, "create default cluster")
+	ErrInvalidConfig     = coderr.NewCodeError(coderr.InvalidParams, "invalid config")
+	ErrProcedureNotFound = coderr.NewCodeError(coderr.NotFound, "procedure not found")
+	ErrInvalidDebugScope = coderr.NewCodeError(coderr.InvalidParams, "invalid debug scope")
+	ErrDebugScopeMissing = coderr.NewCodeError(coderr.NotFound, "debug scope not found")
+	ErrNotLeader         = coderr.NewCodeError(coderr.ServiceUnavailable, "not leader or clusters not reloaded yet")
 )
@@ -0,0 +1,25 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+var authExpiredErrors = []error{rpctypes.ErrInvalidAuthToken, rpctypes.ErrAuthOldRevision, rpctypes.ErrUserEmpty}
+
+// IsAuthExpired tells whether the err is caused by the expired or dropped auth token of the client.
+// The error message is checked because the cause may be flattened into a string by the CodeError.
+func IsAuthExpired(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, authErr := range authExpiredErrors {
+		if rpctypes.Error(err) == authErr || strings.Contains(err.Error(), authErr.Error()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// RevisionPins records the oldest revisions still needed by the active watchers of this server, and the revisions from
+// the oldest pinned one are never compacted by the Compactor of this server. The pins are only seen by the Compactor of
+// another server, i.e. the leader, if they are published by the Publish.
+type RevisionPins struct {
+	mu   sync.Mutex
+	pins map[string]int64
+
+	// Following fields are set by the Publish, and the client is nil if the pins are not published.
+	client  *clientv3.Client
+	key     string
+	ttlSec  int64
+	timeout time.Duration
+	leaseID clientv3.LeaseID
+	// published is the revision published to the key, and zero if nothing is published.
+	published int64
+}
+
+func NewRevisionPins() *RevisionPins {
+	return &RevisionPins{pins: make(map[string]int64)}
+}
+
+// Pin records that the watcher identified by the name needs the revisions from the revision. A pin older than the
+// published revision is published before the Pin returns. All the methods are safe to call on a nil RevisionPins.
+func (p *RevisionPins) Pin(name string, revision int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pins[name] = revision
+	if p.client != nil && (p.published == 0 || revision < p.published) {
+		p.publishLocked()
+	}
+}
+
+// Unpin removes the pin of the watcher.
+func (p *RevisionPins) Unpin(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pins, name)
+}
+
+// Min returns the oldest pinned revision, and false is returned if nothing is pinned.
+func (p *RevisionPins) Min() (int64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.minLocked()
+}
+
+func (p *RevisionPins) minLocked() (int64, bool) {
+	var min int64
+	for _, revision := range p.pins {
+		if min == 0 || revision < min {
+			min = revision
+		}
+	}
+	return min, min > 0
+}
+
+// Publish publishes the oldest pinned revision to the key bound to a lease of the ttl until the ctx is done, so that
+// the Compactor reading the prefix of the key never compacts the revisions pinned by this server even if it runs on
+// another server. The pins advanced are published periodically, because the published revision older than the pins
+// only retains more revisions, and the key is removed along with the lease when the ctx is done or the server dies.
+func (p *RevisionPins) Publish(ctx context.Context, client *clientv3.Client, key string, ttlSec int64, timeout time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.client, p.key, p.ttlSec, p.timeout = client, key, ttlSec, timeout
+	p.publishLocked()
+	p.mu.Unlock()
+
+	interval := time.Duration(ttlSec) * time.Second / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.publishLocked()
+			p.mu.Unlock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.leaseID != 0 {
+				revokeCtx, cancel := context.WithTimeout(context.Background(), p.timeout)
+				if _, err := client.Revoke(revokeCtx, p.leaseID); err != nil {
+					log.Warn("fail to revoke lease of revision pins", zap.String("key", key), zap.Error(err))
+				}
+				cancel()
+			}
+			p.client, p.leaseID, p.published = nil, 0, 0
+			return
+		}
+	}
+}
+
+// publishLocked keeps the lease alive and writes the oldest pinned revision to the key, and the key is deleted if
+// nothing is pinned. The failure is only logged and the publication is retried by the next round.
+func (p *RevisionPins) publishLocked() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if p.leaseID != 0 {
+		if _, err := p.client.KeepAliveOnce(ctx, p.leaseID); err != nil {
+			log.Warn("lease of revision pins is lost", zap.String("key", p.key), zap.Error(err))
+			p.leaseID, p.published = 0, 0
+		}
+	}
+	if p.leaseID == 0 {
+		resp, err := p.client.Grant(ctx, p.ttlSec)
+		if err != nil {
+			log.Warn("fail to grant lease of revision pins", zap.String("key", p.key), zap.Error(err))
+			return
+		}
+		p.leaseID = resp.ID
+	}
+
+	min, ok := p.minLocked()
+	if !ok {
+		if _, err := p.client.Delete(ctx, p.key); err != nil {
+			log.Warn("fail to delete revision pins", zap.String("key", p.key), zap.Error(err))
+			return
+		}
+		p.published = 0
+		return
+	}
+	if _, err := p.client.Put(ctx, p.key, strconv.FormatInt(min, 10), clientv3.WithLease(p.leaseID)); err != nil {
+		log.Warn("fail to publish revision pins", zap.String("key", p.key), zap.Int64("revision", min), zap.Error(err))
+		return
+	}
+	p.published = min
+}
+
+// MaintenanceWindow is a daily time range in UTC, and it wraps around the midnight if the end is before the start.
+type MaintenanceWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseMaintenanceWindow parses the window in the form of HH:MM-HH:MM, and nil is returned for the empty string.
+func ParseMaintenanceWindow(window string) (*MaintenanceWindow, error) {
+	if window == "" {
+		return nil, nil
+	}
+	var startHour, startMinute, endHour, endMinute int
+	if _, err := fmt.Sscanf(window, "%d:%d-%d:%d", &startHour, &startMinute, &endHour, &endMinute); err != nil {
+		return nil, ErrInvalidCompaction.WithCausef("maintenance window:%s, err:%v", window, err)
+	}
+	for _, v := range []int{startHour, endHour} {
+		if v < 0 || v > 23 {
+			return nil, ErrInvalidCompaction.WithCausef("maintenance window:%s, invalid hour:%d", window, v)
+		}
+	}
+	for _, v := range []int{startMinute, endMinute} {
+		if v < 0 || v > 59 {
+			return nil, ErrInvalidCompaction.WithCausef("maintenance window:%s, invalid minute:%d", window, v)
+		}
+	}
+	return &MaintenanceWindow{
+		Start: time.Duration(startHour)*time.Hour + time.Duration(startMinute)*time.Minute,
+		End:   time.Duration(endHour)*time.Hour + time.Duration(endMinute)*time.Minute,
+	}, nil
+}
+
+// Contains tells whether the time is in the window.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// CompactionPolicy decides which revisions are compacted, and the revisions are retained if they are newer than the
+// Retention or within the latest RetentionRevisions. Both limits apply if both are set.
+type CompactionPolicy struct {
+	Retention          time.Duration
+	RetentionRevisions int64
+	// DefragWindow is the window to defragment the etcd after the compaction, and nil disables the defragmentation.
+	DefragWindow *MaintenanceWindow
+}
+
+func (p CompactionPolicy) Enabled() bool {
+	return p.Retention > 0 || p.RetentionRevisions > 0
+}
+
+type revisionSample struct {
+	time     time.Time
+	revision int64
+}
+
+// Compactor compacts the etcd revisions according to the policy, and it never compacts the revisions pinned by the
+// active watchers of this server, or the ones published by the RevisionPins of all the servers under the pinPrefix.
+type Compactor struct {
+	client    *clientv3.Client
+	policy    CompactionPolicy
+	pins      *RevisionPins
+	pinPrefix string
+
+	// Following fields are only accessed by the Compact, which should not be called concurrently.
+	// samples are the revisions observed by the previous runs ordered by the time, which map the time-based retention
+	// to the revisions.
+	samples          []revisionSample
+	lastCompacted    int64
+	lastDefragmented time.Time
+}
+
+func NewCompactor(client *clientv3.Client, policy CompactionPolicy, pins *RevisionPins, pinPrefix string) *Compactor {
+	return &Compactor{client: client, policy: policy, pins: pins, pinPrefix: pinPrefix}
+}
+
+// CompactionResult describes a run of the compaction, and Revision is zero if nothing is compacted.
+type CompactionResult struct {
+	CurrentRevision int64
+	Revision        int64
+	Defragmented    bool
+}
+
+// Compact compacts the revisions out of the retention, and defragments the members of the etcd if it is in the
+// maintenance window and they haven't been defragmented in the current window.
+func (c *Compactor) Compact(ctx context.Context) (CompactionResult, error) {
+	resp, err := c.client.Get(ctx, "compaction_probe", clientv3.WithCountOnly())
+	if err != nil {
+		etcdCompactionsCounter.WithLabelValues("failed").Inc()
+		return CompactionResult{}, ErrEtcdCompact.WithCause(err)
+	}
+	now := time.Now()
+	result := CompactionResult{CurrentRevision: resp.Header.Revision}
+	c.samples = append(c.samples, revisionSample{time: now, revision: result.CurrentRevision})
+
+	published, err := c.publishedPin(ctx)
+	if err != nil {
+		etcdCompactionsCounter.WithLabelValues("failed").Inc()
+		return result, err
+	}
+	target := c.targetRevision(now, result.CurrentRevision)
+	if published > 0 && published < target {
+		target = published
+	}
+	if target > c.lastCompacted {
+		if _, err := c.client.Compact(ctx, target); err != nil {
+			etcdCompactionsCounter.WithLabelValues("failed").Inc()
+			return result, ErrEtcdCompact.WithCausef("revision:%d, err:%v", target, err)
+		}
+		c.lastCompacted = target
+		result.Revision = target
+		etcdCompactionsCounter.WithLabelValues("compacted").Inc()
+		etcdLastCompactedRevisionGauge.Set(float64(target))
+		etcdLastCompactionTimeGauge.Set(float64(now.Unix()))
+		log.Info("compact etcd revisions", zap.Int64("revision", target), zap.Int64("current-revision", result.CurrentRevision))
+	}
+
+	if window := c.policy.DefragWindow; window != nil && window.Contains(now) && !c.defragmentedInWindow(now) {
+		for _, endpoint := range c.client.Endpoints() {
+			if _, err := c.client.Defragment(ctx, endpoint); err != nil {
+				return result, ErrEtcdDefragment.WithCausef("endpoint:%s, err:%v", endpoint, err)
+			}
+		}
+		c.lastDefragmented = now
+		result.Defragmented = true
+		etcdDefragmentsCounter.Inc()
+		log.Info("defragment etcd", zap.Strings("endpoints", c.client.Endpoints()))
+	}
+	return result, nil
+}
+
+// targetRevision returns the revision to compact to, which is bounded by the retention and the oldest pinned revision.
+func (c *Compactor) targetRevision(now time.Time, current int64) int64 {
+	target := current
+	if c.policy.RetentionRevisions > 0 {
+		target = current - c.policy.RetentionRevisions
+	}
+	if c.policy.Retention > 0 {
+		// The newest sample older than the retention is the newest revision out of the retention known for sure, and
+		// the older samples are useless since then.
+		deadline := now.Add(-c.policy.Retention)
+		i := 0
+		for i < len(c.samples) && !c.samples[i].time.After(deadline) {
+			i++
+		}
+		byTime := int64(0)
+		if i > 0 {
+			byTime = c.samples[i-1].revision
+			c.samples = c.samples[i-1:]
+		}
+		if byTime < target {
+			target = byTime
+		}
+	}
+	if pinned, ok := c.pins.Min(); ok && pinned < target {
+		target = pinned
+	}
+	return target
+}
+
+// publishedPin returns the oldest revision published under the pinPrefix, and zero if nothing is published. The
+// compaction fails if any published revision is invalid, rather than compacting the revisions it may pin.
+func (c *Compactor) publishedPin(ctx context.Context) (int64, error) {
+	if c.pinPrefix == "" {
+		return 0, nil
+	}
+	resp, err := c.client.Get(ctx, c.pinPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, ErrEtcdCompact.WithCausef("get revision pins, err:%v", err)
+	}
+	var min int64
+	for _, kv := range resp.Kvs {
+		revision, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return 0, ErrEtcdCompact.WithCausef("invalid revision pin, key:%s, err:%v", kv.Key, err)
+		}
+		if min == 0 || revision < min {
+			min = revision
+		}
+	}
+	return min, nil
+}
+
+func (c *Compactor) defragmentedInWindow(now time.Time) bool {
+	window := c.policy.DefragWindow
+	windowLen := window.End - window.Start
+	if windowLen <= 0 {
+		windowLen += 24 * time.Hour
+	}
+	return !c.lastDefragmented.IsZero() && now.Sub(c.lastDefragmented) < windowLen
+}
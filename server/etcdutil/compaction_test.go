@@ -0,0 +1,164 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	re := require.New(t)
+
+	window, err := ParseMaintenanceWindow("")
+	re.NoError(err)
+	re.Nil(window)
+	_, err = ParseMaintenanceWindow("25:00-01:00")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+	_, err = ParseMaintenanceWindow("0100-0200")
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	day := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	window, err = ParseMaintenanceWindow("02:30-04:00")
+	re.NoError(err)
+	re.False(window.Contains(day.Add(time.Hour * 2)))
+	re.True(window.Contains(day.Add(time.Hour*2 + time.Minute*30)))
+	re.False(window.Contains(day.Add(time.Hour * 4)))
+
+	// The window wraps around the midnight.
+	window, err = ParseMaintenanceWindow("23:00-01:00")
+	re.NoError(err)
+	re.True(window.Contains(day.Add(time.Hour * 23)))
+	re.True(window.Contains(day.Add(time.Minute * 30)))
+	re.False(window.Contains(day.Add(time.Hour * 12)))
+}
+
+func TestCompactor(t *testing.T) {
+	re := require.New(t)
+	cfg := NewTestSingleConfig()
+	defer CleanConfig(cfg)
+
+	etcd, client := startTestEtcd(t, cfg)
+	defer etcd.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	put := func(n int) int64 {
+		var revision int64
+		for i := 0; i < n; i++ {
+			resp, err := client.Put(ctx, fmt.Sprintf("/key/%d", i), "value")
+			re.NoError(err)
+			revision = resp.Header.Revision
+		}
+		return revision
+	}
+
+	// The watcher pins the revision it needs, which bounds the compaction.
+	pinned := put(10)
+	pins := NewRevisionPins()
+	pins.Pin("watcher", pinned)
+	current := put(10)
+	compactor := NewCompactor(client, CompactionPolicy{RetentionRevisions: 5}, pins, "")
+	result, err := compactor.Compact(ctx)
+	re.NoError(err)
+	re.Equal(pinned, result.Revision)
+	re.False(result.Defragmented)
+
+	wch := client.Watch(ctx, "/key/", clientv3.WithPrefix(), clientv3.WithRev(pinned))
+	resp := <-wch
+	re.Zero(resp.CompactRevision)
+	re.NoError(resp.Err())
+	re.NotEmpty(resp.Events)
+
+	pins.Unpin("watcher")
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.Equal(current-5, result.Revision)
+	re.Equal(current, result.CurrentRevision)
+
+	// Nothing is compacted by the time until a run falls out of the retention.
+	compactor = NewCompactor(client, CompactionPolicy{Retention: time.Millisecond * 100}, nil, "")
+	first, err := compactor.Compact(ctx)
+	re.NoError(err)
+	re.Zero(first.Revision)
+	put(5)
+	time.Sleep(time.Millisecond * 150)
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.Equal(first.CurrentRevision, result.Revision)
+
+	// The defragmentation runs once in the window.
+	window := &MaintenanceWindow{Start: 0, End: 24*time.Hour - time.Second}
+	compactor = NewCompactor(client, CompactionPolicy{RetentionRevisions: 1, DefragWindow: window}, nil, "")
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.True(result.Defragmented)
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.False(result.Defragmented)
+}
+
+func TestPublishedRevisionPins(t *testing.T) {
+	re := require.New(t)
+	cfg := NewTestSingleConfig()
+	defer CleanConfig(cfg)
+
+	etcd, client := startTestEtcd(t, cfg)
+	defer etcd.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	put := func(n int) int64 {
+		var revision int64
+		for i := 0; i < n; i++ {
+			resp, err := client.Put(ctx, fmt.Sprintf("/key/%d", i), "value")
+			re.NoError(err)
+			revision = resp.Header.Revision
+		}
+		return revision
+	}
+
+	// The follower publishes its pin, which bounds the compaction of the leader.
+	const prefix = "/revision_pins/"
+	followerPins := NewRevisionPins()
+	publishCtx, stopPublish := context.WithCancel(ctx)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		followerPins.Publish(publishCtx, client, prefix+"follower", 60, time.Second)
+	}()
+	pinned := put(10)
+	followerPins.Pin("watcher", pinned)
+	put(10)
+	compactor := NewCompactor(client, CompactionPolicy{RetentionRevisions: 5}, NewRevisionPins(), prefix)
+	result, err := compactor.Compact(ctx)
+	re.NoError(err)
+	re.Equal(pinned, result.Revision)
+
+	// The pin advanced is published by the next round, and the key is removed once the publication stops.
+	followerPins.Pin("watcher", pinned+5)
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.Zero(result.Revision)
+	stopPublish()
+	<-published
+	resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	re.NoError(err)
+	re.Zero(resp.Count)
+	current := put(1)
+	result, err = compactor.Compact(ctx)
+	re.NoError(err)
+	re.Equal(current-5, result.Revision)
+
+	// The invalid pin fails the compaction.
+	_, err = client.Put(ctx, prefix+"broken", "revision")
+	re.NoError(err)
+	_, err = compactor.Compact(ctx)
+	re.True(coderr.Is(err, coderr.Internal))
+}
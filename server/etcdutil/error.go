@@ -9,4 +9,14 @@ var (
 	ErrEtcdKVGetResponse = coderr.NewCodeError(coderr.Internal, "etcd invalid get value response must only one")
 	ErrEtcdKVPut         = coderr.NewCodeError(coderr.Internal, "etcd KV put failed")
 	ErrEtcdKVDelete      = coderr.NewCodeError(coderr.Internal, "etcd KV delete failed")
+	ErrEtcdSpaceExceeded = coderr.NewCodeError(coderr.InsufficientStorage, "etcd space exceeded")
+	ErrEtcdAlarmList     = coderr.NewCodeError(coderr.Internal, "etcd list alarms failed")
+	ErrEtcdProbeWrite    = coderr.NewCodeError(coderr.Internal, "etcd probe write failed")
+	ErrEtcdTxnConflict   = coderr.NewCodeError(coderr.Conflict, "etcd txn keeps conflicting")
+	ErrEtcdRateLimited   = coderr.NewCodeError(coderr.ServiceUnavailable, "etcd rate limited")
+	ErrEtcdCompact       = coderr.NewCodeError(coderr.Internal, "etcd compact failed")
+	ErrEtcdDefragment    = coderr.NewCodeError(coderr.Internal, "etcd defragment failed")
+	ErrInvalidCompaction = coderr.NewCodeError(coderr.InvalidParams, "invalid etcd compaction policy")
+	ErrTooStale          = coderr.NewCodeError(coderr.ServiceUnavailable, "follower too stale to serve reads")
+	ErrEtcdStartupWait   = coderr.NewCodeError(coderr.ServiceUnavailable, "etcd not ready during startup")
 )
@@ -0,0 +1,53 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var etcdCompactionsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "etcd",
+		Name:      "compactions_total",
+		Help:      "Number of the etcd compactions issued by the ceresmeta.",
+	}, []string{"result"})
+
+var etcdLastCompactedRevisionGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "etcd",
+		Name:      "last_compacted_revision",
+		Help:      "Revision of the last etcd compaction.",
+	})
+
+var etcdLastCompactionTimeGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "etcd",
+		Name:      "last_compaction_timestamp_seconds",
+		Help:      "Unix time of the last etcd compaction.",
+	})
+
+var etcdDefragmentsCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "etcd",
+		Name:      "defragments_total",
+		Help:      "Number of the etcd defragmentations issued by the ceresmeta.",
+	})
+
+var followerReadLagGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "etcd",
+		Name:      "follower_read_lag_revisions",
+		Help:      "Revisions applied by the member lagging behind the leader.",
+	}, []string{"member"})
+
+func init() {
+	prometheus.MustRegister(etcdCompactionsCounter)
+	prometheus.MustRegister(etcdLastCompactedRevisionGauge)
+	prometheus.MustRegister(etcdLastCompactionTimeGauge)
+	prometheus.MustRegister(etcdDefragmentsCounter)
+	prometheus.MustRegister(followerReadLagGauge)
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// RetryOnConflictOptions bounds the retries of a compare-and-swap txn.
+type RetryOnConflictOptions struct {
+	MaxAttempts int
+	// The backoff starts from InitialBackoff and doubles after every conflict until MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryOnConflictOptions = RetryOnConflictOptions{
+	MaxAttempts:    5,
+	InitialBackoff: time.Millisecond * 10,
+	MaxBackoff:     time.Millisecond * 200,
+}
+
+// CASFunc should read the current values and commit a compare-and-swap txn based on them, so that it can be retried
+// as a whole when the txn fails to compare.
+type CASFunc func() (*clientv3.TxnResponse, error)
+
+// DoWithRetryOnConflict runs the fn until its txn succeeds, and the fn is retried with backoff if its txn is not
+// succeeded because of the conflict. The error returned by the fn is returned at once without retrying, and
+// ErrEtcdTxnConflict is returned if the txn keeps conflicting after all the attempts.
+func DoWithRetryOnConflict(ctx context.Context, opts RetryOnConflictOptions, fn CASFunc) error {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := fn()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		if attempt >= opts.MaxAttempts {
+			return ErrEtcdTxnConflict.WithCausef("attempts:%d, last resp:%v", attempt, resp)
+		}
+
+		log.Debug("txn conflicts and retry it", zap.Int("attempt", attempt), zap.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ErrEtcdTxnConflict.WithCausef("attempts:%d, err:%v", attempt, ctx.Err())
+		}
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
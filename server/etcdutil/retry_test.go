@@ -0,0 +1,59 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestDoWithRetryOnConflict(t *testing.T) {
+	re := require.New(t)
+	ctx := context.Background()
+	opts := RetryOnConflictOptions{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 2}
+
+	// Succeed after conflicting twice.
+	attempts := 0
+	err := DoWithRetryOnConflict(ctx, opts, func() (*clientv3.TxnResponse, error) {
+		attempts++
+		return &clientv3.TxnResponse{Succeeded: attempts == 3}, nil
+	})
+	re.NoError(err)
+	re.Equal(3, attempts)
+
+	// Keep conflicting.
+	attempts = 0
+	err = DoWithRetryOnConflict(ctx, opts, func() (*clientv3.TxnResponse, error) {
+		attempts++
+		return &clientv3.TxnResponse{}, nil
+	})
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Equal(3, attempts)
+
+	// The error of the fn is not retried.
+	attempts = 0
+	fnErr := errors.New("get failed")
+	err = DoWithRetryOnConflict(ctx, opts, func() (*clientv3.TxnResponse, error) {
+		attempts++
+		return nil, fnErr
+	})
+	re.Equal(fnErr, err)
+	re.Equal(1, attempts)
+
+	// Stop retrying once the ctx is done.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	attempts = 0
+	err = DoWithRetryOnConflict(ctx, RetryOnConflictOptions{MaxAttempts: 3, InitialBackoff: time.Hour}, func() (*clientv3.TxnResponse, error) {
+		attempts++
+		return &clientv3.TxnResponse{}, nil
+	})
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.Equal(1, attempts)
+}
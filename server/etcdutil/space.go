@@ -0,0 +1,142 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const spaceExceededGuidance = "etcd space quota is exceeded and ceresmeta is read-only now, " +
+	"compact and defragment the etcd (etcdctl compact/defrag), then disarm the alarm (etcdctl alarm disarm) " +
+	"or raise the quota-backend-bytes"
+
+// IsSpaceExceeded tells whether the err is caused by the etcd space quota being exceeded.
+// The error message is checked because the cause may be flattened into a string by the CodeError.
+func IsSpaceExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), rpctypes.ErrNoSpace.Error())
+}
+
+// SpaceStatus describes the space usage of the etcd.
+type SpaceStatus struct {
+	Exceeded bool  `json:"etcd_space_exceeded"`
+	DBSize   int64 `json:"db_size"`
+	Quota    int64 `json:"quota"`
+}
+
+// SpaceMonitor detects whether the etcd space quota is exceeded by the alarms of the etcd and the errors observed by
+// the callers, and the exceeded flag is cleared only after a probe write succeeds.
+type SpaceMonitor struct {
+	client   *clientv3.Client
+	quota    int64
+	probeKey string
+
+	// mu protects the status.
+	mu     sync.RWMutex
+	status SpaceStatus
+}
+
+func NewSpaceMonitor(client *clientv3.Client, quota int64, probeKey string) *SpaceMonitor {
+	return &SpaceMonitor{
+		client:   client,
+		quota:    quota,
+		probeKey: probeKey,
+		status:   SpaceStatus{Quota: quota},
+	}
+}
+
+// Status returns the latest space status.
+func (m *SpaceMonitor) Status() SpaceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.status
+}
+
+// IsExceeded is goroutine safe.
+func (m *SpaceMonitor) IsExceeded() bool {
+	return m.Status().Exceeded
+}
+
+// ObserveError marks the space exceeded if the err is caused by the space quota.
+func (m *SpaceMonitor) ObserveError(err error) {
+	if IsSpaceExceeded(err) {
+		m.setExceeded(true)
+	}
+}
+
+// Check checks the alarms and the db size of the etcd and updates the status.
+// If the space has been marked exceeded and no space alarm is found, a probe write is issued and the exceeded flag is
+// cleared if it succeeds.
+func (m *SpaceMonitor) Check(ctx context.Context) (SpaceStatus, error) {
+	alarmResp, err := m.client.AlarmList(ctx)
+	if err != nil {
+		return m.Status(), ErrEtcdAlarmList.WithCause(err)
+	}
+	alarmed := false
+	for _, alarm := range alarmResp.Alarms {
+		if alarm.Alarm == etcdserverpb.AlarmType_NOSPACE {
+			alarmed = true
+			break
+		}
+	}
+
+	var dbSize int64
+	for _, endpoint := range m.client.Endpoints() {
+		statusResp, err := m.client.Status(ctx, endpoint)
+		if err != nil {
+			log.Warn("fail to get etcd status", zap.String("endpoint", endpoint), zap.Error(err))
+			continue
+		}
+		if statusResp.DbSize > dbSize {
+			dbSize = statusResp.DbSize
+		}
+	}
+	m.setDBSize(dbSize)
+
+	switch {
+	case alarmed:
+		m.setExceeded(true)
+	case m.IsExceeded():
+		if _, err := m.client.Put(ctx, m.probeKey, ""); err != nil {
+			m.ObserveError(err)
+			return m.Status(), ErrEtcdProbeWrite.WithCause(err)
+		}
+		m.setExceeded(false)
+	}
+
+	return m.Status(), nil
+}
+
+func (m *SpaceMonitor) setDBSize(dbSize int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.DBSize = dbSize
+}
+
+func (m *SpaceMonitor) setExceeded(exceeded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.status.Exceeded == exceeded {
+		return
+	}
+	m.status.Exceeded = exceeded
+	if exceeded {
+		log.Error(spaceExceededGuidance, zap.Int64("db-size", m.status.DBSize), zap.Int64("quota", m.status.Quota))
+	} else {
+		log.Info("etcd space is available again and ceresmeta is writable", zap.Int64("db-size", m.status.DBSize),
+			zap.Int64("quota", m.status.Quota))
+	}
+}
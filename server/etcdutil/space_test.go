@@ -0,0 +1,82 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const defaultTestTimeout = time.Second * 10
+
+func startTestEtcd(t *testing.T, cfg *embed.Config) (*embed.Etcd, *clientv3.Client) {
+	re := require.New(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	return etcd, client
+}
+
+func TestSpaceExceeded(t *testing.T) {
+	re := require.New(t)
+	cfg := NewTestSingleConfig()
+	defer CleanConfig(cfg)
+	cfg.QuotaBackendBytes = 64 * 1024
+
+	etcd, client := startTestEtcd(t, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	monitor := NewSpaceMonitor(client, cfg.QuotaBackendBytes, "/probe")
+	status, err := monitor.Check(ctx)
+	re.NoError(err)
+	re.False(status.Exceeded)
+
+	// Fill the etcd until the quota is exceeded.
+	value := strings.Repeat("x", 8*1024)
+	var putErr error
+	for i := 0; i < 1024 && putErr == nil; i++ {
+		_, putErr = client.Put(ctx, "/key", value)
+	}
+	re.Error(putErr)
+	re.True(IsSpaceExceeded(putErr))
+
+	status, err = monitor.Check(ctx)
+	re.NoError(err)
+	re.True(status.Exceeded)
+	re.True(status.DBSize > 0)
+	re.Equal(cfg.QuotaBackendBytes, status.Quota)
+
+	// The flag is kept even if the alarm is disarmed because the probe write still fails.
+	_, err = client.AlarmDisarm(ctx, &clientv3.AlarmMember{})
+	re.NoError(err)
+	_, err = monitor.Check(ctx)
+	re.Error(err)
+	re.True(monitor.IsExceeded())
+
+	// Restart the etcd with a larger quota and the flag should be cleared after disarming the alarm.
+	re.NoError(client.Close())
+	etcd.Close()
+	cfg.QuotaBackendBytes = 64 * 1024 * 1024
+	etcd, client = startTestEtcd(t, cfg)
+	defer etcd.Close()
+	defer client.Close()
+
+	monitor.client = client
+	_, err = client.AlarmDisarm(ctx, &clientv3.AlarmMember{})
+	re.NoError(err)
+	status, err = monitor.Check(ctx)
+	re.NoError(err)
+	re.False(status.Exceeded)
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const stalenessWatchRetryInterval = time.Second
+
+// StalenessStatus describes how far the revision applied by the server lags behind the leader.
+type StalenessStatus struct {
+	Leader          bool  `json:"leader"`
+	AppliedRevision int64 `json:"applied_revision"`
+	LeaderRevision  int64 `json:"leader_revision"`
+	Lag             int64 `json:"lag"`
+}
+
+// StalenessTracker tracks the revision applied by a follower through the position of its watch on the prefix, and
+// compares it with the revision of the leader to bound the staleness of the reads served by the follower.
+type StalenessTracker struct {
+	client *clientv3.Client
+	prefix string
+	// maxLag is the max revisions the follower may lag behind the leader and still serve the reads, and the staleness
+	// is not bounded if it is not positive.
+	maxLag int64
+	name   string
+	pins   *RevisionPins
+
+	// mu protects the status.
+	mu     sync.RWMutex
+	status StalenessStatus
+}
+
+func NewStalenessTracker(client *clientv3.Client, prefix string, maxLag int64, name string, pins *RevisionPins) *StalenessTracker {
+	return &StalenessTracker{
+		client: client,
+		prefix: prefix,
+		maxLag: maxLag,
+		name:   name,
+		pins:   pins,
+	}
+}
+
+// Status returns the latest staleness status.
+func (t *StalenessTracker) Status() StalenessStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.status
+}
+
+// CheckRead returns ErrTooStale if the follower lags behind the leader by more than the max lag. The leader always
+// passes the check.
+func (t *StalenessTracker) CheckRead() error {
+	status := t.Status()
+	if t.maxLag <= 0 || status.Leader || status.Lag <= t.maxLag {
+		return nil
+	}
+	return ErrTooStale.WithCausef("applied revision:%d, leader revision:%d, max lag:%d", status.AppliedRevision,
+		status.LeaderRevision, t.maxLag)
+}
+
+// Watch advances the applied revision by the watch on the prefix until the ctx is done. The watch restarts from the
+// current revision if its revision is compacted.
+func (t *StalenessTracker) Watch(ctx context.Context) {
+	pinName := "read-staleness/" + t.name
+	defer t.pins.Unpin(pinName)
+
+	for ctx.Err() == nil {
+		opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithProgressNotify()}
+		if applied := t.Status().AppliedRevision; applied > 0 {
+			opts = append(opts, clientv3.WithRev(applied+1))
+		}
+		watchCtx, cancel := context.WithCancel(ctx)
+		for resp := range t.client.Watch(watchCtx, t.prefix, opts...) {
+			if resp.CompactRevision != 0 {
+				log.Warn("revision of the staleness watch is compacted, restart from the current revision",
+					zap.String("prefix", t.prefix), zap.Int64("compact-revision", resp.CompactRevision))
+				t.observe(resp.CompactRevision - 1)
+				break
+			}
+			if err := resp.Err(); err != nil {
+				log.Warn("staleness watch fails", zap.String("prefix", t.prefix), zap.Error(err))
+				break
+			}
+			t.observe(resp.Header.Revision)
+			t.pins.Pin(pinName, t.Status().AppliedRevision+1)
+		}
+		cancel()
+
+		select {
+		case <-time.After(stalenessWatchRetryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Check updates the lag with the current revision of the leader, and requests the progress of the watch so that the
+// applied revision is advanced even if nothing under the prefix changes. The lag may be overestimated by the
+// revisions written since the last progress, which only makes the bound stricter.
+func (t *StalenessTracker) Check(ctx context.Context, leader bool) (StalenessStatus, error) {
+	if leader {
+		t.update(func(status *StalenessStatus) {
+			status.Leader = true
+			status.LeaderRevision = status.AppliedRevision
+			status.Lag = 0
+		})
+		return t.Status(), nil
+	}
+
+	resp, err := t.client.Get(ctx, t.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return t.Status(), ErrEtcdKVGet.WithCause(err)
+	}
+	t.update(func(status *StalenessStatus) {
+		status.Leader = false
+		status.LeaderRevision = resp.Header.Revision
+		status.Lag = 0
+		if status.LeaderRevision > status.AppliedRevision {
+			status.Lag = status.LeaderRevision - status.AppliedRevision
+		}
+	})
+	if err := t.client.RequestProgress(ctx); err != nil {
+		log.Warn("fail to request the progress of the staleness watch", zap.Error(err))
+	}
+	return t.Status(), nil
+}
+
+func (t *StalenessTracker) observe(revision int64) {
+	t.update(func(status *StalenessStatus) {
+		if revision > status.AppliedRevision {
+			status.AppliedRevision = revision
+		}
+	})
+}
+
+func (t *StalenessTracker) update(f func(status *StalenessStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f(&t.status)
+	followerReadLagGauge.WithLabelValues(t.name).Set(float64(t.status.Lag))
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStalenessTracker(t *testing.T) {
+	re := require.New(t)
+	cfg := NewTestSingleConfig()
+	defer CleanConfig(cfg)
+
+	etcd, client := startTestEtcd(t, cfg)
+	defer etcd.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Put(ctx, fmt.Sprintf("/root/key/%d", i), "value")
+		re.NoError(err)
+	}
+
+	tracker := NewStalenessTracker(client, "/root", 2, "test", nil)
+	status, err := tracker.Check(ctx, false)
+	re.NoError(err)
+	re.True(status.Lag > 2)
+	re.True(coderr.Is(tracker.CheckRead(), coderr.ServiceUnavailable))
+
+	// The leader always serves the reads.
+	_, err = tracker.Check(ctx, true)
+	re.NoError(err)
+	re.NoError(tracker.CheckRead())
+
+	// The progress of the watch advances the applied revision even if nothing under the prefix changes.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+	go tracker.Watch(watchCtx)
+	_, err = client.Put(ctx, "/other", "value")
+	re.NoError(err)
+	re.Eventually(func() bool {
+		status, err := tracker.Check(ctx, false)
+		return err == nil && status.Lag <= 2
+	}, defaultTestTimeout, 50*time.Millisecond)
+	re.NoError(tracker.CheckRead())
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StartupFailure is why the etcd is not ready during the startup.
+type StartupFailure string
+
+const (
+	StartupUnreachable StartupFailure = "unreachable"
+	StartupAuthFailed  StartupFailure = "auth_failed"
+	StartupUnhealthy   StartupFailure = "unhealthy"
+	StartupTimeout     StartupFailure = "timeout"
+	StartupUnknown     StartupFailure = "unknown"
+)
+
+// StartupWaitOptions bounds the waiting for the etcd to be ready during the startup.
+type StartupWaitOptions struct {
+	// MaxWait is the max duration to wait, and the step is attempted only once if it is not positive.
+	MaxWait time.Duration
+	// AttemptTimeout bounds every attempt.
+	AttemptTimeout time.Duration
+	// The backoff starts from InitialBackoff and doubles after every failed attempt until MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultStartupWaitOptions = StartupWaitOptions{
+	MaxWait:        time.Minute,
+	AttemptTimeout: time.Second * 5,
+	InitialBackoff: time.Millisecond * 200,
+	MaxBackoff:     time.Second * 5,
+}
+
+// ClassifyStartupFailure tells why the etcd is not ready by the err of an attempt.
+func ClassifyStartupFailure(err error) StartupFailure {
+	cause := errors.Cause(err)
+	switch {
+	case errors.Is(cause, rpctypes.ErrAuthFailed), errors.Is(cause, rpctypes.ErrInvalidAuthToken),
+		errors.Is(cause, rpctypes.ErrPermissionDenied), errors.Is(cause, rpctypes.ErrUserEmpty),
+		errors.Is(cause, rpctypes.ErrAuthOldRevision):
+		return StartupAuthFailed
+	case errors.Is(cause, rpctypes.ErrNoLeader), errors.Is(cause, rpctypes.ErrTimeout),
+		errors.Is(cause, rpctypes.ErrTimeoutDueToLeaderFail), errors.Is(cause, rpctypes.ErrTimeoutDueToConnectionLost),
+		errors.Is(cause, rpctypes.ErrNotCapable), errors.Is(cause, rpctypes.ErrStopped):
+		return StartupUnhealthy
+	}
+
+	// The errors of the dialing are only distinguished by their messages.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection refused"), strings.Contains(msg, "no such host"),
+		strings.Contains(msg, "connection reset"):
+		return StartupUnreachable
+	case strings.Contains(msg, "authentication"), strings.Contains(msg, "permission denied"):
+		return StartupAuthFailed
+	case errors.Is(cause, context.DeadlineExceeded), strings.Contains(msg, context.DeadlineExceeded.Error()):
+		return StartupTimeout
+	}
+	switch status.Code(cause) {
+	case codes.Unavailable:
+		return StartupUnreachable
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return StartupAuthFailed
+	case codes.DeadlineExceeded:
+		return StartupTimeout
+	}
+	return StartupUnknown
+}
+
+// WaitStartup attempts the step named by what with backoff until it succeeds or the max wait is reached, and every
+// failed attempt is logged with why the etcd is not ready. ErrEtcdStartupWait summarizing the attempts is returned if
+// the step never succeeds.
+func WaitStartup(ctx context.Context, opts StartupWaitOptions, what string, step func(ctx context.Context) error) error {
+	start := time.Now()
+	deadline := start.Add(opts.MaxWait)
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.AttemptTimeout)
+		}
+		err := step(attemptCtx)
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				log.Info("etcd is ready", zap.String("step", what), zap.Int("attempts", attempt),
+					zap.Duration("elapsed", time.Since(start)))
+			}
+			return nil
+		}
+
+		failure := ClassifyStartupFailure(err)
+		elapsed := time.Since(start)
+		if ctx.Err() != nil || !time.Now().Add(backoff).Before(deadline) {
+			return ErrEtcdStartupWait.WithCausef("step:%s, attempts:%d, elapsed:%s, last failure:%s, err:%v", what,
+				attempt, elapsed, failure, err)
+		}
+		log.Warn("etcd is not ready and retry", zap.String("step", what), zap.Int("attempt", attempt),
+			zap.String("failure", string(failure)), zap.Duration("elapsed", elapsed), zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+// CheckHealth checks whether the etcd cluster serves the linearizable reads, which requires a leader and a quorum.
+// The denied permission means the cluster is healthy because the read has been authenticated by then.
+func CheckHealth(ctx context.Context, client *clientv3.Client) error {
+	_, err := client.Get(ctx, "health")
+	if err == nil || errors.Is(err, rpctypes.ErrPermissionDenied) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package etcdutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestClassifyStartupFailure(t *testing.T) {
+	re := require.New(t)
+
+	re.Equal(StartupAuthFailed, ClassifyStartupFailure(rpctypes.ErrAuthFailed))
+	re.Equal(StartupUnhealthy, ClassifyStartupFailure(rpctypes.ErrNoLeader))
+	re.Equal(StartupUnreachable, ClassifyStartupFailure(fmt.Errorf("dial tcp 127.0.0.1:2379: connect: connection refused")))
+	re.Equal(StartupTimeout, ClassifyStartupFailure(context.DeadlineExceeded))
+	re.Equal(StartupUnknown, ClassifyStartupFailure(fmt.Errorf("unknown")))
+}
+
+func TestWaitStartup(t *testing.T) {
+	re := require.New(t)
+	cfg := NewTestSingleConfig()
+	defer CleanConfig(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The client doesn't block on dialing, so it can be created before the etcd is started.
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{cfg.LCUrls[0].String()}})
+	re.NoError(err)
+	defer client.Close()
+
+	opts := StartupWaitOptions{
+		MaxWait:        defaultTestTimeout,
+		AttemptTimeout: time.Millisecond * 200,
+		InitialBackoff: time.Millisecond * 20,
+		MaxBackoff:     time.Millisecond * 100,
+	}
+
+	// The step gives up after the max wait if the etcd is never ready.
+	shortOpts := opts
+	shortOpts.MaxWait = time.Millisecond * 300
+	err = WaitStartup(ctx, shortOpts, "check health", func(ctx context.Context) error {
+		return CheckHealth(ctx, client)
+	})
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Contains(err.Error(), "step:check health")
+
+	// The step succeeds once the etcd is started after a delay.
+	started := make(chan *embed.Etcd, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		etcd, err := embed.StartEtcd(cfg)
+		if err != nil {
+			close(started)
+			return
+		}
+		started <- etcd
+	}()
+	attempts := 0
+	re.NoError(WaitStartup(ctx, opts, "check health", func(ctx context.Context) error {
+		attempts++
+		return CheckHealth(ctx, client)
+	}))
+	re.Greater(attempts, 1)
+	etcd, ok := <-started
+	re.True(ok)
+	etcd.Close()
+}
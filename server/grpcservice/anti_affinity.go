@@ -0,0 +1,33 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// AntiAffinityGroupKey is the metadata key of the table creation with which the ceresdb server provides the
+// anti-affinity group of the table, usually the id of the partitioned table when its sub-tables are created.
+const AntiAffinityGroupKey = "ceresdb-anti-affinity-group"
+
+// withAntiAffinityGroup returns a context carrying the anti-affinity group provided in the metadata of the ctx, and the
+// invalid group is ignored.
+func withAntiAffinityGroup(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AntiAffinityGroupKey)
+	if len(values) == 0 {
+		return ctx
+	}
+	group, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		log.Warn("ignore invalid anti-affinity group", zap.String("group", values[0]), zap.Error(err))
+		return ctx
+	}
+	return cluster.WithAntiAffinityGroup(ctx, group)
+}
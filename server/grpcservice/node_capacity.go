@@ -0,0 +1,33 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// NodeShardCapacityKey is the metadata key of the heartbeat stream with which the ceresdb server reports the max number
+// of the shards it may own, and the node is unlimited if it is not reported.
+const NodeShardCapacityKey = "ceresdb-node-shard-capacity"
+
+// withNodeShardCapacity returns a context carrying the shard capacity reported in the metadata of the streamCtx, and
+// the invalid capacity is ignored.
+func withNodeShardCapacity(ctx, streamCtx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(streamCtx)
+	values := md.Get(NodeShardCapacityKey)
+	if len(values) == 0 {
+		return ctx
+	}
+	capacity, err := strconv.ParseUint(values[0], 10, 32)
+	if err != nil {
+		log.Warn("ignore invalid node shard capacity", zap.String("capacity", values[0]), zap.Error(err))
+		return ctx
+	}
+	return cluster.WithNodeShardCapacity(ctx, uint32(capacity))
+}
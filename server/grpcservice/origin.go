@@ -0,0 +1,35 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ClientIdentityKey is the metadata key with which the ceresdb server provides its identity.
+const ClientIdentityKey = "ceresdb-client-identity"
+
+// originFromContext returns the ceresdb server sending the request. The peer is always the address of the connection,
+// which the caller can't choose, while the identity is claimed by the caller. The followers never forward the
+// requests to the leader, so no origin carried in the metadata on behalf of another caller is accepted.
+func originFromContext(ctx context.Context) cluster.DDLOrigin {
+	origin := cluster.DDLOrigin{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(ClientIdentityKey); len(values) > 0 {
+			origin.Identity = values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		origin.Peer = p.Addr.String()
+	}
+	return origin
+}
+
+// withDDLOrigin returns a context carrying the origin of the request for the DDLs.
+func withDDLOrigin(ctx context.Context) context.Context {
+	return cluster.WithDDLOrigin(ctx, originFromContext(ctx))
+}
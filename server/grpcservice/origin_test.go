@@ -0,0 +1,62 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// originService records the origins of the drops.
+type originService struct {
+	metapb.UnimplementedCeresmetaRpcServiceServer
+
+	origins []cluster.DDLOrigin
+}
+
+func (s *originService) DropTable(ctx context.Context, _ *metapb.DropTableRequest) (*metapb.DropTableResponse, error) {
+	s.origins = append(s.origins, cluster.DDLOriginFromContext(withDDLOrigin(ctx)))
+	return &metapb.DropTableResponse{Header: okResponseHeader()}, nil
+}
+
+func TestDDLOrigin(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svc := &originService{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	re.NoError(err)
+	srv := grpc.NewServer()
+	metapb.RegisterCeresmetaRpcServiceServer(srv, svc)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	defer srv.Stop()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	re.NoError(err)
+	defer conn.Close()
+	client := metapb.NewCeresmetaRpcServiceClient(conn)
+
+	_, err = client.DropTable(metadata.AppendToOutgoingContext(ctx, ClientIdentityKey, "ceresdb-0"), &metapb.DropTableRequest{})
+	re.NoError(err)
+	re.Len(svc.origins, 1)
+	re.Equal("ceresdb-0", svc.origins[0].Identity)
+	re.NotEmpty(svc.origins[0].Peer)
+
+	// The peer claimed in the metadata is ignored, and the one of the connection is recorded.
+	forged := metadata.AppendToOutgoingContext(ctx, "ceresmeta-forwarded-peer", "10.0.0.1:8831",
+		"ceresmeta-forwarded-identity", "ceresdb-admin")
+	_, err = client.DropTable(forged, &metapb.DropTableRequest{})
+	re.NoError(err)
+	re.Equal(cluster.DDLOrigin{Peer: svc.origins[0].Peer}, svc.origins[1])
+}
@@ -7,9 +7,17 @@ import (
 	"io"
 	"time"
 
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
 	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
 	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/hook"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/schedule"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
 )
 
 type Service struct {
@@ -32,9 +40,32 @@ type HeartbeatStreamSender interface {
 
 // Handler is needed by grpc service to process the requests.
 type Handler interface {
-	UnbindHeartbeatStream(ctx context.Context, node string) error
+	// UnbindHeartbeatStream unbinds the sender from the node only if it is still bound to the node.
+	UnbindHeartbeatStream(ctx context.Context, node string, sender HeartbeatStreamSender) error
+	// BindHeartbeatStream binds the sender to the node, and the peer of the stream is carried by the ctx. It returns
+	// error if the node conflicts with another one of the same identity and the stream is rejected.
 	BindHeartbeatStream(ctx context.Context, node string, sender HeartbeatStreamSender) error
+	// CheckHeartbeatStream returns error if the bound stream has been fenced by another node of the same identity.
+	CheckHeartbeatStream(ctx context.Context, node string, sender HeartbeatStreamSender) error
 	ProcessHeartbeat(ctx context.Context, req *metapb.NodeHeartbeatRequest) error
+	// ValidateNodeEndpoint returns error if the endpoint advertised by the node is unusable.
+	ValidateNodeEndpoint(ctx context.Context, endpoint string) error
+	GetClusterManager() cluster.Manager
+	// CheckWritable returns error if the mutating requests should be rejected.
+	CheckWritable() error
+	// CheckLeader returns error if the server isn't the leader with the clusters reloaded, which is required to serve
+	// the DDLs from the caches of the clusters.
+	CheckLeader(ctx context.Context) error
+	// CheckReadable returns error if the reads should be served by the leader instead.
+	CheckReadable() error
+	// GetProcedureTracker returns the tracker of the in-flight procedures, and nil tracks nothing.
+	GetProcedureTracker() *procedure.Tracker
+	// GetProcedureLimiter returns the limiter of the running procedures, and nil limits nothing.
+	GetProcedureLimiter() *schedule.ProcedureLimiter
+	// GetHooks returns the registry of the hooks invoked on the events, and nil invokes nothing.
+	GetHooks() *hook.Registry
+	// GetAuditor returns the logger of the audit records, and nil records nothing.
+	GetAuditor() *audit.Logger
 
 	// TODO: define the methods for handling other grpc requests.
 }
@@ -72,7 +103,7 @@ func (b *streamBinder) unbind(ctx context.Context) error {
 
 	ctx, cancel := context.WithTimeout(ctx, b.timeout)
 	defer cancel()
-	if err := b.h.UnbindHeartbeatStream(ctx, b.node); err != nil {
+	if err := b.h.UnbindHeartbeatStream(ctx, b.node, b.stream); err != nil {
 		return ErrUnbindHeartbeatStream.WithCausef("node:%s, err:%v", b.node, err)
 	}
 
@@ -82,6 +113,11 @@ func (b *streamBinder) unbind(ctx context.Context) error {
 func (s *Service) NodeHeartbeat(heartbeatSrv metapb.CeresmetaRpcService_NodeHeartbeatServer) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// The peer tells the nodes of the same identity apart.
+	if p, ok := peer.FromContext(heartbeatSrv.Context()); ok {
+		ctx = peer.NewContext(ctx, p)
+	}
+	ctx = withNodeShardCapacity(ctx, heartbeatSrv.Context())
 
 	binder := streamBinder{
 		timeout: s.opTimeout,
@@ -105,8 +141,25 @@ func (s *Service) NodeHeartbeat(heartbeatSrv metapb.CeresmetaRpcService_NodeHear
 			return ErrRecvHeartbeat.WithCause(err)
 		}
 
-		if err := binder.bindIfNot(ctx, req.Info.Node); err != nil {
-			log.Error("fail to bind node stream", zap.Error(err))
+		if err := s.checkNodeEndpoint(ctx, &binder, req); err != nil {
+			log.Error("reject node registration", zap.String("node", req.GetInfo().GetNode()), zap.Error(err))
+			if err := heartbeatSrv.Send(&metapb.NodeHeartbeatResponse{Header: errResponseHeader(err)}); err != nil {
+				log.Error("fail to send heartbeat response", zap.Error(err))
+			}
+			continue
+		}
+
+		// The stream is closed if the node conflicts with another one of the same identity.
+		err = binder.bindIfNot(ctx, req.Info.Node)
+		if err == nil && binder.bound {
+			err = s.h.CheckHeartbeatStream(ctx, binder.node, heartbeatSrv)
+		}
+		if err != nil {
+			log.Error("close conflicting node stream", zap.String("node", req.GetInfo().GetNode()), zap.Error(err))
+			if err := heartbeatSrv.Send(&metapb.NodeHeartbeatResponse{Header: errResponseHeader(err)}); err != nil {
+				log.Error("fail to send heartbeat response", zap.Error(err))
+			}
+			return err
 		}
 
 		func() {
@@ -121,3 +174,221 @@ func (s *Service) NodeHeartbeat(heartbeatSrv metapb.CeresmetaRpcService_NodeHear
 		}()
 	}
 }
+
+// checkNodeEndpoint validates the endpoint when the node registers or its endpoint changes. If the stream has been
+// bound to a valid endpoint, the invalid new one is replaced with the bound one instead of rejecting the heartbeat.
+func (s *Service) checkNodeEndpoint(ctx context.Context, binder *streamBinder, req *metapb.NodeHeartbeatRequest) error {
+	if req.GetInfo() == nil {
+		return cluster.ErrInvalidNodeEndpoint.WithCausef("missing node info")
+	}
+	node := req.GetInfo().GetNode()
+	if binder.bound && node == binder.node {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opTimeout)
+	defer cancel()
+	err := s.h.ValidateNodeEndpoint(ctx, node)
+	if err == nil || !binder.bound {
+		return err
+	}
+
+	log.Warn("node reports an invalid endpoint and keep the previous one", zap.String("endpoint", node),
+		zap.String("previous-endpoint", binder.node), zap.Error(err))
+	req.Info.Node = binder.node
+	return nil
+}
+
+func (s *Service) AllocSchemaId(ctx context.Context, req *metapb.AllocSchemaIdRequest) (resp *metapb.AllocSchemaIdResponse, _ error) { //nolint:revive,stylecheck
+	defer func() {
+		s.audit(ctx, cluster.ProcedureCreateSchema, req.GetHeader().GetClusterName(), req.GetName(), resp.GetHeader())
+	}()
+	if err := s.h.CheckWritable(); err != nil {
+		return &metapb.AllocSchemaIdResponse{Header: errResponseHeader(err)}, nil
+	}
+	if err := s.h.CheckLeader(ctx); err != nil {
+		return &metapb.AllocSchemaIdResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(withDDLOrigin(ctx), s.opTimeout)
+	defer cancel()
+	ctx, finish, err := s.startProcedure(ctx, cluster.ProcedureCreateSchema, req.GetHeader().GetClusterName(), req.GetName())
+	if err != nil {
+		return &metapb.AllocSchemaIdResponse{Header: errResponseHeader(err)}, nil
+	}
+	defer finish()
+
+	schemaID, err := s.h.GetClusterManager().AllocSchemaID(ctx, req.GetHeader().GetClusterName(), req.GetName())
+	if err != nil {
+		log.Error("fail to alloc schema id", zap.Any("request", req), zap.Error(err))
+		return &metapb.AllocSchemaIdResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	return &metapb.AllocSchemaIdResponse{
+		Header: okResponseHeader(),
+		Name:   req.GetName(),
+		Id:     schemaID,
+	}, nil
+}
+
+func (s *Service) AllocTableId(ctx context.Context, req *metapb.AllocTableIdRequest) (resp *metapb.AllocTableIdResponse, _ error) { //nolint:revive,stylecheck
+	defer func() {
+		s.audit(ctx, cluster.ProcedureCreateTable, req.GetHeader().GetClusterName(), req.GetSchemaName()+"."+req.GetName(),
+			resp.GetHeader())
+	}()
+	if err := s.h.CheckWritable(); err != nil {
+		return &metapb.AllocTableIdResponse{Header: errResponseHeader(err)}, nil
+	}
+	if err := s.h.CheckLeader(ctx); err != nil {
+		return &metapb.AllocTableIdResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	ctx = cluster.WithAuditor(cluster.WithHooks(withDDLOrigin(ctx), s.h.GetHooks()), s.h.GetAuditor())
+	ctx = withShardFreezeToken(withTableReservationToken(withAntiAffinityGroup(ctx)))
+	ctx, cancel := context.WithTimeout(withObservedTopologyGeneration(ctx), s.opTimeout)
+	defer cancel()
+	ctx, finish, err := s.startProcedure(ctx, cluster.ProcedureCreateTable, req.GetHeader().GetClusterName(),
+		req.GetSchemaName()+"."+req.GetName())
+	if err != nil {
+		return &metapb.AllocTableIdResponse{Header: errResponseHeader(err)}, nil
+	}
+	defer finish()
+
+	table, err := s.h.GetClusterManager().AllocTableID(ctx, req.GetHeader().GetClusterName(), req.GetSchemaName(), req.GetName())
+	if err != nil {
+		log.Error("fail to alloc table id", zap.Any("request", req), zap.Error(err))
+		return &metapb.AllocTableIdResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	s.setShardVersionPolicyHeader(ctx, req.GetHeader().GetClusterName())
+	return &metapb.AllocTableIdResponse{
+		Header:     okResponseHeader(),
+		SchemaName: table.GetSchemaName(),
+		Name:       table.GetName(),
+		ShardId:    table.GetShardID(),
+		SchemaId:   table.GetSchemaID(),
+		Id:         table.GetID(),
+	}, nil
+}
+
+func (s *Service) GetTables(ctx context.Context, req *metapb.GetTablesRequest) (*metapb.GetTablesResponse, error) {
+	if err := s.h.CheckReadable(); err != nil {
+		return &metapb.GetTablesResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opTimeout)
+	defer cancel()
+	shardTables, err := s.h.GetClusterManager().GetShardTables(ctx, req.GetHeader().GetClusterName(), req.GetShardId())
+	if err != nil {
+		log.Error("fail to get tables", zap.Any("request", req), zap.Error(err))
+		return &metapb.GetTablesResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	tablesMap := make(map[uint32]*metapb.ShardTables, len(shardTables))
+	for shardID, shard := range shardTables {
+		tables := make([]*metapb.TableInfo, 0, len(shard.Tables))
+		for _, table := range shard.Tables {
+			tables = append(tables, &metapb.TableInfo{
+				Id:         table.GetID(),
+				Name:       table.GetName(),
+				SchemaId:   table.GetSchemaID(),
+				SchemaName: table.GetSchemaName(),
+			})
+		}
+		tablesMap[shardID] = &metapb.ShardTables{Role: metapb.ShardRole_LEADER, Tables: tables, Version: shard.Version}
+	}
+	return &metapb.GetTablesResponse{Header: okResponseHeader(), TablesMap: tablesMap}, nil
+}
+
+func (s *Service) DropTable(ctx context.Context, req *metapb.DropTableRequest) (resp *metapb.DropTableResponse, _ error) {
+	defer func() {
+		s.audit(ctx, cluster.ProcedureDropTable, req.GetHeader().GetClusterName(), req.GetSchemaName()+"."+req.GetName(),
+			resp.GetHeader())
+	}()
+	if err := s.h.CheckWritable(); err != nil {
+		return &metapb.DropTableResponse{Header: errResponseHeader(err)}, nil
+	}
+	if err := s.h.CheckLeader(ctx); err != nil {
+		return &metapb.DropTableResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(withObservedTopologyGeneration(withShardFreezeToken(withDDLOrigin(ctx))), s.opTimeout)
+	defer cancel()
+	ctx, finish, err := s.startProcedure(ctx, cluster.ProcedureDropTable, req.GetHeader().GetClusterName(),
+		req.GetSchemaName()+"."+req.GetName())
+	if err != nil {
+		return &metapb.DropTableResponse{Header: errResponseHeader(err)}, nil
+	}
+	defer finish()
+
+	err = s.h.GetClusterManager().DropTable(ctx, req.GetHeader().GetClusterName(), req.GetSchemaName(), req.GetName(), false)
+	if err != nil {
+		log.Error("fail to drop table", zap.Any("request", req), zap.Error(err))
+		return &metapb.DropTableResponse{Header: errResponseHeader(err)}, nil
+	}
+
+	s.setShardVersionPolicyHeader(ctx, req.GetHeader().GetClusterName())
+	return &metapb.DropTableResponse{Header: okResponseHeader()}, nil
+}
+
+// startProcedure tracks the procedure and admits it by the limit of the running procedures, and the returned finish
+// must be called once the procedure ends.
+func (s *Service) startProcedure(ctx context.Context, typ cluster.ProcedureType, clusterName, target string) (context.Context, func(), error) {
+	ctx, finish := s.h.GetProcedureTracker().Start(ctx, string(typ), clusterName, target)
+	release, err := s.h.GetProcedureLimiter().Acquire(ctx)
+	if err != nil {
+		log.Warn("reject procedure", zap.String("type", string(typ)), zap.String("cluster", clusterName),
+			zap.String("target", target), zap.Error(err))
+		finish()
+		return ctx, nil, err
+	}
+	return ctx, func() {
+		release()
+		finish()
+	}, nil
+}
+
+// audit records the mutating operation with the result carried by the header of the response, including the ones
+// rejected before being executed.
+func (s *Service) audit(ctx context.Context, operation cluster.ProcedureType, clusterName, target string, header *commonpb.ResponseHeader) {
+	auditor := s.h.GetAuditor()
+	if auditor == nil {
+		return
+	}
+
+	origin := originFromContext(ctx)
+	record := audit.Record{
+		Cluster:   clusterName,
+		Operation: string(operation),
+		Actor:     origin.Actor(),
+		Peer:      origin.Peer,
+		Target:    target,
+		Result:    audit.ResultSuccess,
+	}
+	// The operation rejected for the unknown cluster is recorded without the environment.
+	if c, err := s.h.GetClusterManager().GetCluster(ctx, clusterName); err == nil {
+		record.Environment = c.Environment()
+	}
+	if header.GetCode() != uint32(coderr.Ok) {
+		record.Result = audit.ResultFailure
+		record.Error = header.GetError()
+	}
+	auditor.Log(record)
+}
+
+func okResponseHeader() *commonpb.ResponseHeader {
+	return &commonpb.ResponseHeader{Code: uint32(coderr.Ok)}
+}
+
+// errResponseHeader converts the err into the response header, and the code of the CodeError is respond if the cause
+// of the err is a CodeError.
+func errResponseHeader(err error) *commonpb.ResponseHeader {
+	code, ok := coderr.GetCauseCode(err)
+	if !ok {
+		code = coderr.Internal
+	}
+	return &commonpb.ResponseHeader{
+		Code:  uint32(code),
+		Error: err.Error(),
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"google.golang.org/grpc/metadata"
+)
+
+// ShardFreezeTokenKey is the metadata key of the table creation and drop with which the ceresdb server provides the
+// token of the freeze of the shard version, so that the operation is allowed to bump the version of the frozen shard.
+const ShardFreezeTokenKey = "ceresdb-shard-freeze-token"
+
+// withShardFreezeToken returns a context carrying the token provided in the metadata of the ctx.
+func withShardFreezeToken(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ShardFreezeTokenKey)
+	if len(values) == 0 {
+		return ctx
+	}
+	return cluster.WithShardFreezeToken(ctx, values[0])
+}
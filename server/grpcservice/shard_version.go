@@ -0,0 +1,29 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// ShardVersionPolicyKey is the header key with which the responses of the DDLs tell the ceresdb server which operations
+// bump the versions of the shards.
+const ShardVersionPolicyKey = "ceresmeta-shard-version-policy"
+
+// setShardVersionPolicyHeader sends the shard version policy of the cluster in the header of the response. The policy
+// is informational, so the failure is only logged.
+func (s *Service) setShardVersionPolicyHeader(ctx context.Context, clusterName string) {
+	c, err := s.h.GetClusterManager().GetCluster(ctx, clusterName)
+	if err != nil {
+		return
+	}
+	policy := string(c.GetOptions().ShardVersionPolicy.OrDefault())
+	if err := grpc.SetHeader(ctx, metadata.Pairs(ShardVersionPolicyKey, policy)); err != nil {
+		log.Warn("fail to set shard version policy header", zap.String("cluster", clusterName), zap.Error(err))
+	}
+}
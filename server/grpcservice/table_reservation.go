@@ -0,0 +1,24 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"google.golang.org/grpc/metadata"
+)
+
+// TableReservationTokenKey is the metadata key of the table creation with which the ceresdb server provides the token
+// of the reservation of the table name.
+const TableReservationTokenKey = "ceresdb-table-reservation-token"
+
+// withTableReservationToken returns a context carrying the token provided in the metadata of the ctx.
+func withTableReservationToken(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(TableReservationTokenKey)
+	if len(values) == 0 {
+		return ctx
+	}
+	return cluster.WithTableReservationToken(ctx, values[0])
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package grpcservice
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// TopologyGenerationKey is the metadata key of the DDLs with which the ceresdb server provides the topology generation
+// it has observed. The heartbeats carry no generation, because the metadata of the heartbeat stream is fixed once the
+// stream is opened.
+const TopologyGenerationKey = "ceresdb-topology-generation"
+
+// withObservedTopologyGeneration returns a context carrying the topology generation provided in the metadata of the
+// ctx, and the invalid generation is ignored just like the missing one.
+func withObservedTopologyGeneration(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(TopologyGenerationKey)
+	if len(values) == 0 {
+		return ctx
+	}
+	generation, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		log.Warn("ignore invalid topology generation", zap.String("generation", values[0]), zap.Error(err))
+		return ctx
+	}
+	return cluster.WithObservedTopologyGeneration(ctx, generation)
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxExecOutputBytes bounds the output of the failed exec-hook kept in the error.
+const maxExecOutputBytes = 4096
+
+// LogHook only logs the events, which is an example of the hooks.
+type LogHook struct{}
+
+func (LogHook) Name() string {
+	return "log"
+}
+
+func (LogHook) Handle(_ context.Context, event Event) error {
+	log.Info("hook event", zap.String("type", string(event.Type)), zap.String("cluster", event.Cluster),
+		zap.String("schema", event.Schema), zap.String("table", event.Table), zap.Uint64("table-id", event.TableID),
+		zap.Uint32("shard", event.ShardID), zap.String("node", event.Node), zap.Time("timestamp", event.Timestamp))
+	return nil
+}
+
+// WebhookHook posts the json-encoded events to the URL, and the response of a status other than 2xx is a failure.
+type WebhookHook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *WebhookHook) Name() string {
+	return "webhook"
+}
+
+func (h *WebhookHook) Handle(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "encode event")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "post event")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ErrInvokeHook.WithCausef("unexpected webhook status:%s", resp.Status)
+	}
+	return nil
+}
+
+// ExecHook runs the external command with the json-encoded event on its stdin, and the command exiting with a
+// non-zero code is a failure. The command is killed once the ctx is done.
+type ExecHook struct {
+	// Command is the path of the executable followed by its arguments, separated by the whitespaces.
+	Command string
+}
+
+func (h *ExecHook) Name() string {
+	return "exec"
+}
+
+func (h *ExecHook) Handle(ctx context.Context, event Event) error {
+	args := strings.Fields(h.Command)
+	if len(args) == 0 {
+		return ErrInvalidHook.WithCausef("exec-hook command is empty")
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "encode event")
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(output) > maxExecOutputBytes {
+			output = output[:maxExecOutputBytes]
+		}
+		return errors.Wrapf(err, "run command:%s, output:%s", args[0], output)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package hook
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrHookRegistered = coderr.NewCodeError(coderr.Conflict, "hook registered")
+	ErrInvalidHook    = coderr.NewCodeError(coderr.InvalidParams, "invalid hook")
+	ErrRegistryClosed = coderr.NewCodeError(coderr.ServiceUnavailable, "hook registry closed")
+	ErrInvokeHook     = coderr.NewCodeError(coderr.Internal, "invoke hook")
+)
@@ -0,0 +1,25 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package hook
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeTimeout = "timeout"
+	outcomePanic   = "panic"
+	outcomeDropped = "dropped"
+)
+
+var hookInvocationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "hook",
+		Name:      "invocations_total",
+		Help:      "Number of the invocations of the hooks by the outcome, which is success, failure, timeout, panic or dropped.",
+	}, []string{"hook", "event", "outcome"})
+
+func init() {
+	prometheus.MustRegister(hookInvocationsCounter)
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package hook
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHookTimeout   = time.Second * 5
+	defaultHookQueueSize = 1024
+)
+
+// EventType is the type of the events the hooks are invoked on.
+type EventType string
+
+const (
+	// EventTableCreated is emitted after the table is created and its shard topology is persisted.
+	EventTableCreated EventType = "table_created"
+	// EventNodeOffline is emitted once a registered node is found offline, and again only after it comes back.
+	EventNodeOffline EventType = "node_offline"
+)
+
+// Event is what happened in the cluster, and the fields irrelevant to its type are empty.
+type Event struct {
+	Type      EventType `json:"type"`
+	Cluster   string    `json:"cluster"`
+	Schema    string    `json:"schema,omitempty"`
+	Table     string    `json:"table,omitempty"`
+	TableID   uint64    `json:"table_id,omitempty"`
+	ShardID   uint32    `json:"shard_id"`
+	Node      string    `json:"node,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Hook is invoked on the events it subscribes to. Handle should return once the ctx is done, or it is abandoned.
+type Hook interface {
+	Name() string
+	Handle(ctx context.Context, event Event) error
+}
+
+// Options configures how a hook is invoked, and the zero values mean the defaults.
+type Options struct {
+	// Events are the types of the events the hook subscribes to, and it subscribes to all if empty.
+	Events    []EventType
+	Timeout   time.Duration
+	QueueSize int
+}
+
+// Registry invokes the registered hooks asynchronously after the events are emitted.
+//
+// Every hook has its own queue and worker, so a slow or failing hook never delays the others nor the emitters. The
+// events are invoked on every hook in the order they are emitted, and the events are dropped if the queue of the hook
+// is full. A hook overrunning its timeout is abandoned and the next event is invoked at once.
+type Registry struct {
+	// mu protects all the fields below, and it serializes the emitters so that all the hooks see the same order.
+	mu      sync.Mutex
+	workers []*worker
+	closed  bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register starts invoking the hook on the events emitted afterwards.
+func (r *Registry) Register(hook Hook, opts Options) error {
+	if hook.Name() == "" {
+		return ErrInvalidHook.WithCausef("hook name is empty")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultHookTimeout
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultHookQueueSize
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrRegistryClosed.WithCausef("hook:%s", hook.Name())
+	}
+	for _, w := range r.workers {
+		if w.hook.Name() == hook.Name() {
+			return ErrHookRegistered.WithCausef("hook:%s", hook.Name())
+		}
+	}
+
+	w := newWorker(hook, opts)
+	r.workers = append(r.workers, w)
+	go w.run()
+	log.Info("register hook", zap.String("hook", hook.Name()), zap.Any("events", opts.Events),
+		zap.Duration("timeout", opts.Timeout))
+	return nil
+}
+
+// Emit queues the event to the hooks subscribing to it without blocking, and a nil registry invokes nothing.
+func (r *Registry) Emit(event Event) {
+	if r == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	for _, w := range r.workers {
+		w.enqueue(event)
+	}
+}
+
+// Close stops invoking the hooks, and the queued events are abandoned.
+func (r *Registry) Close() {
+	r.mu.Lock()
+	workers := r.workers
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, w := range workers {
+		w.stop()
+	}
+}
+
+type worker struct {
+	hook    Hook
+	events  map[EventType]struct{}
+	timeout time.Duration
+	queue   chan Event
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newWorker(hook Hook, opts Options) *worker {
+	events := make(map[EventType]struct{}, len(opts.Events))
+	for _, typ := range opts.Events {
+		events[typ] = struct{}{}
+	}
+	return &worker{
+		hook:    hook,
+		events:  events,
+		timeout: opts.Timeout,
+		queue:   make(chan Event, opts.QueueSize),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+}
+
+func (w *worker) enqueue(event Event) {
+	if _, ok := w.events[event.Type]; len(w.events) > 0 && !ok {
+		return
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		hookInvocationsCounter.WithLabelValues(w.hook.Name(), string(event.Type), outcomeDropped).Inc()
+		log.Warn("drop event for full hook queue", zap.String("hook", w.hook.Name()), zap.String("event", string(event.Type)),
+			zap.String("cluster", event.Cluster), zap.Int("queue-size", cap(w.queue)))
+	}
+}
+
+func (w *worker) run() {
+	defer close(w.doneCh)
+
+	for {
+		select {
+		case event := <-w.queue:
+			w.invoke(event)
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *worker) stop() {
+	close(w.stopCh)
+	<-w.doneCh
+}
+
+type invokeResult struct {
+	err      error
+	panicked bool
+}
+
+// invoke calls the hook on the event, and the failure, the panic or the timeout of the hook is only logged.
+func (w *worker) invoke(event Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	// The channel is buffered so that the abandoned hook can still finish.
+	resultCh := make(chan invokeResult, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				resultCh <- invokeResult{err: ErrInvokeHook.WithCausef("panic:%v", p), panicked: true}
+			}
+		}()
+		resultCh <- invokeResult{err: w.hook.Handle(ctx, event)}
+	}()
+
+	var err error
+	var outcome string
+	select {
+	case result := <-resultCh:
+		err = result.err
+		switch {
+		case result.panicked:
+			outcome = outcomePanic
+		case err != nil:
+			outcome = outcomeFailure
+		default:
+			outcome = outcomeSuccess
+		}
+	case <-ctx.Done():
+		err = ErrInvokeHook.WithCausef("timeout:%s", w.timeout)
+		outcome = outcomeTimeout
+	case <-w.stopCh:
+		err = ErrInvokeHook.WithCausef("registry is closed")
+		outcome = outcomeFailure
+	}
+
+	hookInvocationsCounter.WithLabelValues(w.hook.Name(), string(event.Type), outcome).Inc()
+	if err != nil {
+		log.Error("fail to invoke hook", zap.String("hook", w.hook.Name()), zap.String("event", string(event.Type)),
+			zap.String("cluster", event.Cluster), zap.String("outcome", outcome), zap.Error(err))
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+const defaultTestTimeout = time.Second * 10
+
+// recordHook records the events it handles, and the handle function decides the result.
+type recordHook struct {
+	name   string
+	handle func(ctx context.Context, event Event) error
+
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *recordHook) Name() string {
+	return h.name
+}
+
+func (h *recordHook) Handle(ctx context.Context, event Event) error {
+	h.mu.Lock()
+	h.events = append(h.events, event)
+	h.mu.Unlock()
+	if h.handle != nil {
+		return h.handle(ctx, event)
+	}
+	return nil
+}
+
+func (h *recordHook) tables() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tables := make([]string, 0, len(h.events))
+	for _, event := range h.events {
+		tables = append(tables, event.Table)
+	}
+	return tables
+}
+
+func tableEvent(i int) Event {
+	return Event{Type: EventTableCreated, Cluster: "c1", Schema: "public", Table: fmt.Sprintf("t%d", i), TableID: uint64(i)}
+}
+
+func TestRegistryOrdering(t *testing.T) {
+	re := require.New(t)
+	registry := NewRegistry()
+	defer registry.Close()
+
+	first, second := &recordHook{name: "first"}, &recordHook{name: "second"}
+	nodeOnly := &recordHook{name: "node-only"}
+	re.NoError(registry.Register(first, Options{}))
+	re.NoError(registry.Register(second, Options{}))
+	re.NoError(registry.Register(nodeOnly, Options{Events: []EventType{EventNodeOffline}}))
+	err := registry.Register(&recordHook{name: "first"}, Options{})
+	re.True(coderr.Is(err, coderr.Conflict))
+	err = registry.Register(&recordHook{}, Options{})
+	re.True(coderr.Is(err, coderr.InvalidParams))
+
+	// The events emitted concurrently are seen in the same order by all the hooks.
+	const emitters, eventsPerEmitter = 4, 50
+	var wg sync.WaitGroup
+	for i := 0; i < emitters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < eventsPerEmitter; j++ {
+				registry.Emit(tableEvent(i*eventsPerEmitter + j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	registry.Emit(Event{Type: EventNodeOffline, Cluster: "c1", Node: "n1"})
+
+	re.Eventually(func() bool {
+		return len(first.tables()) == emitters*eventsPerEmitter+1 && len(second.tables()) == emitters*eventsPerEmitter+1
+	}, defaultTestTimeout, time.Millisecond*10)
+	re.Equal(first.tables(), second.tables())
+	// The events of an emitter are in the order they are emitted.
+	last := make(map[int]int)
+	for _, table := range first.tables()[:emitters*eventsPerEmitter] {
+		var id int
+		_, err := fmt.Sscanf(table, "t%d", &id)
+		re.NoError(err)
+		if prev, ok := last[id/eventsPerEmitter]; ok {
+			re.Less(prev, id)
+		}
+		last[id/eventsPerEmitter] = id
+	}
+
+	re.Eventually(func() bool {
+		return len(nodeOnly.tables()) == 1
+	}, defaultTestTimeout, time.Millisecond*10)
+	nodeOnly.mu.Lock()
+	re.Equal("n1", nodeOnly.events[0].Node)
+	re.False(nodeOnly.events[0].Timestamp.IsZero())
+	nodeOnly.mu.Unlock()
+}
+
+func TestRegistryIsolation(t *testing.T) {
+	re := require.New(t)
+	registry := NewRegistry()
+
+	release := make(chan struct{})
+	defer close(release)
+	panicking := &recordHook{name: "panicking", handle: func(context.Context, Event) error {
+		panic("boom")
+	}}
+	failing := &recordHook{name: "failing", handle: func(context.Context, Event) error {
+		return errors.New("failed")
+	}}
+	// The stuck hook ignores the ctx, so it is abandoned on the timeout.
+	stuck := &recordHook{name: "stuck", handle: func(context.Context, Event) error {
+		<-release
+		return nil
+	}}
+	healthy := &recordHook{name: "healthy"}
+	// The counters are global, so only their growth is checked.
+	invocations := func(hook, outcome string) float64 {
+		return testutil.ToFloat64(hookInvocationsCounter.WithLabelValues(hook, string(EventTableCreated), outcome))
+	}
+	panics, failures := invocations("panicking", outcomePanic), invocations("failing", outcomeFailure)
+	timeouts, dropped := invocations("stuck", outcomeTimeout), invocations("stuck", outcomeDropped)
+	re.NoError(registry.Register(panicking, Options{}))
+	re.NoError(registry.Register(failing, Options{}))
+	re.NoError(registry.Register(stuck, Options{Timeout: time.Millisecond * 50, QueueSize: 1}))
+	re.NoError(registry.Register(healthy, Options{}))
+
+	// Emitting never blocks even if the queue of the stuck hook is full.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		registry.Emit(tableEvent(i))
+	}
+	re.Less(time.Since(start), time.Second)
+
+	re.Eventually(func() bool {
+		return len(healthy.tables()) == 10 && len(panicking.tables()) == 10 && len(failing.tables()) == 10
+	}, defaultTestTimeout, time.Millisecond*10)
+	re.Equal(healthy.tables(), panicking.tables())
+	re.Equal(panics+10, invocations("panicking", outcomePanic))
+	re.Equal(failures+10, invocations("failing", outcomeFailure))
+
+	// The stuck hook moves on after the timeout, and the events beyond its queue are dropped.
+	re.Eventually(func() bool {
+		return invocations("stuck", outcomeTimeout) == timeouts+10-(invocations("stuck", outcomeDropped)-dropped)
+	}, defaultTestTimeout, time.Millisecond*10)
+	re.Greater(invocations("stuck", outcomeDropped), dropped)
+	stuckEvents := len(stuck.tables())
+	registry.Emit(tableEvent(10))
+	re.Eventually(func() bool {
+		return len(stuck.tables()) == stuckEvents+1 && len(healthy.tables()) == 11
+	}, defaultTestTimeout, time.Millisecond*10)
+
+	registry.Close()
+	re.True(coderr.Is(registry.Register(&recordHook{name: "late"}, Options{}), coderr.ServiceUnavailable))
+	registry.Emit(tableEvent(11))
+	var nilRegistry *Registry
+	nilRegistry.Emit(tableEvent(12))
+	re.Len(healthy.tables(), 11)
+}
+
+func TestBuiltinHooks(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+	event := tableEvent(1)
+	event.Timestamp = time.Unix(100, 0).UTC()
+
+	re.NoError(LogHook{}.Handle(ctx, event))
+
+	var received []Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := Event{}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Table == "rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, e)
+	}))
+	defer srv.Close()
+	webhook := &WebhookHook{URL: srv.URL}
+	re.NoError(webhook.Handle(ctx, event))
+	re.Equal([]Event{event}, received)
+	rejected := event
+	rejected.Table = "rejected"
+	re.Error(webhook.Handle(ctx, rejected))
+
+	// The exec-hook gets the event on its stdin.
+	dir := t.TempDir()
+	script, output := filepath.Join(dir, "hook.sh"), filepath.Join(dir, "event.json")
+	re.NoError(os.WriteFile(script, []byte("#!/bin/sh\ncat > \"$1\"\n"), 0o700))
+	re.NoError((&ExecHook{Command: script + " " + output}).Handle(ctx, event))
+	payload, err := os.ReadFile(output)
+	re.NoError(err)
+	decoded := Event{}
+	re.NoError(json.Unmarshal(payload, &decoded))
+	re.Equal(event, decoded)
+
+	re.ErrorContains((&ExecHook{Command: "false"}).Handle(ctx, event), "run command:false")
+	re.True(coderr.Is((&ExecHook{}).Handle(ctx, event), coderr.InvalidParams))
+}
@@ -0,0 +1,14 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package httpservice
+
+import (
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+)
+
+var (
+	ErrAuthFailed       = coderr.NewCodeError(coderr.Unauthorized, "admin auth failed")
+	ErrMethodNotAllowed = coderr.NewCodeError(coderr.MethodNotAllowed, "method not allowed")
+	ErrInvalidRequest   = coderr.NewCodeError(coderr.InvalidParams, "invalid request")
+	ErrNotLeader        = coderr.NewCodeError(coderr.ServiceUnavailable, "not leader")
+)
@@ -0,0 +1,1118 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package httpservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/CeresDB/ceresmeta/server/backup"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/CeresDB/ceresmeta/server/member"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// APIPrefix is the path prefix of the http apis, which are served on the client urls of the embedded etcd.
+	APIPrefix = "/ceresmeta/api/v1/"
+
+	bearerPrefix = "Bearer "
+	// maxRequestBytes bounds the body of the requests.
+	maxRequestBytes = 1024 * 1024
+	// auditActor is the actor of the audit records of the operations done through the http apis.
+	auditActor = "admin"
+)
+
+// Handler is needed by http service to process the requests.
+type Handler interface {
+	// IsLeader tells whether the server is the leader of the ceresmeta cluster now.
+	IsLeader(ctx context.Context) bool
+	// CheckWritable returns error if the mutating requests should be rejected.
+	CheckWritable() error
+	// CheckReadable returns error if the reads should be served by the leader instead.
+	CheckReadable() error
+	GetClusterManager() cluster.Manager
+	// GetAuditor returns the logger of the audit records, and nil records nothing.
+	GetAuditor() *audit.Logger
+
+	// SwapShards exchanges the owners of two shards owned by different nodes.
+	SwapShards(ctx context.Context, clusterName string, shardA, shardB uint32) error
+	// ReassignNodeShards moves all the shards of the node to the targets, and the report is returned along with the
+	// error if any move fails.
+	ReassignNodeShards(ctx context.Context, clusterName, from string, targets []string,
+		strategy schedule.ReassignStrategy) (*cluster.ShardReassignReport, error)
+	// AssignShard assigns the unassigned shard to the node and asks the node to open it.
+	AssignShard(ctx context.Context, clusterName string, shardID uint32, node string) error
+	// GetNodeSnapshot returns the complete desired state of the node in one consistent response.
+	GetNodeSnapshot(ctx context.Context, clusterName, nodeName string) (*cluster.NodeSnapshot, error)
+	// ProcedureConcurrency returns the numbers of the running and the queued procedures along with the limit.
+	ProcedureConcurrency(ctx context.Context) schedule.ProcedureConcurrency
+	// ListBlockedProcedures returns the in-flight procedures waiting on something with the reasons.
+	ListBlockedProcedures(ctx context.Context) ([]procedure.BlockedProcedure, error)
+	// GetProcedure returns the procedure in flight or finished lately along with the breakdown of its wall time.
+	GetProcedure(ctx context.Context, id uint64) (*procedure.Procedure, error)
+	// GetReadStaleness returns the latest lag of the server behind the leader.
+	GetReadStaleness() etcdutil.StalenessStatus
+	// GetEtcdSpaceStatus returns the latest space status of the etcd.
+	GetEtcdSpaceStatus() etcdutil.SpaceStatus
+	// GetSnapshotStatus returns the statuses of the latest scheduled snapshots keyed by the cluster name.
+	GetSnapshotStatus() map[string]backup.Status
+	// InspectKeys returns at most limit raw keys under the prefix relative to the storage root path along with their
+	// values, and the values of the known protobuf kinds are decoded if decode is set.
+	InspectKeys(ctx context.Context, prefix string, decode bool, limit int) (*storage.KeyInspection, error)
+	// ListMembers returns the members of the etcd cluster along with the leader of the ceresmeta cluster.
+	ListMembers(ctx context.Context) (*member.Members, error)
+	// PromoteObserver promotes the observer to a voting member of the etcd cluster, replacing the unhealthy voter if
+	// replaceVoterID isn't zero.
+	PromoteObserver(ctx context.Context, observerID, replaceVoterID uint64) (*member.ObserverPromotion, error)
+	// SetShardOpenPacing changes the pacing of the open commands sent to the nodes until the server restarts.
+	SetShardOpenPacing(ctx context.Context, pacing schedule.ShardOpenPacing) error
+	// GetShardOpenPacing returns the pacing of the open commands sent to the nodes.
+	GetShardOpenPacing(ctx context.Context) schedule.ShardOpenPacing
+	// AddDebugScope writes the debug logs about the entities matching the scope for the ttl regardless of the log level.
+	AddDebugScope(ctx context.Context, scope log.DebugScope, ttl time.Duration) (log.DebugScope, error)
+	// RemoveDebugScope removes the debug scope before it expires.
+	RemoveDebugScope(ctx context.Context, id uint64) error
+	// ListDebugScopes lists the active debug scopes with their expiries.
+	ListDebugScopes(ctx context.Context) []log.DebugScope
+}
+
+// Service serves the admin apis over http. Every request must present the admin token as the bearer token, and the
+// mutating requests are served only by the leader, because the followers receive no heartbeats and can't command the
+// nodes.
+type Service struct {
+	adminToken string
+	h          Handler
+	mux        *http.ServeMux
+}
+
+func NewService(adminToken string, h Handler) *Service {
+	s := &Service{
+		adminToken: adminToken,
+		h:          h,
+		mux:        http.NewServeMux(),
+	}
+	s.handle("swap_shards", http.MethodPost, s.swapShards)
+	s.handle("reassign_node_shards", http.MethodPost, s.reassignNodeShards)
+	s.handle("unassigned_shards", http.MethodGet, s.listUnassignedShards)
+	s.handle("assign_shard", http.MethodPost, s.assignShard)
+	s.handle("node_snapshot", http.MethodGet, s.getNodeSnapshot)
+	s.handle("shard", http.MethodGet, s.getShard)
+	s.handle("topology", http.MethodGet, s.getTopology)
+	s.handle("hot_spots", http.MethodGet, s.getHotSpots)
+	s.handle("table_placement", http.MethodGet, s.explainTablePlacement)
+	s.handle("create_schema", http.MethodPost, s.createSchema)
+	s.handle("schema_stats", http.MethodGet, s.getSchemaStats)
+	s.handle("alter_table", http.MethodPost, s.alterTable)
+	s.handle("reserve_table_name", http.MethodPost, s.reserveTableName)
+	s.handle("release_table_name", http.MethodPost, s.releaseTableName)
+	s.handle("procedure_concurrency", http.MethodGet, s.getProcedureConcurrency)
+	s.handle("blocked_procedures", http.MethodGet, s.listBlockedProcedures)
+	s.handle("procedure", http.MethodGet, s.getProcedure)
+	s.handle("read_staleness", http.MethodGet, s.getReadStaleness)
+	s.handle("etcd_space", http.MethodGet, s.getEtcdSpaceStatus)
+	s.handle("snapshot_status", http.MethodGet, s.getSnapshotStatus)
+	s.handle("inspect_keys", http.MethodGet, s.inspectKeys)
+	s.handle("clusters", http.MethodGet, s.listClusters)
+	s.handle("set_cluster_labels", http.MethodPost, s.setClusterLabels)
+	s.handle("rename_cluster", http.MethodPost, s.renameCluster)
+	s.handle("set_cluster_options", http.MethodPost, s.setClusterOptions)
+	s.handle("set_cluster_maintenance", http.MethodPost, s.setClusterMaintenance)
+	s.handle("pending_reconciles", http.MethodGet, s.listPendingReconciles)
+	s.handle("failed_procedures", http.MethodGet, s.listFailedProcedures)
+	s.handle("members", http.MethodGet, s.listMembers)
+	s.handle("promote_observer", http.MethodPost, s.promoteObserver)
+	s.handle("acquire_restart_token", http.MethodPost, s.acquireRestartToken)
+	s.handle("release_restart_token", http.MethodPost, s.releaseRestartToken)
+	s.handle("freeze_shard_version", http.MethodPost, s.freezeShardVersion)
+	s.handle("unfreeze_shard_version", http.MethodPost, s.unfreezeShardVersion)
+	s.handle("shard_open_pacing", http.MethodGet, s.getShardOpenPacing)
+	s.handle("set_shard_open_pacing", http.MethodPost, s.setShardOpenPacing)
+	s.handle("debug_scopes", http.MethodGet, s.listDebugScopes)
+	s.handle("add_debug_scope", http.MethodPost, s.addDebugScope)
+	s.handle("remove_debug_scope", http.MethodPost, s.removeDebugScope)
+	return s
+}
+
+// ServeHTTP serves the request if it presents the admin token.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, bearerPrefix)
+	if len(token) == len(auth) || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		writeError(w, ErrAuthFailed.WithCausef("admin token mismatched"), nil)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handlerFunc serves the request, and the returned response is encoded as json. The response returned along with the
+// error is encoded as the detail of the error.
+type handlerFunc func(r *http.Request) (any, error)
+
+func (s *Service) handle(path, method string, fn handlerFunc) {
+	s.mux.HandleFunc(APIPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, ErrMethodNotAllowed.WithCausef("method:%s, expect:%s", r.Method, method), nil)
+			return
+		}
+		resp, err := fn(r)
+		if err != nil {
+			log.Warn("fail to serve http request", zap.String("path", r.URL.Path), zap.Error(err))
+			writeError(w, err, resp)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+type swapShardsRequest struct {
+	Cluster string `json:"cluster"`
+	ShardA  uint32 `json:"shard_a"`
+	ShardB  uint32 `json:"shard_b"`
+}
+
+func (s *Service) swapShards(r *http.Request) (any, error) {
+	var req swapShardsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%d,%d", req.ShardA, req.ShardB)
+	err := s.mutate(r, string(cluster.ProcedureSwapShards), req.Cluster, target, func(ctx context.Context) error {
+		return s.h.SwapShards(ctx, req.Cluster, req.ShardA, req.ShardB)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type reassignNodeShardsRequest struct {
+	Cluster  string                    `json:"cluster"`
+	From     string                    `json:"from"`
+	Targets  []string                  `json:"targets"`
+	Strategy schedule.ReassignStrategy `json:"strategy"`
+}
+
+// reassignNodeShards responds the report of the moves, which tells the moves done before the failed one.
+func (s *Service) reassignNodeShards(r *http.Request) (any, error) {
+	var req reassignNodeShardsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var report *cluster.ShardReassignReport
+	err := s.mutate(r, string(cluster.ProcedureReassignShards), req.Cluster, req.From, func(ctx context.Context) error {
+		var err error
+		report, err = s.h.ReassignNodeShards(ctx, req.Cluster, req.From, req.Targets, req.Strategy)
+		return err
+	})
+	if report == nil {
+		return nil, err
+	}
+	return report, err
+}
+
+type unassignedShardsResponse struct {
+	ShardIDs []uint32 `json:"shard_ids"`
+}
+
+// listUnassignedShards is served only by the leader, because the followers receive no heartbeats and would see every
+// shard unassigned.
+func (s *Service) listUnassignedShards(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "list unassigned shards"); err != nil {
+		return nil, err
+	}
+	shardIDs, err := s.h.GetClusterManager().ListUnassignedShards(r.Context(), r.URL.Query().Get("cluster"))
+	if err != nil {
+		return nil, err
+	}
+	return unassignedShardsResponse{ShardIDs: shardIDs}, nil
+}
+
+type assignShardRequest struct {
+	Cluster string `json:"cluster"`
+	ShardID uint32 `json:"shard_id"`
+	Node    string `json:"node"`
+}
+
+func (s *Service) assignShard(r *http.Request) (any, error) {
+	var req assignShardRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%d", req.ShardID)
+	err := s.mutate(r, "assign_shard", req.Cluster, target, func(ctx context.Context) error {
+		return s.h.AssignShard(ctx, req.Cluster, req.ShardID, req.Node)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// getNodeSnapshot is served by the followers as well unless they lag behind the leader too much.
+func (s *Service) getNodeSnapshot(r *http.Request) (any, error) {
+	if err := s.h.CheckReadable(); err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	return s.h.GetNodeSnapshot(r.Context(), query.Get("cluster"), query.Get("node"))
+}
+
+type shardResponse struct {
+	ShardID    uint32 `json:"shard_id"`
+	Version    uint64 `json:"version"`
+	Node       string `json:"node"`
+	TableCount int    `json:"table_count"`
+	// LastOwnerChange tells why the shard moved to its owner, and it is null if the owner has never changed.
+	LastOwnerChange *cluster.ShardOwnerChange `json:"last_owner_change"`
+}
+
+// getShard tells the detail of the shard including the reason of its last ownership change, and it is served by the
+// followers as well unless they lag behind the leader too much.
+func (s *Service) getShard(r *http.Request) (any, error) {
+	if err := s.h.CheckReadable(); err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	clusterName := query.Get("cluster")
+	shardID, err := strconv.ParseUint(query.Get("shard_id"), 10, 32)
+	if err != nil {
+		return nil, ErrInvalidRequest.WithCausef("invalid shard id, err:%v", err)
+	}
+
+	manager := s.h.GetClusterManager()
+	shardTables, err := manager.GetShardTables(r.Context(), clusterName, []uint32{uint32(shardID)})
+	if err != nil {
+		return nil, err
+	}
+	change, err := manager.GetShardOwnerChange(r.Context(), clusterName, uint32(shardID))
+	if err != nil {
+		return nil, err
+	}
+	tables := shardTables[uint32(shardID)]
+	return shardResponse{
+		ShardID:         uint32(shardID),
+		Version:         tables.Version,
+		Node:            tables.Node,
+		TableCount:      len(tables.Tables),
+		LastOwnerChange: change,
+	}, nil
+}
+
+// getTopology responds the assembled topology of the cluster, or only its version if it equals to the if_version_not
+// parameter. It is served only by the leader, because the followers tell no alive node.
+func (s *Service) getTopology(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "get_topology"); err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	var ifVersionNot uint64
+	if value := query.Get("if_version_not"); value != "" {
+		var err error
+		if ifVersionNot, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, ErrInvalidRequest.WithCausef("invalid if_version_not, err:%v", err)
+		}
+	}
+	return s.h.GetClusterManager().GetTopology(r.Context(), query.Get("cluster"), ifVersionNot)
+}
+
+// getHotSpots tells the busiest tables and shards counted by the server itself, which counts the route lookups and the
+// DDLs it serves. The top_n parameter is required.
+func (s *Service) getHotSpots(r *http.Request) (any, error) {
+	query := r.URL.Query()
+	topN, err := strconv.Atoi(query.Get("top_n"))
+	if err != nil || topN <= 0 {
+		return nil, ErrInvalidRequest.WithCausef("invalid top_n:%s", query.Get("top_n"))
+	}
+	return s.h.GetClusterManager().HotSpots(r.Context(), query.Get("cluster"), topN)
+}
+
+// explainTablePlacement explains why the table is placed on its shard and node, and it is served by the followers as
+// well unless they lag behind the leader too much.
+func (s *Service) explainTablePlacement(r *http.Request) (any, error) {
+	if err := s.h.CheckReadable(); err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	tableID, err := strconv.ParseUint(query.Get("table_id"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidRequest.WithCausef("invalid table id, err:%v", err)
+	}
+	return s.h.GetClusterManager().ExplainTablePlacement(r.Context(), query.Get("cluster"), tableID)
+}
+
+type createSchemaRequest struct {
+	Cluster string `json:"cluster"`
+	Schema  string `json:"schema"`
+	// ShardCountHint is the number of the shards the tables of the schema are spread over, and zero means all the
+	// shards of the cluster.
+	ShardCountHint uint32 `json:"shard_count_hint"`
+}
+
+type createSchemaResponse struct {
+	ID uint32 `json:"id"`
+}
+
+// createSchema responds the id of the schema, and the hint of the schema already existing isn't changed.
+func (s *Service) createSchema(r *http.Request) (any, error) {
+	var req createSchemaRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var schema *cluster.Schema
+	err := s.mutate(r, string(cluster.ProcedureCreateSchema), req.Cluster, req.Schema, func(ctx context.Context) error {
+		var err error
+		schema, err = s.h.GetClusterManager().CreateSchema(ctx, req.Cluster, req.Schema, req.ShardCountHint)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return createSchemaResponse{ID: schema.GetID()}, nil
+}
+
+// getSchemaStats tells how the tables of the schema are spread over its shards, and it is served by the followers as
+// well unless they lag behind the leader too much.
+func (s *Service) getSchemaStats(r *http.Request) (any, error) {
+	if err := s.h.CheckReadable(); err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	return s.h.GetClusterManager().GetSchemaStats(r.Context(), query.Get("cluster"), query.Get("schema"))
+}
+
+type alterTableRequest struct {
+	Cluster string `json:"cluster"`
+	Schema  string `json:"schema"`
+	Table   string `json:"table"`
+	// ExpectedSchemaVersion must be the current version of the table schema, so that the concurrent alters conflict.
+	ExpectedSchemaVersion uint64 `json:"expected_schema_version"`
+	// EncodedSchema is the new schema encoded by the ceresdb, which is base64 in the json.
+	EncodedSchema []byte `json:"encoded_schema"`
+}
+
+type alterTableResponse struct {
+	ID            uint64 `json:"id"`
+	SchemaVersion uint64 `json:"schema_version"`
+}
+
+// alterTable responds the bumped version of the table schema, and the alter should be applied by the ceresdb owning
+// the table only after it succeeds.
+func (s *Service) alterTable(r *http.Request) (any, error) {
+	var req alterTableRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var table *cluster.Table
+	target := fmt.Sprintf("%s.%s", req.Schema, req.Table)
+	err := s.mutate(r, string(cluster.ProcedureAlterTable), req.Cluster, target, func(ctx context.Context) error {
+		var err error
+		table, err = s.h.GetClusterManager().AlterTable(ctx, req.Cluster, req.Schema, req.Table,
+			req.ExpectedSchemaVersion, req.EncodedSchema)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alterTableResponse{ID: table.GetID(), SchemaVersion: table.GetSchemaVersion()}, nil
+}
+
+type reserveTableNameRequest struct {
+	Cluster string `json:"cluster"`
+	Schema  string `json:"schema"`
+	Table   string `json:"table"`
+	TTLMs   int64  `json:"ttl_ms"`
+}
+
+type reserveTableNameResponse struct {
+	Token      string `json:"token"`
+	ExpireAtMs int64  `json:"expire_at_ms"`
+}
+
+// reserveTableName responds the token, which the creation of the table carries to take the reserved name and the
+// release provides.
+func (s *Service) reserveTableName(r *http.Request) (any, error) {
+	var req reserveTableNameRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var reservation *cluster.TableNameReservation
+	target := fmt.Sprintf("%s.%s", req.Schema, req.Table)
+	err := s.mutate(r, "reserve_table_name", req.Cluster, target, func(ctx context.Context) error {
+		var err error
+		reservation, err = s.h.GetClusterManager().ReserveTableName(ctx, req.Cluster, req.Schema, req.Table,
+			time.Duration(req.TTLMs)*time.Millisecond)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reserveTableNameResponse{Token: reservation.Token, ExpireAtMs: reservation.ExpireAt.UnixMilli()}, nil
+}
+
+type releaseTableNameRequest struct {
+	Cluster string `json:"cluster"`
+	Schema  string `json:"schema"`
+	Table   string `json:"table"`
+	Token   string `json:"token"`
+}
+
+func (s *Service) releaseTableName(r *http.Request) (any, error) {
+	var req releaseTableNameRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s.%s", req.Schema, req.Table)
+	err := s.mutate(r, "release_table_name", req.Cluster, target, func(ctx context.Context) error {
+		return s.h.GetClusterManager().ReleaseTableName(ctx, req.Cluster, req.Schema, req.Table, req.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// getProcedureConcurrency tells the procedures run by the server itself, which are the ones of the requests it serves.
+func (s *Service) getProcedureConcurrency(r *http.Request) (any, error) {
+	return s.h.ProcedureConcurrency(r.Context()), nil
+}
+
+type blockedProceduresResponse struct {
+	Procedures []procedure.BlockedProcedure `json:"procedures"`
+}
+
+func (s *Service) listBlockedProcedures(r *http.Request) (any, error) {
+	procedures, err := s.h.ListBlockedProcedures(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	return blockedProceduresResponse{Procedures: procedures}, nil
+}
+
+type procedureResponse struct {
+	*procedure.Procedure
+	// Failures are the failures of the procedure along with the compensations taken for them, which are only known by
+	// the leader.
+	Failures []cluster.FailedProcedure `json:"failures,omitempty"`
+}
+
+// getProcedure responds the procedure along with its failures if it is finished.
+func (s *Service) getProcedure(r *http.Request) (any, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidRequest.WithCausef("invalid procedure id, err:%v", err)
+	}
+	p, err := s.h.GetProcedure(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if p.FinishedAt == nil {
+		return procedureResponse{Procedure: p}, nil
+	}
+	failed, err := s.h.GetClusterManager().ListFailedProcedures(r.Context(), p.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return procedureResponse{Procedure: p, Failures: matchFailedProcedures(p, failed)}, nil
+}
+
+// matchFailedProcedures returns the failed procedures recorded by the finished procedure, which are of its type and
+// target and fail while it runs. The target of the failed one may carry the id of the table besides its name.
+func matchFailedProcedures(p *procedure.Procedure, failed []cluster.FailedProcedure) []cluster.FailedProcedure {
+	var matched []cluster.FailedProcedure
+	for _, f := range failed {
+		if string(f.Type) != p.Type || (f.Target != p.Target && !strings.HasPrefix(f.Target, p.Target+"(")) {
+			continue
+		}
+		if f.FailedAt.Before(p.StartedAt) || f.FailedAt.After(*p.FinishedAt) {
+			continue
+		}
+		matched = append(matched, f)
+	}
+	return matched
+}
+
+// getReadStaleness tells the lag of the server itself, which decides whether it serves the reads as a follower.
+func (s *Service) getReadStaleness(_ *http.Request) (any, error) {
+	return s.h.GetReadStaleness(), nil
+}
+
+// getEtcdSpaceStatus tells whether the server is read-only because the etcd space quota is exceeded.
+func (s *Service) getEtcdSpaceStatus(_ *http.Request) (any, error) {
+	return s.h.GetEtcdSpaceStatus(), nil
+}
+
+type snapshotStatusResponse struct {
+	Clusters map[string]backup.Status `json:"clusters"`
+}
+
+// getSnapshotStatus tells the snapshots taken by the server itself, which takes them only while it is the leader.
+func (s *Service) getSnapshotStatus(_ *http.Request) (any, error) {
+	return snapshotStatusResponse{Clusters: s.h.GetSnapshotStatus()}, nil
+}
+
+// inspectKeys renders the values of the known protobuf kinds if the decode parameter is true, and the limit parameter
+// is required.
+func (s *Service) inspectKeys(r *http.Request) (any, error) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil {
+		return nil, ErrInvalidRequest.WithCausef("invalid limit, err:%v", err)
+	}
+	decode := false
+	if value := query.Get("decode"); value != "" {
+		if decode, err = strconv.ParseBool(value); err != nil {
+			return nil, ErrInvalidRequest.WithCausef("invalid decode, err:%v", err)
+		}
+	}
+	return s.h.InspectKeys(r.Context(), query.Get("prefix"), decode, limit)
+}
+
+type clustersResponse struct {
+	Clusters []cluster.ClusterSummary `json:"clusters"`
+}
+
+func (s *Service) listClusters(r *http.Request) (any, error) {
+	return clustersResponse{Clusters: s.h.GetClusterManager().ListClusterSummaries(r.Context())}, nil
+}
+
+type setClusterLabelsRequest struct {
+	Cluster string                `json:"cluster"`
+	Labels  cluster.ClusterLabels `json:"labels"`
+}
+
+// setClusterLabels replaces the labels of the cluster as a whole, and the audit record carries the new environment.
+func (s *Service) setClusterLabels(r *http.Request) (any, error) {
+	var req setClusterLabelsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := s.mutate(r, "set_cluster_labels", req.Cluster, req.Cluster, func(ctx context.Context) error {
+		return s.h.GetClusterManager().SetClusterLabels(ctx, req.Cluster, req.Labels)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type renameClusterRequest struct {
+	Cluster string `json:"cluster"`
+	NewName string `json:"new_name"`
+	// GracePeriodMs is how long the old name is still accepted, and zero rejects it at once.
+	GracePeriodMs int64 `json:"grace_period_ms"`
+}
+
+// renameCluster is audited under the old name, and the audit record carries the new one.
+func (s *Service) renameCluster(r *http.Request) (any, error) {
+	var req renameClusterRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := s.mutate(r, "rename_cluster", req.Cluster, req.NewName, func(ctx context.Context) error {
+		return s.h.GetClusterManager().RenameCluster(ctx, req.Cluster, req.NewName,
+			time.Duration(req.GracePeriodMs)*time.Millisecond)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// setClusterOptionsRequest carries the options to change, and the absent ones are kept.
+type setClusterOptionsRequest struct {
+	Cluster                       string                              `json:"cluster"`
+	ShardUnavailablePolicy        *cluster.ShardUnavailablePolicy     `json:"shard_unavailable_policy,omitempty"`
+	ShardUnavailableWaitTimeoutMs *uint64                             `json:"shard_unavailable_wait_timeout_ms,omitempty"`
+	MinHealthyNodes               *uint32                             `json:"min_healthy_nodes,omitempty"`
+	MinHealthyNodeRatio           *float64                            `json:"min_healthy_node_ratio,omitempty"`
+	GapFreeTableID                *bool                               `json:"gap_free_table_id,omitempty"`
+	MaxTopologyGenerationLag      *uint64                             `json:"max_topology_generation_lag,omitempty"`
+	MaxNodeExpiryRatio            *float64                            `json:"max_node_expiry_ratio,omitempty"`
+	ShardVersionPolicy            *cluster.ShardVersionPolicy         `json:"shard_version_policy,omitempty"`
+	ShardTopologyWarnBytes        *int                                `json:"shard_topology_warn_bytes,omitempty"`
+	MaxShardTopologyBytes         *int                                `json:"max_shard_topology_bytes,omitempty"`
+	DecisionSeed                  *int64                              `json:"decision_seed,omitempty"`
+	AutoCreateSchema              *bool                               `json:"auto_create_schema,omitempty"`
+	CreatePersistFailurePolicy    *cluster.CreatePersistFailurePolicy `json:"create_persist_failure_policy,omitempty"`
+}
+
+func (req *setClusterOptionsRequest) merge(opts *cluster.Options) {
+	if req.ShardUnavailablePolicy != nil {
+		opts.ShardUnavailablePolicy = *req.ShardUnavailablePolicy
+	}
+	if req.ShardUnavailableWaitTimeoutMs != nil {
+		opts.ShardUnavailableWaitTimeoutMs = *req.ShardUnavailableWaitTimeoutMs
+	}
+	if req.MinHealthyNodes != nil {
+		opts.MinHealthyNodes = *req.MinHealthyNodes
+	}
+	if req.MinHealthyNodeRatio != nil {
+		opts.MinHealthyNodeRatio = *req.MinHealthyNodeRatio
+	}
+	if req.GapFreeTableID != nil {
+		opts.GapFreeTableID = *req.GapFreeTableID
+	}
+	if req.MaxTopologyGenerationLag != nil {
+		opts.MaxTopologyGenerationLag = *req.MaxTopologyGenerationLag
+	}
+	if req.MaxNodeExpiryRatio != nil {
+		opts.MaxNodeExpiryRatio = *req.MaxNodeExpiryRatio
+	}
+	if req.ShardVersionPolicy != nil {
+		opts.ShardVersionPolicy = *req.ShardVersionPolicy
+	}
+	if req.ShardTopologyWarnBytes != nil {
+		opts.ShardTopologyWarnBytes = *req.ShardTopologyWarnBytes
+	}
+	if req.MaxShardTopologyBytes != nil {
+		opts.MaxShardTopologyBytes = *req.MaxShardTopologyBytes
+	}
+	if req.DecisionSeed != nil {
+		opts.DecisionSeed = *req.DecisionSeed
+	}
+	if req.AutoCreateSchema != nil {
+		opts.AutoCreateSchema = *req.AutoCreateSchema
+	}
+	if req.CreatePersistFailurePolicy != nil {
+		opts.CreatePersistFailurePolicy = *req.CreatePersistFailurePolicy
+	}
+}
+
+// setClusterOptions merges the given options into the current ones instead of replacing them as a whole, so that the
+// options not given, e.g. the initial shard assignment, are kept. It responds the updated options, and the audit record
+// carries the given ones.
+func (s *Service) setClusterOptions(r *http.Request) (any, error) {
+	var req setClusterOptionsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+	target, err := json.Marshal(req)
+	if err != nil {
+		return nil, ErrInvalidRequest.WithCause(err)
+	}
+
+	var opts cluster.Options
+	err = s.mutate(r, "set_cluster_options", req.Cluster, string(target), func(ctx context.Context) error {
+		var err error
+		opts, err = s.h.GetClusterManager().UpdateClusterOptions(ctx, req.Cluster, req.merge)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+type setClusterMaintenanceRequest struct {
+	Cluster string `json:"cluster"`
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason"`
+}
+
+// setClusterMaintenance enters or leaves the maintenance mode of the cluster, and the audit record carries the mode
+// along with the reason.
+func (s *Service) setClusterMaintenance(r *http.Request) (any, error) {
+	var req setClusterMaintenanceRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("enabled:%t, reason:%s", req.Enabled, req.Reason)
+	err := s.mutate(r, "set_cluster_maintenance", req.Cluster, target, func(ctx context.Context) error {
+		return s.h.GetClusterManager().SetClusterMaintenance(ctx, req.Cluster, req.Enabled, req.Reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type pendingReconcilesResponse struct {
+	Reconciles []cluster.PendingReconcile `json:"reconciles"`
+}
+
+// listPendingReconciles is served only by the leader, which retries the reconciles and knows their latest failures.
+func (s *Service) listPendingReconciles(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "list_pending_reconciles"); err != nil {
+		return nil, err
+	}
+	reconciles, err := s.h.GetClusterManager().ListPendingReconciles(r.Context(), r.URL.Query().Get("cluster"))
+	if err != nil {
+		return nil, err
+	}
+	return pendingReconcilesResponse{Reconciles: reconciles}, nil
+}
+
+type failedProceduresResponse struct {
+	Procedures []cluster.FailedProcedure `json:"procedures"`
+}
+
+// listFailedProcedures lists the latest failed procedures of the cluster from the oldest along with their
+// compensations, and it is served only by the leader, which runs the procedures and keeps them in memory.
+func (s *Service) listFailedProcedures(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "list_failed_procedures"); err != nil {
+		return nil, err
+	}
+	procedures, err := s.h.GetClusterManager().ListFailedProcedures(r.Context(), r.URL.Query().Get("cluster"))
+	if err != nil {
+		return nil, err
+	}
+	return failedProceduresResponse{Procedures: procedures}, nil
+}
+
+// listMembers tells the health of the members and the leader, and it is served by any member.
+func (s *Service) listMembers(r *http.Request) (any, error) {
+	return s.h.ListMembers(r.Context())
+}
+
+type promoteObserverRequest struct {
+	ObserverID     uint64 `json:"observer_id"`
+	ReplaceVoterID uint64 `json:"replace_voter_id"`
+}
+
+// promoteObserver is served only by the leader like the automatic promotion, so that they never race. It is served even
+// if the etcd space quota is exceeded, because the membership change writes no keys and it may be needed to recover
+// the etcd cluster.
+func (s *Service) promoteObserver(r *http.Request) (any, error) {
+	var req promoteObserverRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var promotion *member.ObserverPromotion
+	err := s.runOnLeader(r, "promote_observer", "", strconv.FormatUint(req.ObserverID, 10), func(ctx context.Context) error {
+		var err error
+		promotion, err = s.h.PromoteObserver(ctx, req.ObserverID, req.ReplaceVoterID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promotion, nil
+}
+
+type acquireRestartTokenRequest struct {
+	Cluster string `json:"cluster"`
+	Node    string `json:"node"`
+	// TTLMs is how long the token lasts unless it is released, and the default ttl is used if it is zero.
+	TTLMs int64 `json:"ttl_ms"`
+}
+
+// acquireRestartToken responds the decision, which explains the blocking shards if the token is not granted. The
+// tokens are only kept by the leader, which tells the dead nodes by the heartbeats.
+func (s *Service) acquireRestartToken(r *http.Request) (any, error) {
+	var req acquireRestartTokenRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var decision *cluster.RestartDecision
+	err := s.runOnLeader(r, "acquire_restart_token", req.Cluster, req.Node, func(ctx context.Context) error {
+		var err error
+		decision, err = s.h.GetClusterManager().AcquireRestartToken(ctx, req.Cluster, req.Node,
+			time.Duration(req.TTLMs)*time.Millisecond)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+type releaseRestartTokenRequest struct {
+	Cluster string `json:"cluster"`
+	Node    string `json:"node"`
+	Token   string `json:"token"`
+}
+
+func (s *Service) releaseRestartToken(r *http.Request) (any, error) {
+	var req releaseRestartTokenRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := s.runOnLeader(r, "release_restart_token", req.Cluster, req.Node, func(ctx context.Context) error {
+		return s.h.GetClusterManager().ReleaseRestartToken(ctx, req.Cluster, req.Node, req.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type freezeShardVersionRequest struct {
+	Cluster string `json:"cluster"`
+	ShardID uint32 `json:"shard_id"`
+}
+
+type freezeShardVersionResponse struct {
+	Token string `json:"token"`
+}
+
+// freezeShardVersion responds the token, which is provided by the operations allowed to bump the version of the frozen
+// shard and by the unfreeze. The freezes are only kept by the leader, which runs the operations bumping the versions.
+func (s *Service) freezeShardVersion(r *http.Request) (any, error) {
+	var req freezeShardVersionRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	var token string
+	target := strconv.FormatUint(uint64(req.ShardID), 10)
+	err := s.runOnLeader(r, "freeze_shard_version", req.Cluster, target, func(ctx context.Context) error {
+		var err error
+		token, err = s.h.GetClusterManager().FreezeShardVersion(ctx, req.Cluster, req.ShardID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return freezeShardVersionResponse{Token: token}, nil
+}
+
+type unfreezeShardVersionRequest struct {
+	Cluster string `json:"cluster"`
+	Token   string `json:"token"`
+}
+
+// unfreezeShardVersion releases the freeze before it expires, and the token is not audited because it allows bumping
+// the version of the frozen shard.
+func (s *Service) unfreezeShardVersion(r *http.Request) (any, error) {
+	var req unfreezeShardVersionRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := s.runOnLeader(r, "unfreeze_shard_version", req.Cluster, "", func(ctx context.Context) error {
+		return s.h.GetClusterManager().UnfreezeShardVersion(ctx, req.Cluster, req.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type shardOpenPacing struct {
+	BatchSize    int   `json:"batch_size"`
+	MaxInFlight  int   `json:"max_in_flight"`
+	AckTimeoutMs int64 `json:"ack_timeout_ms"`
+}
+
+// getShardOpenPacing is served only by the leader, because the pacing of the followers is never used and may differ.
+func (s *Service) getShardOpenPacing(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "get_shard_open_pacing"); err != nil {
+		return nil, err
+	}
+	pacing := s.h.GetShardOpenPacing(r.Context())
+	return shardOpenPacing{
+		BatchSize:    pacing.BatchSize,
+		MaxInFlight:  pacing.MaxInFlight,
+		AckTimeoutMs: pacing.AckTimeout.Milliseconds(),
+	}, nil
+}
+
+// setShardOpenPacing writes nothing to the storage, so it isn't rejected when the etcd space quota is exceeded.
+func (s *Service) setShardOpenPacing(r *http.Request) (any, error) {
+	var req shardOpenPacing
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	pacing := schedule.ShardOpenPacing{
+		BatchSize:   req.BatchSize,
+		MaxInFlight: req.MaxInFlight,
+		AckTimeout:  time.Duration(req.AckTimeoutMs) * time.Millisecond,
+	}
+	err := s.runOnLeader(r, "set_shard_open_pacing", "", fmt.Sprintf("%+v", pacing), func(ctx context.Context) error {
+		return s.h.SetShardOpenPacing(ctx, pacing)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+type debugScopesResponse struct {
+	Scopes []log.DebugScope `json:"scopes"`
+}
+
+// listDebugScopes is served only by the leader like the other debug scope apis, because the scoped debug logs are
+// written by the heartbeats and the table placements handled by the leader.
+func (s *Service) listDebugScopes(r *http.Request) (any, error) {
+	if err := s.checkLeader(r.Context(), "list_debug_scopes"); err != nil {
+		return nil, err
+	}
+	return debugScopesResponse{Scopes: s.h.ListDebugScopes(r.Context())}, nil
+}
+
+type addDebugScopeRequest struct {
+	Cluster     string  `json:"cluster"`
+	ShardID     *uint32 `json:"shard_id"`
+	TablePrefix string  `json:"table_prefix"`
+	// RatePerSec is the max number of the logs written per second, and the default rate is used if it is zero.
+	RatePerSec float64 `json:"rate_per_sec"`
+	TTLMs      int64   `json:"ttl_ms"`
+}
+
+// addDebugScope responds the added scope along with its id, by which it can be removed before it expires. The scope is
+// kept in the memory of the leader and lost when the leadership changes.
+func (s *Service) addDebugScope(r *http.Request) (any, error) {
+	var req addDebugScopeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	shard := "any"
+	if req.ShardID != nil {
+		shard = strconv.FormatUint(uint64(*req.ShardID), 10)
+	}
+	ttl := time.Duration(req.TTLMs) * time.Millisecond
+	target := fmt.Sprintf("shard:%s, table prefix:%s, ttl:%s", shard, req.TablePrefix, ttl)
+
+	var added log.DebugScope
+	err := s.runOnLeader(r, "add_debug_scope", req.Cluster, target, func(ctx context.Context) error {
+		var err error
+		added, err = s.h.AddDebugScope(ctx, log.DebugScope{
+			Cluster:     req.Cluster,
+			ShardID:     req.ShardID,
+			TablePrefix: req.TablePrefix,
+			RatePerSec:  req.RatePerSec,
+		}, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+type removeDebugScopeRequest struct {
+	ID uint64 `json:"id"`
+}
+
+func (s *Service) removeDebugScope(r *http.Request) (any, error) {
+	var req removeDebugScopeRequest
+	if err := decodeRequest(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := s.runOnLeader(r, "remove_debug_scope", "", strconv.FormatUint(req.ID, 10), func(ctx context.Context) error {
+		return s.h.RemoveDebugScope(ctx, req.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, nil
+}
+
+// checkLeader returns ErrNotLeader if the server is not the leader.
+func (s *Service) checkLeader(ctx context.Context, operation string) error {
+	if !s.h.IsLeader(ctx) {
+		return ErrNotLeader.WithCausef("operation:%s", operation)
+	}
+	return nil
+}
+
+// mutate runs the operation writing the storage by the runOnLeader, and it is rejected if the server is read-only.
+func (s *Service) mutate(r *http.Request, operation, clusterName, target string, fn func(ctx context.Context) error) error {
+	if err := s.h.CheckWritable(); err != nil {
+		s.audit(r, operation, clusterName, target, err)
+		return err
+	}
+	return s.runOnLeader(r, operation, clusterName, target, fn)
+}
+
+// runOnLeader runs the mutating operation only if the server is the leader, and the operation is audited including the
+// rejected one.
+func (s *Service) runOnLeader(r *http.Request, operation, clusterName, target string, fn func(ctx context.Context) error) error {
+	err := s.checkLeader(r.Context(), operation)
+	if err == nil {
+		err = fn(r.Context())
+	}
+	s.audit(r, operation, clusterName, target, err)
+	return err
+}
+
+func (s *Service) audit(r *http.Request, operation, clusterName, target string, opErr error) {
+	auditor := s.h.GetAuditor()
+	if auditor == nil {
+		return
+	}
+
+	record := audit.Record{
+		Cluster:   clusterName,
+		Operation: operation,
+		Actor:     auditActor,
+		Peer:      r.RemoteAddr,
+		Target:    target,
+		Result:    audit.ResultSuccess,
+	}
+	// The operation rejected for the unknown cluster is recorded without the environment.
+	if c, err := s.h.GetClusterManager().GetCluster(r.Context(), clusterName); err == nil {
+		record.Environment = c.Environment()
+	}
+	if opErr != nil {
+		record.Result = audit.ResultFailure
+		record.Error = opErr.Error()
+	}
+	auditor.Log(record)
+}
+
+// decodeRequest decodes the json body of the request into the req, and the unknown fields are rejected so that the
+// misspelled ones are not ignored silently.
+func decodeRequest(r *http.Request, req any) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		return ErrInvalidRequest.WithCause(err)
+	}
+	return nil
+}
+
+type errorResponse struct {
+	Code   coderr.Code `json:"code"`
+	Error  string      `json:"error"`
+	Detail any         `json:"detail,omitempty"`
+}
+
+// writeError responds the err with the status converted from the code of the CodeError if the cause of the err is a
+// CodeError.
+func writeError(w http.ResponseWriter, err error, detail any) {
+	code, ok := coderr.GetCauseCode(err)
+	if !ok {
+		code = coderr.Internal
+	}
+	writeJSON(w, code.ToHTTPCode(), errorResponse{Code: code, Error: err.Error(), Detail: detail})
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warn("fail to write http response", zap.Error(err))
+	}
+}
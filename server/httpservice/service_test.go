@@ -0,0 +1,615 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package httpservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/CeresDB/ceresmeta/server/backup"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/CeresDB/ceresmeta/server/member"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "token"
+
+// fakeHandler records the swaps and the assignments it is asked for, and fails every reassignment after the first move.
+type fakeHandler struct {
+	leader      bool
+	swaps       [][2]uint32
+	assignments map[uint32]string
+	pacing      schedule.ShardOpenPacing
+	scopes      []log.DebugScope
+}
+
+func (h *fakeHandler) IsLeader(_ context.Context) bool {
+	return h.leader
+}
+
+func (h *fakeHandler) CheckWritable() error {
+	return nil
+}
+
+func (h *fakeHandler) CheckReadable() error {
+	return nil
+}
+
+func (h *fakeHandler) GetClusterManager() cluster.Manager {
+	return nil
+}
+
+func (h *fakeHandler) GetAuditor() *audit.Logger {
+	return nil
+}
+
+func (h *fakeHandler) SwapShards(_ context.Context, _ string, shardA, shardB uint32) error {
+	h.swaps = append(h.swaps, [2]uint32{shardA, shardB})
+	return nil
+}
+
+func (h *fakeHandler) ReassignNodeShards(_ context.Context, _, from string, targets []string,
+	strategy schedule.ReassignStrategy,
+) (*cluster.ShardReassignReport, error) {
+	report := &cluster.ShardReassignReport{
+		From:     from,
+		Targets:  targets,
+		Strategy: strategy,
+		Moves: []cluster.ShardMoveResult{
+			{ShardID: 1, State: cluster.ShardMoveDone},
+			{ShardID: 2, State: cluster.ShardMoveFailed},
+		},
+	}
+	return report, cluster.ErrNodeNotAlive.WithCausef("node:%s", targets[0])
+}
+
+func (h *fakeHandler) AssignShard(_ context.Context, _ string, shardID uint32, node string) error {
+	if h.assignments == nil {
+		h.assignments = make(map[uint32]string)
+	}
+	h.assignments[shardID] = node
+	return nil
+}
+
+func (h *fakeHandler) GetNodeSnapshot(_ context.Context, clusterName, nodeName string) (*cluster.NodeSnapshot, error) {
+	return &cluster.NodeSnapshot{ClusterName: clusterName, Node: nodeName, Shards: []cluster.NodeShardView{{ID: 1}}}, nil
+}
+
+func (h *fakeHandler) ProcedureConcurrency(_ context.Context) schedule.ProcedureConcurrency {
+	return schedule.ProcedureConcurrency{Limit: 4, Running: 4, Queued: 1}
+}
+
+func (h *fakeHandler) ListBlockedProcedures(_ context.Context) ([]procedure.BlockedProcedure, error) {
+	return []procedure.BlockedProcedure{{ID: 1, Type: "create_table", Reason: procedure.WaitClusterLock}}, nil
+}
+
+func (h *fakeHandler) GetProcedure(_ context.Context, id uint64) (*procedure.Procedure, error) {
+	if id != 1 {
+		return nil, coderr.NewCodeError(coderr.NotFound, "procedure not found")
+	}
+	return &procedure.Procedure{ID: id, Type: "create_table"}, nil
+}
+
+func (h *fakeHandler) GetReadStaleness() etcdutil.StalenessStatus {
+	return etcdutil.StalenessStatus{AppliedRevision: 8, LeaderRevision: 10, Lag: 2}
+}
+
+func (h *fakeHandler) GetEtcdSpaceStatus() etcdutil.SpaceStatus {
+	return etcdutil.SpaceStatus{Exceeded: true, DBSize: 10, Quota: 8}
+}
+
+func (h *fakeHandler) PromoteObserver(_ context.Context, observerID, replaceVoterID uint64) (*member.ObserverPromotion, error) {
+	return &member.ObserverPromotion{
+		Observer: member.EtcdMember{ID: observerID},
+		Replaced: member.EtcdMember{ID: replaceVoterID},
+	}, nil
+}
+
+func (h *fakeHandler) ListMembers(_ context.Context) (*member.Members, error) {
+	return &member.Members{Voters: []member.EtcdMember{{ID: 1, Healthy: true}}, LeaderID: 1}, nil
+}
+
+func (h *fakeHandler) GetSnapshotStatus() map[string]backup.Status {
+	return map[string]backup.Status{"c": {LastSnapshot: "c-1"}}
+}
+
+func (h *fakeHandler) InspectKeys(_ context.Context, prefix string, decode bool, limit int) (*storage.KeyInspection, error) {
+	return &storage.KeyInspection{Keys: []storage.InspectedKey{{Key: prefix, Decoded: decode}}, More: limit == 1}, nil
+}
+
+func (h *fakeHandler) SetShardOpenPacing(_ context.Context, pacing schedule.ShardOpenPacing) error {
+	h.pacing = pacing
+	return nil
+}
+
+func (h *fakeHandler) GetShardOpenPacing(_ context.Context) schedule.ShardOpenPacing {
+	return h.pacing
+}
+
+func (h *fakeHandler) AddDebugScope(_ context.Context, scope log.DebugScope, ttl time.Duration) (log.DebugScope, error) {
+	scope.ID = uint64(len(h.scopes) + 1)
+	scope.ExpireAt = time.Unix(0, 0).Add(ttl).UTC()
+	h.scopes = append(h.scopes, scope)
+	return scope, nil
+}
+
+func (h *fakeHandler) RemoveDebugScope(_ context.Context, id uint64) error {
+	for i, scope := range h.scopes {
+		if scope.ID == id {
+			h.scopes = append(h.scopes[:i], h.scopes[i+1:]...)
+			return nil
+		}
+	}
+	return coderr.NewCodeError(coderr.NotFound, "debug scope not found")
+}
+
+func (h *fakeHandler) ListDebugScopes(_ context.Context) []log.DebugScope {
+	return h.scopes
+}
+
+func serve(s *Service, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, APIPrefix+path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", bearerPrefix+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestSwapShards(t *testing.T) {
+	re := require.New(t)
+
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	body := `{"cluster":"c","shard_a":1,"shard_b":2}`
+
+	re.Equal(http.StatusUnauthorized, serve(s, http.MethodPost, "swap_shards", "", body).Code)
+	re.Equal(http.StatusUnauthorized, serve(s, http.MethodPost, "swap_shards", "wrong", body).Code)
+	re.Equal(http.StatusMethodNotAllowed, serve(s, http.MethodGet, "swap_shards", testAdminToken, body).Code)
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodPost, "swap_shards", testAdminToken, `{"shard":1}`).Code)
+
+	// Only the leader swaps the shards.
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "swap_shards", testAdminToken, body).Code)
+	re.Empty(h.swaps)
+
+	h.leader = true
+	re.Equal(http.StatusOK, serve(s, http.MethodPost, "swap_shards", testAdminToken, body).Code)
+	re.Equal([][2]uint32{{1, 2}}, h.swaps)
+}
+
+func TestReassignNodeShards(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{leader: true})
+	w := serve(s, http.MethodPost, "reassign_node_shards", testAdminToken,
+		`{"cluster":"c","from":"a","targets":["b"],"strategy":"round_robin"}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+
+	// The moves done before the failed one are told by the report.
+	var resp struct {
+		Detail cluster.ShardReassignReport `json:"detail"`
+	}
+	re.NoError(json.NewDecoder(w.Body).Decode(&resp))
+	re.Equal("a", resp.Detail.From)
+	re.Equal(schedule.ReassignRoundRobin, resp.Detail.Strategy)
+	re.Len(resp.Detail.Moves, 2)
+	re.Equal(cluster.ShardMoveDone, resp.Detail.Moves[0].State)
+}
+
+func TestAssignShard(t *testing.T) {
+	re := require.New(t)
+
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	body := `{"cluster":"c","shard_id":3,"node":"a"}`
+
+	// The followers see every shard unassigned, so neither the listing nor the assignment is served by them.
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "unassigned_shards?cluster=c", testAdminToken, "").Code)
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "assign_shard", testAdminToken, body).Code)
+	re.Empty(h.assignments)
+
+	h.leader = true
+	re.Equal(http.StatusOK, serve(s, http.MethodPost, "assign_shard", testAdminToken, body).Code)
+	re.Equal(map[uint32]string{3: "a"}, h.assignments)
+}
+
+func TestGetNodeSnapshot(t *testing.T) {
+	re := require.New(t)
+
+	// The snapshot is served by the followers as well.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "node_snapshot?cluster=c&node=a", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var snapshot cluster.NodeSnapshot
+	re.NoError(json.NewDecoder(w.Body).Decode(&snapshot))
+	re.Equal("c", snapshot.ClusterName)
+	re.Equal("a", snapshot.Node)
+	re.Len(snapshot.Shards, 1)
+}
+
+func TestGetShard(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "shard?cluster=c&shard_id=a", testAdminToken, "").Code)
+}
+
+func TestGetTopology(t *testing.T) {
+	re := require.New(t)
+
+	// The followers tell no alive node, so the topology is served only by the leader.
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "topology?cluster=c", testAdminToken, "").Code)
+	h.leader = true
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "topology?cluster=c&if_version_not=x", testAdminToken, "").Code)
+}
+
+func TestGetHotSpots(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "hot_spots?cluster=c", testAdminToken, "").Code)
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "hot_spots?cluster=c&top_n=0", testAdminToken, "").Code)
+}
+
+func TestGetProcedureConcurrency(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "procedure_concurrency", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var concurrency schedule.ProcedureConcurrency
+	re.NoError(json.NewDecoder(w.Body).Decode(&concurrency))
+	re.Equal(schedule.ProcedureConcurrency{Limit: 4, Running: 4, Queued: 1}, concurrency)
+}
+
+func TestListBlockedProcedures(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "blocked_procedures", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var resp blockedProceduresResponse
+	re.NoError(json.NewDecoder(w.Body).Decode(&resp))
+	re.Len(resp.Procedures, 1)
+	re.Equal(procedure.WaitClusterLock, resp.Procedures[0].Reason)
+}
+
+func TestGetProcedure(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "procedure?id=x", testAdminToken, "").Code)
+	re.Equal(http.StatusNotFound, serve(s, http.MethodGet, "procedure?id=2", testAdminToken, "").Code)
+
+	w := serve(s, http.MethodGet, "procedure?id=1", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+	var p procedure.Procedure
+	re.NoError(json.NewDecoder(w.Body).Decode(&p))
+	re.Equal(uint64(1), p.ID)
+	re.Equal("create_table", p.Type)
+
+	// The failures of the finished procedure are the ones of its type and target failed while it runs.
+	startedAt := time.Now()
+	finishedAt := startedAt.Add(time.Second)
+	p = procedure.Procedure{Type: "create_table", Target: "public.t", StartedAt: startedAt, FinishedAt: &finishedAt}
+	failed := []cluster.FailedProcedure{
+		{Type: cluster.ProcedureCreateTable, Target: "public.t(1)", FailedAt: startedAt.Add(-time.Second)},
+		{Type: cluster.ProcedureCreateTable, Target: "public.t(2)", FailedAt: startedAt.Add(time.Millisecond)},
+		{Type: cluster.ProcedureCreateTable, Target: "public.t2(3)", FailedAt: startedAt.Add(time.Millisecond)},
+		{Type: cluster.ProcedureDropTable, Target: "public.t", FailedAt: startedAt.Add(time.Millisecond)},
+	}
+	re.Equal(failed[1:2], matchFailedProcedures(&p, failed))
+}
+
+func TestGetReadStaleness(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "read_staleness", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var status etcdutil.StalenessStatus
+	re.NoError(json.NewDecoder(w.Body).Decode(&status))
+	re.Equal(etcdutil.StalenessStatus{AppliedRevision: 8, LeaderRevision: 10, Lag: 2}, status)
+}
+
+func TestGetEtcdSpaceStatus(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "etcd_space", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var status etcdutil.SpaceStatus
+	re.NoError(json.NewDecoder(w.Body).Decode(&status))
+	re.Equal(etcdutil.SpaceStatus{Exceeded: true, DBSize: 10, Quota: 8}, status)
+}
+
+func TestPromoteObserver(t *testing.T) {
+	re := require.New(t)
+
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	body := `{"observer_id":3,"replace_voter_id":1}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "promote_observer", testAdminToken, body).Code)
+
+	h.leader = true
+	w := serve(s, http.MethodPost, "promote_observer", testAdminToken, body)
+	re.Equal(http.StatusOK, w.Code)
+	var promotion member.ObserverPromotion
+	re.NoError(json.NewDecoder(w.Body).Decode(&promotion))
+	re.Equal(uint64(3), promotion.Observer.ID)
+	re.Equal(uint64(1), promotion.Replaced.ID)
+}
+
+func TestRestartToken(t *testing.T) {
+	re := require.New(t)
+
+	// The followers tell no dead node, so they never grant the tokens.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodPost, "acquire_restart_token", testAdminToken, `{"cluster":"c","node":"a","ttl_ms":1000}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "release_restart_token", testAdminToken, `{"cluster":"c","node":"a","token":"t"}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+}
+
+func TestShardVersionFreeze(t *testing.T) {
+	re := require.New(t)
+
+	// The freezes are only kept by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodPost, "freeze_shard_version", testAdminToken, `{"cluster":"c","shard_id":1}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "unfreeze_shard_version", testAdminToken, `{"cluster":"c","token":"t"}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "unfreeze_shard_version", testAdminToken, `{"cluster":"c","shard_id":1}`)
+	re.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestGetSnapshotStatus(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "snapshot_status", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+
+	var resp snapshotStatusResponse
+	re.NoError(json.NewDecoder(w.Body).Decode(&resp))
+	re.Equal("c-1", resp.Clusters["c"].LastSnapshot)
+}
+
+func TestInspectKeys(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "inspect_keys?prefix=v1", testAdminToken, "").Code)
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "inspect_keys?limit=1&decode=x", testAdminToken, "").Code)
+
+	w := serve(s, http.MethodGet, "inspect_keys?prefix=v1&decode=true&limit=1", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+	var inspection storage.KeyInspection
+	re.NoError(json.NewDecoder(w.Body).Decode(&inspection))
+	re.True(inspection.More)
+	re.Equal([]storage.InspectedKey{{Key: "v1", Decoded: true}}, inspection.Keys)
+}
+
+func TestSetClusterLabels(t *testing.T) {
+	re := require.New(t)
+
+	// The labels are persisted only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodPost, "set_cluster_labels", testAdminToken, `{"cluster":"c","labels":{"environment":"prod"}}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "set_cluster_labels", testAdminToken, `{"cluster":"c","labels":{"env":"prod"}}`)
+	re.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestExplainTablePlacement(t *testing.T) {
+	re := require.New(t)
+
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "table_placement?cluster=c&table_id=x", testAdminToken, "")
+	re.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestCreateSchema(t *testing.T) {
+	re := require.New(t)
+
+	// The schema is created only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodPost, "create_schema", testAdminToken, `{"cluster":"c","schema":"s","shard_count_hint":2}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "create_schema", testAdminToken, `{"cluster":"c","schema":"s","shard_count":2}`)
+	re.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAlterTable(t *testing.T) {
+	re := require.New(t)
+
+	// The table is altered only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	body := `{"cluster":"c","schema":"s","table":"t","expected_schema_version":1,"encoded_schema":"AQI="}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "alter_table", testAdminToken, body).Code)
+	body = `{"cluster":"c","schema":"s","table":"t","encoded_schema":"not base64"}`
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodPost, "alter_table", testAdminToken, body).Code)
+}
+
+func TestTableNameReservation(t *testing.T) {
+	re := require.New(t)
+
+	// The names are reserved only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	body := `{"cluster":"c","schema":"s","table":"t","ttl_ms":1000}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "reserve_table_name", testAdminToken, body).Code)
+	body = `{"cluster":"c","schema":"s","table":"t","token":"x"}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "release_table_name", testAdminToken, body).Code)
+	body = `{"cluster":"c","schema":"s","table":"t","ttl":1000}`
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodPost, "reserve_table_name", testAdminToken, body).Code)
+}
+
+func TestRenameCluster(t *testing.T) {
+	re := require.New(t)
+
+	// The cluster is renamed only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	body := `{"cluster":"c","new_name":"d","grace_period_ms":1000}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "rename_cluster", testAdminToken, body).Code)
+	body = `{"cluster":"c","name":"d"}`
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodPost, "rename_cluster", testAdminToken, body).Code)
+}
+
+func TestSetClusterOptions(t *testing.T) {
+	re := require.New(t)
+
+	// The options are changed only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodPost, "set_cluster_options", testAdminToken, `{"cluster":"c","shard_unavailable_policy":"wait"}`)
+	re.Equal(http.StatusServiceUnavailable, w.Code)
+	w = serve(s, http.MethodPost, "set_cluster_options", testAdminToken, `{"cluster":"c","initial_shard_assignment":{}}`)
+	re.Equal(http.StatusBadRequest, w.Code)
+
+	// The options absent from the request are kept.
+	var req setClusterOptionsRequest
+	re.NoError(json.Unmarshal([]byte(`{
+		"cluster": "c",
+		"shard_unavailable_wait_timeout_ms": 300,
+		"min_healthy_nodes": 2,
+		"min_healthy_node_ratio": 0.5,
+		"gap_free_table_id": true,
+		"max_topology_generation_lag": 3,
+		"max_node_expiry_ratio": 0.3,
+		"shard_version_policy": "placement",
+		"shard_topology_warn_bytes": 1024,
+		"max_shard_topology_bytes": 4096,
+		"decision_seed": 42,
+		"auto_create_schema": true,
+		"create_persist_failure_policy": "reconcile"
+	}`), &req))
+	opts := cluster.Options{
+		ShardUnavailablePolicy: cluster.ShardUnavailablePolicyWait,
+		InitialShardAssignment: map[uint32]string{0: "a"},
+	}
+	req.merge(&opts)
+	re.Equal(cluster.Options{
+		ShardUnavailablePolicy:        cluster.ShardUnavailablePolicyWait,
+		ShardUnavailableWaitTimeoutMs: 300,
+		InitialShardAssignment:        map[uint32]string{0: "a"},
+		MinHealthyNodes:               2,
+		MinHealthyNodeRatio:           0.5,
+		GapFreeTableID:                true,
+		MaxTopologyGenerationLag:      3,
+		MaxNodeExpiryRatio:            0.3,
+		ShardVersionPolicy:            cluster.ShardVersionPlacement,
+		ShardTopologyWarnBytes:        1024,
+		MaxShardTopologyBytes:         4096,
+		DecisionSeed:                  42,
+		AutoCreateSchema:              true,
+		CreatePersistFailurePolicy:    cluster.CreatePersistFailureReconcile,
+	}, opts)
+}
+
+func TestSetClusterMaintenance(t *testing.T) {
+	re := require.New(t)
+
+	// The maintenance mode is changed only by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	body := `{"cluster":"c","enabled":true,"reason":"upgrade"}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "set_cluster_maintenance", testAdminToken, body).Code)
+	body = `{"cluster":"c","maintenance":true}`
+	re.Equal(http.StatusBadRequest, serve(s, http.MethodPost, "set_cluster_maintenance", testAdminToken, body).Code)
+}
+
+func TestListPendingReconciles(t *testing.T) {
+	re := require.New(t)
+
+	// The pending reconciles are only known by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "pending_reconciles?cluster=c", testAdminToken, "").Code)
+}
+
+func TestListFailedProcedures(t *testing.T) {
+	re := require.New(t)
+
+	// The failed procedures are only known by the leader.
+	s := NewService(testAdminToken, &fakeHandler{})
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "failed_procedures?cluster=c", testAdminToken, "").Code)
+}
+
+func TestListMembers(t *testing.T) {
+	re := require.New(t)
+
+	// The members are served by any member.
+	s := NewService(testAdminToken, &fakeHandler{})
+	w := serve(s, http.MethodGet, "members", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+	var members member.Members
+	re.NoError(json.Unmarshal(w.Body.Bytes(), &members))
+	re.Equal(uint64(1), members.LeaderID)
+	re.Len(members.Voters, 1)
+	re.True(members.Voters[0].Healthy)
+}
+
+func TestShardOpenPacing(t *testing.T) {
+	re := require.New(t)
+
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	body := `{"batch_size":2,"max_in_flight":4,"ack_timeout_ms":1500}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "set_shard_open_pacing", testAdminToken, body).Code)
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "shard_open_pacing", testAdminToken, "").Code)
+
+	h.leader = true
+	re.Equal(http.StatusOK, serve(s, http.MethodPost, "set_shard_open_pacing", testAdminToken, body).Code)
+	re.Equal(schedule.ShardOpenPacing{BatchSize: 2, MaxInFlight: 4, AckTimeout: 1500 * time.Millisecond}, h.pacing)
+
+	w := serve(s, http.MethodGet, "shard_open_pacing", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+	re.JSONEq(body, w.Body.String())
+}
+
+func TestDebugScopes(t *testing.T) {
+	re := require.New(t)
+
+	h := &fakeHandler{}
+	s := NewService(testAdminToken, h)
+	body := `{"cluster":"c","shard_id":2,"ttl_ms":60000}`
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodPost, "add_debug_scope", testAdminToken, body).Code)
+	re.Equal(http.StatusServiceUnavailable, serve(s, http.MethodGet, "debug_scopes", testAdminToken, "").Code)
+
+	h.leader = true
+	w := serve(s, http.MethodPost, "add_debug_scope", testAdminToken, body)
+	re.Equal(http.StatusOK, w.Code)
+	var added log.DebugScope
+	re.NoError(json.NewDecoder(w.Body).Decode(&added))
+	re.Equal(uint64(1), added.ID)
+	re.Equal("c", added.Cluster)
+	re.Equal(uint32(2), *added.ShardID)
+
+	w = serve(s, http.MethodGet, "debug_scopes", testAdminToken, "")
+	re.Equal(http.StatusOK, w.Code)
+	var resp debugScopesResponse
+	re.NoError(json.NewDecoder(w.Body).Decode(&resp))
+	re.Equal([]log.DebugScope{added}, resp.Scopes)
+
+	re.Equal(http.StatusOK, serve(s, http.MethodPost, "remove_debug_scope", testAdminToken, `{"id":1}`).Code)
+	re.Equal(http.StatusNotFound, serve(s, http.MethodPost, "remove_debug_scope", testAdminToken, `{"id":1}`).Code)
+	re.Empty(h.scopes)
+}
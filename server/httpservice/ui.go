@@ -0,0 +1,23 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package httpservice
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// UIPrefix is the path prefix of the overview page of the clusters, which is served along with the http apis.
+const UIPrefix = "/ceresmeta/ui/"
+
+//go:embed ui
+var uiAssets embed.FS
+
+// NewUIHandler serves the static assets of the overview page. The assets carry nothing of the clusters, so they are
+// served without the admin token, and the page presents the token given by the operator when it reads the http apis.
+func NewUIHandler() http.Handler {
+	// The sub directory of the embedded assets always exists.
+	assets, _ := fs.Sub(uiAssets, "ui")
+	return http.StripPrefix(UIPrefix, http.FileServer(http.FS(assets)))
+}
@@ -0,0 +1,164 @@
+// The overview page of the clusters, which reads the http apis with the admin token given by the operator. The token
+// is kept in the session storage of the browser only.
+"use strict";
+
+const apiPrefix = "/ceresmeta/api/v1/";
+const refreshIntervalMs = 5000;
+const tokenKey = "ceresmeta-admin-token";
+
+async function get(path) {
+  const resp = await fetch(apiPrefix + path, {
+    headers: { Authorization: "Bearer " + (sessionStorage.getItem(tokenKey) || "") },
+  });
+  const body = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    throw new Error(path + ": " + (body.error || resp.statusText));
+  }
+  return body;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function fillTable(table, items, fill) {
+  const body = table.tBodies[0];
+  body.replaceChildren();
+  for (const item of items || []) {
+    fill(body.insertRow(), item);
+  }
+}
+
+function newTable(headers) {
+  const table = document.createElement("table");
+  const head = table.createTHead().insertRow();
+  for (const header of headers) {
+    const th = document.createElement("th");
+    th.textContent = header;
+    head.appendChild(th);
+  }
+  table.createTBody();
+  return table;
+}
+
+function renderMembers(members) {
+  const all = (members.voters || []).concat(members.observers || []);
+  fillTable(document.getElementById("members"), all, (row, m) => {
+    const leader = m.id === members.leader_id;
+    row.className = leader ? "leader" : "";
+    cell(row, m.name);
+    cell(row, m.id);
+    cell(row, m.endpoint);
+    cell(row, leader ? "leader" : m.observer ? "observer" : "voter");
+    cell(row, m.healthy ? "yes" : "no", m.healthy ? "healthy" : "unhealthy");
+    cell(row, m.lag);
+  });
+}
+
+function renderProcedures(concurrency, blocked) {
+  const limit = concurrency.limit === 0 ? "unlimited" : concurrency.limit;
+  document.getElementById("concurrency").textContent =
+    "running: " + concurrency.running + ", queued: " + concurrency.queued + ", limit: " + limit;
+  fillTable(document.getElementById("blocked"), blocked.procedures, (row, p) => {
+    cell(row, p.id);
+    cell(row, p.type);
+    cell(row, p.cluster);
+    cell(row, p.target);
+    cell(row, p.reason + (p.detail ? " (" + p.detail + ")" : ""));
+    cell(row, p.blocked_since);
+  });
+}
+
+// renderCluster renders the topology and the recent failures of the cluster, which are only served by the leader, so
+// the error is shown in place of them on a follower.
+async function renderCluster(summary) {
+  const section = document.createElement("section");
+  const title = document.createElement("h2");
+  title.textContent = "Cluster " + summary.name + " (" + summary.state + ", " + summary.shard_total + " shards)";
+  section.appendChild(title);
+
+  try {
+    const [result, failed] = await Promise.all([
+      get("topology?cluster=" + encodeURIComponent(summary.name)),
+      get("failed_procedures?cluster=" + encodeURIComponent(summary.name)),
+    ]);
+    const topology = result.topology;
+    const tableCounts = new Map();
+    for (const table of topology.tables || []) {
+      tableCounts.set(table.shard_id, (tableCounts.get(table.shard_id) || 0) + 1);
+    }
+
+    const nodes = newTable(["Node", "Alive", "Shards"]);
+    fillTable(nodes, topology.nodes, (row, n) => {
+      cell(row, n.name);
+      cell(row, n.alive ? "yes" : "no", n.alive ? "healthy" : "unhealthy");
+      cell(row, (n.shard_ids || []).join(", "));
+    });
+    const shards = newTable(["Shard", "Node", "Version", "Tables"]);
+    fillTable(shards, topology.shards, (row, s) => {
+      cell(row, s.id);
+      cell(row, s.node || "unassigned", s.node ? "" : "unhealthy");
+      cell(row, s.version);
+      cell(row, tableCounts.get(s.id) || 0);
+    });
+    const failures = newTable(["Failed at", "Type", "Target", "Error", "Compensations"]);
+    fillTable(failures, (failed.procedures || []).slice().reverse(), (row, p) => {
+      cell(row, p.failed_at);
+      cell(row, p.type);
+      cell(row, p.target);
+      cell(row, p.error);
+      cell(row, (p.compensations || []).length);
+    });
+
+    for (const [name, table] of [["Nodes", nodes], ["Shards", shards], ["Recent failures", failures]]) {
+      const header = document.createElement("h3");
+      header.textContent = name;
+      section.append(header, table);
+    }
+  } catch (err) {
+    const p = document.createElement("p");
+    p.className = "error";
+    p.textContent = err.message;
+    section.appendChild(p);
+  }
+  return section;
+}
+
+async function refresh() {
+  const status = document.getElementById("status");
+  if (!sessionStorage.getItem(tokenKey)) {
+    status.textContent = "enter the admin token";
+    return;
+  }
+  try {
+    const [members, concurrency, blocked, clusters] = await Promise.all([
+      get("members"),
+      get("procedure_concurrency"),
+      get("blocked_procedures"),
+      get("clusters"),
+    ]);
+    renderMembers(members);
+    renderProcedures(concurrency, blocked);
+    const sections = await Promise.all((clusters.clusters || []).map(renderCluster));
+    document.getElementById("clusters").replaceChildren(...sections);
+    status.className = "";
+    status.textContent = "updated at " + new Date().toLocaleTimeString();
+  } catch (err) {
+    status.className = "error";
+    status.textContent = err.message;
+  }
+}
+
+document.getElementById("token-form").addEventListener("submit", (event) => {
+  event.preventDefault();
+  sessionStorage.setItem(tokenKey, document.getElementById("token").value);
+  refresh();
+});
+
+refresh();
+setInterval(refresh, refreshIntervalMs);
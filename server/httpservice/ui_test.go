@@ -0,0 +1,31 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package httpservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUIHandler(t *testing.T) {
+	re := require.New(t)
+
+	h := NewUIHandler()
+	for _, path := range []string{"", "app.js", "style.css"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, UIPrefix+path, nil))
+		re.Equal(http.StatusOK, w.Code, "path:%s", path)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, UIPrefix+"missing.js", nil))
+	re.Equal(http.StatusNotFound, w.Code)
+
+	// Every api read by the page is served by the GET method.
+	s := NewService(testAdminToken, &fakeHandler{})
+	for _, path := range []string{"members", "clusters", "topology", "procedure_concurrency", "blocked_procedures", "failed_procedures"} {
+		re.Equal(http.StatusMethodNotAllowed, serve(s, http.MethodPost, path, testAdminToken, "").Code, "path:%s", path)
+	}
+}
@@ -4,4 +4,8 @@ package id
 
 import "github.com/CeresDB/ceresmeta/pkg/coderr"
 
-var ErrTxnPutEndID = coderr.NewCodeError(coderr.Internal, "put end id in txn")
+var (
+	ErrTxnPutEndID = coderr.NewCodeError(coderr.Internal, "put end id in txn")
+	ErrDecodeEndID = coderr.NewCodeError(coderr.Internal, "decode end id")
+	ErrIDExhausted = coderr.NewCodeError(coderr.Internal, "id exhausted")
+)
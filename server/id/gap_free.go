@@ -0,0 +1,92 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package id
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+)
+
+// maxEnsureEndAttempts bounds the attempts to advance the end id racing with the allocations.
+const maxEnsureEndAttempts = 5
+
+// GapFreeAllocator hands out the ids one by one, and the end id shared with the AllocatorImpl of the same key is only
+// advanced by the caller along with persisting the record using the id, so no id is lost if the persisting fails.
+//
+// The callers must be serialized, e.g. by the lock of the cluster, because the same id is returned until the end id
+// is advanced, and the conflicting writes are rejected by comparing the end id. Switching from the AllocatorImpl
+// leaves a gap of the ids cached by it at most once.
+type GapFreeAllocator struct {
+	kv  storage.KV
+	key string
+}
+
+func NewGapFreeAllocator(kv storage.KV, key string) *GapFreeAllocator {
+	return &GapFreeAllocator{kv: kv, key: key}
+}
+
+// Next returns the id right after the end id without advancing it.
+func (alloc *GapFreeAllocator) Next(ctx context.Context) (uint64, error) {
+	end, _, err := alloc.getEnd(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if end == math.MaxUint64 {
+		return 0, ErrIDExhausted.WithCausef("key:%s, end id:%d", alloc.key, end)
+	}
+	return end + 1, nil
+}
+
+// End returns the end id, which is the high-water mark of the ids allocated by any allocator of the key.
+func (alloc *GapFreeAllocator) End(ctx context.Context) (uint64, error) {
+	end, _, err := alloc.getEnd(ctx)
+	return end, err
+}
+
+// EnsureEnd advances the end id to the minEnd if it is below, so that the ids up to the minEnd are never allocated,
+// and the end id after that is returned.
+func (alloc *GapFreeAllocator) EnsureEnd(ctx context.Context, minEnd uint64) (uint64, error) {
+	for i := 0; i < maxEnsureEndAttempts; i++ {
+		end, value, err := alloc.getEnd(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if end >= minEnd {
+			return end, nil
+		}
+		ok, err := alloc.kv.BatchIfEqual(ctx, alloc.key, value, []string{alloc.key}, []string{strconv.FormatUint(minEnd, 10)})
+		if err != nil {
+			return 0, errors.Wrapf(err, "advance end id failed, key:%v", alloc.key)
+		}
+		if ok {
+			return minEnd, nil
+		}
+	}
+	return 0, ErrTxnPutEndID.WithCausef("end id keeps changing, key:%s", alloc.key)
+}
+
+// getEnd returns the end id and its encoded value, which is empty if the end id is never set.
+func (alloc *GapFreeAllocator) getEnd(ctx context.Context) (uint64, string, error) {
+	value, err := alloc.kv.Get(ctx, alloc.key)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "get end id failed, key:%v", alloc.key)
+	}
+	if value == "" {
+		return 0, "", nil
+	}
+
+	end, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, "", ErrDecodeEndID.WithCausef("key:%s, value:%s, err:%v", alloc.key, value, err)
+	}
+	return end, value, nil
+}
+
+// EndIDKey returns the key of the end id, which should be advanced to the id returned by Next once it is used.
+func (alloc *GapFreeAllocator) EndIDKey() string {
+	return alloc.key
+}
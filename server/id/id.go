@@ -5,6 +5,10 @@ package id
 import "context"
 
 // Allocator defines the id allocator on the ceresdb cluster meta info.
+//
+// The ids are monotonically increasing 64-bit values which are never reused, even after the records using them are
+// deleted, so the data left by a deleted record never collides with a new one. The space of the ids lasts for
+// centuries even if a million ids are allocated every second, and ErrIDExhausted is returned once it is used up.
 type Allocator interface {
 	// Alloc allocs a unique id.
 	Alloc(ctx context.Context) (uint64, error)
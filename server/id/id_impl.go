@@ -5,11 +5,13 @@ package id
 import (
 	"context"
 	"fmt"
+	"math"
 	"path"
 	"strconv"
 	"sync"
 
 	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
 	"github.com/CeresDB/ceresmeta/server/storage"
 	"github.com/pkg/errors"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -18,12 +20,9 @@ import (
 
 const defaultAllocStep = uint64(1000)
 
-// When a process performs ID allocation,
-// the lock will lock the shared resource area,
-// so that other processes cannot temporarily perform ID allocation
-var lock sync.Mutex
-
 type AllocatorImpl struct {
+	// lock protects the cached ids, and the allocators of different keys never contend with each other.
+	lock     sync.Mutex
 	base     uint64
 	end      uint64
 	kv       storage.KV
@@ -36,8 +35,8 @@ func NewAllocatorImpl(kv storage.KV, rootPath string, key string) *AllocatorImpl
 }
 
 func (alloc *AllocatorImpl) Alloc(ctx context.Context) (uint64, error) {
-	lock.Lock()
-	defer lock.Unlock()
+	alloc.lock.Lock()
+	defer alloc.lock.Unlock()
 
 	if alloc.base == alloc.end {
 		if err := alloc.fastRebaseLocked(ctx); err != nil {
@@ -53,25 +52,49 @@ func (alloc *AllocatorImpl) Alloc(ctx context.Context) (uint64, error) {
 	return alloc.base, nil
 }
 
+// rebaseLocked re-reads the end id and retries on conflict, because the end id may be advanced by others concurrently.
 func (alloc *AllocatorImpl) rebaseLocked(ctx context.Context) error {
-	currEnd, err := alloc.kv.Get(ctx, alloc.key)
-	if err != nil {
-		return errors.Wrapf(err, "get end id failed, key:%v", alloc.key)
-	}
-
-	if currEnd != "" {
-		return alloc.doRebase(ctx, decodeID(currEnd))
-	}
+	return etcdutil.DoWithRetryOnConflict(ctx, etcdutil.DefaultRetryOnConflictOptions, func() (*clientv3.TxnResponse, error) {
+		value, err := alloc.kv.Get(ctx, alloc.key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get end id failed, key:%v", alloc.key)
+		}
 
-	return alloc.doRebase(ctx, 0)
+		var currEnd uint64
+		if value != "" {
+			if currEnd, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, ErrDecodeEndID.WithCausef("key:%s, value:%s, err:%v", alloc.key, value, err)
+			}
+		}
+		if currEnd < alloc.end {
+			log.Warn("end id goes backward and is advanced from the cached one", zap.String("key", alloc.key),
+				zap.Uint64("end-id", currEnd), zap.Uint64("cached-end-id", alloc.end))
+		}
+		return alloc.doRebase(ctx, currEnd, alloc.end)
+	})
 }
 
 func (alloc *AllocatorImpl) fastRebaseLocked(ctx context.Context) error {
-	return alloc.doRebase(ctx, alloc.end)
+	resp, err := alloc.doRebase(ctx, alloc.end, alloc.end)
+	if err != nil {
+		return err
+	} else if !resp.Succeeded {
+		return ErrTxnPutEndID.WithCausef("txn put end id failed, resp:%v", resp)
+	}
+	return nil
 }
 
-func (alloc *AllocatorImpl) doRebase(ctx context.Context, currEnd uint64) error {
-	newEnd := currEnd + defaultAllocStep
+// doRebase advances the end id if it is still currEnd, and the returned resp tells whether it succeeds. The new end id
+// is advanced from the floor instead if the currEnd is below it, so the ids never go backward even if the end id does.
+func (alloc *AllocatorImpl) doRebase(ctx context.Context, currEnd, floor uint64) (*clientv3.TxnResponse, error) {
+	base := currEnd
+	if base < floor {
+		base = floor
+	}
+	if base > math.MaxUint64-defaultAllocStep {
+		return nil, ErrIDExhausted.WithCausef("key:%s, end id:%d", alloc.key, base)
+	}
+	newEnd := base + defaultAllocStep
 	key := path.Join(alloc.rootPath, alloc.key)
 
 	var cmp clientv3.Cmp
@@ -87,9 +110,9 @@ func (alloc *AllocatorImpl) doRebase(ctx context.Context, currEnd uint64) error
 		Then(opPutEndID).
 		Commit()
 	if err != nil {
-		return errors.Wrapf(err, "put end id failed, key:%v", key)
+		return nil, errors.Wrapf(err, "put end id failed, key:%v", key)
 	} else if !resp.Succeeded {
-		return ErrTxnPutEndID.WithCausef("txn put end id failed, resp:%v", resp)
+		return resp, nil
 	}
 
 	log.Info("Allocator allocates a new id", zap.Uint64("alloc-id", newEnd))
@@ -97,17 +120,9 @@ func (alloc *AllocatorImpl) doRebase(ctx context.Context, currEnd uint64) error
 	alloc.end = newEnd
 	alloc.base = newEnd - defaultAllocStep
 
-	return nil
+	return resp, nil
 }
 
 func encodeID(value uint64) string {
 	return fmt.Sprintf("%d", value)
 }
-
-func decodeID(value string) uint64 {
-	res, err := strconv.ParseUint(value, 10, 64)
-	if err != nil {
-		log.Error("convert string to int failed", zap.Error(err))
-	}
-	return res
-}
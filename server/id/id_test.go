@@ -4,11 +4,14 @@ package id
 
 import (
 	"context"
+	"math"
 	"path"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
 	"github.com/CeresDB/ceresmeta/server/etcdutil"
 	"github.com/CeresDB/ceresmeta/server/storage"
 	"github.com/stretchr/testify/assert"
@@ -19,7 +22,6 @@ import (
 
 const defaultRequestTimeout = time.Second * 10
 
-// TODO: need a concurrent test case
 func TestAlloc(t *testing.T) {
 	re := require.New(t)
 	cfg := etcdutil.NewTestSingleConfig()
@@ -45,3 +47,154 @@ func TestAlloc(t *testing.T) {
 		re.Equal(uint64(i+1), value)
 	}
 }
+
+func TestAllocWithConflict(t *testing.T) {
+	re := require.New(t)
+	cfg := etcdutil.NewTestSingleConfig()
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	defer client.Close()
+	rootPath := path.Join("/ceresmeta", strconv.FormatUint(100, 10))
+	kv := storage.NewEtcdKV(client, rootPath)
+
+	// The allocators share the same key just like the ones in different processes, and their cached end ids conflict
+	// with each other.
+	allocs := []*AllocatorImpl{NewAllocatorImpl(kv, rootPath, "id"), NewAllocatorImpl(kv, rootPath, "id")}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+	allocated := make(map[uint64]struct{})
+	for i := 0; i < 4010; i++ {
+		value, err := allocs[(i/1000)%2].Alloc(ctx)
+		re.NoError(err)
+		_, ok := allocated[value]
+		re.False(ok, "id:%d is allocated twice", value)
+		allocated[value] = struct{}{}
+	}
+}
+
+func TestAllocConcurrently(t *testing.T) {
+	re := require.New(t)
+	cfg := etcdutil.NewTestSingleConfig()
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	defer client.Close()
+	rootPath := path.Join("/ceresmeta", strconv.FormatUint(100, 10))
+	kv := storage.NewEtcdKV(client, rootPath)
+
+	// The goroutines share the allocators, which share the same key, so the ids are allocated concurrently both
+	// within an allocator and across the allocators, whose rebases conflict with each other.
+	const (
+		workers      = 8
+		allocsEach   = 600
+		allocatorNum = 2
+	)
+	allocs := make([]*AllocatorImpl, 0, allocatorNum)
+	for i := 0; i < allocatorNum; i++ {
+		allocs = append(allocs, NewAllocatorImpl(kv, rootPath, "id"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	ids := make([][]uint64, workers)
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			alloc := allocs[i%allocatorNum]
+			for j := 0; j < allocsEach; j++ {
+				value, err := alloc.Alloc(ctx)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				ids[i] = append(ids[i], value)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[uint64]struct{}, workers*allocsEach)
+	for i := 0; i < workers; i++ {
+		re.NoError(errs[i])
+		re.Len(ids[i], allocsEach)
+		for _, value := range ids[i] {
+			_, ok := allocated[value]
+			re.False(ok, "id:%d is allocated twice", value)
+			allocated[value] = struct{}{}
+		}
+	}
+}
+
+func TestAllocNeverGoesBackward(t *testing.T) {
+	re := require.New(t)
+	cfg := etcdutil.NewTestSingleConfig()
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	defer client.Close()
+	rootPath := path.Join("/ceresmeta", strconv.FormatUint(100, 10))
+	kv := storage.NewEtcdKV(client, rootPath)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	alloc := NewAllocatorImpl(kv, rootPath, "id")
+	var last uint64
+	for i := 0; i < 10; i++ {
+		last, err = alloc.Alloc(ctx)
+		re.NoError(err)
+	}
+	// The end id is restored from a stale backup, and the ids keep increasing from the cached end id.
+	re.NoError(kv.Put(ctx, "id", "1"))
+	for i := 0; i < 2000; i++ {
+		value, err := alloc.Alloc(ctx)
+		re.NoError(err)
+		re.Greater(value, last)
+		last = value
+	}
+
+	// The end id is advanced by the EnsureEnd only if it is behind.
+	gapFree := NewGapFreeAllocator(kv, "id")
+	end, err := gapFree.End(ctx)
+	re.NoError(err)
+	re.GreaterOrEqual(end, last)
+	advanced, err := gapFree.EnsureEnd(ctx, end-1)
+	re.NoError(err)
+	re.Equal(end, advanced)
+	advanced, err = gapFree.EnsureEnd(ctx, end+100)
+	re.NoError(err)
+	re.Equal(end+100, advanced)
+	next, err := gapFree.Next(ctx)
+	re.NoError(err)
+	re.Equal(end+101, next)
+
+	re.NoError(kv.Put(ctx, "id", strconv.FormatUint(math.MaxUint64, 10)))
+	_, err = gapFree.Next(ctx)
+	re.True(coderr.Is(err, coderr.Internal))
+	_, err = NewAllocatorImpl(kv, rootPath, "id").Alloc(ctx)
+	re.ErrorContains(err, "id exhausted")
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package id
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/CeresDB/ceresmeta/server/storage"
+)
+
+// partitionBits is the number of the low bits of the ids holding the sequence within the partition.
+const partitionBits = 32
+
+// PartitionedAllocator allocates the ids from the disjoint partitions of the id space, and every partition has its own
+// end id, so the allocations in different partitions never contend on the same counter. The partition is kept in the
+// high 32 bits of the ids, so the ids are unique across the partitions too, and ErrIDExhausted is returned once the
+// sequence of a partition is used up.
+type PartitionedAllocator struct {
+	kv        storage.KV
+	rootPath  string
+	keyPrefix string
+
+	// mu protects the allocs, which are created lazily.
+	mu     sync.Mutex
+	allocs map[uint32]*AllocatorImpl
+}
+
+func NewPartitionedAllocator(kv storage.KV, rootPath string, keyPrefix string) *PartitionedAllocator {
+	return &PartitionedAllocator{
+		kv:        kv,
+		rootPath:  rootPath,
+		keyPrefix: keyPrefix,
+		allocs:    make(map[uint32]*AllocatorImpl),
+	}
+}
+
+// Alloc allocs a unique id in the partition.
+func (alloc *PartitionedAllocator) Alloc(ctx context.Context, partition uint32) (uint64, error) {
+	seq, err := alloc.get(partition).Alloc(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if seq > math.MaxUint32 {
+		return 0, ErrIDExhausted.WithCausef("key:%s, sequence:%d", alloc.Key(partition), seq)
+	}
+	return MakePartitionedID(partition, seq), nil
+}
+
+// Key returns the key of the end id of the partition, whose value is the end of the sequence instead of the id.
+func (alloc *PartitionedAllocator) Key(partition uint32) string {
+	return fmt.Sprintf("%s/%d", alloc.keyPrefix, partition)
+}
+
+func (alloc *PartitionedAllocator) get(partition uint32) *AllocatorImpl {
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+
+	a, ok := alloc.allocs[partition]
+	if !ok {
+		a = NewAllocatorImpl(alloc.kv, alloc.rootPath, alloc.Key(partition))
+		alloc.allocs[partition] = a
+	}
+	return a
+}
+
+// MakePartitionedID returns the id of the sequence in the partition.
+func MakePartitionedID(partition uint32, seq uint64) uint64 {
+	return uint64(partition)<<partitionBits | seq
+}
+
+// SplitPartitionedID returns the partition and the sequence of the id allocated by the PartitionedAllocator.
+func SplitPartitionedID(id uint64) (uint32, uint64) {
+	return uint32(id >> partitionBits), id & math.MaxUint32
+}
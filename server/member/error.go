@@ -14,4 +14,15 @@ var (
 	ErrGrantLease         = coderr.NewCodeError(coderr.Internal, "grant lease")
 	ErrRevokeLease        = coderr.NewCodeError(coderr.Internal, "revoke lease")
 	ErrCloseLease         = coderr.NewCodeError(coderr.Internal, "close lease")
+	ErrCheckLeader        = coderr.NewCodeError(coderr.Internal, "check whether leader is orphaned")
+	ErrDeleteLeader       = coderr.NewCodeError(coderr.Internal, "delete orphaned leader key")
+	ErrNoLeader           = coderr.NewCodeError(coderr.ServiceUnavailable, "no leader elected")
+
+	ErrCheckQuorum         = coderr.NewCodeError(coderr.Internal, "check quorum of etcd members")
+	ErrQuorumLost          = coderr.NewCodeError(coderr.ServiceUnavailable, "quorum of etcd voters lost")
+	ErrObserverNotFound    = coderr.NewCodeError(coderr.NotFound, "observer not found")
+	ErrVoterNotFound       = coderr.NewCodeError(coderr.NotFound, "voter not found")
+	ErrObserverStale       = coderr.NewCodeError(coderr.Conflict, "observer is stale")
+	ErrReplaceHealthyVoter = coderr.NewCodeError(coderr.Conflict, "voter to replace is healthy")
+	ErrChangeMembership    = coderr.NewCodeError(coderr.Internal, "change etcd membership")
 )
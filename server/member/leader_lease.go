@@ -0,0 +1,81 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// LeaderLeaseStatus describes the binding between the leader key and its lease.
+type LeaderLeaseStatus struct {
+	// Leader is the name of the leader in the leader key, which is empty if no leader is elected.
+	Leader   string `json:"leader"`
+	LeaderID uint64 `json:"leader_id"`
+	Revision int64  `json:"revision"`
+	LeaseID  int64  `json:"lease_id"`
+	// TTLSec is the remaining ttl of the lease, which is -1 if the lease is absent.
+	TTLSec int64 `json:"ttl_sec"`
+	// Problem tells why the binding is broken, and it is empty if the binding is valid or no leader is elected.
+	Problem string `json:"problem,omitempty"`
+}
+
+// setHeldLeaseID records the lease the member keeps alive for its leadership, and zero means no lease is held.
+func (m *Member) setHeldLeaseID(leaseID clientv3.LeaseID) {
+	atomic.StoreInt64(&m.heldLeaseID, int64(leaseID))
+}
+
+// inspectLeaderLease checks the lease of the leader key is live and the leader is a member of the etcd cluster. The
+// lease must also be the one held by the member if the member is the leader, which can't be told for the other leaders.
+func (m *Member) inspectLeaderLease(ctx context.Context, leaderResp *GetLeaderResp) (*LeaderLeaseStatus, error) {
+	status := &LeaderLeaseStatus{Revision: leaderResp.Revision, LeaseID: leaderResp.Lease}
+	if leaderResp.Leader == nil {
+		return status, nil
+	}
+	status.Leader = leaderResp.Leader.GetName()
+	status.LeaderID = leaderResp.Leader.GetId()
+
+	ctx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+	defer cancel()
+
+	if leaderResp.Lease == 0 {
+		status.Problem = "leader key has no lease"
+		return status, nil
+	}
+	ttlResp, err := m.etcdCli.TimeToLive(ctx, clientv3.LeaseID(leaderResp.Lease))
+	if err != nil {
+		return nil, ErrCheckLeader.WithCause(err)
+	}
+	status.TTLSec = ttlResp.TTL
+	// The TTL is -1 if the lease is not found.
+	if ttlResp.TTL < 0 {
+		status.Problem = "lease of leader key is absent"
+		return status, nil
+	}
+
+	membersResp, err := m.etcdCli.MemberList(ctx)
+	if err != nil {
+		return nil, ErrCheckLeader.WithCause(err)
+	}
+	isMember := false
+	for _, member := range membersResp.Members {
+		if member.ID == leaderResp.Leader.GetId() {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		status.Problem = "leader is not a member of etcd cluster"
+		return status, nil
+	}
+
+	if leaderResp.Leader.GetId() == m.ID {
+		if held := atomic.LoadInt64(&m.heldLeaseID); held != leaderResp.Lease {
+			status.Problem = fmt.Sprintf("lease of leader key is not held by the leader, held lease:%d", held)
+		}
+	}
+	return status, nil
+}
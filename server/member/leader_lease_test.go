@@ -0,0 +1,70 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestRepairGhostLeader(t *testing.T) {
+	etcd, client, clean := prepareEtcdServerAndClient(t)
+	defer clean()
+
+	rpcTimeout := time.Duration(10) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	leaderGetter := &etcdutil.LeaderGetterWrapper{Server: etcd.Server}
+	mem := NewMember("", uint64(etcd.Server.ID()), "mem0", client, leaderGetter, rpcTimeout)
+
+	// The leader key of the member is left bound to a live lease the member doesn't hold.
+	leaderVal, err := mem.Marshal()
+	assert.NoError(t, err)
+	ghostLease, err := client.Grant(ctx, 3600)
+	assert.NoError(t, err)
+	_, err = client.Put(ctx, mem.leaderKey, leaderVal, clientv3.WithLease(ghostLease.ID))
+	assert.NoError(t, err)
+	leaderResp, err := mem.GetLeader(ctx)
+	assert.NoError(t, err)
+	status, err := mem.inspectLeaderLease(ctx, leaderResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "mem0", status.Leader)
+	assert.Equal(t, int64(ghostLease.ID), status.LeaseID)
+	assert.Positive(t, status.TTLSec)
+	assert.Contains(t, status.Problem, "not held by the leader")
+
+	watchCtx := &mockWatchCtx{client: client, srv: etcd.Server}
+	leaderWatcher := NewLeaderWatcher(watchCtx, mem, int64(1))
+	leaderWatcher.orphanedLeaderConfirmDelay = time.Duration(300) * time.Millisecond
+	repairs := testutil.ToFloat64(orphanedLeaderRepairsCounter)
+	watchCtx1, cancelWatch := context.WithCancel(context.Background())
+	watchedDone := make(chan struct{}, 1)
+	go func() {
+		leaderWatcher.Watch(watchCtx1)
+		watchedDone <- struct{}{}
+	}()
+	defer func() {
+		cancelWatch()
+		<-watchedDone
+	}()
+
+	// The watcher deletes the ghost leader key instead of waiting on it, and the member is elected again with its own
+	// lease.
+	assert.Eventually(t, func() bool {
+		resp, err := mem.GetLeader(ctx)
+		return err == nil && resp.Leader.GetId() == mem.ID && resp.Lease != int64(ghostLease.ID)
+	}, time.Duration(5)*time.Second, time.Duration(50)*time.Millisecond)
+	assert.Equal(t, repairs+1, testutil.ToFloat64(orphanedLeaderRepairsCounter))
+	leaderResp, err = mem.GetLeader(ctx)
+	assert.NoError(t, err)
+	status, err = mem.inspectLeaderLease(ctx, leaderResp)
+	assert.NoError(t, err)
+	assert.Empty(t, status.Problem)
+}
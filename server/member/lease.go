@@ -20,6 +20,9 @@ type lease struct {
 	ttlSec  int64
 	// logger will be updated after Grant is called.
 	logger *zap.Logger
+	// observeDelay is told how long the lease goes without being renewed after every renewal, and it is nil if the
+	// delays are not observed.
+	observeDelay func(delay time.Duration)
 
 	// The fields below are initialized after Grant is called.
 	ID clientv3.LeaseID
@@ -147,6 +150,7 @@ func (l *lease) renewLeaseBg(ctx context.Context, interval time.Duration, renewe
 	l.logger.Info("start renewing lease background", zap.Duration("interval", interval))
 	defer l.logger.Info("stop renewing lease background", zap.Duration("interval", interval))
 
+	lastRenewed := time.Now()
 L:
 	for {
 		func() {
@@ -163,6 +167,10 @@ L:
 				return
 			}
 
+			if l.observeDelay != nil {
+				l.observeDelay(time.Since(lastRenewed))
+			}
+			lastRenewed = time.Now()
 			expireAt := start.Add(time.Duration(resp.TTL) * time.Second)
 			updated := l.setExpireTimeIfNewer(expireAt)
 			l.logger.Debug("got next expired time", zap.Time("expired-at", expireAt), zap.Bool("updated", updated))
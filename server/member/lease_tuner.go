@@ -0,0 +1,155 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"math"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// leaseNearMissRatio is the ratio of the delay to the ttl beyond which the lease nearly expires.
+const leaseNearMissRatio = 0.5
+
+// LeaseTTLTuner adapts the ttl of the leadership lease to the observed delays of the keepalives and the pauses of the
+// gc. The ttl is raised once a delay takes more than half of it, and is lowered by a second after every stable period
+// without such a near miss, within the bounds. The ttl of a granted lease can't be changed, so the tuned ttl takes
+// effect from the next lease granted by the campaign.
+type LeaseTTLTuner struct {
+	minTTLSec    int64
+	maxTTLSec    int64
+	stablePeriod time.Duration
+
+	// mu protects the fields below.
+	mu     sync.Mutex
+	ttlSec int64
+	// stableSince is the time of the last near miss or adjustment.
+	stableSince time.Time
+	// numGC is the number of the gc observed by the last sampling.
+	numGC int64
+}
+
+// NewLeaseTTLTuner starts tuning from the minTTLSec.
+func NewLeaseTTLTuner(minTTLSec, maxTTLSec int64, stablePeriod time.Duration) *LeaseTTLTuner {
+	if maxTTLSec < minTTLSec {
+		maxTTLSec = minTTLSec
+	}
+	stats := debug.GCStats{}
+	debug.ReadGCStats(&stats)
+	leaseTTLGauge.Set(float64(minTTLSec))
+	return &LeaseTTLTuner{
+		minTTLSec:    minTTLSec,
+		maxTTLSec:    maxTTLSec,
+		stablePeriod: stablePeriod,
+		ttlSec:       minTTLSec,
+		stableSince:  time.Now(),
+		numGC:        stats.NumGC,
+	}
+}
+
+// TTLSec returns the tuned ttl.
+func (t *LeaseTTLTuner) TTLSec() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ttlSec
+}
+
+// ObserveDelay observes how long the lease goes without being renewed or the process is paused.
+func (t *LeaseTTLTuner) ObserveDelay(source string, delay time.Duration) {
+	t.observe(source, delay, time.Now())
+}
+
+// Run samples the pauses of the gc and lowers the ttl after the stable periods until the ctx is done.
+func (t *LeaseTTLTuner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if pause := t.sampleGCPause(); pause > 0 {
+				t.observe("gc", pause, time.Now())
+			}
+			t.tick(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *LeaseTTLTuner) observe(source string, delay time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ttl := time.Duration(t.ttlSec) * time.Second
+	if float64(delay) < float64(ttl)*leaseNearMissRatio {
+		return
+	}
+	leaseNearMissesCounter.WithLabelValues(source).Inc()
+	t.stableSince = now
+
+	// The delay should take no more than the ratio of the new ttl, which is raised by half at least.
+	target := int64(math.Ceil(delay.Seconds() / leaseNearMissRatio))
+	if raised := t.ttlSec + (t.ttlSec+1)/2; target < raised {
+		target = raised
+	}
+	if target > t.maxTTLSec {
+		target = t.maxTTLSec
+	}
+	if target <= t.ttlSec {
+		log.Warn("lease nearly expires and ttl is at the max", zap.String("source", source), zap.Duration("delay", delay),
+			zap.Int64("ttl-sec", t.ttlSec))
+		return
+	}
+	t.adjustLocked("up", target, zap.String("source", source), zap.Duration("delay", delay))
+}
+
+// tick lowers the ttl by a second if no near miss happens for the stable period.
+func (t *LeaseTTLTuner) tick(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ttlSec <= t.minTTLSec || now.Sub(t.stableSince) < t.stablePeriod {
+		return
+	}
+	t.stableSince = now
+	t.adjustLocked("down", t.ttlSec-1, zap.Duration("stable-period", t.stablePeriod))
+}
+
+func (t *LeaseTTLTuner) adjustLocked(direction string, ttlSec int64, fields ...zap.Field) {
+	log.Info("adjust lease ttl", append(fields, zap.String("direction", direction), zap.Int64("from-sec", t.ttlSec),
+		zap.Int64("to-sec", ttlSec))...)
+	t.ttlSec = ttlSec
+	leaseTTLGauge.Set(float64(ttlSec))
+	leaseTTLAdjustmentsCounter.WithLabelValues(direction).Inc()
+}
+
+// sampleGCPause returns the longest pause of the gc since the last sampling, and the pauses beyond the ones recorded
+// by the runtime are missed.
+func (t *LeaseTTLTuner) sampleGCPause() time.Duration {
+	stats := debug.GCStats{}
+	debug.ReadGCStats(&stats)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := stats.NumGC - t.numGC
+	t.numGC = stats.NumGC
+	if n > int64(len(stats.Pause)) {
+		n = int64(len(stats.Pause))
+	}
+	var longest time.Duration
+	// The pauses are ordered from the latest.
+	for _, pause := range stats.Pause[:n] {
+		if pause > longest {
+			longest = pause
+		}
+	}
+	return longest
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseTTLTuner(t *testing.T) {
+	re := require.New(t)
+	stable := time.Minute
+	tuner := NewLeaseTTLTuner(10, 40, stable)
+	re.Equal(int64(10), tuner.TTLSec())
+
+	// The delays within half of the ttl are ignored.
+	now := time.Now()
+	tuner.observe("keepalive", time.Second*4, now)
+	re.Equal(int64(10), tuner.TTLSec())
+
+	// The ttl is raised by half at least on a near miss.
+	tuner.observe("gc", time.Second*5, now)
+	re.Equal(int64(15), tuner.TTLSec())
+	// A long delay raises it to keep the delay within half of it.
+	tuner.observe("keepalive", time.Second*16, now)
+	re.Equal(int64(32), tuner.TTLSec())
+	// The ttl is capped at the max.
+	tuner.observe("keepalive", time.Minute, now)
+	re.Equal(int64(40), tuner.TTLSec())
+	tuner.observe("keepalive", time.Minute, now)
+	re.Equal(int64(40), tuner.TTLSec())
+
+	// The ttl is lowered by a second after every stable period down to the min.
+	tuner.tick(now.Add(stable / 2))
+	re.Equal(int64(40), tuner.TTLSec())
+	now = now.Add(stable)
+	tuner.tick(now)
+	re.Equal(int64(39), tuner.TTLSec())
+	tuner.tick(now.Add(stable / 2))
+	re.Equal(int64(39), tuner.TTLSec())
+	for i := 0; i < 40; i++ {
+		now = now.Add(stable)
+		tuner.tick(now)
+	}
+	re.Equal(int64(10), tuner.TTLSec())
+}
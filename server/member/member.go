@@ -30,6 +30,13 @@ type Member struct {
 	leader           *metapb.Member
 	rpcTimeout       time.Duration
 	logger           *zap.Logger
+	// revisionPins is nil if the revisions needed by the leader watch are not reported to the compaction.
+	revisionPins *etcdutil.RevisionPins
+	// leaseTuner is nil if the ttl of the leadership lease is not adaptive.
+	leaseTuner *LeaseTTLTuner
+	// heldLeaseID is the lease kept alive by the member as the leader, which is zero if the member is not the leader.
+	// It is accessed atomically.
+	heldLeaseID int64
 }
 
 func formatLeaderKey(rootPath string) string {
@@ -52,6 +59,11 @@ func NewMember(rootPath string, id uint64, name string, etcdCli *clientv3.Client
 	}
 }
 
+// SetRevisionPins makes the watch of the leader pin the revisions it needs, so that they are not compacted.
+func (m *Member) SetRevisionPins(pins *etcdutil.RevisionPins) {
+	m.revisionPins = pins
+}
+
 // GetLeader gets the leader of the cluster.
 // GetLeaderResp.Leader == nil if no leader found.
 func (m *Member) GetLeader(ctx context.Context) (*GetLeaderResp, error) {
@@ -73,7 +85,7 @@ func (m *Member) GetLeader(ctx context.Context) (*GetLeaderResp, error) {
 	if err != nil {
 		return nil, ErrInvalidLeaderValue.WithCause(err)
 	}
-	return &GetLeaderResp{Leader: leader, Revision: leaderKv.ModRevision}, nil
+	return &GetLeaderResp{Leader: leader, Revision: leaderKv.ModRevision, Lease: leaderKv.Lease}, nil
 }
 
 func (m *Member) ResetLeader(ctx context.Context) error {
@@ -96,11 +108,16 @@ func (m *Member) WaitForLeaderChange(ctx context.Context, revision int64) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	pinName := fmt.Sprintf("leader-watch/%s", m.Name)
+	m.revisionPins.Pin(pinName, revision)
+	defer m.revisionPins.Unpin(pinName)
+
 	for {
 		wch := watcher.Watch(ctx, m.leaderKey, clientv3.WithRev(revision))
 		for resp := range wch {
 			// meet compacted error, use the compact revision.
 			if resp.CompactRevision != 0 {
+				leaderWatchCompactedCounter.Inc()
 				m.logger.Warn("required revision has been compacted, use the compact revision",
 					zap.Int64("required-revision", revision),
 					zap.Int64("compact-revision", resp.CompactRevision))
@@ -119,6 +136,9 @@ func (m *Member) WaitForLeaderChange(ctx context.Context, revision int64) {
 					return
 				}
 			}
+			// The revisions before the response are not needed by the watch any more.
+			revision = resp.Header.Revision + 1
+			m.revisionPins.Pin(pinName, revision)
 		}
 
 		select {
@@ -129,14 +149,27 @@ func (m *Member) WaitForLeaderChange(ctx context.Context, revision int64) {
 	}
 }
 
+// SetLeaseTTLTuner makes the ttl of the leadership lease adaptive, and the ttl given to the campaign is ignored.
+func (m *Member) SetLeaseTTLTuner(tuner *LeaseTTLTuner) {
+	m.leaseTuner = tuner
+}
+
 func (m *Member) CampaignAndKeepLeader(ctx context.Context, leaseTTLSec int64) error {
 	leaderVal, err := m.Marshal()
 	if err != nil {
 		return err
 	}
 
+	if m.leaseTuner != nil {
+		leaseTTLSec = m.leaseTuner.TTLSec()
+	}
 	rawLease := clientv3.NewLease(m.etcdCli)
 	newLease := newLease(rawLease, leaseTTLSec)
+	if m.leaseTuner != nil {
+		newLease.observeDelay = func(delay time.Duration) {
+			m.leaseTuner.ObserveDelay("keepalive", delay)
+		}
+	}
 	closeLeaseOnce := sync.Once{}
 	closeLeaseWg := sync.WaitGroup{}
 	closeLease := func() {
@@ -154,6 +187,9 @@ func (m *Member) CampaignAndKeepLeader(ctx context.Context, leaseTTLSec int64) e
 	if err := newLease.Grant(ctx1); err != nil {
 		return err
 	}
+	// The lease is held before it is bound to the leader key, so the leader key is never found bound to a lease not held.
+	m.setHeldLeaseID(newLease.ID)
+	defer m.setHeldLeaseID(0)
 
 	// The leader key must not exist, so the CreateRevision is 0.
 	cmp := clientv3.Compare(clientv3.CreateRevision(m.leaderKey), "=", 0)
@@ -170,7 +206,8 @@ func (m *Member) CampaignAndKeepLeader(ctx context.Context, leaseTTLSec int64) e
 		return ErrTxnPutLeader.WithCausef("txn put leader failed, resp:%v", resp)
 	}
 
-	m.logger.Info("succeed to set leader", zap.String("leader-key", m.leaderKey), zap.String("leader", m.Name))
+	m.logger.Info("succeed to set leader", zap.String("leader-key", m.leaderKey), zap.String("leader", m.Name),
+		zap.Int64("lease-ttl-sec", leaseTTLSec))
 
 	// keep the leadership after success in campaigning leader.
 	closeLeaseWg.Add(1)
@@ -219,4 +256,6 @@ func (m *Member) Marshal() (string, error) {
 type GetLeaderResp struct {
 	Leader   *metapb.Member
 	Revision int64
+	// Lease is the id of the lease attached to the leader key.
+	Lease int64
 }
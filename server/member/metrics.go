@@ -0,0 +1,71 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var orphanedLeaderRepairsCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "orphaned_leader_repairs_total",
+		Help:      "Number of the orphaned leader keys deleted.",
+	})
+
+var leaderWatchCompactedCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "leader_watch_compacted_total",
+		Help:      "Number of the leader watches restarted because the revisions they need have been compacted.",
+	})
+
+var healthyVotersGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "healthy_voters",
+		Help:      "Number of the healthy voting members of the etcd cluster.",
+	})
+
+var observerPromotionsCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "observer_promotions_total",
+		Help:      "Number of the observers promoted to the voters.",
+	})
+
+var leaseTTLGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "lease_ttl_seconds",
+		Help:      "TTL of the leadership lease tuned adaptively.",
+	})
+
+var leaseTTLAdjustmentsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "lease_ttl_adjustments_total",
+		Help:      "Number of the adjustments of the leadership lease ttl by direction.",
+	}, []string{"direction"})
+
+var leaseNearMissesCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "member",
+		Name:      "lease_near_misses_total",
+		Help:      "Number of the delays taking more than half of the leadership lease ttl by source.",
+	}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(orphanedLeaderRepairsCounter)
+	prometheus.MustRegister(leaderWatchCompactedCounter)
+	prometheus.MustRegister(healthyVotersGauge)
+	prometheus.MustRegister(observerPromotionsCounter)
+	prometheus.MustRegister(leaseTTLGauge)
+	prometheus.MustRegister(leaseTTLAdjustmentsCounter)
+	prometheus.MustRegister(leaseNearMissesCounter)
+}
@@ -0,0 +1,277 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// EtcdMember is a member of the etcd cluster backing the ceresmeta cluster. The observers are the etcd learners, which
+// replicate the data without voting, and they never campaign the leadership since only the etcd leader does.
+type EtcdMember struct {
+	ID       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Observer bool   `json:"observer"`
+	// Healthy is set if the member answers the status request.
+	Healthy      bool   `json:"healthy"`
+	AppliedIndex uint64 `json:"applied_index"`
+	// Lag is how far the applied raft index of the member is behind the most advanced voter.
+	Lag uint64 `json:"lag"`
+}
+
+// QuorumStatus is the health of the voters and the observers of the etcd cluster.
+type QuorumStatus struct {
+	Voters    []EtcdMember
+	Observers []EtcdMember
+}
+
+func (s *QuorumStatus) Quorum() int {
+	return len(s.Voters)/2 + 1
+}
+
+func (s *QuorumStatus) HealthyVoters() int {
+	healthy := 0
+	for _, voter := range s.Voters {
+		if voter.Healthy {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// Lost tells whether the healthy voters are fewer than the quorum, and no membership change is possible then.
+func (s *QuorumStatus) Lost() bool {
+	return s.HealthyVoters() < s.Quorum()
+}
+
+// FreshObservers returns the healthy observers lagging no more than maxLag, the least lagging first.
+func (s *QuorumStatus) FreshObservers(maxLag uint64) []EtcdMember {
+	fresh := make([]EtcdMember, 0, len(s.Observers))
+	for _, observer := range s.Observers {
+		if observer.Healthy && observer.Lag <= maxLag {
+			fresh = append(fresh, observer)
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].Lag < fresh[j].Lag })
+	return fresh
+}
+
+func (s *QuorumStatus) find(id uint64) (EtcdMember, bool) {
+	for _, m := range append(s.Voters, s.Observers...) {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return EtcdMember{}, false
+}
+
+// newQuorumStatus builds the status of the members from the responses of the status requests, and the members absent
+// from the statuses are unhealthy.
+func newQuorumStatus(members []*etcdserverpb.Member, statuses map[uint64]*clientv3.StatusResponse) *QuorumStatus {
+	var maxApplied uint64
+	for _, m := range members {
+		if status, ok := statuses[m.GetID()]; ok && !m.GetIsLearner() && status.RaftAppliedIndex > maxApplied {
+			maxApplied = status.RaftAppliedIndex
+		}
+	}
+
+	s := &QuorumStatus{}
+	for _, m := range members {
+		member := EtcdMember{ID: m.GetID(), Name: m.GetName(), Observer: m.GetIsLearner()}
+		if len(m.GetClientURLs()) > 0 {
+			member.Endpoint = m.GetClientURLs()[0]
+		}
+		if status, ok := statuses[m.GetID()]; ok {
+			member.Healthy = true
+			member.AppliedIndex = status.RaftAppliedIndex
+			if maxApplied > status.RaftAppliedIndex {
+				member.Lag = maxApplied - status.RaftAppliedIndex
+			}
+		}
+		if member.Observer {
+			s.Observers = append(s.Observers, member)
+		} else {
+			s.Voters = append(s.Voters, member)
+		}
+	}
+	return s
+}
+
+// CheckQuorum requests the status of every member of the etcd cluster.
+func (m *Member) CheckQuorum(ctx context.Context) (*QuorumStatus, error) {
+	listCtx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+	defer cancel()
+	resp, err := m.etcdCli.MemberList(listCtx)
+	if err != nil {
+		return nil, ErrCheckQuorum.WithCause(err)
+	}
+
+	statuses := make(map[uint64]*clientv3.StatusResponse, len(resp.Members))
+	for _, member := range resp.Members {
+		if len(member.GetClientURLs()) == 0 {
+			continue
+		}
+		statusCtx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+		status, err := m.etcdCli.Status(statusCtx, member.GetClientURLs()[0])
+		cancel()
+		if err != nil {
+			m.logger.Warn("etcd member is unhealthy", zap.String("member", member.GetName()), zap.Error(err))
+			continue
+		}
+		statuses[member.GetID()] = status
+	}
+	return newQuorumStatus(resp.Members, statuses), nil
+}
+
+// Members are the members of the etcd cluster along with the one serving as the leader of the ceresmeta cluster.
+type Members struct {
+	Voters    []EtcdMember `json:"voters"`
+	Observers []EtcdMember `json:"observers"`
+	// LeaderID is the id of the member serving as the leader, and zero if there is no leader now.
+	LeaderID uint64 `json:"leader_id"`
+}
+
+// ListMembers returns the health of every member of the etcd cluster and tells the leader of the ceresmeta cluster.
+func (m *Member) ListMembers(ctx context.Context) (*Members, error) {
+	status, err := m.CheckQuorum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := m.GetLeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Members{Voters: status.Voters, Observers: status.Observers, LeaderID: leader.Leader.GetId()}, nil
+}
+
+// ObserverPromotion is a promotion of an observer to a voter, which replaces an unhealthy voter if any.
+type ObserverPromotion struct {
+	Observer EtcdMember `json:"observer"`
+	// Replaced is the unhealthy voter removed before the promotion, and its ID is zero if no voter is replaced.
+	Replaced EtcdMember `json:"replaced"`
+}
+
+// PromoteObserver promotes the observer to a voter, and the unhealthy voter is removed first if replaceVoterID isn't
+// zero so that the quorum doesn't grow with the dead voter. The observer lagging behind the voters more than maxLag is
+// stale and never promoted, and the membership can't be changed any more if the quorum is lost.
+func (m *Member) PromoteObserver(ctx context.Context, observerID, replaceVoterID, maxLag uint64) (*ObserverPromotion, error) {
+	status, err := m.CheckQuorum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.Lost() {
+		return nil, ErrQuorumLost.WithCausef("healthy voters:%d, quorum:%d", status.HealthyVoters(), status.Quorum())
+	}
+
+	observer, ok := status.find(observerID)
+	if !ok || !observer.Observer {
+		return nil, ErrObserverNotFound.WithCausef("member:%d", observerID)
+	}
+	if !observer.Healthy || observer.Lag > maxLag {
+		return nil, ErrObserverStale.WithCausef("observer:%s, healthy:%v, lag:%d, max lag:%d", observer.Name, observer.Healthy,
+			observer.Lag, maxLag)
+	}
+
+	promotion := &ObserverPromotion{Observer: observer}
+	if replaceVoterID != 0 {
+		voter, ok := status.find(replaceVoterID)
+		if !ok || voter.Observer {
+			return nil, ErrVoterNotFound.WithCausef("member:%d", replaceVoterID)
+		}
+		if voter.Healthy {
+			return nil, ErrReplaceHealthyVoter.WithCausef("voter:%s", voter.Name)
+		}
+		removeCtx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+		_, err := m.etcdCli.MemberRemove(removeCtx, voter.ID)
+		cancel()
+		if err != nil {
+			return nil, ErrChangeMembership.WithCausef("remove voter:%s, err:%v", voter.Name, err)
+		}
+		m.logger.Warn("remove unhealthy voter", zap.String("voter", voter.Name), zap.Uint64("voter-id", voter.ID))
+		promotion.Replaced = voter
+	}
+
+	promoteCtx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+	defer cancel()
+	if _, err := m.etcdCli.MemberPromote(promoteCtx, observer.ID); err != nil {
+		return nil, ErrChangeMembership.WithCausef("promote observer:%s, err:%v", observer.Name, err)
+	}
+	observerPromotionsCounter.Inc()
+	m.logger.Warn("promote observer", zap.String("observer", observer.Name), zap.Uint64("observer-id", observer.ID),
+		zap.Uint64("lag", observer.Lag), zap.String("replaced", promotion.Replaced.Name))
+	return promotion, nil
+}
+
+// ObserverPromoter promotes the observers to replace the voters unhealthy for longer than the delay automatically,
+// which should only be run by the leader.
+type ObserverPromoter struct {
+	member *Member
+	delay  time.Duration
+	maxLag uint64
+
+	// unhealthySince is when the voters are found unhealthy, and it is only accessed by Check.
+	unhealthySince map[uint64]time.Time
+}
+
+func NewObserverPromoter(member *Member, delay time.Duration, maxLag uint64) *ObserverPromoter {
+	return &ObserverPromoter{
+		member:         member,
+		delay:          delay,
+		maxLag:         maxLag,
+		unhealthySince: make(map[uint64]time.Time),
+	}
+}
+
+// Check replaces at most one voter unhealthy for longer than the delay with the freshest observer, and it returns nil if
+// nothing is promoted.
+func (p *ObserverPromoter) Check(ctx context.Context, now time.Time) (*ObserverPromotion, error) {
+	status, err := p.member.CheckQuorum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	healthyVotersGauge.Set(float64(status.HealthyVoters()))
+
+	var replaced *EtcdMember
+	unhealthy := make(map[uint64]time.Time)
+	for i, voter := range status.Voters {
+		if voter.Healthy {
+			continue
+		}
+		since, ok := p.unhealthySince[voter.ID]
+		if !ok {
+			since = now
+		}
+		unhealthy[voter.ID] = since
+		if replaced == nil && now.Sub(since) >= p.delay {
+			replaced = &status.Voters[i]
+		}
+	}
+	p.unhealthySince = unhealthy
+
+	if replaced == nil {
+		return nil, nil
+	}
+	if status.Lost() {
+		return nil, ErrQuorumLost.WithCausef("healthy voters:%d, quorum:%d", status.HealthyVoters(), status.Quorum())
+	}
+	fresh := status.FreshObservers(p.maxLag)
+	if len(fresh) == 0 {
+		p.member.logger.Warn("no fresh observer to replace unhealthy voter", zap.String("voter", replaced.Name),
+			zap.Int("observers", len(status.Observers)))
+		return nil, nil
+	}
+
+	promotion, err := p.member.PromoteObserver(ctx, fresh[0].ID, replaced.ID, p.maxLag)
+	if err != nil {
+		return nil, err
+	}
+	delete(p.unhealthySince, replaced.ID)
+	return promotion, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestQuorumStatus(t *testing.T) {
+	re := require.New(t)
+
+	members := []*etcdserverpb.Member{
+		{ID: 1, Name: "voter1", ClientURLs: []string{"http://voter1"}},
+		{ID: 2, Name: "voter2", ClientURLs: []string{"http://voter2"}},
+		{ID: 3, Name: "voter3", ClientURLs: []string{"http://voter3"}},
+		{ID: 4, Name: "observer1", IsLearner: true},
+		{ID: 5, Name: "observer2", IsLearner: true},
+		{ID: 6, Name: "observer3", IsLearner: true},
+	}
+	statuses := map[uint64]*clientv3.StatusResponse{
+		1: {RaftAppliedIndex: 100},
+		2: {RaftAppliedIndex: 90},
+		4: {RaftAppliedIndex: 95},
+		5: {RaftAppliedIndex: 10},
+		// The observers are never the reference of the lag.
+		6: {RaftAppliedIndex: 200},
+	}
+	status := newQuorumStatus(members, statuses)
+	re.Len(status.Voters, 3)
+	re.Len(status.Observers, 3)
+	re.Equal(2, status.Quorum())
+	re.Equal(2, status.HealthyVoters())
+	re.False(status.Lost())
+	re.Equal("http://voter1", status.Voters[0].Endpoint)
+	re.Equal(uint64(10), status.Voters[1].Lag)
+	re.False(status.Voters[2].Healthy)
+
+	fresh := status.FreshObservers(10)
+	re.Len(fresh, 2)
+	re.Equal("observer3", fresh[0].Name)
+	re.Equal("observer1", fresh[1].Name)
+	re.Len(status.FreshObservers(90), 3)
+
+	delete(statuses, 2)
+	re.True(newQuorumStatus(members, statuses).Lost())
+}
+
+func TestPromoteObserver(t *testing.T) {
+	re := require.New(t)
+	etcd, client, clean := prepareEtcdServerAndClient(t)
+	defer clean()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Join an observer as an etcd learner.
+	cfg := etcdutil.NewTestSingleConfig()
+	defer etcdutil.CleanConfig(cfg)
+	cfg.Name = "observer"
+	added, err := client.MemberAddAsLearner(ctx, []string{cfg.LPUrls[0].String()})
+	re.NoError(err)
+	cfg.InitialCluster = fmt.Sprintf("%s,%s=%s", etcd.Config().InitialCluster, cfg.Name, &cfg.LPUrls[0])
+	cfg.ClusterState = embed.ClusterStateFlagExisting
+	observerEtcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer observerEtcd.Close()
+	<-observerEtcd.Server.ReadyNotify()
+
+	leaderGetter := &etcdutil.LeaderGetterWrapper{Server: etcd.Server}
+	mem := NewMember("", uint64(etcd.Server.ID()), "mem0", client, leaderGetter, 5*time.Second)
+	status, err := mem.CheckQuorum(ctx)
+	re.NoError(err)
+	re.Len(status.Voters, 1)
+	re.Len(status.Observers, 1)
+	re.Equal(added.Member.ID, status.Observers[0].ID)
+
+	// Nothing is promoted while the voters are healthy.
+	promoter := NewObserverPromoter(mem, 0, 1000)
+	promotion, err := promoter.Check(ctx, time.Now())
+	re.NoError(err)
+	re.Nil(promotion)
+
+	_, err = mem.PromoteObserver(ctx, mem.ID, 0, 1000)
+	re.True(coderr.Is(err, coderr.NotFound))
+	_, err = mem.PromoteObserver(ctx, added.Member.ID, mem.ID, 1000)
+	re.True(coderr.Is(err, coderr.Conflict))
+
+	// The learner is promoted once it catches up with the leader.
+	re.Eventually(func() bool {
+		promotion, err = mem.PromoteObserver(ctx, added.Member.ID, 0, 1000)
+		return err == nil
+	}, 20*time.Second, 200*time.Millisecond)
+	re.Equal("observer", promotion.Observer.Name)
+	re.Zero(promotion.Replaced.ID)
+
+	status, err = mem.CheckQuorum(ctx)
+	re.NoError(err)
+	re.Len(status.Voters, 2)
+	re.Empty(status.Observers)
+	re.Equal(2, status.HealthyVoters())
+}
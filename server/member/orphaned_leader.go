@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package member
+
+import (
+	"context"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// orphanedLeader is a leader key found orphaned, which is identified by its revision.
+type orphanedLeader struct {
+	revision int64
+	reason   string
+	since    time.Time
+}
+
+// deleteLeaderAtRevision deletes the leader key only if it is not changed since the revision.
+func (m *Member) deleteLeaderAtRevision(ctx context.Context, revision int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.rpcTimeout)
+	defer cancel()
+
+	resp, err := m.etcdCli.
+		Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(m.leaderKey), "=", revision)).
+		Then(clientv3.OpDelete(m.leaderKey)).
+		Commit()
+	if err != nil {
+		return false, ErrDeleteLeader.WithCause(err)
+	}
+	return resp.Succeeded, nil
+}
+
+// repairOrphanedLeader deletes the leader key if it has been orphaned at the same revision for the confirmation
+// delay, so that a transient failure of the checks or a leader just elected can't be mistaken for an orphan. True is
+// returned if the leader key is deleted.
+func (l *LeaderWatcher) repairOrphanedLeader(ctx context.Context, leaderResp *GetLeaderResp) (bool, error) {
+	status, err := l.self.inspectLeaderLease(ctx, leaderResp)
+	if err != nil {
+		return false, err
+	}
+	reason := status.Problem
+	if reason == "" {
+		l.orphanedLeader = nil
+		return false, nil
+	}
+
+	orphaned := l.orphanedLeader
+	if orphaned == nil || orphaned.revision != leaderResp.Revision {
+		l.orphanedLeader = &orphanedLeader{revision: leaderResp.Revision, reason: reason, since: time.Now()}
+		l.self.logger.Warn("leader key is orphaned and wait for confirmation", zap.String("reason", reason),
+			zap.Uint64("leader-id", leaderResp.Leader.GetId()), zap.Int64("revision", leaderResp.Revision),
+			zap.Duration("confirm-delay", l.orphanedLeaderConfirmDelay))
+		return false, nil
+	}
+	if time.Since(orphaned.since) < l.orphanedLeaderConfirmDelay {
+		return false, nil
+	}
+
+	l.orphanedLeader = nil
+	deleted, err := l.self.deleteLeaderAtRevision(ctx, leaderResp.Revision)
+	if err != nil {
+		return false, err
+	}
+	if !deleted {
+		l.self.logger.Info("orphaned leader key has been changed", zap.Int64("revision", leaderResp.Revision))
+		return false, nil
+	}
+
+	orphanedLeaderRepairsCounter.Inc()
+	l.self.logger.Warn("delete orphaned leader key", zap.String("reason", reason),
+		zap.Uint64("leader-id", leaderResp.Leader.GetId()), zap.String("leader-name", leaderResp.Leader.GetName()),
+		zap.Int64("revision", leaderResp.Revision), zap.Duration("orphaned", time.Since(orphaned.since)))
+	return true, nil
+}
@@ -18,6 +18,8 @@ const (
 	waitReasonResetLeader = "leader is reset"
 	waitReasonElectLeader = "leader is electing"
 	waitReasonNoWait      = ""
+
+	defaultOrphanedLeaderConfirmDelay = time.Duration(5) * time.Second
 )
 
 type WatchContext interface {
@@ -29,13 +31,20 @@ type LeaderWatcher struct {
 	watchCtx    WatchContext
 	self        *Member
 	leaseTTLSec int64
+
+	// orphanedLeaderConfirmDelay is how long the leader key should stay orphaned before it is deleted.
+	orphanedLeaderConfirmDelay time.Duration
+	// orphanedLeader is the orphaned leader key being confirmed, and it is only accessed by the Watch.
+	orphanedLeader *orphanedLeader
 }
 
 func NewLeaderWatcher(ctx WatchContext, self *Member, leaseTTLSec int64) *LeaderWatcher {
 	return &LeaderWatcher{
-		ctx,
-		self,
-		leaseTTLSec,
+		watchCtx:    ctx,
+		self:        self,
+		leaseTTLSec: leaseTTLSec,
+
+		orphanedLeaderConfirmDelay: defaultOrphanedLeaderConfirmDelay,
 	}
 }
 
@@ -47,6 +56,9 @@ func NewLeaderWatcher(ctx WatchContext, self *Member, leaseTTLSec int64) *Leader
 //   - Elect the etcd leader as the ceresmeta leader.
 //	 - The leader keeps the leadership lease alive.
 //   - The other members keeps waiting for the leader changes.
+//  - Delete the leader key if it stays orphaned longer than the confirmation delay, that is, its lease is absent or its
+//    member is no longer in the etcd cluster, or it names the member itself with a lease not held by the member,
+//    because nobody would reset it.
 func (l *LeaderWatcher) Watch(ctx context.Context) {
 	var wait string
 	logger := log.With(zap.String("self", l.self.Name))
@@ -100,6 +112,18 @@ func (l *LeaderWatcher) Watch(ctx context.Context) {
 			// A new leader should be elected (the leader should be reset by the current leader itself) if the leader is
 			// not the etcd leader.
 			if etcdLeaderID == leaderResp.Leader.Id {
+				// The leader key of the member itself is never kept alive out of the campaign, e.g. it is left bound
+				// to the lease of the previous run of the member, so it would be waited on forever unless repaired.
+				if leaderResp.Leader.Id == l.self.ID {
+					repaired, err := l.repairOrphanedLeader(ctx, leaderResp)
+					if err != nil {
+						logger.Error("fail to repair ghost leader", zap.Error(err))
+						wait = waitReasonFailEtcd
+					} else if !repaired {
+						wait = waitReasonResetLeader
+					}
+					continue
+				}
 				// watch the leader and block until leader changes.
 				l.self.WaitForLeaderChange(ctx, leaderResp.Revision)
 				logger.Warn("leader changes and stop watching")
@@ -115,7 +139,17 @@ func (l *LeaderWatcher) Watch(ctx context.Context) {
 				continue
 			}
 
-			// the leader is not etcd leader and this node is not the leader so just wait a moment and check leader again.
+			// the leader is not etcd leader and this node is not the leader so just wait a moment and check leader again,
+			// unless the leader is orphaned and will never be reset by itself.
+			repaired, err := l.repairOrphanedLeader(ctx, leaderResp)
+			if err != nil {
+				logger.Error("fail to repair orphaned leader", zap.Error(err))
+				wait = waitReasonFailEtcd
+				continue
+			}
+			if repaired {
+				continue
+			}
 			wait = waitReasonResetLeader
 		}
 	}
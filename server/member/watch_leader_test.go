@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/server/v3/embed"
@@ -93,3 +94,101 @@ func TestWatchLeaderSingle(t *testing.T) {
 	assert.NotNil(t, resp)
 	assert.Nil(t, resp.Leader)
 }
+
+func TestRepairOrphanedLeader(t *testing.T) {
+	etcd, client, clean := prepareEtcdServerAndClient(t)
+	defer clean()
+
+	rpcTimeout := time.Duration(10) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	// The leader key is held by a removed member with a lease nobody keeps alive.
+	removed := NewMember("", uint64(etcd.Server.ID())+1, "removed", client, nil, rpcTimeout)
+	leaderVal, err := removed.Marshal()
+	assert.NoError(t, err)
+	lease, err := client.Grant(ctx, 3600)
+	assert.NoError(t, err)
+	_, err = client.Put(ctx, removed.leaderKey, leaderVal, clientv3.WithLease(lease.ID))
+	assert.NoError(t, err)
+
+	watchCtx := &mockWatchCtx{
+		stopped: false,
+		client:  client,
+		srv:     etcd.Server,
+	}
+	leaderGetter := &etcdutil.LeaderGetterWrapper{Server: etcd.Server}
+	mem := NewMember("", uint64(etcd.Server.ID()), "mem0", client, leaderGetter, rpcTimeout)
+	leaderWatcher := NewLeaderWatcher(watchCtx, mem, int64(1))
+	leaderWatcher.orphanedLeaderConfirmDelay = time.Duration(300) * time.Millisecond
+	repairs := testutil.ToFloat64(orphanedLeaderRepairsCounter)
+
+	watchCtx1, cancelWatch := context.WithCancel(context.Background())
+	watchedDone := make(chan struct{}, 1)
+	go func() {
+		leaderWatcher.Watch(watchCtx1)
+		watchedDone <- struct{}{}
+	}()
+	defer func() {
+		cancelWatch()
+		<-watchedDone
+	}()
+
+	// The orphaned leader key is deleted after the confirmation delay and the member becomes the leader.
+	assert.Eventually(t, func() bool {
+		resp, err := mem.GetLeader(ctx)
+		return err == nil && resp.Leader != nil && resp.Leader.Id == mem.ID
+	}, time.Duration(5)*time.Second, time.Duration(50)*time.Millisecond)
+	assert.Equal(t, repairs+1, testutil.ToFloat64(orphanedLeaderRepairsCounter))
+}
+
+func TestLeaderWatchSurvivesCompaction(t *testing.T) {
+	_, client, clean := prepareEtcdServerAndClient(t)
+	defer clean()
+
+	rpcTimeout := time.Duration(10) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	mem := NewMember("", 1, "mem0", client, nil, rpcTimeout)
+	pins := etcdutil.NewRevisionPins()
+	mem.SetRevisionPins(pins)
+	leaderVal, err := mem.Marshal()
+	assert.NoError(t, err)
+	resp, err := client.Put(ctx, mem.leaderKey, leaderVal)
+	assert.NoError(t, err)
+	compacted := testutil.ToFloat64(leaderWatchCompactedCounter)
+
+	watchDone := make(chan struct{})
+	go func() {
+		mem.WaitForLeaderChange(ctx, resp.Header.Revision)
+		close(watchDone)
+	}()
+	assert.Eventually(t, func() bool {
+		_, ok := pins.Min()
+		return ok
+	}, time.Second, time.Millisecond*10)
+
+	// The revisions needed by the watch are kept by the compaction.
+	var current int64
+	for i := 0; i < 20; i++ {
+		resp, err := client.Put(ctx, "/other", "value")
+		assert.NoError(t, err)
+		current = resp.Header.Revision
+	}
+	compactor := etcdutil.NewCompactor(client, etcdutil.CompactionPolicy{RetentionRevisions: 1}, pins, "")
+	result, err := compactor.Compact(ctx)
+	assert.NoError(t, err)
+	assert.Less(t, result.Revision, current-1)
+
+	_, err = client.Delete(ctx, mem.leaderKey)
+	assert.NoError(t, err)
+	select {
+	case <-watchDone:
+	case <-ctx.Done():
+		assert.FailNow(t, "leader change is not observed")
+	}
+	assert.Equal(t, compacted, testutil.ToFloat64(leaderWatchCompactedCounter))
+	_, ok := pins.Min()
+	assert.False(t, ok)
+}
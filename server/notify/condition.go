@@ -0,0 +1,102 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+// ConditionType is the type of a condition of the cluster, whose status transitions are notified.
+type ConditionType string
+
+const (
+	// ConditionClusterDegraded is true if any node is offline or any shard is unassigned too long.
+	ConditionClusterDegraded ConditionType = "ClusterDegraded"
+	// ConditionNodeOffline is true if any registered node is offline.
+	ConditionNodeOffline ConditionType = "NodeOffline"
+	// ConditionShardUnassigned is true if any shard has been owned by no node too long.
+	ConditionShardUnassigned ConditionType = "ShardUnassigned"
+	// ConditionNodeIdentityConflict is true if any node has been started twice with the same identity recently.
+	ConditionNodeIdentityConflict ConditionType = "NodeIdentityConflict"
+	// ConditionShardCapacityInsufficient is true if the total shard capacity of the alive nodes is less than the shards.
+	ConditionShardCapacityInsufficient ConditionType = "ShardCapacityInsufficient"
+)
+
+// ConditionStatus follows the kubernetes conventions, and the status of a condition never observed is unknown.
+type ConditionStatus string
+
+const (
+	ConditionTrue    ConditionStatus = "True"
+	ConditionFalse   ConditionStatus = "False"
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// Event describes a status transition of a condition of the cluster.
+type Event struct {
+	Cluster        string          `json:"cluster"`
+	Condition      ConditionType   `json:"condition"`
+	PreviousStatus ConditionStatus `json:"previous_status"`
+	Status         ConditionStatus `json:"status"`
+	Reason         string          `json:"reason"`
+	Timestamp      time.Time       `json:"timestamp"`
+}
+
+// Notifier delivers the events, and Notify must not block.
+type Notifier interface {
+	Notify(event Event)
+}
+
+type conditionKey struct {
+	cluster   string
+	condition ConditionType
+}
+
+// ConditionTracker remembers the latest status of the conditions and notifies the transitions.
+type ConditionTracker struct {
+	notifier Notifier
+
+	// mu protects the statuses.
+	mu       sync.Mutex
+	statuses map[conditionKey]ConditionStatus
+}
+
+func NewConditionTracker(notifier Notifier) *ConditionTracker {
+	return &ConditionTracker{
+		notifier: notifier,
+		statuses: make(map[conditionKey]ConditionStatus),
+	}
+}
+
+// Update records the status of the condition, and an event is notified if the status is changed.
+func (t *ConditionTracker) Update(cluster string, condition ConditionType, status ConditionStatus, reason string) {
+	t.mu.Lock()
+	key := conditionKey{cluster: cluster, condition: condition}
+	prev, ok := t.statuses[key]
+	if !ok {
+		prev = ConditionUnknown
+	}
+	if prev == status {
+		t.mu.Unlock()
+		return
+	}
+	t.statuses[key] = status
+	t.mu.Unlock()
+
+	t.notifier.Notify(Event{
+		Cluster:        cluster,
+		Condition:      condition,
+		PreviousStatus: prev,
+		Status:         status,
+		Reason:         reason,
+		Timestamp:      time.Now(),
+	})
+}
+
+// StatusOf converts the bool into the status.
+func StatusOf(b bool) ConditionStatus {
+	if b {
+		return ConditionTrue
+	}
+	return ConditionFalse
+}
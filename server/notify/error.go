@@ -0,0 +1,10 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package notify
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrEncodeEvent  = coderr.NewCodeError(coderr.Internal, "encode event")
+	ErrDeliverEvent = coderr.NewCodeError(coderr.Internal, "deliver event to webhook")
+)
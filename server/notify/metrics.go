@@ -0,0 +1,17 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package notify
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var webhookDeadLettersCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "notify",
+		Name:      "webhook_dead_letters_total",
+		Help:      "Number of the events failed to be delivered to the webhook.",
+	})
+
+func init() {
+	prometheus.MustRegister(webhookDeadLettersCounter)
+}
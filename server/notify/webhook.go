@@ -0,0 +1,163 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookMaxAttempts   = 3
+	defaultWebhookRetryInterval = time.Second
+	defaultWebhookTimeout       = time.Second * 5
+	defaultWebhookQueueSize     = 1024
+)
+
+// WebhookConfig configures the WebhookNotifier, and the zero values of the optional fields mean the defaults.
+type WebhookConfig struct {
+	URL string
+	// AuthHeader is the value of the Authorization header of the requests if not empty.
+	AuthHeader    string
+	MaxAttempts   int
+	RetryInterval time.Duration
+	Timeout       time.Duration
+	QueueSize     int
+}
+
+// WebhookNotifier posts the json-encoded events to the webhook in background.
+// The events are dropped as dead letters if the queue is full or all the attempts to deliver them fail, so the
+// notifier never blocks the callers.
+type WebhookNotifier struct {
+	cfg    WebhookConfig
+	client *http.Client
+	queue  chan Event
+
+	deadLetters uint64
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewWebhookNotifier(cfg WebhookConfig) *WebhookNotifier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultWebhookRetryInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultWebhookTimeout
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultWebhookQueueSize
+	}
+
+	n := &WebhookNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan Event, cfg.QueueSize),
+		stopCh: make(chan struct{}),
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+// Notify queues the event without blocking.
+func (n *WebhookNotifier) Notify(event Event) {
+	select {
+	case n.queue <- event:
+	default:
+		n.addDeadLetter(event, ErrDeliverEvent.WithCausef("queue is full, size:%d", n.cfg.QueueSize))
+	}
+}
+
+// DeadLetters returns the number of the events failed to be delivered.
+func (n *WebhookNotifier) DeadLetters() uint64 {
+	return atomic.LoadUint64(&n.deadLetters)
+}
+
+// Close stops the delivery, and the queued events are abandoned.
+func (n *WebhookNotifier) Close() {
+	close(n.stopCh)
+	n.wg.Wait()
+}
+
+func (n *WebhookNotifier) run() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case event := <-n.queue:
+			n.deliver(event)
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliver(event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		n.addDeadLetter(event, ErrEncodeEvent.WithCause(err))
+		return
+	}
+
+	for i := 0; i < n.cfg.MaxAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(n.cfg.RetryInterval):
+			case <-n.stopCh:
+				n.addDeadLetter(event, ErrDeliverEvent.WithCausef("notifier is closed"))
+				return
+			}
+		}
+
+		if err = n.post(body); err == nil {
+			return
+		}
+		log.Warn("fail to deliver event to webhook", zap.String("cluster", event.Cluster),
+			zap.String("condition", string(event.Condition)), zap.Int("attempt", i+1), zap.Error(err))
+	}
+	n.addDeadLetter(event, err)
+}
+
+func (n *WebhookNotifier) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return ErrDeliverEvent.WithCause(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.cfg.AuthHeader != "" {
+		req.Header.Set("Authorization", n.cfg.AuthHeader)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return ErrDeliverEvent.WithCause(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ErrDeliverEvent.WithCausef("unexpected status:%s", resp.Status)
+	}
+	return nil
+}
+
+func (n *WebhookNotifier) addDeadLetter(event Event, err error) {
+	atomic.AddUint64(&n.deadLetters, 1)
+	webhookDeadLettersCounter.Inc()
+	log.Error("drop event as dead letter", zap.String("cluster", event.Cluster),
+		zap.String("condition", string(event.Condition)), zap.String("status", string(event.Status)), zap.Error(err))
+}
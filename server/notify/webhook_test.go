@@ -0,0 +1,96 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const defaultTestTimeout = time.Second * 10
+
+func TestWebhookNotifier(t *testing.T) {
+	re := require.New(t)
+
+	var mu sync.Mutex
+	var events []Event
+	var authHeaders []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := Event{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, event)
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	notifier := NewWebhookNotifier(WebhookConfig{URL: srv.URL, AuthHeader: "Bearer token"})
+	defer notifier.Close()
+	tracker := NewConditionTracker(notifier)
+
+	tracker.Update("c1", ConditionNodeOffline, ConditionTrue, "offline nodes:a")
+	// The unchanged status is not notified.
+	tracker.Update("c1", ConditionNodeOffline, ConditionTrue, "offline nodes:a")
+	tracker.Update("c1", ConditionNodeOffline, ConditionFalse, "")
+
+	re.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2
+	}, defaultTestTimeout, time.Millisecond*10)
+
+	mu.Lock()
+	defer mu.Unlock()
+	re.Equal("c1", events[0].Cluster)
+	re.Equal(ConditionNodeOffline, events[0].Condition)
+	re.Equal(ConditionUnknown, events[0].PreviousStatus)
+	re.Equal(ConditionTrue, events[0].Status)
+	re.Equal("offline nodes:a", events[0].Reason)
+	re.False(events[0].Timestamp.IsZero())
+	re.Equal(ConditionTrue, events[1].PreviousStatus)
+	re.Equal(ConditionFalse, events[1].Status)
+	re.Equal([]string{"Bearer token", "Bearer token"}, authHeaders)
+	re.Equal(uint64(0), notifier.DeadLetters())
+}
+
+func TestWebhookNotifierDownEndpoint(t *testing.T) {
+	re := require.New(t)
+
+	var mu sync.Mutex
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	notifier := NewWebhookNotifier(WebhookConfig{URL: srv.URL, MaxAttempts: 3, RetryInterval: time.Millisecond})
+	defer notifier.Close()
+
+	start := time.Now()
+	notifier.Notify(Event{Cluster: "c1", Condition: ConditionClusterDegraded, Status: ConditionTrue})
+	// Notify never waits for the delivery.
+	re.Less(time.Since(start), time.Second)
+
+	re.Eventually(func() bool { return notifier.DeadLetters() == 1 }, defaultTestTimeout, time.Millisecond*10)
+	mu.Lock()
+	re.Equal(3, attempts)
+	mu.Unlock()
+
+	// The unreachable endpoint is the same as the unavailable one.
+	srv.Close()
+	notifier.Notify(Event{Cluster: "c1", Condition: ConditionClusterDegraded, Status: ConditionFalse})
+	re.Eventually(func() bool { return notifier.DeadLetters() == 2 }, defaultTestTimeout, time.Millisecond*10)
+}
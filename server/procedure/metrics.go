@@ -0,0 +1,18 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package procedure
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var stepDurationHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "procedure",
+		Name:      "step_duration_seconds",
+		Help:      "Wall time spent in the steps by the procedures, summed per procedure and step.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+	}, []string{"type", "step"})
+
+func init() {
+	prometheus.MustRegister(stepDurationHistogram)
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package procedure
+
+import (
+	"context"
+	"time"
+)
+
+// Step is a phase of the execution of a procedure whose wall time is recorded.
+type Step string
+
+const (
+	// StepQueueWait waits for the other DDLs holding the lock of the cluster.
+	StepQueueWait Step = "queue_wait"
+	// StepShardPick picks the shard of a new table.
+	StepShardPick Step = "shard_pick"
+	// StepIDAlloc allocates the id of a new schema or table.
+	StepIDAlloc Step = "id_alloc"
+	// StepDispatch dispatches the changes to the ceresdb servers and waits for their responses.
+	StepDispatch Step = "dispatch"
+	// StepPersist writes the metadata to the etcd.
+	StepPersist Step = "persist"
+	// StepOther is the time not attributed to any step.
+	StepOther Step = "other"
+)
+
+// steps are the steps in the order of the breakdown.
+var steps = []Step{StepQueueWait, StepShardPick, StepIDAlloc, StepDispatch, StepPersist, StepOther}
+
+// StepTiming is the wall time spent in a step, which may be taken several times.
+type StepTiming struct {
+	Step     Step          `json:"step"`
+	Duration time.Duration `json:"duration"`
+	Count    int           `json:"count"`
+}
+
+// Timing is the wall time of a procedure broken down by the steps, and the steps sum up to the total.
+type Timing struct {
+	Total time.Duration `json:"total"`
+	Steps []StepTiming  `json:"steps"`
+}
+
+// stepTimings accumulates the timings of the steps.
+type stepTimings map[Step]StepTiming
+
+func (s stepTimings) add(step Step, d time.Duration, count int) {
+	timing := s[step]
+	timing.Step = step
+	timing.Duration += d
+	timing.Count += count
+	s[step] = timing
+}
+
+// timing returns the breakdown of the total, and the time not attributed to the steps is counted as StepOther.
+func (s stepTimings) timing(total time.Duration) Timing {
+	attributed := time.Duration(0)
+	for step, timing := range s {
+		if step != StepOther {
+			attributed += timing.Duration
+		}
+	}
+	breakdown := make(stepTimings, len(s)+1)
+	for step, timing := range s {
+		breakdown.add(step, timing.Duration, timing.Count)
+	}
+	if other := total - attributed - s[StepOther].Duration; other > 0 {
+		breakdown.add(StepOther, other, 0)
+	}
+
+	result := Timing{Total: total, Steps: make([]StepTiming, 0, len(breakdown))}
+	for _, step := range steps {
+		if timing, ok := breakdown[step]; ok {
+			result.Steps = append(result.Steps, timing)
+		}
+	}
+	return result
+}
+
+// BeginStep records the wall time of the procedure carried by the ctx in the step until the returned end is called,
+// and it does nothing if the ctx carries no procedure. A step begun within another one is attributed to the outer one,
+// so the steps never overlap.
+func BeginStep(ctx context.Context, step Step) func() {
+	p, ok := ctx.Value(inflightKey{}).(*inflight)
+	if !ok {
+		return func() {}
+	}
+
+	p.tracker.mu.Lock()
+	if p.stepping || !p.finishedAt.IsZero() {
+		p.tracker.mu.Unlock()
+		return func() {}
+	}
+	p.stepping = true
+	p.tracker.mu.Unlock()
+
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		p.tracker.mu.Lock()
+		defer p.tracker.mu.Unlock()
+
+		p.stepping = false
+		if p.finishedAt.IsZero() {
+			p.steps.add(step, elapsed, 1)
+		}
+	}
+}
+
+// CurrentTiming returns the timing of the procedure carried by the ctx so far, including the timing carried over by
+// Resume, and false is returned if the ctx carries no procedure.
+func CurrentTiming(ctx context.Context) (Timing, bool) {
+	p, ok := ctx.Value(inflightKey{}).(*inflight)
+	if !ok {
+		return Timing{}, false
+	}
+
+	p.tracker.mu.Lock()
+	defer p.tracker.mu.Unlock()
+
+	return p.timingLocked(time.Now()), true
+}
+
+// Resume carries the timing of the interrupted attempts over to the procedure carried by the ctx, which resumes them,
+// e.g. after the leader of the ceresmeta changes. It does nothing if the ctx carries no procedure.
+func Resume(ctx context.Context, prior Timing) {
+	p, ok := ctx.Value(inflightKey{}).(*inflight)
+	if !ok {
+		return
+	}
+
+	p.tracker.mu.Lock()
+	defer p.tracker.mu.Unlock()
+
+	p.resumed = true
+	p.priorTotal += prior.Total
+	for _, timing := range prior.Steps {
+		p.prior.add(timing.Step, timing.Duration, timing.Count)
+	}
+}
+
+// StorageObserver attributes the etcd calls made by the storage to the procedures carried by their ctx, and it is the
+// observer of the storage.
+type StorageObserver struct{}
+
+// BeginPersist records the write in the StepPersist of the procedure.
+func (StorageObserver) BeginPersist(ctx context.Context) func() {
+	return BeginStep(ctx, StepPersist)
+}
+
+// BeginRateLimitWait marks the procedure as waiting on the rate limit.
+func (StorageObserver) BeginRateLimitWait(ctx context.Context, detail string) func() {
+	return BeginWait(ctx, WaitRateLimit, detail)
+}
@@ -0,0 +1,263 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package procedure
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WaitReason is what an in-flight procedure is waiting on.
+type WaitReason string
+
+const (
+	// WaitClusterLock waits for the other DDLs holding the lock of the cluster.
+	WaitClusterLock WaitReason = "cluster_lock"
+	// WaitShardUnavailable waits for the dead owner of the shard picked for a new table to recover.
+	WaitShardUnavailable WaitReason = "shard_unavailable"
+	// WaitNodeResponse waits for the responses of the ceresdb servers dispatched to.
+	WaitNodeResponse WaitReason = "node_response"
+	// WaitRateLimit waits for the rate limit of the etcd operations.
+	WaitRateLimit WaitReason = "rate_limited"
+	// WaitDropTable waits for the table of the same name being dropped in background to be deleted.
+	WaitDropTable WaitReason = "drop_table"
+	// WaitConcurrency waits for the other procedures to finish under the global limit of the running procedures.
+	WaitConcurrency WaitReason = "procedure_concurrency"
+)
+
+// BlockedProcedure is an in-flight procedure waiting on something. If it waits on several things at once, the innermost
+// wait is reported as the reason, and it has been blocked since the outermost one begins.
+type BlockedProcedure struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Cluster   string    `json:"cluster"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+
+	Reason       WaitReason    `json:"reason"`
+	Detail       string        `json:"detail"`
+	BlockedSince time.Time     `json:"blocked_since"`
+	Waited       time.Duration `json:"waited"`
+}
+
+// Procedure is the record of a procedure tracked, which is kept for a while after it finishes.
+type Procedure struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Cluster   string    `json:"cluster"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	// FinishedAt is nil if the procedure is in flight.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Resumed tells whether the procedure resumes the interrupted attempts, whose timing is included.
+	Resumed bool   `json:"resumed"`
+	Timing  Timing `json:"timing"`
+}
+
+// maxFinishedProcedures is the number of the latest finished procedures kept by the tracker.
+const maxFinishedProcedures = 256
+
+type wait struct {
+	reason WaitReason
+	detail string
+	since  time.Time
+}
+
+type inflight struct {
+	tracker   *Tracker
+	id        uint64
+	typ       string
+	cluster   string
+	target    string
+	startedAt time.Time
+	// Following fields are protected by the lock of the tracker.
+	// waits is the stack of the current waits.
+	waits []*wait
+	// steps are the timings of the steps of this attempt, and prior are the ones carried over from the interrupted
+	// attempts along with their total.
+	steps      stepTimings
+	stepping   bool
+	resumed    bool
+	prior      stepTimings
+	priorTotal time.Duration
+	finishedAt time.Time
+}
+
+func (p *inflight) timingLocked(now time.Time) Timing {
+	if !p.finishedAt.IsZero() {
+		now = p.finishedAt
+	}
+	merged := make(stepTimings, len(p.steps)+len(p.prior))
+	for _, timings := range []stepTimings{p.prior, p.steps} {
+		for step, timing := range timings {
+			merged.add(step, timing.Duration, timing.Count)
+		}
+	}
+	return merged.timing(p.priorTotal + now.Sub(p.startedAt))
+}
+
+func (p *inflight) recordLocked(now time.Time) Procedure {
+	procedure := Procedure{
+		ID:        p.id,
+		Type:      p.typ,
+		Cluster:   p.cluster,
+		Target:    p.target,
+		StartedAt: p.startedAt,
+		Resumed:   p.resumed,
+		Timing:    p.timingLocked(now),
+	}
+	if !p.finishedAt.IsZero() {
+		finishedAt := p.finishedAt
+		procedure.FinishedAt = &finishedAt
+	}
+	return procedure
+}
+
+// observeLocked records the timings of the steps of this attempt, and the carried over ones have been recorded by
+// their own attempts.
+func (p *inflight) observeLocked() {
+	for _, timing := range p.steps.timing(p.finishedAt.Sub(p.startedAt)).Steps {
+		stepDurationHistogram.WithLabelValues(p.typ, string(timing.Step)).Observe(timing.Duration.Seconds())
+	}
+}
+
+type inflightKey struct{}
+
+// Tracker tracks the in-flight procedures and what they are waiting on. The zero value is not usable, but a nil
+// Tracker tracks nothing.
+type Tracker struct {
+	mu        sync.Mutex
+	nextID    uint64
+	inflights map[uint64]*inflight
+	// finished are the latest finished procedures from the oldest.
+	finished []*inflight
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{inflights: make(map[uint64]*inflight)}
+}
+
+// Start tracks the procedure until the returned finish is called, and the waits and the steps begun with the returned
+// context are attributed to it.
+func (t *Tracker) Start(ctx context.Context, typ, cluster, target string) (context.Context, func()) {
+	if t == nil {
+		return ctx, func() {}
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	p := &inflight{
+		tracker:   t,
+		id:        t.nextID,
+		typ:       typ,
+		cluster:   cluster,
+		target:    target,
+		startedAt: time.Now(),
+		steps:     make(stepTimings),
+		prior:     make(stepTimings),
+	}
+	t.inflights[p.id] = p
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, inflightKey{}, p), func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if _, ok := t.inflights[p.id]; !ok {
+			return
+		}
+		delete(t.inflights, p.id)
+		p.finishedAt = time.Now()
+		p.observeLocked()
+		t.finished = append(t.finished, p)
+		if len(t.finished) > maxFinishedProcedures {
+			t.finished = t.finished[len(t.finished)-maxFinishedProcedures:]
+		}
+	}
+}
+
+// Get returns the record of the procedure in flight or finished lately, and false is returned if it is not found.
+func (t *Tracker) Get(id uint64) (Procedure, bool) {
+	if t == nil {
+		return Procedure{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if p, ok := t.inflights[id]; ok {
+		return p.recordLocked(now), true
+	}
+	for _, p := range t.finished {
+		if p.id == id {
+			return p.recordLocked(now), true
+		}
+	}
+	return Procedure{}, false
+}
+
+// BeginWait marks the procedure carried by the ctx as waiting on the reason until the returned end is called, and it
+// does nothing if the ctx carries no procedure.
+func BeginWait(ctx context.Context, reason WaitReason, detail string) func() {
+	p, ok := ctx.Value(inflightKey{}).(*inflight)
+	if !ok {
+		return func() {}
+	}
+
+	w := &wait{reason: reason, detail: detail, since: time.Now()}
+	p.tracker.mu.Lock()
+	p.waits = append(p.waits, w)
+	p.tracker.mu.Unlock()
+
+	return func() {
+		p.tracker.mu.Lock()
+		defer p.tracker.mu.Unlock()
+
+		for i, current := range p.waits {
+			if current == w {
+				p.waits = append(p.waits[:i], p.waits[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// ListBlocked returns the in-flight procedures waiting on something, and the longest waiting one comes first.
+func (t *Tracker) ListBlocked() []BlockedProcedure {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	blocked := make([]BlockedProcedure, 0)
+	for _, p := range t.inflights {
+		if len(p.waits) == 0 {
+			continue
+		}
+		w, since := p.waits[len(p.waits)-1], p.waits[0].since
+		blocked = append(blocked, BlockedProcedure{
+			ID:           p.id,
+			Type:         p.typ,
+			Cluster:      p.cluster,
+			Target:       p.target,
+			StartedAt:    p.startedAt,
+			Reason:       w.reason,
+			Detail:       w.detail,
+			BlockedSince: since,
+			Waited:       now.Sub(since),
+		})
+	}
+	sort.Slice(blocked, func(i, j int) bool {
+		if !blocked[i].BlockedSince.Equal(blocked[j].BlockedSince) {
+			return blocked[i].BlockedSince.Before(blocked[j].BlockedSince)
+		}
+		return blocked[i].ID < blocked[j].ID
+	})
+	return blocked
+}
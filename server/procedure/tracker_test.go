@@ -0,0 +1,137 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package procedure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	re := require.New(t)
+
+	// Nothing is tracked without a tracker.
+	var nilTracker *Tracker
+	ctx, finish := nilTracker.Start(context.Background(), "create_table", "cluster", "public.t0")
+	BeginWait(ctx, WaitClusterLock, "")()
+	finish()
+	re.Empty(nilTracker.ListBlocked())
+
+	tracker := NewTracker()
+	ctx0, finish0 := tracker.Start(context.Background(), "create_table", "cluster", "public.t0")
+	ctx1, finish1 := tracker.Start(context.Background(), "drop_table", "cluster", "public.t1")
+	re.Empty(tracker.ListBlocked())
+
+	// The innermost wait is reported, and the longest waiting procedure comes first.
+	endLock := BeginWait(ctx0, WaitClusterLock, "cluster:1")
+	endRateLimit := BeginWait(ctx1, WaitRateLimit, "write")
+	endNode := BeginWait(ctx0, WaitNodeResponse, "dispatches:2")
+	blocked := tracker.ListBlocked()
+	re.Len(blocked, 2)
+	re.Equal("public.t0", blocked[0].Target)
+	re.Equal(WaitNodeResponse, blocked[0].Reason)
+	re.Equal("public.t1", blocked[1].Target)
+	re.Equal(WaitRateLimit, blocked[1].Reason)
+
+	endNode()
+	blocked = tracker.ListBlocked()
+	re.Equal(WaitClusterLock, blocked[0].Reason)
+	re.Equal("cluster:1", blocked[0].Detail)
+	endLock()
+	blocked = tracker.ListBlocked()
+	re.Len(blocked, 1)
+	re.Equal("drop_table", blocked[0].Type)
+
+	// The finished procedures are never reported.
+	finish1()
+	endRateLimit()
+	re.Empty(tracker.ListBlocked())
+	finish0()
+	BeginWait(ctx0, WaitClusterLock, "")
+	re.Empty(tracker.ListBlocked())
+}
+
+func TestProcedureTiming(t *testing.T) {
+	re := require.New(t)
+
+	tracker := NewTracker()
+	ctx, finish := tracker.Start(context.Background(), "create_table", "cluster", "public.t0")
+	endQueue := BeginStep(ctx, StepQueueWait)
+	time.Sleep(10 * time.Millisecond)
+	endQueue()
+	// The step begun within another one is attributed to the outer one.
+	endAlloc := BeginStep(ctx, StepIDAlloc)
+	BeginStep(ctx, StepPersist)()
+	time.Sleep(10 * time.Millisecond)
+	endAlloc()
+	BeginStep(ctx, StepPersist)()
+	BeginStep(ctx, StepPersist)()
+	time.Sleep(5 * time.Millisecond)
+
+	inflight, ok := tracker.Get(1)
+	re.True(ok)
+	re.Nil(inflight.FinishedAt)
+	finish()
+	// The steps begun after the procedure finishes are ignored.
+	BeginStep(ctx, StepDispatch)()
+
+	record, ok := tracker.Get(1)
+	re.True(ok)
+	re.NotNil(record.FinishedAt)
+	re.False(record.Resumed)
+	timings := make(map[Step]StepTiming)
+	order := make([]Step, 0, len(record.Timing.Steps))
+	sum := time.Duration(0)
+	for _, timing := range record.Timing.Steps {
+		timings[timing.Step] = timing
+		order = append(order, timing.Step)
+		sum += timing.Duration
+	}
+	re.Equal([]Step{StepQueueWait, StepIDAlloc, StepPersist, StepOther}, order)
+	re.GreaterOrEqual(timings[StepQueueWait].Duration, 10*time.Millisecond)
+	re.GreaterOrEqual(timings[StepIDAlloc].Duration, 10*time.Millisecond)
+	re.Equal(2, timings[StepPersist].Count)
+	re.GreaterOrEqual(timings[StepOther].Duration, 5*time.Millisecond)
+	re.Equal(record.Timing.Total, sum)
+	re.Equal(record.FinishedAt.Sub(record.StartedAt), record.Timing.Total)
+	re.Positive(testutil.CollectAndCount(stepDurationHistogram))
+
+	// The resumed procedure carries over the timing of the interrupted attempts.
+	ctx, finish = tracker.Start(context.Background(), "drop_table", "cluster", "public.t1")
+	Resume(ctx, record.Timing)
+	BeginStep(ctx, StepPersist)()
+	current, ok := CurrentTiming(ctx)
+	re.True(ok)
+	re.Greater(current.Total, record.Timing.Total)
+	finish()
+	resumed, ok := tracker.Get(2)
+	re.True(ok)
+	re.True(resumed.Resumed)
+	sum = 0
+	for _, timing := range resumed.Timing.Steps {
+		sum += timing.Duration
+		if timing.Step == StepQueueWait {
+			re.Equal(timings[StepQueueWait], timing)
+		}
+		if timing.Step == StepPersist {
+			re.Equal(3, timing.Count)
+		}
+	}
+	re.Equal(resumed.Timing.Total, sum)
+
+	// The old finished procedures are dropped.
+	for i := 0; i < maxFinishedProcedures; i++ {
+		_, finish := tracker.Start(context.Background(), "create_table", "cluster", "public.t2")
+		finish()
+	}
+	_, ok = tracker.Get(1)
+	re.False(ok)
+	_, ok = tracker.Get(maxFinishedProcedures + 2)
+	re.True(ok)
+	_, ok = CurrentTiming(context.Background())
+	re.False(ok)
+}
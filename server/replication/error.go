@@ -0,0 +1,14 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package replication
+
+import "github.com/CeresDB/ceresmeta/pkg/coderr"
+
+var (
+	ErrReadSource        = coderr.NewCodeError(coderr.Internal, "read replication source")
+	ErrApplyMirror       = coderr.NewCodeError(coderr.Internal, "apply changes to mirror")
+	ErrReadMirror        = coderr.NewCodeError(coderr.Internal, "read mirror")
+	ErrMirrorPromoted    = coderr.NewCodeError(coderr.Conflict, "mirror already promoted")
+	ErrMirrorIncomplete  = coderr.NewCodeError(coderr.Conflict, "mirror incomplete")
+	ErrMirrorNotPromoted = coderr.NewCodeError(coderr.Conflict, "mirror not promoted")
+)
@@ -0,0 +1,35 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package replication
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var appliedRevisionGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "replication",
+		Name:      "applied_revision",
+		Help:      "Revision of the source etcd applied to the mirror.",
+	})
+
+var lagRevisionsGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "replication",
+		Name:      "lag_revisions",
+		Help:      "Number of the revisions of the source etcd not applied to the mirror yet.",
+	})
+
+var resyncsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "replication",
+		Name:      "resyncs_total",
+		Help:      "Number of the full resyncs of the mirror by the reason.",
+	}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(appliedRevisionGauge)
+	prometheus.MustRegister(lagRevisionsGauge)
+	prometheus.MustRegister(resyncsCounter)
+}
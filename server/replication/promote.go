@@ -0,0 +1,163 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// Promotion stamps a mirror as authoritative, after which it is never replicated to.
+type Promotion struct {
+	SourceRoot string `json:"source_root"`
+	// Revision is the revision of the source etcd the mirror is promoted at.
+	Revision   int64     `json:"revision"`
+	PromotedAt time.Time `json:"promoted_at"`
+}
+
+// Verification is the difference between the mirror and the source at the checkpoint revision.
+type Verification struct {
+	Revision int64
+	// Missing, Extra and Different are the keys relative to the root paths.
+	Missing   []string
+	Extra     []string
+	Different []string
+}
+
+func (v *Verification) IsComplete() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Different) == 0
+}
+
+// Verify compares the mirror with the source at the revision of its checkpoint byte by byte, which requires the
+// revision not to be compacted in the source.
+func Verify(ctx context.Context, source *clientv3.Client, sourceRoot string, target *clientv3.Client, targetRoot string) (*Verification, error) {
+	checkpoint, readRevision, err := loadCheckpoint(ctx, target, targetRoot)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint == nil || checkpoint.Syncing {
+		return nil, ErrMirrorIncomplete.WithCausef("mirror is never synced, target root:%s", targetRoot)
+	}
+
+	// The mirror is read at the same revision as the checkpoint, so that it matches the checkpoint even if the
+	// replication is still running.
+	mirrored, err := target.Get(ctx, targetRoot+delimiter, clientv3.WithPrefix(), clientv3.WithRev(readRevision))
+	if err != nil {
+		return nil, ErrReadMirror.WithCause(err)
+	}
+	sourced, err := source.Get(ctx, sourceRoot+delimiter, clientv3.WithPrefix(), clientv3.WithRev(checkpoint.Revision))
+	if err != nil {
+		return nil, ErrReadSource.WithCause(err)
+	}
+
+	values := make(map[string][]byte, len(mirrored.Kvs))
+	for _, kv := range mirrored.Kvs {
+		values[strings.TrimPrefix(string(kv.Key), targetRoot)] = kv.Value
+	}
+	verification := &Verification{Revision: checkpoint.Revision}
+	for _, kv := range sourced.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), sourceRoot)
+		value, ok := values[key]
+		switch {
+		case !ok:
+			verification.Missing = append(verification.Missing, key)
+		case !bytes.Equal(value, kv.Value):
+			verification.Different = append(verification.Different, key)
+		}
+		delete(values, key)
+	}
+	for key := range values {
+		verification.Extra = append(verification.Extra, key)
+	}
+	return verification, nil
+}
+
+// Promote stamps the mirror as authoritative for a new ceresmeta deployment using the root path of the mirror. The
+// mirror must have finished a sync, and it is verified against the source first if the source is still reachable and
+// given. The replicator stops writing the mirror once it is promoted.
+func Promote(ctx context.Context, target *clientv3.Client, targetRoot string, source *clientv3.Client, sourceRoot string) (*Promotion, error) {
+	checkpointKey, promotedKey := targetRoot+checkpointSuffix, targetRoot+promotedSuffix
+	resp, err := target.Get(ctx, checkpointKey)
+	if err != nil {
+		return nil, ErrReadMirror.WithCause(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrMirrorIncomplete.WithCausef("no checkpoint, target root:%s", targetRoot)
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, checkpoint); err != nil {
+		return nil, ErrReadMirror.WithCausef("decode checkpoint, err:%v", err)
+	}
+	if checkpoint.Syncing {
+		return nil, ErrMirrorIncomplete.WithCausef("mirror is being synced, target root:%s", targetRoot)
+	}
+	checkpointModRevision := resp.Kvs[0].ModRevision
+
+	if source != nil {
+		verification, err := Verify(ctx, source, sourceRoot, target, targetRoot)
+		if err != nil {
+			return nil, err
+		}
+		if !verification.IsComplete() {
+			return nil, ErrMirrorIncomplete.WithCausef("revision:%d, missing:%d, extra:%d, different:%d",
+				verification.Revision, len(verification.Missing), len(verification.Extra), len(verification.Different))
+		}
+	}
+
+	promotion := &Promotion{SourceRoot: checkpoint.SourceRoot, Revision: checkpoint.Revision, PromotedAt: time.Now()}
+	value, err := json.Marshal(promotion)
+	if err != nil {
+		return nil, ErrApplyMirror.WithCause(err)
+	}
+	// The checkpoint must not move after the mirror is verified.
+	txnResp, err := target.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(checkpointKey), "=", checkpointModRevision),
+		clientv3.Compare(clientv3.CreateRevision(promotedKey), "=", 0),
+	).Then(clientv3.OpPut(promotedKey, string(value))).Commit()
+	if err != nil {
+		return nil, ErrApplyMirror.WithCause(err)
+	}
+	if !txnResp.Succeeded {
+		if promoted, err := IsPromoted(ctx, target, targetRoot); err == nil && promoted {
+			return nil, ErrMirrorPromoted.WithCausef("target root:%s", targetRoot)
+		}
+		return nil, ErrMirrorIncomplete.WithCausef("mirror is changed during the promotion, target root:%s", targetRoot)
+	}
+
+	log.Info("promote mirror", zap.String("target-root", targetRoot), zap.String("source-root", promotion.SourceRoot),
+		zap.Int64("revision", promotion.Revision))
+	return promotion, nil
+}
+
+// IsPromoted tells whether the mirror under the root path has been promoted.
+func IsPromoted(ctx context.Context, client *clientv3.Client, root string) (bool, error) {
+	resp, err := client.Get(ctx, root+promotedSuffix, clientv3.WithCountOnly())
+	if err != nil {
+		return false, ErrReadMirror.WithCause(err)
+	}
+	return resp.Count > 0, nil
+}
+
+// CheckAuthoritative returns ErrMirrorNotPromoted if the root path holds a mirror which is not promoted, and the
+// ceresmeta must not serve it because it may be incomplete and still be replicated to.
+func CheckAuthoritative(ctx context.Context, client *clientv3.Client, root string) error {
+	checkpoint, _, err := loadCheckpoint(ctx, client, root)
+	if err != nil || checkpoint == nil {
+		return err
+	}
+	promoted, err := IsPromoted(ctx, client, root)
+	if err != nil {
+		return err
+	}
+	if !promoted {
+		return ErrMirrorNotPromoted.WithCausef("root:%s, revision:%d", root, checkpoint.Revision)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+// Package replication mirrors the metadata of the ceresmeta to a standby etcd cluster asynchronously, which can be
+// promoted to serve a new ceresmeta deployment if the primary one is lost.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// The keys of the metadata are under the root path followed by the delimiter, and the keys of the replication are
+	// placed beside the root path of the mirror so that they are never mirrored or compared.
+	delimiter        = "/"
+	checkpointSuffix = ".replication/checkpoint"
+	promotedSuffix   = ".replication/promoted"
+
+	// maxTxnOps is kept below the default limit of the etcd on the operations in a transaction.
+	maxTxnOps = 64
+
+	retryInterval         = time.Second
+	progressCheckInterval = 10 * time.Second
+)
+
+// Checkpoint is the progress of the replication persisted in the mirror along with the changes applied.
+type Checkpoint struct {
+	SourceRoot string `json:"source_root"`
+	// Revision is the revision of the source etcd applied to the mirror.
+	Revision int64 `json:"revision"`
+	// Syncing is set while the mirror is being rebuilt, and the mirror is incomplete until it is cleared.
+	Syncing   bool      `json:"syncing"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Replicator mirrors the keys under the root path of the source etcd to the root path of the target etcd. It resumes
+// from the checkpoint in the target after restarting, and rebuilds the mirror if there is no usable checkpoint or the
+// revision to resume from is compacted.
+type Replicator struct {
+	source     *clientv3.Client
+	sourceRoot string
+	target     *clientv3.Client
+	targetRoot string
+
+	applied int64
+	// promoted is set once the mirror is found promoted, and the replication never writes it again.
+	promoted bool
+}
+
+func NewReplicator(source *clientv3.Client, sourceRoot string, target *clientv3.Client, targetRoot string) *Replicator {
+	return &Replicator{
+		source:     source,
+		sourceRoot: sourceRoot,
+		target:     target,
+		targetRoot: targetRoot,
+	}
+}
+
+// AppliedRevision returns the revision of the source etcd applied to the mirror.
+func (r *Replicator) AppliedRevision() int64 {
+	return atomic.LoadInt64(&r.applied)
+}
+
+// Run replicates the changes until the ctx is done, and the replication is retried after the failures. It stops if the
+// mirror has been promoted, which must never be overwritten.
+func (r *Replicator) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := r.replicate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if r.promoted {
+			log.Error("mirror is promoted, stop replication", zap.String("target-root", r.targetRoot), zap.Error(err))
+			return
+		}
+		log.Warn("replication fails, retry later", zap.String("target-root", r.targetRoot), zap.Error(err))
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (r *Replicator) replicate(ctx context.Context) error {
+	checkpoint, _, err := loadCheckpoint(ctx, r.target, r.targetRoot)
+	if err != nil {
+		return err
+	}
+
+	var revision int64
+	switch {
+	case checkpoint == nil:
+		revision, err = r.resync(ctx, "no_checkpoint")
+	case checkpoint.Syncing:
+		revision, err = r.resync(ctx, "interrupted")
+	case checkpoint.SourceRoot != r.sourceRoot:
+		revision, err = r.resync(ctx, "source_changed")
+	default:
+		revision = checkpoint.Revision
+		r.observe(revision, 0)
+		log.Info("resume replication", zap.String("target-root", r.targetRoot), zap.Int64("revision", revision))
+	}
+	for err == nil {
+		var compacted bool
+		if compacted, err = r.follow(ctx, revision); compacted {
+			revision, err = r.resync(ctx, "compacted")
+		}
+	}
+	return err
+}
+
+// follow applies the changes after the revision until the watch fails, and compacted is set if the changes to apply
+// are compacted.
+func (r *Replicator) follow(ctx context.Context, revision int64) (compacted bool, err error) {
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	// The progress of the watch is requested periodically, so that the lag is cleared even if nothing under the root
+	// path changes.
+	go func() {
+		ticker := time.NewTicker(progressCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.source.RequestProgress(watchCtx); err != nil {
+					log.Warn("fail to request the progress of the replication watch", zap.Error(err))
+				}
+			case <-watchCtx.Done():
+				return
+			}
+		}
+	}()
+
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithRev(revision + 1), clientv3.WithProgressNotify()}
+	for resp := range r.source.Watch(watchCtx, r.sourceRoot+delimiter, opts...) {
+		if resp.CompactRevision != 0 {
+			log.Warn("revision of the replication watch is compacted", zap.String("target-root", r.targetRoot),
+				zap.Int64("revision", revision), zap.Int64("compact-revision", resp.CompactRevision))
+			return true, nil
+		}
+		if err := resp.Err(); err != nil {
+			return false, ErrReadSource.WithCause(err)
+		}
+		if len(resp.Events) == 0 {
+			// All the changes up to the revision of the progress notification have been received.
+			revision = resp.Header.Revision
+			r.observe(revision, resp.Header.Revision)
+			continue
+		}
+
+		// A key may change several times in the events, and only the last change is applied since the etcd rejects the
+		// transactions touching a key twice.
+		ops := make([]clientv3.Op, 0, len(resp.Events))
+		indexes := make(map[string]int, len(resp.Events))
+		for _, event := range resp.Events {
+			key := r.mirrorKey(string(event.Kv.Key))
+			op := clientv3.OpPut(key, string(event.Kv.Value))
+			if event.Type == clientv3.EventTypeDelete {
+				op = clientv3.OpDelete(key)
+			}
+			if i, ok := indexes[key]; ok {
+				ops[i] = op
+				continue
+			}
+			indexes[key] = len(ops)
+			ops = append(ops, op)
+		}
+		// The header revision may be ahead of the events delivered, so the checkpoint is the revision of the last one.
+		applied := resp.Events[len(resp.Events)-1].Kv.ModRevision
+		if err := r.apply(ctx, ops, &Checkpoint{SourceRoot: r.sourceRoot, Revision: applied}); err != nil {
+			return false, err
+		}
+		revision = applied
+		r.observe(revision, resp.Header.Revision)
+	}
+	return false, ErrReadSource.WithCausef("watch is closed, err:%v", ctx.Err())
+}
+
+// resync rebuilds the mirror from a consistent read of the source, and returns the revision of the read. The mirror is
+// marked syncing until it finishes, so an interrupted resync is never mistaken for a complete mirror.
+func (r *Replicator) resync(ctx context.Context, reason string) (int64, error) {
+	log.Info("resync mirror", zap.String("target-root", r.targetRoot), zap.String("reason", reason))
+	resyncsCounter.WithLabelValues(reason).Inc()
+
+	if err := r.apply(ctx, nil, &Checkpoint{SourceRoot: r.sourceRoot, Syncing: true}); err != nil {
+		return 0, err
+	}
+	source, err := r.source.Get(ctx, r.sourceRoot+delimiter, clientv3.WithPrefix())
+	if err != nil {
+		return 0, ErrReadSource.WithCause(err)
+	}
+	mirrored, err := r.target.Get(ctx, r.targetRoot+delimiter, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, ErrReadMirror.WithCause(err)
+	}
+
+	keys := make(map[string]struct{}, len(source.Kvs))
+	ops := make([]clientv3.Op, 0, len(source.Kvs))
+	for _, kv := range source.Kvs {
+		key := r.mirrorKey(string(kv.Key))
+		keys[key] = struct{}{}
+		ops = append(ops, clientv3.OpPut(key, string(kv.Value)))
+	}
+	for _, kv := range mirrored.Kvs {
+		if _, ok := keys[string(kv.Key)]; !ok {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+	}
+	revision := source.Header.Revision
+	if err := r.apply(ctx, ops, &Checkpoint{SourceRoot: r.sourceRoot, Revision: revision}); err != nil {
+		return 0, err
+	}
+	r.observe(revision, revision)
+	return revision, nil
+}
+
+// apply applies the ops to the mirror in the transactions guarded against the promotion, and the checkpoint is put in
+// the last one. The ops already applied are applied again after a failure, which is harmless.
+func (r *Replicator) apply(ctx context.Context, ops []clientv3.Op, checkpoint *Checkpoint) error {
+	checkpoint.UpdatedAt = time.Now()
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return ErrApplyMirror.WithCause(err)
+	}
+	ops = append(ops, clientv3.OpPut(r.targetRoot+checkpointSuffix, string(value)))
+
+	notPromoted := clientv3.Compare(clientv3.CreateRevision(r.targetRoot+promotedSuffix), "=", 0)
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(ops) {
+			end = len(ops)
+		}
+		resp, err := r.target.Txn(ctx).If(notPromoted).Then(ops[start:end]...).Commit()
+		if err != nil {
+			return ErrApplyMirror.WithCause(err)
+		}
+		if !resp.Succeeded {
+			r.promoted = true
+			return ErrMirrorPromoted.WithCausef("target root:%s", r.targetRoot)
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) mirrorKey(key string) string {
+	return r.targetRoot + strings.TrimPrefix(key, r.sourceRoot)
+}
+
+func (r *Replicator) observe(applied, sourceRevision int64) {
+	atomic.StoreInt64(&r.applied, applied)
+	appliedRevisionGauge.Set(float64(applied))
+	lag := int64(0)
+	if sourceRevision > applied {
+		lag = sourceRevision - applied
+	}
+	lagRevisionsGauge.Set(float64(lag))
+}
+
+// loadCheckpoint returns the checkpoint of the mirror and the revision it is read at, and the checkpoint is nil if the
+// mirror has never been replicated to.
+func loadCheckpoint(ctx context.Context, client *clientv3.Client, root string) (*Checkpoint, int64, error) {
+	resp, err := client.Get(ctx, root+checkpointSuffix)
+	if err != nil {
+		return nil, 0, ErrReadMirror.WithCause(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, nil
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, checkpoint); err != nil {
+		return nil, 0, ErrReadMirror.WithCausef("decode checkpoint, err:%v", err)
+	}
+	return checkpoint, resp.Header.Revision, nil
+}
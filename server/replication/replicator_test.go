@@ -0,0 +1,181 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package replication
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+const (
+	defaultTestTimeout = 30 * time.Second
+	testSourceRoot     = "/ceresmeta"
+	testTargetRoot     = "/standby"
+	testClusterName    = "replicated"
+)
+
+func startTestEtcd(t *testing.T) (*clientv3.Client, func()) {
+	re := require.New(t)
+	cfg := etcdutil.NewTestSingleConfig()
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	<-etcd.Server.ReadyNotify()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	return client, func() {
+		_ = client.Close()
+		etcd.Close()
+		etcdutil.CleanConfig(cfg)
+	}
+}
+
+// runReplicator runs a replicator until the returned stop is called, and the returned channel is closed once it stops.
+func runReplicator(ctx context.Context, source, target *clientv3.Client) (stop func(), done chan struct{}) {
+	ctx, cancel := context.WithCancel(ctx)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		NewReplicator(source, testSourceRoot, target, testTargetRoot).Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, done
+}
+
+// mirrored tells whether the keys and values under the root paths are the same byte by byte.
+func mirrored(ctx context.Context, t *testing.T, source, target *clientv3.Client) bool {
+	re := require.New(t)
+	sourced, err := source.Get(ctx, testSourceRoot+delimiter, clientv3.WithPrefix())
+	re.NoError(err)
+	replicated, err := target.Get(ctx, testTargetRoot+delimiter, clientv3.WithPrefix())
+	re.NoError(err)
+	if len(sourced.Kvs) != len(replicated.Kvs) {
+		return false
+	}
+	for i, kv := range sourced.Kvs {
+		if strings.TrimPrefix(string(kv.Key), testSourceRoot) != strings.TrimPrefix(string(replicated.Kvs[i].Key), testTargetRoot) ||
+			!bytes.Equal(kv.Value, replicated.Kvs[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func runDDLs(ctx context.Context, t *testing.T, manager cluster.Manager, from, to int) {
+	re := require.New(t)
+	for i := from; i < to; i++ {
+		name := fmt.Sprintf("table%d", i)
+		_, err := manager.AllocTableID(ctx, testClusterName, "public", name)
+		re.NoError(err)
+		if i%3 == 0 {
+			_, err = manager.AlterTable(ctx, testClusterName, "public", name, 0, []byte(name))
+			re.NoError(err)
+		}
+		if i%4 == 0 {
+			re.NoError(manager.DropTable(ctx, testClusterName, "public", name, false))
+		}
+	}
+}
+
+func TestReplicateAndPromote(t *testing.T) {
+	re := require.New(t)
+	source, cleanSource := startTestEtcd(t)
+	defer cleanSource()
+	target, cleanTarget := startTestEtcd(t)
+	defer cleanTarget()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// The keys beside the root path are never mirrored.
+	_, err := source.Put(ctx, testSourceRoot+"_other/key", "value")
+	re.NoError(err)
+
+	s := storage.NewStorageWithEtcdBackend(source, testSourceRoot, storage.Options{MaxScanLimit: 100, MinScanLimit: 10})
+	manager := cluster.NewManagerImpl(s, testSourceRoot)
+	_, err = manager.CreateCluster(ctx, testClusterName, 1, 1, 4)
+	re.NoError(err)
+	info := &metapb.NodeInfo{Node: "a", Lease: 60}
+	for shardID := uint32(0); shardID < 4; shardID++ {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	re.NoError(manager.RegisterNode(ctx, testClusterName, info))
+	_, err = manager.CreateSchema(ctx, testClusterName, "public", 0)
+	re.NoError(err)
+
+	// A mirror never synced can't be promoted.
+	_, err = Promote(ctx, target, testTargetRoot, source, testSourceRoot)
+	re.True(coderr.Is(err, coderr.Conflict))
+	re.ErrorContains(err, "mirror incomplete")
+
+	// The changes during and after the initial sync are mirrored.
+	stop, _ := runReplicator(ctx, source, target)
+	runDDLs(ctx, t, manager, 0, 40)
+	re.Eventually(func() bool { return mirrored(ctx, t, source, target) }, defaultTestTimeout, 50*time.Millisecond)
+	stop()
+	re.Equal(float64(1), testutil.ToFloat64(resyncsCounter.WithLabelValues("no_checkpoint")))
+
+	// The replication resumes from the checkpoint after restarting.
+	runDDLs(ctx, t, manager, 40, 60)
+	stop, _ = runReplicator(ctx, source, target)
+	re.Eventually(func() bool { return mirrored(ctx, t, source, target) }, defaultTestTimeout, 50*time.Millisecond)
+	stop()
+	re.Equal(float64(1), testutil.ToFloat64(resyncsCounter.WithLabelValues("no_checkpoint")))
+	re.Equal(float64(0), testutil.ToFloat64(resyncsCounter.WithLabelValues("compacted")))
+
+	// The mirror is rebuilt if the revision to resume from is compacted.
+	runDDLs(ctx, t, manager, 60, 70)
+	resp, err := source.Get(ctx, testSourceRoot+"_other/key")
+	re.NoError(err)
+	_, err = source.Compact(ctx, resp.Header.Revision)
+	re.NoError(err)
+	stop, _ = runReplicator(ctx, source, target)
+	re.Eventually(func() bool { return mirrored(ctx, t, source, target) }, defaultTestTimeout, 50*time.Millisecond)
+	re.Equal(float64(1), testutil.ToFloat64(resyncsCounter.WithLabelValues("compacted")))
+	stop()
+	other, err := target.Get(ctx, testTargetRoot+"_other/key")
+	re.NoError(err)
+	re.Empty(other.Kvs)
+
+	// The mirror can't be served until it is promoted, and it is promoted only once.
+	re.True(coderr.Is(CheckAuthoritative(ctx, target, testTargetRoot), coderr.Conflict))
+	re.NoError(CheckAuthoritative(ctx, source, testSourceRoot))
+	verification, err := Verify(ctx, source, testSourceRoot, target, testTargetRoot)
+	re.NoError(err)
+	re.True(verification.IsComplete())
+	promotion, err := Promote(ctx, target, testTargetRoot, source, testSourceRoot)
+	re.NoError(err)
+	re.Equal(testSourceRoot, promotion.SourceRoot)
+	re.Equal(verification.Revision, promotion.Revision)
+	_, err = Promote(ctx, target, testTargetRoot, nil, "")
+	re.ErrorContains(err, "mirror already promoted")
+	re.NoError(CheckAuthoritative(ctx, target, testTargetRoot))
+
+	// The replication stops rather than overwriting the promoted mirror.
+	runDDLs(ctx, t, manager, 70, 71)
+	_, done := runReplicator(ctx, source, target)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		re.FailNow("replicator keeps running on the promoted mirror")
+	}
+	re.False(mirrored(ctx, t, source, target))
+}
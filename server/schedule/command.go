@@ -0,0 +1,128 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+)
+
+// Command is a shard command sent to a node over its heartbeat stream.
+//
+// The protocol has no field for the sequence numbers and the acks, so the sequence number is only known by the
+// ceresmeta, and a command is acked by the heartbeat reporting its effect: an open command is acked once all its
+// shards are reported by the node, and a close command is acked once none of its shards is reported.
+type Command struct {
+	// Seq is increasing in the order of sending, and zero if the command is not tracked.
+	Seq  uint64
+	Node string
+
+	// streams is nil if the command is not tracked.
+	streams *HeartbeatStreams
+	msg     *metapb.NodeHeartbeatResponse
+	done    chan struct{}
+	// err is set before the done is closed.
+	err error
+}
+
+// Wait blocks until the command is acked, and the command is abandoned if the ctx is done before that. The untracked
+// command is done as soon as it is queued for sending.
+func (c *Command) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		if c.streams != nil {
+			c.streams.abandonCommand(c)
+		}
+		return ErrCommandNotAcked.WithCausef("node:%s, seq:%d, err:%v", c.Node, c.Seq, ctx.Err())
+	}
+}
+
+func (c *Command) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// commandShards returns the shards of the command and whether the shards should be reported after it is applied, and
+// false is returned as the last value if the effect of the command can't be observed from the heartbeats.
+func commandShards(msg *metapb.NodeHeartbeatResponse) ([]uint32, bool, bool) {
+	switch cmd := msg.GetCmd().(type) {
+	case *metapb.NodeHeartbeatResponse_OpenCmd:
+		return cmd.OpenCmd.GetShardIds(), true, true
+	case *metapb.NodeHeartbeatResponse_CloseCmd:
+		return cmd.CloseCmd.GetShardIds(), false, true
+	default:
+		return nil, false, false
+	}
+}
+
+// isAckedBy tells whether the effect of the command is observed in the node info.
+func (c *Command) isAckedBy(info *metapb.NodeInfo) bool {
+	shardIDs, reported, _ := commandShards(c.msg)
+	reportedShards := make(map[uint32]struct{}, len(info.GetShardsInfo()))
+	for _, shardInfo := range info.GetShardsInfo() {
+		reportedShards[shardInfo.GetShardId()] = struct{}{}
+	}
+	for _, shardID := range shardIDs {
+		if _, ok := reportedShards[shardID]; ok != reported {
+			return false
+		}
+	}
+	return true
+}
+
+// supportsCommandAck tells whether the binary version of the node is at least the minVersion, and the versions are
+// compared by their dot-separated numeric parts. An empty minVersion disables the tracking for all the nodes.
+func supportsCommandAck(binaryVersion, minVersion string) bool {
+	if minVersion == "" {
+		return false
+	}
+	version, ok := parseVersion(binaryVersion)
+	if !ok {
+		return false
+	}
+	min, ok := parseVersion(minVersion)
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < len(version) || i < len(min); i++ {
+		var v, m uint64
+		if i < len(version) {
+			v = version[i]
+		}
+		if i < len(min) {
+			m = min[i]
+		}
+		if v != m {
+			return v > m
+		}
+	}
+	return true
+}
+
+// parseVersion parses the version like v1.2.3-alpha into [1, 2, 3].
+func parseVersion(version string) ([]uint64, bool) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	if version == "" {
+		return nil, false
+	}
+
+	parts := strings.Split(version, ".")
+	numbers := make([]uint64, 0, len(parts))
+	for _, part := range parts {
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, true
+}
@@ -11,4 +11,12 @@ var (
 	ErrStreamSendMsg          = coderr.NewCodeError(coderr.Internal, "send msg by stream to node")
 	ErrStreamSendTimeout      = coderr.NewCodeError(coderr.Internal, "send msg timeout")
 	ErrHeartbeatStreamsClosed = coderr.NewCodeError(coderr.Internal, "HeartbeatStreams closed")
+	ErrDecodeTopology         = coderr.NewCodeError(coderr.InvalidParams, "decode topology snapshot")
+	ErrNoAvailableNode        = coderr.NewCodeError(coderr.Internal, "no available node")
+	ErrUnknownNode            = coderr.NewCodeError(coderr.InvalidParams, "unknown node")
+	ErrCommandNotAcked        = coderr.NewCodeError(coderr.Internal, "command not acked")
+	ErrInvalidReassign        = coderr.NewCodeError(coderr.InvalidParams, "invalid shard reassignment")
+	ErrNodeConflict           = coderr.NewCodeError(coderr.Conflict, "node identity conflicts")
+	ErrNodeFenced             = coderr.NewCodeError(coderr.Conflict, "node fenced by newcomer")
+	ErrProcedureOverloaded    = coderr.NewCodeError(coderr.ServiceUnavailable, "too many running procedures")
 )
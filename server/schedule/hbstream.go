@@ -28,24 +28,55 @@ type HeartbeatStreams struct {
 	bgJobWg *sync.WaitGroup
 
 	reqCh chan *sendReq
+	// commandAckMinVersion is the min binary version of the nodes whose commands are tracked until acked.
+	commandAckMinVersion string
 
-	// mu protects nodeStreams
+	// mu protects the following fields.
 	mu *sync.RWMutex
 	// TODO: now these streams only can be removed by Unbind method and it is better add a active way to clear the dead
 	//  streams in background.
 	nodeStreams map[string]HeartbeatStreamSender
+	// ackNodes are the nodes negotiated to track the commands by their heartbeats.
+	ackNodes map[string]struct{}
+	// pendingCommands are the unacked commands of the nodes in the order of sending, and they are kept after the
+	// stream is unbound so that they can be resent after the node reconnects.
+	pendingCommands map[string][]*Command
+	// reboundNodes are the nodes whose pending commands should be resent on the new stream.
+	reboundNodes map[string]struct{}
+	lastSeq      uint64
+
+	// conflictPolicy decides how to handle the streams of the same node from different hosts.
+	conflictPolicy NodeConflictPolicy
+	// nodePeers are the peer addresses of the bound streams, and fencedStreams are the streams fenced by the newcomers
+	// of their nodes.
+	nodePeers     map[string]string
+	fencedStreams map[HeartbeatStreamSender]string
+	// conflicts are the latest conflicts of the nodes.
+	conflicts map[string]NodeConflict
 }
 
-func NewHeartbeatStreams(ctx context.Context) *HeartbeatStreams {
+// NewHeartbeatStreams creates the HeartbeatStreams, and the commands sent to the nodes whose binary version is at least
+// commandAckMinVersion are tracked until acked. An empty commandAckMinVersion disables the tracking. The streams of the
+// same node from different hosts are handled by the conflictPolicy.
+func NewHeartbeatStreams(ctx context.Context, commandAckMinVersion string, conflictPolicy NodeConflictPolicy) *HeartbeatStreams {
 	ctx, cancel := context.WithCancel(ctx)
 	h := &HeartbeatStreams{
 		ctx:     ctx,
 		cancel:  cancel,
 		bgJobWg: &sync.WaitGroup{},
 
-		reqCh:       make(chan *sendReq, defaultHeartbeatMsgCap),
-		mu:          &sync.RWMutex{},
-		nodeStreams: make(map[string]HeartbeatStreamSender),
+		reqCh:                make(chan *sendReq, defaultHeartbeatMsgCap),
+		commandAckMinVersion: commandAckMinVersion,
+		mu:                   &sync.RWMutex{},
+		nodeStreams:          make(map[string]HeartbeatStreamSender),
+		ackNodes:             make(map[string]struct{}),
+		pendingCommands:      make(map[string][]*Command),
+		reboundNodes:         make(map[string]struct{}),
+
+		conflictPolicy: conflictPolicy,
+		nodePeers:      make(map[string]string),
+		fencedStreams:  make(map[HeartbeatStreamSender]string),
+		conflicts:      make(map[string]NodeConflict),
 	}
 
 	go h.runBgJob()
@@ -101,7 +132,15 @@ func (h *HeartbeatStreams) Bind(node string, sender HeartbeatStreamSender) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.bindLocked(node, sender)
+	delete(h.nodePeers, node)
+}
+
+func (h *HeartbeatStreams) bindLocked(node string, sender HeartbeatStreamSender) {
 	h.nodeStreams[node] = sender
+	if len(h.pendingCommands[node]) > 0 {
+		h.reboundNodes[node] = struct{}{}
+	}
 }
 
 func (h *HeartbeatStreams) Unbind(node string) {
@@ -109,6 +148,7 @@ func (h *HeartbeatStreams) Unbind(node string) {
 	defer h.mu.Unlock()
 
 	delete(h.nodeStreams, node)
+	delete(h.nodePeers, node)
 }
 
 // SendMsgAsync sends messages to node and this procedure is asynchronous.
@@ -129,8 +169,131 @@ func (h *HeartbeatStreams) SendMsgAsync(ctx context.Context, node string, msg *m
 	}
 }
 
-// Close cancels and waits for all the waiting goroutines.
+// SendCommand sends the shard command to the node asynchronously. The command is tracked until it is acked by the
+// heartbeats if the node has negotiated to do so, otherwise it is done once queued like SendMsgAsync.
+func (h *HeartbeatStreams) SendCommand(ctx context.Context, node string, msg *metapb.NodeHeartbeatResponse) (*Command, error) {
+	cmd := &Command{Node: node, msg: msg, done: make(chan struct{})}
+	_, _, observable := commandShards(msg)
+
+	h.mu.Lock()
+	_, ack := h.ackNodes[node]
+	if ack && observable {
+		h.lastSeq++
+		cmd.Seq = h.lastSeq
+		cmd.streams = h
+		h.pendingCommands[node] = append(h.pendingCommands[node], cmd)
+	}
+	h.mu.Unlock()
+
+	if err := h.SendMsgAsync(ctx, node, msg); err != nil {
+		// The tracked command is resent after the node reconnects.
+		if cmd.streams == nil {
+			return nil, err
+		}
+		log.Warn("fail to send command and wait for resending", zap.String("node", node), zap.Uint64("seq", cmd.Seq),
+			zap.Error(err))
+	}
+	if cmd.streams == nil {
+		cmd.finish(nil)
+	}
+	return cmd, nil
+}
+
+// ObserveHeartbeat negotiates whether to track the commands of the node by its binary version, and acks the pending
+// commands whose effects are reported. The remaining pending commands are resent if the node has reconnected.
+func (h *HeartbeatStreams) ObserveHeartbeat(ctx context.Context, info *metapb.NodeInfo) {
+	node := info.GetNode()
+
+	h.mu.Lock()
+	pending := h.pendingCommands[node]
+	if !supportsCommandAck(info.GetBinaryVersion(), h.commandAckMinVersion) {
+		delete(h.ackNodes, node)
+		delete(h.pendingCommands, node)
+		delete(h.reboundNodes, node)
+		h.mu.Unlock()
+
+		for _, cmd := range pending {
+			cmd.finish(ErrCommandNotAcked.WithCausef("node:%s, seq:%d, node version:%s doesn't support acks", node,
+				cmd.Seq, info.GetBinaryVersion()))
+		}
+		return
+	}
+
+	h.ackNodes[node] = struct{}{}
+	acked := make([]*Command, 0)
+	remained := make([]*Command, 0, len(pending))
+	for _, cmd := range pending {
+		if cmd.isAckedBy(info) {
+			acked = append(acked, cmd)
+		} else {
+			remained = append(remained, cmd)
+		}
+	}
+	h.setPendingCommandsLocked(node, remained)
+	_, rebound := h.reboundNodes[node]
+	delete(h.reboundNodes, node)
+	h.mu.Unlock()
+
+	for _, cmd := range acked {
+		cmd.finish(nil)
+	}
+	if !rebound {
+		return
+	}
+	for _, cmd := range remained {
+		log.Info("resend unacked command", zap.String("node", node), zap.Uint64("seq", cmd.Seq))
+		if err := h.SendMsgAsync(ctx, node, cmd.msg); err != nil {
+			log.Error("fail to resend command", zap.String("node", node), zap.Uint64("seq", cmd.Seq), zap.Error(err))
+		}
+	}
+}
+
+// ListPendingCommands lists the sequence numbers of the unacked commands of the node in the order of sending.
+func (h *HeartbeatStreams) ListPendingCommands(node string) []uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	seqs := make([]uint64, 0, len(h.pendingCommands[node]))
+	for _, cmd := range h.pendingCommands[node] {
+		seqs = append(seqs, cmd.Seq)
+	}
+	return seqs
+}
+
+func (h *HeartbeatStreams) abandonCommand(cmd *Command) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pending := h.pendingCommands[cmd.Node]
+	remained := make([]*Command, 0, len(pending))
+	for _, c := range pending {
+		if c != cmd {
+			remained = append(remained, c)
+		}
+	}
+	h.setPendingCommandsLocked(cmd.Node, remained)
+}
+
+func (h *HeartbeatStreams) setPendingCommandsLocked(node string, pending []*Command) {
+	if len(pending) > 0 {
+		h.pendingCommands[node] = pending
+		return
+	}
+	delete(h.pendingCommands, node)
+}
+
+// Close cancels and waits for all the waiting goroutines, and the pending commands fail.
 func (h *HeartbeatStreams) Close() {
 	h.cancel()
 	h.bgJobWg.Wait()
+
+	h.mu.Lock()
+	pendingCommands := h.pendingCommands
+	h.pendingCommands = make(map[string][]*Command)
+	h.mu.Unlock()
+	for _, pending := range pendingCommands {
+		for _, cmd := range pending {
+			cmd.finish(ErrHeartbeatStreamsClosed)
+		}
+	}
 }
@@ -0,0 +1,142 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+const defaultTestTimeout = time.Second * 5
+
+type mockStream struct {
+	msgs chan *metapb.NodeHeartbeatResponse
+}
+
+func newMockStream() *mockStream {
+	return &mockStream{msgs: make(chan *metapb.NodeHeartbeatResponse, 16)}
+}
+
+func (s *mockStream) Send(msg *metapb.NodeHeartbeatResponse) error {
+	s.msgs <- msg
+	return nil
+}
+
+func (s *mockStream) recv(t *testing.T) *metapb.NodeHeartbeatResponse {
+	select {
+	case msg := <-s.msgs:
+		return msg
+	case <-time.After(defaultTestTimeout):
+		require.FailNow(t, "no message is received")
+		return nil
+	}
+}
+
+func openCmd(shardIDs ...uint32) *metapb.NodeHeartbeatResponse {
+	return &metapb.NodeHeartbeatResponse{Cmd: &metapb.NodeHeartbeatResponse_OpenCmd{OpenCmd: &metapb.OpenCmd{ShardIds: shardIDs}}}
+}
+
+func nodeInfo(node, version string, shardIDs ...uint32) *metapb.NodeInfo {
+	info := &metapb.NodeInfo{Node: node, BinaryVersion: version}
+	for _, shardID := range shardIDs {
+		info.ShardsInfo = append(info.ShardsInfo, &metapb.ShardInfo{ShardId: shardID, Role: metapb.ShardRole_LEADER})
+	}
+	return info
+}
+
+func TestCommandAckAfterReconnect(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	h := NewHeartbeatStreams(ctx, "1.2.0", NodeConflictFence)
+	defer h.Close()
+
+	stream := newMockStream()
+	h.Bind("a", stream)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "v1.3.0"))
+
+	cmd1, err := h.SendCommand(ctx, "a", openCmd(1))
+	re.NoError(err)
+	cmd2, err := h.SendCommand(ctx, "a", openCmd(2, 3))
+	re.NoError(err)
+	re.Less(cmd1.Seq, cmd2.Seq)
+	re.Equal(openCmd(1).String(), stream.recv(t).String())
+	re.Equal(openCmd(2, 3).String(), stream.recv(t).String())
+
+	// The stream breaks after the first command is applied.
+	h.Unbind("a")
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "v1.3.0", 1))
+	re.NoError(cmd1.Wait(ctx))
+	re.Equal([]uint64{cmd2.Seq}, h.ListPendingCommands("a"))
+
+	// Only the unacked command is resent on the new stream.
+	newStream := newMockStream()
+	h.Bind("a", newStream)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "v1.3.0", 1, 2))
+	re.Equal(openCmd(2, 3).String(), newStream.recv(t).String())
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Millisecond*10)
+	re.True(coderr.Is(cmd2.Wait(waitCtx), coderr.Internal))
+	waitCancel()
+	re.Empty(h.ListPendingCommands("a"))
+
+	cmd3, err := h.SendCommand(ctx, "a", openCmd(4))
+	re.NoError(err)
+	newStream.recv(t)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "v1.3.0", 1, 2, 3, 4))
+	re.NoError(cmd3.Wait(ctx))
+
+	// No message is resent without reconnecting.
+	select {
+	case msg := <-newStream.msgs:
+		re.FailNow("unexpected message", msg.String())
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestCommandWithoutAck(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	h := NewHeartbeatStreams(ctx, "1.2.0", NodeConflictFence)
+	defer h.Close()
+
+	stream := newMockStream()
+	h.Bind("a", stream)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "1.1.9"))
+
+	// The node of an old version falls back to the fire-and-forget commands.
+	cmd, err := h.SendCommand(ctx, "a", openCmd(1))
+	re.NoError(err)
+	re.NoError(cmd.Wait(ctx))
+	re.Zero(cmd.Seq)
+	re.Empty(h.ListPendingCommands("a"))
+	stream.recv(t)
+
+	// The pending commands fail if the node is downgraded.
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "1.2.0"))
+	cmd, err = h.SendCommand(ctx, "a", openCmd(2))
+	re.NoError(err)
+	stream.recv(t)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "1.1.9"))
+	re.True(coderr.Is(cmd.Wait(ctx), coderr.Internal))
+	re.Empty(h.ListPendingCommands("a"))
+}
+
+func TestSupportsCommandAck(t *testing.T) {
+	re := require.New(t)
+
+	re.False(supportsCommandAck("1.2.0", ""))
+	re.True(supportsCommandAck("1.2.0", "1.2.0"))
+	re.True(supportsCommandAck("v1.10.0-alpha", "1.2"))
+	re.True(supportsCommandAck("2", "1.2.3"))
+	re.False(supportsCommandAck("1.1.9", "1.2.0"))
+	re.False(supportsCommandAck("", "1.2.0"))
+	re.False(supportsCommandAck("dev", "1.2.0"))
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type heartbeatTask struct {
+	ctx  context.Context
+	fn   func(ctx context.Context)
+	done chan struct{}
+}
+
+// detachedContext keeps the values of the parent but is never done, so the heartbeat run after its caller gives up
+// is not canceled along with the caller.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+// HeartbeatPool runs the slow path of the heartbeats on a bounded number of workers dedicated to the heartbeats, so
+// that they never compete with the other requests for the goroutines. Every heartbeat reports the full state of the
+// node, so a node keeps at most one queued heartbeat, which is replaced by the newer one, and the heartbeat is dropped
+// if the queue is full because the next one of the node carries the same state.
+type HeartbeatPool struct {
+	workers   int
+	queueSize int
+	wg        sync.WaitGroup
+
+	// mu protects the following fields, and cond is signaled when a task is queued or the pool is closed.
+	mu   sync.Mutex
+	cond *sync.Cond
+	// nodes are the nodes having queued tasks in FIFO order.
+	nodes  []string
+	tasks  map[string]*heartbeatTask
+	closed bool
+}
+
+func NewHeartbeatPool(workers, queueSize int) *HeartbeatPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	p := &HeartbeatPool{
+		workers:   workers,
+		queueSize: queueSize,
+		tasks:     make(map[string]*heartbeatTask),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.runWorker()
+	}
+	return p
+}
+
+// Process queues the fn handling the heartbeat of the node and waits for it until the timeout or the ctx is done, and
+// false is returned if the fn isn't done by then. The fn not done is still run later unless it is replaced by a newer
+// heartbeat of the node, and it is never run if the queue is full or the pool is closed. The fn is called with a ctx
+// carrying the values of the ctx but never canceled by it, which should be bounded by the fn itself.
+func (p *HeartbeatPool) Process(ctx context.Context, node string, timeout time.Duration, fn func(ctx context.Context)) bool {
+	task := &heartbeatTask{ctx: detachedContext{ctx}, fn: fn, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return false
+	}
+	if old, ok := p.tasks[node]; ok {
+		// The replaced heartbeat is superseded by the newer one, which carries its state too.
+		close(old.done)
+	} else {
+		if len(p.nodes) >= p.queueSize {
+			p.mu.Unlock()
+			return false
+		}
+		p.nodes = append(p.nodes, node)
+	}
+	p.tasks[node] = task
+	p.cond.Signal()
+	p.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-task.done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Queued returns the number of the heartbeats waiting for the workers.
+func (p *HeartbeatPool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.nodes)
+}
+
+// Close stops the workers after the running heartbeats are done, and the queued ones are dropped.
+func (p *HeartbeatPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.nodes = nil
+	p.tasks = make(map[string]*heartbeatTask)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *HeartbeatPool) runWorker() {
+	defer p.wg.Done()
+
+	for {
+		p.mu.Lock()
+		for len(p.nodes) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		node := p.nodes[0]
+		p.nodes = p.nodes[1:]
+		task := p.tasks[node]
+		delete(p.tasks, node)
+		p.mu.Unlock()
+
+		task.fn(task.ctx)
+		close(task.done)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatPool(t *testing.T) {
+	re := require.New(t)
+
+	pool := NewHeartbeatPool(1, 2)
+	defer pool.Close()
+
+	ctx := context.Background()
+	re.True(pool.Process(ctx, "a", time.Second, func(ctx context.Context) {
+		// The fn is never canceled along with its caller.
+		re.NoError(ctx.Err())
+	}))
+
+	// Block the only worker, and the heartbeat not done before the timeout is still run later.
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	go pool.Process(ctx, "blocker", time.Minute, func(context.Context) {
+		close(blocked)
+		<-release
+	})
+	<-blocked
+
+	var runs, replaced int32
+	re.False(pool.Process(ctx, "a", 10*time.Millisecond, func(context.Context) { atomic.AddInt32(&replaced, 1) }))
+	re.Equal(1, pool.Queued())
+
+	// The newer heartbeat of the same node replaces the queued one, whose caller is released at once.
+	done := make(chan bool)
+	go func() {
+		done <- pool.Process(ctx, "a", time.Minute, func(context.Context) { atomic.AddInt32(&runs, 1) })
+	}()
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	re.False(pool.Process(canceledCtx, "b", time.Minute, func(context.Context) { atomic.AddInt32(&runs, 1) }))
+	re.Eventually(func() bool { return pool.Queued() == 2 }, time.Second, time.Millisecond)
+
+	// The heartbeat of another node is dropped once the queue is full.
+	re.False(pool.Process(ctx, "c", time.Minute, func(context.Context) { t.Error("dropped heartbeat is run") }))
+
+	close(release)
+	re.True(<-done)
+	re.Eventually(func() bool { return atomic.LoadInt32(&runs) == 2 }, time.Second, time.Millisecond)
+	re.Equal(int32(0), atomic.LoadInt32(&replaced))
+	re.Equal(0, pool.Queued())
+
+	pool.Close()
+	re.False(pool.Process(ctx, "a", time.Second, func(context.Context) { t.Error("heartbeat is run after close") }))
+}
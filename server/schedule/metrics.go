@@ -0,0 +1,97 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The paths the heartbeats are handled by.
+const (
+	// HeartbeatPathFast only records the liveness of the node without the lock of the cluster.
+	HeartbeatPathFast = "fast"
+	// HeartbeatPathSlow registers the node on the HeartbeatPool.
+	HeartbeatPathSlow = "slow"
+	// HeartbeatPathDeferred acks the heartbeat failing to be registered within the deadline.
+	HeartbeatPathDeferred = "deferred"
+)
+
+var (
+	nodeConflictsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "node_conflicts_total",
+			Help:      "Number of the heartbeat streams of the same node from different hosts.",
+		}, []string{"policy"})
+
+	heartbeatLatencyHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "heartbeat_latency_seconds",
+			Help:      "Latency of handling the heartbeats by the path.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"path"})
+
+	heartbeatSLOViolationsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "heartbeat_slo_violations_total",
+			Help:      "Number of the heartbeats handled slower than the latency SLO by the path.",
+		}, []string{"path"})
+
+	runningProceduresGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "running_procedures",
+			Help:      "Number of the procedures admitted by the global procedure limit and still running.",
+		})
+
+	queuedProceduresGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "queued_procedures",
+			Help:      "Number of the procedures waiting for the global procedure limit.",
+		})
+
+	proceduresAdmittedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "procedure_admissions_total",
+			Help:      "Number of the procedures admitted at once, after being queued, or rejected by the global procedure limit.",
+		}, []string{"priority", "result"})
+
+	pendingShardOpensGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ceresmeta",
+			Subsystem: "schedule",
+			Name:      "pending_shard_opens",
+			Help:      "Number of the shards waiting to be sent to their nodes for opening.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(nodeConflictsCounter)
+	prometheus.MustRegister(heartbeatLatencyHistogram)
+	prometheus.MustRegister(heartbeatSLOViolationsCounter)
+	prometheus.MustRegister(runningProceduresGauge)
+	prometheus.MustRegister(queuedProceduresGauge)
+	prometheus.MustRegister(proceduresAdmittedCounter)
+	prometheus.MustRegister(pendingShardOpensGauge)
+}
+
+// ObserveHeartbeatLatency records the latency of the heartbeat handled by the path against the SLO, and zero SLO
+// disables the check.
+func ObserveHeartbeatLatency(path string, latency, slo time.Duration) {
+	heartbeatLatencyHistogram.WithLabelValues(path).Observe(latency.Seconds())
+	if slo > 0 && latency > slo {
+		heartbeatSLOViolationsCounter.WithLabelValues(path).Inc()
+	}
+}
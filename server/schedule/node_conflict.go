@@ -0,0 +1,132 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"net"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// NodeConflictPolicy decides how to handle the heartbeat streams of the same node from different hosts, which means
+// the node is started twice with the same identity.
+type NodeConflictPolicy string
+
+const (
+	// NodeConflictReject rejects the stream of the newcomer until the stream of the existing node is closed.
+	NodeConflictReject NodeConflictPolicy = "reject"
+	// NodeConflictFence binds the stream of the newcomer, and the stream of the existing node is closed on its next
+	// heartbeat.
+	NodeConflictFence NodeConflictPolicy = "fence"
+	// NodeConflictIgnore only logs the conflict, and the stream of the newcomer replaces the existing one.
+	NodeConflictIgnore NodeConflictPolicy = "ignore"
+)
+
+// IsValid tells whether the policy is known.
+func (p NodeConflictPolicy) IsValid() bool {
+	switch p {
+	case NodeConflictReject, NodeConflictFence, NodeConflictIgnore:
+		return true
+	default:
+		return false
+	}
+}
+
+// NodeConflict is the conflict between the streams of the same node from different hosts.
+type NodeConflict struct {
+	Node         string             `json:"node"`
+	ExistingPeer string             `json:"existing_peer"`
+	NewPeer      string             `json:"new_peer"`
+	Policy       NodeConflictPolicy `json:"policy"`
+	DetectedAt   time.Time          `json:"detected_at"`
+}
+
+// BindFromPeer binds the stream from the peer address to the node. The stream conflicts with the one bound to the node
+// if they come from different hosts, and the conflict is handled by the policy, which may reject the stream with
+// ErrNodeConflict. The streams from the same host are never conflicting because the node only reconnects then.
+func (h *HeartbeatStreams) BindFromPeer(node, peer string, sender HeartbeatStreamSender) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, ok := h.nodeStreams[node]
+	existingPeer := h.nodePeers[node]
+	if ok && existing != sender && isDifferentHost(existingPeer, peer) {
+		conflict := NodeConflict{
+			Node:         node,
+			ExistingPeer: existingPeer,
+			NewPeer:      peer,
+			Policy:       h.conflictPolicy,
+			DetectedAt:   time.Now(),
+		}
+		h.conflicts[node] = conflict
+		nodeConflictsCounter.WithLabelValues(string(h.conflictPolicy)).Inc()
+		log.Error("node identity conflicts", zap.String("node", node), zap.String("existing-peer", existingPeer),
+			zap.String("new-peer", peer), zap.String("policy", string(h.conflictPolicy)))
+
+		switch h.conflictPolicy {
+		case NodeConflictReject:
+			return ErrNodeConflict.WithCausef("node:%s, existing peer:%s, new peer:%s", node, existingPeer, peer)
+		case NodeConflictFence:
+			h.fencedStreams[existing] = node
+		case NodeConflictIgnore:
+		}
+	}
+
+	h.bindLocked(node, sender)
+	h.nodePeers[node] = peer
+	return nil
+}
+
+// CheckStream returns ErrNodeFenced if the stream has been fenced by a newcomer of the node.
+func (h *HeartbeatStreams) CheckStream(node string, sender HeartbeatStreamSender) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, ok := h.fencedStreams[sender]; ok {
+		return ErrNodeFenced.WithCausef("node:%s, peer:%s", node, h.nodePeers[node])
+	}
+	return nil
+}
+
+// UnbindStream unbinds the stream from the node only if it is still bound, so that the closed stream of a fenced or
+// replaced node never unbinds the stream of the newcomer.
+func (h *HeartbeatStreams) UnbindStream(node string, sender HeartbeatStreamSender) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.fencedStreams, sender)
+	if h.nodeStreams[node] == sender {
+		delete(h.nodeStreams, node)
+		delete(h.nodePeers, node)
+	}
+}
+
+// NodeConflicts lists the latest conflicts of the nodes detected after the since.
+func (h *HeartbeatStreams) NodeConflicts(since time.Time) []NodeConflict {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	conflicts := make([]NodeConflict, 0, len(h.conflicts))
+	for _, conflict := range h.conflicts {
+		if conflict.DetectedAt.After(since) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
+
+// isDifferentHost tells whether the peer addresses are known and from different hosts.
+func isDifferentHost(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	hostOf := func(addr string) string {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			return host
+		}
+		return addr
+	}
+	return hostOf(a) != hostOf(b)
+}
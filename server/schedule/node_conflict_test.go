@@ -0,0 +1,60 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeConflict(t *testing.T) {
+	for _, policy := range []NodeConflictPolicy{NodeConflictReject, NodeConflictFence, NodeConflictIgnore} {
+		t.Run(string(policy), func(t *testing.T) {
+			re := require.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+			defer cancel()
+
+			h := NewHeartbeatStreams(ctx, "", policy)
+			defer h.Close()
+
+			// The node reconnecting from the same host doesn't conflict.
+			oldStream, reconnected, newcomer := newMockStream(), newMockStream(), newMockStream()
+			re.NoError(h.BindFromPeer("a", "10.0.0.1:1000", oldStream))
+			re.NoError(h.BindFromPeer("a", "10.0.0.1:1001", reconnected))
+			re.Empty(h.NodeConflicts(time.Time{}))
+
+			before := testutil.ToFloat64(nodeConflictsCounter.WithLabelValues(string(policy)))
+			err := h.BindFromPeer("a", "10.0.0.2:1000", newcomer)
+			conflicts := h.NodeConflicts(time.Time{})
+			re.Len(conflicts, 1)
+			re.Equal("10.0.0.1:1001", conflicts[0].ExistingPeer)
+			re.Equal("10.0.0.2:1000", conflicts[0].NewPeer)
+			re.Equal(before+1, testutil.ToFloat64(nodeConflictsCounter.WithLabelValues(string(policy))))
+
+			switch policy {
+			case NodeConflictReject:
+				re.True(coderr.Is(err, coderr.Conflict))
+				re.Equal(reconnected, h.getStream("a"))
+				re.NoError(h.CheckStream("a", reconnected))
+			case NodeConflictFence:
+				re.NoError(err)
+				re.Equal(newcomer, h.getStream("a"))
+				re.True(coderr.Is(h.CheckStream("a", reconnected), coderr.Conflict))
+				// The closed stream of the fenced node doesn't unbind the newcomer.
+				h.UnbindStream("a", reconnected)
+				re.Equal(newcomer, h.getStream("a"))
+				re.NoError(h.CheckStream("a", newcomer))
+			case NodeConflictIgnore:
+				re.NoError(err)
+				re.Equal(newcomer, h.getStream("a"))
+				re.NoError(h.CheckStream("a", reconnected))
+			}
+			re.Empty(h.NodeConflicts(time.Now()))
+		})
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// TopologySnapshot is an in-memory snapshot of the shard assignment of a cluster, and the planners only operate on it
+// so that they can run without etcd or network.
+type TopologySnapshot struct {
+	Nodes []string `json:"nodes"`
+	// Shards maps the shard id to the node owning it, and the empty node means the shard is not assigned.
+	Shards map[uint32]string `json:"shards"`
+	// AffinityGroups maps the shard id to the anti-affinity groups of its tables, and the planners avoid placing the
+	// shards sharing a group on the same node.
+	AffinityGroups map[uint32][]uint64 `json:"affinity_groups,omitempty"`
+	// Capacities maps the node to the max number of the shards it may own, which the planners never exceed and balance
+	// the shards in proportion to. The nodes without a capacity are unlimited, and they are weighted as the largest
+	// capacity of the others in the balancing.
+	Capacities map[string]int `json:"capacities,omitempty"`
+}
+
+// LoadTopologySnapshot decodes the json-encoded topology snapshot.
+func LoadTopologySnapshot(r io.Reader) (*TopologySnapshot, error) {
+	snapshot := &TopologySnapshot{}
+	if err := json.NewDecoder(r).Decode(snapshot); err != nil {
+		return nil, ErrDecodeTopology.WithCause(err)
+	}
+	if snapshot.Shards == nil {
+		snapshot.Shards = make(map[uint32]string)
+	}
+
+	nodes := make(map[string]struct{}, len(snapshot.Nodes))
+	for _, node := range snapshot.Nodes {
+		nodes[node] = struct{}{}
+	}
+	for shardID, node := range snapshot.Shards {
+		if _, ok := nodes[node]; node != "" && !ok {
+			return nil, ErrDecodeTopology.WithCausef("shard:%d is assigned to unknown node:%s", shardID, node)
+		}
+	}
+	return snapshot, nil
+}
+
+// Clone returns a deep copy of the snapshot.
+func (t *TopologySnapshot) Clone() *TopologySnapshot {
+	nodes := make([]string, len(t.Nodes))
+	copy(nodes, t.Nodes)
+	shards := make(map[uint32]string, len(t.Shards))
+	for shardID, node := range t.Shards {
+		shards[shardID] = node
+	}
+	var groups map[uint32][]uint64
+	if t.AffinityGroups != nil {
+		groups = make(map[uint32][]uint64, len(t.AffinityGroups))
+		for shardID, shardGroups := range t.AffinityGroups {
+			groups[shardID] = append([]uint64(nil), shardGroups...)
+		}
+	}
+	var capacities map[string]int
+	if t.Capacities != nil {
+		capacities = make(map[string]int, len(t.Capacities))
+		for node, capacity := range t.Capacities {
+			capacities[node] = capacity
+		}
+	}
+	return &TopologySnapshot{Nodes: nodes, Shards: shards, AffinityGroups: groups, Capacities: capacities}
+}
+
+// SortedShardIDs returns the ids of all the shards in ascending order.
+func (t *TopologySnapshot) SortedShardIDs() []uint32 {
+	shardIDs := make([]uint32, 0, len(t.Shards))
+	for shardID := range t.Shards {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Slice(shardIDs, func(i, j int) bool { return shardIDs[i] < shardIDs[j] })
+	return shardIDs
+}
+
+// NodeShards returns the shards owned by every node, and the shard ids are in ascending order.
+func (t *TopologySnapshot) NodeShards() map[string][]uint32 {
+	nodeShards := make(map[string][]uint32, len(t.Nodes))
+	for _, node := range t.Nodes {
+		nodeShards[node] = []uint32{}
+	}
+	for _, shardID := range t.SortedShardIDs() {
+		if node := t.Shards[shardID]; node != "" {
+			nodeShards[node] = append(nodeShards[node], shardID)
+		}
+	}
+	return nodeShards
+}
+
+// Apply applies the moves of the plan to the snapshot, unassigns the unplaced shards and removes the offline nodes of
+// the plan.
+func (t *TopologySnapshot) Apply(plan *Plan) {
+	for _, move := range plan.Moves {
+		t.Shards[move.ShardID] = move.To
+	}
+	for _, shardID := range plan.Unplaced {
+		t.Shards[shardID] = ""
+	}
+
+	if len(plan.OfflineNodes) == 0 {
+		return
+	}
+	offline := make(map[string]struct{}, len(plan.OfflineNodes))
+	for _, node := range plan.OfflineNodes {
+		offline[node] = struct{}{}
+	}
+	nodes := make([]string, 0, len(t.Nodes))
+	for _, node := range t.Nodes {
+		if _, ok := offline[node]; !ok {
+			nodes = append(nodes, node)
+		}
+	}
+	t.Nodes = nodes
+}
+
+// ShardMove moves the shard from one node to another, and the empty From means the shard is not assigned before.
+type ShardMove struct {
+	ShardID uint32 `json:"shard_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type Plan struct {
+	Planner string      `json:"planner"`
+	Moves   []ShardMove `json:"moves"`
+	// OfflineNodes are the nodes which should not own any shard after the plan is applied.
+	OfflineNodes []string `json:"offline_nodes,omitempty"`
+	// Unplaced are the shards left unassigned because no node has the capacity for them.
+	Unplaced []uint32 `json:"unplaced,omitempty"`
+}
+
+// Planner makes a plan to change the shard assignment according to the topology snapshot, and the snapshot must not be
+// modified by the planner.
+type Planner interface {
+	Name() string
+	Plan(snapshot *TopologySnapshot) (*Plan, error)
+}
+
+// nodeLoads tracks the number of shards on every alive node during planning, and the loads are compared by the ratio
+// of the number of the shards to the weight of the node.
+type nodeLoads struct {
+	nodes  []string
+	counts map[string]int
+	// capacities of the limited nodes, and weights of all the nodes.
+	capacities map[string]int
+	weights    map[string]int
+}
+
+func newNodeLoads(snapshot *TopologySnapshot, excluded string) *nodeLoads {
+	loads := &nodeLoads{
+		counts:     make(map[string]int, len(snapshot.Nodes)),
+		capacities: make(map[string]int, len(snapshot.Capacities)),
+		weights:    make(map[string]int, len(snapshot.Nodes)),
+	}
+	unlimitedWeight := 1
+	for _, node := range snapshot.Nodes {
+		if node == excluded {
+			continue
+		}
+		loads.nodes = append(loads.nodes, node)
+		loads.counts[node] = 0
+		if capacity, ok := snapshot.Capacities[node]; ok && capacity > 0 {
+			loads.capacities[node] = capacity
+			if capacity > unlimitedWeight {
+				unlimitedWeight = capacity
+			}
+		}
+	}
+	for _, node := range loads.nodes {
+		loads.weights[node] = unlimitedWeight
+		if capacity, ok := loads.capacities[node]; ok {
+			loads.weights[node] = capacity
+		}
+	}
+	for _, node := range snapshot.Shards {
+		if _, ok := loads.counts[node]; ok {
+			loads.counts[node]++
+		}
+	}
+	return loads
+}
+
+// hasRoom tells whether the node can own one more shard.
+func (l *nodeLoads) hasRoom(node string) bool {
+	capacity, ok := l.capacities[node]
+	return !ok || l.counts[node] < capacity
+}
+
+// lighter tells whether the node a is lighter than the node b after the shards are added to them respectively.
+func (l *nodeLoads) lighter(a string, addA int, b string, addB int) bool {
+	return (l.counts[a]+addA)*l.weights[b] < (l.counts[b]+addB)*l.weights[a]
+}
+
+// lightest returns the node with room which is the lightest after owning one more shard, and the node listed earlier
+// is preferred on ties. The empty node is returned if no node has room.
+func (l *nodeLoads) lightest() string {
+	lightest := ""
+	for _, node := range l.nodes {
+		if !l.hasRoom(node) {
+			continue
+		}
+		if lightest == "" || l.lighter(node, 1, lightest, 1) {
+			lightest = node
+		}
+	}
+	return lightest
+}
+
+// heaviest returns the heaviest node, and the node listed earlier is preferred on ties.
+func (l *nodeLoads) heaviest() string {
+	heaviest := ""
+	for _, node := range l.nodes {
+		if heaviest == "" || l.lighter(heaviest, 0, node, 0) {
+			heaviest = node
+		}
+	}
+	return heaviest
+}
+
+// lightestFor returns the node with room having the fewest shards sharing an anti-affinity group with the shard, and
+// the lighter node is preferred on ties, so the shards are still spread when the grouping can't be respected. The
+// empty node is returned if no node has room.
+func (l *nodeLoads) lightestFor(shardID uint32, groups *groupLoads) string {
+	lightest, lightestConflicts := "", 0
+	for _, node := range l.nodes {
+		if !l.hasRoom(node) {
+			continue
+		}
+		conflicts := groups.conflicts(shardID, node)
+		if lightest == "" || conflicts < lightestConflicts ||
+			(conflicts == lightestConflicts && l.lighter(node, 1, lightest, 1)) {
+			lightest, lightestConflicts = node, conflicts
+		}
+	}
+	return lightest
+}
+
+func (l *nodeLoads) move(from, to string) {
+	if from != "" {
+		l.counts[from]--
+	}
+	l.counts[to]++
+}
+
+// groupLoads tracks the number of the shards of every anti-affinity group on every node during planning.
+type groupLoads struct {
+	groups map[uint32][]uint64
+	counts map[string]map[uint64]int
+}
+
+func newGroupLoads(snapshot *TopologySnapshot) *groupLoads {
+	loads := &groupLoads{groups: snapshot.AffinityGroups, counts: make(map[string]map[uint64]int)}
+	for shardID, node := range snapshot.Shards {
+		if node != "" {
+			loads.move(shardID, "", node)
+		}
+	}
+	return loads
+}
+
+// conflicts returns the number of the shards on the node sharing an anti-affinity group with the shard, and the
+// shard itself is not counted.
+func (g *groupLoads) conflicts(shardID uint32, node string) int {
+	conflicts := 0
+	for _, group := range g.groups[shardID] {
+		conflicts += g.counts[node][group]
+	}
+	return conflicts
+}
+
+func (g *groupLoads) move(shardID uint32, from, to string) {
+	for _, group := range g.groups[shardID] {
+		if from != "" {
+			g.counts[from][group]--
+		}
+		if g.counts[to] == nil {
+			g.counts[to] = make(map[uint64]int)
+		}
+		g.counts[to][group]++
+	}
+}
+
+// ScatterPlanner assigns the unassigned shards to the lightest nodes with room, and the nodes without the shards
+// sharing an anti-affinity group with the assigned one are preferred. The shards beyond the capacities of the nodes
+// are left unplaced.
+type ScatterPlanner struct{}
+
+func (ScatterPlanner) Name() string {
+	return "scatter"
+}
+
+func (p ScatterPlanner) Plan(snapshot *TopologySnapshot) (*Plan, error) {
+	loads := newNodeLoads(snapshot, "")
+	if len(loads.nodes) == 0 {
+		return nil, ErrNoAvailableNode.WithCausef("planner:%s", p.Name())
+	}
+
+	groups := newGroupLoads(snapshot)
+	plan := &Plan{Planner: p.Name(), Moves: []ShardMove{}}
+	for _, shardID := range snapshot.SortedShardIDs() {
+		if snapshot.Shards[shardID] != "" {
+			continue
+		}
+		to := loads.lightestFor(shardID, groups)
+		if to == "" {
+			plan.Unplaced = append(plan.Unplaced, shardID)
+			continue
+		}
+		loads.move("", to)
+		groups.move(shardID, "", to)
+		plan.Moves = append(plan.Moves, ShardMove{ShardID: shardID, To: to})
+	}
+	return plan, nil
+}
+
+// RebalancePlanner moves shards from the heaviest node to the lightest node with room until the move makes the lightest
+// one heavier than the heaviest one, e.g. the difference between them is at most one shard if they are weighted
+// equally, and the moved shard is the one sharing the fewest anti-affinity groups with the lightest node.
+type RebalancePlanner struct{}
+
+func (RebalancePlanner) Name() string {
+	return "rebalance"
+}
+
+func (p RebalancePlanner) Plan(snapshot *TopologySnapshot) (*Plan, error) {
+	loads := newNodeLoads(snapshot, "")
+	if len(loads.nodes) == 0 {
+		return nil, ErrNoAvailableNode.WithCausef("planner:%s", p.Name())
+	}
+
+	// Moved shards are taken from the tail of the node's shard list on ties so that the plan is deterministic.
+	nodeShards := snapshot.NodeShards()
+	groups := newGroupLoads(snapshot)
+	plan := &Plan{Planner: p.Name(), Moves: []ShardMove{}}
+	for {
+		from, to := loads.heaviest(), loads.lightest()
+		if to == "" || loads.lighter(from, -1, to, 1) {
+			return plan, nil
+		}
+
+		shards := nodeShards[from]
+		picked := len(shards) - 1
+		for i := picked - 1; i >= 0; i-- {
+			if groups.conflicts(shards[i], to) < groups.conflicts(shards[picked], to) {
+				picked = i
+			}
+		}
+		shardID := shards[picked]
+		nodeShards[from] = append(shards[:picked:picked], shards[picked+1:]...)
+		nodeShards[to] = append(nodeShards[to], shardID)
+		loads.move(from, to)
+		groups.move(shardID, from, to)
+		plan.Moves = append(plan.Moves, ShardMove{ShardID: shardID, From: from, To: to})
+	}
+}
+
+// FailoverPlanner moves all the shards of the dead node to the other lightest nodes with room, and the nodes without
+// the shards sharing an anti-affinity group with the moved one are preferred. The shards beyond the capacities of the
+// other nodes are left unplaced.
+type FailoverPlanner struct {
+	DeadNode string
+}
+
+func (FailoverPlanner) Name() string {
+	return "failover"
+}
+
+func (p FailoverPlanner) Plan(snapshot *TopologySnapshot) (*Plan, error) {
+	loads := newNodeLoads(snapshot, p.DeadNode)
+	if len(loads.nodes) == len(snapshot.Nodes) {
+		return nil, ErrUnknownNode.WithCausef("planner:%s, node:%s", p.Name(), p.DeadNode)
+	}
+	if len(loads.nodes) == 0 {
+		return nil, ErrNoAvailableNode.WithCausef("planner:%s, dead node:%s", p.Name(), p.DeadNode)
+	}
+
+	groups := newGroupLoads(snapshot)
+	plan := &Plan{Planner: p.Name(), Moves: []ShardMove{}, OfflineNodes: []string{p.DeadNode}}
+	for _, shardID := range snapshot.NodeShards()[p.DeadNode] {
+		to := loads.lightestFor(shardID, groups)
+		if to == "" {
+			plan.Unplaced = append(plan.Unplaced, shardID)
+			continue
+		}
+		loads.move("", to)
+		groups.move(shardID, p.DeadNode, to)
+		plan.Moves = append(plan.Moves, ShardMove{ShardID: shardID, From: p.DeadNode, To: to})
+	}
+	return plan, nil
+}
+
+// ReassignStrategy decides how the ReassignPlanner distributes the shards over the targets.
+type ReassignStrategy string
+
+const (
+	// ReassignLeastLoaded moves every shard to the target with the fewest shards like the failover.
+	ReassignLeastLoaded ReassignStrategy = "least_loaded"
+	// ReassignRoundRobin deals the shards to the targets in turn regardless of their loads.
+	ReassignRoundRobin ReassignStrategy = "round_robin"
+)
+
+// ReassignPlanner moves all the shards of the From node to the Targets only, and the other nodes are neither the
+// targets nor counted in the loads.
+type ReassignPlanner struct {
+	From     string
+	Targets  []string
+	Strategy ReassignStrategy
+}
+
+func (ReassignPlanner) Name() string {
+	return "reassign"
+}
+
+func (p ReassignPlanner) Plan(snapshot *TopologySnapshot) (*Plan, error) {
+	if len(p.Targets) == 0 {
+		return nil, ErrInvalidReassign.WithCausef("no targets, from:%s", p.From)
+	}
+	known := make(map[string]struct{}, len(snapshot.Nodes))
+	for _, node := range snapshot.Nodes {
+		known[node] = struct{}{}
+	}
+	involved := make(map[string]struct{}, len(p.Targets)+1)
+	for _, node := range append([]string{p.From}, p.Targets...) {
+		if _, ok := known[node]; !ok {
+			return nil, ErrUnknownNode.WithCausef("planner:%s, node:%s", p.Name(), node)
+		}
+		if _, ok := involved[node]; ok {
+			return nil, ErrInvalidReassign.WithCausef("duplicated node:%s, from:%s, targets:%v", node, p.From, p.Targets)
+		}
+		involved[node] = struct{}{}
+	}
+
+	// The planning only sees the source and the targets.
+	restricted := snapshot.Clone()
+	restricted.Nodes = append([]string{p.From}, p.Targets...)
+	for shardID, node := range restricted.Shards {
+		if _, ok := involved[node]; !ok {
+			delete(restricted.Shards, shardID)
+		}
+	}
+
+	switch p.Strategy {
+	case ReassignLeastLoaded, "":
+		plan, err := FailoverPlanner{DeadNode: p.From}.Plan(restricted)
+		if err != nil {
+			return nil, err
+		}
+		plan.Planner = p.Name()
+		return plan, nil
+	case ReassignRoundRobin:
+		plan := &Plan{Planner: p.Name(), Moves: []ShardMove{}, OfflineNodes: []string{p.From}}
+		for i, shardID := range restricted.NodeShards()[p.From] {
+			plan.Moves = append(plan.Moves, ShardMove{ShardID: shardID, From: p.From, To: p.Targets[i%len(p.Targets)]})
+		}
+		return plan, nil
+	default:
+		return nil, ErrInvalidReassign.WithCausef("unknown strategy:%s", p.Strategy)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/storage"
+)
+
+// ProcedureConcurrency describes the procedures admitted by the ProcedureLimiter.
+type ProcedureConcurrency struct {
+	// Limit is the max number of the running procedures, and zero means unlimited.
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	// Queued is the number of the procedures waiting to run.
+	Queued int `json:"queued"`
+	// QueuedByPriority maps the priority to the number of its queued procedures.
+	QueuedByPriority map[string]int `json:"queued_by_priority"`
+}
+
+type procedureWaiter struct {
+	ready chan struct{}
+	// granted is set once the waiter is admitted, and it is protected by the lock of the limiter.
+	granted bool
+}
+
+// ProcedureLimiter caps the procedures running at the same time across all the clusters, which protects the etcd and
+// the ceresdb servers from the bursts of the procedures during the mass operations. The procedures beyond the limit
+// are queued in FIFO order by the priority of their ctx: the high priority ones run before the normal ones, and the
+// low priority ones are rejected at once instead of being queued.
+type ProcedureLimiter struct {
+	limit int
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	running int
+	// queues are the queued waiters of the high and the normal priorities in FIFO order.
+	queues map[storage.Priority][]*procedureWaiter
+}
+
+// NewProcedureLimiter creates a limiter allowing at most limit running procedures, and a non-positive limit never
+// queues any procedure.
+func NewProcedureLimiter(limit int) *ProcedureLimiter {
+	if limit < 0 {
+		limit = 0
+	}
+	return &ProcedureLimiter{limit: limit, queues: make(map[storage.Priority][]*procedureWaiter)}
+}
+
+// Acquire admits the procedure carried by the ctx, and the returned release must be called once it finishes. It waits
+// in the queue if the limit is reached, and ErrProcedureOverloaded is returned if the procedure is rejected or the ctx
+// is done before it is admitted. A nil limiter admits every procedure.
+func (l *ProcedureLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	priority := storage.PriorityFromContext(ctx)
+	l.mu.Lock()
+	if l.admittableLocked(priority) {
+		l.running++
+		l.observeLocked()
+		l.mu.Unlock()
+		proceduresAdmittedCounter.WithLabelValues(priority.String(), "admitted").Inc()
+		return l.releaseFunc(), nil
+	}
+	if priority == storage.PriorityLow {
+		running := l.running
+		l.mu.Unlock()
+		proceduresAdmittedCounter.WithLabelValues(priority.String(), "rejected").Inc()
+		return nil, ErrProcedureOverloaded.WithCausef("running:%d, limit:%d, priority:%s", running, l.limit, priority)
+	}
+	w := &procedureWaiter{ready: make(chan struct{})}
+	l.queues[priority] = append(l.queues[priority], w)
+	queued := l.queuedLocked()
+	l.observeLocked()
+	l.mu.Unlock()
+
+	endStep := procedure.BeginStep(ctx, procedure.StepQueueWait)
+	endWait := procedure.BeginWait(ctx, procedure.WaitConcurrency, fmt.Sprintf("limit:%d, queued:%d", l.limit, queued))
+	defer endStep()
+	defer endWait()
+
+	select {
+	case <-w.ready:
+		proceduresAdmittedCounter.WithLabelValues(priority.String(), "queued").Inc()
+		return l.releaseFunc(), nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	if w.granted {
+		// The slot is granted along with the ctx being done, and it is handed over to the next waiter.
+		l.running--
+		l.grantLocked()
+	} else {
+		queue := l.queues[priority]
+		for i, waiter := range queue {
+			if waiter == w {
+				l.queues[priority] = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+	}
+	l.observeLocked()
+	l.mu.Unlock()
+	proceduresAdmittedCounter.WithLabelValues(priority.String(), "timed_out").Inc()
+	return nil, ErrProcedureOverloaded.WithCausef("wait for running procedures, limit:%d, err:%v", l.limit, ctx.Err())
+}
+
+// Concurrency returns the current running and queued procedures.
+func (l *ProcedureLimiter) Concurrency() ProcedureConcurrency {
+	if l == nil {
+		return ProcedureConcurrency{QueuedByPriority: map[string]int{}}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	concurrency := ProcedureConcurrency{
+		Limit:            l.limit,
+		Running:          l.running,
+		Queued:           l.queuedLocked(),
+		QueuedByPriority: make(map[string]int, len(l.queues)),
+	}
+	for priority, queue := range l.queues {
+		if len(queue) > 0 {
+			concurrency.QueuedByPriority[priority.String()] = len(queue)
+		}
+	}
+	return concurrency
+}
+
+// admittableLocked tells whether the procedure of the priority runs at once, which never overtakes the queued ones of
+// the same or a higher priority.
+func (l *ProcedureLimiter) admittableLocked(priority storage.Priority) bool {
+	if l.limit == 0 {
+		return true
+	}
+	if l.running >= l.limit {
+		return false
+	}
+	if len(l.queues[storage.PriorityHigh]) > 0 {
+		return false
+	}
+	return priority == storage.PriorityHigh || len(l.queues[storage.PriorityNormal]) == 0
+}
+
+func (l *ProcedureLimiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.running--
+			l.grantLocked()
+			l.observeLocked()
+		})
+	}
+}
+
+// grantLocked admits the queued waiters while the limit allows, and the high priority ones go first.
+func (l *ProcedureLimiter) grantLocked() {
+	for _, priority := range []storage.Priority{storage.PriorityHigh, storage.PriorityNormal} {
+		for len(l.queues[priority]) > 0 && (l.limit == 0 || l.running < l.limit) {
+			w := l.queues[priority][0]
+			l.queues[priority] = l.queues[priority][1:]
+			w.granted = true
+			l.running++
+			close(w.ready)
+		}
+	}
+}
+
+func (l *ProcedureLimiter) queuedLocked() int {
+	queued := 0
+	for _, queue := range l.queues {
+		queued += len(queue)
+	}
+	return queued
+}
+
+func (l *ProcedureLimiter) observeLocked() {
+	runningProceduresGauge.Set(float64(l.running))
+	queuedProceduresGauge.Set(float64(l.queuedLocked()))
+}
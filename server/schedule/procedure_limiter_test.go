@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcedureLimiter(t *testing.T) {
+	re := require.New(t)
+
+	ctx := context.Background()
+	limiter := NewProcedureLimiter(1)
+	release, err := limiter.Acquire(ctx)
+	re.NoError(err)
+
+	// The low priority procedure is rejected at once if the limit is reached.
+	_, err = limiter.Acquire(storage.WithPriority(ctx, storage.PriorityLow))
+	re.True(coderr.Is(err, ErrProcedureOverloaded.Code()))
+
+	admitted := make(chan string, 3)
+	acquire := func(ctx context.Context, name string) {
+		go func() {
+			release, err := limiter.Acquire(ctx)
+			if err != nil {
+				admitted <- "rejected " + name
+				return
+			}
+			admitted <- name
+			release()
+		}()
+	}
+	waitQueued := func(queued int) {
+		re.Eventually(func() bool { return limiter.Concurrency().Queued == queued }, time.Second, time.Millisecond)
+	}
+
+	// The procedure whose ctx is done leaves the queue.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	acquire(canceledCtx, "canceled")
+	waitQueued(1)
+	cancel()
+	re.Equal("rejected canceled", <-admitted)
+	waitQueued(0)
+
+	acquire(ctx, "normal-1")
+	waitQueued(1)
+	acquire(ctx, "normal-2")
+	waitQueued(2)
+	acquire(storage.WithPriority(ctx, storage.PriorityHigh), "high")
+	waitQueued(3)
+	re.Equal(ProcedureConcurrency{
+		Limit:            1,
+		Running:          1,
+		Queued:           3,
+		QueuedByPriority: map[string]int{"high": 1, "normal": 2},
+	}, limiter.Concurrency())
+
+	// The high priority procedure runs first, and the normal ones run in FIFO order.
+	release()
+	release()
+	re.Equal("high", <-admitted)
+	re.Equal("normal-1", <-admitted)
+	re.Equal("normal-2", <-admitted)
+	re.Eventually(func() bool { return limiter.Concurrency().Running == 0 }, time.Second, time.Millisecond)
+
+	// The nil limiter admits every procedure.
+	var nilLimiter *ProcedureLimiter
+	release, err = nilLimiter.Acquire(ctx)
+	re.NoError(err)
+	release()
+}
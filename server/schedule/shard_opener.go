@@ -0,0 +1,226 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"go.uber.org/zap"
+)
+
+// ShardOpenPacing paces the open commands sent to a node.
+type ShardOpenPacing struct {
+	// BatchSize is the max number of the shards opened by a command, and zero means unlimited.
+	BatchSize int `json:"batch_size"`
+	// MaxInFlight is the max number of the shards of a node being opened at the same time, and zero means unlimited.
+	MaxInFlight int `json:"max_in_flight"`
+	// AckTimeout bounds the wait for the ack of a command, after which its shards no longer count as being opened, and
+	// zero waits until the opener is closed.
+	AckTimeout time.Duration `json:"ack_timeout"`
+}
+
+// nodeShardOpens are the shards of a node waiting to be opened and being opened.
+type nodeShardOpens struct {
+	// pending are the shards waiting to be opened in the order of opening, and opening are the shards sent but not
+	// acked yet.
+	pending []uint32
+	opening map[uint32]struct{}
+	// running tells whether the batches of the node are being sent.
+	running bool
+}
+
+// ShardOpener sends the open commands to the nodes in batches, so that a node reopening many shards at once, e.g.
+// after it restarts, isn't overwhelmed by opening them all concurrently. The next batch of a node is sent only after
+// the acks of the previous ones bring the shards being opened below the max in flight. The commands are acked only by
+// the nodes negotiated to track them, and the commands to the other nodes count as opened once queued for sending.
+type ShardOpener struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams *HeartbeatStreams
+	wg      sync.WaitGroup
+
+	// mu protects the following fields, and cond is signaled when a batch is acked, the pacing changes or the opener
+	// is closed.
+	mu     sync.Mutex
+	cond   *sync.Cond
+	pacing ShardOpenPacing
+	nodes  map[string]*nodeShardOpens
+	closed bool
+}
+
+func NewShardOpener(ctx context.Context, streams *HeartbeatStreams, pacing ShardOpenPacing) *ShardOpener {
+	ctx, cancel := context.WithCancel(ctx)
+	o := &ShardOpener{
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: streams,
+		pacing:  pacing,
+		nodes:   make(map[string]*nodeShardOpens),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// SetPacing changes the pacing, which applies to the following batches of all the nodes.
+func (o *ShardOpener) SetPacing(pacing ShardOpenPacing) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pacing = pacing
+	o.cond.Broadcast()
+}
+
+// Pacing returns the current pacing.
+func (o *ShardOpener) Pacing() ShardOpenPacing {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.pacing
+}
+
+// Open queues the shards to be opened by the node in the given order after the shards queued before, and the shards
+// already queued or being opened are ignored. It returns at once, and the shards failing to be opened will be assigned again since the
+// node won't report them as owned.
+func (o *ShardOpener) Open(node string, shardIDs []uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || len(shardIDs) == 0 {
+		return
+	}
+	opens, ok := o.nodes[node]
+	if !ok {
+		opens = &nodeShardOpens{opening: make(map[uint32]struct{})}
+		o.nodes[node] = opens
+	}
+	if !opens.running {
+		opens.running = true
+		o.wg.Add(1)
+		go o.runNode(node, opens)
+	}
+	queued := make(map[uint32]struct{}, len(opens.pending))
+	for _, shardID := range opens.pending {
+		queued[shardID] = struct{}{}
+	}
+	for _, shardID := range shardIDs {
+		if _, ok := opens.opening[shardID]; ok {
+			continue
+		}
+		if _, ok := queued[shardID]; !ok {
+			queued[shardID] = struct{}{}
+			opens.pending = append(opens.pending, shardID)
+			pendingShardOpensGauge.Inc()
+		}
+	}
+	o.cond.Broadcast()
+}
+
+// PendingShards returns the shards of the node waiting to be opened in the order of opening.
+func (o *ShardOpener) PendingShards(node string) []uint32 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	opens, ok := o.nodes[node]
+	if !ok {
+		return nil
+	}
+	return append([]uint32(nil), opens.pending...)
+}
+
+// Close abandons the pending shards and waits for the batches being sent.
+func (o *ShardOpener) Close() {
+	o.mu.Lock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+
+	o.cancel()
+	o.wg.Wait()
+}
+
+// runNode sends the batches of the node until no shard is pending, and the batches being acked are waited by their own
+// goroutines.
+func (o *ShardOpener) runNode(node string, opens *nodeShardOpens) {
+	defer o.wg.Done()
+
+	for {
+		o.mu.Lock()
+		for !o.closed && len(opens.pending) > 0 && o.pacing.MaxInFlight > 0 && len(opens.opening) >= o.pacing.MaxInFlight {
+			o.cond.Wait()
+		}
+		if o.closed || len(opens.pending) == 0 {
+			pendingShardOpensGauge.Sub(float64(len(opens.pending)))
+			opens.pending = nil
+			opens.running = false
+			o.removeIdleLocked(node, opens)
+			o.mu.Unlock()
+			return
+		}
+		size := len(opens.pending)
+		if o.pacing.BatchSize > 0 && size > o.pacing.BatchSize {
+			size = o.pacing.BatchSize
+		}
+		if o.pacing.MaxInFlight > 0 && size > o.pacing.MaxInFlight-len(opens.opening) {
+			size = o.pacing.MaxInFlight - len(opens.opening)
+		}
+		batch := opens.pending[:size:size]
+		opens.pending = opens.pending[size:]
+		for _, shardID := range batch {
+			opens.opening[shardID] = struct{}{}
+		}
+		ackTimeout := o.pacing.AckTimeout
+		pendingShardOpensGauge.Sub(float64(size))
+		o.mu.Unlock()
+
+		msg := &metapb.NodeHeartbeatResponse{
+			Header: &commonpb.ResponseHeader{},
+			Cmd:    &metapb.NodeHeartbeatResponse_OpenCmd{OpenCmd: &metapb.OpenCmd{ShardIds: batch}},
+		}
+		cmd, err := o.streams.SendCommand(o.ctx, node, msg)
+		if err != nil {
+			log.Error("fail to send open shard cmd", zap.String("node", node), zap.Uint32s("shards", batch), zap.Error(err))
+			o.finishBatch(node, opens, batch)
+			continue
+		}
+
+		o.wg.Add(1)
+		go func() {
+			defer o.wg.Done()
+
+			ctx := o.ctx
+			if ackTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, ackTimeout)
+				defer cancel()
+			}
+			if err := cmd.Wait(ctx); err != nil {
+				log.Warn("open shard cmd not acked", zap.String("node", node), zap.Uint32s("shards", batch), zap.Error(err))
+			}
+			o.finishBatch(node, opens, batch)
+		}()
+	}
+}
+
+func (o *ShardOpener) finishBatch(node string, opens *nodeShardOpens, batch []uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, shardID := range batch {
+		delete(opens.opening, shardID)
+	}
+	o.removeIdleLocked(node, opens)
+	o.cond.Broadcast()
+}
+
+// removeIdleLocked forgets the node once it has no shard waiting to be opened or being opened, and the node is kept
+// while its batches are being acked so that the shards queued later are still paced by them.
+func (o *ShardOpener) removeIdleLocked(node string, opens *nodeShardOpens) {
+	if !opens.running && len(opens.opening) == 0 && len(opens.pending) == 0 {
+		delete(o.nodes, node)
+	}
+}
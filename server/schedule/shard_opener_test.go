@@ -0,0 +1,112 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mockOpeningNode opens the shards of the open commands at once after a delay, and it measures how many shards are
+// being opened at the same time.
+type mockOpeningNode struct {
+	name    string
+	streams *HeartbeatStreams
+	stream  *mockStream
+
+	mu         sync.Mutex
+	received   []uint32
+	opened     []uint32
+	opening    int
+	maxOpening int
+}
+
+func (n *mockOpeningNode) run(ctx context.Context) {
+	for {
+		select {
+		case msg := <-n.stream.msgs:
+			shardIDs := msg.GetOpenCmd().GetShardIds()
+			n.mu.Lock()
+			n.received = append(n.received, shardIDs...)
+			n.opening += len(shardIDs)
+			if n.opening > n.maxOpening {
+				n.maxOpening = n.opening
+			}
+			n.mu.Unlock()
+
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				n.mu.Lock()
+				n.opening -= len(shardIDs)
+				n.opened = append(n.opened, shardIDs...)
+				info := nodeInfo(n.name, "v1.3.0", n.opened...)
+				n.mu.Unlock()
+				n.streams.ObserveHeartbeat(ctx, info)
+			}()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stats returns the shards received in order and the max shards being opened since the last call.
+func (n *mockOpeningNode) stats() ([]uint32, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	received, maxOpening := n.received, n.maxOpening
+	n.received, n.maxOpening = nil, 0
+	return received, maxOpening
+}
+
+func (n *mockOpeningNode) openedCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.opened)
+}
+
+func TestShardOpener(t *testing.T) {
+	re := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	h := NewHeartbeatStreams(ctx, "1.2.0", NodeConflictFence)
+	defer h.Close()
+	node := &mockOpeningNode{name: "a", streams: h, stream: newMockStream()}
+	h.Bind("a", node.stream)
+	h.ObserveHeartbeat(ctx, nodeInfo("a", "v1.3.0"))
+	go node.run(ctx)
+
+	opener := NewShardOpener(ctx, h, ShardOpenPacing{BatchSize: 2, MaxInFlight: 4, AckTimeout: time.Second})
+	defer opener.Close()
+
+	// The shards are sent in the given order, and at most 4 of them are being opened at the same time.
+	shardIDs := []uint32{7, 3, 11, 0, 5, 9, 1, 10, 2, 8, 4, 6}
+	opener.Open("a", shardIDs)
+	opener.Open("a", []uint32{3, 12})
+	re.Eventually(func() bool { return node.openedCount() == 13 }, defaultTestTimeout, time.Millisecond)
+	received, maxOpening := node.stats()
+	re.Equal(append(shardIDs, 12), received)
+	re.Equal(4, maxOpening)
+	re.Empty(opener.PendingShards("a"))
+
+	// The pacing changed at runtime applies to the following shards.
+	opener.SetPacing(ShardOpenPacing{BatchSize: 1, MaxInFlight: 1, AckTimeout: time.Second})
+	re.Equal(ShardOpenPacing{BatchSize: 1, MaxInFlight: 1, AckTimeout: time.Second}, opener.Pacing())
+	opener.Open("a", []uint32{13, 14, 15, 16})
+	re.Eventually(func() bool { return node.openedCount() == 17 }, defaultTestTimeout, time.Millisecond)
+	received, maxOpening = node.stats()
+	re.Equal([]uint32{13, 14, 15, 16}, received)
+	re.Equal(1, maxOpening)
+
+	opener.SetPacing(ShardOpenPacing{})
+	opener.Open("a", []uint32{17, 18, 19, 20, 21, 22})
+	re.Eventually(func() bool { return node.openedCount() == 23 }, defaultTestTimeout, time.Millisecond)
+	_, maxOpening = node.stats()
+	re.Equal(6, maxOpening)
+}
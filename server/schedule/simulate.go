@@ -0,0 +1,116 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// BalanceMetrics describes how balanced the shards are distributed over the nodes.
+type BalanceMetrics struct {
+	NodeShardCounts map[string]int `json:"node_shard_counts"`
+	MaxShards       int            `json:"max_shards"`
+	MinShards       int            `json:"min_shards"`
+	Unassigned      int            `json:"unassigned"`
+	// StdDev is the standard deviation of the shard counts of the nodes.
+	StdDev float64 `json:"std_dev"`
+}
+
+func ComputeBalanceMetrics(snapshot *TopologySnapshot) *BalanceMetrics {
+	metrics := &BalanceMetrics{NodeShardCounts: make(map[string]int, len(snapshot.Nodes))}
+	for node, shards := range snapshot.NodeShards() {
+		metrics.NodeShardCounts[node] = len(shards)
+	}
+	for _, node := range snapshot.Shards {
+		if node == "" {
+			metrics.Unassigned++
+		}
+	}
+
+	if len(snapshot.Nodes) == 0 {
+		return metrics
+	}
+
+	metrics.MinShards = math.MaxInt
+	sum := 0
+	for _, count := range metrics.NodeShardCounts {
+		sum += count
+		if count > metrics.MaxShards {
+			metrics.MaxShards = count
+		}
+		if count < metrics.MinShards {
+			metrics.MinShards = count
+		}
+	}
+	mean := float64(sum) / float64(len(metrics.NodeShardCounts))
+	variance := 0.0
+	for _, count := range metrics.NodeShardCounts {
+		variance += (float64(count) - mean) * (float64(count) - mean)
+	}
+	metrics.StdDev = math.Sqrt(variance / float64(len(metrics.NodeShardCounts)))
+	return metrics
+}
+
+// SimulationResult is the outcome of running a planner over a topology snapshot without touching the cluster.
+type SimulationResult struct {
+	Plan   *Plan           `json:"plan"`
+	Before *BalanceMetrics `json:"before"`
+	After  *BalanceMetrics `json:"after"`
+}
+
+// Simulate runs the planner over the snapshot and computes the balance metrics before and after applying the plan.
+// The snapshot is not modified.
+func Simulate(snapshot *TopologySnapshot, planner Planner) (*SimulationResult, error) {
+	plan, err := planner.Plan(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	after := snapshot.Clone()
+	after.Apply(plan)
+	return &SimulationResult{
+		Plan:   plan,
+		Before: ComputeBalanceMetrics(snapshot),
+		After:  ComputeBalanceMetrics(after),
+	}, nil
+}
+
+// Print prints the plan and the balance metrics in a human-readable format.
+func (r *SimulationResult) Print(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "planner: %s\n", r.Plan.Planner)
+	fmt.Fprintf(&b, "moves: %d\n", len(r.Plan.Moves))
+	for _, move := range r.Plan.Moves {
+		from := move.From
+		if from == "" {
+			from = "<unassigned>"
+		}
+		fmt.Fprintf(&b, "  shard %d: %s -> %s\n", move.ShardID, from, move.To)
+	}
+	if len(r.Plan.Unplaced) > 0 {
+		fmt.Fprintf(&b, "unplaced: %v\n", r.Plan.Unplaced)
+	}
+	printBalanceMetrics(&b, "before", r.Before)
+	printBalanceMetrics(&b, "after", r.After)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func printBalanceMetrics(b *strings.Builder, title string, metrics *BalanceMetrics) {
+	fmt.Fprintf(b, "%s: max=%d min=%d unassigned=%d stddev=%.3f\n", title, metrics.MaxShards, metrics.MinShards,
+		metrics.Unassigned, metrics.StdDev)
+
+	nodes := make([]string, 0, len(metrics.NodeShardCounts))
+	for node := range metrics.NodeShardCounts {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		fmt.Fprintf(b, "  %s: %d\n", node, metrics.NodeShardCounts[node])
+	}
+}
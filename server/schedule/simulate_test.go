@@ -0,0 +1,201 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package schedule
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the simulation tests")
+
+func TestSimulateGolden(t *testing.T) {
+	testCases := []struct {
+		name     string
+		topology string
+		planner  Planner
+	}{
+		{name: "rebalance_skewed", topology: "skewed.json", planner: RebalancePlanner{}},
+		{name: "rebalance_balanced", topology: "balanced.json", planner: RebalancePlanner{}},
+		{name: "scatter_partially_assigned", topology: "partially_assigned.json", planner: ScatterPlanner{}},
+		{name: "failover_skewed", topology: "skewed.json", planner: FailoverPlanner{DeadNode: "node-0"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			re := require.New(t)
+			f, err := os.Open(filepath.Join("testdata", "simulate", tc.topology))
+			re.NoError(err)
+			defer f.Close()
+
+			snapshot, err := LoadTopologySnapshot(f)
+			re.NoError(err)
+			before := snapshot.Clone()
+
+			result, err := Simulate(snapshot, tc.planner)
+			re.NoError(err)
+			// The simulation must not touch the input snapshot.
+			re.Equal(before, snapshot)
+
+			var buf bytes.Buffer
+			re.NoError(result.Print(&buf))
+
+			goldenPath := filepath.Join("testdata", "simulate", tc.name+".golden")
+			if *updateGolden {
+				re.NoError(os.WriteFile(goldenPath, buf.Bytes(), 0o600))
+			}
+			expect, err := os.ReadFile(goldenPath)
+			re.NoError(err)
+			re.Equal(string(expect), buf.String())
+		})
+	}
+}
+
+func TestSimulateInvalid(t *testing.T) {
+	re := require.New(t)
+
+	_, err := LoadTopologySnapshot(strings.NewReader(`{"nodes": ["node-0"], "shards": {"0": "node-1"}}`))
+	re.Error(err)
+
+	snapshot, err := LoadTopologySnapshot(strings.NewReader(`{"nodes": ["node-0"], "shards": {"0": "node-0"}}`))
+	re.NoError(err)
+	_, err = Simulate(snapshot, FailoverPlanner{DeadNode: "node-1"})
+	re.Error(err)
+	_, err = Simulate(snapshot, FailoverPlanner{DeadNode: "node-0"})
+	re.Error(err)
+}
+
+func TestPlannerAntiAffinity(t *testing.T) {
+	re := require.New(t)
+
+	// The scatter planner spreads the shards of the same group over the nodes even if the load allows otherwise.
+	snapshot := &TopologySnapshot{
+		Nodes:          []string{"node-0", "node-1"},
+		Shards:         map[uint32]string{0: "", 1: "", 2: "", 3: ""},
+		AffinityGroups: map[uint32][]uint64{0: {1}, 1: {2}, 2: {1}, 3: {2}},
+	}
+	plan, err := ScatterPlanner{}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{
+		{ShardID: 0, To: "node-0"},
+		{ShardID: 1, To: "node-1"},
+		{ShardID: 2, To: "node-1"},
+		{ShardID: 3, To: "node-0"},
+	}, plan.Moves)
+
+	// The rebalance planner moves the shard not sharing a group with the lightest node.
+	snapshot = &TopologySnapshot{
+		Nodes:          []string{"node-0", "node-1"},
+		Shards:         map[uint32]string{0: "node-0", 1: "node-0", 2: "node-0", 3: "node-1"},
+		AffinityGroups: map[uint32][]uint64{2: {1}, 3: {1}},
+	}
+	plan, err = RebalancePlanner{}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{{ShardID: 1, From: "node-0", To: "node-1"}}, plan.Moves)
+
+	// The failover planner falls back to the load if every node holds the group.
+	snapshot = &TopologySnapshot{
+		Nodes:          []string{"node-0", "node-1", "node-2"},
+		Shards:         map[uint32]string{0: "node-0", 1: "node-1", 2: "node-1", 3: "node-2"},
+		AffinityGroups: map[uint32][]uint64{0: {1}, 1: {1}, 3: {1}},
+	}
+	plan, err = FailoverPlanner{DeadNode: "node-0"}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{{ShardID: 0, From: "node-0", To: "node-2"}}, plan.Moves)
+}
+
+func TestPlannerCapacity(t *testing.T) {
+	re := require.New(t)
+
+	// The shards are distributed in proportion to the capacities on a 2:1 fleet.
+	snapshot := &TopologySnapshot{
+		Nodes:      []string{"node-0", "node-1"},
+		Shards:     map[uint32]string{0: "", 1: "", 2: "", 3: "", 4: "", 5: ""},
+		Capacities: map[string]int{"node-0": 8, "node-1": 4},
+	}
+	result, err := Simulate(snapshot, ScatterPlanner{})
+	re.NoError(err)
+	re.Empty(result.Plan.Unplaced)
+	re.Equal(map[string]int{"node-0": 4, "node-1": 2}, result.After.NodeShardCounts)
+
+	// The rebalance keeps the proportion instead of the equal counts.
+	snapshot = &TopologySnapshot{
+		Nodes:      []string{"node-0", "node-1"},
+		Shards:     map[uint32]string{0: "node-1", 1: "node-1", 2: "node-1", 3: "node-1", 4: "node-0", 5: "node-0"},
+		Capacities: map[string]int{"node-0": 8, "node-1": 4},
+	}
+	result, err = Simulate(snapshot, RebalancePlanner{})
+	re.NoError(err)
+	re.Equal(map[string]int{"node-0": 4, "node-1": 2}, result.After.NodeShardCounts)
+
+	// The failover never exceeds the capacities, and the excess shards are left unplaced.
+	snapshot = &TopologySnapshot{
+		Nodes:      []string{"node-0", "node-1", "node-2"},
+		Shards:     map[uint32]string{0: "node-0", 1: "node-0", 2: "node-0", 3: "node-1", 4: "node-2"},
+		Capacities: map[string]int{"node-1": 2, "node-2": 1},
+	}
+	plan, err := FailoverPlanner{DeadNode: "node-0"}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{{ShardID: 0, From: "node-0", To: "node-1"}}, plan.Moves)
+	re.Equal([]uint32{1, 2}, plan.Unplaced)
+	after := snapshot.Clone()
+	after.Apply(plan)
+	re.Equal(2, ComputeBalanceMetrics(after).Unassigned)
+
+	// The unlimited nodes are weighted as the largest capacity.
+	snapshot = &TopologySnapshot{
+		Nodes:      []string{"node-0", "node-1"},
+		Shards:     map[uint32]string{0: "", 1: "", 2: "", 3: "", 4: "", 5: "", 6: "", 7: ""},
+		Capacities: map[string]int{"node-1": 2},
+	}
+	result, err = Simulate(snapshot, ScatterPlanner{})
+	re.NoError(err)
+	re.Empty(result.Plan.Unplaced)
+	re.Equal(map[string]int{"node-0": 6, "node-1": 2}, result.After.NodeShardCounts)
+}
+
+func TestReassignPlanner(t *testing.T) {
+	re := require.New(t)
+
+	snapshot := &TopologySnapshot{
+		Nodes:  []string{"node-0", "node-1", "node-2", "node-3"},
+		Shards: map[uint32]string{0: "node-0", 1: "node-0", 2: "node-0", 3: "node-1", 4: "node-1", 5: "node-3"},
+	}
+
+	// The least loaded strategy fills the lighter target first, and the other nodes are never chosen.
+	plan, err := ReassignPlanner{From: "node-0", Targets: []string{"node-1", "node-2"}}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{
+		{ShardID: 0, From: "node-0", To: "node-2"},
+		{ShardID: 1, From: "node-0", To: "node-2"},
+		{ShardID: 2, From: "node-0", To: "node-1"},
+	}, plan.Moves)
+	re.Equal("reassign", plan.Planner)
+
+	plan, err = ReassignPlanner{From: "node-0", Targets: []string{"node-1", "node-2"}, Strategy: ReassignRoundRobin}.Plan(snapshot)
+	re.NoError(err)
+	re.Equal([]ShardMove{
+		{ShardID: 0, From: "node-0", To: "node-1"},
+		{ShardID: 1, From: "node-0", To: "node-2"},
+		{ShardID: 2, From: "node-0", To: "node-1"},
+	}, plan.Moves)
+
+	for _, p := range []ReassignPlanner{
+		{From: "node-0"},
+		{From: "node-0", Targets: []string{"node-0"}},
+		{From: "node-0", Targets: []string{"node-1", "node-1"}},
+		{From: "node-0", Targets: []string{"node-1"}, Strategy: "unknown"},
+	} {
+		_, err = p.Plan(snapshot)
+		re.True(coderr.Is(err, coderr.InvalidParams), "planner:%+v", p)
+	}
+	_, err = ReassignPlanner{From: "node-0", Targets: []string{"node-9"}}.Plan(snapshot)
+	re.True(coderr.Is(err, coderr.InvalidParams))
+}
@@ -4,35 +4,86 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
 	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
 	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/audit"
+	"github.com/CeresDB/ceresmeta/server/backup"
+	"github.com/CeresDB/ceresmeta/server/cluster"
 	"github.com/CeresDB/ceresmeta/server/config"
 	"github.com/CeresDB/ceresmeta/server/etcdutil"
 	"github.com/CeresDB/ceresmeta/server/grpcservice"
+	"github.com/CeresDB/ceresmeta/server/hook"
+	"github.com/CeresDB/ceresmeta/server/httpservice"
 	"github.com/CeresDB/ceresmeta/server/member"
+	"github.com/CeresDB/ceresmeta/server/notify"
+	"github.com/CeresDB/ceresmeta/server/procedure"
+	"github.com/CeresDB/ceresmeta/server/replication"
 	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/CeresDB/ceresmeta/server/storage"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/server/v3/embed"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 )
 
 type Server struct {
 	isClosed int32
+	// leaderLoaded is set once the clusters are reloaded after the server becomes the leader, and cleared once it is
+	// not the leader, and the DDLs are only served while it is set.
+	leaderLoaded int32
 
 	cfg     *config.Config
 	etcdCfg *embed.Config
 
+	// procedures tracks the in-flight procedures and what they are waiting on.
+	procedures *procedure.Tracker
+	// procedureLimiter caps the procedures running at the same time.
+	procedureLimiter *schedule.ProcedureLimiter
+
 	// The fields below are initialized after Run of server is called.
-	hbStreams *schedule.HeartbeatStreams
+	hbStreams      *schedule.HeartbeatStreams
+	clusterManager cluster.Manager
+	// shardOpener paces the open commands sent to the nodes.
+	shardOpener *schedule.ShardOpener
+	// heartbeatPool handles the heartbeats changing more than the liveness of the nodes on the dedicated workers.
+	heartbeatPool *schedule.HeartbeatPool
+	// notifier delivers the transitions of the cluster conditions, and it is nil if no webhook is configured.
+	notifier         *notify.WebhookNotifier
+	conditionTracker *notify.ConditionTracker
+	// hooks invokes the configured hooks on the events, and it is nil if no hook is configured.
+	hooks *hook.Registry
+	// auditor ships the records of the mutating operations to the sink, and it is nil if no sink is configured.
+	auditor *audit.Logger
+	// snapshotScheduler takes the snapshots of the clusters periodically, and it is nil if disabled.
+	snapshotScheduler *backup.Scheduler
+	// observerPromoter replaces the unhealthy voters with the observers, and it is nil if disabled.
+	observerPromoter *member.ObserverPromoter
+	// leaseTuner tunes the ttl of the leadership lease, and it is nil if disabled.
+	leaseTuner *member.LeaseTTLTuner
+	// replicaCli connects the standby etcd cluster the leader mirrors the metadata to, and it is nil if disabled.
+	replicaCli *clientv3.Client
 
 	// member describes membership in ceresmeta cluster.
 	member  *member.Member
 	etcdCli *clientv3.Client
 	etcdSrv *embed.Etcd
+	// spaceMonitor tells whether the etcd space quota is exceeded, and the server is read-only if so.
+	spaceMonitor *etcdutil.SpaceMonitor
+	// revisionPins are the revisions still needed by the watches, which are never compacted.
+	revisionPins *etcdutil.RevisionPins
+	// stalenessTracker bounds the staleness of the reads served by the server as a follower.
+	stalenessTracker *etcdutil.StalenessTracker
 
 	// bgJobWg can be used to join with the background jobs.
 	bgJobWg sync.WaitGroup
@@ -46,18 +97,30 @@ func CreateServer(cfg *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !schedule.NodeConflictPolicy(cfg.NodeConflictPolicy).IsValid() {
+		return nil, ErrInvalidConfig.WithCausef("unknown node conflict policy:%s", cfg.NodeConflictPolicy)
+	}
 
 	srv := &Server{
 		isClosed: 0,
 
 		cfg:     cfg,
 		etcdCfg: etcdCfg,
+
+		procedures:       procedure.NewTracker(),
+		procedureLimiter: schedule.NewProcedureLimiter(cfg.MaxConcurrentProcedures),
 	}
 
 	grpcService := grpcservice.NewService(cfg.GrpcHandleTimeout(), srv)
 	etcdCfg.ServiceRegister = func(grpcSrv *grpc.Server) {
 		grpcSrv.RegisterService(&metapb.CeresmetaRpcService_ServiceDesc, grpcService)
 	}
+	if cfg.AdminToken != "" {
+		etcdCfg.UserHandlers = map[string]http.Handler{
+			httpservice.APIPrefix: httpservice.NewService(cfg.AdminToken, srv),
+			httpservice.UIPrefix:  httpservice.NewUIHandler(),
+		}
+	}
 
 	return srv, nil
 }
@@ -88,8 +151,24 @@ func (srv *Server) Close() {
 			log.Error("fail to close etcdCli", zap.Error(err))
 		}
 	}
+	if srv.replicaCli != nil {
+		if err := srv.replicaCli.Close(); err != nil {
+			log.Error("fail to close replicaCli", zap.Error(err))
+		}
+	}
 
+	srv.shardOpener.Close()
 	srv.hbStreams.Close()
+	srv.heartbeatPool.Close()
+	if srv.notifier != nil {
+		srv.notifier.Close()
+	}
+	if srv.hooks != nil {
+		srv.hooks.Close()
+	}
+	if srv.auditor != nil {
+		srv.auditor.Close()
+	}
 
 	// TODO: release other resources: httpclient, etcd server and so on.
 }
@@ -115,25 +194,198 @@ func (srv *Server) startEtcd(ctx context.Context) error {
 
 	endpoints := []string{srv.etcdCfg.ACUrls[0].String()}
 	lgc := log.GetLoggerConfig()
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
-		DialTimeout: srv.cfg.EtcdCallTimeout(),
-		LogConfig:   lgc,
+	var client *clientv3.Client
+	// The client is created again only if the dialing or the authentication fails.
+	err = etcdutil.WaitStartup(ctx, srv.startupWaitOptions(), "connect etcd", func(ctx context.Context) error {
+		if client == nil {
+			var err error
+			if client, err = clientv3.New(clientv3.Config{
+				Endpoints:   endpoints,
+				DialTimeout: srv.cfg.EtcdCallTimeout(),
+				LogConfig:   lgc,
+				Username:    srv.cfg.EtcdUsername,
+				Password:    srv.cfg.EtcdPassword,
+			}); err != nil {
+				return err
+			}
+		}
+		return etcdutil.CheckHealth(ctx, client)
 	})
 	if err != nil {
+		if client != nil {
+			_ = client.Close()
+		}
 		return ErrCreateEtcdClient.WithCause(err)
 	}
 
 	srv.etcdCli = client
+	srv.spaceMonitor = etcdutil.NewSpaceMonitor(client, srv.cfg.QuotaBackendBytes, path.Join(srv.cfg.StorageRootPath, "etcd_space_probe"))
 	etcdLeaderGetter := &etcdutil.LeaderGetterWrapper{Server: etcdSrv.Server}
 	srv.member = member.NewMember("", uint64(etcdSrv.Server.ID()), srv.cfg.NodeName, client, etcdLeaderGetter, srv.cfg.EtcdCallTimeout())
+	srv.revisionPins = etcdutil.NewRevisionPins()
+	srv.member.SetRevisionPins(srv.revisionPins)
+	if srv.cfg.EnableAdaptiveLeaseTTL {
+		srv.leaseTuner = member.NewLeaseTTLTuner(srv.cfg.LeaseTTLSec, srv.cfg.AdaptiveLeaseMaxTTLSec, srv.cfg.AdaptiveLeaseStable())
+		srv.member.SetLeaseTTLTuner(srv.leaseTuner)
+	}
+	srv.stalenessTracker = etcdutil.NewStalenessTracker(client, srv.cfg.StorageRootPath, srv.cfg.MaxReadStalenessRevisions,
+		srv.cfg.NodeName, srv.revisionPins)
+	if srv.cfg.EnableObserverAutoPromotion {
+		srv.observerPromoter = member.NewObserverPromoter(srv.member, srv.cfg.ObserverPromotionDelay(), srv.cfg.ObserverMaxLagIndex)
+	}
 	srv.etcdSrv = etcdSrv
 	return nil
 }
 
 /// startServer starts involved services.
 func (srv *Server) startServer(ctx context.Context) error {
-	srv.hbStreams = schedule.NewHeartbeatStreams(ctx)
+	srv.hbStreams = schedule.NewHeartbeatStreams(ctx, srv.cfg.CommandAckMinNodeVersion,
+		schedule.NodeConflictPolicy(srv.cfg.NodeConflictPolicy))
+	srv.shardOpener = schedule.NewShardOpener(ctx, srv.hbStreams, schedule.ShardOpenPacing{
+		BatchSize:   srv.cfg.ShardOpenBatchSize,
+		MaxInFlight: srv.cfg.ShardOpenMaxInFlight,
+		AckTimeout:  srv.cfg.ShardOpenAckTimeout(),
+	})
+	srv.heartbeatPool = schedule.NewHeartbeatPool(srv.cfg.HeartbeatWorkers, srv.cfg.HeartbeatQueueSize)
+	if srv.cfg.WebhookURL != "" {
+		srv.notifier = notify.NewWebhookNotifier(notify.WebhookConfig{
+			URL:        srv.cfg.WebhookURL,
+			AuthHeader: srv.cfg.WebhookAuthHeader,
+		})
+		srv.conditionTracker = notify.NewConditionTracker(srv.notifier)
+	}
+	if err := srv.registerHooks(); err != nil {
+		return err
+	}
+	if srv.cfg.AuditSink != "" {
+		sink, err := audit.NewSink(srv.cfg.AuditSink, srv.cfg.AuditSinkAddress)
+		if err != nil {
+			return ErrInvalidConfig.WithCause(err)
+		}
+		srv.auditor = audit.NewLogger(sink, srv.cfg.NodeName)
+	}
+	if srv.cfg.SnapshotIntervalMs > 0 {
+		srv.snapshotScheduler = backup.NewScheduler(backup.NewLocalWriter(srv.cfg.SnapshotDir), backup.RetentionPolicy{
+			MaxCount: srv.cfg.SnapshotRetentionCount,
+			MaxAge:   srv.cfg.SnapshotRetention(),
+		})
+	}
+
+	if endpoints := srv.cfg.ReplicaEndpoints(); len(endpoints) > 0 {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   endpoints,
+			DialTimeout: srv.cfg.EtcdCallTimeout(),
+			LogConfig:   log.GetLoggerConfig(),
+		})
+		if err != nil {
+			return ErrCreateEtcdClient.WithCausef("replica endpoints:%v, err:%v", endpoints, err)
+		}
+		srv.replicaCli = client
+	}
+
+	metaStorage := storage.NewStorageWithEtcdBackend(srv.etcdCli, srv.cfg.StorageRootPath, storage.Options{
+		MaxScanLimit: srv.cfg.MaxScanLimit,
+		MinScanLimit: srv.cfg.MinScanLimit,
+		RateLimit: storage.RateLimitOptions{
+			ReadOpsPerSec:  srv.cfg.EtcdReadRateLimit,
+			ReadBurst:      srv.cfg.EtcdReadBurst,
+			WriteOpsPerSec: srv.cfg.EtcdWriteRateLimit,
+			WriteBurst:     srv.cfg.EtcdWriteBurst,
+			FailFast:       srv.cfg.EtcdRateLimitFailFast,
+		},
+		TopologyBatchWindow: srv.cfg.TopologyBatchWindow(),
+		TopologyDelta: storage.TopologyDeltaOptions{
+			MinTables:  srv.cfg.TopologyDeltaMinTables,
+			MaxChanges: srv.cfg.TopologyDeltaMaxChanges,
+		},
+		Observer: procedure.StorageObserver{},
+	})
+	// The clusters are loaded only after the first read succeeds, so that a failed load is never retried.
+	if err := etcdutil.WaitStartup(ctx, srv.startupWaitOptions(), "read storage", func(ctx context.Context) error {
+		_, err := metaStorage.ListClusters(ctx)
+		return err
+	}); err != nil {
+		return ErrLoadClusters.WithCause(err)
+	}
+	// A mirror must not be served until it is promoted, since it may be incomplete and still be written by the leader
+	// of the primary ceresmeta cluster.
+	if err := replication.CheckAuthoritative(ctx, srv.etcdCli, srv.cfg.StorageRootPath); err != nil {
+		return ErrLoadClusters.WithCause(err)
+	}
+	// The root path shared by another deployment by accident must not be served, since their data would interleave.
+	fingerprint, err := cluster.ClaimDeployment(ctx, metaStorage, cluster.DeploymentExpectation{
+		ID:       srv.cfg.DeploymentID,
+		Clusters: []string{srv.cfg.DefaultClusterName},
+		Override: srv.cfg.AllowRootPathTakeover,
+	})
+	if err != nil {
+		return ErrLoadClusters.WithCause(err)
+	}
+	log.Info("serve deployment", zap.String("deployment", fingerprint.ID), zap.String("root", srv.cfg.StorageRootPath))
+	manager := cluster.NewManagerImpl(metaStorage, srv.cfg.StorageRootPath)
+	if err := manager.Load(ctx); err != nil {
+		return ErrLoadClusters.WithCause(err)
+	}
+	srv.clusterManager = manager
+
+	return srv.createDefaultClusterIfNotExist(ctx)
+}
+
+func (srv *Server) startupWaitOptions() etcdutil.StartupWaitOptions {
+	opts := etcdutil.DefaultStartupWaitOptions
+	opts.MaxWait = srv.cfg.EtcdStartupWait()
+	opts.AttemptTimeout = srv.cfg.EtcdCallTimeout()
+	return opts
+}
+
+func (srv *Server) createDefaultClusterIfNotExist(ctx context.Context) error {
+	_, err := srv.clusterManager.GetCluster(ctx, srv.cfg.DefaultClusterName)
+	if err == nil {
+		return nil
+	}
+	if !coderr.Is(err, coderr.NotFound) {
+		return ErrCreateCluster.WithCause(err)
+	}
+
+	var assignment *cluster.InitialShardAssignment
+	if srv.cfg.DefaultClusterInitialNodes != "" || srv.cfg.DefaultClusterInitialShardAssignment != "" {
+		assignment, err = cluster.ParseInitialShardAssignment(srv.cfg.DefaultClusterInitialNodes,
+			srv.cfg.DefaultClusterInitialShardAssignment)
+		if err != nil {
+			return ErrCreateCluster.WithCause(err)
+		}
+	}
+	tags, err := cluster.ParseClusterTags(srv.cfg.DefaultClusterTags)
+	if err != nil {
+		return ErrCreateCluster.WithCause(err)
+	}
+	_, err = srv.clusterManager.CreateClusterWithOptions(ctx, srv.cfg.DefaultClusterName,
+		uint32(srv.cfg.DefaultClusterNodeCount), uint32(srv.cfg.DefaultClusterReplicationFactor),
+		uint32(srv.cfg.DefaultClusterShardTotal), cluster.CreateClusterOptions{
+			InitialShardAssignment: assignment,
+			TableNameScope:         cluster.TableNameScope(srv.cfg.DefaultClusterTableNameScope),
+			TableIDAllocScope:      cluster.TableIDAllocScope(srv.cfg.DefaultClusterTableIDAllocScope),
+			Labels: cluster.ClusterLabels{
+				Environment: srv.cfg.DefaultClusterEnvironment,
+				Owner:       srv.cfg.DefaultClusterOwner,
+				Tags:        tags,
+			},
+		})
+	if err == nil {
+		return nil
+	}
+	if !coderr.Is(err, coderr.InvalidParams) {
+		return ErrCreateCluster.WithCause(err)
+	}
+	// The servers starting together race to create the default cluster, and the losers load the one created by the
+	// winner.
+	if loadErr := srv.clusterManager.Load(ctx); loadErr != nil {
+		return ErrLoadClusters.WithCause(loadErr)
+	}
+	if _, getErr := srv.clusterManager.GetCluster(ctx, srv.cfg.DefaultClusterName); getErr != nil {
+		return ErrCreateCluster.WithCause(err)
+	}
+	log.Info("default cluster is created by another server", zap.String("cluster", srv.cfg.DefaultClusterName))
 	return nil
 }
 
@@ -143,6 +395,59 @@ func (srv *Server) startBgJobs(ctx context.Context) {
 
 	go srv.watchLeader(bgJobCtx)
 	go srv.watchEtcdLeaderPriority(bgJobCtx)
+	go srv.watchEtcdSpace(bgJobCtx)
+	go srv.publishRevisionPins(bgJobCtx)
+	go srv.compactEtcd(bgJobCtx)
+	go srv.watchReadStaleness(bgJobCtx)
+	go srv.watchLeadership(bgJobCtx)
+	go srv.watchUnassignedShards(bgJobCtx)
+	go srv.watchTopologies(bgJobCtx)
+	go srv.flushHeartbeats(bgJobCtx)
+	if srv.conditionTracker != nil {
+		go srv.watchClusterConditions(bgJobCtx)
+	}
+	go srv.verifyShardTableSets(bgJobCtx)
+	go srv.persistTableRouteStats(bgJobCtx)
+	if srv.snapshotScheduler != nil {
+		go srv.takeSnapshots(bgJobCtx)
+	}
+	if srv.replicaCli != nil {
+		go srv.replicateToStandby(bgJobCtx)
+	}
+	if srv.observerPromoter != nil {
+		go srv.promoteObservers(bgJobCtx)
+	}
+	if srv.leaseTuner != nil {
+		go srv.tuneLeaseTTL(bgJobCtx)
+	}
+	if srv.hooks != nil {
+		go srv.watchOfflineNodes(bgJobCtx)
+	}
+}
+
+// registerHooks registers the built-in hooks configured, and the registry is left nil if none is configured.
+func (srv *Server) registerHooks() error {
+	hooks := make([]hook.Hook, 0, 3)
+	if srv.cfg.EnableLogHook {
+		hooks = append(hooks, hook.LogHook{})
+	}
+	if srv.cfg.HookWebhookURL != "" {
+		hooks = append(hooks, &hook.WebhookHook{URL: srv.cfg.HookWebhookURL})
+	}
+	if srv.cfg.HookExecCommand != "" {
+		hooks = append(hooks, &hook.ExecHook{Command: srv.cfg.HookExecCommand})
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	srv.hooks = hook.NewRegistry()
+	for _, h := range hooks {
+		if err := srv.hooks.Register(h, hook.Options{Timeout: srv.cfg.HookTimeout()}); err != nil {
+			return ErrInvalidConfig.WithCause(err)
+		}
+	}
+	return nil
 }
 
 func (srv *Server) stopBgJobs() {
@@ -170,6 +475,633 @@ func (srv *Server) watchEtcdLeaderPriority(_ context.Context) {
 	defer srv.bgJobWg.Done()
 }
 
+// watchEtcdSpace checks the etcd space quota periodically to enter or leave the read-only mode.
+func (srv *Server) watchEtcdSpace(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.EtcdSpaceCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, srv.cfg.EtcdCallTimeout())
+			if _, err := srv.spaceMonitor.Check(checkCtx); err != nil {
+				log.Warn("fail to check etcd space", zap.Error(err))
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// revisionPinsPrefix is the prefix of the keys to which the servers publish their revision pins.
+func (srv *Server) revisionPinsPrefix() string {
+	return path.Join(srv.cfg.StorageRootPath, "revision_pins") + "/"
+}
+
+// publishRevisionPins publishes the revisions pinned by the watches of the server, so that they are not compacted by
+// the leader.
+func (srv *Server) publishRevisionPins(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	srv.revisionPins.Publish(ctx, srv.etcdCli, srv.revisionPinsPrefix()+srv.cfg.NodeName, srv.cfg.LeaseTTLSec,
+		srv.cfg.EtcdCallTimeout())
+}
+
+// compactEtcd compacts the etcd revisions out of the retention periodically if the server is the leader.
+func (srv *Server) compactEtcd(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	window, err := etcdutil.ParseMaintenanceWindow(srv.cfg.EtcdDefragWindow)
+	if err != nil {
+		log.Error("invalid etcd defrag window and the defragmentation is disabled", zap.Error(err))
+	}
+	policy := etcdutil.CompactionPolicy{
+		Retention:          time.Duration(srv.cfg.EtcdCompactionRetentionMs) * time.Millisecond,
+		RetentionRevisions: srv.cfg.EtcdCompactionRetentionRevisions,
+		DefragWindow:       window,
+	}
+	if !policy.Enabled() {
+		return
+	}
+	compactor := etcdutil.NewCompactor(srv.etcdCli, policy, srv.revisionPins, srv.revisionPinsPrefix())
+
+	ticker := time.NewTicker(srv.cfg.EtcdCompactionInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			compactCtx, cancel := context.WithTimeout(ctx, srv.cfg.EtcdCallTimeout())
+			if _, err := compactor.Compact(compactCtx); err != nil {
+				log.Warn("fail to compact etcd", zap.Error(err))
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchReadStaleness tracks the revision applied by the server and checks its lag behind the leader periodically.
+func (srv *Server) watchReadStaleness(ctx context.Context) {
+	srv.bgJobWg.Add(2)
+	defer srv.bgJobWg.Done()
+
+	go func() {
+		defer srv.bgJobWg.Done()
+		srv.stalenessTracker.Watch(ctx)
+	}()
+
+	ticker := time.NewTicker(srv.cfg.ReadStalenessCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			leader := srv.IsLeader(ctx)
+			checkCtx, cancel := context.WithTimeout(ctx, srv.cfg.EtcdCallTimeout())
+			if _, err := srv.stalenessTracker.Check(checkCtx, leader); err != nil {
+				log.Warn("fail to check read staleness", zap.Error(err))
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchLeadership restarts tracking the heartbeats of the nodes when the server becomes the leader, instead of
+// inheriting the stale ones received before, which would expire the nodes heartbeating to the previous leader. The
+// leader also resumes the drops of the tables found being dropped by loading the clusters, which the followers leave.
+func (srv *Server) watchLeadership(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.LeadershipCheckInterval())
+	defer ticker.Stop()
+
+	leader := false
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				atomic.StoreInt32(&srv.leaderLoaded, 0)
+				// The changes written by the new leader before the watches see the server as a follower are missed.
+				if leader {
+					for _, c := range srv.clusterManager.ListClusters(ctx) {
+						c.MarkStale()
+					}
+				}
+				leader = false
+				continue
+			}
+			if !leader {
+				// The caches of the clusters are only refreshed by the leader's own writes, so the ones kept as a
+				// follower are stale, and the clusters are reloaded before serving the DDLs.
+				if err := srv.clusterManager.Load(ctx); err != nil {
+					log.Error("fail to reload clusters after becoming leader", zap.Error(err))
+					continue
+				}
+				leader = true
+				log.Info("become leader, reload clusters and reset node liveness", zap.String("node", srv.cfg.NodeName))
+				for _, c := range srv.clusterManager.ListClusters(ctx) {
+					c.ResetNodeLiveness()
+				}
+				atomic.StoreInt32(&srv.leaderLoaded, 1)
+			}
+			// The clusters may be reloaded at any time, so the drops found are resumed on every check.
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				if err := c.ReloadIfStale(ctx); err != nil {
+					log.Error("fail to reload stale cluster", zap.String("cluster", c.Name()), zap.Error(err))
+				}
+				c.ResumeDropTables()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// IsLeader tells whether the server is the leader of the ceresmeta cluster now.
+func (srv *Server) IsLeader(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, srv.cfg.EtcdCallTimeout())
+	defer cancel()
+
+	resp, err := srv.member.GetLeader(ctx)
+	if err != nil {
+		log.Warn("fail to get leader", zap.Error(err))
+		return false
+	}
+	return resp.Leader != nil && resp.Leader.GetId() == srv.member.ID
+}
+
+// isFollower tells whether the server isn't the leader with the clusters reloaded.
+func (srv *Server) isFollower() bool {
+	return atomic.LoadInt32(&srv.leaderLoaded) == 0
+}
+
+// CheckLeader checks the server is the leader and has reloaded the clusters since it became the leader.
+func (srv *Server) CheckLeader(ctx context.Context) error {
+	if srv.isFollower() || !srv.IsLeader(ctx) {
+		return ErrNotLeader.WithCausef("node:%s", srv.cfg.NodeName)
+	}
+	return nil
+}
+
+// watchUnassignedShards refreshes the gauge of the unassigned shards periodically, assigns the shards to their initial
+// owners given at the creation of the cluster, and assigns the others to the alive nodes if the auto assignment is
+// enabled. Only the leader assigns the shards, because the followers receive no heartbeats and would see every shard
+// unassigned.
+func (srv *Server) watchUnassignedShards(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	// Assigning the shards is the failover, which should proceed even if the storage is overloaded.
+	ctx = storage.WithPriority(ctx, storage.PriorityHigh)
+
+	ticker := time.NewTicker(srv.cfg.ShardAutoAssignInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				assignments, err := c.ApplyInitialShardAssignment(ctx)
+				if err != nil {
+					log.Warn("fail to assign shards to initial owners", zap.String("cluster", c.Name()), zap.Error(err))
+				}
+				srv.openShards(c, assignments)
+
+				if !srv.cfg.EnableShardAutoAssign {
+					c.ListUnassignedShards(0)
+					continue
+				}
+
+				assignments, err = c.AutoAssignShards(ctx, srv.cfg.ShardAutoAssignDelay())
+				if err != nil {
+					log.Warn("fail to assign shards automatically", zap.String("cluster", c.Name()), zap.Error(err))
+				}
+				srv.openShards(c, assignments)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchClusterConditions checks the conditions of the clusters periodically and the transitions are notified. Only the
+// leader checks them, because the followers receive no heartbeats and would see every node offline.
+func (srv *Server) watchClusterConditions(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.ConditionCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				srv.checkClusterConditions(c)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nodeConflictConditionWindow is how long a detected node identity conflict keeps the condition true.
+const nodeConflictConditionWindow = time.Minute
+
+func (srv *Server) checkClusterConditions(c *cluster.Cluster) {
+	offlineNodes := make([]string, 0)
+	for _, node := range c.GetNodes(0).Nodes {
+		if !node.Alive {
+			offlineNodes = append(offlineNodes, node.Name)
+		}
+	}
+	// The shards are considered unassigned too long if they are not assigned within the delay of the auto assignment.
+	unassignedShards := c.ListUnassignedShards(srv.cfg.ShardAutoAssignDelay())
+
+	var nodeReason, shardReason string
+	degradedReasons := make([]string, 0, 2)
+	if len(offlineNodes) > 0 {
+		nodeReason = fmt.Sprintf("offline nodes:%v", offlineNodes)
+		degradedReasons = append(degradedReasons, nodeReason)
+	}
+	if len(unassignedShards) > 0 {
+		shardReason = fmt.Sprintf("shards unassigned longer than %s:%v", srv.cfg.ShardAutoAssignDelay(), unassignedShards)
+		degradedReasons = append(degradedReasons, shardReason)
+	}
+	degradedReason := strings.Join(degradedReasons, "; ")
+
+	nodes := make(map[string]struct{})
+	for _, node := range c.GetNodes(0).Nodes {
+		nodes[node.Name] = struct{}{}
+	}
+	conflicts := make([]string, 0)
+	for _, conflict := range srv.hbStreams.NodeConflicts(time.Now().Add(-nodeConflictConditionWindow)) {
+		if _, ok := nodes[conflict.Node]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s(%s,%s)", conflict.Node, conflict.ExistingPeer, conflict.NewPeer))
+		}
+	}
+	var conflictReason string
+	if len(conflicts) > 0 {
+		conflictReason = fmt.Sprintf("nodes started twice:%v", conflicts)
+	}
+	capacity := c.GetShardCapacity()
+	var capacityReason string
+	if capacity.Insufficient() {
+		capacityReason = fmt.Sprintf("shard capacity:%d of alive nodes is less than shards:%d", capacity.Capacity, capacity.Shards)
+	}
+
+	name := c.Name()
+	srv.conditionTracker.Update(name, notify.ConditionNodeOffline, notify.StatusOf(len(offlineNodes) > 0), nodeReason)
+	srv.conditionTracker.Update(name, notify.ConditionShardUnassigned, notify.StatusOf(len(unassignedShards) > 0), shardReason)
+	srv.conditionTracker.Update(name, notify.ConditionClusterDegraded, notify.StatusOf(degradedReason != ""), degradedReason)
+	srv.conditionTracker.Update(name, notify.ConditionNodeIdentityConflict, notify.StatusOf(len(conflicts) > 0), conflictReason)
+	srv.conditionTracker.Update(name, notify.ConditionShardCapacityInsufficient, notify.StatusOf(capacity.Insufficient()), capacityReason)
+}
+
+// watchOfflineNodes emits the node offline events while the server is the leader. The event is emitted once the node
+// observed alive goes offline, so the nodes already offline when the server becomes the leader are not reported.
+func (srv *Server) watchOfflineNodes(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.ConditionCheckInterval())
+	defer ticker.Stop()
+
+	// aliveNodes maps the name of the cluster to the liveness of its nodes observed in the last round.
+	aliveNodes := make(map[string]map[string]bool)
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				aliveNodes = make(map[string]map[string]bool)
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				last := aliveNodes[c.Name()]
+				current := make(map[string]bool)
+				for _, node := range c.GetNodes(0).Nodes {
+					current[node.Name] = node.Alive
+					if alive, ok := last[node.Name]; ok && alive && !node.Alive {
+						srv.hooks.Emit(hook.Event{Type: hook.EventNodeOffline, Cluster: c.Name(), Node: node.Name})
+					}
+				}
+				aliveNodes[c.Name()] = current
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushHeartbeats applies the liveness recorded by the fast path of the heartbeats to the nodes periodically.
+func (srv *Server) flushHeartbeats(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.HeartbeatFlushInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				c.FlushHeartbeats()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// verifyShardTableSets retries the compensations and verifies the placement of the tables periodically, so that the
+// problems are found before the queries fail. Only the leader verifies them, because the compensations and the owners
+// of the shards are known by the leader only.
+func (srv *Server) verifyShardTableSets(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.TableSetVerifyInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				c.RetryCompensations(ctx)
+				verification := c.VerifyShardTableSets()
+				for _, table := range verification.UncompensatedTables {
+					log.Warn("table of failed creation is left", zap.String("cluster", c.Name()),
+						zap.String("schema", table.SchemaName), zap.String("table", table.TableName),
+						zap.Uint64("table-id", table.TableID), zap.Time("flagged-at", table.FlaggedAt))
+				}
+				for _, reconcile := range verification.PendingReconciles {
+					log.Warn("shard topology of created table is not persisted", zap.String("cluster", c.Name()),
+						zap.String("schema", reconcile.SchemaName), zap.String("table", reconcile.TableName),
+						zap.Uint64("table-id", reconcile.TableID), zap.Uint32("shard", reconcile.ShardID),
+						zap.Int("attempts", reconcile.Attempts), zap.Time("recorded-at", reconcile.RecordedAt))
+				}
+				for _, violation := range verification.AntiAffinityViolations {
+					log.Warn("tables of anti-affinity group are not spread", zap.String("cluster", c.Name()),
+						zap.String("schema", violation.SchemaName), zap.Uint64("group", violation.Group),
+						zap.String("kind", string(violation.Kind)), zap.Uint32("shard", violation.ShardID),
+						zap.String("node", violation.Node), zap.Int("count", violation.Count), zap.Int("limit", violation.Limit))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// persistTableRouteStats persists the route statistics of the tables periodically. Only the leader persists them, so
+// that the stale statistics of a follower never overwrite the ones of the leader.
+func (srv *Server) persistTableRouteStats(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	// The statistics are persisted again in the next round if they are shed.
+	ctx = storage.WithPriority(ctx, storage.PriorityLow)
+
+	ticker := time.NewTicker(srv.cfg.TableRouteStatsPersistInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				if err := c.PersistTableRouteStats(ctx); err != nil {
+					log.Warn("fail to persist table route stats", zap.String("cluster", c.Name()), zap.Error(err))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// topologyWatchCheckInterval is how often the clusters are checked to watch their topologies.
+const topologyWatchCheckInterval = time.Second * 10
+
+// watchTopologies watches the topologies of the clusters to keep their cached topologies valid, and the clusters
+// created later are watched in the next round. The clusters replaced by a reload are no longer watched.
+func (srv *Server) watchTopologies(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(topologyWatchCheckInterval)
+	defer ticker.Stop()
+
+	watched := make(map[*cluster.Cluster]context.CancelFunc)
+	for {
+		clusters := srv.clusterManager.ListClusters(ctx)
+		current := make(map[*cluster.Cluster]struct{}, len(clusters))
+		for _, c := range clusters {
+			current[c] = struct{}{}
+			if _, ok := watched[c]; ok {
+				continue
+			}
+			watchCtx, cancel := context.WithCancel(ctx)
+			watched[c] = cancel
+			srv.bgJobWg.Add(1)
+			go func(c *cluster.Cluster) {
+				defer srv.bgJobWg.Done()
+				c.WatchTopology(watchCtx, srv.isFollower)
+			}(c)
+		}
+		for c, cancel := range watched {
+			if _, ok := current[c]; !ok {
+				cancel()
+				delete(watched, c)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// takeSnapshots takes the snapshots of the clusters periodically if the server is the leader.
+func (srv *Server) takeSnapshots(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	// The snapshot is taken again in the next round if it is shed.
+	ctx = storage.WithPriority(ctx, storage.PriorityLow)
+
+	ticker := time.NewTicker(srv.cfg.SnapshotInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			for _, c := range srv.clusterManager.ListClusters(ctx) {
+				if err := srv.snapshotScheduler.TakeSnapshot(ctx, c, now); err != nil {
+					log.Error("fail to take scheduled snapshot", zap.String("cluster", c.Name()), zap.Error(err))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replicateToStandby mirrors the metadata to the standby etcd cluster while the server is the leader, and the
+// replication is stopped once the server loses the leadership so that only one server writes the mirror.
+func (srv *Server) replicateToStandby(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.LeadershipCheckInterval())
+	defer ticker.Stop()
+
+	var (
+		cancel func()
+		done   chan struct{}
+	)
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			<-done
+			cancel, done = nil, nil
+		}
+	}
+	defer stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			leader := srv.IsLeader(ctx)
+			if !leader {
+				stop()
+				continue
+			}
+			if cancel != nil {
+				continue
+			}
+
+			log.Info("become leader, start replicating to standby", zap.String("root", srv.cfg.ReplicaStorageRootPath))
+			replicator := replication.NewReplicator(srv.etcdCli, srv.cfg.StorageRootPath, srv.replicaCli,
+				srv.cfg.ReplicaStorageRootPath)
+			replicateCtx, replicateCancel := context.WithCancel(ctx)
+			cancel, done = replicateCancel, make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				replicator.Run(replicateCtx)
+			}(done)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// promoteObservers replaces the voters unhealthy for a while with the observers if the server is the leader.
+func (srv *Server) promoteObservers(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	ticker := time.NewTicker(srv.cfg.ObserverCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if !srv.IsLeader(ctx) {
+				continue
+			}
+			if _, err := srv.observerPromoter.Check(ctx, now); err != nil {
+				log.Error("fail to promote observer", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// leaseTunerSampleInterval is how often the gc pauses are sampled for tuning the ttl of the leadership lease.
+const leaseTunerSampleInterval = time.Second
+
+// tuneLeaseTTL samples the gc pauses and lowers the ttl of the leadership lease after the stable periods.
+func (srv *Server) tuneLeaseTTL(ctx context.Context) {
+	srv.bgJobWg.Add(1)
+	defer srv.bgJobWg.Done()
+
+	srv.leaseTuner.Run(ctx, leaseTunerSampleInterval)
+}
+
+// PromoteObserver promotes the observer to a voting member of the etcd cluster, replacing the unhealthy voter if
+// replaceVoterID isn't zero.
+func (srv *Server) PromoteObserver(ctx context.Context, observerID, replaceVoterID uint64) (*member.ObserverPromotion, error) {
+	return srv.member.PromoteObserver(ctx, observerID, replaceVoterID, srv.cfg.ObserverMaxLagIndex)
+}
+
+// ListMembers returns the members of the etcd cluster along with the leader of the ceresmeta cluster.
+func (srv *Server) ListMembers(ctx context.Context) (*member.Members, error) {
+	return srv.member.ListMembers(ctx)
+}
+
+// AssignShard assigns the unassigned shard to the node and asks the node to open it.
+func (srv *Server) AssignShard(ctx context.Context, clusterName string, shardID uint32, node string) error {
+	c, err := srv.clusterManager.GetCluster(ctx, clusterName)
+	if err != nil {
+		return err
+	}
+	if err := c.AssignShard(ctx, shardID, node); err != nil {
+		return err
+	}
+
+	srv.openShards(c, []cluster.ShardAssignment{{ShardID: shardID, Node: node}})
+	return nil
+}
+
+// shardOpenRouteWindow is how far back the route lookups of the tables decide the order of opening their shards.
+const shardOpenRouteWindow = time.Hour
+
+// openShards queues the shards to be opened by the nodes, and the shards with more tables routed lately are opened
+// first. The failed ones will be assigned again after the delay since the nodes won't report the shards as owned.
+func (srv *Server) openShards(c *cluster.Cluster, assignments []cluster.ShardAssignment) {
+	nodeShards := make(map[string][]uint32)
+	for _, assignment := range assignments {
+		nodeShards[assignment.Node] = append(nodeShards[assignment.Node], assignment.ShardID)
+	}
+
+	since := time.Now().Add(-shardOpenRouteWindow)
+	for node, shardIDs := range nodeShards {
+		srv.shardOpener.Open(node, c.OrderShardsByRoutes(shardIDs, since))
+	}
+}
+
 type leaderWatchContext struct {
 	srv *Server
 }
@@ -182,16 +1114,203 @@ func (ctx *leaderWatchContext) EtcdLeaderID() uint64 {
 	return ctx.srv.etcdSrv.Server.Lead()
 }
 
-func (srv *Server) BindHeartbeatStream(_ context.Context, node string, sender grpcservice.HeartbeatStreamSender) error {
-	srv.hbStreams.Bind(node, sender)
+func (srv *Server) BindHeartbeatStream(ctx context.Context, node string, sender grpcservice.HeartbeatStreamSender) error {
+	peerAddr := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddr = p.Addr.String()
+	}
+	return srv.hbStreams.BindFromPeer(node, peerAddr, sender)
+}
+
+func (srv *Server) UnbindHeartbeatStream(_ context.Context, node string, sender grpcservice.HeartbeatStreamSender) error {
+	srv.hbStreams.UnbindStream(node, sender)
+	return nil
+}
+
+func (srv *Server) CheckHeartbeatStream(_ context.Context, node string, sender grpcservice.HeartbeatStreamSender) error {
+	return srv.hbStreams.CheckStream(node, sender)
+}
+
+// ProcessHeartbeat registers the node, and the pending shard commands of the node are acked by the heartbeat. The
+// heartbeat carrying a stale topology generation in the ctx still registers the node but acks no command. The
+// heartbeat failing to be registered within the deadline is acked without error, and it acks no command either. The
+// node reporting the shards owned by other alive nodes is told to close them.
+func (srv *Server) ProcessHeartbeat(ctx context.Context, req *metapb.NodeHeartbeatRequest) error {
+	start := time.Now()
+	c, err := srv.clusterManager.GetCluster(ctx, req.GetHeader().GetClusterName())
+	if err != nil {
+		return err
+	}
+	path, conflicts, err := c.HandleHeartbeat(ctx, req.GetInfo(), srv.heartbeatPool, srv.cfg.HeartbeatDeadline(),
+		srv.cfg.GrpcHandleTimeout())
+	schedule.ObserveHeartbeatLatency(path, time.Since(start), srv.cfg.HeartbeatLatencySLO())
+	if len(conflicts) > 0 {
+		srv.closeConflictingShards(ctx, req.GetInfo().GetNode(), conflicts)
+	}
+	if err != nil || path == schedule.HeartbeatPathDeferred {
+		return err
+	}
+
+	srv.hbStreams.ObserveHeartbeat(ctx, req.GetInfo())
+	return nil
+}
+
+// closeConflictingShards tells the node to close the shards owned by other alive nodes. The close command is not
+// tracked, since the node reporting the shards again is told to close them by every heartbeat.
+func (srv *Server) closeConflictingShards(ctx context.Context, node string, shardIDs []uint32) {
+	msg := &metapb.NodeHeartbeatResponse{
+		Header: &commonpb.ResponseHeader{},
+		Cmd:    &metapb.NodeHeartbeatResponse_CloseCmd{CloseCmd: &metapb.CloseCmd{ShardIds: shardIDs}},
+	}
+	if err := srv.hbStreams.SendMsgAsync(ctx, node, msg); err != nil {
+		log.Warn("fail to close conflicting shards", zap.String("node", node), zap.Uint32s("shards", shardIDs),
+			zap.Error(err))
+	}
+}
+
+// ValidateNodeEndpoint checks the endpoint advertised by the node, and the endpoint is connected if the probe is
+// enabled.
+func (srv *Server) ValidateNodeEndpoint(ctx context.Context, endpoint string) error {
+	if err := cluster.ValidateNodeEndpoint(endpoint, srv.cfg.AllowLoopbackNodeEndpoint); err != nil {
+		return err
+	}
+	if !srv.cfg.EnableNodeEndpointProbe {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, srv.cfg.NodeEndpointProbeTimeout())
+	defer cancel()
+	return cluster.ProbeNodeEndpoint(ctx, endpoint)
+}
+
+func (srv *Server) GetClusterManager() cluster.Manager {
+	return srv.clusterManager
+}
+
+// CheckWritable returns error if the server is in the read-only mode because the etcd space quota is exceeded.
+func (srv *Server) CheckWritable() error {
+	if status := srv.spaceMonitor.Status(); status.Exceeded {
+		return etcdutil.ErrEtcdSpaceExceeded.WithCausef("db size:%d, quota:%d", status.DBSize, status.Quota)
+	}
 	return nil
 }
 
-func (srv *Server) UnbindHeartbeatStream(_ context.Context, node string) error {
-	srv.hbStreams.Unbind(node)
+// GetProcedureTracker returns the tracker of the in-flight procedures.
+func (srv *Server) GetProcedureTracker() *procedure.Tracker {
+	return srv.procedures
+}
+
+// GetNodeSnapshot returns the shards assigned to the node along with their tables and the options of the cluster in one
+// consistent response.
+func (srv *Server) GetNodeSnapshot(ctx context.Context, clusterName, nodeName string) (*cluster.NodeSnapshot, error) {
+	return srv.clusterManager.GetNodeSnapshot(ctx, clusterName, nodeName)
+}
+
+// GetProcedureLimiter returns the limiter of the running procedures.
+func (srv *Server) GetProcedureLimiter() *schedule.ProcedureLimiter {
+	return srv.procedureLimiter
+}
+
+// ProcedureConcurrency returns the numbers of the running and the queued procedures along with the limit.
+func (srv *Server) ProcedureConcurrency(_ context.Context) schedule.ProcedureConcurrency {
+	return srv.procedureLimiter.Concurrency()
+}
+
+// GetHooks returns the registry of the hooks invoked on the events.
+func (srv *Server) GetHooks() *hook.Registry {
+	return srv.hooks
+}
+
+// GetAuditor returns the logger of the audit records.
+func (srv *Server) GetAuditor() *audit.Logger {
+	return srv.auditor
+}
+
+// ListBlockedProcedures returns the in-flight procedures waiting on something with the reasons, and the longest waiting
+// one comes first.
+func (srv *Server) ListBlockedProcedures(_ context.Context) ([]procedure.BlockedProcedure, error) {
+	return srv.procedures.ListBlocked(), nil
+}
+
+// GetProcedure returns the procedure in flight or finished lately along with the breakdown of its wall time by the
+// steps.
+func (srv *Server) GetProcedure(_ context.Context, id uint64) (*procedure.Procedure, error) {
+	p, ok := srv.procedures.Get(id)
+	if !ok {
+		return nil, ErrProcedureNotFound.WithCausef("id:%d", id)
+	}
+	return &p, nil
+}
+
+// CheckReadable returns ErrTooStale if the server is a follower lagging behind the leader by more than the max read
+// staleness, and the reads should be served by the leader instead.
+func (srv *Server) CheckReadable() error {
+	return srv.stalenessTracker.CheckRead()
+}
+
+// GetReadStaleness returns the latest lag of the server behind the leader.
+func (srv *Server) GetReadStaleness() etcdutil.StalenessStatus {
+	return srv.stalenessTracker.Status()
+}
+
+// GetSnapshotStatus returns the statuses of the latest scheduled snapshots keyed by the cluster name, which is empty
+// if the scheduled snapshots are disabled or the server has never been the leader.
+func (srv *Server) GetSnapshotStatus() map[string]backup.Status {
+	if srv.snapshotScheduler == nil {
+		return map[string]backup.Status{}
+	}
+	return srv.snapshotScheduler.Status()
+}
+
+// InspectKeys returns at most limit raw keys under the prefix relative to the storage root path along with their
+// values, and the values of the known protobuf kinds are rendered by the protojson if decode is set.
+func (srv *Server) InspectKeys(ctx context.Context, prefix string, decode bool, limit int) (*storage.KeyInspection, error) {
+	log.Info("inspect keys", zap.String("prefix", prefix), zap.Bool("decode", decode), zap.Int("limit", limit))
+	return storage.InspectKeys(ctx, storage.NewEtcdKV(srv.etcdCli, srv.cfg.StorageRootPath), prefix, decode, limit)
+}
+
+// SetShardOpenPacing changes the pacing of the open commands sent to the nodes at runtime, and the change is lost when
+// the server restarts.
+func (srv *Server) SetShardOpenPacing(_ context.Context, pacing schedule.ShardOpenPacing) error {
+	if pacing.BatchSize < 0 || pacing.MaxInFlight < 0 || pacing.AckTimeout < 0 {
+		return ErrInvalidConfig.WithCausef("negative shard open pacing:%+v", pacing)
+	}
+
+	srv.shardOpener.SetPacing(pacing)
+	log.Info("set shard open pacing", zap.Int("batch-size", pacing.BatchSize),
+		zap.Int("max-in-flight", pacing.MaxInFlight), zap.Duration("ack-timeout", pacing.AckTimeout))
 	return nil
 }
 
-func (*Server) ProcessHeartbeat(_ context.Context, _ *metapb.NodeHeartbeatRequest) error {
+// GetShardOpenPacing returns the pacing of the open commands sent to the nodes.
+func (srv *Server) GetShardOpenPacing(_ context.Context) schedule.ShardOpenPacing {
+	return srv.shardOpener.Pacing()
+}
+
+// AddDebugScope writes the debug logs about the cluster, the shard or the tables with the name prefix of the scope for
+// the ttl regardless of the log level. The scope expires by itself, and its logs are limited by its rate.
+func (srv *Server) AddDebugScope(_ context.Context, scope log.DebugScope, ttl time.Duration) (log.DebugScope, error) {
+	added, err := log.AddDebugScope(scope, ttl)
+	if err != nil {
+		return log.DebugScope{}, ErrInvalidDebugScope.WithCause(err)
+	}
+	return added, nil
+}
+
+// RemoveDebugScope removes the debug scope before it expires.
+func (srv *Server) RemoveDebugScope(_ context.Context, id uint64) error {
+	if !log.RemoveDebugScope(id) {
+		return ErrDebugScopeMissing.WithCausef("id:%d", id)
+	}
 	return nil
 }
+
+// ListDebugScopes lists the active debug scopes with their expiries.
+func (srv *Server) ListDebugScopes(_ context.Context) []log.DebugScope {
+	return log.ListDebugScopes()
+}
+
+// GetEtcdSpaceStatus returns the latest space status of the etcd.
+func (srv *Server) GetEtcdSpaceStatus() etcdutil.SpaceStatus {
+	return srv.spaceMonitor.Status()
+}
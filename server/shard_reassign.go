@@ -0,0 +1,118 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ReassignNodeShards moves all the shards of the node to the targets by the strategy, and returns the plan along with
+// the result of every move. The shards are moved one by one, and every move drains the DDLs of the shard, closes it on
+// the node, opens it on the target and commits the new owner along with the version bump. The procedure stops at the
+// first failed move, which is rolled back in best effort, and the remaining moves are skipped, so the shards moved
+// before are kept on their targets.
+func (srv *Server) ReassignNodeShards(ctx context.Context, clusterName, from string, targets []string,
+	strategy schedule.ReassignStrategy,
+) (*cluster.ShardReassignReport, error) {
+	start := time.Now()
+	report, rolledBack, err := srv.reassignNodeShards(ctx, clusterName, from, targets, strategy)
+	outcome := cluster.ProcedureOutcomeOf(err)
+	if rolledBack && outcome == cluster.ProcedureFailed {
+		outcome = cluster.ProcedureRolledBack
+	}
+	cluster.ObserveProcedure(clusterName, cluster.ProcedureReassignShards, start, outcome)
+	return report, err
+}
+
+// reassignNodeShards tells whether the failed move is rolled back.
+func (srv *Server) reassignNodeShards(ctx context.Context, clusterName, from string, targets []string,
+	strategy schedule.ReassignStrategy,
+) (*cluster.ShardReassignReport, bool, error) {
+	c, err := srv.clusterManager.GetCluster(ctx, clusterName)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "reassign node shards, cluster:%s", clusterName)
+	}
+	report, err := c.PlanShardReassignment(from, targets, strategy)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "plan node shards reassignment, cluster:%s", clusterName)
+	}
+	log.Info("reassign node shards", zap.String("cluster", clusterName), zap.String("procedure", report.ProcedureID),
+		zap.String("from", from), zap.Strings("targets", targets), zap.Int("moves", len(report.Moves)))
+
+	for i := range report.Moves {
+		move := &report.Moves[i]
+		rolledBack, err := srv.moveShard(ctx, c, report.ProcedureID, move)
+		if err == nil {
+			move.State = cluster.ShardMoveDone
+			continue
+		}
+		move.State, move.Error = cluster.ShardMoveFailed, err.Error()
+		for j := i + 1; j < len(report.Moves); j++ {
+			report.Moves[j].State = cluster.ShardMoveSkipped
+		}
+		return report, rolledBack, errors.Wrapf(err, "reassign node shards, procedure:%s", report.ProcedureID)
+	}
+	return report, false, nil
+}
+
+// moveShard moves the shard to the target of the move, and tells whether the failed move is rolled back.
+func (srv *Server) moveShard(ctx context.Context, c *cluster.Cluster, procedureID string, move *cluster.ShardMoveResult) (bool, error) {
+	transfer, err := c.PrepareShardTransfer(procedureID, move.ShardID, move.From, move.To)
+	if err != nil {
+		return false, errors.Wrapf(err, "prepare shard transfer, shard:%d", move.ShardID)
+	}
+	shardIDs := []uint32{move.ShardID}
+	drainCtx, cancel := context.WithTimeout(ctx, defaultShardSwapStepTimeout)
+	err = c.DrainShardDDLs(drainCtx, shardIDs)
+	cancel()
+	if err != nil {
+		c.AbortShardTransfer(transfer)
+		return false, errors.Wrapf(err, "drain shard ddls of transfer, shard:%d", move.ShardID)
+	}
+	defer c.UndrainShardDDLs(shardIDs)
+
+	closeCmds := []shardCommand{{node: move.From, shardIDs: shardIDs}}
+	openCmds := []shardCommand{{node: move.To, shardIDs: shardIDs}}
+	if err := srv.runShardCommands(ctx, closeCmds, false); err != nil {
+		srv.rollbackShardTransfer(c, transfer, nil)
+		return true, errors.Wrapf(err, "close shard of transfer, shard:%d", move.ShardID)
+	}
+	if err := srv.runShardCommands(ctx, openCmds, true); err != nil {
+		srv.rollbackShardTransfer(c, transfer, openCmds)
+		return true, errors.Wrapf(err, "open shard of transfer, shard:%d", move.ShardID)
+	}
+	if err := c.CommitShardTransfer(ctx, transfer); err != nil {
+		srv.rollbackShardTransfer(c, transfer, openCmds)
+		return true, errors.Wrapf(err, "commit shard transfer, shard:%d", move.ShardID)
+	}
+	return false, nil
+}
+
+// rollbackShardTransfer closes the shard opened on the target and reopens it on the original node, and then releases
+// the freeze of the transfer. The errors are only logged because the heartbeats will correct the owner anyway.
+func (srv *Server) rollbackShardTransfer(c *cluster.Cluster, transfer *cluster.ShardTransfer, openedCmds []shardCommand) {
+	ctx, cancel := context.WithTimeout(storage.WithPriority(context.Background(), storage.PriorityHigh),
+		defaultShardSwapRollbackTimeout)
+	defer cancel()
+
+	if len(openedCmds) > 0 {
+		if err := srv.runShardCommands(ctx, openedCmds, false); err != nil {
+			log.Error("fail to close transferred shard in rollback", zap.String("procedure", transfer.ProcedureID),
+				zap.Uint32("shard", transfer.ShardID), zap.Error(err))
+		}
+	}
+	reopenCmds := []shardCommand{{node: transfer.From, shardIDs: []uint32{transfer.ShardID}}}
+	if err := srv.runShardCommands(ctx, reopenCmds, true); err != nil {
+		log.Error("fail to reopen shard in rollback", zap.String("procedure", transfer.ProcedureID),
+			zap.Uint32("shard", transfer.ShardID), zap.Error(err))
+	}
+	c.AbortShardTransfer(transfer)
+}
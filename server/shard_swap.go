@@ -0,0 +1,129 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/commonpb"
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/cluster"
+	"github.com/CeresDB/ceresmeta/server/schedule"
+	"github.com/CeresDB/ceresmeta/server/storage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultShardSwapStepTimeout bounds the waiting for the acks of the commands of every step of the swap.
+	defaultShardSwapStepTimeout = time.Second * 30
+	// defaultShardSwapRollbackTimeout bounds the rollback of a failed swap.
+	defaultShardSwapRollbackTimeout = time.Second * 30
+)
+
+// shardCommand is a command on some shards of a node.
+type shardCommand struct {
+	node     string
+	shardIDs []uint32
+}
+
+// SwapShards exchanges the owners of two shards owned by different nodes. The pending DDLs of both shards are drained
+// at first, and both shards are closed on their owners and then opened on the other nodes, and the new owners are
+// committed along with the version bumps of both shards in a single transaction. If any step fails, the shards are
+// closed on the new nodes and reopened on the original ones in best effort, and the swap is recorded as rolled back
+// unless it times out.
+func (srv *Server) SwapShards(ctx context.Context, clusterName string, shardA, shardB uint32) error {
+	start := time.Now()
+	rolledBack, err := srv.swapShards(ctx, clusterName, shardA, shardB)
+	outcome := cluster.ProcedureOutcomeOf(err)
+	if rolledBack && outcome == cluster.ProcedureFailed {
+		outcome = cluster.ProcedureRolledBack
+	}
+	cluster.ObserveProcedure(clusterName, cluster.ProcedureSwapShards, start, outcome)
+	return err
+}
+
+// swapShards tells whether the failed swap is rolled back.
+func (srv *Server) swapShards(ctx context.Context, clusterName string, shardA, shardB uint32) (bool, error) {
+	c, err := srv.clusterManager.GetCluster(ctx, clusterName)
+	if err != nil {
+		return false, errors.Wrapf(err, "swap shards, cluster:%s", clusterName)
+	}
+	swap, err := c.PrepareShardSwap(shardA, shardB)
+	if err != nil {
+		return false, errors.Wrapf(err, "prepare shard swap, shards:%d,%d", shardA, shardB)
+	}
+	shardIDs := []uint32{shardA, shardB}
+	drainCtx, cancel := context.WithTimeout(ctx, defaultShardSwapStepTimeout)
+	err = c.DrainShardDDLs(drainCtx, shardIDs)
+	cancel()
+	if err != nil {
+		c.AbortShardSwap(swap)
+		return false, errors.Wrapf(err, "drain shard ddls of swap, procedure:%s", swap.ProcedureID)
+	}
+	defer c.UndrainShardDDLs(shardIDs)
+
+	closeCmds := []shardCommand{{node: swap.NodeA, shardIDs: []uint32{shardA}}, {node: swap.NodeB, shardIDs: []uint32{shardB}}}
+	openCmds := []shardCommand{{node: swap.NodeB, shardIDs: []uint32{shardA}}, {node: swap.NodeA, shardIDs: []uint32{shardB}}}
+	if err := srv.runShardCommands(ctx, closeCmds, false); err != nil {
+		srv.rollbackShardSwap(c, swap, nil)
+		return true, errors.Wrapf(err, "close shards of swap, procedure:%s", swap.ProcedureID)
+	}
+	if err := srv.runShardCommands(ctx, openCmds, true); err != nil {
+		srv.rollbackShardSwap(c, swap, openCmds)
+		return true, errors.Wrapf(err, "open shards of swap, procedure:%s", swap.ProcedureID)
+	}
+	if err := c.CommitShardSwap(ctx, swap); err != nil {
+		srv.rollbackShardSwap(c, swap, openCmds)
+		return true, errors.Wrapf(err, "commit shard swap, procedure:%s", swap.ProcedureID)
+	}
+	return false, nil
+}
+
+// rollbackShardSwap closes the shards opened on the new nodes and reopens them on the original nodes, and then
+// releases the freezes of the swap. The errors are only logged because the heartbeats will correct the owners anyway.
+func (srv *Server) rollbackShardSwap(c *cluster.Cluster, swap *cluster.ShardSwap, openedCmds []shardCommand) {
+	ctx, cancel := context.WithTimeout(storage.WithPriority(context.Background(), storage.PriorityHigh),
+		defaultShardSwapRollbackTimeout)
+	defer cancel()
+
+	if len(openedCmds) > 0 {
+		if err := srv.runShardCommands(ctx, openedCmds, false); err != nil {
+			log.Error("fail to close swapped shards in rollback", zap.String("procedure", swap.ProcedureID), zap.Error(err))
+		}
+	}
+	reopenCmds := []shardCommand{{node: swap.NodeA, shardIDs: []uint32{swap.ShardA}}, {node: swap.NodeB, shardIDs: []uint32{swap.ShardB}}}
+	if err := srv.runShardCommands(ctx, reopenCmds, true); err != nil {
+		log.Error("fail to reopen shards in rollback", zap.String("procedure", swap.ProcedureID), zap.Error(err))
+	}
+	c.AbortShardSwap(swap)
+}
+
+// runShardCommands sends the open or close commands to the nodes and waits for all their acks.
+func (srv *Server) runShardCommands(ctx context.Context, cmds []shardCommand, open bool) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultShardSwapStepTimeout)
+	defer cancel()
+
+	sent := make([]*schedule.Command, 0, len(cmds))
+	for _, cmd := range cmds {
+		msg := &metapb.NodeHeartbeatResponse{Header: &commonpb.ResponseHeader{}}
+		if open {
+			msg.Cmd = &metapb.NodeHeartbeatResponse_OpenCmd{OpenCmd: &metapb.OpenCmd{ShardIds: cmd.shardIDs}}
+		} else {
+			msg.Cmd = &metapb.NodeHeartbeatResponse_CloseCmd{CloseCmd: &metapb.CloseCmd{ShardIds: cmd.shardIDs}}
+		}
+		command, err := srv.hbStreams.SendCommand(ctx, cmd.node, msg)
+		if err != nil {
+			return errors.Wrapf(err, "send shard command, node:%s, shards:%v", cmd.node, cmd.shardIDs)
+		}
+		sent = append(sent, command)
+	}
+	for i, command := range sent {
+		if err := command.Wait(ctx); err != nil {
+			return errors.Wrapf(err, "wait shard command, node:%s, shards:%v", cmds[i].node, cmds[i].shardIDs)
+		}
+	}
+	return nil
+}
@@ -4,4 +4,12 @@ package storage
 
 import "github.com/CeresDB/ceresmeta/pkg/coderr"
 
-var ErrMetaGetSchemas = coderr.NewCodeError(coderr.Internal, "meta storage get schemas")
+var (
+	ErrMetaGetSchemas = coderr.NewCodeError(coderr.Internal, "meta storage get schemas")
+	ErrEncode         = coderr.NewCodeError(coderr.Internal, "storage encode")
+	ErrDecode         = coderr.NewCodeError(coderr.Internal, "storage decode")
+	ErrInvalidArgs    = coderr.NewCodeError(coderr.InvalidParams, "storage invalid arguments")
+	ErrNameTaken      = coderr.NewCodeError(coderr.InvalidParams, "storage name taken")
+
+	ErrShardTopologyConflict = coderr.NewCodeError(coderr.Conflict, "shard topology written by others")
+)
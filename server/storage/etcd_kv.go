@@ -20,7 +20,9 @@ package storage
 import (
 	"path"
 	"strings"
+	"time"
 
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
 	"github.com/CeresDB/ceresmeta/server/etcdutil"
 	"github.com/pingcap/log"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -30,26 +32,49 @@ import (
 
 const (
 	delimiter = "/"
+	// maxTxnOps is the default limit of the operations in a transaction of the etcd.
+	maxTxnOps = 128
 )
 
 type etcdKV struct {
 	client   *clientv3.Client
 	rootPath string
+
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+	observer     Observer
 }
 
 // NewEtcdKV creates a new etcd kv.
 //nolint
 func NewEtcdKV(client *clientv3.Client, rootPath string) KV {
+	return newEtcdKV(client, rootPath, RateLimitOptions{}, nil)
+}
+
+func newEtcdKV(client *clientv3.Client, rootPath string, rateLimit RateLimitOptions, observer Observer) *etcdKV {
+	observer = observerOrNop(observer)
 	return &etcdKV{
 		client:   client,
 		rootPath: rootPath,
+		readLimiter: newRateLimiter(rateLimitKindRead, rateLimit.ReadOpsPerSec, rateLimit.ReadBurst, rateLimit.FailFast,
+			observer),
+		writeLimiter: newRateLimiter(rateLimitKindWrite, rateLimit.WriteOpsPerSec, rateLimit.WriteBurst, rateLimit.FailFast,
+			observer),
+		observer: observer,
 	}
 }
 
 func (kv *etcdKV) Get(ctx context.Context, key string) (string, error) {
 	key = path.Join(kv.rootPath, key)
+	if err := kv.readLimiter.wait(ctx); err != nil {
+		return "", err
+	}
 
-	resp, err := kv.client.Get(ctx, key)
+	var resp *clientv3.GetResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = kv.client.Get(ctx, key)
+		return err
+	})
 	if err != nil {
 		return "", etcdutil.ErrEtcdKVGet.WithCause(err)
 	}
@@ -61,13 +86,52 @@ func (kv *etcdKV) Get(ctx context.Context, key string) (string, error) {
 	return string(resp.Kvs[0].Value), nil
 }
 
+func (kv *etcdKV) BatchGet(ctx context.Context, keys []string) ([]string, []int64, error) {
+	if err := kv.readLimiter.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	ops := make([]clientv3.Op, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, clientv3.OpGet(strings.Join([]string{kv.rootPath, key}, delimiter)))
+	}
+	var resp *clientv3.TxnResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = kv.client.Txn(ctx).Then(ops...).Commit()
+		return err
+	})
+	if err != nil {
+		return nil, nil, etcdutil.ErrEtcdKVGet.WithCause(err)
+	}
+	values := make([]string, len(keys))
+	versions := make([]int64, len(keys))
+	for i, op := range resp.Responses {
+		kvs := op.GetResponseRange().GetKvs()
+		if n := len(kvs); n > 1 {
+			return nil, nil, etcdutil.ErrEtcdKVGetResponse.WithCausef("%v", kvs)
+		} else if n == 1 {
+			values[i] = string(kvs[0].Value)
+			versions[i] = kvs[0].Version
+		}
+	}
+	return values, versions, nil
+}
+
 func (kv *etcdKV) Scan(ctx context.Context, key, endKey string, limit int) ([]string, []string, error) {
 	key = strings.Join([]string{kv.rootPath, key}, delimiter)
 	endKey = strings.Join([]string{kv.rootPath, endKey}, delimiter)
 
+	if err := kv.readLimiter.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+
 	withRange := clientv3.WithRange(endKey)
 	withLimit := clientv3.WithLimit(int64(limit))
-	resp, err := kv.client.Get(ctx, key, withRange, withLimit)
+	var resp *clientv3.GetResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = kv.client.Get(ctx, key, withRange, withLimit)
+		return err
+	})
 	if err != nil {
 		return nil, nil, etcdutil.ErrEtcdKVGet.WithCause(err)
 	}
@@ -81,27 +145,271 @@ func (kv *etcdKV) Scan(ctx context.Context, key, endKey string, limit int) ([]st
 }
 
 func (kv *etcdKV) Put(ctx context.Context, key, value string) error {
+	defer kv.observer.BeginPersist(ctx)()
+
 	key = strings.Join([]string{kv.rootPath, key}, delimiter)
-	_, err := kv.client.Put(ctx, key, value)
+	if err := kv.writeLimiter.wait(ctx); err != nil {
+		return err
+	}
+	err := doWithReauth(func() error {
+		_, err := kv.client.Put(ctx, key, value)
+		return err
+	})
 	if err != nil {
-		e := etcdutil.ErrEtcdKVPut.WithCause(err)
+		e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
 		log.Error("save to etcd meet error", zap.String("key", key), zap.String("value", value), zap.Error(e))
 		return e
 	}
 	return nil
 }
 
+func (kv *etcdKV) PutWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	defer kv.observer.BeginPersist(ctx)()
+
+	key = strings.Join([]string{kv.rootPath, key}, delimiter)
+	if err := kv.writeLimiter.wait(ctx); err != nil {
+		return err
+	}
+	ttlSec := int64((ttl + time.Second - 1) / time.Second)
+	err := doWithReauth(func() error {
+		lease, err := kv.client.Grant(ctx, ttlSec)
+		if err != nil {
+			return err
+		}
+		_, err = kv.client.Put(ctx, key, value, clientv3.WithLease(lease.ID))
+		return err
+	})
+	if err != nil {
+		e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
+		log.Error("save to etcd with ttl meet error", zap.String("key", key), zap.Duration("ttl", ttl), zap.Error(e))
+		return e
+	}
+	return nil
+}
+
 func (kv *etcdKV) Delete(ctx context.Context, key string) error {
+	defer kv.observer.BeginPersist(ctx)()
+
 	key = strings.Join([]string{kv.rootPath, key}, delimiter)
-	_, err := kv.client.Delete(ctx, key)
+	if err := kv.writeLimiter.wait(ctx); err != nil {
+		return err
+	}
+	err := doWithReauth(func() error {
+		_, err := kv.client.Delete(ctx, key)
+		return err
+	})
 	if err != nil {
-		err = etcdutil.ErrEtcdKVDelete.WithCause(err)
+		err = classifyWriteError(err, etcdutil.ErrEtcdKVDelete)
 		log.Error("remove from etcd meet error", zap.String("key", key), zap.Error(err))
 		return err
 	}
 	return nil
 }
 
+func (kv *etcdKV) Replace(ctx context.Context, startKey, endKey string, keys, values []string) error {
+	if len(keys) != len(values) {
+		return ErrInvalidArgs.WithCausef("keys and values mismatch, keys:%d, values:%d", len(keys), len(values))
+	}
+
+	startKey = strings.Join([]string{kv.rootPath, startKey}, delimiter)
+	endKey = strings.Join([]string{kv.rootPath, endKey}, delimiter)
+	if err := kv.readLimiter.wait(ctx); err != nil {
+		return err
+	}
+	var resp *clientv3.GetResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = kv.client.Get(ctx, startKey, clientv3.WithRange(endKey), clientv3.WithKeysOnly())
+		return err
+	})
+	if err != nil {
+		e := etcdutil.ErrEtcdKVGet.WithCause(err)
+		log.Error("scan in etcd meet error", zap.String("start-key", startKey), zap.String("end-key", endKey), zap.Error(e))
+		return e
+	}
+
+	// The etcd refuses to delete and put the same key in a transaction, so only the stale keys are deleted.
+	puts := make(map[string]string, len(keys))
+	for i, key := range keys {
+		puts[strings.Join([]string{kv.rootPath, key}, delimiter)] = values[i]
+	}
+	ops := make([]clientv3.Op, 0, len(resp.Kvs)+len(keys))
+	for _, item := range resp.Kvs {
+		if _, ok := puts[string(item.Key)]; !ok {
+			ops = append(ops, clientv3.OpDelete(string(item.Key)))
+		}
+	}
+	for _, key := range keys {
+		key = strings.Join([]string{kv.rootPath, key}, delimiter)
+		if value, ok := puts[key]; ok {
+			ops = append(ops, clientv3.OpPut(key, value))
+			delete(puts, key)
+		}
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if _, err := kv.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
+			log.Error("replace in etcd meet error", zap.String("start-key", startKey), zap.String("end-key", endKey), zap.Error(e))
+			return e
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+func (kv *etcdKV) BatchIfAbsent(ctx context.Context, absentKeys, deleteKeys, keys, values []string) (bool, error) {
+	if len(keys) != len(values) {
+		return false, ErrInvalidArgs.WithCausef("keys and values mismatch, keys:%d, values:%d", len(keys), len(values))
+	}
+
+	cmps := make([]clientv3.Cmp, 0, len(absentKeys))
+	for _, key := range absentKeys {
+		key = strings.Join([]string{kv.rootPath, key}, delimiter)
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+	}
+	ops := make([]clientv3.Op, 0, len(deleteKeys)+len(keys))
+	for _, key := range deleteKeys {
+		ops = append(ops, clientv3.OpDelete(strings.Join([]string{kv.rootPath, key}, delimiter)))
+	}
+	for i, key := range keys {
+		ops = append(ops, clientv3.OpPut(strings.Join([]string{kv.rootPath, key}, delimiter), values[i]))
+	}
+
+	resp, err := kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
+		log.Error("batch in etcd meet error", zap.Strings("keys", keys), zap.Error(e))
+		return false, e
+	}
+	return resp.Succeeded, nil
+}
+
+func (kv *etcdKV) BatchIfEqual(ctx context.Context, cmpKey, cmpValue string, keys, values []string) (bool, error) {
+	if len(keys) != len(values) {
+		return false, ErrInvalidArgs.WithCausef("keys and values mismatch, keys:%d, values:%d", len(keys), len(values))
+	}
+
+	cmpKey = strings.Join([]string{kv.rootPath, cmpKey}, delimiter)
+	cmp := clientv3.Compare(clientv3.Value(cmpKey), "=", cmpValue)
+	if cmpValue == "" {
+		cmp = clientv3.Compare(clientv3.CreateRevision(cmpKey), "=", 0)
+	}
+	ops := make([]clientv3.Op, 0, len(keys))
+	for i, key := range keys {
+		ops = append(ops, clientv3.OpPut(strings.Join([]string{kv.rootPath, key}, delimiter), values[i]))
+	}
+
+	resp, err := kv.Txn(ctx).If(cmp).Then(ops...).Commit()
+	if err != nil {
+		e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
+		log.Error("batch in etcd meet error", zap.Strings("keys", keys), zap.Error(e))
+		return false, e
+	}
+	return resp.Succeeded, nil
+}
+
+func (kv *etcdKV) BatchIf(ctx context.Context, conds []Condition, deleteKeys, keys, values []string) (bool, error) {
+	if len(keys) != len(values) {
+		return false, ErrInvalidArgs.WithCausef("keys and values mismatch, keys:%d, values:%d", len(keys), len(values))
+	}
+
+	cmps := make([]clientv3.Cmp, 0, len(conds))
+	for _, cond := range conds {
+		key := strings.Join([]string{kv.rootPath, cond.Key}, delimiter)
+		if cond.Value != "" {
+			cmps = append(cmps, clientv3.Compare(clientv3.Value(key), "=", cond.Value))
+		} else {
+			cmps = append(cmps, clientv3.Compare(clientv3.Version(key), "=", cond.Version))
+		}
+	}
+	ops := make([]clientv3.Op, 0, len(deleteKeys)+len(keys))
+	for _, key := range deleteKeys {
+		ops = append(ops, clientv3.OpDelete(strings.Join([]string{kv.rootPath, key}, delimiter)))
+	}
+	for i, key := range keys {
+		ops = append(ops, clientv3.OpPut(strings.Join([]string{kv.rootPath, key}, delimiter), values[i]))
+	}
+
+	resp, err := kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		e := classifyWriteError(err, etcdutil.ErrEtcdKVPut)
+		log.Error("batch in etcd meet error", zap.Strings("keys", keys), zap.Error(e))
+		return false, e
+	}
+	return resp.Succeeded, nil
+}
+
+// Txn returns a txn which is retried once if the auth token has expired when it is committed, and the commit counts
+// as one write against the rate limit.
 func (kv *etcdKV) Txn(ctx context.Context) clientv3.Txn {
-	return kv.client.Txn(ctx)
+	return &reauthTxn{ctx: ctx, client: kv.client, limiter: kv.writeLimiter, observer: kv.observer}
+}
+
+// reauthTxn records the conditions and the operations, and a new txn is built for every attempt to commit.
+type reauthTxn struct {
+	ctx      context.Context
+	client   *clientv3.Client
+	limiter  *rateLimiter
+	observer Observer
+
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+func (txn *reauthTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	txn.cmps = append(txn.cmps, cs...)
+	return txn
+}
+
+func (txn *reauthTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.thenOps = append(txn.thenOps, ops...)
+	return txn
+}
+
+func (txn *reauthTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	txn.elseOps = append(txn.elseOps, ops...)
+	return txn
+}
+
+func (txn *reauthTxn) Commit() (*clientv3.TxnResponse, error) {
+	defer txn.observer.BeginPersist(txn.ctx)()
+
+	if err := txn.limiter.wait(txn.ctx); err != nil {
+		return nil, err
+	}
+	var resp *clientv3.TxnResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = txn.client.Txn(txn.ctx).If(txn.cmps...).Then(txn.thenOps...).Else(txn.elseOps...).Commit()
+		return err
+	})
+	return resp, err
+}
+
+// doWithReauth runs the request and retries it once if it fails because the auth token has expired. The client drops
+// the rejected token, so the retried request authenticates again with the credentials of the client.
+func doWithReauth(fn func() error) error {
+	err := fn()
+	if !etcdutil.IsAuthExpired(err) {
+		return err
+	}
+
+	etcdReauthCounter.Inc()
+	log.Warn("etcd auth token expired and retry the request after re-authentication", zap.Error(err))
+	return fn()
+}
+
+// classifyWriteError distinguishes the failure caused by the etcd space quota or the rate limit from the generic one.
+func classifyWriteError(err error, generic coderr.CodeError) coderr.CodeError {
+	if cerr, ok := err.(coderr.CodeError); ok && cerr.Code() == etcdutil.ErrEtcdRateLimited.Code() {
+		return cerr
+	}
+	if etcdutil.IsSpaceExceeded(err) {
+		return etcdutil.ErrEtcdSpaceExceeded.WithCause(err)
+	}
+	return generic.WithCause(err)
 }
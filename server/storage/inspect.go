@@ -0,0 +1,84 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxInspectKeysLimit bounds the keys returned by a single inspection.
+const MaxInspectKeysLimit = 1000
+
+// InspectedKey is a key under the root path along with its value.
+type InspectedKey struct {
+	// Key is relative to the root path.
+	Key  string `json:"key"`
+	Kind string `json:"kind,omitempty"`
+	// Value is the raw value, or the protobuf message rendered by the protojson if Decoded is set.
+	Value   string `json:"value"`
+	Decoded bool   `json:"decoded"`
+	// DecodeErr is the failure to decode the value of a protobuf kind, and the raw value is kept.
+	DecodeErr string `json:"decode_err,omitempty"`
+}
+
+// KeyInspection is the keys found under the prefix in ascending order.
+type KeyInspection struct {
+	Keys []InspectedKey `json:"keys"`
+	// More tells whether more keys under the prefix are left out by the limit.
+	More bool `json:"more"`
+}
+
+// InspectKeys returns at most limit keys under the prefix relative to the root path of the kv along with their values,
+// and the values of the known protobuf kinds are rendered by the protojson if decode is set. It is only for debugging
+// the storage, and the values are returned as they are stored without any check.
+func InspectKeys(ctx context.Context, kv KV, prefix string, decode bool, limit int) (*KeyInspection, error) {
+	if limit <= 0 || limit > MaxInspectKeysLimit {
+		return nil, ErrInvalidArgs.WithCausef("limit:%d is out of [1, %d]", limit, MaxInspectKeysLimit)
+	}
+
+	// The empty prefix covers all the keys under the root path, which are never larger than the 0xff byte.
+	endKey := "\xff"
+	if prefix != "" {
+		endKey = clientv3.GetPrefixRangeEnd(prefix)
+	}
+	keys, values, err := kv.Scan(ctx, prefix, endKey, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &KeyInspection{Keys: make([]InspectedKey, 0, len(keys))}
+	if len(keys) > limit {
+		keys, values = keys[:limit], values[:limit]
+		inspection.More = true
+	}
+	for i, key := range keys {
+		inspected := InspectedKey{Key: key, Kind: KeyKind(key), Value: values[i]}
+		if decode {
+			inspected.decode()
+		}
+		inspection.Keys = append(inspection.Keys, inspected)
+	}
+	return inspection, nil
+}
+
+func (k *InspectedKey) decode() {
+	msg := NewValueMessage(k.Kind)
+	if msg == nil {
+		return
+	}
+	if err := proto.Unmarshal([]byte(k.Value), msg); err != nil {
+		k.DecodeErr = err.Error()
+		return
+	}
+	rendered, err := protojson.Marshal(msg)
+	if err != nil {
+		k.DecodeErr = err.Error()
+		return
+	}
+	k.Value = string(rendered)
+	k.Decoded = true
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestInspectKeys(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{cfg.LCUrls[0].String()}})
+	re.NoError(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	s := NewStorageWithEtcdBackend(client, "/ceresmeta", Options{MaxScanLimit: 100, MinScanLimit: 10})
+	re.NoError(s.PutCluster(ctx, 1, &metapb.Cluster{Id: 1, Name: "c1", ShardTotal: 2}))
+	re.NoError(s.PutSchemas(ctx, 1, []*metapb.Schema{{Id: 1, ClusterId: 1, Name: "public"}, {Id: 2, ClusterId: 1, Name: "other"}}))
+	re.NoError(s.PutClusterOptions(ctx, 1, `{"table_name_scope":"schema"}`))
+	// A key of the root path of another ceresmeta cluster sharing the etcd is never visible.
+	re.NoError(NewEtcdKV(client, "/other").Put(ctx, makeClusterKey(1), "other"))
+
+	inspection, err := InspectKeys(ctx, s, "", true, 10)
+	re.NoError(err)
+	re.False(inspection.More)
+	re.Len(inspection.Keys, 4)
+	re.Equal(makeClusterOptionsKey(1), inspection.Keys[0].Key)
+	re.Equal(`{"table_name_scope":"schema"}`, inspection.Keys[0].Value)
+	re.False(inspection.Keys[0].Decoded)
+	re.Equal("schema", inspection.Keys[1].Kind)
+	re.True(inspection.Keys[1].Decoded)
+	re.Contains(inspection.Keys[1].Value, `"name":"public"`)
+	re.Equal(makeClusterKey(1), inspection.Keys[3].Key)
+	re.Equal("cluster_meta", inspection.Keys[3].Kind)
+	re.Contains(inspection.Keys[3].Value, `"name":"c1"`)
+
+	// The raw values are kept without decoding, and the keys beyond the limit are left out.
+	inspection, err = InspectKeys(ctx, s, path.Dir(makeSchemaKey(1, 0))+"/", false, 1)
+	re.NoError(err)
+	re.True(inspection.More)
+	re.Len(inspection.Keys, 1)
+	re.Equal(makeSchemaKey(1, 1), inspection.Keys[0].Key)
+	re.False(inspection.Keys[0].Decoded)
+	schema := &metapb.Schema{}
+	re.NoError(proto.Unmarshal([]byte(inspection.Keys[0].Value), schema))
+	re.Equal("public", schema.GetName())
+
+	// The value of a protobuf kind failing to be decoded is kept raw along with the error.
+	re.NoError(s.Put(ctx, makeTableKey(1, 1, 1), "\xff"))
+	inspection, err = InspectKeys(ctx, s, makeTableKey(1, 1, 1), true, 1)
+	re.NoError(err)
+	re.Len(inspection.Keys, 1)
+	re.False(inspection.Keys[0].Decoded)
+	re.NotEmpty(inspection.Keys[0].DecodeErr)
+	re.Equal("\xff", inspection.Keys[0].Value)
+
+	for _, limit := range []int{0, MaxInspectKeysLimit + 1} {
+		_, err = InspectKeys(ctx, s, "", false, limit)
+		re.True(coderr.Is(err, coderr.InvalidParams))
+	}
+}
@@ -5,13 +5,77 @@ package storage
 import (
 	"fmt"
 	"path"
+	"strings"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
-	cluster = "v1/cluster"
-	schema  = "schema"
+	cluster         = "v1/cluster"
+	clusterMeta     = "v1/cluster_meta"
+	clusterName     = "v1/cluster_name"
+	clusterRestore  = "v1/cluster_restore"
+	schema          = "schema"
+	schemaShardHint = "schema_shard_hint"
+	clusterOptions  = "options"
+	clusterStatus   = "status"
+	clusterLabels   = "labels"
+	table           = "table"
+	tableSchema     = "table_schema"
+	tableAffinity   = "table_affinity"
+	tablePlacement  = "table_placement"
+	tableDeleting   = "table_deleting"
+	tableReserve    = "table_reservation"
+	shard           = "shard"
+	shardDelta      = "shard_delta"
+	shardOwner      = "shard_owner"
+	tableRouteStat  = "table_route_stat"
+	routeStatSince  = "table_route_stat_since"
+	clusterTopology = "topo"
+	nodeCapacity    = "node_shard_capacity"
 )
 
+// deploymentFingerprint is the key of the fingerprint of the deployment owning the root path.
+const deploymentFingerprint = "v1/deployment_fingerprint"
+
+// makeClusterKey returns the cluster meta info key path with the given cluster ID.
+// example:
+// cluster 1: v1/cluster_meta/1 -> ceresmeta.Cluster
+// cluster 2: v1/cluster_meta/2 -> ceresmeta.Cluster
+func makeClusterKey(clusterID uint32) string {
+	return path.Join(clusterMeta, fmt.Sprintf("%020d", clusterID))
+}
+
+// makeClusterNameKey returns the key path of the index entry from the cluster name to the cluster ID.
+// example:
+// cluster 1 named defaultCluster: v1/cluster_name/defaultCluster -> 1
+func makeClusterNameKey(name string) string {
+	return path.Join(clusterName, name)
+}
+
+// makeClusterRestoreKey returns the key path of the marker of the unfinished replacement of the key-values of the
+// cluster, which lies outside the keys of the cluster so that it is not replaced along with them.
+// example:
+// cluster 1: v1/cluster_restore/1 -> 42
+func makeClusterRestoreKey(clusterID uint32) string {
+	return path.Join(clusterRestore, fmt.Sprintf("%020d", clusterID))
+}
+
+// makeClusterKeyPrefix returns the prefix of all the keys belonging to the cluster except the cluster meta info key.
+// example:
+// cluster 1: v1/cluster/1/
+func makeClusterKeyPrefix(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID)) + "/"
+}
+
+// makeClusterTopologyKey returns the cluster topology key path with the given cluster ID.
+// example:
+// cluster 1: v1/cluster/1/topo -> ceresmeta.ClusterTopology
+func makeClusterTopologyKey(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), clusterTopology)
+}
+
 // makeSchemaKey returns the schema meta info key path with the given region ID.
 // example:
 // cluster 1: v1/cluster/1/schema/1 -> ceresmeta.Schema
@@ -20,3 +84,169 @@ const (
 func makeSchemaKey(clusterID uint32, schemaID uint32) string {
 	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), schema, fmt.Sprintf("%020d", schemaID))
 }
+
+// makeSchemaShardHintKey returns the key path of the shard count hint of the schema.
+// example:
+// cluster 1: v1/cluster/1/schema_shard_hint/1 -> 4
+//            v1/cluster/1/schema_shard_hint/2 -> 16
+func makeSchemaShardHintKey(clusterID uint32, schemaID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), schemaShardHint, fmt.Sprintf("%020d", schemaID))
+}
+
+// makeNodeShardCapacityKey returns the key path of the max number of the shards the node may own.
+// example:
+// cluster 1: v1/cluster/1/node_shard_capacity/127.0.0.1:8831 -> 16
+func makeNodeShardCapacityKey(clusterID uint32, node string) string {
+	return path.Join(makeNodeShardCapacityPrefix(clusterID), node)
+}
+
+func makeNodeShardCapacityPrefix(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), nodeCapacity) + "/"
+}
+
+// makeClusterOptionsKey returns the key path of the options of the cluster.
+// example:
+// cluster 1: v1/cluster/1/options -> encoded options
+func makeClusterOptionsKey(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), clusterOptions)
+}
+
+// makeClusterStatusKey returns the key path of the status of the cluster.
+// example:
+// cluster 1: v1/cluster/1/status -> encoded status
+func makeClusterStatusKey(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), clusterStatus)
+}
+
+// makeClusterLabelsKey returns the key path of the labels describing the cluster.
+// example:
+// cluster 1: v1/cluster/1/labels -> encoded labels
+func makeClusterLabelsKey(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), clusterLabels)
+}
+
+// makeTableKey returns the table meta info key path.
+// example:
+// cluster 1: v1/cluster/1/table/1/1 -> ceresmeta.Table
+//            v1/cluster/1/table/1/2 -> ceresmeta.Table
+//            v1/cluster/1/table/2/3 -> ceresmeta.Table
+func makeTableKey(clusterID uint32, schemaID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), table, fmt.Sprintf("%020d", schemaID), fmt.Sprintf("%020d", tableID))
+}
+
+// makeShardTopologyKey returns the shard topology key path.
+// example:
+// cluster 1: v1/cluster/1/shard/1 -> ceresmeta.ShardTopology
+//            v1/cluster/1/shard/2 -> ceresmeta.ShardTopology
+func makeShardTopologyKey(clusterID uint32, shardID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), shard, fmt.Sprintf("%020d", shardID))
+}
+
+// makeShardTopologyDeltaKey returns the key path of the delta of the shard topology against the one of the shard
+// topology key.
+// example:
+// cluster 1: v1/cluster/1/shard_delta/1 -> encoded topology delta
+func makeShardTopologyDeltaKey(clusterID uint32, shardID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), shardDelta, fmt.Sprintf("%020d", shardID))
+}
+
+// makeShardOwnerChangeKey returns the key path of the last ownership change of the shard.
+// example:
+// cluster 1: v1/cluster/1/shard_owner/1 -> encoded ownership change
+//            v1/cluster/1/shard_owner/2 -> encoded ownership change
+func makeShardOwnerChangeKey(clusterID uint32, shardID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), shardOwner, fmt.Sprintf("%020d", shardID))
+}
+
+// makeTableSchemaKey returns the key path of the versioned encoded schema of the table.
+// example:
+// cluster 1: v1/cluster/1/table_schema/1/1 -> encoded versioned schema
+//            v1/cluster/1/table_schema/1/2 -> encoded versioned schema
+func makeTableSchemaKey(clusterID uint32, schemaID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tableSchema, fmt.Sprintf("%020d", schemaID), fmt.Sprintf("%020d", tableID))
+}
+
+// makeTableAffinityGroupKey returns the key path of the anti-affinity group of the table.
+// example:
+// cluster 1: v1/cluster/1/table_affinity/1/1 -> 100
+//            v1/cluster/1/table_affinity/1/2 -> 100
+func makeTableAffinityGroupKey(clusterID uint32, schemaID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tableAffinity, fmt.Sprintf("%020d", schemaID), fmt.Sprintf("%020d", tableID))
+}
+
+// makeTablePlacementKey returns the key path of the placement record of the table taken at its creation.
+// example:
+// cluster 1: v1/cluster/1/table_placement/1/1 -> encoded placement record
+func makeTablePlacementKey(clusterID uint32, schemaID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tablePlacement, fmt.Sprintf("%020d", schemaID), fmt.Sprintf("%020d", tableID))
+}
+
+// makeTableDeletingKey returns the key path of the marker of the table being deleted along with its sub-tables.
+// example:
+// cluster 1: v1/cluster/1/table_deleting/1/1 -> encoded marker
+func makeTableDeletingKey(clusterID uint32, schemaID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tableDeleting, fmt.Sprintf("%020d", schemaID), fmt.Sprintf("%020d", tableID))
+}
+
+// makeTableReservationKey returns the key path of the reservation of the table name, which is bound to a lease.
+// example:
+// cluster 1: v1/cluster/1/table_reservation/1/table0 -> encoded reservation
+func makeTableReservationKey(clusterID uint32, schemaID uint32, tableName string) string {
+	return makeTableReservationPrefix(clusterID, schemaID) + tableName
+}
+
+func makeTableReservationPrefix(clusterID uint32, schemaID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tableReserve, fmt.Sprintf("%020d", schemaID)) + "/"
+}
+
+// makeTableRouteStatKey returns the key path of the route statistics of the table.
+// example:
+// cluster 1: v1/cluster/1/table_route_stat/1 -> encoded route statistics
+//            v1/cluster/1/table_route_stat/2 -> encoded route statistics
+func makeTableRouteStatKey(clusterID uint32, tableID uint64) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), tableRouteStat, fmt.Sprintf("%020d", tableID))
+}
+
+// makeTableRouteStatsSinceKey returns the key path of the time since when the route lookups of the tables are tracked.
+// example:
+// cluster 1: v1/cluster/1/table_route_stat_since -> unix nanoseconds
+func makeTableRouteStatsSinceKey(clusterID uint32) string {
+	return path.Join(cluster, fmt.Sprintf("%020d", clusterID), routeStatSince)
+}
+
+// KeyKind returns the kind of the value stored under the key of the cluster, which is the segment of the key path
+// naming it, e.g. "table" for v1/cluster/1/table/1/1 and "cluster_meta" for v1/cluster_meta/1. The kind is empty if
+// the key doesn't belong to a cluster.
+func KeyKind(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if strings.HasPrefix(key, clusterMeta+"/") {
+		return clusterMeta[len("v1/"):]
+	}
+	if !strings.HasPrefix(key, cluster+"/") {
+		return ""
+	}
+	segments := strings.Split(key[len(cluster)+1:], "/")
+	if len(segments) < 2 {
+		return ""
+	}
+	return segments[1]
+}
+
+// NewValueMessage returns the empty protobuf message stored under the keys of the kind returned by the KeyKind, which
+// is nil if the value is not a protobuf message.
+func NewValueMessage(kind string) proto.Message {
+	switch kind {
+	case clusterMeta[len("v1/"):]:
+		return &metapb.Cluster{}
+	case clusterTopology:
+		return &metapb.ClusterTopology{}
+	case schema:
+		return &metapb.Schema{}
+	case table:
+		return &metapb.Table{}
+	case shard:
+		return &metapb.ShardTopology{}
+	default:
+		return nil
+	}
+}
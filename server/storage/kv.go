@@ -19,16 +19,46 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// Condition is checked against a key by BatchIf. The key must hold the Value if it is not empty, otherwise it must be
+// of the Version, which is the number of the puts since the key is created, and zero means the key must be absent.
+type Condition struct {
+	Key     string
+	Value   string
+	Version int64
+}
+
 // KV is an abstract interface for kv storage
 type KV interface {
 	Get(ctx context.Context, key string) (string, error)
+	// BatchGet gets the values and the versions of the keys at the same revision, and the absent key is of the empty
+	// value and the version zero.
+	BatchGet(ctx context.Context, keys []string) (values []string, versions []int64, err error)
 	Scan(ctx context.Context, key, endKey string, limit int) (keys []string, values []string, err error)
 	Put(ctx context.Context, key, value string) error
+	// PutWithTTL puts the key bound to a new lease of the ttl, which is rounded up to seconds, and the key is deleted
+	// once the lease expires.
+	PutWithTTL(ctx context.Context, key, value string, ttl time.Duration) error
 	Delete(ctx context.Context, key string) error
+	// Replace deletes the keys in the range [startKey, endKey) and puts the given keys in a single transaction if the
+	// number of the operations does not exceed the limit of the transaction, otherwise they are done in batches, and
+	// then it is not atomic.
+	Replace(ctx context.Context, startKey, endKey string, keys, values []string) error
+	// BatchIfAbsent deletes the deleteKeys and puts the keys in a single transaction if none of the absentKeys exists,
+	// and false is returned if any of them exists.
+	BatchIfAbsent(ctx context.Context, absentKeys, deleteKeys, keys, values []string) (bool, error)
+	// BatchIfEqual puts the keys in a single transaction if the value of the cmpKey equals the cmpValue, and an empty
+	// cmpValue means the cmpKey must be absent. False is returned if the comparison fails.
+	BatchIfEqual(ctx context.Context, cmpKey, cmpValue string, keys, values []string) (bool, error)
+	// BatchIf deletes the deleteKeys and puts the keys in a single transaction if all the conditions hold, and false is
+	// returned if any of them doesn't.
+	BatchIf(ctx context.Context, conds []Condition, deleteKeys, keys, values []string) (bool, error)
+	// Watch calls the fn with the changes of the keys with the prefix until the ctx is done.
+	Watch(ctx context.Context, prefix string, fn WatchFunc)
 
 	Txn(ctx context.Context) clientv3.Txn
 }
@@ -27,8 +27,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/tikv/pd/pkg/tempurl"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/server/v3/embed"
 )
@@ -131,3 +134,116 @@ func newTestSingleConfig(t *testing.T) *embed.Config {
 	cfg.ClusterState = embed.ClusterStateFlagNew
 	return cfg
 }
+
+func TestDoWithReauth(t *testing.T) {
+	re := require.New(t)
+
+	reauths := testutil.ToFloat64(etcdReauthCounter)
+	attempts := 0
+	err := doWithReauth(func() error {
+		attempts++
+		if attempts == 1 {
+			return rpctypes.ErrInvalidAuthToken
+		}
+		return nil
+	})
+	re.NoError(err)
+	re.Equal(2, attempts)
+	re.Equal(reauths+1, testutil.ToFloat64(etcdReauthCounter))
+
+	// The request is retried only once.
+	attempts = 0
+	err = doWithReauth(func() error {
+		attempts++
+		return rpctypes.ErrAuthOldRevision
+	})
+	re.Equal(rpctypes.ErrAuthOldRevision, err)
+	re.Equal(2, attempts)
+
+	// The other errors are not retried.
+	attempts = 0
+	err = doWithReauth(func() error {
+		attempts++
+		return rpctypes.ErrPermissionDenied
+	})
+	re.Equal(rpctypes.ErrPermissionDenied, err)
+	re.Equal(1, attempts)
+	re.Equal(reauths+2, testutil.ToFloat64(etcdReauthCounter))
+}
+
+func TestEtcdRateLimit(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	// The writes beyond the burst fail at once, and the reads are limited separately.
+	kv := newEtcdKV(client, "/rate_limit", RateLimitOptions{WriteOpsPerSec: 0.1, WriteBurst: 1, FailFast: true}, nil)
+	rejected := testutil.ToFloat64(etcdRateLimitedCounter.WithLabelValues(rateLimitKindWrite, PriorityNormal.String(), "rejected"))
+	re.NoError(kv.Put(ctx, "key", "value"))
+	err = kv.Put(ctx, "key", "value")
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	_, err = kv.BatchIfAbsent(ctx, nil, nil, []string{"key"}, []string{"value"})
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+	re.Equal(rejected+2, testutil.ToFloat64(etcdRateLimitedCounter.WithLabelValues(rateLimitKindWrite, PriorityNormal.String(), "rejected")))
+	for i := 0; i < 3; i++ {
+		value, err := kv.Get(ctx, "key")
+		re.NoError(err)
+		re.Equal("value", value)
+	}
+
+	// The reads beyond the burst wait for the tokens, and give up once the ctx is done.
+	kv = newEtcdKV(client, "/rate_limit", RateLimitOptions{ReadOpsPerSec: 20, ReadBurst: 1}, nil)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := kv.Get(ctx, "key")
+		re.NoError(err)
+	}
+	re.GreaterOrEqual(time.Since(start), time.Millisecond*90)
+
+	kv = newEtcdKV(client, "/rate_limit", RateLimitOptions{ReadOpsPerSec: 0.1, ReadBurst: 1}, nil)
+	_, err = kv.Get(ctx, "key")
+	re.NoError(err)
+	shortCtx, shortCancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer shortCancel()
+	_, _, err = kv.Scan(shortCtx, "", "z", 10)
+	re.True(coderr.Is(err, coderr.ServiceUnavailable))
+}
+
+func TestEtcdRateLimitPriority(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	kv := newEtcdKV(client, "/rate_limit", RateLimitOptions{WriteOpsPerSec: 5, WriteBurst: 1}, nil)
+	re.NoError(kv.Put(ctx, "key", "value"))
+
+	// The high priority request is admitted at once by borrowing a token.
+	admitted := testutil.ToFloat64(etcdRateLimitAdmittedCounter.WithLabelValues(rateLimitKindWrite, PriorityHigh.String()))
+	start := time.Now()
+	re.NoError(kv.Put(WithPriority(ctx, PriorityHigh), "key", "high"))
+	re.Less(time.Since(start), time.Millisecond*100)
+	re.Equal(admitted+1, testutil.ToFloat64(etcdRateLimitAdmittedCounter.WithLabelValues(rateLimitKindWrite, PriorityHigh.String())))
+
+	// The low priority request is shed instead of waiting, while the normal one waits for the borrowed token.
+	re.True(coderr.Is(kv.Put(WithPriority(ctx, PriorityLow), "key", "low"), coderr.ServiceUnavailable))
+	re.NoError(kv.Put(ctx, "key", "normal"))
+	re.GreaterOrEqual(time.Since(start), time.Millisecond*200)
+}
@@ -4,28 +4,147 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/CeresDB/ceresdbproto/pkg/metapb"
 )
 
+// KeyValue is a raw key-value pair stored in the storage.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
 // MetaStorage defines the storage operations on the ceresdb cluster meta info.
 type MetaStorage interface {
+	ListClusters(ctx context.Context) ([]*metapb.Cluster, error)
+	// GetCluster returns nil if the cluster does not exist.
 	GetCluster(ctx context.Context, clusterID uint32) (*metapb.Cluster, error)
 	PutCluster(ctx context.Context, clusterID uint32, meta *metapb.Cluster) error
 
+	// GetClusterTopology returns nil if the topology of the cluster does not exist.
 	GetClusterTopology(ctx context.Context, clusterID uint32) (*metapb.ClusterTopology, error)
 	PutClusterTopology(ctx context.Context, clusterID uint32, clusterMetaData *metapb.ClusterTopology) error
 
+	// GetClusterOptions returns the encoded options of the cluster, and empty string is returned if not exists.
+	GetClusterOptions(ctx context.Context, clusterID uint32) (string, error)
+	// PutClusterOptions puts the encoded options of the cluster, and the encoding is decided by the caller.
+	PutClusterOptions(ctx context.Context, clusterID uint32, options string) error
+	// GetClusterStatus returns the encoded status of the cluster, and empty string is returned if not exists.
+	GetClusterStatus(ctx context.Context, clusterID uint32) (string, error)
+	PutClusterStatus(ctx context.Context, clusterID uint32, status string) error
+	// GetClusterLabels returns the encoded labels of the cluster, and empty string is returned if not exists.
+	GetClusterLabels(ctx context.Context, clusterID uint32) (string, error)
+	PutClusterLabels(ctx context.Context, clusterID uint32, labels string) error
+
 	ListSchemas(ctx context.Context, clusterID uint32) ([]*metapb.Schema, error)
 	PutSchemas(ctx context.Context, clusterID uint32, schemas []*metapb.Schema) error
+	// ListSchemaShardCountHints returns the shard count hints of all the schemas which have one, keyed by schema id.
+	ListSchemaShardCountHints(ctx context.Context, clusterID uint32) (map[uint32]uint32, error)
+	PutSchemaShardCountHint(ctx context.Context, clusterID uint32, schemaID uint32, hint uint32) error
 
-	ListTables(ctx context.Context, clusterID uint32, schemaID uint32, tableID []uint64) ([]*metapb.Table, error)
+	ListTables(ctx context.Context, clusterID uint32, schemaID uint32) ([]*metapb.Table, error)
 	PutTables(ctx context.Context, clusterID uint32, schemaID uint32, tables []*metapb.Table) error
+	// DeleteTables deletes the tables along with their schemas, anti-affinity groups, placement records, deleting
+	// markers and route statistics.
 	DeleteTables(ctx context.Context, clusterID uint32, schemaID uint32, tableIDs []uint64) error
+	// ListTableSchemas returns the encoded schemas of the tables of the schema which have one, keyed by table id.
+	ListTableSchemas(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]string, error)
+	// PutTableSchema puts the encoded schema of the table if the current one equals the prevValue, and an empty
+	// prevValue means the table has no schema. False is returned if the comparison fails.
+	PutTableSchema(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, value, prevValue string) (bool, error)
+	// ListTableAffinityGroups returns the anti-affinity groups of the tables of the schema which have one, keyed by
+	// table id.
+	ListTableAffinityGroups(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]uint64, error)
+	PutTableAffinityGroup(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, group uint64) error
+	// GetTablePlacement returns the encoded placement record of the table, and empty string is returned if not exists.
+	GetTablePlacement(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64) (string, error)
+	PutTablePlacement(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, record string) error
+	// ListDeletingTables returns the encoded markers of the tables of the schema being deleted along with their
+	// sub-tables, keyed by table id. The marker is deleted along with the table.
+	ListDeletingTables(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]string, error)
+	PutDeletingTable(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, marker string) error
+	// PutTableWithDeletingMarker puts the table along with its encoded deleting marker in a single transaction, so the
+	// table is taken as being deleted until the marker is deleted by placing it on its shard.
+	PutTableWithDeletingMarker(ctx context.Context, clusterID uint32, table *metapb.Table, marker string) error
+	// ListTableReservations returns the encoded reservations of the table names of the schema keyed by table name.
+	ListTableReservations(ctx context.Context, clusterID uint32, schemaID uint32) (map[string]string, error)
+	// PutTableReservation puts the reservation of the table name, which is deleted once the ttl passes.
+	PutTableReservation(ctx context.Context, clusterID uint32, schemaID uint32, tableName, reservation string, ttl time.Duration) error
+	// DeleteTableReservation deletes the reservation of the table name before its ttl passes.
+	DeleteTableReservation(ctx context.Context, clusterID uint32, schemaID uint32, tableName string) error
+	// ListTableRouteStats returns the encoded route statistics of the tables which have one, keyed by table id.
+	ListTableRouteStats(ctx context.Context, clusterID uint32) (map[uint64]string, error)
+	// PutTableRouteStats puts the encoded route statistics of the tables in batches, so they are not written atomically.
+	PutTableRouteStats(ctx context.Context, clusterID uint32, tableIDs []uint64, stats []string) error
+	// DeleteTableRouteStats deletes the route statistics of all the tables.
+	DeleteTableRouteStats(ctx context.Context, clusterID uint32) error
+	// GetTableRouteStatsSince returns the encoded time since when the route lookups are tracked, and empty if not set.
+	GetTableRouteStatsSince(ctx context.Context, clusterID uint32) (string, error)
+	PutTableRouteStatsSince(ctx context.Context, clusterID uint32, since string) error
+
+	// ListShardTopologies returns the topologies of the shards in the same order as the shardIDs, and the topology is
+	// nil if it does not exist.
+	ListShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32) ([]*metapb.ShardTopology, error)
+	PutShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology) error
+	// PutShardTopologyPlacingTables puts the topology of the shard on which the tables are placed and deletes the
+	// deleting markers of the tables in a single transaction.
+	PutShardTopologyPlacingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, tables []*metapb.Table) error
+	// PutShardTopologyRemovingTables puts the topology of the shard from which the tables are removed and the encoded
+	// deleting markers of the tables in a single transaction.
+	PutShardTopologyRemovingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, schemaID uint32, tableIDs []uint64, marker string) error
+	// PutTableWithIDEnd puts the table and the topology of its shard, and advances the decimal end id at the endIDKey
+	// to the id of the table in a single transaction. Nothing is written and false is returned if the end id is not the
+	// one right before the id of the table.
+	PutTableWithIDEnd(ctx context.Context, clusterID uint32, table *metapb.Table, topology *metapb.ShardTopology, endIDKey string) (bool, error)
+	// ListShardOwnerChanges returns the encoded last ownership changes of the shards which have one, keyed by shard id.
+	ListShardOwnerChanges(ctx context.Context, clusterID uint32) (map[uint32]string, error)
+	// PutShardOwnerChanges puts the encoded ownership changes of the shards in a single transaction, and the encoding
+	// is decided by the caller.
+	PutShardOwnerChanges(ctx context.Context, clusterID uint32, shardIDs []uint32, changes []string) error
+	// PutShardTopologiesWithOwnerChanges puts the topologies and the encoded ownership changes of the shards in a
+	// single transaction.
+	PutShardTopologiesWithOwnerChanges(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology, changes []string) error
 
-	ListShardTopologies(ctx context.Context, clusterID uint32, shardID []uint32) ([]*metapb.ShardTopology, error)
-	PutShardTopologies(ctx context.Context, clusterID uint32, shardID []uint32, topologies []*metapb.ShardTopology) error
+	// ListClusterNameIndex lists the index from the cluster name to the cluster id.
+	ListClusterNameIndex(ctx context.Context) (map[string]uint32, error)
+	// PutClusterNameIndex puts the index entry of the cluster name unconditionally.
+	PutClusterNameIndex(ctx context.Context, name string, clusterID uint32) error
+	// PutClusterWithName puts the cluster meta and the index entry of its name in a single transaction, and the index
+	// entry of the oldName is deleted if it is not empty. ErrNameTaken is returned if the name is indexed already.
+	PutClusterWithName(ctx context.Context, meta *metapb.Cluster, oldName string) error
+	// CreateClusterWithName puts the cluster meta, the index entry of its name, the topologies of its shards, its
+	// encoded options and labels in a single transaction, and the options are skipped if empty. ErrNameTaken is returned
+	// if the name is indexed already.
+	CreateClusterWithName(ctx context.Context, meta *metapb.Cluster, topologies []*metapb.ShardTopology, options, labels string) error
+
+	// GetDeploymentFingerprint returns the encoded fingerprint of the deployment owning the root path, and empty string
+	// is returned if not exists.
+	GetDeploymentFingerprint(ctx context.Context) (string, error)
+	// PutDeploymentFingerprint puts the encoded fingerprint if the current one equals the prevValue, and an empty
+	// prevValue means no fingerprint exists. False is returned if the comparison fails.
+	PutDeploymentFingerprint(ctx context.Context, fingerprint, prevValue string) (bool, error)
+
+	// ListClusterKeyValues lists all the raw key-values of the cluster, including the cluster meta info.
+	ListClusterKeyValues(ctx context.Context, clusterID uint32) ([]KeyValue, error)
+	// ReplaceClusterKeyValues replaces all the raw key-values of the cluster with the given ones, and every given key
+	// must belong to the cluster. It is not atomic: the key-values exceeding the limit of a transaction are replaced in
+	// batches, and the readers may see a mix of the old and the new ones until it finishes. The cluster is marked as
+	// partially restored before the first batch and unmarked after the last one, so an interrupted replacement is
+	// detected by IsClusterPartiallyRestored instead of being taken as done.
+	ReplaceClusterKeyValues(ctx context.Context, clusterID uint32, kvs []KeyValue) error
+	// IsClusterPartiallyRestored tells whether a ReplaceClusterKeyValues of the cluster started but didn't finish, in
+	// which case the key-values of the cluster may be a mix of the old and the new ones.
+	IsClusterPartiallyRestored(ctx context.Context, clusterID uint32) (bool, error)
 
 	ListNodes(ctx context.Context, clusterID uint32) ([]*metapb.Node, error)
+	// ListNodeShardCapacities returns the shard capacities of all the nodes which have reported one, keyed by node name.
+	ListNodeShardCapacities(ctx context.Context, clusterID uint32) (map[string]uint32, error)
+	PutNodeShardCapacity(ctx context.Context, clusterID uint32, node string, capacity uint32) error
 	PutNodes(ctx context.Context, clusterID uint32, node []*metapb.Node) error
+
+	// WatchClusterTopology calls the fn with the revision of every change of the schemas, the tables, the shard
+	// topologies or the shard owners of the cluster until the ctx is done. The fn is also called when the watch
+	// (re)starts, since the changes before it may have been missed.
+	WatchClusterTopology(ctx context.Context, clusterID uint32, fn func(revision int64))
 }
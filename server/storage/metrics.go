@@ -0,0 +1,72 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var etcdReauthCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "etcd_reauth_total",
+		Help:      "Number of the etcd requests retried after re-authentication because the auth token expired.",
+	})
+
+var etcdRateLimitedCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "etcd_rate_limited_total",
+		Help:      "Number of the etcd requests delayed or rejected by the rate limit.",
+	}, []string{"kind", "priority", "result"})
+
+var etcdRateLimitAdmittedCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "etcd_rate_limit_admitted_total",
+		Help:      "Number of the etcd requests admitted by the rate limit.",
+	}, []string{"kind", "priority"})
+
+var etcdRateLimitWaitingGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "etcd_rate_limit_waiting",
+		Help:      "Number of the etcd requests waiting for the rate limit now.",
+	}, []string{"kind"})
+
+var etcdRateLimitWaitHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "etcd_rate_limit_wait_seconds",
+		Help:      "Time the delayed etcd requests wait for the rate limit.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"kind"})
+
+var topologyBatchesCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "topology_batches_total",
+		Help:      "Number of the batches of the shard topology writes, and the failed ones fall back to the individual writes.",
+	}, []string{"result"})
+
+var topologyWritesCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "ceresmeta",
+		Subsystem: "storage",
+		Name:      "topology_writes_total",
+		Help:      "Number of the shard topologies written with the delta encoding enabled by the encoding.",
+	}, []string{"encoding"})
+
+func init() {
+	prometheus.MustRegister(etcdReauthCounter)
+	prometheus.MustRegister(etcdRateLimitedCounter)
+	prometheus.MustRegister(etcdRateLimitAdmittedCounter)
+	prometheus.MustRegister(etcdRateLimitWaitingGauge)
+	prometheus.MustRegister(etcdRateLimitWaitHistogram)
+	prometheus.MustRegister(topologyBatchesCounter)
+	prometheus.MustRegister(topologyWritesCounter)
+}
@@ -0,0 +1,29 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import "context"
+
+// Observer is notified of the etcd calls made by the storage, so that the time spent in the storage is attributed to
+// the callers, e.g. the procedures, without the storage depending on them.
+type Observer interface {
+	// BeginPersist is called before a write to the etcd, and the returned function is called once it finishes.
+	BeginPersist(ctx context.Context) func()
+	// BeginRateLimitWait is called before the call waits for the rate limit with the detail of the wait, and the returned
+	// function is called once the wait ends.
+	BeginRateLimitWait(ctx context.Context, detail string) func()
+}
+
+// nopObserver observes nothing, and it is used if no observer is provided.
+type nopObserver struct{}
+
+func (nopObserver) BeginPersist(_ context.Context) func() { return func() {} }
+
+func (nopObserver) BeginRateLimitWait(_ context.Context, _ string) func() { return func() {} }
+
+func observerOrNop(observer Observer) Observer {
+	if observer == nil {
+		return nopObserver{}
+	}
+	return observer
+}
@@ -0,0 +1,45 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import "context"
+
+// Priority is the QoS class of a request, which decides how its etcd operations are admitted by the rate limits when
+// the storage is overloaded.
+type Priority int
+
+const (
+	// PriorityLow is for the bulk operations, which are shed at once instead of waiting if the rate limit is exceeded.
+	PriorityLow Priority = iota
+	// PriorityNormal is the default class, which waits for the rate limit or fails if the limit fails fast.
+	PriorityNormal
+	// PriorityHigh is for the operations keeping the control plane operational, e.g. the failover, which are always
+	// admitted and borrow the tokens from the following requests.
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose storage operations run at the priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority of the ctx, and PriorityNormal is returned if it is not set.
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PriorityNormal
+}
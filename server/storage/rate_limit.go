@@ -0,0 +1,100 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitKindRead  = "read"
+	rateLimitKindWrite = "write"
+)
+
+// RateLimitOptions caps the etcd operations issued by the storage, and a transaction counts as one write.
+type RateLimitOptions struct {
+	// ReadOpsPerSec and WriteOpsPerSec are the rates of the token buckets, and zero disables the limit.
+	ReadOpsPerSec  float64
+	ReadBurst      int
+	WriteOpsPerSec float64
+	WriteBurst     int
+	// FailFast makes the operations exceeding the limit fail with ErrEtcdRateLimited at once instead of waiting for
+	// the tokens.
+	FailFast bool
+}
+
+// rateLimiter is a token bucket, and the nil rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	kind     string
+	limiter  *rate.Limiter
+	failFast bool
+	observer Observer
+}
+
+func newRateLimiter(kind string, opsPerSec float64, burst int, failFast bool, observer Observer) *rateLimiter {
+	if opsPerSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		kind:     kind,
+		limiter:  rate.NewLimiter(rate.Limit(opsPerSec), burst),
+		failFast: failFast,
+		observer: observerOrNop(observer),
+	}
+}
+
+// wait takes a token according to the priority of the ctx. The high priority request takes the token at once even if
+// it has to borrow one, the low priority request is rejected if no token is available now, and the normal one blocks
+// until the token is available unless the limiter fails fast. The token is given back if the ctx is done before that.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	priority := PriorityFromContext(ctx)
+	if priority == PriorityHigh {
+		l.limiter.Reserve()
+		etcdRateLimitAdmittedCounter.WithLabelValues(l.kind, priority.String()).Inc()
+		return nil
+	}
+	if l.failFast || priority == PriorityLow {
+		if !l.limiter.Allow() {
+			etcdRateLimitedCounter.WithLabelValues(l.kind, priority.String(), "rejected").Inc()
+			return etcdutil.ErrEtcdRateLimited.WithCausef("%s rate limit:%v exceeded, priority:%s", l.kind,
+				l.limiter.Limit(), priority)
+		}
+		etcdRateLimitAdmittedCounter.WithLabelValues(l.kind, priority.String()).Inc()
+		return nil
+	}
+
+	reservation := l.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		etcdRateLimitAdmittedCounter.WithLabelValues(l.kind, priority.String()).Inc()
+		return nil
+	}
+	etcdRateLimitedCounter.WithLabelValues(l.kind, priority.String(), "delayed").Inc()
+	etcdRateLimitWaitingGauge.WithLabelValues(l.kind).Inc()
+	defer etcdRateLimitWaitingGauge.WithLabelValues(l.kind).Dec()
+	endWait := l.observer.BeginRateLimitWait(ctx, fmt.Sprintf("%s rate limit, delay:%s", l.kind, delay))
+	defer endWait()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		etcdRateLimitWaitHistogram.WithLabelValues(l.kind).Observe(delay.Seconds())
+		etcdRateLimitAdmittedCounter.WithLabelValues(l.kind, priority.String()).Inc()
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return etcdutil.ErrEtcdRateLimited.WithCausef("wait for %s rate limit, err:%v", l.kind, ctx.Err())
+	}
+}
@@ -5,11 +5,13 @@ package storage
 import (
 	"context"
 	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/CeresDB/ceresdbproto/pkg/metapb"
-	"github.com/CeresDB/ceresmeta/pkg/log"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -18,6 +20,15 @@ type Options struct {
 	MaxScanLimit int
 	// MinScanLimit is the min limit of the number of keys in a scan.
 	MinScanLimit int
+	// RateLimit caps the etcd reads and writes of the storage.
+	RateLimit RateLimitOptions
+	// TopologyBatchWindow is how long the shard topology writes are coalesced into a batch, and zero disables the
+	// batching.
+	TopologyBatchWindow time.Duration
+	// TopologyDelta makes the small changes of the large shard topologies written as the deltas.
+	TopologyDelta TopologyDeltaOptions
+	// Observer is notified of the etcd calls, and nothing observes them if it is nil.
+	Observer Observer
 }
 
 // MetaStorageImpl is the base underlying storage endpoint for all other upper
@@ -27,6 +38,13 @@ type MetaStorageImpl struct {
 	KV
 
 	opts Options
+	// topologyBatcher is nil if the batching of the shard topology writes is disabled.
+	topologyBatcher *topologyBatcher
+	// topologyDeltas is nil if the delta encoding of the shard topologies is disabled, and the deltas written before
+	// are still applied by the reads.
+	topologyDeltas *topologyDeltaEncoder
+	// topologyVersions are the versions of the shard topology keys which the topology writes are conditional on.
+	topologyVersions *topologyVersions
 }
 
 // NewMetaStorageImpl creates a new base storage endpoint with the given KV and encryption key manager.
@@ -35,95 +53,840 @@ func NewMetaStorageImpl(
 	kv KV,
 	opts Options,
 ) *MetaStorageImpl {
-	return &MetaStorageImpl{kv, opts}
+	s := &MetaStorageImpl{KV: kv, opts: opts, topologyVersions: newTopologyVersions()}
+	if opts.TopologyBatchWindow > 0 {
+		s.topologyBatcher = newTopologyBatcher(kv, opts.TopologyBatchWindow, opts.Observer)
+	}
+	if opts.TopologyDelta.MinTables > 0 {
+		s.topologyDeltas = newTopologyDeltaEncoder(opts.TopologyDelta)
+	}
+	return s
 }
 
 // newEtcdBackend is used to create a new etcd backend.
 func newEtcdStorage(client *clientv3.Client, rootPath string, opts Options) *MetaStorageImpl {
 	return NewMetaStorageImpl(
-		NewEtcdKV(client, rootPath), opts)
+		newEtcdKV(client, rootPath, opts.RateLimit, opts.Observer), opts)
+}
+
+func (s *MetaStorageImpl) ListClusters(ctx context.Context) ([]*metapb.Cluster, error) {
+	clusters := make([]*metapb.Cluster, 0)
+	startKey := makeClusterKey(0)
+	endKey := makeClusterKey(math.MaxUint32)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(_, value string) error {
+		cluster := &metapb.Cluster{}
+		if err := proto.Unmarshal([]byte(value), cluster); err != nil {
+			return ErrDecode.WithCausef("decode cluster, err:%v", err)
+		}
+		clusters = append(clusters, cluster)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return clusters, nil
 }
 
 func (s *MetaStorageImpl) GetCluster(ctx context.Context, clusterID uint32) (*metapb.Cluster, error) {
-	return nil, nil
+	value, err := s.Get(ctx, makeClusterKey(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	cluster := &metapb.Cluster{}
+	if err := proto.Unmarshal([]byte(value), cluster); err != nil {
+		return nil, ErrDecode.WithCausef("decode cluster, clusterID:%d, err:%v", clusterID, err)
+	}
+	return cluster, nil
 }
 
 func (s *MetaStorageImpl) PutCluster(ctx context.Context, clusterID uint32, meta *metapb.Cluster) error {
+	value, err := proto.Marshal(meta)
+	if err != nil {
+		return ErrEncode.WithCausef("encode cluster, clusterID:%d, err:%v", clusterID, err)
+	}
+
+	return s.Put(ctx, makeClusterKey(clusterID), string(value))
+}
+
+func (s *MetaStorageImpl) ListClusterNameIndex(ctx context.Context) (map[string]uint32, error) {
+	index := make(map[string]uint32)
+	prefix := makeClusterNameKey("") + "/"
+	err := s.rangeScan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), func(key, value string) error {
+		clusterID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ErrDecode.WithCausef("decode cluster id of name index, key:%s, err:%v", key, err)
+		}
+		index[strings.TrimPrefix(key, prefix)] = uint32(clusterID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func (s *MetaStorageImpl) GetDeploymentFingerprint(ctx context.Context) (string, error) {
+	return s.Get(ctx, deploymentFingerprint)
+}
+
+func (s *MetaStorageImpl) PutDeploymentFingerprint(ctx context.Context, fingerprint, prevValue string) (bool, error) {
+	return s.BatchIfEqual(ctx, deploymentFingerprint, prevValue, []string{deploymentFingerprint}, []string{fingerprint})
+}
+
+func (s *MetaStorageImpl) PutClusterNameIndex(ctx context.Context, name string, clusterID uint32) error {
+	return s.Put(ctx, makeClusterNameKey(name), strconv.FormatUint(uint64(clusterID), 10))
+}
+
+func (s *MetaStorageImpl) PutClusterWithName(ctx context.Context, meta *metapb.Cluster, oldName string) error {
+	value, err := proto.Marshal(meta)
+	if err != nil {
+		return ErrEncode.WithCausef("encode cluster, clusterID:%d, err:%v", meta.GetId(), err)
+	}
+
+	nameKey := makeClusterNameKey(meta.GetName())
+	deleteKeys := make([]string, 0, 1)
+	if oldName != "" {
+		deleteKeys = append(deleteKeys, makeClusterNameKey(oldName))
+	}
+	keys := []string{nameKey, makeClusterKey(meta.GetId())}
+	values := []string{strconv.FormatUint(uint64(meta.GetId()), 10), string(value)}
+	ok, err := s.BatchIfAbsent(ctx, []string{nameKey}, deleteKeys, keys, values)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNameTaken.WithCausef("cluster name:%s", meta.GetName())
+	}
+	return nil
+}
+
+func (s *MetaStorageImpl) CreateClusterWithName(ctx context.Context, meta *metapb.Cluster, topologies []*metapb.ShardTopology, options, labels string) error {
+	value, err := proto.Marshal(meta)
+	if err != nil {
+		return ErrEncode.WithCausef("encode cluster, clusterID:%d, err:%v", meta.GetId(), err)
+	}
+
+	nameKey := makeClusterNameKey(meta.GetName())
+	keys := make([]string, 0, len(topologies)+4)
+	values := make([]string, 0, len(topologies)+4)
+	shardIDs := make([]uint32, 0, len(topologies))
+	puts := make([]topologyPut, 0, len(topologies))
+	for i, topology := range topologies {
+		shardID := uint32(i)
+		// The new cluster has no deltas to delete.
+		put, err := s.encodeShardTopology(meta.GetId(), shardID, topology)
+		if err != nil {
+			s.forgetShardTopologies(meta.GetId(), shardIDs)
+			return err
+		}
+		shardIDs = append(shardIDs, shardID)
+		puts = append(puts, put)
+		keys = append(keys, put.key)
+		values = append(values, put.value)
+	}
+	if options != "" {
+		keys = append(keys, makeClusterOptionsKey(meta.GetId()))
+		values = append(values, options)
+	}
+	keys = append(keys, makeClusterLabelsKey(meta.GetId()), nameKey, makeClusterKey(meta.GetId()))
+	values = append(values, labels, strconv.FormatUint(uint64(meta.GetId()), 10), string(value))
+	ok, err := s.BatchIfAbsent(ctx, []string{nameKey}, nil, keys, values)
+	if err != nil || !ok {
+		s.forgetShardTopologies(meta.GetId(), shardIDs)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNameTaken.WithCausef("cluster name:%s", meta.GetName())
+	}
+	// The topologies of the new cluster are put for the first time.
+	s.topologyVersions.written(puts)
 	return nil
 }
 
 func (s *MetaStorageImpl) GetClusterTopology(ctx context.Context, clusterID uint32) (*metapb.ClusterTopology, error) {
-	return nil, nil
+	value, err := s.Get(ctx, makeClusterTopologyKey(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	topology := &metapb.ClusterTopology{}
+	if err := proto.Unmarshal([]byte(value), topology); err != nil {
+		return nil, ErrDecode.WithCausef("decode cluster topology, clusterID:%d, err:%v", clusterID, err)
+	}
+	return topology, nil
 }
 
 func (s *MetaStorageImpl) PutClusterTopology(ctx context.Context, clusterID uint32, clusterMetaData *metapb.ClusterTopology) error {
-	return nil
+	value, err := proto.Marshal(clusterMetaData)
+	if err != nil {
+		return ErrEncode.WithCausef("encode cluster topology, clusterID:%d, err:%v", clusterID, err)
+	}
+
+	return s.Put(ctx, makeClusterTopologyKey(clusterID), string(value))
 }
 
 func (s *MetaStorageImpl) ListSchemas(ctx context.Context, clusterID uint32) ([]*metapb.Schema, error) {
 	schemas := make([]*metapb.Schema, 0)
-	nextID := uint32(0)
+	startKey := makeSchemaKey(clusterID, 0)
 	endKey := makeSchemaKey(clusterID, math.MaxUint32)
 
-	rangeLimit := s.opts.MaxScanLimit
-	for {
-		startKey := makeSchemaKey(clusterID, nextID)
-		_, res, err := s.Scan(ctx, startKey, endKey, rangeLimit)
+	err := s.rangeScan(ctx, startKey, endKey, func(_, value string) error {
+		schema := &metapb.Schema{}
+		if err := proto.Unmarshal([]byte(value), schema); err != nil {
+			return ErrMetaGetSchemas.WithCausef("proto parse err:%v", err)
+		}
+		schemas = append(schemas, schema)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schemas, nil
+}
+
+func (s *MetaStorageImpl) PutSchemas(ctx context.Context, clusterID uint32, schemas []*metapb.Schema) error {
+	for _, schema := range schemas {
+		value, err := proto.Marshal(schema)
+		if err != nil {
+			return ErrEncode.WithCausef("encode schema, clusterID:%d, schemaID:%d, err:%v", clusterID, schema.GetId(), err)
+		}
+		if err := s.Put(ctx, makeSchemaKey(clusterID, schema.GetId()), string(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MetaStorageImpl) GetClusterOptions(ctx context.Context, clusterID uint32) (string, error) {
+	return s.Get(ctx, makeClusterOptionsKey(clusterID))
+}
+
+func (s *MetaStorageImpl) PutClusterOptions(ctx context.Context, clusterID uint32, options string) error {
+	return s.Put(ctx, makeClusterOptionsKey(clusterID), options)
+}
+
+func (s *MetaStorageImpl) GetClusterStatus(ctx context.Context, clusterID uint32) (string, error) {
+	return s.Get(ctx, makeClusterStatusKey(clusterID))
+}
+
+func (s *MetaStorageImpl) PutClusterStatus(ctx context.Context, clusterID uint32, status string) error {
+	return s.Put(ctx, makeClusterStatusKey(clusterID), status)
+}
+
+func (s *MetaStorageImpl) GetClusterLabels(ctx context.Context, clusterID uint32) (string, error) {
+	return s.Get(ctx, makeClusterLabelsKey(clusterID))
+}
+
+func (s *MetaStorageImpl) PutClusterLabels(ctx context.Context, clusterID uint32, labels string) error {
+	return s.Put(ctx, makeClusterLabelsKey(clusterID), labels)
+}
+
+func (s *MetaStorageImpl) ListSchemaShardCountHints(ctx context.Context, clusterID uint32) (map[uint32]uint32, error) {
+	hints := make(map[uint32]uint32)
+	startKey := makeSchemaShardHintKey(clusterID, 0)
+	endKey := makeSchemaShardHintKey(clusterID, math.MaxUint32)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		schemaID, err := strconv.ParseUint(path.Base(key), 10, 32)
+		if err != nil {
+			return ErrDecode.WithCausef("decode schema id of shard count hint, key:%s, err:%v", key, err)
+		}
+		hint, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ErrDecode.WithCausef("decode shard count hint, key:%s, err:%v", key, err)
+		}
+		hints[uint32(schemaID)] = uint32(hint)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hints, nil
+}
+
+func (s *MetaStorageImpl) PutSchemaShardCountHint(ctx context.Context, clusterID uint32, schemaID uint32, hint uint32) error {
+	return s.Put(ctx, makeSchemaShardHintKey(clusterID, schemaID), strconv.FormatUint(uint64(hint), 10))
+}
+
+func (s *MetaStorageImpl) ListTables(ctx context.Context, clusterID uint32, schemaID uint32) ([]*metapb.Table, error) {
+	tables := make([]*metapb.Table, 0)
+	startKey := makeTableKey(clusterID, schemaID, 0)
+	endKey := makeTableKey(clusterID, schemaID, math.MaxUint64)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(_, value string) error {
+		table := &metapb.Table{}
+		if err := proto.Unmarshal([]byte(value), table); err != nil {
+			return ErrDecode.WithCausef("decode table, clusterID:%d, schemaID:%d, err:%v", clusterID, schemaID, err)
+		}
+		tables = append(tables, table)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tables, nil
+}
+
+func (s *MetaStorageImpl) PutTables(ctx context.Context, clusterID uint32, schemaID uint32, tables []*metapb.Table) error {
+	for _, table := range tables {
+		value, err := proto.Marshal(table)
+		if err != nil {
+			return ErrEncode.WithCausef("encode table, clusterID:%d, tableID:%d, err:%v", clusterID, table.GetId(), err)
+		}
+		if err := s.Put(ctx, makeTableKey(clusterID, schemaID, table.GetId()), string(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MetaStorageImpl) DeleteTables(ctx context.Context, clusterID uint32, schemaID uint32, tableIDs []uint64) error {
+	for _, tableID := range tableIDs {
+		if err := s.Delete(ctx, makeTableSchemaKey(clusterID, schemaID, tableID)); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, makeTableAffinityGroupKey(clusterID, schemaID, tableID)); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, makeTablePlacementKey(clusterID, schemaID, tableID)); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, makeTableRouteStatKey(clusterID, tableID)); err != nil {
+			return err
+		}
+		if err := s.Delete(ctx, makeTableKey(clusterID, schemaID, tableID)); err != nil {
+			return err
+		}
+		// The marker is deleted at last, so the table deleted partially is still dropped after reloading.
+		if err := s.Delete(ctx, makeTableDeletingKey(clusterID, schemaID, tableID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MetaStorageImpl) ListTableSchemas(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]string, error) {
+	schemas := make(map[uint64]string)
+	startKey := makeTableSchemaKey(clusterID, schemaID, 0)
+	endKey := makeTableSchemaKey(clusterID, schemaID, math.MaxUint64)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		tableID, err := strconv.ParseUint(path.Base(key), 10, 64)
+		if err != nil {
+			return ErrDecode.WithCausef("decode table id of table schema, key:%s, err:%v", key, err)
+		}
+		schemas[tableID] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schemas, nil
+}
+
+func (s *MetaStorageImpl) PutTableSchema(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, value, prevValue string) (bool, error) {
+	key := makeTableSchemaKey(clusterID, schemaID, tableID)
+	return s.BatchIfEqual(ctx, key, prevValue, []string{key}, []string{value})
+}
+
+func (s *MetaStorageImpl) ListTableAffinityGroups(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]uint64, error) {
+	groups := make(map[uint64]uint64)
+	startKey := makeTableAffinityGroupKey(clusterID, schemaID, 0)
+	endKey := makeTableAffinityGroupKey(clusterID, schemaID, math.MaxUint64)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		tableID, err := strconv.ParseUint(path.Base(key), 10, 64)
+		if err != nil {
+			return ErrDecode.WithCausef("decode table id of anti-affinity group, key:%s, err:%v", key, err)
+		}
+		group, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return ErrDecode.WithCausef("decode anti-affinity group, key:%s, err:%v", key, err)
+		}
+		groups[tableID] = group
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func (s *MetaStorageImpl) PutTableAffinityGroup(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, group uint64) error {
+	return s.Put(ctx, makeTableAffinityGroupKey(clusterID, schemaID, tableID), strconv.FormatUint(group, 10))
+}
+
+func (s *MetaStorageImpl) GetTablePlacement(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64) (string, error) {
+	return s.Get(ctx, makeTablePlacementKey(clusterID, schemaID, tableID))
+}
+
+func (s *MetaStorageImpl) PutTablePlacement(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, record string) error {
+	return s.Put(ctx, makeTablePlacementKey(clusterID, schemaID, tableID), record)
+}
+
+func (s *MetaStorageImpl) ListDeletingTables(ctx context.Context, clusterID uint32, schemaID uint32) (map[uint64]string, error) {
+	markers := make(map[uint64]string)
+	startKey := makeTableDeletingKey(clusterID, schemaID, 0)
+	endKey := makeTableDeletingKey(clusterID, schemaID, math.MaxUint64)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		tableID, err := strconv.ParseUint(path.Base(key), 10, 64)
+		if err != nil {
+			return ErrDecode.WithCausef("decode table id of deleting marker, key:%s, err:%v", key, err)
+		}
+		markers[tableID] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return markers, nil
+}
+
+func (s *MetaStorageImpl) PutDeletingTable(ctx context.Context, clusterID uint32, schemaID uint32, tableID uint64, marker string) error {
+	return s.Put(ctx, makeTableDeletingKey(clusterID, schemaID, tableID), marker)
+}
+
+func (s *MetaStorageImpl) PutTableWithDeletingMarker(ctx context.Context, clusterID uint32, table *metapb.Table, marker string) error {
+	value, err := proto.Marshal(table)
+	if err != nil {
+		return ErrEncode.WithCausef("encode table, clusterID:%d, tableID:%d, err:%v", clusterID, table.GetId(), err)
+	}
+	keys := []string{makeTableKey(clusterID, table.GetSchemaId(), table.GetId()), makeTableDeletingKey(clusterID, table.GetSchemaId(), table.GetId())}
+	_, err = s.BatchIfAbsent(ctx, nil, nil, keys, []string{string(value), marker})
+	return err
+}
+
+func (s *MetaStorageImpl) ListTableReservations(ctx context.Context, clusterID uint32, schemaID uint32) (map[string]string, error) {
+	reservations := make(map[string]string)
+	prefix := makeTableReservationPrefix(clusterID, schemaID)
+
+	err := s.rangeScan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), func(key, value string) error {
+		reservations[strings.TrimPrefix(key, prefix)] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+func (s *MetaStorageImpl) PutTableReservation(ctx context.Context, clusterID uint32, schemaID uint32, tableName, reservation string, ttl time.Duration) error {
+	return s.PutWithTTL(ctx, makeTableReservationKey(clusterID, schemaID, tableName), reservation, ttl)
+}
+
+func (s *MetaStorageImpl) DeleteTableReservation(ctx context.Context, clusterID uint32, schemaID uint32, tableName string) error {
+	return s.Delete(ctx, makeTableReservationKey(clusterID, schemaID, tableName))
+}
+
+func (s *MetaStorageImpl) ListTableRouteStats(ctx context.Context, clusterID uint32) (map[uint64]string, error) {
+	stats := make(map[uint64]string)
+	startKey := makeTableRouteStatKey(clusterID, 0)
+	endKey := makeTableRouteStatKey(clusterID, math.MaxUint64)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		tableID, err := strconv.ParseUint(path.Base(key), 10, 64)
+		if err != nil {
+			return ErrDecode.WithCausef("decode table id of route statistics, key:%s, err:%v", key, err)
+		}
+		stats[tableID] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (s *MetaStorageImpl) PutTableRouteStats(ctx context.Context, clusterID uint32, tableIDs []uint64, stats []string) error {
+	if len(tableIDs) != len(stats) {
+		return ErrInvalidArgs.WithCausef("tableIDs and stats mismatch, tableIDs:%d, stats:%d", len(tableIDs), len(stats))
+	}
+
+	for start := 0; start < len(tableIDs); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(tableIDs) {
+			end = len(tableIDs)
+		}
+		keys := make([]string, 0, end-start)
+		for _, tableID := range tableIDs[start:end] {
+			keys = append(keys, makeTableRouteStatKey(clusterID, tableID))
+		}
+		if _, err := s.BatchIfAbsent(ctx, nil, nil, keys, stats[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MetaStorageImpl) DeleteTableRouteStats(ctx context.Context, clusterID uint32) error {
+	return s.Replace(ctx, makeTableRouteStatKey(clusterID, 0), makeTableRouteStatKey(clusterID, math.MaxUint64), nil, nil)
+}
+
+func (s *MetaStorageImpl) GetTableRouteStatsSince(ctx context.Context, clusterID uint32) (string, error) {
+	return s.Get(ctx, makeTableRouteStatsSinceKey(clusterID))
+}
+
+func (s *MetaStorageImpl) PutTableRouteStatsSince(ctx context.Context, clusterID uint32, since string) error {
+	return s.Put(ctx, makeTableRouteStatsSinceKey(clusterID), since)
+}
+
+func (s *MetaStorageImpl) ListShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32) ([]*metapb.ShardTopology, error) {
+	topologies := make([]*metapb.ShardTopology, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		baseKey := makeShardTopologyKey(clusterID, shardID)
+		keys := []string{baseKey, makeShardTopologyDeltaKey(clusterID, shardID)}
+		values, versions, err := s.BatchGet(ctx, keys)
 		if err != nil {
-			if rangeLimit /= 2; rangeLimit >= s.opts.MinScanLimit {
-				continue
-			}
 			return nil, err
 		}
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
+
+		base, topology, err := decodeShardTopology(baseKey, values[0], values[1])
+		if err != nil {
+			return nil, err
 		}
+		s.topologyVersions.observe(keys, versions)
+		if s.topologyDeltas != nil {
+			s.topologyDeltas.observeBase(baseKey, base)
+		}
+		topologies = append(topologies, topology)
+	}
 
-		for _, r := range res {
-			schema := &metapb.Schema{}
-			if err := proto.Unmarshal([]byte(r), schema); err != nil {
-				return nil, ErrMetaGetSchemas.WithCausef("proto parse err:%v", err)
-			}
-			schemas = append(schemas, schema)
-			if schema.GetId() == math.MaxUint32 {
-				log.Warn("list schemas schema_id has reached max value", zap.Uint32("schema-id", schema.GetId()))
-				return schemas, nil
-			}
-			nextID = schema.GetId() + 1
+	return topologies, nil
+}
+
+// encodeShardTopology returns the put of the topology of the shard, which is the delta against its base if the delta
+// encoding is enabled and the change is small, otherwise the base along with the deletion of its delta.
+func (s *MetaStorageImpl) encodeShardTopology(clusterID uint32, shardID uint32, topology *metapb.ShardTopology) (topologyPut, error) {
+	baseKey := makeShardTopologyKey(clusterID, shardID)
+	deltaKey := makeShardTopologyDeltaKey(clusterID, shardID)
+	put := topologyPut{key: baseKey, conds: s.topologyVersions.conditions([]string{baseKey, deltaKey})}
+	if s.topologyDeltas != nil {
+		key, value, err := s.topologyDeltas.encode(baseKey, deltaKey, topology)
+		if err != nil {
+			return topologyPut{}, err
 		}
+		put.key, put.value = key, value
+	} else {
+		value, err := proto.Marshal(topology)
+		if err != nil {
+			return topologyPut{}, ErrEncode.WithCausef("encode shard topology, clusterID:%d, shardID:%d, err:%v", clusterID, shardID, err)
+		}
+		put.value = string(value)
+	}
+	if put.key == baseKey {
+		put.deleteKey = deltaKey
+	}
+	return put, nil
+}
 
-		if len(res) < rangeLimit {
-			return schemas, nil
+// forgetShardTopologies drops the cached bases of the shards whose writes fail, so that they are written as new bases
+// next time.
+func (s *MetaStorageImpl) forgetShardTopologies(clusterID uint32, shardIDs []uint32) {
+	if s.topologyDeltas == nil {
+		return
+	}
+	keys := make([]string, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		keys = append(keys, makeShardTopologyKey(clusterID, shardID))
+	}
+	s.topologyDeltas.forget(keys)
+}
+
+// putShardTopologiesIf writes the topologies along with deleting the deleteKeys and putting the keys in a single
+// transaction if the conds hold and the topologies are not written by others since they are read or written by the
+// storage.
+func (s *MetaStorageImpl) putShardTopologiesIf(ctx context.Context, puts []topologyPut, conds []Condition, deleteKeys, keys, values []string) (bool, error) {
+	for _, put := range puts {
+		conds = append(conds, put.conds...)
+		if put.deleteKey != "" {
+			deleteKeys = append(deleteKeys, put.deleteKey)
 		}
+		keys = append(keys, put.key)
+		values = append(values, put.value)
 	}
+	ok, err := s.BatchIf(ctx, conds, deleteKeys, keys, values)
+	if err != nil || !ok {
+		return false, err
+	}
+	s.topologyVersions.written(puts)
+	return true, nil
 }
 
-func (s *MetaStorageImpl) PutSchemas(ctx context.Context, clusterID uint32, schemas []*metapb.Schema) error {
+// putShardTopologiesOrConflict is the putShardTopologiesIf without the extra conditions, and the
+// ErrShardTopologyConflict is returned if the topologies are written by others.
+func (s *MetaStorageImpl) putShardTopologiesOrConflict(ctx context.Context, clusterID uint32, shardIDs []uint32, puts []topologyPut, deleteKeys, keys, values []string) error {
+	ok, err := s.putShardTopologiesIf(ctx, puts, nil, deleteKeys, keys, values)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrShardTopologyConflict.WithCausef("clusterID:%d, shardIDs:%v", clusterID, shardIDs)
+	}
 	return nil
 }
 
-func (s *MetaStorageImpl) ListTables(ctx context.Context, clusterID uint32, schemaID uint32, tableID []uint64) ([]*metapb.Table, error) {
-	return nil, nil
+func (s *MetaStorageImpl) PutShardTopologies(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology) error {
+	if len(shardIDs) != len(topologies) {
+		return ErrInvalidArgs.WithCausef("shardIDs and topologies mismatch, shardIDs:%d, topologies:%d", len(shardIDs), len(topologies))
+	}
+
+	if s.topologyBatcher != nil {
+		return s.putShardTopologiesBatched(ctx, clusterID, shardIDs, topologies)
+	}
+
+	for i, shardID := range shardIDs {
+		put, err := s.encodeShardTopology(clusterID, shardID, topologies[i])
+		if err != nil {
+			return err
+		}
+		if err := s.putShardTopologiesOrConflict(ctx, clusterID, []uint32{shardID}, []topologyPut{put}, nil, nil, nil); err != nil {
+			s.forgetShardTopologies(clusterID, []uint32{shardID})
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (s *MetaStorageImpl) PutTables(ctx context.Context, clusterID uint32, schemaID uint32, tables []*metapb.Table) error {
+func (s *MetaStorageImpl) putShardTopologiesBatched(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology) error {
+	if len(shardIDs) == 0 {
+		return nil
+	}
+
+	puts := make([]topologyPut, 0, len(shardIDs))
+	for i, shardID := range shardIDs {
+		put, err := s.encodeShardTopology(clusterID, shardID, topologies[i])
+		if err != nil {
+			s.forgetShardTopologies(clusterID, shardIDs[:i])
+			return err
+		}
+		puts = append(puts, put)
+	}
+	if err := s.topologyBatcher.put(ctx, puts); err != nil {
+		s.forgetShardTopologies(clusterID, shardIDs)
+		return err
+	}
+	s.topologyVersions.written(puts)
 	return nil
 }
 
-func (s *MetaStorageImpl) DeleteTables(ctx context.Context, clusterID uint32, schemaID uint32, tableIDs []uint64) error {
+func (s *MetaStorageImpl) PutShardTopologyPlacingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, tables []*metapb.Table) error {
+	put, err := s.encodeShardTopology(clusterID, shardID, topology)
+	if err != nil {
+		return err
+	}
+	deleteKeys := make([]string, 0, len(tables)+1)
+	for _, table := range tables {
+		deleteKeys = append(deleteKeys, makeTableDeletingKey(clusterID, table.GetSchemaId(), table.GetId()))
+	}
+	if err := s.putShardTopologiesOrConflict(ctx, clusterID, []uint32{shardID}, []topologyPut{put}, deleteKeys, nil, nil); err != nil {
+		s.forgetShardTopologies(clusterID, []uint32{shardID})
+		return err
+	}
 	return nil
 }
 
-func (s *MetaStorageImpl) ListShardTopologies(ctx context.Context, clusterID uint32, shardID []uint32) ([]*metapb.ShardTopology, error) {
-	return nil, nil
+func (s *MetaStorageImpl) PutShardTopologyRemovingTables(ctx context.Context, clusterID uint32, shardID uint32, topology *metapb.ShardTopology, schemaID uint32, tableIDs []uint64, marker string) error {
+	put, err := s.encodeShardTopology(clusterID, shardID, topology)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(tableIDs)+1)
+	values := make([]string, 0, len(tableIDs)+1)
+	for _, tableID := range tableIDs {
+		keys = append(keys, makeTableDeletingKey(clusterID, schemaID, tableID))
+		values = append(values, marker)
+	}
+	if err := s.putShardTopologiesOrConflict(ctx, clusterID, []uint32{shardID}, []topologyPut{put}, nil, keys, values); err != nil {
+		s.forgetShardTopologies(clusterID, []uint32{shardID})
+		return err
+	}
+	return nil
 }
 
-func (s *MetaStorageImpl) PutShardTopologies(ctx context.Context, clusterID uint32, shardID []uint32, shardTableInfo []*metapb.ShardTopology) error {
+func (s *MetaStorageImpl) PutTableWithIDEnd(ctx context.Context, clusterID uint32, table *metapb.Table, topology *metapb.ShardTopology, endIDKey string) (bool, error) {
+	if table.GetId() == 0 {
+		return false, ErrInvalidArgs.WithCausef("table id must be positive, table:%s", table.GetName())
+	}
+	tableValue, err := proto.Marshal(table)
+	if err != nil {
+		return false, ErrEncode.WithCausef("encode table, clusterID:%d, tableID:%d, err:%v", clusterID, table.GetId(), err)
+	}
+	put, err := s.encodeShardTopology(clusterID, table.GetShardId(), topology)
+	if err != nil {
+		return false, err
+	}
+
+	prevEndID := ""
+	if table.GetId() > 1 {
+		prevEndID = strconv.FormatUint(table.GetId()-1, 10)
+	}
+	keys := []string{makeTableKey(clusterID, table.GetSchemaId(), table.GetId()), endIDKey}
+	values := []string{string(tableValue), strconv.FormatUint(table.GetId(), 10)}
+	ok, err := s.putShardTopologiesIf(ctx, []topologyPut{put}, []Condition{{Key: endIDKey, Value: prevEndID}}, nil, keys, values)
+	if err != nil || !ok {
+		s.forgetShardTopologies(clusterID, []uint32{table.GetShardId()})
+	}
+	if err != nil || ok {
+		return ok, err
+	}
+	// The transaction fails for either the end id or the topology changed by others.
+	endID, err := s.Get(ctx, endIDKey)
+	if err != nil {
+		return false, err
+	}
+	if endID == prevEndID {
+		return false, ErrShardTopologyConflict.WithCausef("clusterID:%d, shardID:%d", clusterID, table.GetShardId())
+	}
+	return false, nil
+}
+
+func (s *MetaStorageImpl) ListShardOwnerChanges(ctx context.Context, clusterID uint32) (map[uint32]string, error) {
+	changes := make(map[uint32]string)
+	startKey := makeShardOwnerChangeKey(clusterID, 0)
+	endKey := makeShardOwnerChangeKey(clusterID, math.MaxUint32)
+
+	err := s.rangeScan(ctx, startKey, endKey, func(key, value string) error {
+		shardID, err := strconv.ParseUint(path.Base(key), 10, 32)
+		if err != nil {
+			return ErrDecode.WithCausef("decode shard id of ownership change, key:%s, err:%v", key, err)
+		}
+		changes[uint32(shardID)] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (s *MetaStorageImpl) PutShardOwnerChanges(ctx context.Context, clusterID uint32, shardIDs []uint32, changes []string) error {
+	if len(shardIDs) != len(changes) {
+		return ErrInvalidArgs.WithCausef("shardIDs and changes mismatch, shardIDs:%d, changes:%d", len(shardIDs), len(changes))
+	}
+	if len(shardIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(shardIDs))
+	for _, shardID := range shardIDs {
+		keys = append(keys, makeShardOwnerChangeKey(clusterID, shardID))
+	}
+	_, err := s.BatchIfAbsent(ctx, nil, nil, keys, changes)
+	return err
+}
+
+func (s *MetaStorageImpl) PutShardTopologiesWithOwnerChanges(ctx context.Context, clusterID uint32, shardIDs []uint32, topologies []*metapb.ShardTopology, changes []string) error {
+	if len(shardIDs) != len(topologies) || len(shardIDs) != len(changes) {
+		return ErrInvalidArgs.WithCausef("shardIDs, topologies and changes mismatch, shardIDs:%d, topologies:%d, changes:%d",
+			len(shardIDs), len(topologies), len(changes))
+	}
+
+	puts := make([]topologyPut, 0, len(shardIDs))
+	keys := make([]string, 0, len(shardIDs))
+	for i, shardID := range shardIDs {
+		put, err := s.encodeShardTopology(clusterID, shardID, topologies[i])
+		if err != nil {
+			s.forgetShardTopologies(clusterID, shardIDs[:i])
+			return err
+		}
+		puts = append(puts, put)
+		keys = append(keys, makeShardOwnerChangeKey(clusterID, shardID))
+	}
+	if err := s.putShardTopologiesOrConflict(ctx, clusterID, shardIDs, puts, nil, keys, changes); err != nil {
+		s.forgetShardTopologies(clusterID, shardIDs)
+		return err
+	}
 	return nil
 }
 
+func (s *MetaStorageImpl) ListClusterKeyValues(ctx context.Context, clusterID uint32) ([]KeyValue, error) {
+	kvs := make([]KeyValue, 0)
+	metaKey := makeClusterKey(clusterID)
+	value, err := s.Get(ctx, metaKey)
+	if err != nil {
+		return nil, err
+	}
+	if value != "" {
+		kvs = append(kvs, KeyValue{Key: metaKey, Value: []byte(value)})
+	}
+
+	prefix := makeClusterKeyPrefix(clusterID)
+	err = s.rangeScan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), func(key, value string) error {
+		kvs = append(kvs, KeyValue{Key: key, Value: []byte(value)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return kvs, nil
+}
+
+func (s *MetaStorageImpl) ReplaceClusterKeyValues(ctx context.Context, clusterID uint32, kvs []KeyValue) error {
+	metaKey := makeClusterKey(clusterID)
+	prefix := makeClusterKeyPrefix(clusterID)
+	keys := make([]string, 0, len(kvs))
+	values := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		if kv.Key != metaKey && !strings.HasPrefix(kv.Key, prefix) {
+			return ErrInvalidArgs.WithCausef("key:%s does not belong to cluster:%d", kv.Key, clusterID)
+		}
+		keys = append(keys, kv.Key)
+		values = append(values, string(kv.Value))
+	}
+
+	// The topologies are replaced along with their deltas, so the cached bases are stale whether it succeeds or not.
+	if s.topologyDeltas != nil {
+		defer s.topologyDeltas.forgetAll()
+	}
+	defer s.topologyVersions.forgetAll()
+	// The replacement isn't atomic once it is split into batches, so the marker is kept until the last batch is
+	// replaced, and a replacement interrupted midway is never taken as done.
+	restoreKey := makeClusterRestoreKey(clusterID)
+	if err := s.Put(ctx, restoreKey, strconv.Itoa(len(kvs))); err != nil {
+		return err
+	}
+	if err := s.Replace(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), keys, values); err != nil {
+		return err
+	}
+	return s.Delete(ctx, restoreKey)
+}
+
+func (s *MetaStorageImpl) IsClusterPartiallyRestored(ctx context.Context, clusterID uint32) (bool, error) {
+	value, err := s.Get(ctx, makeClusterRestoreKey(clusterID))
+	if err != nil {
+		return false, err
+	}
+	return value != "", nil
+}
+
 func (s *MetaStorageImpl) ListNodes(ctx context.Context, clusterID uint32) ([]*metapb.Node, error) {
 	return nil, nil
 }
@@ -131,3 +894,81 @@ func (s *MetaStorageImpl) ListNodes(ctx context.Context, clusterID uint32) ([]*m
 func (s *MetaStorageImpl) PutNodes(ctx context.Context, clusterID uint32, node []*metapb.Node) error {
 	return nil
 }
+
+func (s *MetaStorageImpl) ListNodeShardCapacities(ctx context.Context, clusterID uint32) (map[string]uint32, error) {
+	capacities := make(map[string]uint32)
+	prefix := makeNodeShardCapacityPrefix(clusterID)
+
+	err := s.rangeScan(ctx, prefix, clientv3.GetPrefixRangeEnd(prefix), func(key, value string) error {
+		capacity, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ErrDecode.WithCausef("decode node shard capacity, key:%s, err:%v", key, err)
+		}
+		capacities[strings.TrimPrefix(key, prefix)] = uint32(capacity)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return capacities, nil
+}
+
+func (s *MetaStorageImpl) PutNodeShardCapacity(ctx context.Context, clusterID uint32, node string, capacity uint32) error {
+	return s.Put(ctx, makeNodeShardCapacityKey(clusterID, node), strconv.FormatUint(uint64(capacity), 10))
+}
+
+func (s *MetaStorageImpl) WatchClusterTopology(ctx context.Context, clusterID uint32, fn func(revision int64)) {
+	prefixes := []string{
+		makeClusterKeyPrefix(clusterID) + schema + delimiter,
+		makeClusterKeyPrefix(clusterID) + table + delimiter,
+		makeClusterKeyPrefix(clusterID) + shard + delimiter,
+		makeClusterKeyPrefix(clusterID) + shardOwner + delimiter,
+	}
+	s.Watch(ctx, makeClusterKeyPrefix(clusterID), func(revision int64, keys []string) {
+		if keys == nil {
+			fn(revision)
+			return
+		}
+		for _, key := range keys {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					fn(revision)
+					return
+				}
+			}
+		}
+	})
+}
+
+// rangeScan scans the keys in the range [startKey, endKey) in batches and calls do on every key-value pair.
+// The batch size is halved until MinScanLimit if the scan fails.
+func (s *MetaStorageImpl) rangeScan(ctx context.Context, startKey, endKey string, do func(key, value string) error) error {
+	rangeLimit := s.opts.MaxScanLimit
+	for {
+		keys, values, err := s.Scan(ctx, startKey, endKey, rangeLimit)
+		if err != nil {
+			if rangeLimit /= 2; rangeLimit >= s.opts.MinScanLimit {
+				continue
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		for i := range keys {
+			if err := do(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(keys) == 0 || len(keys) < rangeLimit {
+			return nil
+		}
+		// Continue from the key right after the last scanned one.
+		startKey = keys[len(keys)-1] + "\x00"
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// topologyWrite is the shard topologies put by a caller, which are always written in the same transaction.
+type topologyWrite struct {
+	ctx  context.Context
+	puts []topologyPut
+	done chan error
+}
+
+// txnSize returns the operations and the comparisons the puts take in a transaction, which are limited separately.
+func txnSize(puts []topologyPut) (int, int) {
+	ops, cmps := 0, 0
+	for _, put := range puts {
+		ops++
+		if put.deleteKey != "" {
+			ops++
+		}
+		cmps += len(put.conds)
+	}
+	return ops, cmps
+}
+
+// topologyBatcher coalesces the shard topologies put within the window into the etcd transactions, so that a burst of
+// the topology writes, e.g. in a failover, doesn't cost a round trip per shard. The topologies of a caller are never
+// split across the transactions, and every topology is written only if its keys are still of the versions the caller
+// expects. A batch putting a shard more than once, or a failed one, is retried by writing the topologies of every
+// caller in its own transaction, so that only the conflicting or failed callers fail.
+type topologyBatcher struct {
+	kv       KV
+	window   time.Duration
+	observer Observer
+
+	// mu protects the pending writes, and a flush is scheduled once the first one arrives.
+	mu      sync.Mutex
+	pending []*topologyWrite
+}
+
+func newTopologyBatcher(kv KV, window time.Duration, observer Observer) *topologyBatcher {
+	return &topologyBatcher{kv: kv, window: window, observer: observerOrNop(observer)}
+}
+
+// put queues the topologies and waits for them to be written.
+func (b *topologyBatcher) put(ctx context.Context, puts []topologyPut) error {
+	// The batch written by another procedure is attributed to the one waiting for it too.
+	defer b.observer.BeginPersist(ctx)()
+
+	w := &topologyWrite{ctx: ctx, puts: puts, done: make(chan error, 1)}
+	// The topologies exceeding the limit of a transaction can't be batched with the others.
+	if ops, cmps := txnSize(puts); ops > maxTxnOps || cmps > maxTxnOps {
+		return b.writeAlone(w)
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, w)
+	if len(b.pending) == 1 {
+		time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return etcdutil.ErrEtcdKVPut.WithCausef("wait for batched shard topologies, err:%v", ctx.Err())
+	}
+}
+
+// flush writes the pending writes in as few transactions as possible.
+func (b *topologyBatcher) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	batch := make([]*topologyWrite, 0, len(pending))
+	ops, cmps := 0, 0
+	for _, w := range pending {
+		wOps, wCmps := txnSize(w.puts)
+		if ops+wOps > maxTxnOps || cmps+wCmps > maxTxnOps {
+			b.writeBatch(batch)
+			batch, ops, cmps = batch[:0:0], 0, 0
+		}
+		batch = append(batch, w)
+		ops += wOps
+		cmps += wCmps
+	}
+	if len(batch) > 0 {
+		b.writeBatch(batch)
+	}
+}
+
+func (b *topologyBatcher) writeBatch(batch []*topologyWrite) {
+	if len(batch) == 1 {
+		batch[0].done <- b.writeAlone(batch[0])
+		return
+	}
+
+	// The etcd refuses to put the same key twice in a transaction, and the writes of a shard expecting the same
+	// versions conflict with each other if they are applied one by one, so they are written alone.
+	written := make(map[string]struct{})
+	puts := make([]topologyPut, 0)
+	for _, w := range batch {
+		for _, put := range w.puts {
+			for _, cond := range put.conds {
+				if _, ok := written[cond.Key]; ok {
+					b.fallback(batch, len(puts), ErrShardTopologyConflict.WithCausef("key put more than once, key:%s", cond.Key))
+					return
+				}
+				written[cond.Key] = struct{}{}
+			}
+		}
+		puts = append(puts, w.puts...)
+	}
+
+	// The batch is bounded by the ctx of its first write, and the others retry alone with their own ctx if it is done.
+	err := b.writePuts(batch[0].ctx, puts)
+	if err == nil {
+		topologyBatchesCounter.WithLabelValues("success").Inc()
+		for _, w := range batch {
+			w.done <- nil
+		}
+		return
+	}
+
+	b.fallback(batch, len(puts), err)
+}
+
+// fallback writes the batch failed for the err one by one.
+func (b *topologyBatcher) fallback(batch []*topologyWrite, shards int, err error) {
+	topologyBatchesCounter.WithLabelValues("fallback").Inc()
+	log.Warn("fail to put batched shard topologies and put them one by one", zap.Int("writes", len(batch)),
+		zap.Int("shards", shards), zap.Error(err))
+	for _, w := range batch {
+		w.done <- b.writeAlone(w)
+	}
+}
+
+// writeAlone puts the topologies of a caller in its own transactions.
+func (b *topologyBatcher) writeAlone(w *topologyWrite) error {
+	start, ops, cmps := 0, 0, 0
+	for i := range w.puts {
+		putOps, putCmps := txnSize(w.puts[i : i+1])
+		if i > start && (ops+putOps > maxTxnOps || cmps+putCmps > maxTxnOps) {
+			if err := b.writePuts(w.ctx, w.puts[start:i]); err != nil {
+				return err
+			}
+			start, ops, cmps = i, 0, 0
+		}
+		ops += putOps
+		cmps += putCmps
+	}
+	if start < len(w.puts) {
+		return b.writePuts(w.ctx, w.puts[start:])
+	}
+	return nil
+}
+
+// writePuts writes the puts in a transaction, and the ErrShardTopologyConflict is returned if any of them is written by
+// others.
+func (b *topologyBatcher) writePuts(ctx context.Context, puts []topologyPut) error {
+	conds := make([]Condition, 0, 2*len(puts))
+	deleteKeys := make([]string, 0, len(puts))
+	keys := make([]string, 0, len(puts))
+	values := make([]string, 0, len(puts))
+	for _, put := range puts {
+		conds = append(conds, put.conds...)
+		if put.deleteKey != "" {
+			deleteKeys = append(deleteKeys, put.deleteKey)
+		}
+		keys = append(keys, put.key)
+		values = append(values, put.value)
+	}
+	ok, err := b.kv.BatchIf(ctx, conds, deleteKeys, keys, values)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrShardTopologyConflict.WithCausef("keys:%v", keys)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// failingBatchKV counts the batches and fails the ones putting the failKey.
+type failingBatchKV struct {
+	KV
+
+	mu      sync.Mutex
+	failKey string
+	batches int
+}
+
+func (kv *failingBatchKV) BatchIf(ctx context.Context, conds []Condition, deleteKeys, keys, values []string) (bool, error) {
+	kv.mu.Lock()
+	kv.batches++
+	for _, key := range keys {
+		if key == kv.failKey {
+			kv.mu.Unlock()
+			return false, fmt.Errorf("inject failure, key:%s", key)
+		}
+	}
+	kv.mu.Unlock()
+	return kv.KV.BatchIf(ctx, conds, deleteKeys, keys, values)
+}
+
+func (kv *failingBatchKV) batchCount() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.batches
+}
+
+func TestPutShardTopologiesBatched(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	kv := &failingBatchKV{KV: newEtcdKV(client, "/topology_batch", RateLimitOptions{}, nil)}
+	s := NewMetaStorageImpl(kv, Options{TopologyBatchWindow: 200 * time.Millisecond})
+	const clusterID = 1
+	putConcurrently := func(writes map[uint32]uint64) map[uint32]error {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		errs := make(map[uint32]error, len(writes))
+		for shardID, version := range writes {
+			wg.Add(1)
+			go func(shardID uint32, version uint64) {
+				defer wg.Done()
+				err := s.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{{Version: version}})
+				mu.Lock()
+				errs[shardID] = err
+				mu.Unlock()
+			}(shardID, version)
+		}
+		wg.Wait()
+		return errs
+	}
+	versions := func(shardIDs []uint32) []uint64 {
+		topologies, err := s.ListShardTopologies(ctx, clusterID, shardIDs)
+		re.NoError(err)
+		versions := make([]uint64, 0, len(topologies))
+		for _, topology := range topologies {
+			versions = append(versions, topology.GetVersion())
+		}
+		return versions
+	}
+
+	// The concurrent writes are coalesced into a single transaction.
+	errs := putConcurrently(map[uint32]uint64{0: 1, 1: 1, 2: 1, 3: 1})
+	for _, err := range errs {
+		re.NoError(err)
+	}
+	re.Equal(1, kv.batchCount())
+	re.Equal([]uint64{1, 1, 1, 1}, versions([]uint32{0, 1, 2, 3}))
+
+	// The writes of a shard in a batch expect the same stored topology, so only one of them is written.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	written := make([]uint64, 0)
+	for _, version := range []uint64{5, 3} {
+		wg.Add(1)
+		go func(version uint64) {
+			defer wg.Done()
+			err := s.PutShardTopologies(ctx, clusterID, []uint32{0}, []*metapb.ShardTopology{{Version: version}})
+			if err != nil {
+				re.True(coderr.Is(err, coderr.Conflict), "err:%v", err)
+				return
+			}
+			mu.Lock()
+			written = append(written, version)
+			mu.Unlock()
+		}(version)
+	}
+	wg.Wait()
+	re.Len(written, 1)
+	re.Equal(written, versions([]uint32{0}))
+
+	// The failed batch is retried by the writes one by one, and only the failed shard keeps its previous version.
+	kv.failKey = makeShardTopologyKey(clusterID, 2)
+	batches := kv.batchCount()
+	errs = putConcurrently(map[uint32]uint64{1: 2, 2: 2, 3: 2})
+	re.NoError(errs[1])
+	re.Error(errs[2])
+	re.NoError(errs[3])
+	re.Equal(batches+4, kv.batchCount())
+	re.Equal([]uint64{written[0], 2, 1, 2}, versions([]uint32{0, 1, 2, 3}))
+	kv.failKey = ""
+
+	// The writes exceeding the limit of a transaction are not batched, and every shard takes two comparisons, of its base
+	// and its delta, so a transaction holds half as many shards as the limit.
+	shardIDs := make([]uint32, 0, 2*maxTxnOps+1)
+	topologies := make([]*metapb.ShardTopology, 0, 2*maxTxnOps+1)
+	for shardID := uint32(0); shardID < 2*maxTxnOps+1; shardID++ {
+		shardIDs = append(shardIDs, shardID)
+		topologies = append(topologies, &metapb.ShardTopology{Version: 10})
+	}
+	batches = kv.batchCount()
+	re.NoError(s.PutShardTopologies(ctx, clusterID, shardIDs, topologies))
+	re.Equal(batches+5, kv.batchCount())
+	for _, version := range versions(shardIDs) {
+		re.Equal(uint64(10), version)
+	}
+}
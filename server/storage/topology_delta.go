@@ -0,0 +1,198 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"google.golang.org/protobuf/proto"
+)
+
+// TopologyDeltaOptions makes the small changes of the large shard topologies written as the deltas against their base
+// topologies instead of the whole topologies.
+type TopologyDeltaOptions struct {
+	// MinTables is the number of the tables a shard topology should hold to be written as a delta, and zero disables
+	// the delta encoding.
+	MinTables int
+	// MaxChanges is the number of the tables added or removed since the base beyond which the topology is written as a
+	// new base, which compacts the delta.
+	MaxChanges int
+}
+
+// topologyDelta is the shard topology encoded as the changes against its base topology of the BaseVersion. The
+// topology is the tables of the base without the Removed ones followed by the Added ones, so the delta is only valid
+// along with the base of the BaseVersion. The delta is only written if the base is still the one it is made against,
+// and it is deleted along with the base written again.
+type topologyDelta struct {
+	BaseVersion uint64   `json:"base_version"`
+	Version     uint64   `json:"version"`
+	Added       []uint64 `json:"added,omitempty"`
+	Removed     []uint64 `json:"removed,omitempty"`
+}
+
+// topologyDeltaEncoder decides whether a shard topology is written as a delta or a new base. The base topologies are
+// cached by their keys when they are read or written, and a topology whose base is not cached is always written as a
+// new base. So the writes of a shard must be serialized, which is guaranteed by the lock of its cluster.
+type topologyDeltaEncoder struct {
+	opts TopologyDeltaOptions
+
+	mu    sync.Mutex
+	bases map[string]*metapb.ShardTopology
+}
+
+func newTopologyDeltaEncoder(opts TopologyDeltaOptions) *topologyDeltaEncoder {
+	return &topologyDeltaEncoder{opts: opts, bases: make(map[string]*metapb.ShardTopology)}
+}
+
+// encode returns the key and the value to write the topology of the shard, which is either the base key or the delta
+// key. The written base is cached at once, and it should be forgotten if the write fails.
+func (e *topologyDeltaEncoder) encode(baseKey, deltaKey string, topology *metapb.ShardTopology) (string, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if base, ok := e.bases[baseKey]; ok && e.opts.MinTables > 0 && len(topology.GetTableIds()) >= e.opts.MinTables {
+		if delta, ok := diffShardTopology(base, topology, e.opts.MaxChanges); ok {
+			value, err := json.Marshal(delta)
+			if err != nil {
+				return "", "", ErrEncode.WithCausef("encode shard topology delta, key:%s, err:%v", deltaKey, err)
+			}
+			topologyWritesCounter.WithLabelValues("delta").Inc()
+			return deltaKey, string(value), nil
+		}
+	}
+
+	value, err := proto.Marshal(topology)
+	if err != nil {
+		return "", "", ErrEncode.WithCausef("encode shard topology, key:%s, err:%v", baseKey, err)
+	}
+	e.bases[baseKey] = topology
+	topologyWritesCounter.WithLabelValues("base").Inc()
+	return baseKey, string(value), nil
+}
+
+// observeBase caches the base topology read or written by the other paths.
+func (e *topologyDeltaEncoder) observeBase(baseKey string, base *metapb.ShardTopology) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if base == nil {
+		delete(e.bases, baseKey)
+		return
+	}
+	e.bases[baseKey] = base
+}
+
+// forget drops the cached bases of the keys, whose writes may or may not be applied, so the next writes of them are
+// new bases.
+func (e *topologyDeltaEncoder) forget(baseKeys []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, key := range baseKeys {
+		delete(e.bases, key)
+	}
+}
+
+func (e *topologyDeltaEncoder) forgetAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.bases = make(map[string]*metapb.ShardTopology)
+}
+
+// diffShardTopology returns the delta of the topology against the base, and false is returned if the topology isn't
+// newer than the base, has more changes than the maxChanges, or can't be rebuilt from the base in the same order. The
+// delta only carries the tables, so the topology whose unknown fields differ from the base's is never a delta.
+func diffShardTopology(base, topology *metapb.ShardTopology, maxChanges int) (*topologyDelta, bool) {
+	if topology.GetVersion() <= base.GetVersion() {
+		return nil, false
+	}
+	if !bytes.Equal(base.ProtoReflect().GetUnknown(), topology.ProtoReflect().GetUnknown()) {
+		return nil, false
+	}
+
+	baseIDs := make(map[uint64]struct{}, len(base.GetTableIds()))
+	for _, id := range base.GetTableIds() {
+		baseIDs[id] = struct{}{}
+	}
+	ids := make(map[uint64]struct{}, len(topology.GetTableIds()))
+	delta := &topologyDelta{BaseVersion: base.GetVersion(), Version: topology.GetVersion()}
+	for _, id := range topology.GetTableIds() {
+		ids[id] = struct{}{}
+		if _, ok := baseIDs[id]; !ok {
+			delta.Added = append(delta.Added, id)
+		}
+	}
+	for _, id := range base.GetTableIds() {
+		if _, ok := ids[id]; !ok {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	if len(delta.Added)+len(delta.Removed) > maxChanges {
+		return nil, false
+	}
+
+	rebuilt := delta.apply(base)
+	if len(rebuilt.GetTableIds()) != len(topology.GetTableIds()) {
+		return nil, false
+	}
+	for i, id := range topology.GetTableIds() {
+		if rebuilt.GetTableIds()[i] != id {
+			return nil, false
+		}
+	}
+	return delta, true
+}
+
+// apply rebuilds the topology from the base, and the unknown fields of the base are kept.
+func (d *topologyDelta) apply(base *metapb.ShardTopology) *metapb.ShardTopology {
+	removed := make(map[uint64]struct{}, len(d.Removed))
+	for _, id := range d.Removed {
+		removed[id] = struct{}{}
+	}
+	tableIDs := make([]uint64, 0, len(base.GetTableIds())+len(d.Added)-len(d.Removed))
+	for _, id := range base.GetTableIds() {
+		if _, ok := removed[id]; !ok {
+			tableIDs = append(tableIDs, id)
+		}
+	}
+	tableIDs = append(tableIDs, d.Added...)
+	topology := &metapb.ShardTopology{TableIds: tableIDs, Version: d.Version}
+	if unknown := base.ProtoReflect().GetUnknown(); len(unknown) > 0 {
+		topology.ProtoReflect().SetUnknown(unknown)
+	}
+	return topology
+}
+
+// decodeShardTopology decodes the base topology of the baseKey and applies the delta, and both the base and the topology
+// are returned, which are nil if the base is absent. The delta not newer than the base is ignored, and the delta newer
+// than a base it isn't made against means the topology is lost, which is an error.
+func decodeShardTopology(baseKey, baseValue, deltaValue string) (*metapb.ShardTopology, *metapb.ShardTopology, error) {
+	if baseValue == "" {
+		return nil, nil, nil
+	}
+	base := &metapb.ShardTopology{}
+	if err := proto.Unmarshal([]byte(baseValue), base); err != nil {
+		return nil, nil, ErrDecode.WithCausef("decode shard topology, key:%s, err:%v", baseKey, err)
+	}
+	if deltaValue == "" {
+		return base, base, nil
+	}
+
+	delta := &topologyDelta{}
+	if err := json.Unmarshal([]byte(deltaValue), delta); err != nil {
+		return nil, nil, ErrDecode.WithCausef("decode shard topology delta, key:%s, err:%v", baseKey, err)
+	}
+	// The delta left by the base written before the base deletes its delta is superseded by the base.
+	if delta.Version <= base.GetVersion() {
+		return base, base, nil
+	}
+	if delta.BaseVersion != base.GetVersion() {
+		return nil, nil, ErrDecode.WithCausef("decode shard topology delta against another base, key:%s, baseVersion:%d, deltaBaseVersion:%d",
+			baseKey, base.GetVersion(), delta.BaseVersion)
+	}
+	return base, delta.apply(base), nil
+}
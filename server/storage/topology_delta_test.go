@@ -0,0 +1,179 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// failingPutKV fails the batches putting the failKey.
+type failingPutKV struct {
+	KV
+
+	failKey string
+}
+
+func (kv *failingPutKV) BatchIf(ctx context.Context, conds []Condition, deleteKeys, keys, values []string) (bool, error) {
+	for _, key := range keys {
+		if key == kv.failKey {
+			return false, fmt.Errorf("inject failure, key:%s", key)
+		}
+	}
+	return kv.KV.BatchIf(ctx, conds, deleteKeys, keys, values)
+}
+
+func TestShardTopologyDelta(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	kv := &failingPutKV{KV: newEtcdKV(client, "/topology_delta", RateLimitOptions{}, nil)}
+	opts := Options{TopologyDelta: TopologyDeltaOptions{MinTables: 4, MaxChanges: 3}}
+	s := NewMetaStorageImpl(kv, opts)
+	const (
+		clusterID = 1
+		shardID   = 0
+	)
+	baseKey := makeShardTopologyKey(clusterID, shardID)
+	deltaKey := makeShardTopologyDeltaKey(clusterID, shardID)
+
+	// put puts the topology, and checks it is read back along with the version of the base it is written against.
+	put := func(s *MetaStorageImpl, version uint64, tableIDs []uint64, baseVersion uint64) {
+		topology := &metapb.ShardTopology{TableIds: tableIDs, Version: version}
+		re.NoError(s.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{topology}))
+		topologies, err := s.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+		re.NoError(err)
+		re.True(proto.Equal(topology, topologies[0]), "expect:%v, got:%v", topology, topologies[0])
+
+		value, err := kv.Get(ctx, baseKey)
+		re.NoError(err)
+		base := &metapb.ShardTopology{}
+		re.NoError(proto.Unmarshal([]byte(value), base))
+		re.Equal(baseVersion, base.GetVersion())
+	}
+
+	// The first topology is written as a base, and the small changes are written as the deltas.
+	put(s, 1, []uint64{1, 2, 3, 4, 5}, 1)
+	put(s, 2, []uint64{1, 2, 3, 4, 5, 6}, 1)
+	put(s, 3, []uint64{1, 2, 4, 5, 6}, 1)
+	delta, err := kv.Get(ctx, deltaKey)
+	re.NoError(err)
+	re.JSONEq(`{"base_version":1,"version":3,"added":[6],"removed":[3]}`, delta)
+
+	// The deltas are applied by the reads even if the delta encoding is disabled.
+	plain := NewMetaStorageImpl(kv, Options{})
+	topologies, err := plain.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+	re.NoError(err)
+	re.Equal([]uint64{1, 2, 4, 5, 6}, topologies[0].GetTableIds())
+
+	// Too many changes since the base compact the delta into a new base, which deletes the delta.
+	put(s, 4, []uint64{1, 2, 4, 5, 6, 7, 8}, 4)
+	delta, err = kv.Get(ctx, deltaKey)
+	re.NoError(err)
+	re.Empty(delta)
+	put(s, 5, []uint64{1, 2, 4, 5, 6, 7, 8, 9}, 4)
+
+	// The topology which can't be rebuilt in the same order or is too small is written as a base.
+	put(s, 6, []uint64{9, 1, 2, 4, 5, 6, 7, 8}, 6)
+	put(s, 7, []uint64{9, 1, 2}, 7)
+
+	// The topology is unknown to a new storage until it is read, e.g. after the leader changes, so its write is
+	// rejected.
+	fresh := NewMetaStorageImpl(kv, opts)
+	topology := &metapb.ShardTopology{TableIds: []uint64{9, 1, 2, 3}, Version: 8}
+	err = fresh.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{topology})
+	re.True(coderr.Is(err, coderr.Conflict), "err:%v", err)
+	_, err = fresh.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+	re.NoError(err)
+	put(fresh, 8, []uint64{9, 1, 2, 3}, 7)
+	put(fresh, 9, []uint64{9, 1, 2, 3, 4}, 7)
+
+	// The failed write makes the next one a base, which may have been applied or not.
+	kv.failKey = deltaKey
+	topology = &metapb.ShardTopology{TableIds: []uint64{9, 1, 2, 3, 4, 5}, Version: 10}
+	re.Error(fresh.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{topology}))
+	kv.failKey = ""
+	put(fresh, 11, []uint64{9, 1, 2, 3, 4, 5, 6}, 11)
+
+	// The delta newer than the base it isn't made against is an error instead of the topology silently lost.
+	re.NoError(kv.Put(ctx, deltaKey, `{"base_version":10,"version":12,"added":[7]}`))
+	_, err = fresh.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+	re.ErrorContains(err, "against another base")
+}
+
+func TestShardTopologyUnknownFields(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	kv := newEtcdKV(client, "/topology_unknown_fields", RateLimitOptions{}, nil)
+	s := NewMetaStorageImpl(kv, Options{TopologyDelta: TopologyDeltaOptions{MinTables: 1, MaxChanges: 3}})
+	const (
+		clusterID = 1
+		shardID   = 0
+	)
+	baseKey := makeShardTopologyKey(clusterID, shardID)
+
+	// The topology written by a newer version carries a field unknown to this version.
+	future := protowire.AppendTag(nil, 1000, protowire.BytesType)
+	future = protowire.AppendString(future, "future")
+	value, err := proto.Marshal(&metapb.ShardTopology{TableIds: []uint64{1}, Version: 1})
+	re.NoError(err)
+	re.NoError(kv.Put(ctx, baseKey, string(append(value, future...))))
+
+	read := func() *metapb.ShardTopology {
+		topologies, err := s.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+		re.NoError(err)
+		return topologies[0]
+	}
+	topology := read()
+	re.Equal([]uint64{1}, topology.GetTableIds())
+	re.Equal(future, []byte(topology.ProtoReflect().GetUnknown()))
+
+	// The rewrite carrying the unknown field is written as a delta, and the field is kept along with the base.
+	rewritten := &metapb.ShardTopology{TableIds: []uint64{1, 2}, Version: 2}
+	rewritten.ProtoReflect().SetUnknown(topology.ProtoReflect().GetUnknown())
+	re.NoError(s.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{rewritten}))
+	topology = read()
+	re.True(proto.Equal(rewritten, topology))
+	re.Equal(future, []byte(topology.ProtoReflect().GetUnknown()))
+
+	// The topology whose unknown fields differ from the base is written as a new base, which the newer version reads
+	// back with its field.
+	rewritten = &metapb.ShardTopology{TableIds: []uint64{1, 2, 3}, Version: 3}
+	rewritten.ProtoReflect().SetUnknown(append(future, future...))
+	re.NoError(s.PutShardTopologies(ctx, clusterID, []uint32{shardID}, []*metapb.ShardTopology{rewritten}))
+	stored, err := kv.Get(ctx, baseKey)
+	re.NoError(err)
+	re.True(bytes.HasSuffix([]byte(stored), append(future, future...)))
+	re.True(proto.Equal(rewritten, read()))
+}
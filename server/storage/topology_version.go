@@ -0,0 +1,75 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import "sync"
+
+// topologyVersions tracks the versions of the shard topology keys last read or written by the storage, and the writes
+// of the topologies are conditional on them, so that a topology built from a stale cache, e.g. by a former leader or
+// a follower, is never written over the newer one. A key not tracked is expected to be absent.
+type topologyVersions struct {
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func newTopologyVersions() *topologyVersions {
+	return &topologyVersions{versions: make(map[string]int64)}
+}
+
+// conditions returns the conditions that the keys are still of the tracked versions.
+func (v *topologyVersions) conditions(keys []string) []Condition {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	conds := make([]Condition, 0, len(keys))
+	for _, key := range keys {
+		conds = append(conds, Condition{Key: key, Version: v.versions[key]})
+	}
+	return conds
+}
+
+// observe tracks the versions of the keys read.
+func (v *topologyVersions) observe(keys []string, versions []int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i, key := range keys {
+		v.versions[key] = versions[i]
+	}
+}
+
+// topologyPut is the write of the topology of a shard, which is either its delta, or its base along with the deletion of
+// its delta.
+type topologyPut struct {
+	key   string
+	value string
+	// deleteKey is the delta deleted along with the base, and it is empty if the delta itself is put.
+	deleteKey string
+	// conds hold the versions of both the base and the delta, so that the delta is only written against the base it is
+	// encoded against, and the base never drops the delta written by others.
+	conds []Condition
+}
+
+// written tracks the puts written under their conds.
+func (v *topologyVersions) written(puts []topologyPut) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, put := range puts {
+		for _, cond := range put.conds {
+			switch cond.Key {
+			case put.key:
+				v.versions[cond.Key] = cond.Version + 1
+			case put.deleteKey:
+				v.versions[cond.Key] = 0
+			}
+		}
+	}
+}
+
+func (v *topologyVersions) forgetAll() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.versions = make(map[string]int64)
+}
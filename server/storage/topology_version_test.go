@@ -0,0 +1,73 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/CeresDB/ceresdbproto/pkg/metapb"
+	"github.com/CeresDB/ceresmeta/pkg/coderr"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func TestShardTopologyConflict(t *testing.T) {
+	re := require.New(t)
+	cfg := newTestSingleConfig(t)
+	etcd, err := embed.StartEtcd(cfg)
+	re.NoError(err)
+	defer etcd.Close()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: []string{cfg.LCUrls[0].String()},
+	})
+	re.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	kv := newEtcdKV(client, "/topology_version", RateLimitOptions{}, nil)
+	const (
+		clusterID = 1
+		shardID   = 0
+	)
+	put := func(s *MetaStorageImpl, version uint64) error {
+		topology := &metapb.ShardTopology{TableIds: []uint64{version}, Version: version}
+		return s.PutShardTopologyPlacingTables(ctx, clusterID, shardID, topology, nil)
+	}
+	read := func(s *MetaStorageImpl) *metapb.ShardTopology {
+		topologies, err := s.ListShardTopologies(ctx, clusterID, []uint32{shardID})
+		re.NoError(err)
+		return topologies[0]
+	}
+
+	// Both the leader and the former one read the topology, and the leader writes a newer one.
+	leader := NewMetaStorageImpl(kv, Options{})
+	former := NewMetaStorageImpl(kv, Options{})
+	re.NoError(put(leader, 1))
+	read(leader)
+	read(former)
+	re.NoError(put(leader, 2))
+
+	// The topology written by the former leader from its stale cache is rejected until it reads the topology again.
+	err = put(former, 3)
+	re.True(coderr.Is(err, coderr.Conflict), "err:%v", err)
+	re.Equal(uint64(2), read(leader).GetVersion())
+	read(former)
+	re.NoError(put(former, 3))
+	re.Equal(uint64(3), read(leader).GetVersion())
+
+	// The gap-free creation tells the conflict of the topology from the one of the end id.
+	re.NoError(put(former, 4))
+	endIDKey := "topology_version_end_id"
+	table := &metapb.Table{Id: 1, Name: "table", ShardId: shardID}
+	ok, err := leader.PutTableWithIDEnd(ctx, clusterID, table, &metapb.ShardTopology{TableIds: []uint64{1}, Version: 5}, endIDKey)
+	re.False(ok)
+	re.True(coderr.Is(err, coderr.Conflict), "err:%v", err)
+	read(leader)
+	re.NoError(kv.Put(ctx, endIDKey, "1"))
+	ok, err = leader.PutTableWithIDEnd(ctx, clusterID, table, &metapb.ShardTopology{TableIds: []uint64{1}, Version: 5}, endIDKey)
+	re.NoError(err)
+	re.False(ok)
+}
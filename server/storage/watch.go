@@ -0,0 +1,66 @@
+// Copyright 2022 CeresDB Project Authors. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/CeresDB/ceresmeta/pkg/log"
+	"github.com/CeresDB/ceresmeta/server/etcdutil"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const watchRetryInterval = time.Second
+
+// WatchFunc is called with the revision and the keys of the changes, and the keys are nil if the watch (re)starts, in
+// which case the changes before the revision may have been missed.
+type WatchFunc func(revision int64, keys []string)
+
+// Watch calls the fn with every change of the keys with the prefix until the ctx is done. The watch restarts from the
+// current revision if it fails.
+func (kv *etcdKV) Watch(ctx context.Context, prefix string, fn WatchFunc) {
+	prefix = path.Join(kv.rootPath, prefix) + delimiter
+	for ctx.Err() == nil {
+		kv.watchOnce(ctx, prefix, fn)
+
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (kv *etcdKV) watchOnce(ctx context.Context, prefix string, fn WatchFunc) {
+	var resp *clientv3.GetResponse
+	err := doWithReauth(func() (err error) {
+		resp, err = kv.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		return err
+	})
+	if err != nil {
+		log.Warn("fail to get revision to watch", zap.String("prefix", prefix), zap.Error(etcdutil.ErrEtcdKVGet.WithCause(err)))
+		return
+	}
+	revision := resp.Header.Revision
+	fn(revision, nil)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for resp := range kv.client.Watch(watchCtx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+		if err := resp.Err(); err != nil {
+			log.Warn("watch fails and restart it", zap.String("prefix", prefix), zap.Error(err))
+			return
+		}
+		if len(resp.Events) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(resp.Events))
+		for _, event := range resp.Events {
+			keys = append(keys, strings.TrimPrefix(strings.TrimPrefix(string(event.Kv.Key), kv.rootPath), delimiter))
+		}
+		fn(resp.Header.Revision, keys)
+	}
+}